@@ -0,0 +1,317 @@
+// Command goleveldb administers a DB.
+//
+// Usage:
+//
+//	goleveldb [flags] <path> <command> [args]
+//
+// The commands are:
+//
+//	get <key>                 print value of the key
+//	put <key> <value>         set value of the key
+//	delete <key>              delete the key
+//	scan [flags]              print keys and values in order
+//	stats                     print the DB statistics
+//	compact [flags]           compact the underlying storage
+//	repair                    recover the DB from its tables, corrupted
+//	                          tables are moved to <path>/lost
+//	dump-manifest [-json]     print records of the manifest
+//	verify-checksums          read every table verifying block checksums
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/FactomProject/goleveldb/leveldb"
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/table"
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+var hexMode = false
+
+func init() {
+	flag.BoolVar(&hexMode, "hex", hexMode, "keys and values are hex-encoded, both input and output")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] <path> <command> [args]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "commands: get, put, delete, scan, stats, compact, repair, dump-manifest, verify-checksums\n\n")
+		flag.PrintDefaults()
+	}
+}
+
+type command struct {
+	// Number of the positional arguments.
+	nargs int
+	// Whether the command modifies the DB.
+	write bool
+	run   func(db *leveldb.DB, fs *flag.FlagSet) error
+}
+
+var commands = map[string]*command{
+	"get":     {nargs: 1, run: get},
+	"put":     {nargs: 2, write: true, run: put},
+	"delete":  {nargs: 1, write: true, run: del},
+	"scan":    {run: scan},
+	"stats":   {run: stats},
+	"compact": {write: true, run: compact},
+}
+
+func decode(s string) ([]byte, error) {
+	if hexMode {
+		return hex.DecodeString(s)
+	}
+	return []byte(s), nil
+}
+
+func encode(b []byte) string {
+	if hexMode {
+		return hex.EncodeToString(b)
+	}
+	return string(b)
+}
+
+func get(db *leveldb.DB, fs *flag.FlagSet) error {
+	key, err := decode(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	value, err := db.Get(key, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encode(value))
+	return nil
+}
+
+func put(db *leveldb.DB, fs *flag.FlagSet) error {
+	key, err := decode(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	value, err := decode(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	return db.Put(key, value, nil)
+}
+
+func del(db *leveldb.DB, fs *flag.FlagSet) error {
+	key, err := decode(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return db.Delete(key, nil)
+}
+
+// Flags of scan and compact.
+var (
+	rangeStart  string
+	rangeLimit  string
+	rangePrefix string
+	scanMax     int
+	scanNoValue bool
+)
+
+func rangeFlags(fs *flag.FlagSet) {
+	fs.StringVar(&rangeStart, "start", "", "start of the key range, inclusive")
+	fs.StringVar(&rangeLimit, "limit", "", "limit of the key range, exclusive")
+	fs.StringVar(&rangePrefix, "prefix", "", "key prefix, overrides start and limit")
+}
+
+func keyRange() (*util.Range, error) {
+	if rangePrefix != "" {
+		prefix, err := decode(rangePrefix)
+		if err != nil {
+			return nil, err
+		}
+		return util.BytesPrefix(prefix), nil
+	}
+	r := &util.Range{}
+	var err error
+	if rangeStart != "" {
+		if r.Start, err = decode(rangeStart); err != nil {
+			return nil, err
+		}
+	}
+	if rangeLimit != "" {
+		if r.Limit, err = decode(rangeLimit); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func scan(db *leveldb.DB, fs *flag.FlagSet) error {
+	r, err := keyRange()
+	if err != nil {
+		return err
+	}
+	iter := db.NewIterator(r, nil)
+	defer iter.Release()
+	for n := 0; iter.Next() && (scanMax <= 0 || n < scanMax); n++ {
+		if scanNoValue {
+			fmt.Println(encode(iter.Key()))
+		} else {
+			fmt.Printf("%s\t%s\n", encode(iter.Key()), encode(iter.Value()))
+		}
+	}
+	return iter.Error()
+}
+
+func stats(db *leveldb.DB, fs *flag.FlagSet) error {
+	for _, name := range []string{"leveldb.stats", "leveldb.sstables", "leveldb.writestall"} {
+		value, err := db.GetProperty(name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s:\n%s\n", name, value)
+	}
+	return nil
+}
+
+func compact(db *leveldb.DB, fs *flag.FlagSet) error {
+	r, err := keyRange()
+	if err != nil {
+		return err
+	}
+	return db.CompactRange(*r)
+}
+
+func repair(path string) error {
+	return leveldb.Repair(path, nil)
+}
+
+var manifestJSON bool
+
+func dumpManifest(path string) error {
+	stor, err := storage.OpenFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer stor.Close()
+	if manifestJSON {
+		return leveldb.DumpManifestJSON(stor, os.Stdout)
+	}
+	return leveldb.DumpManifest(stor, os.Stdout)
+}
+
+func verifyTable(stor storage.Storage, fd storage.FileDesc) (entries int, err error) {
+	r, err := stor.Open(fd)
+	if err != nil {
+		return 0, err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		r.Close()
+		return 0, err
+	}
+	o := &opt.Options{
+		Strict: opt.StrictBlockChecksum | opt.StrictReader,
+	}
+	tr, err := table.NewReader(r, size, fd, nil, nil, o)
+	if err != nil {
+		r.Close()
+		return 0, err
+	}
+	defer tr.Release()
+	iter := tr.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if _, err := table.ParseInternalKey(iter.Key()); err != nil {
+			return entries, err
+		}
+		entries++
+	}
+	return entries, iter.Error()
+}
+
+func verifyChecksums(path string) error {
+	stor, err := storage.OpenFile(path, true)
+	if err != nil {
+		return err
+	}
+	defer stor.Close()
+	fds, err := stor.List(storage.TypeTable)
+	if err != nil {
+		return err
+	}
+	var corrupted int
+	for _, fd := range fds {
+		entries, err := verifyTable(stor, fd)
+		if err != nil {
+			if !errors.IsCorrupted(err) {
+				return err
+			}
+			corrupted++
+			fmt.Printf("%s: %v\n", fd, err)
+			continue
+		}
+		fmt.Printf("%s: ok, %d entries\n", fd, entries)
+	}
+	if corrupted > 0 {
+		return fmt.Errorf("%d of %d tables corrupted", corrupted, len(fds))
+	}
+	return nil
+}
+
+func run(path, name string, args []string) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	switch name {
+	case "scan":
+		rangeFlags(fs)
+		fs.IntVar(&scanMax, "n", 0, "maximum number of entries to print, zero means no limit")
+		fs.BoolVar(&scanNoValue, "keys", false, "only print the keys")
+	case "compact":
+		rangeFlags(fs)
+	case "dump-manifest":
+		fs.BoolVar(&manifestJSON, "json", false, "print the records as JSON objects, one per line")
+	}
+	fs.Parse(args)
+
+	switch name {
+	case "repair":
+		return repair(path)
+	case "dump-manifest":
+		return dumpManifest(path)
+	case "verify-checksums":
+		return verifyChecksums(path)
+	}
+
+	cmd := commands[name]
+	if cmd == nil {
+		return fmt.Errorf("unknown command %q", name)
+	}
+	if fs.NArg() != cmd.nargs {
+		return fmt.Errorf("%s: want %d arguments, got %d", name, cmd.nargs, fs.NArg())
+	}
+	db, err := leveldb.OpenFile(path, &opt.Options{
+		ErrorIfMissing: true,
+		ReadOnly:       !cmd.write,
+	})
+	if err != nil {
+		return err
+	}
+	err = cmd.run(db, fs)
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := run(flag.Arg(0), flag.Arg(1), flag.Args()[2:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
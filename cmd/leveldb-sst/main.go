@@ -0,0 +1,120 @@
+// Command leveldb-sst prints the contents of table files.
+//
+// Usage:
+//
+//	leveldb-sst [flags] file...
+//
+// Each entry is printed as the user key, sequence number and key type of
+// its internal key, optionally followed by the value.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/table"
+)
+
+var (
+	infoOnly   = false
+	showValues = false
+	hexOutput  = false
+	strict     = true
+)
+
+func init() {
+	flag.BoolVar(&infoOnly, "info", infoOnly, "only print the table description")
+	flag.BoolVar(&showValues, "values", showValues, "print the values")
+	flag.BoolVar(&hexOutput, "hex", hexOutput, "print keys and values in hex")
+	flag.BoolVar(&strict, "strict", strict, "stop at corrupted block, otherwise corrupted blocks are skipped")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [flags] file...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func format(b []byte) string {
+	if hexOutput {
+		return fmt.Sprintf("%x", b)
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+func formatKey(ikey []byte) string {
+	ik, err := table.ParseInternalKey(ikey)
+	if err != nil {
+		return fmt.Sprintf("%s <corrupted: %v>", format(ikey), err)
+	}
+	return fmt.Sprintf("%s @%d %v", format(ik.UserKey), ik.Seq, ik.Type)
+}
+
+func dump(path string) error {
+	o := &opt.Options{
+		Strict: opt.NoStrict,
+	}
+	if strict {
+		o.Strict = opt.StrictBlockChecksum | opt.StrictReader
+	}
+	f, err := table.OpenFile(path, o)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Info()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: size=%d blocks=%d metaindex=%q\n", path, info.Size, info.DataBlocks, info.MetaIndex)
+	if p := info.Properties; p != nil {
+		fmt.Printf("  entries=%d rawkeys=%d rawvalues=%d data=%d ratio=%.2f created=%v\n",
+			p.NumEntries, p.RawKeySize, p.RawValueSize, p.DataSize, p.CompressionRatio(), p.CreationTime)
+		if p.NumEntries > 0 {
+			fmt.Printf("  min=%s max=%s\n", formatKey(p.MinKey), formatKey(p.MaxKey))
+		}
+		names := make([]string, 0, len(p.User))
+		for name := range p.User {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s=%s\n", name, format(p.User[name]))
+		}
+	}
+	if infoOnly {
+		return nil
+	}
+
+	iter := f.NewIterator(nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		if showValues {
+			fmt.Printf("%s %s\n", formatKey(iter.Key()), format(iter.Value()))
+		} else {
+			fmt.Println(formatKey(iter.Key()))
+		}
+	}
+	return iter.Error()
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, path := range flag.Args() {
+		if err := dump(path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
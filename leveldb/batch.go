@@ -12,8 +12,9 @@ import (
 	"io"
 
 	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/journal"
 	"github.com/FactomProject/goleveldb/leveldb/memdb"
-	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
 // ErrBatchCorrupted records reason of batch corruption. This error will be
@@ -27,13 +28,28 @@ func (e *ErrBatchCorrupted) Error() string {
 }
 
 func newErrBatchCorrupted(reason string) error {
-	return errors.NewErrCorrupted(storage.FileDesc{}, &ErrBatchCorrupted{reason})
+	return &errors.ErrCorrupted{Reason: reason, Err: &ErrBatchCorrupted{reason}}
+}
+
+// ErrBatchTooLarge is returned by writes of a batch exceeding the
+// MaxBatchSize or MaxBatchLen option.
+type ErrBatchTooLarge struct {
+	Size int // Size of the batch data, see Batch.Dump.
+	Len  int // Number of records of the batch.
+}
+
+func (e *ErrBatchTooLarge) Error() string {
+	return fmt.Sprintf("leveldb: batch too large: %d bytes, %d records", e.Size, e.Len)
 }
 
 const (
 	batchHeaderLen = 8 + 4
 	batchGrowRec   = 3000
 	batchBufioSize = 16
+
+	// Batches written to the journal larger than this are split into
+	// multiple journal records.
+	batchSplitSize = 4 * 1024 * 1024
 )
 
 // BatchReplay wraps basic batch operations.
@@ -42,6 +58,14 @@ type BatchReplay interface {
 	Delete(key []byte)
 }
 
+// BatchRangeReplay wraps basic batch operations plus range deletion.
+// Range deletions are skipped when replaying to a BatchReplay that
+// doesn't implement BatchRangeReplay.
+type BatchRangeReplay interface {
+	BatchReplay
+	DeleteRange(start, limit []byte)
+}
+
 type batchIndex struct {
 	keyType            keyType
 	keyPos, keyLen     int
@@ -87,7 +111,7 @@ func (b *Batch) grow(n int) {
 
 func (b *Batch) appendRec(kt keyType, key, value []byte) {
 	n := 1 + binary.MaxVarintLen32 + len(key)
-	if kt == keyTypeVal {
+	if kt != keyTypeDel {
 		n += binary.MaxVarintLen32 + len(value)
 	}
 	b.grow(n)
@@ -100,7 +124,7 @@ func (b *Batch) appendRec(kt keyType, key, value []byte) {
 	index.keyPos = o
 	index.keyLen = len(key)
 	o += copy(data[o:], key)
-	if kt == keyTypeVal {
+	if kt != keyTypeDel {
 		o += binary.PutUvarint(data[o:], uint64(len(value)))
 		index.valuePos = o
 		index.valueLen = len(value)
@@ -125,6 +149,26 @@ func (b *Batch) Delete(key []byte) {
 	b.appendRec(keyTypeDel, key, nil)
 }
 
+// DeleteRange appends 'range delete operation' of the given key range to
+// the batch. It deletes every key within the range, start is included in
+// the range while limit is not. An empty range is ignored once written,
+// writing the batch fails with ErrInvalidRange if start is after limit.
+// It is safe to modify the contents of the argument after DeleteRange
+// returns but not before.
+func (b *Batch) DeleteRange(start, limit []byte) {
+	b.appendRec(keyTypeRangeDel, start, limit)
+}
+
+// Returns true if the batch holds range deletions.
+func (b *Batch) hasRangeDel() bool {
+	for _, index := range b.index {
+		if index.keyType == keyTypeRangeDel {
+			return true
+		}
+	}
+	return false
+}
+
 // Dump dumps batch contents. The returned slice can be loaded into the
 // batch using Load method.
 // The returned slice is not its own copy, so the contents should not be
@@ -141,14 +185,20 @@ func (b *Batch) Load(data []byte) error {
 	return b.decode(data, -1)
 }
 
-// Replay replays batch contents.
+// Replay replays batch contents. Range deletions are only replayed if r
+// implements BatchRangeReplay.
 func (b *Batch) Replay(r BatchReplay) error {
+	rr, _ := r.(BatchRangeReplay)
 	for _, index := range b.index {
 		switch index.keyType {
 		case keyTypeVal:
 			r.Put(index.k(b.data), index.v(b.data))
 		case keyTypeDel:
 			r.Delete(index.k(b.data))
+		case keyTypeRangeDel:
+			if rr != nil {
+				rr.DeleteRange(index.kv(b.data))
+			}
 		}
 	}
 	return nil
@@ -212,13 +262,29 @@ func (b *Batch) decode(data []byte, expectedLen int) error {
 	return nil
 }
 
-func (b *Batch) putMem(seq uint64, mdb *memdb.DB) error {
+// Puts the batch records into the memdb, concurrently with other writers
+// if concurrent is true, see memdb.DB.PutConcurrent.
+func (b *Batch) putMem(seq uint64, mdb *memDB, concurrent bool) error {
+	put := mdb.Put
+	if concurrent {
+		put = mdb.PutConcurrent
+	}
 	var ik []byte
 	for i, index := range b.index {
+		if index.keyType == keyTypeRangeDel {
+			// Empty range deletions are ignored, the sequence number is
+			// still consumed.
+			if ok, _ := checkRangeDel(mdb.db.s.icmp, index.k(b.data), index.v(b.data)); !ok {
+				continue
+			}
+		}
 		ik = makeInternalKey(ik, index.k(b.data), seq+uint64(i), index.keyType)
-		if err := mdb.Put(ik, index.v(b.data)); err != nil {
+		if err := put(ik, index.v(b.data)); err != nil {
 			return err
 		}
+		if index.keyType == keyTypeRangeDel {
+			mdb.putRangeDel(seq+uint64(i), index.k(b.data), index.v(b.data))
+		}
 	}
 	return nil
 }
@@ -243,7 +309,7 @@ func decodeBatch(data []byte, fn func(i int, index batchIndex) error) error {
 	for i, o := 0, 0; o < len(data); i++ {
 		// Key type.
 		index.keyType = keyType(data[o])
-		if index.keyType > keyTypeVal {
+		if index.keyType > keyTypeRangeDel {
 			return newErrBatchCorrupted(fmt.Sprintf("bad record: invalid type %#x", uint(index.keyType)))
 		}
 		o++
@@ -259,7 +325,7 @@ func decodeBatch(data []byte, fn func(i int, index batchIndex) error) error {
 		o += index.keyLen
 
 		// Value.
-		if index.keyType == keyTypeVal {
+		if index.keyType != keyTypeDel {
 			x, n = binary.Uvarint(data[o:])
 			o += n
 			if n <= 0 || o+int(x) > len(data) {
@@ -347,3 +413,161 @@ func writeBatchesWithHeader(wr io.Writer, batches []*Batch, seq uint64) error {
 	}
 	return nil
 }
+
+// A part of split batches, written as a journal record of its own.
+type batchFragment struct {
+	len   int
+	parts [][]byte
+}
+
+// Splits the batches into fragments of at most splitSize bytes of records,
+// a record larger than that is a fragment of its own.
+func splitBatches(batches []*Batch, splitSize int) (frags []batchFragment) {
+	var (
+		frag batchFragment
+		size int
+	)
+	for _, batch := range batches {
+		start, end := 0, 0
+		for _, index := range batch.index {
+			n := index.valuePos + index.valueLen
+			if index.keyType == keyTypeDel {
+				n = index.keyPos + index.keyLen
+			}
+			if frag.len > 0 && size+n-end > splitSize {
+				if end > start {
+					frag.parts = append(frag.parts, batch.data[start:end])
+				}
+				frags = append(frags, frag)
+				frag, size, start = batchFragment{}, 0, end
+			}
+			size += n - end
+			end = n
+			frag.len++
+		}
+		if end > start {
+			frag.parts = append(frag.parts, batch.data[start:end])
+		}
+	}
+	if frag.len > 0 {
+		frags = append(frags, frag)
+	}
+	return
+}
+
+// Writes the batches to the journal as a single record. Batches larger than
+// splitSize are split into multiple records instead, written between a
+// begin and an end marker record so that they're only replayed as a whole;
+// a marker is a batch header with zero sequence number, the number of
+// records being the number of fragments for the begin marker and zero for
+// the end marker.
+func writeBatchesToJournal(jw *journal.Writer, batches []*Batch, seq uint64, splitSize int) error {
+	size := 0
+	for _, batch := range batches {
+		size += len(batch.data)
+	}
+	if size <= splitSize {
+		wr, err := jw.Next()
+		if err != nil {
+			return err
+		}
+		return writeBatchesWithHeader(wr, batches, seq)
+	}
+
+	frags := splitBatches(batches, splitSize)
+	wr, err := jw.Next()
+	if err != nil {
+		return err
+	}
+	if _, err := wr.Write(encodeBatchHeader(nil, 0, len(frags))); err != nil {
+		return err
+	}
+	for _, frag := range frags {
+		if wr, err = jw.Next(); err != nil {
+			return err
+		}
+		if _, err := wr.Write(encodeBatchHeader(nil, seq, frag.len)); err != nil {
+			return err
+		}
+		for _, part := range frag.parts {
+			if _, err := wr.Write(part); err != nil {
+				return err
+			}
+		}
+		seq += uint64(frag.len)
+	}
+	if wr, err = jw.Next(); err != nil {
+		return err
+	}
+	_, err = wr.Write(encodeBatchHeader(nil, 0, 0))
+	return err
+}
+
+// Reads the next batch record of the journal into buf, see
+// writeBatchesToJournal. Split batches are reassembled into a single batch
+// record; a split batch that isn't terminated by its end marker, e.g. torn
+// by a crash, is dropped with io.ErrUnexpectedEOF, as a torn record is.
+// A journal header record is read into buf, and errJournalHeader returned.
+// Other records are returned as is, their header isn't checked.
+func readJournalBatch(jr *journal.Reader, buf *util.Buffer) error {
+	r, err := jr.Next()
+	if err != nil {
+		return err
+	}
+	buf.Reset()
+	if _, err := buf.ReadFrom(r); err != nil {
+		return err
+	}
+	seq, nfrags, err := decodeBatchHeader(buf.Bytes())
+	if err != nil || seq != 0 {
+		return nil
+	}
+	if nfrags == 0 && buf.Len() == journalHeaderLen {
+		return errJournalHeader
+	}
+	if nfrags == 0 || buf.Len() != batchHeaderLen {
+		return newErrBatchCorrupted("unexpected split batch marker")
+	}
+
+	buf.Reset()
+	var (
+		frag     util.Buffer
+		batchLen int
+	)
+	for i := 0; i <= nfrags; i++ {
+		r, err := jr.Next()
+		if err == nil {
+			frag.Reset()
+			_, err = frag.ReadFrom(r)
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		fseq, flen, err := decodeBatchHeader(frag.Bytes())
+		if err != nil {
+			return err
+		}
+		switch {
+		case i == nfrags:
+			if fseq != 0 || flen != 0 || frag.Len() != batchHeaderLen {
+				return newErrBatchCorrupted("missing split batch end marker")
+			}
+		case i == 0:
+			if fseq == 0 {
+				return newErrBatchCorrupted("invalid split batch fragment")
+			}
+			buf.Write(frag.Bytes())
+		default:
+			if start, _, _ := decodeBatchHeader(buf.Bytes()); fseq != start+uint64(batchLen) {
+				return newErrBatchCorrupted("invalid split batch fragment")
+			}
+			buf.Write(frag.Bytes()[batchHeaderLen:])
+		}
+		batchLen += flen
+	}
+	binary.LittleEndian.PutUint32(buf.Bytes()[8:], uint32(batchLen))
+	return nil
+}
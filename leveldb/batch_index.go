@@ -0,0 +1,145 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"github.com/FactomProject/goleveldb/leveldb/comparer"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+)
+
+// BatchWithIndex is a write batch that maintains an index of its records
+// by key, so the pending writes of the batch can be read before the batch
+// is written, see GetFromBatchAndDB. The embedded Batch is written as any
+// batch, e.g. with DB.Write(&b.Batch, wo).
+//
+// The records must be appended with the methods of BatchWithIndex, the
+// index isn't maintained by the methods of the embedded Batch. The zero
+// value is an empty batch using the default comparer.
+type BatchWithIndex struct {
+	Batch
+
+	cmp    comparer.BasicComparer
+	keys   map[string]int // Record index of the latest put or delete of each key.
+	ranges []int          // Record indexes of the range deletions.
+}
+
+// NewBatchWithIndex returns an empty batch with index. The comparer must
+// be the comparer of the DB the batch is read with, it is only used to
+// match keys against range deletions; if nil, the default comparer is used.
+func NewBatchWithIndex(cmp comparer.BasicComparer) *BatchWithIndex {
+	return &BatchWithIndex{cmp: cmp}
+}
+
+func (b *BatchWithIndex) indexRec(i int) {
+	index := b.index[i]
+	if index.keyType == keyTypeRangeDel {
+		b.ranges = append(b.ranges, i)
+		return
+	}
+	if b.keys == nil {
+		b.keys = make(map[string]int)
+	}
+	b.keys[string(index.k(b.data))] = i
+}
+
+// Put appends 'put operation' of the given key/value pair to the batch.
+// It is safe to modify the contents of the argument after Put returns but not
+// before.
+func (b *BatchWithIndex) Put(key, value []byte) {
+	b.Batch.Put(key, value)
+	b.indexRec(len(b.index) - 1)
+}
+
+// Delete appends 'delete operation' of the given key to the batch.
+// It is safe to modify the contents of the argument after Delete returns but
+// not before.
+func (b *BatchWithIndex) Delete(key []byte) {
+	b.Batch.Delete(key)
+	b.indexRec(len(b.index) - 1)
+}
+
+// DeleteRange appends 'range delete operation' of the given key range to
+// the batch, see Batch.DeleteRange.
+// It is safe to modify the contents of the argument after DeleteRange
+// returns but not before.
+func (b *BatchWithIndex) DeleteRange(start, limit []byte) {
+	b.Batch.DeleteRange(start, limit)
+	b.indexRec(len(b.index) - 1)
+}
+
+// Load loads given slice into the batch and indexes its records, see
+// Batch.Load.
+func (b *BatchWithIndex) Load(data []byte) error {
+	b.resetIndex()
+	if err := b.Batch.Load(data); err != nil {
+		return err
+	}
+	for i := range b.index {
+		b.indexRec(i)
+	}
+	return nil
+}
+
+// Reset resets the batch and its index.
+func (b *BatchWithIndex) Reset() {
+	b.Batch.Reset()
+	b.resetIndex()
+}
+
+func (b *BatchWithIndex) resetIndex() {
+	for key := range b.keys {
+		delete(b.keys, key)
+	}
+	b.ranges = b.ranges[:0]
+}
+
+// Looks up the given key in the batch. The key is deleted if found is true
+// while value is nil.
+func (b *BatchWithIndex) lookup(key []byte) (value []byte, found bool) {
+	i, ok := b.keys[string(key)]
+	if !ok {
+		i = -1
+	}
+	cmp := b.cmp
+	if cmp == nil {
+		cmp = comparer.DefaultComparer
+	}
+	for j := len(b.ranges) - 1; j >= 0 && b.ranges[j] > i; j-- {
+		start, limit := b.index[b.ranges[j]].kv(b.data)
+		if cmp.Compare(start, key) <= 0 && cmp.Compare(key, limit) < 0 {
+			return nil, true
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	index := b.index[i]
+	if index.keyType == keyTypeDel {
+		return nil, true
+	}
+	return append([]byte{}, index.v(b.data)...), true
+}
+
+// GetFromBatchAndDB gets the value for the given key as if the batch was
+// written to the given DB, snapshot or transaction: the latest write of
+// the key in the batch takes precedence, otherwise the value is read from
+// db. It returns ErrNotFound if the key is deleted by the batch, or if the
+// batch doesn't write the key and db doesn't contain it.
+//
+// The returned slice is its own copy, it is safe to modify the contents
+// of the returned slice.
+// It is safe to modify the contents of the argument after GetFromBatchAndDB
+// returns.
+func (b *BatchWithIndex) GetFromBatchAndDB(db Reader, key []byte, ro *opt.ReadOptions) (value []byte, err error) {
+	if value, found := b.lookup(key); found {
+		if value == nil {
+			return nil, ErrNotFound
+		}
+		return value, nil
+	}
+	return db.Get(key, ro)
+}
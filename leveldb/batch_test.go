@@ -9,10 +9,14 @@ package leveldb
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"testing"
 	"testing/quick"
 
+	"github.com/FactomProject/goleveldb/leveldb/journal"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
 	"github.com/FactomProject/goleveldb/leveldb/testutil"
+	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
 func TestBatchHeader(t *testing.T) {
@@ -145,3 +149,114 @@ func TestBatch(t *testing.T) {
 	}
 	t.Logf("length=%d internalLen=%d", len(kvs), internalLen)
 }
+
+func TestBatchSplit(t *testing.T) {
+	b1, b2 := new(Batch), new(Batch)
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%03d", i))
+		switch {
+		case i%10 == 0:
+			b1.Delete(key)
+		case i == 50:
+			// A record larger than the split size.
+			b1.Put(key, bytes.Repeat([]byte{'x'}, 2000))
+		default:
+			b1.Put(key, []byte("value"))
+		}
+		b2.Put(key, nil)
+	}
+	batches := []*Batch{b1, b2}
+	want := new(bytes.Buffer)
+	if err := writeBatchesWithHeader(want, batches, 10); err != nil {
+		t.Fatal("writeBatchesWithHeader: got error: ", err)
+	}
+
+	for _, splitSize := range []int{1 << 20, 100, 1} {
+		jbuf := new(bytes.Buffer)
+		jw := journal.NewWriter(jbuf)
+		if err := writeBatchesToJournal(jw, batches, 10, splitSize); err != nil {
+			t.Fatal("writeBatchesToJournal: got error: ", err)
+		}
+		if err := jw.Close(); err != nil {
+			t.Fatal("journal close: got error: ", err)
+		}
+
+		buf := new(util.Buffer)
+		jr := journal.NewReader(bytes.NewReader(jbuf.Bytes()), nil, true, true)
+		if err := readJournalBatch(jr, buf); err != nil {
+			t.Fatalf("split size %d: readJournalBatch: got error: %v", splitSize, err)
+		}
+		if !bytes.Equal(buf.Bytes(), want.Bytes()) {
+			t.Errorf("split size %d: reassembled batch mismatch", splitSize)
+		}
+		if err := readJournalBatch(jr, buf); err != io.EOF {
+			t.Errorf("split size %d: got error %v, want io.EOF", splitSize, err)
+		}
+		if splitSize == 1<<20 {
+			continue
+		}
+
+		// A split batch without its end marker is dropped.
+		jbuf.Reset()
+		jw = journal.NewWriter(jbuf)
+		if err := writeBatchesToJournal(jw, batches, 10, splitSize); err != nil {
+			t.Fatal("writeBatchesToJournal: got error: ", err)
+		}
+		jw.Flush()
+		data := jbuf.Bytes()
+		// Cut the end marker, a chunk of 7 bytes header plus its batch header.
+		jr = journal.NewReader(bytes.NewReader(data[:len(data)-7-batchHeaderLen]), nil, true, true)
+		if err := readJournalBatch(jr, buf); err != io.ErrUnexpectedEOF {
+			t.Errorf("split size %d: torn batch: got error %v, want io.ErrUnexpectedEOF", splitSize, err)
+		}
+	}
+}
+
+func TestBatchWithIndex(t *testing.T) {
+	db, err := Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	defer db.Close()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		if err := db.Put([]byte(key), []byte("db"), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+
+	b := NewBatchWithIndex(nil)
+	b.Put([]byte("a"), []byte("batch"))
+	b.Delete([]byte("b"))
+	b.DeleteRange([]byte("c"), []byte("e"))
+	b.Put([]byte("d"), []byte("batch"))
+	b.Put([]byte("f"), nil)
+
+	check := func(b *BatchWithIndex, want map[string]string) {
+		for _, key := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+			value, err := b.GetFromBatchAndDB(db, []byte(key), nil)
+			if w, ok := want[key]; !ok {
+				if err != ErrNotFound {
+					t.Errorf("key %q: got (%q, %v), want ErrNotFound", key, value, err)
+				}
+			} else if err != nil || string(value) != w {
+				t.Errorf("key %q: got (%q, %v), want %q", key, value, err, w)
+			}
+		}
+	}
+	want := map[string]string{"a": "batch", "d": "batch", "e": "db", "f": ""}
+	check(b, want)
+
+	// The index is rebuilt by Load.
+	nb := NewBatchWithIndex(nil)
+	nb.Put([]byte("e"), []byte("stale"))
+	if err := nb.Load(append([]byte{}, b.Dump()...)); err != nil {
+		t.Fatal("Load: got error: ", err)
+	}
+	check(nb, want)
+
+	if err := db.Write(&b.Batch, nil); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	b.Reset()
+	check(b, want)
+}
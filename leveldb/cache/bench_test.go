@@ -27,3 +27,19 @@ func BenchmarkLRUCache(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkShardedLRUCache(b *testing.B) {
+	c := NewCache(NewShardedLRU(10000, 0))
+
+	b.SetParallelism(10)
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+		for pb.Next() {
+			key := uint64(r.Intn(1000000))
+			c.Get(0, key, func() (int, Value) {
+				return 1, key
+			}).Release()
+		}
+	})
+}
@@ -189,7 +189,7 @@ func (b *mBucket) delete(r *Cache, h *mNode, hash uint32, ns, key uint64) (done,
 		}
 
 		// Update counter.
-		atomic.AddInt32(&r.size, int32(n.size)*-1)
+		atomic.AddInt64(&r.size, int64(n.size)*-1)
 		shrink := atomic.AddInt32(&r.nodes, -1) < h.shrinkThreshold
 		if bLen >= mOverflowThreshold {
 			atomic.AddInt32(&h.overflow, -1)
@@ -286,10 +286,12 @@ func (n *mNode) initBuckets() {
 
 // Cache is a 'cache map'.
 type Cache struct {
+	hit    int64
+	miss   int64
+	size   int64
 	mu     sync.RWMutex
 	mHead  unsafe.Pointer // *mNode
 	nodes  int32
-	size   int32
 	cacher Cacher
 	closed bool
 }
@@ -341,7 +343,53 @@ func (r *Cache) Nodes() int {
 
 // Size returns sums of 'cache node' size in the map.
 func (r *Cache) Size() int {
-	return int(atomic.LoadInt32(&r.size))
+	return int(atomic.LoadInt64(&r.size))
+}
+
+// Hits returns number of Get calls that found existing 'cache node' value.
+func (r *Cache) Hits() int64 {
+	return atomic.LoadInt64(&r.hit)
+}
+
+// Misses returns number of Get calls that did not find existing 'cache node'
+// value.
+func (r *Cache) Misses() int64 {
+	return atomic.LoadInt64(&r.miss)
+}
+
+// Stats holds 'cache map' statistics.
+type Stats struct {
+	// Hits and Misses are number of Get calls that did and did not find
+	// existing 'cache node' value.
+	Hits, Misses int64
+
+	// Evictions is number of 'cache node' evicted by the cacher to stay
+	// within its capacity. Only counted by the builtin cachers.
+	Evictions int64
+
+	// Nodes is number of 'cache node' in the map, Size is sums of their
+	// size and Capacity is the cacher capacity.
+	Nodes, Size, Capacity int
+}
+
+// evictionCounter is implemented by cacher that counts evictions.
+type evictionCounter interface {
+	evictions() int64
+}
+
+// Stats returns the 'cache map' statistics.
+func (r *Cache) Stats() Stats {
+	s := Stats{
+		Hits:     r.Hits(),
+		Misses:   r.Misses(),
+		Nodes:    r.Nodes(),
+		Size:     r.Size(),
+		Capacity: r.Capacity(),
+	}
+	if c, ok := r.cacher.(evictionCounter); ok {
+		s.Evictions = c.evictions()
+	}
+	return s
 }
 
 // Capacity returns cache capacity.
@@ -380,6 +428,7 @@ func (r *Cache) Get(ns, key uint64, setFunc func() (size int, value Value)) *Han
 			if n != nil {
 				n.mu.Lock()
 				if n.value == nil {
+					atomic.AddInt64(&r.miss, 1)
 					if setFunc == nil {
 						n.mu.Unlock()
 						n.unref()
@@ -393,7 +442,9 @@ func (r *Cache) Get(ns, key uint64, setFunc func() (size int, value Value)) *Han
 						n.unref()
 						return nil
 					}
-					atomic.AddInt32(&r.size, int32(n.size))
+					atomic.AddInt64(&r.size, int64(n.size))
+				} else {
+					atomic.AddInt64(&r.hit, 1)
 				}
 				n.mu.Unlock()
 				if r.cacher != nil {
@@ -402,6 +453,7 @@ func (r *Cache) Get(ns, key uint64, setFunc func() (size int, value Value)) *Han
 				return &Handle{unsafe.Pointer(n)}
 			}
 
+			atomic.AddInt64(&r.miss, 1)
 			break
 		}
 	}
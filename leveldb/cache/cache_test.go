@@ -182,6 +182,25 @@ func TestCacheMap_NodesAndSize(t *testing.T) {
 	}
 }
 
+func TestCacheMap_HitsAndMisses(t *testing.T) {
+	c := NewCache(nil)
+	set(c, 0, 1, 1, 1, nil)
+	set(c, 0, 2, 2, 1, nil)
+	set(c, 0, 1, 1, 1, nil)
+	if h := c.Get(0, 3, nil); h != nil {
+		t.Error("cache handle is non-nil")
+	}
+	if h := c.Get(0, 2, nil); h == nil {
+		t.Error("cache handle is nil")
+	}
+	if c.Hits() != 2 {
+		t.Errorf("invalid hits counter: want=%d got=%d", 2, c.Hits())
+	}
+	if c.Misses() != 3 {
+		t.Errorf("invalid misses counter: want=%d got=%d", 3, c.Misses())
+	}
+}
+
 func TestLRUCache_Capacity(t *testing.T) {
 	c := NewCache(NewLRU(10))
 	if c.Capacity() != 10 {
@@ -213,6 +232,55 @@ func TestLRUCache_Capacity(t *testing.T) {
 	}
 }
 
+func TestCacheMap_Stats(t *testing.T) {
+	c := NewCache(NewLRU(10))
+	set(c, 0, 1, 1, 4, nil).Release()
+	set(c, 0, 2, 2, 4, nil).Release()
+	set(c, 0, 3, 3, 4, nil).Release()
+	if h := c.Get(0, 3, nil); h != nil {
+		h.Release()
+	}
+	c.Get(0, 1, nil)
+	want := Stats{Hits: 1, Misses: 4, Evictions: 1, Nodes: 2, Size: 8, Capacity: 10}
+	if got := c.Stats(); got != want {
+		t.Errorf("invalid stats: want=%+v got=%+v", want, got)
+	}
+}
+
+func TestShardedLRUCache_Capacity(t *testing.T) {
+	c := NewCache(NewShardedLRU(100, 4))
+	if c.Capacity() != 100 {
+		t.Errorf("invalid capacity: want=%d got=%d", 100, c.Capacity())
+	}
+	// Larger than capacity of a shard.
+	set(c, 0, 1, 1, 26, nil).Release()
+	if c.Nodes() != 0 {
+		t.Errorf("invalid nodes counter: want=%d got=%d", 0, c.Nodes())
+	}
+	for i := 0; i < 1000; i++ {
+		set(c, uint64(i%3), uint64(i), i, 5, nil).Release()
+	}
+	if size := c.Size(); size > 100 || size < 60 {
+		t.Errorf("invalid size counter: want 60 - 100 got=%d", size)
+	}
+	if n := c.Stats().Evictions; int(n) != 1000-c.Nodes() {
+		t.Errorf("invalid evictions counter: want=%d got=%d", 1000-c.Nodes(), n)
+	}
+	c.EvictNS(1)
+	for i := 0; i < 1000; i++ {
+		if h := c.Get(uint64(i%3), uint64(i), nil); h != nil {
+			if i%3 == 1 {
+				t.Errorf("hit for evicted namespace, key '%d'", i)
+			}
+			h.Release()
+		}
+	}
+	c.SetCapacity(0)
+	if c.Nodes() != 0 || c.Size() != 0 {
+		t.Errorf("cache is not empty: nodes=%d size=%d", c.Nodes(), c.Size())
+	}
+}
+
 func TestCacheMap_NilValue(t *testing.T) {
 	c := NewCache(NewLRU(10))
 	h := c.Get(0, 0, func() (size int, value Value) {
@@ -561,3 +629,100 @@ func TestLRUCache_Close(t *testing.T) {
 		t.Errorf("delFunc isn't called 1 times: got=%d", delFuncCalled)
 	}
 }
+
+func TestS3FIFOCache_Capacity(t *testing.T) {
+	c := NewCache(NewS3FIFO(10))
+	if c.Capacity() != 10 {
+		t.Errorf("invalid capacity: want=%d got=%d", 10, c.Capacity())
+	}
+	for i := 0; i < 20; i++ {
+		set(c, 0, uint64(i), i, 2, nil).Release()
+	}
+	if c.Nodes() != 5 || c.Size() != 10 {
+		t.Errorf("invalid counters: nodes=%d size=%d", c.Nodes(), c.Size())
+	}
+	if n := c.Stats().Evictions; n != 15 {
+		t.Errorf("invalid evictions counter: want=%d got=%d", 15, n)
+	}
+	c.SetCapacity(4)
+	if c.Nodes() != 2 || c.Size() != 4 {
+		t.Errorf("invalid counters: nodes=%d size=%d", c.Nodes(), c.Size())
+	}
+	if h := set(c, 0, 100, 100, 5, nil); h != nil {
+		h.Release()
+	}
+	if c.Size() > 4 {
+		t.Errorf("invalid size counter: got=%d", c.Size())
+	}
+}
+
+func TestS3FIFOCache_ScanResistance(t *testing.T) {
+	get := func(c *Cache, key uint64) {
+		set(c, 0, key, key, 1, nil).Release()
+	}
+	hot := func(c *Cache) (n int) {
+		for key := uint64(0); key < 50; key++ {
+			if h := c.Get(0, key, nil); h != nil {
+				h.Release()
+				n++
+			}
+		}
+		return
+	}
+	for _, x := range []struct {
+		name   string
+		cacher Cacher
+		min    int
+	}{
+		{"lru", NewLRU(100), 0},
+		{"s3fifo", NewS3FIFO(100), 45},
+	} {
+		c := NewCache(x.cacher)
+		// Hot set.
+		for n := 0; n < 3; n++ {
+			for key := uint64(0); key < 50; key++ {
+				get(c, key)
+			}
+		}
+		// Scan.
+		for key := uint64(1000); key < 2000; key++ {
+			get(c, key)
+		}
+		n := hot(c)
+		t.Logf("%s: %d of hot set survived the scan", x.name, n)
+		if n < x.min {
+			t.Errorf("%s: hot set evicted by scan, want at least %d got %d", x.name, x.min, n)
+		}
+	}
+}
+
+func TestS3FIFOCache_Evict(t *testing.T) {
+	c := NewCache(NewS3FIFO(6))
+	set(c, 0, 1, 1, 1, nil).Release()
+	set(c, 0, 2, 2, 1, nil).Release()
+	set(c, 1, 1, 4, 1, nil).Release()
+	set(c, 1, 2, 5, 1, nil).Release()
+
+	if ok := c.Evict(0, 1); !ok {
+		t.Error("Cache.Evict on #0.1 return false")
+	}
+	if h := c.Get(0, 1, nil); h != nil {
+		t.Errorf("Cache.Get on #0.1 return non-nil: %v", h.Value())
+	}
+	c.EvictNS(1)
+	if h := c.Get(1, 1, nil); h != nil {
+		t.Errorf("Cache.Get on #1.1 return non-nil: %v", h.Value())
+	}
+	if h := c.Get(0, 2, nil); h == nil {
+		t.Error("Cache.Get on #0.2 return nil")
+	} else {
+		h.Release()
+	}
+	if ok := c.Delete(0, 2, nil); !ok {
+		t.Error("Cache.Delete on #0.2 return false")
+	}
+	c.EvictAll()
+	if c.Nodes() != 0 || c.Size() != 0 {
+		t.Errorf("cache is not empty: nodes=%d size=%d", c.Nodes(), c.Size())
+	}
+}
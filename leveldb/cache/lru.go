@@ -8,6 +8,7 @@ package cache
 
 import (
 	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
@@ -39,6 +40,7 @@ func (n *lruNode) remove() {
 }
 
 type lru struct {
+	evicted  int64
 	mu       sync.Mutex
 	capacity int
 	used     int
@@ -74,6 +76,7 @@ func (r *lru) SetCapacity(capacity int) {
 	}
 	r.mu.Unlock()
 
+	atomic.AddInt64(&r.evicted, int64(len(evicted)))
 	for _, rn := range evicted {
 		rn.h.Release()
 	}
@@ -110,6 +113,7 @@ func (r *lru) Promote(n *Node) {
 	}
 	r.mu.Unlock()
 
+	atomic.AddInt64(&r.evicted, int64(len(evicted)))
 	for _, rn := range evicted {
 		rn.h.Release()
 	}
@@ -187,9 +191,101 @@ func (r *lru) Close() error {
 	return nil
 }
 
+func (r *lru) evictions() int64 {
+	return atomic.LoadInt64(&r.evicted)
+}
+
 // NewLRU create a new LRU-cache.
 func NewLRU(capacity int) Cacher {
 	r := &lru{capacity: capacity}
 	r.reset()
 	return r
 }
+
+// shardedLRU splits capacity among LRU-caches, each 'cache node' is kept
+// by the LRU-cache picked by its hash. This reduces lock contention at the
+// cost of per-shard rather than global recency.
+type shardedLRU struct {
+	shards []*lru
+}
+
+func (r *shardedLRU) shard(n *Node) *lru {
+	return r.shards[(n.hash>>16)%uint32(len(r.shards))]
+}
+
+func (r *shardedLRU) Capacity() int {
+	var capacity int
+	for _, s := range r.shards {
+		capacity += s.Capacity()
+	}
+	return capacity
+}
+
+func (r *shardedLRU) SetCapacity(capacity int) {
+	n := len(r.shards)
+	for i, s := range r.shards {
+		c := capacity / n
+		if i < capacity%n {
+			c++
+		}
+		s.SetCapacity(c)
+	}
+}
+
+func (r *shardedLRU) Promote(n *Node) {
+	r.shard(n).Promote(n)
+}
+
+func (r *shardedLRU) Ban(n *Node) {
+	r.shard(n).Ban(n)
+}
+
+func (r *shardedLRU) Evict(n *Node) {
+	r.shard(n).Evict(n)
+}
+
+func (r *shardedLRU) EvictNS(ns uint64) {
+	for _, s := range r.shards {
+		s.EvictNS(ns)
+	}
+}
+
+func (r *shardedLRU) EvictAll() {
+	for _, s := range r.shards {
+		s.EvictAll()
+	}
+}
+
+func (r *shardedLRU) Close() error {
+	return nil
+}
+
+func (r *shardedLRU) evictions() int64 {
+	var n int64
+	for _, s := range r.shards {
+		n += s.evictions()
+	}
+	return n
+}
+
+// DefaultLRUShards is the default number of shards of NewShardedLRU.
+const DefaultLRUShards = 16
+
+// NewShardedLRU create a new LRU-cache split into the given number of
+// shards, each holds an equal share of the capacity. Use zero for
+// DefaultLRUShards.
+//
+// Note that a 'cache node' larger than the capacity of a shard is not
+// cached.
+func NewShardedLRU(capacity, shards int) Cacher {
+	if shards <= 0 {
+		shards = DefaultLRUShards
+	}
+	r := &shardedLRU{shards: make([]*lru, shards)}
+	for i := range r.shards {
+		r.shards[i] = &lru{}
+		r.shards[i].reset()
+	}
+	r.SetCapacity(capacity)
+	return r
+}
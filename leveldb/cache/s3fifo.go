@@ -0,0 +1,322 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// The S3-FIFO implementation is based on:
+// "FIFO queues are all you need for cache eviction", by Juncheng Yang,
+// Yazhuo Zhang, Ziyue Qiu, Yao Yue and K. V. Rashmi.
+// ACM Symposium on Operating Systems Principles, Oct 2023.
+
+const (
+	s3fifoMaxFreq = 3
+	// Percentage of the capacity used by the small queue.
+	s3fifoSmallRatio = 10
+)
+
+type s3fifoNode struct {
+	n     *Node
+	h     *Handle
+	ban   bool
+	freq  uint8
+	queue *s3fifoQueue
+
+	next, prev *s3fifoNode
+}
+
+type s3fifoQueue struct {
+	used int
+	root s3fifoNode
+}
+
+func (q *s3fifoQueue) reset() {
+	q.root.next = &q.root
+	q.root.prev = &q.root
+	q.used = 0
+}
+
+func (q *s3fifoQueue) empty() bool {
+	return q.root.next == &q.root
+}
+
+// Pushes the node to the head of the queue.
+func (q *s3fifoQueue) push(sn *s3fifoNode) {
+	x := q.root.next
+	q.root.next = sn
+	sn.prev = &q.root
+	sn.next = x
+	x.prev = sn
+	sn.queue = q
+	q.used += sn.n.Size()
+}
+
+func (q *s3fifoQueue) remove(sn *s3fifoNode) {
+	if sn.queue != q {
+		panic("BUG: removing removed node")
+	}
+	sn.prev.next = sn.next
+	sn.next.prev = sn.prev
+	sn.prev = nil
+	sn.next = nil
+	sn.queue = nil
+	q.used -= sn.n.Size()
+}
+
+type s3fifoGhostKey struct {
+	ns, key uint64
+}
+
+type s3fifoGhostEntry struct {
+	k   s3fifoGhostKey
+	seq uint64
+}
+
+// s3fifoGhost remembers keys recently evicted from the small queue.
+type s3fifoGhost struct {
+	seq   uint64
+	keys  map[s3fifoGhostKey]uint64
+	queue []s3fifoGhostEntry
+}
+
+func (g *s3fifoGhost) reset() {
+	g.keys = make(map[s3fifoGhostKey]uint64)
+	g.queue = nil
+}
+
+func (g *s3fifoGhost) add(k s3fifoGhostKey, limit int) {
+	g.seq++
+	g.keys[k] = g.seq
+	g.queue = append(g.queue, s3fifoGhostEntry{k, g.seq})
+	for len(g.keys) > limit && len(g.queue) > 0 {
+		e := g.queue[0]
+		g.queue = g.queue[1:]
+		if seq, ok := g.keys[e.k]; ok && seq == e.seq {
+			delete(g.keys, e.k)
+		}
+	}
+	if len(g.queue) > 2*limit+16 {
+		// Drop stale entries.
+		queue := make([]s3fifoGhostEntry, 0, len(g.keys))
+		for _, e := range g.queue {
+			if seq, ok := g.keys[e.k]; ok && seq == e.seq {
+				queue = append(queue, e)
+			}
+		}
+		g.queue = queue
+	}
+}
+
+// Returns true and forget the key if it is remembered.
+func (g *s3fifoGhost) remove(k s3fifoGhostKey) bool {
+	if _, ok := g.keys[k]; ok {
+		delete(g.keys, k)
+		return true
+	}
+	return false
+}
+
+type s3fifo struct {
+	evicted  int64
+	mu       sync.Mutex
+	capacity int
+	nodes    int
+	small    s3fifoQueue
+	main     s3fifoQueue
+	ghost    s3fifoGhost
+}
+
+func (r *s3fifo) reset() {
+	r.small.reset()
+	r.main.reset()
+	r.ghost.reset()
+	r.nodes = 0
+}
+
+// Evicts until within capacity. Must be called with mu held.
+func (r *s3fifo) evictNB(evicted []*s3fifoNode) []*s3fifoNode {
+	for r.small.used+r.main.used > r.capacity {
+		if r.small.used > r.capacity*s3fifoSmallRatio/100 || r.main.empty() {
+			sn := r.small.root.prev
+			r.small.remove(sn)
+			if sn.freq > 0 {
+				// Accessed while in the small queue, move to main queue.
+				sn.freq = 0
+				r.main.push(sn)
+				continue
+			}
+			r.ghost.add(s3fifoGhostKey{sn.n.NS(), sn.n.Key()}, r.nodes)
+			sn.n.CacheData = nil
+			r.nodes--
+			evicted = append(evicted, sn)
+		} else {
+			sn := r.main.root.prev
+			r.main.remove(sn)
+			if sn.freq > 0 {
+				// Reinsertion.
+				sn.freq--
+				r.main.push(sn)
+				continue
+			}
+			sn.n.CacheData = nil
+			r.nodes--
+			evicted = append(evicted, sn)
+		}
+	}
+	return evicted
+}
+
+func (r *s3fifo) release(evicted []*s3fifoNode, count bool) {
+	if count {
+		atomic.AddInt64(&r.evicted, int64(len(evicted)))
+	}
+	for _, sn := range evicted {
+		sn.h.Release()
+	}
+}
+
+func (r *s3fifo) Capacity() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.capacity
+}
+
+func (r *s3fifo) SetCapacity(capacity int) {
+	r.mu.Lock()
+	r.capacity = capacity
+	evicted := r.evictNB(nil)
+	r.mu.Unlock()
+
+	r.release(evicted, true)
+}
+
+func (r *s3fifo) Promote(n *Node) {
+	var evicted []*s3fifoNode
+
+	r.mu.Lock()
+	if n.CacheData == nil {
+		if n.Size() <= r.capacity {
+			sn := &s3fifoNode{n: n, h: n.GetHandle()}
+			n.CacheData = unsafe.Pointer(sn)
+			r.nodes++
+			if r.ghost.remove(s3fifoGhostKey{n.NS(), n.Key()}) {
+				// Recently evicted from the small queue.
+				r.main.push(sn)
+			} else {
+				r.small.push(sn)
+			}
+			evicted = r.evictNB(evicted)
+		}
+	} else {
+		sn := (*s3fifoNode)(n.CacheData)
+		if !sn.ban && sn.freq < s3fifoMaxFreq {
+			sn.freq++
+		}
+	}
+	r.mu.Unlock()
+
+	r.release(evicted, true)
+}
+
+// Removes the node from its queue. Must be called with mu held.
+func (r *s3fifo) removeNB(sn *s3fifoNode) {
+	sn.queue.remove(sn)
+	r.nodes--
+}
+
+func (r *s3fifo) Ban(n *Node) {
+	r.mu.Lock()
+	if n.CacheData == nil {
+		n.CacheData = unsafe.Pointer(&s3fifoNode{n: n, ban: true})
+	} else {
+		sn := (*s3fifoNode)(n.CacheData)
+		if !sn.ban {
+			r.removeNB(sn)
+			sn.ban = true
+			r.mu.Unlock()
+
+			sn.h.Release()
+			sn.h = nil
+			return
+		}
+	}
+	r.mu.Unlock()
+}
+
+func (r *s3fifo) Evict(n *Node) {
+	r.mu.Lock()
+	sn := (*s3fifoNode)(n.CacheData)
+	if sn == nil || sn.ban {
+		r.mu.Unlock()
+		return
+	}
+	r.removeNB(sn)
+	n.CacheData = nil
+	r.mu.Unlock()
+
+	sn.h.Release()
+}
+
+func (r *s3fifo) EvictNS(ns uint64) {
+	var evicted []*s3fifoNode
+
+	r.mu.Lock()
+	for _, q := range []*s3fifoQueue{&r.small, &r.main} {
+		for e := q.root.prev; e != &q.root; {
+			sn := e
+			e = e.prev
+			if sn.n.NS() == ns {
+				r.removeNB(sn)
+				sn.n.CacheData = nil
+				evicted = append(evicted, sn)
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	r.release(evicted, false)
+}
+
+func (r *s3fifo) EvictAll() {
+	var evicted []*s3fifoNode
+
+	r.mu.Lock()
+	for _, q := range []*s3fifoQueue{&r.small, &r.main} {
+		for sn := q.root.prev; sn != &q.root; sn = sn.prev {
+			sn.n.CacheData = nil
+			evicted = append(evicted, sn)
+		}
+	}
+	r.reset()
+	r.mu.Unlock()
+
+	r.release(evicted, false)
+}
+
+func (r *s3fifo) Close() error {
+	return nil
+}
+
+func (r *s3fifo) evictions() int64 {
+	return atomic.LoadInt64(&r.evicted)
+}
+
+// NewS3FIFO create a new S3-FIFO cache.
+//
+// Unlike LRU-cache, S3-FIFO is scan resistant: 'cache node' that are only
+// accessed once, such as by a full iteration, are quickly evicted through
+// a small queue and don't displace frequently accessed ones held by the
+// main queue.
+func NewS3FIFO(capacity int) Cacher {
+	r := &s3fifo{capacity: capacity}
+	r.reset()
+	return r
+}
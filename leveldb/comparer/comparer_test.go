@@ -0,0 +1,278 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func u64(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+func cat(a ...[]byte) []byte {
+	return bytes.Join(a, nil)
+}
+
+// Checks that the keys are in increasing order, and the Separator and
+// Successor contracts over each pair of keys.
+func testComparer(t *testing.T, c Comparer, keys [][]byte) {
+	for i, a := range keys {
+		for j, b := range keys {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if r := c.Compare(a, b); r < 0 && want >= 0 || r > 0 && want <= 0 || r == 0 && want != 0 {
+				t.Fatalf("%s: Compare(%q, %q) = %d, want sign %d", c.Name(), a, b, r, want)
+			}
+			if i >= j {
+				continue
+			}
+			dst := []byte("dst")
+			x := c.Separator(dst, a, b)
+			if x == nil {
+				continue
+			}
+			if !bytes.HasPrefix(x, dst) {
+				t.Fatalf("%s: Separator(%q, %q) = %q, doesn't append to dst", c.Name(), a, b, x)
+			}
+			x = x[len(dst):]
+			if c.Compare(a, x) > 0 || c.Compare(x, b) >= 0 {
+				t.Fatalf("%s: Separator(%q, %q) = %q, out of range", c.Name(), a, b, x)
+			}
+		}
+		if x := c.Successor(nil, a); x != nil && c.Compare(x, a) < 0 {
+			t.Fatalf("%s: Successor(%q) = %q, less than key", c.Name(), a, x)
+		}
+	}
+	if err := Validate(c, keys); err != nil {
+		t.Fatal("Validate: got error: ", err)
+	}
+}
+
+func TestDefaultComparer(t *testing.T) {
+	testComparer(t, DefaultComparer, [][]byte{
+		{}, {0}, {0, 0xff}, {1}, {1, 2}, {1, 3}, {2}, {0xff}, {0xff, 0xff},
+	})
+}
+
+func TestReverseComparer(t *testing.T) {
+	keys := [][]byte{
+		{}, {0xff, 0xff}, {0xff}, {2}, {1, 3}, {1, 2, 3}, {1, 2}, {1}, {0, 0xff}, {0, 1}, {0},
+	}
+	testComparer(t, ReverseComparer, keys)
+
+	for _, x := range []struct {
+		a, b, want []byte
+	}{
+		{[]byte("foo5"), []byte("bar"), []byte("f")},
+		{[]byte("foo5"), []byte("foo"), nil},
+		{[]byte("foo56"), []byte("foo"), []byte("foo5")},
+		{[]byte("foo56"), []byte("foo4"), []byte("foo5")},
+		{[]byte("foo5"), []byte("foo4"), nil},
+	} {
+		if got := ReverseComparer.Separator(nil, x.a, x.b); !bytes.Equal(got, x.want) {
+			t.Errorf("Separator(%q, %q) = %q, want %q", x.a, x.b, got, x.want)
+		}
+	}
+	if got := ReverseComparer.Successor(nil, []byte("foo")); string(got) != "f" {
+		t.Errorf("Successor(%q) = %q, want %q", "foo", got, "f")
+	}
+}
+
+func TestUint64Comparer(t *testing.T) {
+	testComparer(t, Uint64Comparer, [][]byte{
+		u64(0), u64(1), u64(0xff), u64(0x100), u64(1 << 40), u64(1<<40 + 1), u64(1<<64 - 1),
+	})
+}
+
+func TestCompositeComparer(t *testing.T) {
+	c := NewCompositeComparer(8, false)
+	keys := [][]byte{
+		{},
+		[]byte("a"),
+		cat([]byte("a"), u64(1)),
+		cat([]byte("a"), u64(2)),
+		cat([]byte("a"), u64(1<<40)),
+		[]byte("ab"),
+		cat([]byte("ab"), u64(0)),
+		cat([]byte("ab"), u64(1<<64-1)),
+		cat([]byte("b"), u64(0)),
+		cat([]byte("series-0001"), u64(5)),
+		cat([]byte("series-0002"), u64(1)),
+		cat([]byte("series-0003"), u64(1)),
+	}
+	testComparer(t, c, keys)
+
+	rc := NewCompositeComparer(8, true)
+	rkeys := [][]byte{
+		{},
+		[]byte("a"),
+		cat([]byte("a"), u64(1<<40)),
+		cat([]byte("a"), u64(2)),
+		cat([]byte("a"), u64(1)),
+		[]byte("ab"),
+		cat([]byte("ab"), u64(1<<64-1)),
+		cat([]byte("ab"), u64(0)),
+		cat([]byte("b"), u64(0)),
+	}
+	testComparer(t, rc, rkeys)
+	if c.Name() == rc.Name() || c.Name() == NewCompositeComparer(4, false).Name() {
+		t.Errorf("names of different orderings must differ: %q, %q", c.Name(), rc.Name())
+	}
+
+	// Separators between series are the least key of a prefix in between,
+	// a short prefix alone.
+	a, b := cat([]byte("series-0001-cpu"), u64(5)), cat([]byte("series-0003-mem"), u64(1))
+	if got, want := c.Separator(nil, a, b), cat([]byte("series-0002"), u64(0)); !bytes.Equal(got, want) {
+		t.Errorf("Separator(%q, %q) = %q, want %q", a, b, got, want)
+	}
+	a, b = cat([]byte("abc-cpu"), u64(5)), cat([]byte("abe-mem"), u64(1))
+	if got, want := c.Separator(nil, a, b), []byte("abd"); !bytes.Equal(got, want) {
+		t.Errorf("Separator(%q, %q) = %q, want %q", a, b, got, want)
+	}
+	a, b = cat([]byte("series-0001"), u64(5)), cat([]byte("series-0003"), u64(1))
+	if got := c.Separator(nil, a, b); got != nil {
+		t.Errorf("Separator(%q, %q) = %q, want nil", a, b, got)
+	}
+	// Keys of a series aren't shortened.
+	a, b = cat([]byte("a"), u64(1)), cat([]byte("a"), u64(1<<40))
+	if got := c.Separator(nil, a, b); got != nil {
+		t.Errorf("Separator(%q, %q) = %q, want nil", a, b, got)
+	}
+	a = cat([]byte("series-0001"), u64(5))
+	if got, want := c.Successor(nil, a), []byte("t"); !bytes.Equal(got, want) {
+		t.Errorf("Successor(%q) = %q, want %q", a, got, want)
+	}
+}
+
+// brokenComparer is the natural ordering, broken by the given functions.
+type brokenComparer struct {
+	compare   func(a, b []byte) int
+	separator func(dst, a, b []byte) []byte
+	successor func(dst, b []byte) []byte
+}
+
+func (c brokenComparer) Name() string { return "test.Broken" }
+
+func (c brokenComparer) Compare(a, b []byte) int {
+	if c.compare != nil {
+		return c.compare(a, b)
+	}
+	return bytes.Compare(a, b)
+}
+
+func (c brokenComparer) Separator(dst, a, b []byte) []byte {
+	if c.separator != nil {
+		return c.separator(dst, a, b)
+	}
+	return DefaultComparer.Separator(dst, a, b)
+}
+
+func (c brokenComparer) Successor(dst, b []byte) []byte {
+	if c.successor != nil {
+		return c.successor(dst, b)
+	}
+	return DefaultComparer.Successor(dst, b)
+}
+
+func TestValidate(t *testing.T) {
+	keys := [][]byte{
+		[]byte("AB"), []byte("a"), []byte("a\xff"), []byte("ab"), []byte("abc"), []byte("b"), []byte("bcd"),
+		[]byte("x\xff\xff"), []byte("y"), []byte("\xff"), []byte("\xff\xff\x00"),
+	}
+	for _, c := range []Comparer{DefaultComparer, ReverseComparer, Uint64Comparer, NewCompositeComparer(2, false), NewCompositeComparer(2, true)} {
+		if err := Validate(c, keys); err != nil {
+			t.Errorf("Validate %s: got error: %v", c.Name(), err)
+		}
+	}
+
+	for _, x := range []struct {
+		desc string
+		c    brokenComparer
+		want string
+	}{
+		{"case-insensitive", brokenComparer{compare: func(a, b []byte) int {
+			return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+		}}, "must not be equal"},
+		{"empty greatest", brokenComparer{compare: func(a, b []byte) int {
+			return ReverseComparer.Compare(b, a)
+		}}, "empty slice"},
+		{"not antisymmetric", brokenComparer{compare: func(a, b []byte) int {
+			if r := bytes.Compare(a, b); r != 0 && len(a) == 1 && len(b) == 1 {
+				return -1
+			}
+			return bytes.Compare(a, b)
+		}}, "antisymmetric"},
+		{"not transitive", brokenComparer{compare: func(a, b []byte) int {
+			// Compares by length if the lengths differ by one.
+			if d := len(a) - len(b); d == 1 || d == -1 {
+				return d
+			}
+			return bytes.Compare(a, b)
+		}}, "transitive"},
+		{"separator overwrites dst", brokenComparer{separator: func(dst, a, b []byte) []byte {
+			if dst = DefaultComparer.Separator(dst, a, b); dst != nil {
+				dst[0] = 'x'
+			}
+			return dst
+		}}, "doesn't append to dst"},
+		{"separator out of range", brokenComparer{separator: func(dst, a, b []byte) []byte {
+			return append(dst, b...)
+		}}, "not in [a, b)"},
+		{"separator modifies key", brokenComparer{separator: func(dst, a, b []byte) []byte {
+			if len(a) > 0 {
+				a[0]++
+			}
+			return nil
+		}}, "modified"},
+		{"successor less", brokenComparer{successor: func(dst, b []byte) []byte {
+			if len(b) > 0 {
+				return append(dst, b[:len(b)-1]...)
+			}
+			return nil
+		}}, "less than the key"},
+		{"panic", brokenComparer{successor: func(dst, b []byte) []byte {
+			return append(dst, b[1])
+		}}, "panic"},
+	} {
+		err := Validate(x.c, keys)
+		if err == nil || !strings.Contains(err.Error(), x.want) {
+			t.Errorf("Validate %s: got error %v, want %q", x.desc, err, x.want)
+		}
+	}
+}
+
+func TestValidateRandom(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	// Few byte values, so keys share prefixes and hit the byte limits.
+	alphabet := []byte{0, 1, 'a', 'b', 0xfe, 0xff}
+	for iter := 0; iter < 20; iter++ {
+		keys := make([][]byte, 100)
+		for i := range keys {
+			key := make([]byte, rnd.Intn(12))
+			for j := range key {
+				key[j] = alphabet[rnd.Intn(len(alphabet))]
+			}
+			keys[i] = key
+		}
+		for _, c := range []Comparer{DefaultComparer, ReverseComparer, Uint64Comparer, NewCompositeComparer(4, false), NewCompositeComparer(4, true)} {
+			if err := Validate(c, keys); err != nil {
+				t.Fatalf("Validate %s: got error: %v", c.Name(), err)
+			}
+		}
+	}
+}
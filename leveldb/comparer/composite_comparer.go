@@ -0,0 +1,102 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import (
+	"bytes"
+	"fmt"
+)
+
+type compositeComparer struct {
+	n             int
+	reverseSuffix bool
+}
+
+// Splits the key into its prefix and suffix, keys shorter than the suffix
+// are a prefix alone.
+func (c compositeComparer) split(key []byte) (prefix, suffix []byte) {
+	if len(key) < c.n {
+		return key, nil
+	}
+	return key[:len(key)-c.n], key[len(key)-c.n:]
+}
+
+func (c compositeComparer) Compare(a, b []byte) int {
+	ap, as := c.split(a)
+	bp, bs := c.split(b)
+	if r := bytes.Compare(ap, bp); r != 0 {
+		return r
+	}
+	if c.reverseSuffix && as != nil && bs != nil {
+		return bytes.Compare(bs, as)
+	}
+	return bytes.Compare(as, bs)
+}
+
+func (c compositeComparer) Name() string {
+	if c.reverseSuffix {
+		return fmt.Sprintf("leveldb.CompositeComparator.%d.reverse", c.n)
+	}
+	return fmt.Sprintf("leveldb.CompositeComparator.%d", c.n)
+}
+
+// Appends the least key of the prefix, which starts at dst[off:], to dst.
+// Returns nil unless the key is shorter than n.
+func (c compositeComparer) appendKey(dst []byte, off, n int) []byte {
+	size := len(dst) - off
+	if size < c.n {
+		// Prefix alone.
+		if size >= n {
+			return nil
+		}
+		return dst
+	}
+	if size+c.n >= n {
+		return nil
+	}
+	for i := 0; i < c.n; i++ {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+func (c compositeComparer) Separator(dst, a, b []byte) []byte {
+	// The suffix is fixed-width, only a key of a prefix in between is
+	// shorter.
+	ap, _ := c.split(a)
+	bp, _ := c.split(b)
+	off := len(dst)
+	if dst = DefaultComparer.Separator(dst, ap, bp); dst == nil {
+		return nil
+	}
+	return c.appendKey(dst, off, len(a))
+}
+
+func (c compositeComparer) Successor(dst, b []byte) []byte {
+	bp, _ := c.split(b)
+	off := len(dst)
+	if dst = DefaultComparer.Successor(dst, bp); dst == nil {
+		return nil
+	}
+	return c.appendKey(dst, off, len(b))
+}
+
+// NewCompositeComparer returns a comparer of keys composed of a prefix of
+// any length followed by a fixed-width suffix of n bytes, such as a series
+// identifier followed by a big-endian timestamp. Keys are ordered by prefix,
+// then by suffix; both in the natural ordering, or the reverse one for the
+// suffix if reverseSuffix is true. Keys shorter than n are a prefix alone,
+// ordered before the keys of the same prefix with a suffix.
+//
+// Unlike the natural ordering of such keys, the keys of a prefix are
+// contiguous even if the prefix is a prefix of another one. Their range
+// starts with the prefix followed by the least suffix, n zero bytes, or n
+// 0xff bytes if reverseSuffix; the prefix alone is the start only if
+// shorter than n.
+func NewCompositeComparer(n int, reverseSuffix bool) Comparer {
+	return compositeComparer{n, reverseSuffix}
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import "fmt"
+
+// Prefixer extracts prefix from keys. Prefixes are added to the table
+// filters, which allows iterations over a prefix to skip tables that
+// doesn't contain such prefix.
+type Prefixer interface {
+	// Name returns name of the prefixer.
+	//
+	// The name is stored in the tables, and prefix filtering will only be
+	// used with tables written by the prefixer with same name. Changes to
+	// the prefix extraction should change the name.
+	//
+	// Names starting with "leveldb." are reserved and should not be used
+	// by any users of this package.
+	Name() string
+
+	// Prefix returns prefix of the given key, or nil if the key has no
+	// prefix. Keys with the same prefix must be contiguous with respect to
+	// the comparer ordering.
+	//
+	// Contents of key should not by any means modified. The returned slice
+	// may refer to key.
+	Prefix(key []byte) []byte
+}
+
+type fixedPrefixer int
+
+func (p fixedPrefixer) Name() string {
+	return fmt.Sprintf("leveldb.FixedPrefix.%d", int(p))
+}
+
+func (p fixedPrefixer) Prefix(key []byte) []byte {
+	if len(key) < int(p) {
+		return nil
+	}
+	return key[:p]
+}
+
+// NewFixedPrefixer returns a prefixer that extracts the first n bytes of
+// keys. Keys shorter than n have no prefix.
+func NewFixedPrefixer(n int) Prefixer {
+	return fixedPrefixer(n)
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import "bytes"
+
+type reverseComparer struct{}
+
+func (reverseComparer) Compare(a, b []byte) int {
+	// The empty slice is still the least.
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) - len(b)
+	}
+	return bytes.Compare(b, a)
+}
+
+func (reverseComparer) Name() string {
+	return "leveldb.ReverseBytewiseComparator"
+}
+
+func (reverseComparer) Separator(dst, a, b []byte) []byte {
+	i, n := 0, len(a)
+	if n > len(b) {
+		n = len(b)
+	}
+	for ; i < n && a[i] == b[i]; i++ {
+	}
+	// Prefixes of a are bytewise less than a, the one ending at the first
+	// differing byte is still bytewise greater than b.
+	if i+1 < len(a) && (i == len(b) || a[i] > b[i]) {
+		return append(dst, a[:i+1]...)
+	}
+	return nil
+}
+
+func (reverseComparer) Successor(dst, b []byte) []byte {
+	// Prefixes of b are bytewise less than b.
+	if len(b) > 1 {
+		return append(dst, b[0])
+	}
+	return nil
+}
+
+// ReverseComparer is an implementation of the Comparer interface ordering
+// keys in the reverse of the natural ordering, except for the empty slice
+// which is still the least, see BasicComparer.
+var ReverseComparer = reverseComparer{}
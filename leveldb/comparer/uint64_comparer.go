@@ -0,0 +1,35 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import "bytes"
+
+type uint64Comparer struct{}
+
+func (uint64Comparer) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+func (uint64Comparer) Name() string {
+	return "leveldb.Uint64BigEndianComparator"
+}
+
+func (uint64Comparer) Separator(dst, a, b []byte) []byte {
+	return DefaultComparer.Separator(dst, a, b)
+}
+
+func (uint64Comparer) Successor(dst, b []byte) []byte {
+	return DefaultComparer.Successor(dst, b)
+}
+
+// Uint64Comparer is an implementation of the Comparer interface ordering
+// keys holding 8-byte big-endian encoded uint64 by their numeric value.
+// The numeric ordering of such keys matches the natural ordering, which is
+// used for keys of other lengths, only the name differs from
+// DefaultComparer; the DB records the comparer name, so that the DB can't
+// be opened with a comparer of another key encoding.
+var Uint64Comparer = uint64Comparer{}
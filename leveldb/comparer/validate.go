@@ -0,0 +1,127 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package comparer
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+type keysSorter struct {
+	keys [][]byte
+	cmp  BasicComparer
+}
+
+func (x *keysSorter) Len() int           { return len(x.keys) }
+func (x *keysSorter) Less(i, j int) bool { return x.cmp.Compare(x.keys[i], x.keys[j]) < 0 }
+func (x *keysSorter) Swap(i, j int)      { x.keys[i], x.keys[j] = x.keys[j], x.keys[i] }
+
+func sign(r int) int {
+	switch {
+	case r < 0:
+		return -1
+	case r > 0:
+		return 1
+	}
+	return 0
+}
+
+// Validate checks the comparer against the Comparer contracts over the
+// given keys, along with the empty slice:
+//   - Compare returns 0 for and only for keys of the same contents, and
+//     the empty slice is less than any non-empty slice.
+//   - Compare is antisymmetric and transitive, the keys sorted by Compare
+//     are in increasing order pairwise.
+//   - Separator of each pair of ordered keys a, b returns nil or appends
+//     to dst x such that a <= x < b, and Successor of each key b returns
+//     nil or appends x such that x >= b. Neither modifies the keys.
+//
+// It returns an error describing the first violation found, or nil. Panics
+// of the comparer are reported as errors. The keys must be valid keys for
+// the comparer, the more varied the better; the checks grow with the square
+// of the number of keys.
+func Validate(c Comparer, keys [][]byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("comparer %s: panic: %v", c.Name(), r)
+		}
+	}()
+	errorf := func(format string, args ...interface{}) error {
+		return fmt.Errorf("comparer %s: %s", c.Name(), fmt.Sprintf(format, args...))
+	}
+
+	// Distinct keys, copied so modifications are detected.
+	ks := [][]byte{{}}
+	seen := map[string]bool{"": true}
+	for _, key := range keys {
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			ks = append(ks, append([]byte{}, key...))
+		}
+	}
+	for _, a := range ks {
+		if r := c.Compare(a, a); r != 0 {
+			return errorf("Compare(%q, %q) = %d, want 0", a, a, r)
+		}
+		if r := c.Compare(nil, a); len(a) > 0 && r >= 0 {
+			return errorf("Compare(%q, %q) = %d, the empty slice must be the least", "", a, r)
+		}
+	}
+
+	sort.Sort(&keysSorter{ks, c})
+	for i, a := range ks {
+		for _, b := range ks[i+1:] {
+			r0, r1 := c.Compare(a, b), c.Compare(b, a)
+			switch {
+			case r0 == 0 || r1 == 0:
+				return errorf("Compare(%q, %q) = %d and Compare(%q, %q) = %d, distinct keys must not be equal", a, b, r0, b, a, r1)
+			case sign(r0) != -sign(r1):
+				return errorf("Compare(%q, %q) = %d and Compare(%q, %q) = %d, not antisymmetric", a, b, r0, b, a, r1)
+			case r0 > 0:
+				return errorf("Compare(%q, %q) = %d once sorted, not transitive", a, b, r0)
+			}
+		}
+	}
+
+	dst := []byte("dst")
+	for i, a := range ks {
+		a0 := append([]byte{}, a...)
+		for _, b := range ks[i+1:] {
+			b0 := append([]byte{}, b...)
+			x := c.Separator(dst[:len(dst):len(dst)], a, b)
+			if !bytes.Equal(a, a0) || !bytes.Equal(b, b0) {
+				return errorf("Separator(%q, %q) modified the keys", a0, b0)
+			}
+			if x == nil {
+				continue
+			}
+			if !bytes.HasPrefix(x, dst) {
+				return errorf("Separator(%q, %q, %q) = %q, doesn't append to dst", dst, a, b, x)
+			}
+			x = x[len(dst):]
+			if c.Compare(a, x) > 0 || c.Compare(x, b) >= 0 {
+				return errorf("Separator(%q, %q) = %q, not in [a, b)", a, b, x)
+			}
+		}
+		x := c.Successor(dst[:len(dst):len(dst)], a)
+		if !bytes.Equal(a, a0) {
+			return errorf("Successor(%q) modified the key", a0)
+		}
+		if x == nil {
+			continue
+		}
+		if !bytes.HasPrefix(x, dst) {
+			return errorf("Successor(%q, %q) = %q, doesn't append to dst", dst, a, x)
+		}
+		x = x[len(dst):]
+		if c.Compare(x, a) < 0 {
+			return errorf("Successor(%q) = %q, less than the key", a, x)
+		}
+	}
+	return nil
+}
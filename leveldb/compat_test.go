@@ -0,0 +1,474 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	snappy "github.com/FactomProject/snappy-go"
+
+	"github.com/FactomProject/goleveldb/leveldb/filter"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+// The checks below decode the files following the documentation of the
+// C++ LevelDB library (doc/log_format.md, doc/table_format.md and
+// db/version_edit.cc), independently of the implementation of this
+// package.
+
+var cppCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+func cppMaskedCRC(b []byte) uint32 {
+	c := crc32.Checksum(b, cppCRCTable)
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+// Returns the records of a log file, as read by the C++ log::Reader.
+func cppReadLog(data []byte) (records [][]byte, err error) {
+	const blockSize = 32 * 1024
+	var rec []byte
+	for off := 0; off < len(data); {
+		if left := blockSize - off%blockSize; left < 7 {
+			// Trailer of the block.
+			off += left
+			continue
+		}
+		if off+7 > len(data) {
+			return nil, fmt.Errorf("truncated header at %d", off)
+		}
+		length := int(binary.LittleEndian.Uint16(data[off+4:]))
+		t := data[off+6]
+		end := off + 7 + length
+		if end > len(data) || (end-1)/blockSize != off/blockSize {
+			return nil, fmt.Errorf("bad chunk length at %d", off)
+		}
+		if t < 1 || t > 4 {
+			return nil, fmt.Errorf("unknown chunk type %d at %d", t, off)
+		}
+		if cppMaskedCRC(data[off+6:end]) != binary.LittleEndian.Uint32(data[off:]) {
+			return nil, fmt.Errorf("checksum mismatch at %d", off)
+		}
+		rec = append(rec, data[off+7:end]...)
+		if t == 1 || t == 4 {
+			records = append(records, rec)
+			rec = nil
+		}
+		off = end
+	}
+	if rec != nil {
+		return nil, fmt.Errorf("partial record")
+	}
+	return
+}
+
+// Checks the version edits of a manifest only hold tags known to the C++
+// VersionEdit::DecodeFrom.
+func cppCheckManifest(data []byte) error {
+	records, err := cppReadLog(data)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		r := bytes.NewReader(rec)
+		skipBytes := func() error {
+			n, err := binary.ReadUvarint(r)
+			if err == nil && int64(n) > int64(r.Len()) {
+				err = fmt.Errorf("bad length")
+			}
+			if err == nil {
+				_, err = r.Seek(int64(n), 1)
+			}
+			return err
+		}
+		skipVarints := func(n int) error {
+			for i := 0; i < n; i++ {
+				if _, err := binary.ReadUvarint(r); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for r.Len() > 0 {
+			tag, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			switch tag {
+			case 1: // kComparator
+				err = skipBytes()
+			case 2, 3, 4, 9: // kLogNumber, kNextFileNumber, kLastSequence, kPrevLogNumber
+				err = skipVarints(1)
+			case 5: // kCompactPointer
+				if err = skipVarints(1); err == nil {
+					err = skipBytes()
+				}
+			case 6: // kDeletedFile
+				err = skipVarints(2)
+			case 7: // kNewFile
+				if err = skipVarints(3); err == nil {
+					if err = skipBytes(); err == nil {
+						err = skipBytes()
+					}
+				}
+			default:
+				return fmt.Errorf("unknown version edit tag %d", tag)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Checks the write batches of a journal only hold puts and deletions.
+func cppCheckJournal(data []byte) error {
+	records, err := cppReadLog(data)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if len(rec) < 12 {
+			return fmt.Errorf("batch too short")
+		}
+		r := bytes.NewReader(rec[12:])
+		for n := binary.LittleEndian.Uint32(rec[8:]); n > 0; n-- {
+			t, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			if t != 0 && t != 1 {
+				return fmt.Errorf("unknown batch record type %d", t)
+			}
+			for i := 0; i <= int(t); i++ {
+				l, err := binary.ReadUvarint(r)
+				if err != nil || int64(l) > int64(r.Len()) {
+					return fmt.Errorf("bad batch record")
+				}
+				r.Seek(int64(l), 1)
+			}
+		}
+		if r.Len() != 0 {
+			return fmt.Errorf("trailing batch data")
+		}
+	}
+	return nil
+}
+
+// Returns the contents of the block of the given handle, as read by the
+// C++ ReadBlock.
+func cppReadBlock(data, handle []byte) ([]byte, error) {
+	offset, n := binary.Uvarint(handle)
+	size, m := binary.Uvarint(handle[n:])
+	if n <= 0 || m <= 0 || offset+size+5 > uint64(len(data)) {
+		return nil, fmt.Errorf("bad block handle")
+	}
+	b := data[offset : offset+size+5]
+	if cppMaskedCRC(b[:size+1]) != binary.LittleEndian.Uint32(b[size+1:]) {
+		return nil, fmt.Errorf("block checksum mismatch at %d", offset)
+	}
+	switch b[size] {
+	case 0:
+		return b[:size], nil
+	case 1:
+		return snappy.Decode(nil, b[:size])
+	}
+	return nil, fmt.Errorf("unknown compression type %d at %d", b[size], offset)
+}
+
+// Returns the entries of a block.
+func cppBlockEntries(b []byte) (keys, values [][]byte, err error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("block too short")
+	}
+	nrestarts := int(binary.LittleEndian.Uint32(b[len(b)-4:]))
+	end := len(b) - 4*(nrestarts+1)
+	if end < 0 {
+		return nil, nil, fmt.Errorf("bad restarts")
+	}
+	var key []byte
+	for off := 0; off < end; {
+		shared, n0 := binary.Uvarint(b[off:])
+		unshared, n1 := binary.Uvarint(b[off+n0:])
+		vlen, n2 := binary.Uvarint(b[off+n0+n1:])
+		off += n0 + n1 + n2
+		if n0 <= 0 || n1 <= 0 || n2 <= 0 || shared > uint64(len(key)) || off+int(unshared+vlen) > end {
+			return nil, nil, fmt.Errorf("bad block entry")
+		}
+		key = append(key[:shared:shared], b[off:off+int(unshared)]...)
+		keys = append(keys, key)
+		values = append(values, b[off+int(unshared):off+int(unshared+vlen)])
+		off += int(unshared + vlen)
+	}
+	return
+}
+
+// Checks a table is readable by the C++ Table, and its keys are internal
+// keys of puts and deletions. Returns the number of entries.
+func cppCheckTable(data []byte) (int, error) {
+	if len(data) < 48 || binary.LittleEndian.Uint64(data[len(data)-8:]) != 0xdb4775248b80fb57 {
+		return 0, fmt.Errorf("bad magic")
+	}
+	footer := data[len(data)-48:]
+	_, n := binary.Uvarint(footer)
+	_, m := binary.Uvarint(footer[n:])
+	metaindexHandle := footer[:n+m]
+	_, n1 := binary.Uvarint(footer[n+m:])
+	_, m1 := binary.Uvarint(footer[n+m+n1:])
+	indexHandle := footer[n+m : n+m+n1+m1]
+
+	metaindex, err := cppReadBlock(data, metaindexHandle)
+	if err != nil {
+		return 0, err
+	}
+	keys, values, err := cppBlockEntries(metaindex)
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if strings.HasPrefix(string(key), "filter.") {
+			if _, err := cppReadBlock(data, values[i]); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	index, err := cppReadBlock(data, indexHandle)
+	if err != nil {
+		return 0, err
+	}
+	_, handles, err := cppBlockEntries(index)
+	if err != nil {
+		return 0, err
+	}
+	entries := 0
+	for _, handle := range handles {
+		b, err := cppReadBlock(data, handle)
+		if err != nil {
+			return 0, err
+		}
+		keys, _, err := cppBlockEntries(b)
+		if err != nil {
+			return 0, err
+		}
+		for _, key := range keys {
+			if len(key) < 8 || key[len(key)-8] > 1 {
+				return 0, fmt.Errorf("bad internal key %q", key)
+			}
+		}
+		entries += len(keys)
+	}
+	return entries, nil
+}
+
+func cppCopyDB(t *testing.T, src, dst string) {
+	fis, err := ioutil.ReadDir(src)
+	if err != nil {
+		t.Fatal("ReadDir: got error: ", err)
+	}
+	for _, fi := range fis {
+		data, err := ioutil.ReadFile(filepath.Join(src, fi.Name()))
+		if err != nil {
+			t.Fatal("ReadFile: got error: ", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dst, fi.Name()), data, 0644); err != nil {
+			t.Fatal("WriteFile: got error: ", err)
+		}
+	}
+}
+
+func TestLevelDBCompatible_ReadGolden(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "goleveldbtestCompat")
+	if err != nil {
+		t.Fatal("TempDir: got error: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+	// The golden files are generated by testdata/cppdb/gen.go, not by the
+	// C++ library.
+	cppCopyDB(t, filepath.Join("testdata", "cppdb", "db"), dbpath)
+
+	// The first data block of the table is snappy compressed.
+	tdata, err := ioutil.ReadFile(filepath.Join(dbpath, "000005.ldb"))
+	if err != nil {
+		t.Fatal("ReadFile: got error: ", err)
+	}
+	if n, err := cppCheckTable(tdata); err != nil || n != 5 {
+		t.Fatalf("golden table: got %d entries, err %v; want 5", n, err)
+	}
+	footer := tdata[len(tdata)-48:]
+	_, n := binary.Uvarint(footer)
+	_, m := binary.Uvarint(footer[n:])
+	index, err := cppReadBlock(tdata, footer[n+m:])
+	if err != nil {
+		t.Fatal("golden table index: got error: ", err)
+	}
+	_, handles, err := cppBlockEntries(index)
+	if err != nil || len(handles) != 2 {
+		t.Fatalf("golden table index: got %d handles, err %v; want 2", len(handles), err)
+	}
+	offset, k := binary.Uvarint(handles[0])
+	size, _ := binary.Uvarint(handles[0][k:])
+	if typ := tdata[offset+size]; typ != 1 {
+		t.Fatalf("golden table first data block: got compression type %d, want snappy", typ)
+	}
+
+	db, err := OpenFile(dbpath, &opt.Options{
+		ErrorIfMissing:    true,
+		Filter:            filter.NewBloomFilter(10),
+		LevelDBCompatible: true,
+	})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer db.Close()
+
+	// The keys of the table are found through its bloom filter.
+	for key, want := range map[string]string{"bar": "v1", "baz": "", "big": strings.Repeat("v5", 500), "foo": "", "qux": "v4"} {
+		value, err := db.Get([]byte(key), nil)
+		switch {
+		case want == "" && err != ErrNotFound:
+			t.Errorf("Get(%q): got value %q, err %v; want not found", key, value, err)
+		case want != "" && (err != nil || string(value) != want):
+			t.Errorf("Get(%q): got value %q, err %v; want %q", key, value, err, want)
+		}
+	}
+	var keys []string
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		t.Fatal("iterator: got error: ", err)
+	}
+	if fmt.Sprint(keys) != "[bar big qux]" {
+		t.Errorf("iterated keys: got %v, want [bar big qux]", keys)
+	}
+	// The journal batch holds sequence numbers 11 and 12.
+	if seq := db.seq; seq < 12 {
+		t.Errorf("sequence number: got %d, want at least 12", seq)
+	}
+}
+
+func TestLevelDBCompatible_Write(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "goleveldbtestCompat")
+	if err != nil {
+		t.Fatal("TempDir: got error: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	o := &opt.Options{
+		Filter:              filter.NewBloomFilter(10),
+		LevelDBCompatible:   true,
+		WriteBuffer:         64 * opt.KiB,
+		CompactionTableSize: 64 * opt.KiB,
+	}
+	db, err := OpenFile(dbpath, o)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 2000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(value), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+		if i%3 == 0 {
+			if err := db.Delete([]byte(fmt.Sprintf("key%05d", i/2)), nil); err != nil {
+				t.Fatal("Delete: got error: ", err)
+			}
+		}
+	}
+	if err := db.DeleteRange([]byte("a"), []byte("b"), nil); err != ErrNotCompatible {
+		t.Errorf("DeleteRange: got %v, want ErrNotCompatible", err)
+	}
+	batch := new(Batch)
+	batch.DeleteRange([]byte("a"), []byte("b"))
+	if err := db.Write(batch, nil); err != ErrNotCompatible {
+		t.Errorf("Write range deletion: got %v, want ErrNotCompatible", err)
+	}
+	if _, err := db.CreateNamedSnapshot("snap"); err != ErrNotCompatible {
+		t.Errorf("CreateNamedSnapshot: got %v, want ErrNotCompatible", err)
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	for i := 2000; i < 2100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(value), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	fis, err := ioutil.ReadDir(dbpath)
+	if err != nil {
+		t.Fatal("ReadDir: got error: ", err)
+	}
+	var journals, manifests, tables, entries int
+	for _, fi := range fis {
+		data, err := ioutil.ReadFile(filepath.Join(dbpath, fi.Name()))
+		if err != nil {
+			t.Fatal("ReadFile: got error: ", err)
+		}
+		switch name := fi.Name(); {
+		case strings.HasSuffix(name, ".log"):
+			journals++
+			err = cppCheckJournal(data)
+		case strings.HasPrefix(name, "MANIFEST-"):
+			manifests++
+			err = cppCheckManifest(data)
+		case strings.HasSuffix(name, ".ldb"):
+			var n int
+			n, err = cppCheckTable(data)
+			tables++
+			entries += n
+		}
+		if err != nil {
+			t.Errorf("%s: %v", fi.Name(), err)
+		}
+	}
+	if journals == 0 || manifests == 0 || tables == 0 || entries == 0 {
+		t.Errorf("files checked: got %d journals, %d manifests, %d tables of %d entries", journals, manifests, tables, entries)
+	}
+}
+
+func TestLevelDBCompatible_Options(t *testing.T) {
+	for _, o := range []*opt.Options{
+		{Checksum: opt.XXHash64Checksum},
+		{JournalBlockSize: 4 * opt.KiB},
+		{JournalRecycle: 2},
+		{ValueLogThreshold: opt.KiB},
+		{CorruptionPolicy: opt.CorruptionQuarantine},
+		{ComparerVersion: 1},
+		{
+			CompressionPerLevel: []opt.Compression{opt.DefaultCompression, opt.UserCompression(0)},
+			Compressors:         map[opt.Compression]opt.Compressor{opt.UserCompression(0): &countingCompressor{}},
+		},
+	} {
+		db, err := Open(storage.NewMemStorage(), o)
+		if err != nil {
+			t.Fatalf("Open(%+v): got error: %v", o, err)
+		}
+		db.Close()
+		o.LevelDBCompatible = true
+		if db, err := Open(storage.NewMemStorage(), o); err == nil {
+			db.Close()
+			t.Errorf("Open(%+v): got no error in LevelDB compatible mode", o)
+		}
+	}
+}
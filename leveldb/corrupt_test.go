@@ -11,11 +11,23 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/onsi/gomega"
+
+	"github.com/FactomProject/goleveldb/leveldb/errors"
 	"github.com/FactomProject/goleveldb/leveldb/filter"
 	"github.com/FactomProject/goleveldb/leveldb/opt"
 	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/table"
+	"github.com/FactomProject/goleveldb/leveldb/testutil"
+	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
 const ctValSize = 1000
@@ -30,6 +42,14 @@ func newDbCorruptHarnessWopt(t *testing.T, o *opt.Options) *dbCorruptHarness {
 	return h
 }
 
+func (h *dbCorruptHarness) init(t *testing.T, o *opt.Options) {
+	gomega.RegisterTestingT(t)
+	stor := testutil.NewStorage()
+	// Catch the files the DB depends on before they are durable.
+	stor.AuditDurability(func(msg string) { t.Error(msg) })
+	h.initStor(t, stor, o)
+}
+
 func newDbCorruptHarness(t *testing.T) *dbCorruptHarness {
 	return newDbCorruptHarnessWopt(t, &opt.Options{
 		BlockCacheCapacity: 100,
@@ -161,6 +181,14 @@ func (h *dbCorruptHarness) corrupt(ft storage.FileType, fi, offset, n int) {
 		t.Fatal("cannot write new file: ", err)
 	}
 	w.Close()
+	h.syncStor()
+}
+
+// Syncs the storage, so the files changed by the test are durable.
+func (h *dbCorruptHarness) syncStor() {
+	if err := h.stor.Sync(); err != nil {
+		h.t.Fatal("sync storage: ", err)
+	}
 }
 
 func (h *dbCorruptHarness) removeAll(ft storage.FileType) {
@@ -173,6 +201,7 @@ func (h *dbCorruptHarness) removeAll(ft storage.FileType) {
 			h.t.Error("remove file: ", err)
 		}
 	}
+	h.syncStor()
 }
 
 func (h *dbCorruptHarness) forceRemoveAll(ft storage.FileType) {
@@ -185,6 +214,7 @@ func (h *dbCorruptHarness) forceRemoveAll(ft storage.FileType) {
 			h.t.Error("remove file: ", err)
 		}
 	}
+	h.syncStor()
 }
 
 func (h *dbCorruptHarness) removeOne(ft storage.FileType) {
@@ -197,6 +227,7 @@ func (h *dbCorruptHarness) removeOne(ft storage.FileType) {
 	if err := h.stor.Remove(fd); err != nil {
 		h.t.Error("remove file: ", err)
 	}
+	h.syncStor()
 }
 
 func (h *dbCorruptHarness) check(min, max int) {
@@ -244,6 +275,49 @@ func TestCorruptDB_Journal(t *testing.T) {
 	h.check(36, 36)
 }
 
+func TestCorruptDB_WALRecoveryMode(t *testing.T) {
+	const (
+		tail   = -100
+		middle = 32*1024 + 1000
+	)
+	tests := []struct {
+		mode     opt.WALRecoveryMode
+		offset   int
+		fail     bool
+		min, max int
+	}{
+		{opt.WALTolerateCorruptedTailRecords, tail, false, 99, 99},
+		{opt.WALTolerateCorruptedTailRecords, middle, true, 0, 0},
+		{opt.WALAbsoluteConsistency, tail, true, 0, 0},
+		{opt.WALAbsoluteConsistency, middle, true, 0, 0},
+		{opt.WALPointInTimeRecovery, tail, false, 99, 99},
+		{opt.WALPointInTimeRecovery, middle, false, 32, 32},
+		{opt.WALSkipAnyCorruptedRecords, tail, false, 99, 99},
+		{opt.WALSkipAnyCorruptedRecords, middle, false, 68, 68},
+		{opt.WALRecoveryDefault, middle, false, 68, 68},
+	}
+	for _, test := range tests {
+		t.Logf("mode=%v offset=%d", test.mode, test.offset)
+		h := newDbCorruptHarness(t)
+		h.build(100)
+		h.closeDB()
+		h.corrupt(storage.TypeJournal, -1, test.offset, 1)
+
+		h.o.WALRecoveryMode = test.mode
+		err := h.openDB0()
+		if test.fail {
+			if !errors.IsCorrupted(err) {
+				t.Errorf("mode=%v offset=%d: Open: got error %v, want corrupted error", test.mode, test.offset, err)
+			}
+		} else if err != nil {
+			t.Errorf("mode=%v offset=%d: Open: got error: %v", test.mode, test.offset, err)
+		} else {
+			h.check(test.min, test.max)
+		}
+		h.close()
+	}
+}
+
 func TestCorruptDB_Table(t *testing.T) {
 	h := newDbCorruptHarness(t)
 	defer h.close()
@@ -259,6 +333,55 @@ func TestCorruptDB_Table(t *testing.T) {
 	h.check(99, 99)
 }
 
+func TestCorruptDB_ParanoidChecks(t *testing.T) {
+	h := newDbCorruptHarness(t)
+	defer h.close()
+
+	h.build(100)
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	h.closeDB()
+	h.corrupt(storage.TypeTable, -1, 100, 1)
+
+	// Block checksum is not verified, the corrupted block is cached.
+	h.openDB()
+	if v, err := h.db.Get(tkey(0), nil); err != nil || bytes.Equal(v, tval(0, ctValSize)) {
+		t.Fatalf("Get: got corrupted=%v error=%v, want corrupted value", !bytes.Equal(v, tval(0, ctValSize)), err)
+	}
+
+	checkErr := func(err error) {
+		cerr, ok := errors.AsCorrupted(err)
+		if !ok {
+			t.Fatalf("got error %v, want corrupted", err)
+		}
+		terr, ok := cerr.Err.(*table.ErrCorrupted)
+		if !ok {
+			t.Fatalf("got %T, want *table.ErrCorrupted", cerr.Err)
+		}
+		if cerr.Fd.Type != storage.TypeTable || cerr.Offset != 0 || cerr.Size == 0 || cerr.Size != terr.Size {
+			t.Fatalf("invalid corruption context %v", err)
+		}
+		if !strings.HasPrefix(cerr.Reason, "checksum mismatch") {
+			t.Fatalf("invalid corruption reason %q", cerr.Reason)
+		}
+	}
+	ro := &opt.ReadOptions{Strict: opt.StrictParanoidChecks | opt.StrictReader}
+	_, err := h.db.Get(tkey(0), ro)
+	checkErr(err)
+	iter := h.db.NewIterator(nil, ro)
+	for iter.Next() {
+	}
+	checkErr(iter.Error())
+	iter.Release()
+
+	h.closeDB()
+	h.o.Strict = opt.StrictParanoidChecks | opt.StrictReader
+	h.openDB()
+	_, err = h.db.Get(tkey(0), nil)
+	checkErr(err)
+}
+
 func TestCorruptDB_TableIndex(t *testing.T) {
 	h := newDbCorruptHarness(t)
 	defer h.close()
@@ -272,6 +395,57 @@ func TestCorruptDB_TableIndex(t *testing.T) {
 	h.check(5000, 9999)
 }
 
+func TestCorruptDB_SkipCorrupted(t *testing.T) {
+	h := newDbCorruptHarnessWopt(t, &opt.Options{
+		BlockCacheCapacity: 100,
+		Strict:             opt.DefaultStrict,
+	})
+	defer h.close()
+
+	h.build(100)
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	h.closeDB()
+	h.corrupt(storage.TypeTable, -1, 100, 1)
+	h.openDB()
+
+	scan := func(ro *opt.ReadOptions) (good, last int, err error) {
+		iter := h.db.NewIterator(nil, ro)
+		defer iter.Release()
+		last = -1
+		for iter.Next() {
+			fmt.Sscanf(string(iter.Key()), "%d", &last)
+			if bytes.Equal(iter.Value(), tval(last, ctValSize)) {
+				good++
+			}
+		}
+		return good, last, iter.Error()
+	}
+
+	// The corrupted block halts the iteration.
+	if good, _, err := scan(nil); good != 0 || !errors.IsCorrupted(err) {
+		t.Fatalf("strict scan: got %d good entries, error %v", good, err)
+	}
+
+	var skipped []error
+	good, last, err := scan(&opt.ReadOptions{
+		SkipCorrupted: true,
+		OnSkipCorrupted: func(err error) {
+			skipped = append(skipped, err)
+		},
+	})
+	if good < 90 || good >= 100 || last != 99 {
+		t.Errorf("skipping scan: got %d good entries, last key %d", good, last)
+	}
+	if len(skipped) != 1 || !errors.IsCorrupted(skipped[0]) {
+		t.Fatalf("invalid skipped corruptions %v", skipped)
+	}
+	if err != skipped[0] {
+		t.Errorf("iterator error: got %v, want the skipped corruption %v", err, skipped[0])
+	}
+}
+
 func TestCorruptDB_MissingManifest(t *testing.T) {
 	rnd := rand.New(rand.NewSource(0x0badda7a))
 	h := newDbCorruptHarnessWopt(t, &opt.Options{
@@ -361,6 +535,10 @@ func TestCorruptDB_CorruptedManifest(t *testing.T) {
 	h.closeDB()
 	h.corrupt(storage.TypeManifest, -1, 0, 1000)
 	h.openAssert(false)
+	_, err := Open(h.stor, h.o)
+	if cerr, ok := errors.AsCorrupted(err); !ok || cerr.Fd.Type != storage.TypeManifest || cerr.Reason == "" {
+		t.Errorf("Open: got error %v, want manifest corruption", err)
+	}
 
 	h.recover()
 	h.getVal("foo", "hello")
@@ -382,6 +560,77 @@ func TestCorruptDB_CompactionInputError(t *testing.T) {
 	h.check(10000, 10000)
 }
 
+func TestCorruptDB_CompactionQuarantine(t *testing.T) {
+	var (
+		mu          sync.Mutex
+		quarantined []opt.TableInfo
+	)
+	h := newDbCorruptHarnessWopt(t, &opt.Options{
+		Strict:           opt.StrictJournalChecksum | opt.StrictBlockChecksum,
+		CorruptionPolicy: opt.CorruptionQuarantine,
+		Compression:      opt.NoCompression,
+		EventListener: &opt.EventListener{
+			OnTableQuarantined: func(info opt.TableInfo, err error) {
+				if !errors.IsCorrupted(err) {
+					t.Errorf("OnTableQuarantined: got error %v, want corrupted", err)
+				}
+				mu.Lock()
+				quarantined = append(quarantined, info)
+				mu.Unlock()
+			},
+		},
+	})
+	defer h.close()
+
+	h.build(100)
+	h.compactMem()
+	h.closeDB()
+	h.corrupt(storage.TypeTable, -1, 100, 1)
+	fds, _ := h.stor.List(storage.TypeTable)
+	if len(fds) != 1 {
+		t.Fatalf("invalid number of tables, want=1 got=%d", len(fds))
+	}
+	bad := fds[0]
+
+	h.openDB()
+	h.put("z", "v1")
+	h.compactMem()
+	h.tablesPerLevel("2")
+	h.compactRangeAt(0, "", "")
+
+	mu.Lock()
+	if len(quarantined) != 1 || quarantined[0].Num != bad.Num || quarantined[0].Level != 0 {
+		t.Fatalf("invalid quarantined tables %v, want @%d", quarantined, bad.Num)
+	}
+	mu.Unlock()
+	// The DB keeps serving from other tables and accepting writes.
+	h.tablesPerLevel("1")
+	h.getVal("z", "v1")
+	h.get(string(tkey(50)), false)
+	h.put("y", "v1")
+	h.getVal("y", "v1")
+
+	// The table file is kept, even after reopen.
+	h.reopenDB()
+	fds, _ = h.stor.List(storage.TypeTable)
+	var kept bool
+	for _, fd := range fds {
+		kept = kept || fd == bad
+	}
+	if !kept {
+		t.Fatal("quarantined table is removed")
+	}
+	h.getVal("y", "v1")
+	h.getVal("z", "v1")
+	h.get(string(tkey(50)), false)
+	h.closeDB()
+
+	// Recover salvages entries of the quarantined table.
+	h.recover()
+	h.check(90, 99)
+	h.getVal("z", "v1")
+}
+
 func TestCorruptDB_UnrelatedKeys(t *testing.T) {
 	h := newDbCorruptHarness(t)
 	defer h.close()
@@ -494,3 +743,221 @@ func TestCorruptDB_RecoverTable(t *testing.T) {
 	}
 	h.check(985, 985)
 }
+
+func TestCorruptDB_Repair(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestRepair-%d", os.Getuid()))
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &opt.Options{
+		CompactionTableSize: 40 * opt.KiB,
+		Compression:         opt.NoCompression,
+	}
+	db, err := OpenFile(dir, o)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	const n = 300
+	for i := 0; i < n; i++ {
+		if err := db.Put(tkey(i), tval(i, ctValSize), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	tables, err := filepath.Glob(filepath.Join(dir, "*.ldb"))
+	if err != nil {
+		t.Fatal("Glob: got error: ", err)
+	}
+	if len(tables) < 3 {
+		t.Fatalf("too few tables, got=%d", len(tables))
+	}
+	sort.Strings(tables)
+	first, last := tables[0], tables[len(tables)-1]
+
+	tf, err := table.OpenFile(last, o)
+	if err != nil {
+		t.Fatal("table.OpenFile: got error: ", err)
+	}
+	lastEntries, _ := tf.NumEntries()
+	tf.Close()
+
+	corrupt := func(path string, offset int64) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal("OpenFile: got error: ", err)
+		}
+		defer f.Close()
+		if offset < 0 {
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal("Stat: got error: ", err)
+			}
+			offset += fi.Size()
+		}
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, offset); err != nil {
+			t.Fatal("ReadAt: got error: ", err)
+		}
+		b[0] ^= 0x80
+		if _, err := f.WriteAt(b, offset); err != nil {
+			t.Fatal("WriteAt: got error: ", err)
+		}
+	}
+	// Corrupted first data block, the table is rebuilt.
+	corrupt(first, 100)
+	// Corrupted footer, the table is dropped.
+	corrupt(last, -1)
+
+	if err := Repair(dir, o); err != nil {
+		t.Fatal("Repair: got error: ", err)
+	}
+	for _, path := range []string{first, last} {
+		if _, err := os.Stat(filepath.Join(dir, "lost", filepath.Base(path))); err != nil {
+			t.Errorf("table is not moved to lost directory: %v", err)
+		}
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Errorf("rebuilt table is missing: %v", err)
+	}
+	if _, err := os.Stat(last); !os.IsNotExist(err) {
+		t.Errorf("dropped table still exist: %v", err)
+	}
+
+	db, err = OpenFile(dir, o)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer db.Close()
+	var good int
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		k := 0
+		fmt.Sscanf(string(iter.Key()), "%d", &k)
+		if !bytes.Equal(iter.Value(), tval(k, ctValSize)) {
+			t.Errorf("invalid value of key %q", iter.Key())
+		}
+		good++
+	}
+	if err := iter.Error(); err != nil {
+		t.Error("iterator error: ", err)
+	}
+	iter.Release()
+	// Entries of the corrupted block are lost.
+	max := n - int(lastEntries) - 1
+	min := max + 1 - o.GetBlockSize()/ctValSize - 1
+	if good < min || good > max {
+		t.Errorf("good entries number not in range, want=%d..%d got=%d", min, max, good)
+	}
+}
+
+func TestCorruptDB_VerifyChecksums(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestVerify-%d", os.Getuid()))
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &opt.Options{
+		CompactionTableSize: 40 * opt.KiB,
+		Compression:         opt.NoCompression,
+	}
+	db, err := OpenFile(dir, o)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer db.Close()
+	const n = 300
+	for i := 0; i < n; i++ {
+		if err := db.Put(tkey(i), tval(i, ctValSize), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(tkey(i), tval(i, ctValSize), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+
+	rep, err := db.VerifyChecksums(nil)
+	if err != nil {
+		t.Fatal("VerifyChecksums: got error: ", err)
+	}
+	if !rep.OK() {
+		t.Fatalf("VerifyChecksums: got corruptions: %v", rep.Corrupted)
+	}
+	if rep.Tables < 3 || rep.Journals != 1 {
+		t.Fatalf("VerifyChecksums: invalid number of verified files, tables=%d journals=%d", rep.Tables, rep.Journals)
+	}
+	if rep.Size < n*ctValSize {
+		t.Fatalf("VerifyChecksums: too few bytes read, got=%d", rep.Size)
+	}
+
+	// Rate limited.
+	rate := int(rep.Size * 5)
+	rep, err = db.VerifyChecksums(&opt.VerifyOptions{BytesPerSec: rate})
+	if err != nil {
+		t.Fatal("VerifyChecksums: got error: ", err)
+	}
+	if min := time.Duration(rep.Size*int64(time.Second)/int64(rate)) * 9 / 10; rep.Duration < min {
+		t.Errorf("VerifyChecksums: read rate isn't limited, want>=%v got=%v", min, rep.Duration)
+	}
+
+	tables, err := filepath.Glob(filepath.Join(dir, "*.ldb"))
+	if err != nil {
+		t.Fatal("Glob: got error: ", err)
+	}
+	journals, err := filepath.Glob(filepath.Join(dir, "*.log"))
+	if err != nil {
+		t.Fatal("Glob: got error: ", err)
+	}
+	if len(journals) != 1 {
+		t.Fatalf("invalid number of journals, got=%d", len(journals))
+	}
+	sort.Strings(tables)
+	corrupt := func(path string, offset int64) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal("OpenFile: got error: ", err)
+		}
+		defer f.Close()
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, offset); err != nil {
+			t.Fatal("ReadAt: got error: ", err)
+		}
+		b[0] ^= 0x80
+		if _, err := f.WriteAt(b, offset); err != nil {
+			t.Fatal("WriteAt: got error: ", err)
+		}
+	}
+	corrupt(tables[0], 100)
+	corrupt(journals[0], 100)
+
+	rep, err = db.VerifyChecksums(nil)
+	if err != nil {
+		t.Fatal("VerifyChecksums: got error: ", err)
+	}
+	if len(rep.Corrupted) != 2 {
+		t.Fatalf("VerifyChecksums: invalid number of corruptions, want=2 got=%d: %v", len(rep.Corrupted), rep.Corrupted)
+	}
+	cerr := rep.Corrupted[0]
+	if cerr.Fd.Type != storage.TypeTable || filepath.Base(tables[0]) != fmt.Sprintf("%06d.ldb", cerr.Fd.Num) {
+		t.Errorf("VerifyChecksums: invalid corrupted table, want=%s got=%s", filepath.Base(tables[0]), cerr.Fd)
+	}
+	if cerr.Offset != 0 || cerr.Size == 0 || !strings.HasPrefix(cerr.Reason, "checksum mismatch") {
+		t.Errorf("VerifyChecksums: invalid table corruption: %v", cerr)
+	}
+	if cerr := rep.Corrupted[1]; cerr.Fd.Type != storage.TypeJournal {
+		t.Errorf("VerifyChecksums: invalid corrupted journal: %v", cerr)
+	}
+}
@@ -8,15 +8,20 @@ package leveldb
 
 import (
 	"container/list"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/FactomProject/goleveldb/leveldb/cache"
 	"github.com/FactomProject/goleveldb/leveldb/errors"
 	"github.com/FactomProject/goleveldb/leveldb/iterator"
 	"github.com/FactomProject/goleveldb/leveldb/journal"
@@ -32,6 +37,17 @@ type DB struct {
 	// Need 64-bit alignment.
 	seq uint64
 
+	// Stats. Need 64-bit alignment.
+	cGets                  uint64 // The cumulative number of key lookups
+	cPuts                  uint64 // The cumulative number of written records
+	cWriteDelay            int64  // The cumulative duration of write delays
+	cWriteDelayN           int32  // The cumulative number of write delays
+	inWritePaused          int32  // The indicator whether write operation is paused by compaction
+	aliveSnaps, aliveIters int32
+	memComp                uint32 // The cumulative number of memdb compactions
+	level0Comp             uint32 // The cumulative number of level-0 table compactions
+	nonLevel0Comp          uint32 // The cumulative number of non level-0 table compactions
+
 	// Session.
 	s *session
 
@@ -40,17 +56,23 @@ type DB struct {
 	memPool         chan *memdb.DB
 	mem, frozenMem  *memDB
 	journal         *journal.Writer
-	journalWriter   storage.Writer
+	journalWriter   *journalFile
 	journalFd       storage.FileDesc
 	frozenJournalFd storage.FileDesc
 	frozenSeq       uint64
 
+	// Retained and recycled journals.
+	jretainMu sync.Mutex
+	jretained retainedJournals
+	jrecycled []storage.FileDesc
+
 	// Snapshot.
-	snapsMu   sync.Mutex
-	snapsList *list.List
+	snapsMu    sync.Mutex
+	snapsList  *list.List
+	namedSnaps map[string]*snapshotElement
 
-	// Stats.
-	aliveSnaps, aliveIters int32
+	// Read.
+	ikeyPool sync.Pool
 
 	// Write.
 	batchPool    sync.Pool
@@ -60,8 +82,14 @@ type DB struct {
 	writeAckC    chan error
 	writeDelay   time.Duration
 	writeDelayN  int
+	journalDirty bool // Whether the journal has unsynced writes.
 	tr           *Transaction
 
+	// Pipelined write, see writeLocked.
+	writeApplyC   chan struct{}
+	writeApplySeq uint64
+	writeApplyLen int // Internal length of the batches pending memdb apply.
+
 	// Compaction.
 	compCommitLk     sync.Mutex
 	tcompCmdC        chan cCmd
@@ -72,8 +100,12 @@ type DB struct {
 	compErrSetC      chan error
 	compWriteLocking bool
 	compStats        cStats
+	compDebt         int // The compaction debt thresholds reached, guarded by compCommitLk.
 	memdbMaxLevel    int // For testing.
 
+	// Secondary.
+	secondary bool
+
 	// Close.
 	closeW sync.WaitGroup
 	closeC chan struct{}
@@ -82,7 +114,7 @@ type DB struct {
 }
 
 func openDB(s *session) (*DB, error) {
-	s.log("db@open opening")
+	s.log(opt.LogInfo, "db@open opening")
 	start := time.Now()
 	db := &DB{
 		s: s,
@@ -91,7 +123,10 @@ func openDB(s *session) (*DB, error) {
 		// MemDB
 		memPool: make(chan *memdb.DB, 1),
 		// Snapshot
-		snapsList: list.New(),
+		snapsList:  list.New(),
+		namedSnaps: make(map[string]*snapshotElement),
+		// Read
+		ikeyPool: sync.Pool{New: newIkeyBuffer},
 		// Write
 		batchPool:    sync.Pool{New: newBatch},
 		writeMergeC:  make(chan writeMerge),
@@ -109,8 +144,15 @@ func openDB(s *session) (*DB, error) {
 		closeC: make(chan struct{}),
 	}
 
+	if s.o.GetValidateComparer() {
+		if err := db.validateComparer(); err != nil {
+			return nil, err
+		}
+	}
+
 	// Read-only mode.
 	readOnly := s.o.GetReadOnly()
+	upgrade := s.cmpUpgrade != nil
 
 	if readOnly {
 		// Recover journals (read-only mode).
@@ -118,6 +160,14 @@ func openDB(s *session) (*DB, error) {
 			return nil, err
 		}
 	} else {
+		// Upgrade comparer, the journals are then replayed under the new
+		// ordering.
+		if upgrade {
+			if err := db.upgradeComparer(); err != nil {
+				return nil, err
+			}
+		}
+
 		// Recover journals.
 		if err := db.recoverJournal(); err != nil {
 			return nil, err
@@ -130,11 +180,15 @@ func openDB(s *session) (*DB, error) {
 				db.journal.Close()
 				db.journalWriter.Close()
 			}
+			db.syncRemoved()
 			return nil, err
 		}
 
 	}
 
+	// Pin named snapshots before compactions start.
+	db.pinNamedSnapshots()
+
 	// Doesn't need to be included in the wait group.
 	go db.compactionError()
 	go db.mpoolDrain()
@@ -142,13 +196,30 @@ func openDB(s *session) (*DB, error) {
 	if readOnly {
 		db.SetReadOnly()
 	} else {
+		db.compCommitLk.Lock()
+		db.checkCompactionDebt()
+		db.compCommitLk.Unlock()
+
 		db.closeW.Add(2)
 		go db.tCompaction()
 		go db.mCompaction()
 		// go db.jWriter()
+		if interval := s.o.GetJournalSyncInterval(); interval > 0 {
+			db.closeW.Add(1)
+			go db.jSync(interval)
+		}
+
+		// The upgraded tables are all in level-0.
+		if upgrade {
+			if err := db.CompactRange(util.Range{}); err != nil {
+				db.Close()
+				return nil, err
+			}
+			s.cmpUpgrade = nil
+		}
 	}
 
-	s.logf("db@open done T·%v", time.Since(start))
+	s.log(opt.LogInfo, "db@open done", "duration", time.Since(start))
 
 	runtime.SetFinalizer(db, (*DB).Close)
 	return db, nil
@@ -209,7 +280,10 @@ func Open(stor storage.Storage, o *opt.Options) (db *DB, err error) {
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
 func OpenFile(path string, o *opt.Options) (db *DB, err error) {
-	stor, err := storage.OpenFile(path, o.GetReadOnly())
+	stor, err := storage.OpenFileWithOptions(path, &storage.FileOptions{
+		ReadOnly:       o.GetReadOnly(),
+		BreakStaleLock: o.GetBreakStaleLock(),
+	})
 	if err != nil {
 		return
 	}
@@ -227,9 +301,17 @@ func OpenFile(path string, o *opt.Options) (db *DB, err error) {
 // The DB must already exist or it will returns an error.
 // Also, Recover will ignore ErrorIfMissing and ErrorIfExist options.
 //
+// The tables ingested by DB.IngestTables and not yet compacted keep the
+// sequence numbers recorded by the manifests still readable, otherwise
+// they are placed above all recovered entries.
+//
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
 func Recover(stor storage.Storage, o *opt.Options) (db *DB, err error) {
+	return recoverDB(stor, o, nil)
+}
+
+func recoverDB(stor storage.Storage, o *opt.Options, quarantine func(fd storage.FileDesc) error) (db *DB, err error) {
 	s, err := newSession(stor, o)
 	if err != nil {
 		return
@@ -241,7 +323,7 @@ func Recover(stor storage.Storage, o *opt.Options) (db *DB, err error) {
 		}
 	}()
 
-	err = recoverTable(s, o)
+	err = recoverTable(s, o, quarantine)
 	if err != nil {
 		return
 	}
@@ -259,7 +341,7 @@ func Recover(stor storage.Storage, o *opt.Options) (db *DB, err error) {
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
 func RecoverFile(path string, o *opt.Options) (db *DB, err error) {
-	stor, err := storage.OpenFile(path, false)
+	stor, err := storage.OpenFileWithOptions(path, &storage.FileOptions{BreakStaleLock: o.GetBreakStaleLock()})
 	if err != nil {
 		return
 	}
@@ -272,7 +354,51 @@ func RecoverFile(path string, o *opt.Options) (db *DB, err error) {
 	return
 }
 
-func recoverTable(s *session, o *opt.Options) error {
+// Repair repairs the DB of the given path, it is like RecoverFile but
+// it also moves tables that are dropped to the "lost" directory within
+// the DB directory, instead of removing them.
+//
+// Each table is scanned block-by-block, tables with corrupted blocks or
+// keys are rebuilt from the readable entries, while the original tables
+// are moved to the "lost" directory. Tables that can't be read at all,
+// e.g. due to corrupted index block, are moved to the "lost" directory.
+// Unless StrictRecovery is set, in which case any corrupted table is
+// moved to the "lost" directory as is. The journals are then replayed
+// and flushed into tables, as by OpenFile.
+//
+// Repair will ignore ErrorIfMissing and ErrorIfExist options.
+func Repair(path string, o *opt.Options) error {
+	stor, err := storage.OpenFileWithOptions(path, &storage.FileOptions{BreakStaleLock: o.GetBreakStaleLock()})
+	if err != nil {
+		return err
+	}
+	defer stor.Close()
+
+	lost := filepath.Join(path, "lost")
+	quarantine := func(fd storage.FileDesc) error {
+		if err := os.MkdirAll(lost, 0755); err != nil {
+			return err
+		}
+		name := fd.String()
+		err := os.Rename(filepath.Join(path, name), filepath.Join(lost, name))
+		if os.IsNotExist(err) && fd.Type == storage.TypeTable {
+			// Try the old table file name.
+			name = fmt.Sprintf("%06d.sst", fd.Num)
+			err = os.Rename(filepath.Join(path, name), filepath.Join(lost, name))
+		}
+		return err
+	}
+	db, err := recoverDB(stor, o, quarantine)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// Recovers the tables and creates a new manifest. If quarantine is not nil
+// it is called with the tables that are dropped or rebuilt, otherwise the
+// dropped tables are left as is and the rebuilt tables are replaced.
+func recoverTable(s *session, o *opt.Options, quarantine func(fd storage.FileDesc) error) error {
 	o = dupOptions(o)
 	// Mask StrictReader, lets StrictRecovery doing its job.
 	o.Strict &= ^opt.StrictReader
@@ -294,8 +420,15 @@ func recoverTable(s *session, o *opt.Options) error {
 
 		rec   = &sessionRecord{}
 		bpool = util.NewBufferPool(o.GetBlockSize() + 5)
+
+		// Ingested tables keyed by user keys, see tFile.gseq. Their
+		// sequence numbers are read from the manifests if still readable.
+		utables []atRecord
+		gseqs   = s.readGlobalSeqs()
 	)
-	buildTable := func(iter iterator.Iterator) (tmpFd storage.FileDesc, size int64, err error) {
+	// Rebuilds the table from the readable entries; the tables keyed by
+	// user keys are rebuilt as is.
+	buildTable := func(iter iterator.Iterator, user bool) (tmpFd storage.FileDesc, size int64, err error) {
 		tmpFd = s.newTemp()
 		writer, err := s.stor.Create(tmpFd)
 		if err != nil {
@@ -310,10 +443,14 @@ func recoverTable(s *session, o *opt.Options) error {
 		}()
 
 		// Copy entries.
-		tw := table.NewWriter(writer, o)
+		wo := o
+		if user {
+			wo = s.uo
+		}
+		tw := table.NewWriter(writer, wo)
 		for iter.Next() {
 			key := iter.Key()
-			if validInternalKey(key) {
+			if user || validInternalKey(key) {
 				err = tw.Append(key, iter.Value())
 				if err != nil {
 					return
@@ -338,7 +475,7 @@ func recoverTable(s *session, o *opt.Options) error {
 		return
 	}
 	recoverTable := func(fd storage.FileDesc) error {
-		s.logf("table@recovery recovering @%d", fd.Num)
+		s.log(opt.LogInfo, "table@recovery recovering", "file", fd)
 		reader, err := s.stor.Open(fd)
 		if err != nil {
 			return err
@@ -360,16 +497,39 @@ func recoverTable(s *session, o *opt.Options) error {
 			tSeq                                     uint64
 			tgoodKey, tcorruptedKey, tcorruptedBlock int
 			imin, imax                               []byte
+			umin, umax                               []byte
+			uordered                                 = true
+			rdels                                    rangeDels
+			vlogs                                    = make(map[int64]struct{})
 		)
+		// Moves the table to quarantine, if any.
+		drop := func() error {
+			droppedTable++
+			if quarantine == nil {
+				return nil
+			}
+			closed = true
+			reader.Close()
+			if err := quarantine(fd); err != nil {
+				return err
+			}
+			s.log(opt.LogWarn, "table@recovery quarantined", "file", fd)
+			return nil
+		}
+
 		tr, err := table.NewReader(reader, size, fd, nil, bpool, o)
 		if err != nil {
+			if quarantine != nil && errors.IsCorrupted(err) {
+				s.log(opt.LogWarn, "table@recovery unreadable", "file", fd, "err", err)
+				return drop()
+			}
 			return err
 		}
 		iter := tr.NewIterator(nil, nil)
 		if itererr, ok := iter.(iterator.ErrorCallbackSetter); ok {
 			itererr.SetErrorCallback(func(err error) {
 				if errors.IsCorrupted(err) {
-					s.logf("table@recovery block corruption @%d %q", fd.Num, err)
+					s.log(opt.LogWarn, "table@recovery block corruption", "file", fd, "err", err)
 					tcorruptedBlock++
 				}
 			})
@@ -378,7 +538,14 @@ func recoverTable(s *session, o *opt.Options) error {
 		// Scan the table.
 		for iter.Next() {
 			key := iter.Key()
-			_, seq, _, kerr := parseInternalKey(key)
+			if uordered {
+				uordered = umax == nil || s.icmp.uCompare(umax, key) < 0
+				if umin == nil {
+					umin = append([]byte{}, key...)
+				}
+				umax = append(umax[:0], key...)
+			}
+			ukey, seq, kt, kerr := parseInternalKey(key)
 			if kerr != nil {
 				tcorruptedKey++
 				continue
@@ -387,6 +554,14 @@ func recoverTable(s *session, o *opt.Options) error {
 			if seq > tSeq {
 				tSeq = seq
 			}
+			switch kt {
+			case keyTypeRangeDel:
+				rdels = append(rdels, rangeDel{seq, append([]byte{}, ukey...), append([]byte{}, iter.Value()...)})
+			case keyTypeValPtr:
+				if p, err := decodeValuePtr(iter.Value()); err == nil {
+					vlogs[p.num] = struct{}{}
+				}
+			}
 			if imin == nil {
 				imin = append([]byte{}, key...)
 			}
@@ -394,47 +569,80 @@ func recoverTable(s *session, o *opt.Options) error {
 		}
 		if err := iter.Error(); err != nil {
 			iter.Release()
+			if quarantine != nil && errors.IsCorrupted(err) {
+				s.log(opt.LogWarn, "table@recovery unreadable", "file", fd, "err", err)
+				return drop()
+			}
 			return err
 		}
 		iter.Release()
 
+		// A table whose keys aren't all internal keys, but are ordered as
+		// user keys, is an ingested table keyed by user keys. Ingestion
+		// rewrites the tables whose keys all look like internal keys.
+		user := tcorruptedKey > 0 && uordered
+		if user {
+			tgoodKey += tcorruptedKey
+			tcorruptedKey = 0
+			imin, imax = umin, umax
+		}
+
 		goodKey += tgoodKey
 		corruptedKey += tcorruptedKey
 		corruptedBlock += tcorruptedBlock
 
 		if strict && (tcorruptedKey > 0 || tcorruptedBlock > 0) {
-			droppedTable++
-			s.logf("table@recovery dropped @%d Gk·%d Ck·%d Cb·%d S·%d Q·%d", fd.Num, tgoodKey, tcorruptedKey, tcorruptedBlock, size, tSeq)
-			return nil
+			s.log(opt.LogWarn, "table@recovery dropped", "file", fd, "goodKeys", tgoodKey, "corruptedKeys", tcorruptedKey, "corruptedBlocks", tcorruptedBlock, "size", size, "seq", tSeq)
+			return drop()
 		}
 
 		if tgoodKey > 0 {
 			if tcorruptedKey > 0 || tcorruptedBlock > 0 {
 				// Rebuild the table.
-				s.logf("table@recovery rebuilding @%d", fd.Num)
+				s.log(opt.LogInfo, "table@recovery rebuilding", "file", fd)
 				iter := tr.NewIterator(nil, nil)
-				tmpFd, newSize, err := buildTable(iter)
+				tmpFd, newSize, err := buildTable(iter, user)
 				iter.Release()
 				if err != nil {
 					return err
 				}
 				closed = true
 				reader.Close()
+				if quarantine != nil {
+					// Keep the original table.
+					if err := quarantine(fd); err != nil {
+						s.stor.Remove(tmpFd)
+						return err
+					}
+					s.log(opt.LogWarn, "table@recovery quarantined", "file", fd)
+				}
 				if err := s.stor.Rename(tmpFd, fd); err != nil {
 					return err
 				}
 				size = newSize
 			}
+			recoveredKey += tgoodKey
+			if user {
+				// Added once the sequence numbers are known.
+				utables = append(utables, atRecord{num: fd.Num, size: size, imin: imin, imax: imax, gseq: gseqs[fd.Num]})
+				s.log(opt.LogInfo, "table@recovery recovered", "file", fd, "goodKeys", tgoodKey, "corruptedBlocks", tcorruptedBlock, "size", size, "gseq", gseqs[fd.Num])
+				return nil
+			}
 			if tSeq > maxSeq {
 				maxSeq = tSeq
 			}
-			recoveredKey += tgoodKey
 			// Add table to level 0.
 			rec.addTable(0, fd.Num, size, imin, imax)
-			s.logf("table@recovery recovered @%d Gk·%d Ck·%d Cb·%d S·%d Q·%d", fd.Num, tgoodKey, tcorruptedKey, tcorruptedBlock, size, tSeq)
+			for _, rd := range rdels {
+				rec.addRangeDel(0, fd.Num, rd)
+			}
+			for vnum := range vlogs {
+				rec.addValueLogRef(0, fd.Num, vnum)
+			}
+			s.log(opt.LogInfo, "table@recovery recovered", "file", fd, "goodKeys", tgoodKey, "corruptedKeys", tcorruptedKey, "corruptedBlocks", tcorruptedBlock, "size", size, "seq", tSeq)
 		} else {
-			droppedTable++
-			s.logf("table@recovery unrecoverable @%d Ck·%d Cb·%d S·%d", fd.Num, tcorruptedKey, tcorruptedBlock, size)
+			s.log(opt.LogWarn, "table@recovery unrecoverable", "file", fd, "corruptedKeys", tcorruptedKey, "corruptedBlocks", tcorruptedBlock, "size", size)
+			return drop()
 		}
 
 		return nil
@@ -442,7 +650,7 @@ func recoverTable(s *session, o *opt.Options) error {
 
 	// Recover all tables.
 	if len(fds) > 0 {
-		s.logf("table@recovery F·%d", len(fds))
+		s.log(opt.LogInfo, "table@recovery", "files", len(fds))
 
 		// Mark file number as used.
 		s.markFileNum(fds[len(fds)-1].Num)
@@ -453,7 +661,24 @@ func recoverTable(s *session, o *opt.Options) error {
 			}
 		}
 
-		s.logf("table@recovery recovered F·%d N·%d Gk·%d Ck·%d Q·%d", len(fds), recoveredKey, goodKey, corruptedKey, maxSeq)
+		// The ingested tables not found in the manifests are ordered by
+		// file number, above the recovered entries.
+		for _, r := range utables {
+			if r.gseq > maxSeq {
+				maxSeq = r.gseq
+			}
+		}
+		for _, r := range utables {
+			if r.gseq == 0 {
+				maxSeq++
+				r.gseq = maxSeq
+				s.log(opt.LogWarn, "table@recovery unknown gseq", "file", storage.FileDesc{Type: storage.TypeTable, Num: r.num}, "gseq", r.gseq)
+			}
+			rec.addTable(0, r.num, r.size, makeInternalKey(nil, r.imin, r.gseq, keyTypeVal), makeInternalKey(nil, r.imax, r.gseq, keyTypeVal))
+			rec.setTableGlobalSeq(0, r.num, r.gseq)
+		}
+
+		s.log(opt.LogInfo, "table@recovery done", "files", len(fds), "recoveredKeys", recoveredKey, "goodKeys", goodKey, "corruptedKeys", corruptedKey, "seq", maxSeq)
 	}
 
 	// Set sequence number.
@@ -468,6 +693,182 @@ func recoverTable(s *session, o *opt.Options) error {
 	return s.commit(rec)
 }
 
+// journalReplay reads the batches of the journals being recovered, the
+// corrupted records are handled according to opt.WALRecoveryMode.
+//
+// A recycled journal file holds stale chunks past the written ones, see
+// writeJournalHeader. The corruptions of a recycled journal are only
+// handled if followed by a valid record, otherwise they are the stale tail
+// of the journal and are dropped.
+type journalReplay struct {
+	s         *session
+	mode      opt.WALRecoveryMode
+	checksum  bool
+	blockSize int
+	jr        *journal.Reader
+	dropper   *recoveryDropper
+	fd        storage.FileDesc
+	first     bool   // Whether the next record is the first of the journal.
+	recycled  bool   // Whether the journal has a journal header.
+	hdrSeq    uint64 // Sequence number of the journal header.
+	stale     error  // Corruption of a recycled journal, maybe stale tail.
+	tail      error  // Corruption tolerated if at the tail of the journal.
+	stopped   bool   // Replay stopped at a corruption.
+}
+
+func newJournalReplay(s *session) *journalReplay {
+	return &journalReplay{
+		s:         s,
+		mode:      s.o.GetWALRecoveryMode(),
+		checksum:  s.o.GetStrict(opt.StrictJournalChecksum),
+		blockSize: s.o.GetJournalBlockSize(),
+	}
+}
+
+// Starts replaying the given journal.
+func (r *journalReplay) reset(fr io.Reader, fd storage.FileDesc) {
+	r.fd = fd
+	r.first = true
+	r.recycled = false
+	r.hdrSeq = 0
+	r.stale = nil
+	r.tail = nil
+	r.dropper = &recoveryDropper{}
+	// The journal reader is never strict, dropped chunks are reported by
+	// the dropper instead.
+	if r.jr == nil {
+		r.jr = journal.NewReaderSize(fr, r.dropper, false, r.checksum, r.blockSize)
+	} else {
+		r.jr.Reset(fr, r.dropper, false, r.checksum)
+	}
+	r.jr.SetNumber(fd.Num)
+}
+
+// Handles a corrupted record, the handling is deferred if the journal is
+// recycled. Returns the error if the recovery must fail.
+func (r *journalReplay) corrupted(err error) error {
+	if r.recycled {
+		if r.stale == nil {
+			r.stale = err
+		}
+		return nil
+	}
+	return r.handle(err)
+}
+
+// Handles a corrupted record according to the recovery mode. Returns the
+// error if the recovery must fail.
+func (r *journalReplay) handle(err error) error {
+	switch r.mode {
+	case opt.WALAbsoluteConsistency:
+		return err
+	case opt.WALPointInTimeRecovery:
+		r.s.log(opt.LogWarn, "journal@recovery stopped", "err", err)
+		r.stopped = true
+	case opt.WALTolerateCorruptedTailRecords:
+		if r.tail == nil {
+			r.tail = err
+		}
+	default:
+		r.s.log(opt.LogWarn, "journal@recovery skipped", "err", err)
+	}
+	return nil
+}
+
+// Returns the first chunk dropped since last call, if any.
+func (r *journalReplay) dropped() error {
+	err := r.dropper.err
+	if err == nil {
+		return nil
+	}
+	r.dropper.err = nil
+	if e, ok := err.(*journal.ErrCorrupted); ok {
+		return errors.NewErrCorruptedAt(r.fd, e.Offset, int64(e.Size), e.Reason, e)
+	}
+	return errors.NewErrCorrupted(r.fd, err)
+}
+
+// Reads the next batch of the journal into buf. Returns io.EOF at the end
+// of the journal, or once the replay is stopped.
+func (r *journalReplay) next(buf *util.Buffer) error {
+	for !r.stopped {
+		err := readJournalBatch(r.jr, buf)
+		first := r.first
+		r.first = false
+		if derr := r.dropped(); derr != nil {
+			if cerr := r.corrupted(derr); cerr != nil {
+				return cerr
+			}
+			if err == io.ErrUnexpectedEOF {
+				// The record is truncated by the dropped chunk.
+				continue
+			}
+		}
+		if err == errJournalHeader {
+			num, seq := decodeJournalHeader(buf.Bytes())
+			switch {
+			case first && num == r.fd.Num:
+				r.recycled, r.hdrSeq = true, seq
+				continue
+			case first:
+				// The journal file is recycled, but none of its records
+				// were written.
+				r.s.log(opt.LogDebug, "journal@recovery stale", "file", r.fd)
+				return io.EOF
+			}
+			err = newErrBatchCorrupted("unexpected journal header")
+		} else if err == nil && r.recycled {
+			if seq, _, _ := decodeBatchHeader(buf.Bytes()); seq <= r.hdrSeq {
+				err = newErrBatchCorrupted("stale record")
+			}
+		}
+		switch {
+		case r.stopped:
+		case err == io.EOF:
+			if r.stale != nil {
+				r.s.log(opt.LogDebug, "journal@recovery stale tail dropped", "file", r.fd, "err", r.stale)
+				r.stale = nil
+			}
+			if r.tail != nil {
+				r.s.log(opt.LogWarn, "journal@recovery tail dropped", "file", r.fd, "err", r.tail)
+				r.tail = nil
+			}
+			return io.EOF
+		case err == io.ErrUnexpectedEOF:
+			// Torn split batch.
+			if cerr := r.corrupted(errors.NewErrCorrupted(r.fd, errors.New("leveldb: torn split batch"))); cerr != nil {
+				return cerr
+			}
+		case errors.IsCorrupted(err):
+			if cerr := r.corrupted(errors.SetFd(err, r.fd)); cerr != nil {
+				return cerr
+			}
+		case err != nil:
+			return errors.SetFd(err, r.fd)
+		default:
+			if r.stale != nil {
+				// The corruption is followed by a valid record, thus isn't
+				// the stale tail of the journal.
+				serr := r.stale
+				r.stale = nil
+				if cerr := r.handle(serr); cerr != nil {
+					return cerr
+				}
+				if r.stopped {
+					break
+				}
+			}
+			if r.tail != nil {
+				// The corruption is followed by a valid record, thus isn't
+				// at the tail of the journal.
+				return r.tail
+			}
+			return nil
+		}
+	}
+	return io.EOF
+}
+
 func (db *DB) recoverJournal() error {
 	// Get all journals and sort it by file number.
 	rawFds, err := db.s.stor.List(storage.TypeJournal)
@@ -491,18 +892,16 @@ func (db *DB) recoverJournal() error {
 
 	// Recover journals.
 	if len(fds) > 0 {
-		db.logf("journal@recovery F·%d", len(fds))
+		db.log(opt.LogInfo, "journal@recovery", "files", len(fds))
 
 		// Mark file number as used.
 		db.s.markFileNum(fds[len(fds)-1].Num)
 
 		var (
 			// Options.
-			strict      = db.s.o.GetStrict(opt.StrictJournal)
-			checksum    = db.s.o.GetStrict(opt.StrictJournalChecksum)
 			writeBuffer = db.s.o.GetWriteBuffer()
 
-			jr       *journal.Reader
+			jrp      = newJournalReplay(db.s)
 			mdb      = memdb.New(db.s.icmp, writeBuffer)
 			buf      = &util.Buffer{}
 			batchSeq uint64
@@ -510,19 +909,15 @@ func (db *DB) recoverJournal() error {
 		)
 
 		for _, fd := range fds {
-			db.logf("journal@recovery recovering @%d", fd.Num)
+			db.log(opt.LogInfo, "journal@recovery recovering", "file", fd)
 
 			fr, err := db.s.stor.Open(fd)
 			if err != nil {
 				return err
 			}
 
-			// Create or reset journal reader instance.
-			if jr == nil {
-				jr = journal.NewReader(fr, dropper{db.s, fd}, strict, checksum)
-			} else {
-				jr.Reset(fr, dropper{db.s, fd}, strict, checksum)
-			}
+			// Reset journal replay.
+			jrp.reset(fr, fd)
 
 			// Flush memdb and remove obsolete journal file.
 			if !ofd.Zero() {
@@ -541,39 +936,28 @@ func (db *DB) recoverJournal() error {
 				}
 				rec.resetAddedTables()
 
-				db.s.stor.Remove(ofd)
+				db.removeJournal(ofd)
 				ofd = storage.FileDesc{}
 			}
 
 			// Replay journal to memdb.
 			mdb.Reset()
 			for {
-				r, err := jr.Next()
-				if err != nil {
+				if err := jrp.next(buf); err != nil {
 					if err == io.EOF {
 						break
 					}
 
 					fr.Close()
-					return errors.SetFd(err, fd)
-				}
-
-				buf.Reset()
-				if _, err := buf.ReadFrom(r); err != nil {
-					if err == io.ErrUnexpectedEOF {
-						// This is error returned due to corruption, with strict == false.
-						continue
-					}
-
-					fr.Close()
-					return errors.SetFd(err, fd)
+					return err
 				}
 				batchSeq, batchLen, err = decodeBatchToMem(buf.Bytes(), db.seq, mdb)
 				if err != nil {
-					if !strict && errors.IsCorrupted(err) {
-						db.s.logf("journal error: %v (skipped)", err)
+					if errors.IsCorrupted(err) {
 						// We won't apply sequence number as it might be corrupted.
-						continue
+						if err := jrp.corrupted(errors.SetFd(err, fd)); err == nil {
+							continue
+						}
 					}
 
 					fr.Close()
@@ -625,32 +1009,50 @@ func (db *DB) recoverJournal() error {
 
 	// Remove the last obsolete journal file.
 	if !ofd.Zero() {
-		db.s.stor.Remove(ofd)
+		db.removeJournal(ofd)
 	}
 
 	return nil
 }
 
 func (db *DB) recoverJournalRO() error {
+	mdb, seq, _, err := db.replayJournalsRO(db.seq, db.s.stJournalNum, db.s.stPrevJournalNum)
+	if err != nil {
+		return err
+	}
+	db.seq = seq
+
+	// Set memDB.
+	db.mem = &memDB{db: db, DB: mdb, ref: 1}
+	if err := db.mem.loadRangeDels(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Replays the journals not yet flushed, according to the given journal
+// numbers of the session state, into a new memdb, without modifying them.
+// Returns the memdb, the sequence number of the latest replayed record or
+// seq if none, and the replayed journals.
+func (db *DB) replayJournalsRO(seq uint64, journalNum, prevJournalNum int64) (*memdb.DB, uint64, []storage.FileDesc, error) {
 	// Get all journals and sort it by file number.
 	rawFds, err := db.s.stor.List(storage.TypeJournal)
 	if err != nil {
-		return err
+		return nil, 0, nil, err
 	}
 	sortFds(rawFds)
 
 	// Journals that will be recovered.
 	var fds []storage.FileDesc
 	for _, fd := range rawFds {
-		if fd.Num >= db.s.stJournalNum || fd.Num == db.s.stPrevJournalNum {
+		if fd.Num >= journalNum || fd.Num == prevJournalNum {
 			fds = append(fds, fd)
 		}
 	}
 
 	var (
 		// Options.
-		strict      = db.s.o.GetStrict(opt.StrictJournal)
-		checksum    = db.s.o.GetStrict(opt.StrictJournalChecksum)
 		writeBuffer = db.s.o.GetWriteBuffer()
 
 		mdb = memdb.New(db.s.icmp, writeBuffer)
@@ -658,123 +1060,281 @@ func (db *DB) recoverJournalRO() error {
 
 	// Recover journals.
 	if len(fds) > 0 {
-		db.logf("journal@recovery RO·Mode F·%d", len(fds))
+		db.log(opt.LogInfo, "journal@recovery read-only", "files", len(fds))
 
 		var (
-			jr       *journal.Reader
+			jrp      = newJournalReplay(db.s)
 			buf      = &util.Buffer{}
 			batchSeq uint64
 			batchLen int
 		)
 
 		for _, fd := range fds {
-			db.logf("journal@recovery recovering @%d", fd.Num)
+			db.log(opt.LogInfo, "journal@recovery recovering", "file", fd)
 
 			fr, err := db.s.stor.Open(fd)
 			if err != nil {
-				return err
+				return nil, 0, nil, err
 			}
 
-			// Create or reset journal reader instance.
-			if jr == nil {
-				jr = journal.NewReader(fr, dropper{db.s, fd}, strict, checksum)
-			} else {
-				jr.Reset(fr, dropper{db.s, fd}, strict, checksum)
-			}
+			// Reset journal replay.
+			jrp.reset(fr, fd)
 
 			// Replay journal to memdb.
 			for {
-				r, err := jr.Next()
-				if err != nil {
+				if err := jrp.next(buf); err != nil {
 					if err == io.EOF {
 						break
 					}
 
 					fr.Close()
-					return errors.SetFd(err, fd)
-				}
-
-				buf.Reset()
-				if _, err := buf.ReadFrom(r); err != nil {
-					if err == io.ErrUnexpectedEOF {
-						// This is error returned due to corruption, with strict == false.
-						continue
-					}
-
-					fr.Close()
-					return errors.SetFd(err, fd)
+					return nil, 0, nil, err
 				}
-				batchSeq, batchLen, err = decodeBatchToMem(buf.Bytes(), db.seq, mdb)
+				batchSeq, batchLen, err = decodeBatchToMem(buf.Bytes(), seq, mdb)
 				if err != nil {
-					if !strict && errors.IsCorrupted(err) {
-						db.s.logf("journal error: %v (skipped)", err)
+					if errors.IsCorrupted(err) {
 						// We won't apply sequence number as it might be corrupted.
-						continue
+						if err := jrp.corrupted(errors.SetFd(err, fd)); err == nil {
+							continue
+						}
 					}
 
 					fr.Close()
-					return errors.SetFd(err, fd)
+					return nil, 0, nil, errors.SetFd(err, fd)
 				}
 
 				// Save sequence number.
-				db.seq = batchSeq + uint64(batchLen)
+				seq = batchSeq + uint64(batchLen)
 			}
 
 			fr.Close()
 		}
 	}
 
-	// Set memDB.
-	db.mem = &memDB{db: db, DB: mdb, ref: 1}
+	return mdb, seq, fds, nil
+}
 
-	return nil
+// EntryType is the type of the entry a key resolved to, see EntryMeta.
+type EntryType int
+
+const (
+	// EntryNone means the key has no entry.
+	EntryNone EntryType = iota
+
+	// EntryValue is a value stored in 'memdb' or 'sorted table'.
+	EntryValue
+
+	// EntryValueLog is a value stored in the value log, see
+	// Options.ValueLogThreshold.
+	EntryValueLog
+
+	// EntryDeletion is a deletion of the key.
+	EntryDeletion
+
+	// EntryRangeDeletion is a range deletion covering the key.
+	EntryRangeDeletion
+)
+
+func (t EntryType) isValue() bool {
+	return t == EntryValue || t == EntryValueLog
+}
+
+func (t EntryType) String() string {
+	switch t {
+	case EntryNone:
+		return "none"
+	case EntryValue:
+		return "value"
+	case EntryValueLog:
+		return "value-log"
+	case EntryDeletion:
+		return "deletion"
+	case EntryRangeDeletion:
+		return "range-deletion"
+	}
+	return fmt.Sprintf("EntryType(%d)", int(t))
+}
+
+// EntryMeta holds the metadata of the entry a key resolved to, i.e. the
+// latest write of the key visible to the read.
+type EntryMeta struct {
+	// Seq is the sequence number of the write, as in GetUpdatesSince.
+	// For a key covered by a range deletion, it is the sequence number of
+	// the range deletion.
+	Seq uint64
+
+	Type EntryType
+}
+
+// Returns the metadata of the entry with given user key, sequence number
+// and type, as seen at snapshot sequence number snap.
+func entryMeta(icmp *iComparer, rdels rangeDelSet, ukey []byte, seq uint64, kt keyType, snap uint64) EntryMeta {
+	switch kt {
+	case keyTypeVal, keyTypeValPtr:
+		if tseq, ok := rdels.coveredBy(icmp, ukey, seq, snap); ok {
+			return EntryMeta{Seq: tseq, Type: EntryRangeDeletion}
+		}
+		if kt == keyTypeValPtr {
+			return EntryMeta{Seq: seq, Type: EntryValueLog}
+		}
+		return EntryMeta{Seq: seq, Type: EntryValue}
+	case keyTypeDel:
+		return EntryMeta{Seq: seq, Type: EntryDeletion}
+	}
+	panic("leveldb: invalid internalKey type")
 }
 
-func memGet(mdb *memdb.DB, ikey internalKey, icmp *iComparer) (ok bool, mv []byte, err error) {
+func memGet(mdb *memdb.DB, ikey internalKey, icmp *iComparer, rdels rangeDelSet) (ok bool, mv []byte, meta EntryMeta, err error) {
+	iseq, _ := ikey.parseNum()
 	mk, mv, err := mdb.Find(ikey)
-	if err == nil {
-		ukey, _, kt, kerr := parseInternalKey(mk)
+	for err == nil {
+		ukey, seq, kt, kerr := parseInternalKey(mk)
 		if kerr != nil {
 			// Shouldn't have had happen.
 			panic(kerr)
 		}
-		if icmp.uCompare(ukey, ikey.ukey()) == 0 {
-			if kt == keyTypeDel {
-				return true, nil, ErrNotFound
+		if icmp.uCompare(ukey, ikey.ukey()) != 0 {
+			break
+		}
+		// Range tombstones are keyed by their start key but don't
+		// delete it, look past them.
+		if kt == keyTypeRangeDel {
+			if seq == 0 {
+				break
 			}
-			return true, mv, nil
-
+			mk, mv, err = mdb.Find(makeInternalKey(nil, ukey, seq-1, keyTypeSeek))
+			continue
+		}
+		if meta = entryMeta(icmp, rdels, ukey, seq, kt, iseq); meta.Type != EntryValue {
+			return true, nil, meta, ErrNotFound
 		}
-	} else if err != ErrNotFound {
-		return true, nil, err
+		return true, mv, meta, nil
 	}
-	return
+	if err != nil && err != ErrNotFound {
+		return true, nil, meta, err
+	}
+	return false, nil, meta, nil
 }
 
-func (db *DB) get(auxm *memdb.DB, auxt tFiles, key []byte, seq uint64, ro *opt.ReadOptions) (value []byte, err error) {
-	ikey := makeInternalKey(nil, key, seq, keyTypeSeek)
+// Gets the value of the given key, the value is appended to dst, or to a
+// new slice if dst is nil.
+func (db *DB) get(ctx context.Context, auxm *memDB, auxt tFiles, key, dst []byte, seq uint64, ro *opt.ReadOptions) (value []byte, err error) {
+	value, _, err = db.getMeta(ctx, auxm, auxt, key, dst, seq, ro)
+	return
+}
 
-	if auxm != nil {
-		if ok, mv, me := memGet(auxm, ikey, db.s.icmp); ok {
-			return append([]byte{}, mv...), me
-		}
+// Like get, but also returns the metadata of the entry the key resolved to.
+func (db *DB) getMeta(ctx context.Context, auxm *memDB, auxt tFiles, key, dst []byte, seq uint64, ro *opt.ReadOptions) (value []byte, meta EntryMeta, err error) {
+	atomic.AddUint64(&db.cGets, 1)
+	tinfo := opt.TraceInfo{Op: opt.TraceGet, KeySize: len(key), Level: -1, TableNum: -1}
+	ctx = db.s.traceStart(ctx, tinfo)
+	defer func() {
+		db.s.traceEnd(ctx, tinfo, err)
+	}()
+	ikbuf := db.ikeyPool.Get().(*ikeyBuffer)
+	defer db.ikeyPool.Put(ikbuf)
+	ikey := ikbuf.make(key, seq, keyTypeSeek)
+	if dst == nil {
+		dst = db.s.tops.valueDst(ro)
 	}
 
 	em, fm := db.getMems()
 	for _, m := range [...]*memDB{em, fm} {
+		if m != nil {
+			defer m.decref()
+		}
+	}
+	v := db.s.version()
+	defer v.release()
+	rdels := db.getRangeDels(v, auxt, auxm, em, fm)
+
+	for _, m := range [...]*memDB{auxm, em, fm} {
 		if m == nil {
 			continue
 		}
-		defer m.decref()
 
-		if ok, mv, me := memGet(m.DB, ikey, db.s.icmp); ok {
-			return append([]byte{}, mv...), me
+		if ok, mv, mmeta, me := memGet(m.DB, ikey, db.s.icmp, rdels); ok {
+			if me != nil {
+				return dst, mmeta, me
+			}
+			return db.s.tops.copyValue(dst, mv), mmeta, nil
 		}
 	}
 
+	value, meta, cSched, err := v.get(ctx, auxt, ikey, dst, ro, false, rdels)
+	if cSched {
+		// Trigger table compaction.
+		db.compTrigger(db.tcompCmdC)
+	}
+	return
+}
+
+// Sorts indexes of keys by the keys.
+type keysIndex struct {
+	icmp *iComparer
+	keys [][]byte
+	idx  []int
+}
+
+func (x *keysIndex) Len() int { return len(x.idx) }
+
+func (x *keysIndex) Less(i, j int) bool {
+	return x.icmp.uCompare(x.keys[x.idx[i]], x.keys[x.idx[j]]) < 0
+}
+
+func (x *keysIndex) Swap(i, j int) { x.idx[i], x.idx[j] = x.idx[j], x.idx[i] }
+
+func (db *DB) getMany(keys [][]byte, seq uint64, ro *opt.ReadOptions) (values [][]byte, errs []error) {
+	atomic.AddUint64(&db.cGets, uint64(len(keys)))
+	values = make([][]byte, len(keys))
+	errs = make([]error, len(keys))
+
+	em, fm := db.getMems()
+	for _, m := range [...]*memDB{em, fm} {
+		if m != nil {
+			defer m.decref()
+		}
+	}
 	v := db.s.version()
-	value, cSched, err := v.get(auxt, ikey, ro, false)
-	v.release()
+	defer v.release()
+	rdels := db.getRangeDels(v, nil, em, fm)
+
+	// Lookup in key order, so the tables are probed in file order.
+	x := &keysIndex{icmp: db.s.icmp, keys: keys, idx: make([]int, len(keys))}
+	for i := range x.idx {
+		x.idx[i] = i
+	}
+	sort.Sort(x)
+
+	var (
+		ikey   internalKey
+		cSched bool
+	)
+	for _, i := range x.idx {
+		ikey = makeInternalKey(ikey[:0], keys[i], seq, keyTypeSeek)
+		tinfo := opt.TraceInfo{Op: opt.TraceGet, KeySize: len(keys[i]), Level: -1, TableNum: -1}
+		ctx := db.s.traceStart(context.Background(), tinfo)
+		found := false
+		for _, m := range [...]*memDB{em, fm} {
+			if m == nil {
+				continue
+			}
+			if ok, mv, _, me := memGet(m.DB, ikey, db.s.icmp, rdels); ok {
+				if me == nil {
+					values[i] = db.s.tops.copyValue(db.s.tops.valueDst(ro), mv)
+				}
+				errs[i] = me
+				found = true
+				break
+			}
+		}
+		if !found {
+			var tcomp bool
+			values[i], _, tcomp, errs[i] = v.get(ctx, nil, ikey, db.s.tops.valueDst(ro), ro, false, rdels)
+			cSched = cSched || tcomp
+		}
+		db.s.traceEnd(ctx, tinfo, errs[i])
+	}
 	if cSched {
 		// Trigger table compaction.
 		db.compTrigger(db.tcompCmdC)
@@ -789,30 +1349,38 @@ func nilIfNotFound(err error) error {
 	return err
 }
 
-func (db *DB) has(auxm *memdb.DB, auxt tFiles, key []byte, seq uint64, ro *opt.ReadOptions) (ret bool, err error) {
-	ikey := makeInternalKey(nil, key, seq, keyTypeSeek)
+func (db *DB) has(ctx context.Context, auxm *memDB, auxt tFiles, key []byte, seq uint64, ro *opt.ReadOptions) (ret bool, err error) {
+	atomic.AddUint64(&db.cGets, 1)
+	tinfo := opt.TraceInfo{Op: opt.TraceGet, KeySize: len(key), Level: -1, TableNum: -1}
+	ctx = db.s.traceStart(ctx, tinfo)
+	defer func() {
+		db.s.traceEnd(ctx, tinfo, err)
+	}()
+	ikbuf := db.ikeyPool.Get().(*ikeyBuffer)
+	defer db.ikeyPool.Put(ikbuf)
+	ikey := ikbuf.make(key, seq, keyTypeSeek)
 
-	if auxm != nil {
-		if ok, _, me := memGet(auxm, ikey, db.s.icmp); ok {
-			return me == nil, nilIfNotFound(me)
+	em, fm := db.getMems()
+	for _, m := range [...]*memDB{em, fm} {
+		if m != nil {
+			defer m.decref()
 		}
 	}
+	v := db.s.version()
+	defer v.release()
+	rdels := db.getRangeDels(v, auxt, auxm, em, fm)
 
-	em, fm := db.getMems()
-	for _, m := range [...]*memDB{em, fm} {
+	for _, m := range [...]*memDB{auxm, em, fm} {
 		if m == nil {
 			continue
 		}
-		defer m.decref()
 
-		if ok, _, me := memGet(m.DB, ikey, db.s.icmp); ok {
+		if ok, _, _, me := memGet(m.DB, ikey, db.s.icmp, rdels); ok {
 			return me == nil, nilIfNotFound(me)
 		}
 	}
 
-	v := db.s.version()
-	_, cSched, err := v.get(auxt, ikey, ro, true)
-	v.release()
+	_, _, cSched, err := v.get(ctx, auxt, ikey, nil, ro, true, rdels)
 	if cSched {
 		// Trigger table compaction.
 		db.compTrigger(db.tcompCmdC)
@@ -839,12 +1407,101 @@ func (db *DB) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
 
 	se := db.acquireSnapshot()
 	defer db.releaseSnapshot(se)
-	return db.get(nil, nil, key, se.seq, ro)
+	return db.get(context.Background(), nil, nil, key, nil, se.seq, ro)
 }
 
-// Has returns true if the DB does contains the given key.
+// GetTo is like Get, but appends the value to dst and returns the extended
+// slice as value, e.g. to reuse a buffer across lookups instead of copying
+// each value into a new slice. The contents of dst are kept, and it is
+// only reallocated if its capacity is insufficient, as with append.
 //
-// It is safe to modify the contents of the argument after Get returns.
+// It is safe to modify the contents of the arguments after GetTo returns.
+func (db *DB) GetTo(key, dst []byte, ro *opt.ReadOptions) (value []byte, err error) {
+	err = db.ok()
+	if err != nil {
+		return
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	return db.get(context.Background(), nil, nil, key, dst, se.seq, ro)
+}
+
+// ReleaseValue hands a value returned by Get, GetContext, GetWithMeta,
+// GetMany or Snapshot.Get with the ReadOptions PoolValues back to the
+// buffer pool of the DB, for reuse by later reads. The value must no longer
+// be used once released. Releasing values is optional, values not released
+// are garbage collected as usual. It is a no-op if the buffer pool is
+// disabled, see opt.Options.DisableBufferPool.
+func (db *DB) ReleaseValue(value []byte) {
+	db.s.tops.bpool.Put(value)
+}
+
+// GetWithMeta is like Get, but also returns the metadata of the entry the
+// key resolved to, e.g. to learn the version of a value for change data
+// capture or conflict resolution. If the key is deleted, ErrNotFound is
+// returned along with the metadata of the deletion; the metadata is of
+// type EntryNone if the DB has no entry for the key.
+//
+// It is safe to modify the contents of the argument after GetWithMeta
+// returns.
+func (db *DB) GetWithMeta(key []byte, ro *opt.ReadOptions) (value []byte, meta EntryMeta, err error) {
+	err = db.ok()
+	if err != nil {
+		return
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	return db.getMeta(context.Background(), nil, nil, key, nil, se.seq, ro)
+}
+
+// GetMany gets the values for the given keys, values and errs are in the
+// same order as keys. The error is ErrNotFound if the DB does not contains
+// the key. All keys are looked up from the same snapshot.
+//
+// GetMany is cheaper than calling Get for each key, since the underlying
+// DB state is only acquired once and the keys are looked up in order.
+//
+// The returned slices are its own copy, it is safe to modify the contents
+// of the returned slices.
+// It is safe to modify the contents of the argument after GetMany returns.
+func (db *DB) GetMany(keys [][]byte, ro *opt.ReadOptions) (values [][]byte, errs []error) {
+	if err := db.ok(); err != nil {
+		errs = make([]error, len(keys))
+		for i := range errs {
+			errs[i] = err
+		}
+		return make([][]byte, len(keys)), errs
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	return db.getMany(keys, se.seq, ro)
+}
+
+// GetContext is like Get, but returns ctx.Err() if the given context is
+// already done. Lookups never wait for writes or compaction, so the context
+// is only checked before the lookup starts. The context is the parent of
+// the lookup trace spans, see opt.Tracer.
+func (db *DB) GetContext(ctx context.Context, key []byte, ro *opt.ReadOptions) (value []byte, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	err = db.ok()
+	if err != nil {
+		return
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	return db.get(ctx, nil, nil, key, nil, se.seq, ro)
+}
+
+// Has returns true if the DB does contains the given key. Unlike Get,
+// the value is never copied, and table lookups stop at the key.
+//
+// It is safe to modify the contents of the argument after Has returns.
 func (db *DB) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error) {
 	err = db.ok()
 	if err != nil {
@@ -853,7 +1510,7 @@ func (db *DB) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error) {
 
 	se := db.acquireSnapshot()
 	defer db.releaseSnapshot(se)
-	return db.has(nil, nil, key, se.seq, ro)
+	return db.has(context.Background(), nil, nil, key, se.seq, ro)
 }
 
 // NewIterator returns an iterator for the latest snapshot of the
@@ -867,7 +1524,8 @@ func (db *DB) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error) {
 // Slice allows slicing the iterator to only contains keys in the given
 // range. A nil Range.Start is treated as a key before all keys in the
 // DB. And a nil Range.Limit is treated as a key after all keys in
-// the DB.
+// the DB. The slice is further narrowed by ReadOptions LowerBound and
+// UpperBound, if any.
 //
 // The iterator must be released after use, by calling Release method.
 //
@@ -881,7 +1539,19 @@ func (db *DB) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Itera
 	defer db.releaseSnapshot(se)
 	// Iterator holds 'version' lock, 'version' is immutable so snapshot
 	// can be released after iterator created.
-	return db.newIterator(nil, nil, se.seq, slice, ro)
+	return db.newIterator(nil, nil, se.seq, slice, ro, nil)
+}
+
+// NewIteratorContext is like NewIterator, but the returned iterator becomes
+// invalid once the given context is done; the context is checked on each
+// positioning call, and the iterator Error method then returns ctx.Err().
+//
+// The iterator must still be released after use, by calling Release method.
+func (db *DB) NewIteratorContext(ctx context.Context, slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	if err := ctx.Err(); err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	return &ctxIter{Iterator: db.NewIterator(slice, ro), ctx: ctx}
 }
 
 // GetSnapshot returns a latest snapshot of the underlying DB. A snapshot
@@ -904,6 +1574,8 @@ func (db *DB) GetSnapshot() (*Snapshot, error) {
 //		Returns the number of files at level 'n'.
 //	leveldb.stats
 //		Returns statistics of the underlying DB.
+//	leveldb.stats-json
+//		Returns statistics of the underlying DB as JSON object, see DBStats.
 //	leveldb.sstables
 //		Returns sstables list for each level.
 //	leveldb.blockpool
@@ -916,6 +1588,22 @@ func (db *DB) GetSnapshot() (*Snapshot, error) {
 //		Returns number of alive snapshots.
 //	leveldb.aliveiters
 //		Returns number of alive iterators.
+//	leveldb.writestall
+//		Returns current write stall condition; normal, slowdown or pause.
+//	leveldb.num-snapshots
+//		Returns number of acquired snapshots, including the implicit
+//		snapshots of iterators and in-flight reads.
+//	leveldb.oldest-snapshot-seq
+//		Returns sequence number of the oldest acquired snapshot, or 0 if
+//		there is none.
+//	leveldb.mem-usage
+//		Returns bytes of memory used by memdbs, block caches and table
+//		filters.
+//	leveldb.pending-compaction-bytes
+//		Returns estimated bytes table compaction has yet to compact to
+//		bring each level within its limit.
+//	leveldb.live-sst-size
+//		Returns total size of the live tables.
 func (db *DB) GetProperty(name string) (value string, err error) {
 	err = db.ok()
 	if err != nil {
@@ -976,6 +1664,55 @@ func (db *DB) GetProperty(name string) (value string, err error) {
 		value = fmt.Sprintf("%d", atomic.LoadInt32(&db.aliveSnaps))
 	case p == "aliveiters":
 		value = fmt.Sprintf("%d", atomic.LoadInt32(&db.aliveIters))
+	case p == "writestall":
+		cond, _ := db.s.o.GetWriteStallPolicy().WriteStall(v.tLen(0))
+		value = cond.String()
+	case p == "stats-json":
+		var stats *DBStats
+		if stats, err = db.Stats(); err == nil {
+			var b []byte
+			b, err = json.Marshal(stats)
+			value = string(b)
+		}
+	case p == "num-snapshots", p == "oldest-snapshot-seq":
+		var (
+			n   int
+			seq uint64
+		)
+		db.snapsMu.Lock()
+		if e := db.snapsList.Front(); e != nil {
+			n, seq = db.snapsList.Len(), e.Value.(*snapshotElement).seq
+		}
+		db.snapsMu.Unlock()
+		if p == "num-snapshots" {
+			value = fmt.Sprintf("%d", n)
+		} else {
+			value = fmt.Sprintf("%d", seq)
+		}
+	case p == "mem-usage":
+		var n int64
+		em, fm := db.getMems()
+		for _, m := range [...]*memDB{em, fm} {
+			if m != nil {
+				n += int64(m.Size())
+				m.decref()
+			}
+		}
+		for _, c := range [...]*cache.Cache{db.s.tops.bcache, db.s.tops.ccache, db.s.tops.mcache} {
+			if c != nil {
+				n += int64(c.Size())
+			}
+		}
+		for _, tables := range v.levels {
+			for _, t := range tables {
+				n += int64(t.filterSize())
+			}
+		}
+		value = fmt.Sprintf("%d", n)
+	case p == "pending-compaction-bytes":
+		value = fmt.Sprintf("%d", v.pendingCompactionBytes())
+	case p == "live-sst-size":
+		value = fmt.Sprintf("%d", v.size())
 	default:
 		err = ErrNotFound
 	}
@@ -983,12 +1720,165 @@ func (db *DB) GetProperty(name string) (value string, err error) {
 	return
 }
 
+// DBStats is database statistics.
+type DBStats struct {
+	GetCount uint64 // Number of key lookups, by Get, GetMany and Has
+	PutCount uint64 // Number of records written, including deletions
+
+	WriteDelayCount    int32
+	WriteDelayDuration time.Duration
+	WritePaused        bool
+
+	AliveSnapshots int32
+	AliveIterators int32
+
+	IOWrite uint64 // Bytes written to the storage files
+	IORead  uint64 // Bytes read from the storage files
+
+	BlockCacheSize      int
+	BlockCacheHits      int64
+	BlockCacheMisses    int64
+	BlockCacheEvictions int64
+	OpenedTablesCount   int
+	OpenedTablesHits    int64
+	OpenedTablesMisses  int64
+	OpenedTablesPinned  int
+
+	CompressedBlockCacheSize   int
+	CompressedBlockCacheHits   int64
+	CompressedBlockCacheMisses int64
+
+	MetaBlockCacheSize   int
+	MetaBlockCacheHits   int64
+	MetaBlockCacheMisses int64
+
+	MemTableSize      int  // Size of the effective and frozen memdbs
+	CompactionPending bool // Whether table compaction is needed
+
+	LevelSizes        []int64
+	LevelTablesCounts []int
+	LevelRead         []int64
+	LevelWrite        []int64
+	LevelDurations    []time.Duration
+
+	MemComp       uint32
+	Level0Comp    uint32
+	NonLevel0Comp uint32
+}
+
+// Stats returns a snapshot of the database statistics. The counters are
+// cumulative since the DB was opened, while the sizes and indicators
+// reflect the current state.
+func (db *DB) Stats() (*DBStats, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+
+	s := &DBStats{
+		GetCount: atomic.LoadUint64(&db.cGets),
+		PutCount: atomic.LoadUint64(&db.cPuts),
+
+		WriteDelayCount:    atomic.LoadInt32(&db.cWriteDelayN),
+		WriteDelayDuration: time.Duration(atomic.LoadInt64(&db.cWriteDelay)),
+		WritePaused:        atomic.LoadInt32(&db.inWritePaused) == 1,
+
+		AliveSnapshots: atomic.LoadInt32(&db.aliveSnaps),
+		AliveIterators: atomic.LoadInt32(&db.aliveIters),
+
+		IOWrite: db.s.stor.writes(),
+		IORead:  db.s.stor.reads(),
+
+		OpenedTablesCount:  db.s.tops.cache.Size(),
+		OpenedTablesHits:   db.s.tops.cache.Hits(),
+		OpenedTablesMisses: db.s.tops.cache.Misses(),
+		OpenedTablesPinned: db.s.tops.pinnedLen(),
+
+		MemComp:       atomic.LoadUint32(&db.memComp),
+		Level0Comp:    atomic.LoadUint32(&db.level0Comp),
+		NonLevel0Comp: atomic.LoadUint32(&db.nonLevel0Comp),
+	}
+	if bcache := db.s.tops.bcache; bcache != nil {
+		cs := bcache.Stats()
+		s.BlockCacheSize = cs.Size
+		s.BlockCacheHits = cs.Hits
+		s.BlockCacheMisses = cs.Misses
+		s.BlockCacheEvictions = cs.Evictions
+	}
+	if ccache := db.s.tops.ccache; ccache != nil {
+		cs := ccache.Stats()
+		s.CompressedBlockCacheSize = cs.Size
+		s.CompressedBlockCacheHits = cs.Hits
+		s.CompressedBlockCacheMisses = cs.Misses
+	}
+	if mcache := db.s.tops.mcache; mcache != nil {
+		cs := mcache.Stats()
+		s.MetaBlockCacheSize = cs.Size
+		s.MetaBlockCacheHits = cs.Hits
+		s.MetaBlockCacheMisses = cs.Misses
+	}
+
+	em, fm := db.getMems()
+	if em != nil {
+		s.MemTableSize += em.Size()
+		em.decref()
+	}
+	if fm != nil {
+		s.MemTableSize += fm.Size()
+		fm.decref()
+	}
+
+	v := db.s.version()
+	defer v.release()
+
+	s.CompactionPending = v.needCompaction()
+	for level, tables := range v.levels {
+		duration, read, write := db.compStats.getStat(level)
+		s.LevelSizes = append(s.LevelSizes, tables.size())
+		s.LevelTablesCounts = append(s.LevelTablesCounts, len(tables))
+		s.LevelRead = append(s.LevelRead, read)
+		s.LevelWrite = append(s.LevelWrite, write)
+		s.LevelDurations = append(s.LevelDurations, duration)
+	}
+	return s, nil
+}
+
+// CompactionPending returns the estimated compaction debt, that is the size
+// and number of the tables pending compaction: the level-0 tables once
+// they reach the compaction trigger, and the tables exceeding the total
+// size limit of the other levels. The DB stalls writes as the level-0
+// tables grow, writers may throttle themselves as the debt grows instead,
+// see also opt.Options.CompactionDebtThresholds.
+//
+// It returns zeros if the DB is closed.
+func (db *DB) CompactionPending() (bytes int64, files int) {
+	if err := db.ok(); err != nil {
+		return 0, 0
+	}
+	v := db.s.version()
+	defer v.release()
+	return v.compactionDebt()
+}
+
+// Returns the internal key bounds of the given range, imax is nil if the
+// range has no limit.
+func (db *DB) sizeRange(r util.Range) (imin, imax internalKey) {
+	imin = makeInternalKey(nil, r.Start, keyMaxSeq, keyTypeSeek)
+	if r.Limit != nil {
+		imax = makeInternalKey(nil, r.Limit, keyMaxSeq, keyTypeSeek)
+	}
+	return
+}
+
 // SizeOf calculates approximate sizes of the given key ranges.
 // The length of the returned sizes are equal with the length of the given
 // ranges. The returned sizes measure storage space usage, so if the user
 // data compresses by a factor of ten, the returned sizes will be one-tenth
 // the size of the corresponding user data size.
 // The results may not include the sizes of recently written data.
+//
+// A nil Range.Start is treated as a key before all keys in the DB, and a
+// nil Range.Limit as a key after all keys in the DB, e.g. the range of a
+// prefix as returned by util.BytesPrefix.
 func (db *DB) SizeOf(ranges []util.Range) (Sizes, error) {
 	if err := db.ok(); err != nil {
 		return nil, err
@@ -999,8 +1889,11 @@ func (db *DB) SizeOf(ranges []util.Range) (Sizes, error) {
 
 	sizes := make(Sizes, 0, len(ranges))
 	for _, r := range ranges {
-		imin := makeInternalKey(nil, r.Start, keyMaxSeq, keyTypeSeek)
-		imax := makeInternalKey(nil, r.Limit, keyMaxSeq, keyTypeSeek)
+		if r.Empty(db.s.icmp.ucmp) {
+			sizes = append(sizes, 0)
+			continue
+		}
+		imin, imax := db.sizeRange(r)
 		start, err := v.offsetOf(imin)
 		if err != nil {
 			return nil, err
@@ -1019,6 +1912,92 @@ func (db *DB) SizeOf(ranges []util.Range) (Sizes, error) {
 	return sizes, nil
 }
 
+// RangeSizes is like SizeOf, but it also includes recently written data
+// that haven't been flushed to tables, and breaks down the size of each
+// range. The length of the returned sizes are equal with the length of
+// the given ranges.
+func (db *DB) RangeSizes(ranges []util.Range) ([]RangeSize, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+
+	em, fm := db.getMems()
+	defer func() {
+		if em != nil {
+			em.decref()
+		}
+		if fm != nil {
+			fm.decref()
+		}
+	}()
+	v := db.s.version()
+	defer v.release()
+
+	sizes := make([]RangeSize, 0, len(ranges))
+	for _, r := range ranges {
+		imin, imax := db.sizeRange(r)
+		var size RangeSize
+		if !r.Empty(db.s.icmp.ucmp) {
+			var err error
+			size.TableSize, size.Entries, err = v.sizeOf(imin, imax)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range [...]*memDB{em, fm} {
+				if m == nil {
+					continue
+				}
+				iter := m.NewIterator(&util.Range{Start: imin, Limit: imax})
+				for iter.Next() {
+					size.MemTableSize += int64(len(iter.Key()) + len(iter.Value()))
+					size.Entries++
+				}
+				iter.Release()
+			}
+		}
+		sizes = append(sizes, size)
+	}
+
+	return sizes, nil
+}
+
+// EstimateNumKeys returns approximate number of entries in the DB. Entries
+// that are overwritten or deleted are counted until they are compacted.
+func (db *DB) EstimateNumKeys() (int64, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+
+	v := db.s.version()
+	defer v.release()
+	n, err := v.numEntries()
+	if err != nil {
+		return 0, err
+	}
+
+	em, fm := db.getMems()
+	if em != nil {
+		n += int64(em.Len())
+		em.decref()
+	}
+	if fm != nil {
+		n += int64(fm.Len())
+		fm.decref()
+	}
+	return n, nil
+}
+
+// Syncs the storage, so the files removed, e.g. by the compactions, are
+// durably removed.
+func (db *DB) syncRemoved() {
+	if db.s.o.GetNoSync() || db.s.o.GetReadOnly() {
+		return
+	}
+	if err := db.s.stor.Sync(); err != nil {
+		db.log(opt.LogError, "db@sync storage sync failed", "err", err)
+	}
+}
+
 // Close closes the DB. This will also releases any outstanding snapshot,
 // abort any in-flight compaction and discard open transaction.
 //
@@ -1031,7 +2010,7 @@ func (db *DB) Close() error {
 	}
 
 	start := time.Now()
-	db.log("db@close closing")
+	db.log(opt.LogInfo, "db@close closing")
 
 	// Clear the finalizer.
 	runtime.SetFinalizer(db, nil)
@@ -1067,14 +2046,17 @@ func (db *DB) Close() error {
 		db.journal = nil
 		db.journalWriter = nil
 	}
+	db.dropRecycledJournals()
+
+	db.syncRemoved()
 
 	if db.writeDelayN > 0 {
-		db.logf("db@write was delayed N·%d T·%v", db.writeDelayN, db.writeDelay)
+		db.log(opt.LogInfo, "db@write was delayed", "count", db.writeDelayN, "duration", db.writeDelay)
 	}
 
 	// Close session.
 	db.s.close()
-	db.logf("db@close done T·%v", time.Since(start))
+	db.log(opt.LogInfo, "db@close done", "duration", time.Since(start))
 	db.s.release()
 
 	if db.closer != nil {
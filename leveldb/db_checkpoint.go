@@ -0,0 +1,255 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"io"
+	"time"
+
+	"github.com/FactomProject/goleveldb/leveldb/journal"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/table"
+)
+
+type checkpoint struct {
+	db  *DB
+	dst storage.Storage
+	fds []storage.FileDesc
+}
+
+func (c *checkpoint) create(fd storage.FileDesc) (storage.Writer, error) {
+	w, err := c.dst.Create(fd)
+	if err == nil {
+		c.fds = append(c.fds, fd)
+	}
+	return w, err
+}
+
+func (c *checkpoint) finish(w storage.Writer) error {
+	if err := w.Sync(); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Removes files created in the destination storage.
+func (c *checkpoint) revert() {
+	for _, fd := range c.fds {
+		c.dst.Remove(fd)
+	}
+}
+
+// Links the given file into the destination storage, copies it if the
+// storage can't link it. The links are made durable along with the
+// manifest, which syncs the destination directory.
+func (c *checkpoint) linkFile(fd storage.FileDesc) error {
+	if l, ok := c.db.s.stor.Storage.(storage.Linker); ok {
+		err := l.Link(fd, c.dst)
+		if err == nil {
+			c.fds = append(c.fds, fd)
+		}
+		if err != storage.ErrNotSupported {
+			return err
+		}
+	}
+	r, err := c.db.s.stor.Open(fd)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := c.create(fd)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+	return c.finish(w)
+}
+
+// Writes entries of the given memdb up to the given sequence number into
+// a new table file. Returns nil table file if there is no such entries.
+func (c *checkpoint) writeMem(fd storage.FileDesc, mdb *memDB, seq uint64) (*tFile, error) {
+	iter := mdb.NewIterator(nil)
+	defer iter.Release()
+	var (
+		tw          *table.Writer
+		w           storage.Writer
+		first, last []byte
+		rdels       rangeDels
+	)
+	for iter.Next() {
+		ukey, kseq, kt, kerr := parseInternalKey(iter.Key())
+		if kerr != nil {
+			return nil, kerr
+		}
+		if kseq > seq {
+			continue
+		}
+		if tw == nil {
+			var err error
+			if w, err = c.create(fd); err != nil {
+				return nil, err
+			}
+			tw = table.NewWriter(w, c.db.s.o.tableOptions(0))
+			first = append([]byte{}, iter.Key()...)
+		}
+		last = append(last[:0], iter.Key()...)
+		if kt == keyTypeRangeDel {
+			rdels = append(rdels, rangeDel{kseq, append([]byte{}, ukey...), append([]byte{}, iter.Value()...)})
+		}
+		if err := tw.Append(iter.Key(), iter.Value()); err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	if tw == nil {
+		return nil, iter.Error()
+	}
+	if err := iter.Error(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := c.finish(w); err != nil {
+		return nil, err
+	}
+	t := newTableFile(fd, int64(tw.BytesLen()), internalKey(first), internalKey(last))
+	t.rdels = rdels
+	return t, nil
+}
+
+// Writes the manifest and points the destination storage to it.
+func (c *checkpoint) writeManifest(fd storage.FileDesc, rec *sessionRecord) error {
+	w, err := c.create(fd)
+	if err != nil {
+		return err
+	}
+	jw := journal.NewWriter(w)
+	jr, err := jw.Next()
+	if err == nil {
+		err = rec.encode(jr)
+	}
+	if err == nil {
+		err = jw.Close()
+	}
+	if err != nil {
+		w.Close()
+		return err
+	}
+	if err := c.finish(w); err != nil {
+		return err
+	}
+	return c.dst.SetMeta(fd)
+}
+
+// Checkpoint creates a consistent copy of the DB into the given storage.
+// The copy can be opened as a separate DB with the same comparer.
+//
+// The table and value log files are hard-linked when the storages allow
+// it, see storage.Linker, and copied as is otherwise, while the memdbs
+// content is written into new level-0 tables, so the copy does not need
+// a journal. Writes are blocked only while the DB state is captured; the
+// copy reflects the DB state when Checkpoint was called. Obsolete table
+// files are retained until the checkpoint is done.
+//
+// The destination storage should be empty and must not be the DB storage.
+func (db *DB) Checkpoint(dst storage.Storage) (err error) {
+	if err = db.ok(); err != nil {
+		return
+	}
+
+	start := time.Now()
+
+	// The state is captured under the write lock, so the sequence number
+	// matches the memdbs and the tables content. Writes can't pass in
+	// read-only mode.
+	locked := true
+	if err = db.lockWriter(); err == ErrReadOnly {
+		locked, err = false, nil
+	} else if err != nil {
+		return
+	}
+	em, fm := db.getMems()
+	v := db.s.version()
+	seq := db.getSeq()
+	num := db.s.nextFileNum()
+
+	// The manifest state, as the comparer version and the named snapshots,
+	// is carried over; the quarantined tables aren't copied.
+	rec := &sessionRecord{}
+	db.compCommitLk.Lock()
+	db.s.fillRecord(rec, true)
+	db.compCommitLk.Unlock()
+	rec.resetQuarantinedTables()
+	if locked {
+		<-db.writeLockC
+	}
+
+	defer v.release()
+	if em == nil {
+		return ErrClosed
+	}
+	defer em.decref()
+	if fm != nil {
+		defer fm.decref()
+	}
+
+	c := &checkpoint{db: db, dst: dst}
+	defer func() {
+		if err != nil {
+			c.revert()
+		}
+	}()
+
+	vlogs := make(map[int64]bool)
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			if err = c.linkFile(t.fd); err != nil {
+				return
+			}
+			for _, vnum := range t.vlogs {
+				if !vlogs[vnum] {
+					if err = c.linkFile(storage.FileDesc{Type: storage.TypeValueLog, Num: vnum}); err != nil {
+						return
+					}
+					vlogs[vnum] = true
+				}
+			}
+			rec.addTableFile(level, t)
+		}
+	}
+	for _, mdb := range []*memDB{fm, em} {
+		if mdb == nil {
+			continue
+		}
+		var t *tFile
+		t, err = c.writeMem(storage.FileDesc{Type: storage.TypeTable, Num: num}, mdb, seq)
+		if err != nil {
+			return
+		}
+		if t != nil {
+			rec.addTableFile(0, t)
+			num++
+		}
+	}
+	manifestFd := storage.FileDesc{Type: storage.TypeManifest, Num: num}
+	rec.setJournalNum(0)
+	rec.setSeqNum(seq)
+	rec.setNextFileNum(num + 1)
+	if err = c.writeManifest(manifestFd, rec); err != nil {
+		return
+	}
+	db.log(opt.LogInfo, "db@checkpoint done", "files", len(c.fds), "seq", seq, "duration", time.Since(start))
+	return
+}
@@ -7,12 +7,16 @@
 package leveldb
 
 import (
+	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/FactomProject/goleveldb/leveldb/errors"
 	"github.com/FactomProject/goleveldb/leveldb/opt"
 	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
 var (
@@ -119,6 +123,9 @@ haserr:
 	}
 hasperr:
 	// Persistent error.
+	if errors.IsCorrupted(err) {
+		db.onCorruption(err)
+	}
 	for {
 		select {
 		case db.compErrC <- err:
@@ -147,12 +154,48 @@ type compactionTransactInterface interface {
 	revert() error
 }
 
+// quarantineBuilder wraps a table compaction builder, corruption of an
+// input table aborts the compaction instead of failing it.
+type quarantineBuilder struct {
+	compactionTransactInterface
+	c *compaction
+
+	// The corrupted input table, if any.
+	level int
+	t     *tFile
+	err   error
+}
+
+func (b *quarantineBuilder) run(cnt *compactionTransactCounter) error {
+	err := b.compactionTransactInterface.run(cnt)
+	if cerr, ok := errors.AsCorrupted(err); ok {
+		if level, t := b.c.inputTable(cerr.Fd); t != nil {
+			if rerr := b.revert(); rerr != nil {
+				return rerr
+			}
+			b.level, b.t, b.err = level, t, err
+			return nil
+		}
+	}
+	return err
+}
+
+// Excludes the corrupted table from the version, the table file is kept.
+func (db *DB) quarantineTable(level int, t *tFile, err error) {
+	db.log(opt.LogWarn, "table@quarantine", "level", level, "file", t.fd, "err", err)
+	rec := &sessionRecord{}
+	rec.delTable(level, t.fd.Num)
+	rec.addQuarantinedTable(t.fd.Num, t.vlogs)
+	db.compactionCommit("table-quarantine", rec)
+	db.onTableQuarantined(opt.TableInfo{Level: level, Num: t.fd.Num, Size: t.size}, err)
+}
+
 func (db *DB) compactionTransact(name string, t compactionTransactInterface) {
 	defer func() {
 		if x := recover(); x != nil {
 			if x == errCompactionTransactExiting {
 				if err := t.revert(); err != nil {
-					db.logf("%s revert error %q", name, err)
+					db.log(opt.LogWarn, name+" revert failed", "err", err)
 				}
 			}
 			panic(x)
@@ -174,17 +217,17 @@ func (db *DB) compactionTransact(name string, t compactionTransactInterface) {
 	for n := 0; ; n++ {
 		// Check whether the DB is closed.
 		if db.isClosed() {
-			db.logf("%s exiting", name)
+			db.log(opt.LogDebug, name+" exiting")
 			db.compactionExitTransact()
 		} else if n > 0 {
-			db.logf("%s retrying N·%d", name, n)
+			db.log(opt.LogInfo, name+" retrying", "retry", n)
 		}
 
 		// Execute.
 		cnt := compactionTransactCounter(0)
 		err := t.run(&cnt)
 		if err != nil {
-			db.logf("%s error I·%d %q", name, cnt, err)
+			db.log(opt.LogWarn, name+" error", "progress", cnt, "err", err)
 		}
 
 		// Set compaction error status.
@@ -192,18 +235,18 @@ func (db *DB) compactionTransact(name string, t compactionTransactInterface) {
 		case db.compErrSetC <- err:
 		case perr := <-db.compPerErrC:
 			if err != nil {
-				db.logf("%s exiting (persistent error %q)", name, perr)
+				db.log(opt.LogError, name+" exiting on persistent error", "err", perr)
 				db.compactionExitTransact()
 			}
 		case <-db.closeC:
-			db.logf("%s exiting", name)
+			db.log(opt.LogDebug, name+" exiting")
 			db.compactionExitTransact()
 		}
 		if err == nil {
 			return
 		}
 		if errors.IsCorrupted(err) {
-			db.logf("%s exiting (corruption detected)", name)
+			db.log(opt.LogError, name+" exiting on corruption")
 			db.compactionExitTransact()
 		}
 
@@ -225,7 +268,7 @@ func (db *DB) compactionTransact(name string, t compactionTransactInterface) {
 			select {
 			case <-backoffT.C:
 			case <-db.closeC:
-				db.logf("%s exiting", name)
+				db.log(opt.LogDebug, name+" exiting")
 				db.compactionExitTransact()
 			}
 		}
@@ -252,6 +295,20 @@ func (db *DB) compactionTransactFunc(name string, run func(cnt *compactionTransa
 	db.compactionTransact(name, &compactionTransactFunc{run, revert})
 }
 
+// Traces each run of the wrapped transaction, see opt.Tracer.
+type compactionTransactTrace struct {
+	compactionTransactInterface
+	s    *session
+	info opt.TraceInfo
+}
+
+func (t *compactionTransactTrace) run(cnt *compactionTransactCounter) error {
+	ctx := t.s.traceStart(context.Background(), t.info)
+	err := t.compactionTransactInterface.run(cnt)
+	t.s.traceEnd(ctx, t.info, err)
+	return err
+}
+
 func (db *DB) compactionExitTransact() {
 	panic(errCompactionTransactExiting)
 }
@@ -260,8 +317,13 @@ func (db *DB) compactionCommit(name string, rec *sessionRecord) {
 	db.compCommitLk.Lock()
 	defer db.compCommitLk.Unlock() // Defer is necessary.
 	db.compactionTransactFunc(name+"@commit", func(cnt *compactionTransactCounter) error {
-		return db.s.commit(rec)
+		tinfo := opt.TraceInfo{Op: opt.TraceCompactionCommit, Level: -1, TableNum: -1}
+		ctx := db.s.traceStart(context.Background(), tinfo)
+		err := db.s.commit(rec)
+		db.s.traceEnd(ctx, tinfo, err)
+		return err
 	}, nil)
+	db.checkCompactionDebt()
 }
 
 func (db *DB) memCompaction() {
@@ -271,11 +333,11 @@ func (db *DB) memCompaction() {
 	}
 	defer mdb.decref()
 
-	db.logf("memdb@flush N·%d S·%s", mdb.Len(), shortenb(mdb.Size()))
+	db.log(opt.LogInfo, "memdb@flush", "entries", mdb.Len(), "size", mdb.Size())
 
 	// Don't compact empty memdb.
 	if mdb.Len() == 0 {
-		db.logf("memdb@flush skipping")
+		db.log(opt.LogDebug, "memdb@flush skipping")
 		// drop frozen memdb
 		db.dropFrozenMem()
 		return
@@ -300,16 +362,23 @@ func (db *DB) memCompaction() {
 
 	// Generate tables.
 	db.compactionTransactFunc("memdb@flush", func(cnt *compactionTransactCounter) (err error) {
+		tinfo := opt.TraceInfo{Op: opt.TraceMemFlush, Level: -1, TableNum: -1, Size: int64(mdb.Size())}
+		ctx := db.s.traceStart(context.Background(), tinfo)
 		stats.startTimer()
 		flushLevel, err = db.s.flushMemdb(rec, mdb.DB, db.memdbMaxLevel)
 		stats.stopTimer()
+		if err == nil {
+			tinfo.Level = flushLevel
+		}
+		db.s.traceEnd(ctx, tinfo, err)
 		return
 	}, func() error {
 		for _, r := range rec.addedTables {
-			db.logf("memdb@flush revert @%d", r.num)
+			db.log(opt.LogDebug, "memdb@flush revert", "file", storage.FileDesc{Type: storage.TypeTable, Num: r.num})
 			if err := db.s.stor.Remove(storage.FileDesc{Type: storage.TypeTable, Num: r.num}); err != nil {
 				return err
 			}
+			removeTableVlog(db.s.stor, r.num, r.vlogs)
 		}
 		return nil
 	})
@@ -322,12 +391,15 @@ func (db *DB) memCompaction() {
 	db.compactionCommit("memdb", rec)
 	stats.stopTimer()
 
-	db.logf("memdb@flush committed F·%d T·%v", len(rec.addedTables), stats.duration)
+	db.log(opt.LogInfo, "memdb@flush committed", "files", len(rec.addedTables), "duration", stats.duration)
+	atomic.AddUint32(&db.memComp, 1)
 
 	for _, r := range rec.addedTables {
 		stats.write += r.size
 	}
 	db.compStats.addStat(flushLevel, stats)
+	db.onMemFlush(opt.MemFlushInfo{Level: flushLevel, Entries: mdb.Len(), Size: stats.write, Duration: stats.duration})
+	db.onTablesCreated(rec)
 
 	// Drop frozen memdb.
 	db.dropFrozenMem()
@@ -359,13 +431,19 @@ type tableCompactionBuilder struct {
 	snapIter        int
 	snapKerrCnt     int
 	snapDropCnt     int
+	snapRdels       rangeDels
+	snapVdiscard    int
 
-	kerrCnt int
-	dropCnt int
+	kerrCnt  int
+	dropCnt  int
+	rdels    rangeDels
+	vdiscard []valuePtr // dropped value pointers
 
 	minSeq    uint64
 	strict    bool
 	tableSize int
+	filter    opt.CompactionFilter
+	slice     *util.Range
 
 	tw *tWriter
 }
@@ -374,7 +452,7 @@ func (b *tableCompactionBuilder) appendKV(key, value []byte) error {
 	// Create new table if not already.
 	if b.tw == nil {
 		// Check for pause event.
-		if b.db != nil {
+		if b.db != nil && !b.c.exclusive {
 			select {
 			case ch := <-b.db.tcompPauseC:
 				b.db.pauseCompaction(ch)
@@ -386,10 +464,11 @@ func (b *tableCompactionBuilder) appendKV(key, value []byte) error {
 
 		// Create new table.
 		var err error
-		b.tw, err = b.s.tops.create()
+		b.tw, err = b.s.tops.create(b.c.outputLevel())
 		if err != nil {
 			return err
 		}
+		b.tw.dropCache = b.s.o.GetCompactionDropCache()
 	}
 
 	// Write key/value into table.
@@ -405,13 +484,22 @@ func (b *tableCompactionBuilder) flush() error {
 	if err != nil {
 		return err
 	}
-	b.rec.addTableFile(b.c.sourceLevel+1, t)
+	b.rec.addTableFile(b.c.outputLevel(), t)
 	b.stat1.write += t.size
-	b.s.logf("table@build created L%d@%d N·%d S·%s %q:%q", b.c.sourceLevel+1, t.fd.Num, b.tw.tw.EntriesLen(), shortenb(int(t.size)), t.imin, t.imax)
+	b.s.log(opt.LogInfo, "table@build created", "level", b.c.outputLevel(), "file", t.fd, "entries", b.tw.tw.EntriesLen(), "size", t.size, "min", t.imin, "max", t.imax)
 	b.tw = nil
 	return nil
 }
 
+// Records value pointer dropped by the compaction.
+func (b *tableCompactionBuilder) discard(kt keyType, value []byte) {
+	if kt == keyTypeValPtr {
+		if p, err := decodeValuePtr(value); err == nil {
+			b.vdiscard = append(b.vdiscard, p)
+		}
+	}
+}
+
 func (b *tableCompactionBuilder) cleanup() {
 	if b.tw != nil {
 		b.tw.drop()
@@ -426,6 +514,8 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 	lastSeq := b.snapLastSeq
 	b.kerrCnt = b.snapKerrCnt
 	b.dropCnt = b.snapDropCnt
+	b.rdels = b.snapRdels
+	b.vdiscard = b.vdiscard[:b.snapVdiscard]
 	// Restore compaction state.
 	b.c.restore()
 
@@ -434,7 +524,7 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 	b.stat1.startTimer()
 	defer b.stat1.stopTimer()
 
-	iter := b.c.newIterator()
+	iter := b.c.newIterator(b.slice)
 	defer iter.Release()
 	for i := 0; iter.Next(); i++ {
 		// Incr transact counter.
@@ -451,11 +541,15 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 			snapResumed = false
 		}
 
-		ikey := iter.Key()
+		ikey, value := iter.Key(), iter.Value()
 		ukey, seq, kt, kerr := parseInternalKey(ikey)
 
 		if kerr == nil {
-			shouldStop := !resumed && b.c.shouldStopBefore(ikey)
+			var size int
+			if b.tw != nil {
+				size = b.tw.tw.BytesLen()
+			}
+			shouldStop := !resumed && b.c.shouldStopBefore(ikey, size)
 
 			if !hasLastUkey || b.s.icmp.uCompare(lastUkey, ukey) != 0 {
 				// First occurrence of this user key.
@@ -474,6 +568,8 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 					b.snapIter = i
 					b.snapKerrCnt = b.kerrCnt
 					b.snapDropCnt = b.dropCnt
+					b.snapRdels = b.rdels
+					b.snapVdiscard = len(b.vdiscard)
 				}
 
 				hasLastUkey = true
@@ -482,6 +578,19 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 			}
 
 			switch {
+			case kt == keyTypeRangeDel:
+				// Range tombstone covers more than its own user key, so it
+				// can't be shadowed by newer entries of the same user key.
+				if seq <= b.minSeq {
+					rd := rangeDel{seq, append([]byte{}, ukey...), append([]byte{}, iter.Value()...)}
+					b.rdels = append(b.rdels, rd)
+					if b.c.rangeDelObsolete(rd.start, rd.limit) {
+						// Every entry it covers is either newer or being
+						// dropped by this compaction.
+						b.dropCnt++
+						continue
+					}
+				}
 			case lastSeq <= b.minSeq:
 				// Dropped because newer entry for same user key exist
 				fallthrough // (A)
@@ -495,9 +604,40 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 				// Therefore this deletion marker is obsolete and can be dropped.
 				lastSeq = seq
 				b.dropCnt++
+				b.discard(kt, value)
+				continue
+			case b.rdels.covers(b.s.icmp, ukey, seq, b.minSeq):
+				// Deleted by range tombstone which visible to all snapshots.
+				lastSeq = seq
+				b.dropCnt++
+				b.discard(kt, value)
 				continue
 			default:
 				lastSeq = seq
+				if b.filter != nil && (kt == keyTypeVal || kt == keyTypeValPtr) && seq <= b.minSeq {
+					fvalue := value
+					if kt == keyTypeValPtr {
+						var err error
+						if fvalue, err = b.s.tops.readValue(value, nil); err != nil {
+							return err
+						}
+					}
+					decision, newValue := b.filter.Filter(b.c.outputLevel(), ukey, fvalue)
+					switch decision {
+					case opt.CompactionFilterRemove:
+						b.discard(kt, value)
+						if b.c.baseLevelForKey(ukey) {
+							b.dropCnt++
+							continue
+						}
+						// Older entries may exist in higher levels, so
+						// replace it with a deletion marker.
+						ikey, value = makeInternalKey(nil, ukey, seq, keyTypeDel), nil
+					case opt.CompactionFilterChange:
+						b.discard(kt, value)
+						ikey, value = makeInternalKey(nil, ukey, seq, keyTypeVal), newValue
+					}
+				}
 			}
 		} else {
 			if b.strict {
@@ -511,7 +651,7 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 			b.kerrCnt++
 		}
 
-		if err := b.appendKV(ikey, iter.Value()); err != nil {
+		if err := b.appendKV(ikey, value); err != nil {
 			return err
 		}
 	}
@@ -529,26 +669,144 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 
 func (b *tableCompactionBuilder) revert() error {
 	for _, at := range b.rec.addedTables {
-		b.s.logf("table@build revert @%d", at.num)
+		b.s.log(opt.LogDebug, "table@build revert", "file", storage.FileDesc{Type: storage.TypeTable, Num: at.num})
 		if err := b.s.stor.Remove(storage.FileDesc{Type: storage.TypeTable, Num: at.num}); err != nil {
 			return err
 		}
+		removeTableVlog(b.s.stor, at.num, at.vlogs)
+	}
+	return nil
+}
+
+// Splits the builder into builders of the key ranges separated by the
+// given user keys.
+func (b *tableCompactionBuilder) split(ukeys [][]byte) *subcompactionBuilder {
+	sb := &subcompactionBuilder{
+		db:   b.db,
+		done: make([]bool, len(ukeys)+1),
+	}
+	var start []byte
+	for i := 0; i <= len(ukeys); i++ {
+		var limit []byte
+		if i < len(ukeys) {
+			limit = makeInternalKey(nil, ukeys[i], keyMaxSeq, keyTypeSeek)
+		}
+		sb.shards = append(sb.shards, &tableCompactionBuilder{
+			db:        b.db,
+			s:         b.s,
+			c:         b.c.subcompaction(),
+			rec:       &sessionRecord{},
+			stat1:     &cStatStaging{},
+			minSeq:    b.minSeq,
+			strict:    b.strict,
+			tableSize: b.tableSize,
+			filter:    b.filter,
+			slice:     &util.Range{Start: start, Limit: limit},
+		})
+		start = limit
+	}
+	return sb
+}
+
+// subcompactionBuilder compacts key ranges of a table compaction
+// concurrently, each using its own table compaction builder.
+type subcompactionBuilder struct {
+	db     *DB
+	shards []*tableCompactionBuilder
+	done   []bool
+}
+
+func (b *subcompactionBuilder) run(cnt *compactionTransactCounter) error {
+	var (
+		wg      sync.WaitGroup
+		errs    = make([]error, len(b.shards))
+		cnts    = make([]compactionTransactCounter, len(b.shards))
+		exiting int32
+	)
+	for i, sb := range b.shards {
+		// Don't redo key ranges already compacted by previous run.
+		if b.done[i] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, sb *tableCompactionBuilder) {
+			defer wg.Done()
+			defer func() {
+				if x := recover(); x != nil {
+					if x != errCompactionTransactExiting {
+						panic(x)
+					}
+					atomic.StoreInt32(&exiting, 1)
+				}
+			}()
+			errs[i] = sb.run(&cnts[i])
+			b.done[i] = errs[i] == nil
+		}(i, sb)
+	}
+	wg.Wait()
+
+	for _, n := range cnts {
+		*cnt += n
+	}
+	if exiting != 0 {
+		b.db.compactionExitTransact()
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *subcompactionBuilder) revert() error {
+	for _, sb := range b.shards {
+		if err := sb.revert(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// Merges the results of the key ranges into the given builder.
+func (b *subcompactionBuilder) merge(dst *tableCompactionBuilder) {
+	for _, sb := range b.shards {
+		dst.rec.addTables(sb.rec)
+		dst.stat1.write += sb.stat1.write
+		dst.kerrCnt += sb.kerrCnt
+		dst.dropCnt += sb.dropCnt
+		dst.vdiscard = append(dst.vdiscard, sb.vdiscard...)
+	}
+}
+
 func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 	defer c.release()
 
+	if c.sourceLevel == 0 {
+		atomic.AddUint32(&db.level0Comp, 1)
+	} else {
+		atomic.AddUint32(&db.nonLevel0Comp, 1)
+	}
+
 	rec := &sessionRecord{}
-	rec.addCompPtr(c.sourceLevel, c.imax)
+	if !c.intraL0 {
+		rec.addCompPtr(c.sourceLevel, c.imax)
+	}
 
 	if !noTrivial && c.trivial() {
-		t := c.levels[0][0]
-		db.logf("table@move L%d@%d -> L%d", c.sourceLevel, t.fd.Num, c.sourceLevel+1)
-		rec.delTable(c.sourceLevel, t.fd.Num)
-		rec.addTableFile(c.sourceLevel+1, t)
+		info := opt.CompactionInfo{SourceLevel: c.sourceLevel, Trivial: true}
+		for _, t := range c.levels[0] {
+			db.log(opt.LogInfo, "table@move", "level", c.sourceLevel, "file", t.fd, "targetLevel", c.sourceLevel+1)
+			rec.delTable(c.sourceLevel, t.fd.Num)
+			rec.addTableFile(c.sourceLevel+1, t)
+			info.InputTables++
+			info.InputSize += t.size
+		}
+		db.onCompactionBegin(info)
+		start := time.Now()
 		db.compactionCommit("table-move", rec)
+		info.OutputTables, info.OutputSize, info.Duration = info.InputTables, info.InputSize, time.Since(start)
+		db.onCompactionEnd(info)
 		return
 	}
 
@@ -562,7 +820,8 @@ func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 	}
 	sourceSize := int(stats[0].read + stats[1].read)
 	minSeq := db.minSeq()
-	db.logf("table@compaction L%d·%d -> L%d·%d S·%s Q·%d", c.sourceLevel, len(c.levels[0]), c.sourceLevel+1, len(c.levels[1]), shortenb(sourceSize), minSeq)
+	db.log(opt.LogInfo, "table@compaction", "level", c.sourceLevel, "files", len(c.levels[0]), "targetLevel", c.outputLevel(), "targetFiles", len(c.levels[1]), "size", sourceSize, "seq", minSeq)
+	info := opt.CompactionInfo{SourceLevel: c.sourceLevel, IntraL0: c.intraL0, InputTables: len(c.levels[0]) + len(c.levels[1]), InputSize: int64(sourceSize)}
 
 	b := &tableCompactionBuilder{
 		db:        db,
@@ -572,9 +831,86 @@ func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 		stat1:     &stats[1],
 		minSeq:    minSeq,
 		strict:    db.s.o.GetStrict(opt.StrictCompaction),
-		tableSize: db.s.o.GetCompactionTableSize(c.sourceLevel + 1),
+		tableSize: c.tableSize,
+		filter:    db.s.o.GetCompactionFilter(),
+	}
+
+	// Split wide compaction into key ranges compacted concurrently. Range
+	// tombstones may cover keys beyond the key range they're in, so such
+	// compaction is not split.
+	var sb *subcompactionBuilder
+	if n := db.s.o.GetMaxSubcompactions(); n > 1 && sourceSize >= 2*b.tableSize && !c.hasRangeDels() {
+		if m := sourceSize / b.tableSize; n > m {
+			n = m
+		}
+		if ukeys := c.split(n); len(ukeys) > 0 {
+			sb = b.split(ukeys)
+			info.Subcompactions = len(sb.shards)
+			db.log(opt.LogDebug, "table@compaction split", "subcompactions", len(sb.shards))
+		}
+	}
+
+	db.onCompactionBegin(info)
+	start := time.Now()
+
+	var builder compactionTransactInterface = b
+	if sb != nil {
+		builder = sb
+	}
+	var qb *quarantineBuilder
+	if !b.strict && db.s.o.GetCorruptionPolicy() == opt.CorruptionQuarantine {
+		qb = &quarantineBuilder{compactionTransactInterface: builder, c: c}
+		builder = qb
+	}
+	if db.s.tracer != nil {
+		builder = &compactionTransactTrace{
+			compactionTransactInterface: builder,
+			s:                           db.s,
+			info:                        opt.TraceInfo{Op: opt.TraceCompactionBuild, Level: c.sourceLevel, TableNum: -1, Size: int64(sourceSize)},
+		}
+	}
+	if sb != nil {
+		stats[1].startTimer()
+		db.compactionTransact("table@build", builder)
+		stats[1].stopTimer()
+	} else {
+		db.compactionTransact("table@build", builder)
+	}
+	if qb != nil && qb.t != nil {
+		db.quarantineTable(qb.level, qb.t, qb.err)
+		info.Duration = time.Since(start)
+		db.onCompactionEnd(info)
+		return
+	}
+	if sb != nil {
+		sb.merge(b)
+	}
+
+	if db.s.o.GetCompactionDropCache() {
+		for _, tables := range c.levels {
+			for _, t := range tables {
+				db.s.tops.dropCache(t)
+			}
+		}
+	}
+
+	// The discarded bytes of the value logs are committed along with the
+	// compaction; only the table compaction discards values.
+	if len(b.vdiscard) > 0 {
+		discards := make(map[int64]int64)
+		var nums []int64
+		for _, p := range b.vdiscard {
+			if _, ok := discards[p.num]; !ok {
+				discards[p.num] = db.s.tops.vlogDiscarded(p.num)
+				nums = append(nums, p.num)
+			}
+			discards[p.num] += p.size()
+		}
+		sort.Sort(int64Slice(nums))
+		for _, num := range nums {
+			rec.addValueLogDiscard(num, discards[num])
+		}
 	}
-	db.compactionTransact("table@build", b)
 
 	// Commit.
 	stats[1].startTimer()
@@ -582,38 +918,63 @@ func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 	stats[1].stopTimer()
 
 	resultSize := int(stats[1].write)
-	db.logf("table@compaction committed F%s S%s Ke·%d D·%d T·%v", sint(len(rec.addedTables)-len(rec.deletedTables)), sshortenb(resultSize-sourceSize), b.kerrCnt, b.dropCnt, stats[1].duration)
+	db.log(opt.LogInfo, "table@compaction committed", "files", len(rec.addedTables)-len(rec.deletedTables), "size", resultSize-sourceSize, "keyErrors", b.kerrCnt, "dropped", b.dropCnt, "duration", stats[1].duration)
 
 	// Save compaction stats
 	for i := range stats {
-		db.compStats.addStat(c.sourceLevel+1, &stats[i])
+		db.compStats.addStat(c.outputLevel(), &stats[i])
+	}
+
+	info.OutputTables, info.OutputSize, info.Duration = len(rec.addedTables), stats[1].write, time.Since(start)
+	db.onCompactionEnd(info)
+	db.onTablesCreated(rec)
+}
+
+// Returns the deepest level, at least level-1, with tables overlapping the
+// given range.
+func (db *DB) rangeMaxLevel(umin, umax []byte) int {
+	v := db.s.version()
+	defer v.release()
+	m := 1
+	for i := m; i < len(v.levels); i++ {
+		tables := v.levels[i]
+		if tables.overlaps(db.s.icmp, umin, umax, false) {
+			m = i
+		}
 	}
+	return m
 }
 
-func (db *DB) tableRangeCompaction(level int, umin, umax []byte) error {
-	db.logf("table@compaction range L%d %q:%q", level, umin, umax)
-	if level >= 0 {
+func (db *DB) tableRangeCompaction(level int, umin, umax []byte, o *opt.CompactionOptions) error {
+	db.log(opt.LogInfo, "table@compaction range", "level", level, "min", umin, "max", umax)
+	if db.s.o.GetFIFOCompactionTotalSize() > 0 {
+		db.fifoCompaction()
+	} else if level >= 0 {
 		if c := db.s.getCompactionRange(level, umin, umax, true); c != nil {
 			db.tableCompaction(c, true)
 		}
+	} else if o.GetMoveOnly() {
+		m := o.GetTargetLevel()
+		if m == 0 {
+			m = db.rangeMaxLevel(umin, umax)
+		}
+		for level := 0; level < m; level++ {
+			db.tableRangeMove(level, umin, umax)
+		}
 	} else {
 		// Retry until nothing to compact.
 		for {
 			compacted := false
 
 			// Scan for maximum level with overlapped tables.
-			v := db.s.version()
-			m := 1
-			for i := m; i < len(v.levels); i++ {
-				tables := v.levels[i]
-				if tables.overlaps(db.s.icmp, umin, umax, false) {
-					m = i
-				}
+			m := o.GetTargetLevel()
+			if m == 0 {
+				m = db.rangeMaxLevel(umin, umax)
 			}
-			v.release()
 
 			for level := 0; level < m; level++ {
 				if c := db.s.getCompactionRange(level, umin, umax, false); c != nil {
+					c.exclusive = o.GetExclusive()
 					db.tableCompaction(c, true)
 					compacted = true
 				}
@@ -628,16 +989,154 @@ func (db *DB) tableRangeCompaction(level int, umin, umax []byte) error {
 	return nil
 }
 
+// Moves tables of the given level within the given range into the next
+// level, unless they overlap with tables in the next level.
+func (db *DB) tableRangeMove(level int, umin, umax []byte) {
+	v := db.s.version()
+	defer v.release()
+	if level >= len(v.levels) || db.s.isLastLevel(level) {
+		return
+	}
+	vt0 := v.levels[level]
+	vt1 := tFiles{}
+	if level+1 < len(v.levels) {
+		vt1 = v.levels[level+1]
+	}
+
+	rec := &sessionRecord{}
+	info := opt.CompactionInfo{SourceLevel: level, Trivial: true}
+	for _, t := range vt0.getOverlaps(nil, db.s.icmp, umin, umax, level == 0) {
+		imin, imax := t.imin.ukey(), t.imax.ukey()
+		// Level-0 tables may overlap each other, moving one of them would
+		// break their ordering.
+		if level == 0 && len(vt0.getOverlaps(nil, db.s.icmp, imin, imax, true)) > 1 {
+			continue
+		}
+		if vt1.overlaps(db.s.icmp, imin, tFiles{t}.rangeDelLimit(db.s.icmp, imax), false) {
+			continue
+		}
+		db.log(opt.LogInfo, "table@move", "level", level, "file", t.fd, "targetLevel", level+1)
+		rec.delTable(level, t.fd.Num)
+		rec.addTableFile(level+1, t)
+		info.InputTables++
+		info.InputSize += t.size
+	}
+	if info.InputTables == 0 {
+		return
+	}
+	db.onCompactionBegin(info)
+	start := time.Now()
+	db.compactionCommit("table-move", rec)
+	info.OutputTables, info.OutputSize, info.Duration = info.InputTables, info.InputSize, time.Since(start)
+	db.onCompactionEnd(info)
+}
+
+// Rewrites a table referencing value log being collected, relocating the
+// values out of that value log. The rewritten table stays at the same level.
+func (db *DB) vlogGC() {
+	v := db.s.version()
+	defer v.release()
+	level, t := v.pickVlogGC()
+	if t == nil {
+		return
+	}
+
+	// Check for pause event.
+	select {
+	case ch := <-db.tcompPauseC:
+		db.pauseCompaction(ch)
+	case <-db.closeC:
+		db.compactionExitTransact()
+	default:
+	}
+
+	db.log(opt.LogInfo, "vlog@gc rewriting", "level", level, "file", t.fd)
+	stats := &cStatStaging{read: t.size}
+	ro := &opt.ReadOptions{
+		DontFillCache: true,
+		Strict:        opt.StrictOverride,
+	}
+	var nt *tFile
+	db.compactionTransactFunc("vlog@gc", func(cnt *compactionTransactCounter) (err error) {
+		stats.startTimer()
+		defer stats.stopTimer()
+		w, err := db.s.tops.create(level)
+		if err != nil {
+			return
+		}
+		defer func() {
+			if err != nil {
+				w.drop()
+			}
+		}()
+		iter := db.s.tops.newIterator(t, nil, ro)
+		defer iter.Release()
+		for iter.Next() {
+			cnt.incr()
+			if err = w.append(iter.Key(), iter.Value()); err != nil {
+				return
+			}
+		}
+		if err = iter.Error(); err != nil {
+			return
+		}
+		nt, err = w.finish()
+		return
+	}, nil)
+
+	rec := &sessionRecord{}
+	rec.delTable(level, t.fd.Num)
+	rec.addTableFile(level, nt)
+	stats.startTimer()
+	db.compactionCommit("vlog@gc", rec)
+	stats.stopTimer()
+	stats.write = nt.size
+	db.log(opt.LogInfo, "vlog@gc committed", "level", level, "file", t.fd, "newFile", nt.fd, "duration", stats.duration)
+	db.compStats.addStat(level, stats)
+	db.onTablesCreated(rec)
+}
+
+// Drops the oldest tables, see opt.Options.FIFOCompactionTotalSize.
+func (db *DB) fifoCompaction() {
+	v := db.s.version()
+	drop := v.pickFIFO(db.s.o.GetFIFOCompactionTotalSize())
+	v.release()
+	if len(drop) == 0 {
+		return
+	}
+
+	rec := &sessionRecord{}
+	var size int64
+	for _, ft := range drop {
+		db.log(opt.LogInfo, "table@fifo dropping", "level", ft.level, "file", ft.t.fd, "size", ft.t.size)
+		rec.delTable(ft.level, ft.t.fd.Num)
+		size += ft.t.size
+	}
+	db.compactionCommit("table-fifo", rec)
+	db.log(opt.LogInfo, "table@fifo committed", "files", len(drop), "size", size)
+}
+
 func (db *DB) tableAutoCompaction() {
-	if c := db.s.pickCompaction(); c != nil {
+	if db.s.o.GetFIFOCompactionTotalSize() > 0 {
+		db.fifoCompaction()
+	} else if c := db.s.pickCompaction(); c != nil {
 		db.tableCompaction(c, false)
+	} else {
+		db.vlogGC()
 	}
 }
 
 func (db *DB) tableNeedCompaction() bool {
 	v := db.s.version()
 	defer v.release()
-	return v.needCompaction()
+	if v.needCompaction() {
+		return true
+	}
+	if db.s.o.GetFIFOCompactionTotalSize() > 0 {
+		return false
+	}
+	_, t := v.pickVlogGC()
+	return t != nil
 }
 
 func (db *DB) pauseCompaction(ch chan<- struct{}) {
@@ -668,6 +1167,7 @@ func (r cAuto) ack(err error) {
 type cRange struct {
 	level    int
 	min, max []byte
+	o        *opt.CompactionOptions
 	ackC     chan<- error
 }
 
@@ -690,6 +1190,12 @@ func (db *DB) compTrigger(compC chan<- cCmd) {
 
 // This will trigger auto compaction and/or wait for all compaction to be done.
 func (db *DB) compTriggerWait(compC chan<- cCmd) (err error) {
+	return db.compTriggerWaitContext(context.Background(), compC)
+}
+
+// Same as compTriggerWait, but the wait is abandoned once the given context
+// is done.
+func (db *DB) compTriggerWaitContext(ctx context.Context, compC chan<- cCmd) (err error) {
 	ch := make(chan error)
 	defer close(ch)
 	// Send cmd.
@@ -699,6 +1205,8 @@ func (db *DB) compTriggerWait(compC chan<- cCmd) (err error) {
 		return
 	case <-db.closeC:
 		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 	// Wait cmd.
 	select {
@@ -706,17 +1214,20 @@ func (db *DB) compTriggerWait(compC chan<- cCmd) (err error) {
 	case err = <-db.compErrC:
 	case <-db.closeC:
 		return ErrClosed
+	case <-ctx.Done():
+		// The ack will be dropped, see cAuto.ack.
+		return ctx.Err()
 	}
 	return err
 }
 
 // Send range compaction request.
-func (db *DB) compTriggerRange(compC chan<- cCmd, level int, min, max []byte) (err error) {
+func (db *DB) compTriggerRange(compC chan<- cCmd, level int, min, max []byte, o *opt.CompactionOptions) (err error) {
 	ch := make(chan error)
 	defer close(ch)
 	// Send cmd.
 	select {
-	case compC <- cRange{level, min, max, ch}:
+	case compC <- cRange{level, min, max, o, ch}:
 	case err := <-db.compErrC:
 		return err
 	case <-db.closeC:
@@ -815,7 +1326,7 @@ func (db *DB) tCompaction() {
 			case cAuto:
 				ackQ = append(ackQ, x)
 			case cRange:
-				x.ack(db.tableRangeCompaction(cmd.level, cmd.min, cmd.max))
+				x.ack(db.tableRangeCompaction(cmd.level, cmd.min, cmd.max, cmd.o))
 			default:
 				panic("leveldb: unknown command")
 			}
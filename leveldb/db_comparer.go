@@ -0,0 +1,179 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/FactomProject/goleveldb/leveldb/comparer"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+)
+
+// Maximum number of keys validated by DB.validateComparer.
+const comparerValidateKeys = 256
+
+// Validates the comparer over the boundaries of the tables, see
+// opt.Options.ValidateComparer.
+func (db *DB) validateComparer() error {
+	v := db.s.version()
+	defer v.release()
+
+	var tables tFiles
+	for _, lt := range v.levels {
+		tables = append(tables, lt...)
+	}
+	step := 1
+	if n := len(tables) * 2; n > comparerValidateKeys {
+		step = (n + comparerValidateKeys - 1) / comparerValidateKeys
+	}
+	var keys [][]byte
+	for i := 0; i < len(tables); i += step {
+		keys = append(keys, tables[i].imin.ukey(), tables[i].imax.ukey())
+	}
+	if err := comparer.Validate(db.s.icmp.ucmp, keys); err != nil {
+		return fmt.Errorf("leveldb: invalid comparer: %v", err)
+	}
+	return nil
+}
+
+// Upgrades the DB to the comparer of the options, as allowed by
+// opt.Options.ComparerUpgrade; need external synchronization.
+//
+// Each table is rewritten into a new level-0 table, with its entries sorted
+// under the new ordering. The tables are rewritten from the deepest level
+// up, and level-0 tables from the oldest, so the newer versions of a key
+// are still in the newer tables. The journals are replayed afterward under
+// the new ordering, and a full compaction must follow to restore the
+// levels.
+func (db *DB) upgradeComparer() error {
+	mismatch := db.s.cmpUpgrade
+	db.log(opt.LogInfo, "db@upgrade-comparer", "from", mismatch.Name, "from-version", mismatch.Version, "to", mismatch.WantName, "to-version", mismatch.WantVersion)
+
+	v := db.s.version()
+	defer v.release()
+
+	// Range deletions would cover other keys under the new ordering.
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			if len(t.rdels) > 0 {
+				return fmt.Errorf("leveldb: comparer upgrade: table %d holds range deletions", t.fd.Num)
+			}
+		}
+	}
+	mdb, _, _, err := db.replayJournalsRO(db.seq, db.s.stJournalNum, db.s.stPrevJournalNum)
+	if err != nil {
+		return err
+	}
+	rds, err := collectRangeDels(mdb.NewIterator(nil))
+	if err != nil {
+		return err
+	}
+	if len(rds) > 0 {
+		return fmt.Errorf("leveldb: comparer upgrade: journals hold range deletions")
+	}
+
+	var (
+		rec    = &sessionRecord{}
+		tables tFiles
+	)
+	discard := func() {
+		for _, t := range tables {
+			removeTableVlog(db.s.stor, t.fd.Num, t.vlogs)
+			if err := db.s.stor.Remove(t.fd); err == nil {
+				db.s.reuseFileNum(t.fd.Num)
+			}
+		}
+	}
+	for level := len(v.levels) - 1; level >= 0; level-- {
+		// Level-0 tables are sorted by file number in descending order.
+		for i := len(v.levels[level]) - 1; i >= 0; i-- {
+			t := v.levels[level][i]
+			nt, err := db.rewriteTable(t)
+			if err != nil {
+				discard()
+				return err
+			}
+			rec.delTable(level, t.fd.Num)
+			if nt != nil {
+				rec.addTableFile(0, nt)
+				tables = append(tables, nt)
+				db.log(opt.LogDebug, "table@upgrade-comparer", "level", level, "file", t.fd, "new", nt.fd)
+			}
+		}
+	}
+	rec.setComparer(mismatch.WantName)
+	if mismatch.Version > 0 || mismatch.WantVersion > 0 {
+		rec.setComparerVersion(mismatch.WantVersion)
+	}
+	if err := db.s.commit(rec); err != nil {
+		discard()
+		return err
+	}
+	db.onTablesCreated(rec)
+	return nil
+}
+
+// Rewrites the entries of the given table into a new level-0 table, sorted
+// under the comparer ordering. Returns nil if the table is empty.
+func (db *DB) rewriteTable(t *tFile) (*tFile, error) {
+	ro := &opt.ReadOptions{
+		DontFillCache: true,
+		Strict:        opt.StrictOverride | opt.StrictReader,
+	}
+	// The table is iterated in its stored order, which the new comparer
+	// doesn't match; the entries are sorted in memory.
+	x := &entriesSortByKey{icmp: db.s.icmp}
+	iter := db.s.tops.newIterator(t, nil, ro)
+	for iter.Next() {
+		x.keys = append(x.keys, append([]byte{}, iter.Key()...))
+		x.values = append(x.values, append([]byte{}, iter.Value()...))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if len(x.keys) == 0 {
+		return nil, nil
+	}
+	sort.Sort(x)
+
+	w, err := db.s.tops.create(0)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range x.keys {
+		if err := w.append(key, x.values[i]); err != nil {
+			w.drop()
+			return nil, err
+		}
+	}
+	nt, err := w.finish()
+	if err != nil {
+		w.drop()
+		return nil, err
+	}
+	return nt, nil
+}
+
+type entriesSortByKey struct {
+	keys, values [][]byte
+	icmp         *iComparer
+}
+
+func (x *entriesSortByKey) Len() int {
+	return len(x.keys)
+}
+
+func (x *entriesSortByKey) Less(i, j int) bool {
+	return x.icmp.Compare(x.keys[i], x.keys[j]) < 0
+}
+
+func (x *entriesSortByKey) Swap(i, j int) {
+	x.keys[i], x.keys[j] = x.keys[j], x.keys[i]
+	x.values[i], x.values[j] = x.values[j], x.values[i]
+}
@@ -0,0 +1,423 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"runtime"
+	"sync/atomic"
+
+	"github.com/FactomProject/goleveldb/leveldb/iterator"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+// DiffIterator iterates over keys whose visible value differ between two
+// DB states, see DB.NewDiffIterator.
+type DiffIterator interface {
+	iterator.Iterator
+
+	// Deleted returns true if the current key is deleted in the newer
+	// state, Value returns nil then.
+	Deleted() bool
+}
+
+type emptyDiffIter struct {
+	iterator.Iterator
+}
+
+func (emptyDiffIter) Deleted() bool { return false }
+
+// diffIter walks the raw iterator one user key at a time, comparing the
+// entry visible at each of the sequence numbers.
+type diffIter struct {
+	db       *DB
+	icmp     *iComparer
+	iter     iterator.Iterator
+	rdels    rangeDelSet
+	fromSeq  uint64
+	toSeq    uint64
+	strict   bool
+	dir      dir
+	key      []byte
+	value    []byte
+	vptr     bool
+	deleted  bool
+	err      error
+	releaser util.Releaser
+}
+
+func (i *diffIter) setErr(err error) {
+	i.err = err
+	i.key = nil
+	i.value = nil
+}
+
+func (i *diffIter) iterErr() {
+	if err := i.iter.Error(); err != nil {
+		i.setErr(err)
+	}
+}
+
+// Returns user key at the raw iterator position, skips invalid keys.
+// Returns false if the raw iterator is exhausted or on error.
+func (i *diffIter) ukey(forward bool) ([]byte, bool) {
+	for i.iter.Valid() {
+		ukey, _, _, kerr := parseInternalKey(i.iter.Key())
+		if kerr == nil {
+			return ukey, true
+		} else if i.strict {
+			i.setErr(kerr)
+			return nil, false
+		}
+		if forward {
+			i.iter.Next()
+		} else {
+			i.iter.Prev()
+		}
+	}
+	i.iterErr()
+	return nil, false
+}
+
+// Reads all entries of the user key at the raw iterator position, in the
+// given direction, leaving the raw iterator past them. Returns true if
+// the visible value of the key differ.
+func (i *diffIter) readKey(ukey []byte, forward bool) bool {
+	i.key = append(i.key[:0], ukey...)
+	var (
+		fromSeq, toSeq uint64
+		fromKt, toKt   keyType
+		hasFrom, hasTo bool
+	)
+	for {
+		ukey, seq, kt, kerr := parseInternalKey(i.iter.Key())
+		if kerr == nil {
+			if i.icmp.uCompare(ukey, i.key) != 0 {
+				break
+			}
+			// The entry with the largest sequence number not greater
+			// than the state sequence number is visible. Range tombstones
+			// are keyed by their start key but don't delete it.
+			if kt != keyTypeRangeDel {
+				if seq <= i.toSeq && (!hasTo || seq > toSeq) {
+					toSeq, toKt, hasTo = seq, kt, true
+					if kt == keyTypeVal || kt == keyTypeValPtr {
+						i.value = append(i.value[:0], i.iter.Value()...)
+						i.vptr = kt == keyTypeValPtr
+					}
+				}
+				if seq <= i.fromSeq && (!hasFrom || seq > fromSeq) {
+					fromSeq, fromKt, hasFrom = seq, kt, true
+				}
+			}
+		} else if i.strict {
+			i.setErr(kerr)
+			return false
+		}
+		var ok bool
+		if forward {
+			ok = i.iter.Next()
+		} else {
+			ok = i.iter.Prev()
+		}
+		if !ok {
+			i.iterErr()
+			break
+		}
+	}
+	live := func(has bool, kt keyType, seq, snap uint64) bool {
+		return has && (kt == keyTypeVal || kt == keyTypeValPtr) && !i.rdels.covers(i.icmp, i.key, seq, snap)
+	}
+	liveFrom := live(hasFrom, fromKt, fromSeq, i.fromSeq)
+	liveTo := live(hasTo, toKt, toSeq, i.toSeq)
+	switch {
+	case !liveFrom && !liveTo:
+		return false
+	case liveFrom && liveTo && fromSeq == toSeq:
+		return false
+	}
+	i.deleted = !liveTo
+	return true
+}
+
+func (i *diffIter) forward() bool {
+	for i.err == nil {
+		ukey, ok := i.ukey(true)
+		if !ok {
+			break
+		}
+		if i.readKey(ukey, true) && i.err == nil {
+			i.dir = dirForward
+			return true
+		}
+	}
+	i.dir = dirEOI
+	return false
+}
+
+func (i *diffIter) backward() bool {
+	for i.err == nil {
+		ukey, ok := i.ukey(false)
+		if !ok {
+			break
+		}
+		if i.readKey(ukey, false) && i.err == nil {
+			i.dir = dirBackward
+			return true
+		}
+	}
+	i.dir = dirSOI
+	return false
+}
+
+// Moves the raw iterator over the entries of the current key, in the given
+// direction.
+func (i *diffIter) skipKey(forward bool) {
+	for i.iter.Valid() {
+		ukey, _, _, kerr := parseInternalKey(i.iter.Key())
+		if kerr == nil && i.icmp.uCompare(ukey, i.key) != 0 {
+			return
+		}
+		if forward {
+			i.iter.Next()
+		} else {
+			i.iter.Prev()
+		}
+	}
+}
+
+func (i *diffIter) Valid() bool {
+	return i.err == nil && i.dir > dirEOI
+}
+
+func (i *diffIter) First() bool {
+	if i.err != nil {
+		return false
+	} else if i.dir == dirReleased {
+		i.err = ErrIterReleased
+		return false
+	}
+
+	i.iter.First()
+	return i.forward()
+}
+
+func (i *diffIter) Last() bool {
+	if i.err != nil {
+		return false
+	} else if i.dir == dirReleased {
+		i.err = ErrIterReleased
+		return false
+	}
+
+	i.iter.Last()
+	return i.backward()
+}
+
+func (i *diffIter) Seek(key []byte) bool {
+	if i.err != nil {
+		return false
+	} else if i.dir == dirReleased {
+		i.err = ErrIterReleased
+		return false
+	}
+
+	i.iter.Seek(makeInternalKey(nil, key, keyMaxSeq, keyTypeSeek))
+	return i.forward()
+}
+
+func (i *diffIter) SeekLE(key []byte) bool {
+	if i.err != nil {
+		return false
+	} else if i.dir == dirReleased {
+		i.err = ErrIterReleased
+		return false
+	}
+
+	i.iter.SeekLE(makeInternalKey(nil, key, 0, keyTypeDel))
+	return i.backward()
+}
+
+func (i *diffIter) Next() bool {
+	if i.dir == dirEOI || i.err != nil {
+		return false
+	} else if i.dir == dirReleased {
+		i.err = ErrIterReleased
+		return false
+	}
+
+	switch i.dir {
+	case dirSOI:
+		return i.First()
+	case dirBackward:
+		// The raw iterator is before the current key.
+		if !i.iter.Next() && !i.iter.First() {
+			i.iterErr()
+			i.dir = dirEOI
+			return false
+		}
+		i.skipKey(true)
+	}
+	return i.forward()
+}
+
+func (i *diffIter) Prev() bool {
+	if i.dir == dirSOI || i.err != nil {
+		return false
+	} else if i.dir == dirReleased {
+		i.err = ErrIterReleased
+		return false
+	}
+
+	switch i.dir {
+	case dirEOI:
+		return i.Last()
+	case dirForward:
+		// The raw iterator is past the current key.
+		if !i.iter.Prev() && !i.iter.Last() {
+			i.iterErr()
+			i.dir = dirSOI
+			return false
+		}
+		i.skipKey(false)
+	}
+	return i.backward()
+}
+
+func (i *diffIter) Key() []byte {
+	if i.err != nil || i.dir <= dirEOI {
+		return nil
+	}
+	return i.key
+}
+
+func (i *diffIter) Value() []byte {
+	if i.err != nil || i.dir <= dirEOI || i.deleted {
+		return nil
+	}
+	// Value resides in the value log, fetch it lazily.
+	if i.vptr {
+		value, err := i.db.s.tops.readValue(i.value, nil)
+		if err != nil {
+			i.setErr(err)
+			return nil
+		}
+		i.value = value
+		i.vptr = false
+	}
+	return i.value
+}
+
+func (i *diffIter) Deleted() bool {
+	if i.err != nil || i.dir <= dirEOI {
+		return false
+	}
+	return i.deleted
+}
+
+func (i *diffIter) Release() {
+	if i.dir != dirReleased {
+		// Clear the finalizer.
+		runtime.SetFinalizer(i, nil)
+
+		if i.releaser != nil {
+			i.releaser.Release()
+			i.releaser = nil
+		}
+
+		i.dir = dirReleased
+		i.key = nil
+		i.value = nil
+		i.iter.Release()
+		i.iter = nil
+		i.rdels = nil
+		atomic.AddInt32(&i.db.aliveIters, -1)
+		i.db = nil
+	}
+}
+
+func (i *diffIter) SetReleaser(releaser util.Releaser) {
+	if i.dir == dirReleased {
+		panic(util.ErrReleased)
+	}
+	if i.releaser != nil && releaser != nil {
+		panic(util.ErrHasReleaser)
+	}
+	i.releaser = releaser
+}
+
+func (i *diffIter) Error() error {
+	return i.err
+}
+
+// Returns sequence number of the given snapshot, or def if the snapshot
+// is nil.
+func snapshotSeq(snap *Snapshot, def uint64) (uint64, error) {
+	if snap == nil {
+		return def, nil
+	}
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	if snap.released {
+		return 0, ErrSnapshotReleased
+	}
+	return snap.elem.seq, nil
+}
+
+// NewDiffIterator returns an iterator over keys whose visible value differ
+// between the from and the to snapshots, e.g. to implement incremental
+// backups or change feeds. A nil from snapshot is treated as an empty DB
+// state, and a nil to snapshot as the latest DB state.
+//
+// The iterator yields each changed key once, with its value in the to
+// snapshot; keys deleted in the to snapshot are yielded with Deleted set,
+// including keys deleted by range deletion. A key that is rewritten,
+// even with the same value, is reported as changed.
+//
+// The from snapshot is typically the older one, but the iterator works
+// either way. Slice and the read options bounds narrow the iterated keys
+// as for NewIterator.
+//
+// The iterator must be released after use, by calling Release method.
+// Releasing the snapshots doesn't release the iterator, the iterator would
+// be still valid until released.
+func (db *DB) NewDiffIterator(from, to *Snapshot, slice *util.Range, ro *opt.ReadOptions) DiffIterator {
+	if err := db.ok(); err != nil {
+		return emptyDiffIter{iterator.NewEmptyIterator(err)}
+	}
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	fromSeq, err := snapshotSeq(from, 0)
+	if err != nil {
+		return emptyDiffIter{iterator.NewEmptyIterator(err)}
+	}
+	toSeq, err := snapshotSeq(to, se.seq)
+	if err != nil {
+		return emptyDiffIter{iterator.NewEmptyIterator(err)}
+	}
+
+	if ro.GetPinData() {
+		// The values are copied, don't pin the blocks.
+		nro := *ro
+		nro.PinData = false
+		ro = &nro
+	}
+	rawIter, rdels := db.newRawIterator(nil, nil, db.iterInternalRange(slice, ro), ro, nil)
+	iter := &diffIter{
+		db:      db,
+		icmp:    db.s.icmp,
+		iter:    rawIter,
+		rdels:   rdels,
+		fromSeq: fromSeq,
+		toSeq:   toSeq,
+		strict:  opt.GetStrict(db.s.o.Options, ro, opt.StrictReader),
+	}
+	atomic.AddInt32(&db.aliveIters, 1)
+	runtime.SetFinalizer(iter, (*diffIter).Release)
+	return iter
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/iterator"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+/*
+Dump format:
+
+The dump is a portable stream of key/value pairs, independent of the DB
+file formats, written by ExportTo and read by ImportFrom. It starts with
+an 8-byte magic followed by the 1-byte dump version, then the records.
+Each key/value pair is an entry record:
+
+    +----------+------------------+--------------------+-----+-------+--------------+
+    | type (1) | key len (varint) | value len (varint) | key | value | checksum (4) |
+    +----------+------------------+--------------------+-----+-------+--------------+
+
+The last record is the end record, holding the number of the preceding
+records; a dump without it is truncated:
+
+    +----------+--------------------------+--------------+
+    | type (0) | records count (varint)   | checksum (4) |
+    +----------+--------------------------+--------------+
+
+The checksum is the masked CRC-32C of the preceding bytes of the record.
+
+NOTE: All fixed-length integer are little-endian.
+*/
+
+const (
+	dumpMagic   = "\x8a\x4c\x44\x42\x44\x55\x4d\x50"
+	dumpVersion = 1
+
+	dumpRecordEnd   = 0
+	dumpRecordEntry = 1
+
+	// Size of the batches written by ImportFrom.
+	dumpImportBatchSize = 1 * opt.MiB
+)
+
+func newErrDumpCorrupted(offset int64, reason string) error {
+	return &errors.ErrCorrupted{Offset: offset, Reason: reason, Err: fmt.Errorf("leveldb: dump corrupted (pos=%d): %s", offset, reason)}
+}
+
+// Writes the entries of the given iterator as a dump, the iterator will be
+// released.
+func exportIter(w io.Writer, iter iterator.Iterator) error {
+	defer iter.Release()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(dumpMagic); err != nil {
+		return err
+	}
+	if err := bw.WriteByte(dumpVersion); err != nil {
+		return err
+	}
+	var (
+		rec []byte
+		n   uint64
+		tmp [binary.MaxVarintLen64]byte
+	)
+	writeRec := func() error {
+		binary.LittleEndian.PutUint32(tmp[:4], util.NewCRC(rec).Value())
+		rec = append(rec, tmp[:4]...)
+		_, err := bw.Write(rec)
+		return err
+	}
+	for iter.Next() {
+		key, value := iter.Key(), iter.Value()
+		rec = append(rec[:0], dumpRecordEntry)
+		rec = append(rec, tmp[:binary.PutUvarint(tmp[:], uint64(len(key)))]...)
+		rec = append(rec, tmp[:binary.PutUvarint(tmp[:], uint64(len(value)))]...)
+		rec = append(rec, key...)
+		rec = append(rec, value...)
+		if err := writeRec(); err != nil {
+			return err
+		}
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	rec = append(rec[:0], dumpRecordEnd)
+	rec = append(rec, tmp[:binary.PutUvarint(tmp[:], n)]...)
+	if err := writeRec(); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ExportTo writes the key/value pairs of the latest snapshot of the DB to
+// w, as a portable dump read by ImportFrom. The dump is independent of the
+// DB file formats, each record is checksummed.
+//
+// The exported keys may be restricted by the ReadOptions LowerBound,
+// UpperBound and Prefix, see Snapshot.ExportTo for exporting a given
+// snapshot.
+func (db *DB) ExportTo(w io.Writer, ro *opt.ReadOptions) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	return exportIter(w, db.NewIterator(nil, ro))
+}
+
+// ExportTo writes the key/value pairs of the snapshot to w, see
+// DB.ExportTo.
+func (snap *Snapshot) ExportTo(w io.Writer, ro *opt.ReadOptions) error {
+	return exportIter(w, snap.NewIterator(nil, ro))
+}
+
+// dumpReader reads the records of a dump.
+type dumpReader struct {
+	r   *bufio.Reader
+	off int64
+	rec bytes.Buffer
+}
+
+func (d *dumpReader) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err == nil {
+		d.rec.WriteByte(c)
+	}
+	return c, err
+}
+
+func (d *dumpReader) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(byteReaderFunc(d.readByte))
+}
+
+// Reads the next record, returns its type and the record bytes up to the
+// checksum.
+func (d *dumpReader) next() (rtype byte, rec []byte, err error) {
+	d.rec.Reset()
+	if rtype, err = d.readByte(); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if rtype == dumpRecordEntry {
+		var klen, vlen uint64
+		if klen, err = d.readUvarint(); err == nil {
+			if vlen, err = d.readUvarint(); err == nil {
+				if klen > math.MaxInt32 || vlen > math.MaxInt32 {
+					return 0, nil, newErrDumpCorrupted(d.off, "bad record length")
+				}
+				// Grows the record as data arrive, a corrupted length
+				// doesn't allocate ahead.
+				var n int64
+				n, err = io.CopyN(&d.rec, d.r, int64(klen+vlen))
+				if err == nil && uint64(n) != klen+vlen {
+					err = io.ErrUnexpectedEOF
+				}
+			}
+		}
+	} else if rtype == dumpRecordEnd {
+		_, err = d.readUvarint()
+	} else {
+		return 0, nil, newErrDumpCorrupted(d.off, fmt.Sprintf("unknown record type %d", rtype))
+	}
+	var checksum [4]byte
+	if err == nil {
+		_, err = io.ReadFull(d.r, checksum[:])
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	rec = d.rec.Bytes()
+	if checksum0, checksum1 := binary.LittleEndian.Uint32(checksum[:]), util.NewCRC(rec).Value(); checksum0 != checksum1 {
+		return 0, nil, newErrDumpCorrupted(d.off, fmt.Sprintf("checksum mismatch, want=%#x got=%#x", checksum0, checksum1))
+	}
+	d.off += int64(len(rec) + len(checksum))
+	return
+}
+
+type byteReaderFunc func() (byte, error)
+
+func (f byteReaderFunc) ReadByte() (byte, error) {
+	return f()
+}
+
+// ImportFrom writes the key/value pairs of the given dump, as written by
+// ExportTo, into the DB. The pairs are written by batches, each as by
+// Write with the given write options; the import isn't atomic, on error
+// the pairs of the batches already written are kept. The existing keys
+// absent from the dump are left untouched.
+//
+// The dump is read up to its end record, a dump without one is considered
+// truncated.
+func (db *DB) ImportFrom(r io.Reader, wo *opt.WriteOptions) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	d := &dumpReader{r: bufio.NewReader(r)}
+	var header [len(dumpMagic) + 1]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrInvalidDump
+		}
+		return err
+	}
+	if string(header[:len(dumpMagic)]) != dumpMagic || header[len(dumpMagic)] != dumpVersion {
+		return ErrInvalidDump
+	}
+	d.off = int64(len(header))
+
+	maxSize, maxLen := dumpImportBatchSize, db.s.o.GetMaxBatchLen()
+	if n := db.s.o.GetMaxBatchSize(); n > 0 && n < maxSize {
+		maxSize = n
+	}
+	var (
+		batch = new(Batch)
+		n     uint64
+	)
+	for {
+		off := d.off
+		rtype, rec, err := d.next()
+		if err != nil {
+			return err
+		}
+		if rtype == dumpRecordEnd {
+			if count, _ := binary.Uvarint(rec[1:]); count != n {
+				return newErrDumpCorrupted(off, fmt.Sprintf("records count mismatch, want=%d got=%d", count, n))
+			}
+			break
+		}
+		klen, k := binary.Uvarint(rec[1:])
+		_, v := binary.Uvarint(rec[1+k:])
+		kv := rec[1+k+v:]
+		if batch.Len() > 0 && (len(batch.data)+len(kv) > maxSize || (maxLen > 0 && batch.Len() >= maxLen)) {
+			if err := db.Write(batch, wo); err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		batch.Put(kv[:klen], kv[klen:])
+		n++
+	}
+	if batch.Len() > 0 {
+		return db.Write(batch, wo)
+	}
+	return nil
+}
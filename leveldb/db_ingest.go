@@ -0,0 +1,505 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/table"
+)
+
+// Minimum level an ingested table can sink to while the number of levels
+// isn't limited, mirrors the memdb flush limit of the original leveldb.
+const ingestMaxLevel = 2
+
+// Imports the given external table as is into a new DB table, keyed by
+// user keys, see tFile.gseq. Returns nil table file if the table is empty.
+//
+// Table recovery tells the tables keyed by user keys apart by their keys
+// that aren't valid internal keys, thus if all the keys are valid internal
+// keys the table isn't imported and must be rewritten instead.
+func (db *DB) importTable(path string) (t *tFile, rewrite bool, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	// The table is read as the DB reads it, with all checksums verified.
+	o := *db.s.uo
+	o.Strict = opt.StrictAll
+	tr, err := table.NewReader(f, fi.Size(), storage.FileDesc{}, nil, db.s.tops.bpool, &o)
+	if err != nil {
+		return
+	}
+	defer tr.Release()
+	iter := tr.NewIterator(nil, nil)
+	var umin, umax []byte
+	rewrite = true
+	for iter.Next() {
+		ukey := iter.Key()
+		rewrite = rewrite && validInternalKey(ukey)
+		if umax != nil && db.s.icmp.uCompare(umax, ukey) >= 0 {
+			err = fmt.Errorf("leveldb: ingest %s: keys are not in increasing order: %q, %q", path, umax, ukey)
+			break
+		}
+		if umin == nil {
+			umin = append([]byte{}, ukey...)
+		}
+		umax = append(umax[:0], ukey...)
+	}
+	iter.Release()
+	if err == nil {
+		err = iter.Error()
+	}
+	if err != nil || umin == nil {
+		return nil, false, err
+	}
+	if rewrite {
+		return
+	}
+
+	fd := storage.FileDesc{Type: storage.TypeTable, Num: db.s.allocFileNum()}
+	err = storage.ErrNotSupported
+	if imp, ok := db.s.stor.Storage.(storage.Importer); ok {
+		err = imp.Import(path, fd)
+	}
+	if err == storage.ErrNotSupported {
+		err = db.copyTable(f, fd)
+	}
+	if err != nil {
+		db.s.reuseFileNum(fd.Num)
+		return
+	}
+	// The range is set once the sequence number is assigned.
+	t = newTableFile(fd, fi.Size(), internalKey(umin), internalKey(umax))
+	db.log(opt.LogDebug, "table@ingest imported", "path", path, "file", fd)
+	return
+}
+
+// Copies the external table into a new DB table, e.g. if the storage
+// can't import it or encrypts its files.
+func (db *DB) copyTable(f *os.File, fd storage.FileDesc) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w, err := db.s.stor.Create(fd)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(w, f); err == nil {
+		err = w.Sync()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		db.s.stor.Remove(fd)
+	}
+	return err
+}
+
+// Whether the external table must be rewritten into a DB table keyed by
+// internal keys instead of being imported as is.
+func (db *DB) mustRewriteTable(path string) (bool, error) {
+	if db.s.o.GetLevelDBCompatible() {
+		// The C++ leveldb can't read tables keyed by user keys.
+		return true, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	return table.IsRocksDBTable(f, fi.Size()), nil
+}
+
+// Rewrites the given external table into a new DB table, all entries
+// are assigned the given sequence number.
+func (db *DB) ingestTable(path string, seq uint64) (t *tFile, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return
+	}
+
+	// External tables are keyed by user keys.
+	o := &opt.Options{
+		Comparer:    db.s.icmp.ucmp,
+		Compressors: db.s.o.Compressors,
+		Strict:      opt.StrictAll,
+	}
+	var fill func(w *tWriter) error
+	if table.IsRocksDBTable(f, fi.Size()) {
+		tr, err := table.NewRocksDBReader(f, fi.Size(), storage.FileDesc{}, o)
+		if err != nil {
+			return nil, err
+		}
+		defer tr.Release()
+		fill = func(w *tWriter) error {
+			return db.appendRocksDBTable(path, tr, seq, w)
+		}
+	} else {
+		tr, err := table.NewReader(f, fi.Size(), storage.FileDesc{}, nil, db.s.tops.bpool, o)
+		if err != nil {
+			return nil, err
+		}
+		defer tr.Release()
+		fill = func(w *tWriter) error {
+			return db.appendTable(path, tr, seq, w)
+		}
+	}
+
+	w, err := db.s.tops.create(0)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			w.drop()
+		}
+	}()
+	if err = fill(w); err != nil {
+		return
+	}
+	if w.empty() {
+		w.drop()
+		return nil, nil
+	}
+	return w.finish()
+}
+
+// Appends the entries of the external table to the DB table.
+func (db *DB) appendTable(path string, tr *table.Reader, seq uint64, w *tWriter) error {
+	iter := tr.NewIterator(nil, nil)
+	defer iter.Release()
+	var prev []byte
+	for iter.Next() {
+		ukey := iter.Key()
+		if prev != nil && db.s.icmp.uCompare(prev, ukey) >= 0 {
+			return fmt.Errorf("leveldb: ingest %s: keys are not in increasing order: %q, %q", path, prev, ukey)
+		}
+		prev = append(prev[:0], ukey...)
+		if err := w.append(makeInternalKey(nil, ukey, seq, keyTypeVal), iter.Value()); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
+
+// Appends the entries of the RocksDB table to the DB table. Only the
+// latest version of each key is kept, and dropped if hidden by a later
+// range deletion of the table; the range deletions are kept as they may
+// hide existing entries.
+func (db *DB) appendRocksDBTable(path string, tr *table.RocksDBReader, seq uint64, w *tWriter) error {
+	var rds rangeDels
+	riter := tr.NewRangeDelIterator()
+	for riter.Next() {
+		ukey, rseq, _, err := table.ParseRocksDBKey(riter.Key())
+		if err != nil {
+			riter.Release()
+			return err
+		}
+		if db.s.icmp.uCompare(ukey, riter.Value()) < 0 {
+			rds = append(rds, rangeDel{rseq, append([]byte{}, ukey...), append([]byte{}, riter.Value()...)})
+		}
+	}
+	riter.Release()
+	if err := riter.Error(); err != nil {
+		return err
+	}
+
+	// Once assigned the same sequence number, the range deletions sharing
+	// a start are merged.
+	sort.Sort(&rangeDelsSortByStart{rangeDels: rds, icmp: db.s.icmp})
+	var merged rangeDels
+	for _, rd := range rds {
+		if n := len(merged); n > 0 && db.s.icmp.uCompare(merged[n-1].start, rd.start) == 0 {
+			if db.s.icmp.uCompare(rd.limit, merged[n-1].limit) > 0 {
+				merged[n-1].limit = rd.limit
+			}
+			continue
+		}
+		merged = append(merged, rd)
+	}
+	appendRangeDels := func(ukey []byte) error {
+		for len(merged) > 0 && (ukey == nil || db.s.icmp.uCompare(merged[0].start, ukey) <= 0) {
+			if err := w.append(makeInternalKey(nil, merged[0].start, seq, keyTypeRangeDel), merged[0].limit); err != nil {
+				return err
+			}
+			merged = merged[1:]
+		}
+		return nil
+	}
+
+	iter := tr.NewIterator(nil, nil)
+	defer iter.Release()
+	var prev []byte
+	for iter.Next() {
+		ukey, kseq, kt, err := table.ParseRocksDBKey(iter.Key())
+		if err != nil {
+			return err
+		}
+		if prev != nil {
+			if c := db.s.icmp.uCompare(prev, ukey); c == 0 {
+				// Older version.
+				continue
+			} else if c > 0 {
+				return fmt.Errorf("leveldb: ingest %s: keys are not in increasing order: %q, %q", path, prev, ukey)
+			}
+		}
+		prev = append(prev[:0], ukey...)
+		if err := appendRangeDels(ukey); err != nil {
+			return err
+		}
+		if rds.covers(db.s.icmp, ukey, kseq, keyMaxSeq) {
+			continue
+		}
+		switch kt {
+		case table.RocksDBTypeValue:
+			err = w.append(makeInternalKey(nil, ukey, seq, keyTypeVal), iter.Value())
+		case table.RocksDBTypeDeletion, table.RocksDBTypeSingleDeletion:
+			err = w.append(makeInternalKey(nil, ukey, seq, keyTypeDel), nil)
+		default:
+			err = fmt.Errorf("leveldb: ingest %s: unsupported RocksDB entry type %#x of key %q", path, kt, ukey)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return appendRangeDels(nil)
+}
+
+type rangeDelsSortByStart struct {
+	rangeDels
+	icmp *iComparer
+}
+
+func (x *rangeDelsSortByStart) Len() int {
+	return len(x.rangeDels)
+}
+
+func (x *rangeDelsSortByStart) Less(i, j int) bool {
+	return x.icmp.uCompare(x.rangeDels[i].start, x.rangeDels[j].start) < 0
+}
+
+func (x *rangeDelsSortByStart) Swap(i, j int) {
+	x.rangeDels[i], x.rangeDels[j] = x.rangeDels[j], x.rangeDels[i]
+}
+
+// IngestTables ingests the given table files into the DB. The files must be
+// written by table.Writer, keyed by user keys ordered by the DB comparer.
+//
+// The files are hard-linked into the DB when the storage allows it, see
+// storage.Importer, and copied as is otherwise; a linked file must not be
+// modified afterwards. Each file is assigned its
+// own sequence number, recorded in the manifest, so an entry in a file
+// overrides the existing entries and the entries of preceding files. The
+// tables are placed at the deepest level that does not overlap with
+// existing data, overlapping files go to level-0. The memdb is only
+// flushed if it overlaps with the files. The ingested tables are keyed by
+// user keys until compacted; a file whose keys all happen to be valid
+// internal keys, e.g. fixed 8-byte keys, is rewritten into a new DB table
+// so Recover can tell the tables apart.
+//
+// RocksDB block-based tables are also accepted, see table.RocksDBReader,
+// e.g. to migrate a RocksDB dataset by ingesting its table files. Only
+// the latest version of each key is ingested, deletions and range
+// deletions are kept; merge operands and other RocksDB specific entries
+// fail the ingestion. Since the later files override the earlier ones, the
+// files of a RocksDB dataset should be given from the deepest level up,
+// and level-0 files by increasing file number. RocksDB tables, and all
+// tables if the DB is opened with LevelDBCompatible, are rewritten into
+// new DB tables.
+//
+// The ingestion is atomic; either all files are ingested or none. Write,
+// Put, Delete and OpenTransaction will be blocked while the ingestion is
+// committed to the manifest, and while the tables are rewritten.
+func (db *DB) IngestTables(files []string, io *opt.IngestOptions) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	var (
+		tables   = make(tFiles, len(files))
+		rewrites = make([]bool, len(files))
+	)
+	discard := func() {
+		for _, t := range tables {
+			if t == nil {
+				continue
+			}
+			db.log(opt.LogDebug, "table@ingest discard", "file", t.fd)
+			removeTableVlog(db.s.stor, t.fd.Num, t.vlogs)
+			if err := db.s.stor.Remove(t.fd); err == nil {
+				db.s.reuseFileNum(t.fd.Num)
+			}
+		}
+	}
+	for i, path := range files {
+		rewrite, err := db.mustRewriteTable(path)
+		if err == nil && !rewrite {
+			tables[i], rewrite, err = db.importTable(path)
+		}
+		if err != nil {
+			discard()
+			return err
+		}
+		rewrites[i] = rewrite
+	}
+
+	// Wait compaction when certain threshold reached.
+	if err := db.waitCompaction(); err != nil {
+		discard()
+		return err
+	}
+
+	if err := db.lockWriter(); err != nil {
+		discard()
+		return err
+	}
+	defer func() { <-db.writeLockC }()
+	db.waitWriteApply()
+
+	var (
+		seq     = db.seq
+		flushed = false
+	)
+	for i, path := range files {
+		seq++
+		if !rewrites[i] {
+			if t := tables[i]; t != nil {
+				t.gseq = seq
+				t.imin = makeInternalKey(nil, t.imin, seq, keyTypeVal)
+				t.imax = makeInternalKey(nil, t.imax, seq, keyTypeVal)
+			}
+			continue
+		}
+		if !flushed {
+			// Rewritten tables may have range deletions reaching past
+			// their range, the memdb is flushed unconditionally.
+			if db.mem.Len() != 0 {
+				if _, err := db.rotateMem(0, true); err != nil {
+					discard()
+					return err
+				}
+			}
+			flushed = true
+		}
+		t, err := db.ingestTable(path, seq)
+		if err != nil {
+			discard()
+			return err
+		}
+		tables[i] = t
+	}
+	if !flushed {
+		// Flush the memdbs the ingested entries must shadow, the memdb
+		// is looked up first.
+		mem, frozen := db.getMems()
+		memOverlaps, frozenOverlaps := false, false
+		for _, t := range tables {
+			if t != nil {
+				umin, umax := t.imin.ukey(), t.imax.ukey()
+				memOverlaps = memOverlaps || mem.overlaps(db.s.icmp, umin, umax)
+				frozenOverlaps = frozenOverlaps || frozen.overlaps(db.s.icmp, umin, umax)
+			}
+		}
+		mem.decref()
+		if frozen != nil {
+			frozen.decref()
+		}
+		var err error
+		if memOverlaps {
+			_, err = db.rotateMem(0, true)
+		} else if frozenOverlaps {
+			err = db.compTriggerWait(db.mcompCmdC)
+		}
+		if err != nil {
+			discard()
+			return err
+		}
+	}
+
+	var nt tFiles
+	for _, t := range tables {
+		if t != nil {
+			nt = append(nt, t)
+		}
+	}
+	if len(nt) == 0 {
+		return nil
+	}
+
+	db.compCommitLk.Lock()
+	defer db.compCommitLk.Unlock()
+
+	// Overlapping tables must go to level-0, where the newer one takes
+	// precedence.
+	overlapped := false
+	for i, t := range nt {
+		for _, t0 := range nt[:i] {
+			if t.overlaps(db.s.icmp, t0.imin.ukey(), t0.imax.ukey()) {
+				overlapped = true
+			}
+		}
+	}
+	rec := &sessionRecord{}
+	v := db.s.version()
+	for _, t := range nt {
+		level := 0
+		if !overlapped {
+			level = v.pickIngestLevel(t.imin.ukey(), t.imax.ukey())
+		}
+		rec.addTableFile(level, t)
+		db.log(opt.LogInfo, "table@ingest", "level", level, "file", t.fd, "seq", t.imin.num()>>8, "size", t.size, "min", t.imin, "max", t.imax)
+	}
+	v.release()
+	rec.setSeqNum(seq)
+	if err := db.s.commit(rec); err != nil {
+		discard()
+		return err
+	}
+	db.setSeq(seq)
+	db.onTablesCreated(rec)
+	db.checkCompactionDebt()
+
+	// Trigger table auto-compaction.
+	db.compTrigger(db.tcompCmdC)
+
+	if io.GetRemoveSource() {
+		for _, path := range files {
+			if err := os.Remove(path); err != nil {
+				db.log(opt.LogWarn, "table@ingest remove failed", "path", path, "err", err)
+			}
+		}
+	}
+	return nil
+}
@@ -7,12 +7,13 @@
 package leveldb
 
 import (
-	"errors"
+	"context"
 	"math/rand"
 	"runtime"
 	"sync"
 	"sync/atomic"
 
+	"github.com/FactomProject/goleveldb/leveldb/errors"
 	"github.com/FactomProject/goleveldb/leveldb/iterator"
 	"github.com/FactomProject/goleveldb/leveldb/opt"
 	"github.com/FactomProject/goleveldb/leveldb/util"
@@ -33,64 +34,144 @@ func (mr *memdbReleaser) Release() {
 	})
 }
 
-func (db *DB) newRawIterator(auxm *memDB, auxt tFiles, slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+func (db *DB) newRawIterator(auxm *memDB, auxt tFiles, slice *util.Range, ro *opt.ReadOptions, smp *sampler) (iterator.Iterator, rangeDelSet) {
 	strict := opt.GetStrict(db.s.o.Options, ro, opt.StrictReader)
 	em, fm := db.getMems()
 	v := db.s.version()
+	rdels := db.getRangeDels(v, auxt, auxm, em, fm)
 
-	tableIts := v.getIterators(slice, ro)
+	tableIts := v.getIterators(slice, ro, smp)
 	n := len(tableIts) + len(auxt) + 3
 	its := make([]iterator.Iterator, 0, n)
 
 	if auxm != nil {
 		ami := auxm.NewIterator(slice)
 		ami.SetReleaser(&memdbReleaser{m: auxm})
-		its = append(its, ami)
+		its = append(its, smp.wrap(ami))
 	}
 	for _, t := range auxt {
-		its = append(its, v.s.tops.newIterator(t, slice, ro))
+		its = append(its, v.s.tops.newSampleIterator(t, slice, ro, smp))
 	}
 
 	emi := em.NewIterator(slice)
 	emi.SetReleaser(&memdbReleaser{m: em})
-	its = append(its, emi)
+	its = append(its, smp.wrap(emi))
 	if fm != nil {
 		fmi := fm.NewIterator(slice)
 		fmi.SetReleaser(&memdbReleaser{m: fm})
-		its = append(its, fmi)
+		its = append(its, smp.wrap(fmi))
 	}
 	its = append(its, tableIts...)
 	mi := iterator.NewMergedIterator(its, db.s.icmp, strict)
 	mi.SetReleaser(&versionReleaser{v: v})
-	return mi
+	return mi, rdels
 }
 
-func (db *DB) newIterator(auxm *memDB, auxt tFiles, seq uint64, slice *util.Range, ro *opt.ReadOptions) *dbIter {
-	var islice *util.Range
-	if slice != nil {
-		islice = &util.Range{}
-		if slice.Start != nil {
-			islice.Start = makeInternalKey(nil, slice.Start, keyMaxSeq, keyTypeSeek)
-		}
-		if slice.Limit != nil {
-			islice.Limit = makeInternalKey(nil, slice.Limit, keyMaxSeq, keyTypeSeek)
-		}
+// Returns intersection of the given slice and the read options bounds and
+// prefix.
+func (db *DB) iterRange(slice *util.Range, ro *opt.ReadOptions) *util.Range {
+	lower, upper, prefix := ro.GetLowerBound(), ro.GetUpperBound(), ro.GetPrefix()
+	if lower == nil && upper == nil && prefix == nil {
+		return slice
+	}
+	r := slice.Intersect(db.s.icmp.ucmp, &util.Range{Start: lower, Limit: upper})
+	if prefix != nil {
+		r = r.Intersect(db.s.icmp.ucmp, util.BytesPrefix(prefix))
+	}
+	return r
+}
+
+// Returns internal key range of the given slice, narrowed by the read
+// options bounds and prefix.
+func (db *DB) iterInternalRange(slice *util.Range, ro *opt.ReadOptions) *util.Range {
+	slice = db.iterRange(slice, ro)
+	if slice == nil {
+		return nil
+	}
+	islice := &util.Range{}
+	if slice.Start != nil {
+		islice.Start = makeInternalKey(nil, slice.Start, keyMaxSeq, keyTypeSeek)
 	}
-	rawIter := db.newRawIterator(auxm, auxt, islice, ro)
+	if slice.Limit != nil {
+		islice.Limit = makeInternalKey(nil, slice.Limit, keyMaxSeq, keyTypeSeek)
+	}
+	return islice
+}
+
+func (db *DB) newIterator(auxm *memDB, auxt tFiles, seq uint64, slice *util.Range, ro *opt.ReadOptions, smp *sampler) *dbIter {
+	rawIter, rdels := db.newRawIterator(auxm, auxt, db.iterInternalRange(slice, ro), ro, smp)
 	iter := &dbIter{
-		db:     db,
-		icmp:   db.s.icmp,
-		iter:   rawIter,
-		seq:    seq,
-		strict: opt.GetStrict(db.s.o.Options, ro, opt.StrictReader),
-		key:    make([]byte, 0),
-		value:  make([]byte, 0),
+		db:        db,
+		icmp:      db.s.icmp,
+		iter:      rawIter,
+		rdels:     rdels,
+		seq:       seq,
+		strict:    opt.GetStrict(db.s.o.Options, ro, opt.StrictReader),
+		pin:       ro.GetPinData(),
+		cacheOnly: ro.GetCacheOnly(),
+		key:       make([]byte, 0),
+		value:     make([]byte, 0),
+	}
+	if ro.GetSkipCorrupted() {
+		if ecs, ok := rawIter.(iterator.ErrorCallbackSetter); ok {
+			f := ro.GetOnSkipCorrupted()
+			ecs.SetErrorCallback(func(err error) {
+				// Other errors halt the iterator.
+				if !errors.IsCorrupted(err) {
+					return
+				}
+				if iter.skipErr == nil {
+					iter.skipErr = err
+				}
+				if f != nil {
+					f(err)
+				}
+			})
+		}
+	}
+	if cursor := ro.GetResumeFrom(); cursor != nil {
+		if ukey, err := decodeCursor(cursor); err != nil {
+			iter.setErr(err)
+		} else {
+			iter.resume = ukey
+		}
 	}
 	atomic.AddInt32(&db.aliveIters, 1)
 	runtime.SetFinalizer(iter, (*dbIter).Release)
 	return iter
 }
 
+// CursorIterator is the interface that wraps iterator.Iterator and the
+// Cursor method. The iterators returned by DB.NewIterator and
+// Snapshot.NewIterator implement it.
+type CursorIterator interface {
+	iterator.Iterator
+
+	// Cursor returns an opaque token of the current position, or nil if
+	// done. An iterator created with the token as ReadOptions.ResumeFrom
+	// continues after or before the position, e.g. to chunk a large scan
+	// across requests. The token is a position only, iterate a snapshot
+	// to resume over the same DB state.
+	Cursor() []byte
+}
+
+// Cursor format version.
+const cursorV1 = 1
+
+func encodeCursor(ukey []byte) []byte {
+	cursor := make([]byte, 1+len(ukey))
+	cursor[0] = cursorV1
+	copy(cursor[1:], ukey)
+	return cursor
+}
+
+func decodeCursor(cursor []byte) ([]byte, error) {
+	if len(cursor) == 0 || cursor[0] != cursorV1 {
+		return nil, ErrInvalidCursor
+	}
+	return append([]byte{}, cursor[1:]...), nil
+}
+
 func (db *DB) iterSamplingRate() int {
 	return rand.Intn(2 * db.s.o.GetIteratorSamplingRate())
 }
@@ -107,17 +188,25 @@ const (
 
 // dbIter represent an interator states over a database session.
 type dbIter struct {
-	db     *DB
-	icmp   *iComparer
-	iter   iterator.Iterator
-	seq    uint64
-	strict bool
+	db        *DB
+	icmp      *iComparer
+	iter      iterator.Iterator
+	rdels     rangeDelSet
+	seq       uint64
+	strict    bool
+	pin       bool
+	cacheOnly bool
 
 	smaplingGap int
+	ikey        internalKey // Scratch buffer of the seek keys.
+	resume      []byte
 	dir         dir
 	key         []byte
 	value       []byte
+	vseq        uint64
+	vptr        bool
 	err         error
+	skipErr     error
 	releaser    util.Releaser
 }
 
@@ -130,6 +219,25 @@ func (i *dbIter) sampleSeek() {
 	}
 }
 
+// Sets the value of the current key to the given raw iterator value.
+func (i *dbIter) setValue(value []byte, seq uint64, kt keyType) {
+	if i.pin {
+		i.value = value
+	} else {
+		i.value = append(i.value[:0], value...)
+	}
+	i.vseq = seq
+	i.vptr = kt == keyTypeValPtr
+}
+
+// Releases the blocks pinned for the previous values, the keys are copied
+// and so always valid.
+func (i *dbIter) unpin() {
+	if p, ok := i.iter.(iterator.Pinner); ok && i.pin {
+		p.Unpin()
+	}
+}
+
 func (i *dbIter) setErr(err error) {
 	i.err = err
 	i.key = nil
@@ -153,6 +261,8 @@ func (i *dbIter) First() bool {
 		i.err = ErrIterReleased
 		return false
 	}
+	i.resume = nil
+	i.unpin()
 
 	if i.iter.First() {
 		i.dir = dirSOI
@@ -170,6 +280,8 @@ func (i *dbIter) Last() bool {
 		i.err = ErrIterReleased
 		return false
 	}
+	i.resume = nil
+	i.unpin()
 
 	if i.iter.Last() {
 		return i.prev()
@@ -186,9 +298,11 @@ func (i *dbIter) Seek(key []byte) bool {
 		i.err = ErrIterReleased
 		return false
 	}
+	i.resume = nil
+	i.unpin()
 
-	ikey := makeInternalKey(nil, key, i.seq, keyTypeSeek)
-	if i.iter.Seek(ikey) {
+	i.ikey = makeInternalKey(i.ikey, key, i.seq, keyTypeSeek)
+	if i.iter.Seek(i.ikey) {
 		i.dir = dirSOI
 		return i.next()
 	}
@@ -197,6 +311,26 @@ func (i *dbIter) Seek(key []byte) bool {
 	return false
 }
 
+func (i *dbIter) SeekLE(key []byte) bool {
+	if i.err != nil {
+		return false
+	} else if i.dir == dirReleased {
+		i.err = ErrIterReleased
+		return false
+	}
+	i.resume = nil
+	i.unpin()
+
+	// The last possible entry of the given key.
+	i.ikey = makeInternalKey(i.ikey, key, 0, keyTypeDel)
+	if i.iter.SeekLE(i.ikey) {
+		return i.prev()
+	}
+	i.dir = dirSOI
+	i.iterErr()
+	return false
+}
+
 func (i *dbIter) next() bool {
 	for {
 		if ukey, seq, kt, kerr := parseInternalKey(i.iter.Key()); kerr == nil {
@@ -207,12 +341,15 @@ func (i *dbIter) next() bool {
 					// Skip deleted key.
 					i.key = append(i.key[:0], ukey...)
 					i.dir = dirForward
-				case keyTypeVal:
+				case keyTypeVal, keyTypeValPtr:
 					if i.dir == dirSOI || i.icmp.uCompare(ukey, i.key) > 0 {
 						i.key = append(i.key[:0], ukey...)
-						i.value = append(i.value[:0], i.iter.Value()...)
 						i.dir = dirForward
-						return true
+						// Skip key deleted by range tombstone.
+						if !i.rdels.covers(i.icmp, ukey, seq, i.seq) {
+							i.setValue(i.iter.Value(), seq, kt)
+							return true
+						}
 					}
 				}
 			}
@@ -236,6 +373,19 @@ func (i *dbIter) Next() bool {
 		i.err = ErrIterReleased
 		return false
 	}
+	i.unpin()
+
+	if i.dir == dirSOI && i.resume != nil {
+		// Skip past the last possible entry of the cursor key.
+		i.ikey = makeInternalKey(i.ikey, i.resume, 0, keyTypeDel)
+		i.resume = nil
+		if i.iter.Seek(i.ikey) {
+			return i.next()
+		}
+		i.dir = dirEOI
+		i.iterErr()
+		return false
+	}
 
 	if !i.iter.Next() || (i.dir == dirBackward && !i.iter.Next()) {
 		i.dir = dirEOI
@@ -256,10 +406,13 @@ func (i *dbIter) prev() bool {
 					if !del && i.icmp.uCompare(ukey, i.key) < 0 {
 						return true
 					}
-					del = (kt == keyTypeDel)
+					// Range tombstones don't delete their start key.
+					if kt != keyTypeRangeDel {
+						del = kt == keyTypeDel || i.rdels.covers(i.icmp, ukey, seq, i.seq)
+					}
 					if !del {
 						i.key = append(i.key[:0], ukey...)
-						i.value = append(i.value[:0], i.iter.Value()...)
+						i.setValue(i.iter.Value(), seq, kt)
 					}
 				}
 			} else if i.strict {
@@ -280,12 +433,30 @@ func (i *dbIter) prev() bool {
 }
 
 func (i *dbIter) Prev() bool {
+	if i.dir == dirSOI && i.resume != nil && i.err == nil {
+		// Move before the first possible entry of the cursor key.
+		i.ikey = makeInternalKey(i.ikey, i.resume, keyMaxSeq, keyTypeSeek)
+		i.resume = nil
+		ok := i.iter.Seek(i.ikey)
+		if ok {
+			ok = i.iter.Prev()
+		} else if i.iter.Error() == nil {
+			ok = i.iter.Last()
+		}
+		if ok {
+			return i.prev()
+		}
+		i.iterErr()
+		return false
+	}
+
 	if i.dir == dirSOI || i.err != nil {
 		return false
 	} else if i.dir == dirReleased {
 		i.err = ErrIterReleased
 		return false
 	}
+	i.unpin()
 
 	switch i.dir {
 	case dirEOI:
@@ -311,6 +482,13 @@ cont:
 	return i.prev()
 }
 
+func (i *dbIter) Cursor() []byte {
+	if i.err != nil || i.dir <= dirEOI {
+		return nil
+	}
+	return encodeCursor(i.key)
+}
+
 func (i *dbIter) Key() []byte {
 	if i.err != nil || i.dir <= dirEOI {
 		return nil
@@ -322,9 +500,51 @@ func (i *dbIter) Value() []byte {
 	if i.err != nil || i.dir <= dirEOI {
 		return nil
 	}
+	// Value resides in the value log, fetch it lazily.
+	if i.vptr {
+		if i.cacheOnly {
+			// The value log isn't cached.
+			i.setErr(ErrCacheMiss)
+			return nil
+		}
+		value, err := i.db.s.tops.readValue(i.value, nil)
+		if err != nil {
+			i.setErr(err)
+			return nil
+		}
+		i.value = value
+		i.vptr = false
+	}
 	return i.value
 }
 
+func (i *dbIter) Seq() uint64 {
+	if i.err != nil || i.dir <= dirEOI {
+		return 0
+	}
+	return i.vseq
+}
+
+func (i *dbIter) ValueTo(dst []byte) []byte {
+	if i.err != nil || i.dir <= dirEOI {
+		return dst
+	}
+	if i.vptr {
+		if i.cacheOnly {
+			// The value log isn't cached.
+			i.setErr(ErrCacheMiss)
+			return dst
+		}
+		value, err := i.db.s.tops.readValue(i.value, dst)
+		if err != nil {
+			i.setErr(err)
+			return dst
+		}
+		return value
+	}
+	return append(dst, i.value...)
+}
+
 func (i *dbIter) Release() {
 	if i.dir != dirReleased {
 		// Clear the finalizer.
@@ -340,6 +560,7 @@ func (i *dbIter) Release() {
 		i.value = nil
 		i.iter.Release()
 		i.iter = nil
+		i.rdels = nil
 		atomic.AddInt32(&i.db.aliveIters, -1)
 		i.db = nil
 	}
@@ -356,5 +577,81 @@ func (i *dbIter) SetReleaser(releaser util.Releaser) {
 }
 
 func (i *dbIter) Error() error {
-	return i.err
+	if i.err != nil {
+		return i.err
+	}
+	return i.skipErr
+}
+
+// ctxIter wraps an iterator and makes it invalid once the context is done.
+type ctxIter struct {
+	iterator.Iterator
+	ctx context.Context
+	err error
+}
+
+func (i *ctxIter) check() bool {
+	if i.err == nil {
+		i.err = i.ctx.Err()
+	}
+	return i.err == nil
+}
+
+func (i *ctxIter) Valid() bool { return i.err == nil && i.Iterator.Valid() }
+
+func (i *ctxIter) First() bool { return i.check() && i.Iterator.First() }
+
+func (i *ctxIter) Last() bool { return i.check() && i.Iterator.Last() }
+
+func (i *ctxIter) Seek(key []byte) bool { return i.check() && i.Iterator.Seek(key) }
+
+func (i *ctxIter) SeekLE(key []byte) bool { return i.check() && i.Iterator.SeekLE(key) }
+
+func (i *ctxIter) Next() bool { return i.check() && i.Iterator.Next() }
+
+func (i *ctxIter) Prev() bool { return i.check() && i.Iterator.Prev() }
+
+func (i *ctxIter) Cursor() []byte {
+	if c, ok := i.Iterator.(CursorIterator); ok && i.err == nil {
+		return c.Cursor()
+	}
+	return nil
+}
+
+func (i *ctxIter) Key() []byte {
+	if i.err != nil {
+		return nil
+	}
+	return i.Iterator.Key()
+}
+
+func (i *ctxIter) Value() []byte {
+	if i.err != nil {
+		return nil
+	}
+	return i.Iterator.Value()
+}
+
+func (i *ctxIter) ValueTo(dst []byte) []byte {
+	if i.err != nil {
+		return dst
+	}
+	if va, ok := i.Iterator.(iterator.ValueAppender); ok {
+		return va.ValueTo(dst)
+	}
+	return append(dst, i.Iterator.Value()...)
+}
+
+func (i *ctxIter) Seq() uint64 {
+	if s, ok := i.Iterator.(iterator.Sequencer); ok && i.err == nil {
+		return s.Seq()
+	}
+	return 0
+}
+
+func (i *ctxIter) Error() error {
+	if i.err != nil {
+		return i.err
+	}
+	return i.Iterator.Error()
 }
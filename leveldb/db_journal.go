@@ -0,0 +1,466 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/journal"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+// retainedJournal is an obsolete journal kept for DB.GetUpdatesSince, see
+// opt.Options.JournalRetentionSize.
+type retainedJournal struct {
+	fd   storage.FileDesc
+	size int64
+	time time.Time
+}
+
+type retainedJournals []retainedJournal
+
+func (p retainedJournals) Len() int           { return len(p) }
+func (p retainedJournals) Less(i, j int) bool { return p[i].fd.Num < p[j].fd.Num }
+func (p retainedJournals) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Returns true if obsolete journals should be retained.
+func (db *DB) journalRetention() bool {
+	return db.s.o.GetJournalRetentionSize() > 0 || db.s.o.GetJournalRetentionTime() > 0
+}
+
+// Retains the given obsolete journal, unless already retained.
+func (db *DB) retainJournal(fd storage.FileDesc) error {
+	r, err := db.s.stor.Open(fd)
+	if err != nil {
+		return err
+	}
+	size, err := r.Seek(0, io.SeekEnd)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	db.jretainMu.Lock()
+	defer db.jretainMu.Unlock()
+	for _, rj := range db.jretained {
+		if rj.fd == fd {
+			return nil
+		}
+	}
+	db.jretained = append(db.jretained, retainedJournal{fd, size, time.Now()})
+	sort.Sort(db.jretained)
+	return nil
+}
+
+// Archives the given journal if journal archiving is enabled and supported
+// by the storage, otherwise removes it.
+func (db *DB) dropJournal(fd storage.FileDesc) error {
+	if db.s.o.GetJournalArchive() {
+		if a, ok := db.s.stor.Storage.(storage.Archiver); ok {
+			if err := a.Archive(fd); err != storage.ErrNotSupported {
+				return err
+			}
+		}
+	}
+	return db.s.stor.Remove(fd)
+}
+
+// Removes the given obsolete journal, or retains it if journal retention
+// is enabled.
+func (db *DB) removeJournal(fd storage.FileDesc) error {
+	if !db.journalRetention() {
+		return db.dropJournal(fd)
+	}
+	if err := db.retainJournal(fd); err != nil {
+		return err
+	}
+	db.log(opt.LogDebug, "journal@retain retained", "file", fd)
+	db.purgeJournals()
+	return nil
+}
+
+// Removes retained journals beyond the retention size or time, oldest
+// first.
+func (db *DB) purgeJournals() {
+	var (
+		maxSize = int64(db.s.o.GetJournalRetentionSize())
+		maxTime = db.s.o.GetJournalRetentionTime()
+		size    int64
+	)
+	db.jretainMu.Lock()
+	defer db.jretainMu.Unlock()
+	for _, rj := range db.jretained {
+		size += rj.size
+	}
+	for len(db.jretained) > 0 {
+		rj := db.jretained[0]
+		if !(maxSize > 0 && size > maxSize) && !(maxTime > 0 && time.Since(rj.time) > maxTime) {
+			break
+		}
+		if err := db.dropJournal(rj.fd); err != nil {
+			db.log(opt.LogWarn, "journal@retain remove failed", "file", rj.fd, "err", err)
+			break
+		}
+		db.log(opt.LogDebug, "journal@retain removed", "file", rj.fd)
+		size -= rj.size
+		db.jretained = db.jretained[1:]
+	}
+}
+
+// journalFile counts the bytes written to a journal or manifest file, a
+// recycled journal file is larger than that.
+type journalFile struct {
+	storage.Writer
+	size int64
+}
+
+func (f *journalFile) Write(p []byte) (int, error) {
+	n, err := f.Writer.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Length of the journal header record, see writeJournalHeader.
+const journalHeaderLen = batchHeaderLen + 16
+
+var errJournalHeader = errors.New("leveldb: journal header")
+
+// Writes the header record of the journal with the given file number, it
+// is written first to each journal when journals are recycled. The header
+// is a batch header with zero sequence number and length, followed by the
+// journal file number and the last sequence number before the journal.
+//
+// A recycled journal file holds the stale chunks of its previous use past
+// the written ones. The chunks of recycled journals hold the journal file
+// number, so the journal reader stops at the stale ones, see
+// journal.Writer.SetNumber; the header tells the bytes at the end of the
+// written chunks may be stale rather than corrupted. The header sequence
+// number guards against the stale records of a reused low 32 bits file
+// number: the records of a recycled journal file are all written by the
+// same DB instance, so their sequence numbers are increasing.
+func writeJournalHeader(jw *journal.Writer, num int64, seq uint64) error {
+	w, err := jw.Next()
+	if err != nil {
+		return err
+	}
+	hdr := make([]byte, journalHeaderLen)
+	binary.LittleEndian.PutUint64(hdr[batchHeaderLen:], uint64(num))
+	binary.LittleEndian.PutUint64(hdr[batchHeaderLen+8:], seq)
+	_, err = w.Write(hdr)
+	return err
+}
+
+func decodeJournalHeader(data []byte) (num int64, seq uint64) {
+	num = int64(binary.LittleEndian.Uint64(data[batchHeaderLen:]))
+	seq = binary.LittleEndian.Uint64(data[batchHeaderLen+8:])
+	return
+}
+
+// Returns true if obsolete journals should be recycled.
+func (db *DB) journalRecycling() bool {
+	if db.s.o.GetJournalRecycle() == 0 || db.s.o.GetJournalArchive() || db.journalRetention() {
+		return false
+	}
+	_, ok := db.s.stor.Storage.(storage.Recycler)
+	return ok
+}
+
+// Keeps the given obsolete journal for reuse by createJournal, unless the
+// number of recycled journals is at the limit. Only journals created by
+// this DB instance may be recycled, see writeJournalHeader.
+func (db *DB) recycleJournal(fd storage.FileDesc) bool {
+	if !db.journalRecycling() {
+		return false
+	}
+	db.jretainMu.Lock()
+	defer db.jretainMu.Unlock()
+	if len(db.jrecycled) >= db.s.o.GetJournalRecycle() {
+		return false
+	}
+	db.jrecycled = append(db.jrecycled, fd)
+	return true
+}
+
+// Removes the recycled journals.
+func (db *DB) dropRecycledJournals() {
+	db.jretainMu.Lock()
+	defer db.jretainMu.Unlock()
+	for _, fd := range db.jrecycled {
+		if err := db.s.stor.Remove(fd); err != nil {
+			db.log(opt.LogWarn, "journal@recycle remove failed", "file", fd, "err", err)
+		}
+	}
+	db.jrecycled = nil
+}
+
+// Creates the journal file with the given file number, reusing a recycled
+// journal file if any.
+func (db *DB) createJournal(fd storage.FileDesc) (storage.Writer, error) {
+	db.jretainMu.Lock()
+	var rfd storage.FileDesc
+	if n := len(db.jrecycled); n > 0 {
+		rfd = db.jrecycled[0]
+		db.jrecycled = db.jrecycled[1:]
+	}
+	db.jretainMu.Unlock()
+	if !rfd.Zero() {
+		w, err := db.s.stor.Recycle(rfd, fd)
+		if err == nil {
+			db.log(opt.LogDebug, "journal@recycle reused", "file", rfd, "as", fd)
+			return w, nil
+		}
+		if err != storage.ErrNotSupported {
+			db.log(opt.LogWarn, "journal@recycle failed", "file", rfd, "err", err)
+		}
+		if err := db.s.stor.Remove(rfd); err != nil {
+			db.log(opt.LogWarn, "journal@recycle remove failed", "file", rfd, "err", err)
+		}
+	}
+
+	w, err := db.s.stor.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	if size := db.s.o.GetJournalPreallocateSize(); size > 0 {
+		if p, ok := w.(storage.Preallocator); ok {
+			if err := p.Preallocate(int64(size)); err != nil && err != storage.ErrNotSupported {
+				db.log(opt.LogWarn, "journal@preallocate", "file", fd, "err", err)
+			}
+		}
+	}
+	return w, nil
+}
+
+// BatchIterator iterates over write batches read from the journals, see
+// DB.GetUpdatesSince.
+type BatchIterator interface {
+	// Next moves the iterator to the next batch. It returns false if the
+	// iterator is exhausted or on error.
+	Next() bool
+
+	// Seq returns sequence number of the first record of the current
+	// batch, the batch records are numbered consecutively.
+	Seq() uint64
+
+	// Batch returns the current batch. The batch is only valid until the
+	// next call to Next, and should not be modified.
+	Batch() *Batch
+
+	// Error returns any accumulated error.
+	Error() error
+
+	util.Releaser
+}
+
+type journalBatchIter struct {
+	readers []io.Reader
+	closers []io.Closer
+	fds     []storage.FileDesc
+	jr      *journal.Reader
+	jbuf    []byte
+	bpool   *util.BufferPool
+	bsize   int
+	seq     uint64
+
+	// The journal header of the current journal, if recycled.
+	recycled bool
+	hdrSeq   uint64
+
+	// The first batch, read in advance to check the update availability.
+	pending  bool
+	hasFirst bool
+	firstSeq uint64
+	batchSeq uint64
+	batch    Batch
+	buf      util.Buffer
+	err      error
+}
+
+// Reads the next batch whose records aren't all before seq.
+func (i *journalBatchIter) next() bool {
+	for i.err == nil {
+		first := i.jr == nil
+		if first {
+			if len(i.readers) == 0 {
+				return false
+			}
+			// The block buffer is shared by the readers of the journals,
+			// read one after another.
+			if i.jbuf == nil {
+				i.jbuf = i.bpool.Get(i.bsize)
+			}
+			i.jr = journal.NewReaderBuffer(i.readers[0], nil, true, true, i.jbuf)
+			i.jr.SetNumber(i.fds[0].Num)
+			i.recycled = false
+		}
+		err := readJournalBatch(i.jr, &i.buf)
+		if err == errJournalHeader {
+			num, seq := decodeJournalHeader(i.buf.Bytes())
+			if first && num == i.fds[0].Num {
+				i.recycled, i.hdrSeq = true, seq
+				continue
+			}
+			// Stale header of a recycled journal file.
+			err = io.EOF
+		} else if i.recycled && (err == io.ErrUnexpectedEOF || errors.IsCorrupted(err)) {
+			// The records past the written ones of a recycled journal
+			// file are stale, possibly partially overwritten.
+			err = io.EOF
+		}
+		if err == io.EOF {
+			i.readers, i.fds, i.jr = i.readers[1:], i.fds[1:], nil
+			continue
+		}
+		if err == nil {
+			data := i.buf.Bytes()
+			var batchLen int
+			i.batchSeq, batchLen, err = decodeBatchHeader(data)
+			if err == nil && i.recycled && i.batchSeq <= i.hdrSeq {
+				// Stale record of a recycled journal file.
+				i.readers, i.fds, i.jr = i.readers[1:], i.fds[1:], nil
+				continue
+			}
+			if err == nil {
+				if !i.hasFirst {
+					i.hasFirst, i.firstSeq = true, i.batchSeq
+				}
+				if i.batchSeq+uint64(batchLen) <= i.seq {
+					continue
+				}
+				err = i.batch.decode(data[batchHeaderLen:], batchLen)
+			}
+		}
+		if err != nil {
+			i.err = errors.SetFd(err, i.fds[0])
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (i *journalBatchIter) Next() bool {
+	if i.pending {
+		i.pending = false
+		return true
+	}
+	return i.next()
+}
+
+func (i *journalBatchIter) Seq() uint64 {
+	return i.batchSeq
+}
+
+func (i *journalBatchIter) Batch() *Batch {
+	return &i.batch
+}
+
+func (i *journalBatchIter) Error() error {
+	return i.err
+}
+
+func (i *journalBatchIter) Release() {
+	for _, c := range i.closers {
+		c.Close()
+	}
+	i.closers = nil
+	i.readers = nil
+	i.jr = nil
+	if i.jbuf != nil {
+		i.bpool.Put(i.jbuf)
+		i.jbuf = nil
+	}
+	if i.err == nil {
+		i.err = ErrIterReleased
+	}
+}
+
+// GetUpdatesSince returns an iterator over the write batches since the
+// given sequence number, in order, read from the journals; the first batch
+// holds the record of the given sequence number, if any. This is the
+// building block for replication: a follower applies the batches, then
+// calls GetUpdatesSince again with the sequence number following the last
+// applied record.
+//
+// The iterator reads the journals up to the latest write when it is
+// called. Obsolete journals are removed once their memdb is flushed, set
+// opt.Options.JournalRetentionSize or JournalRetentionTime to retain them.
+// ErrUpdatesUnavailable is returned if the journal holding the given
+// sequence number is no longer retained; sequence numbers may skip on DB
+// recovery, so it is also returned for a skipped sequence number right
+// before the oldest retained journal. Records written bypassing the
+// journal, by transactions and table ingestion, aren't included.
+//
+// The current journal is read while it is open for writing, the storage
+// must allow that; the file-system backed storage does.
+//
+// The iterator must be released after use, by calling Release method.
+func (db *DB) GetUpdatesSince(seq uint64) (BatchIterator, error) {
+	if err := db.lockWriter(); err != nil {
+		return nil, err
+	}
+	iter := &journalBatchIter{bpool: db.s.tops.bpool, bsize: db.s.o.GetJournalBlockSize(), seq: seq}
+	err := func() error {
+		defer func() { <-db.writeLockC }()
+
+		db.purgeJournals()
+		db.memMu.RLock()
+		defer db.memMu.RUnlock()
+		db.jretainMu.Lock()
+		for _, rj := range db.jretained {
+			iter.fds = append(iter.fds, rj.fd)
+		}
+		db.jretainMu.Unlock()
+		if !db.frozenJournalFd.Zero() {
+			iter.fds = append(iter.fds, db.frozenJournalFd)
+		}
+		iter.fds = append(iter.fds, db.journalFd)
+
+		for n, fd := range iter.fds {
+			r, err := db.s.stor.Open(fd)
+			if err != nil {
+				return err
+			}
+			iter.closers = append(iter.closers, r)
+			if n < len(iter.fds)-1 {
+				iter.readers = append(iter.readers, r)
+				continue
+			}
+			// Writes may follow, only read what is written so far.
+			iter.readers = append(iter.readers, io.NewSectionReader(r, 0, db.journalWriter.size))
+		}
+		return nil
+	}()
+	if err != nil {
+		iter.Release()
+		return nil, err
+	}
+
+	// The updates are available if the oldest journal starts at or before
+	// the given sequence number. Sequence numbers may skip on recovery, so
+	// this is conservative; the first sequence number is 1.
+	if seq == 0 {
+		seq = 1
+	}
+	latest := db.getSeq()
+	iter.pending = iter.next()
+	if err := iter.err; err != nil {
+		iter.Release()
+		return nil, err
+	}
+	if (iter.hasFirst && seq < iter.firstSeq) || (!iter.hasFirst && seq <= latest) {
+		iter.Release()
+		return nil, ErrUpdatesUnavailable
+	}
+	return iter, nil
+}
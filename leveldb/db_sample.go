@@ -0,0 +1,96 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/FactomProject/goleveldb/leveldb/iterator"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+// sampler picks the keys yielded by a sample iterator, see
+// DB.NewSampleIterator.
+type sampler struct {
+	fraction float64
+	seed     uint32
+}
+
+// Returns true if the given user key is picked.
+func (s *sampler) sampled(ukey []byte) bool {
+	return uint64(util.Hash(ukey, s.seed)) < uint64(s.fraction*(1<<32))
+}
+
+// Wraps the given iterator to only yield the picked keys, returns the
+// iterator as is if the sampler is nil.
+func (s *sampler) wrap(iter iterator.Iterator) iterator.Iterator {
+	if s == nil {
+		return iter
+	}
+	return &sampleIter{Iterator: iter, smp: s}
+}
+
+// sampleIter skips the entries of an internal key iterator whose user key
+// isn't picked by the sampler. Invalid keys are yielded as is.
+type sampleIter struct {
+	iterator.Iterator
+	smp *sampler
+}
+
+func (i *sampleIter) skip(ok, forward bool) bool {
+	for ok {
+		if ukey, _, _, kerr := parseInternalKey(i.Key()); kerr != nil || i.smp.sampled(ukey) {
+			return true
+		}
+		if forward {
+			ok = i.Iterator.Next()
+		} else {
+			ok = i.Iterator.Prev()
+		}
+	}
+	return false
+}
+
+func (i *sampleIter) First() bool            { return i.skip(i.Iterator.First(), true) }
+func (i *sampleIter) Last() bool             { return i.skip(i.Iterator.Last(), false) }
+func (i *sampleIter) Seek(key []byte) bool   { return i.skip(i.Iterator.Seek(key), true) }
+func (i *sampleIter) SeekLE(key []byte) bool { return i.skip(i.Iterator.SeekLE(key), false) }
+func (i *sampleIter) Next() bool             { return i.skip(i.Iterator.Next(), true) }
+func (i *sampleIter) Prev() bool             { return i.skip(i.Iterator.Prev(), false) }
+
+// NewSampleIterator returns an iterator over approximately the given
+// fraction of the keys of the latest snapshot of the underlying DB, e.g.
+// to estimate the key distribution without a full scan. The 'sorted table'
+// data blocks are picked as a whole, by skipping through the table
+// indexes, and the skipped data blocks aren't read; the keys of the memdb
+// are picked one by one.
+//
+// The iterator yields the picked keys in order, with their value. The
+// sample is approximate: a key may be yielded with a value overwritten or
+// deleted in a skipped data block. A fraction of 1 or greater yields all
+// keys, and a fraction of 0 or less none. The read options apply as for
+// NewIterator.
+//
+// The iterator must be released after use, by calling Release method.
+func (db *DB) NewSampleIterator(ro *opt.ReadOptions, fraction float64) iterator.Iterator {
+	if err := db.ok(); err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	if fraction <= 0 {
+		return iterator.NewEmptyIterator(nil)
+	}
+
+	smp := &sampler{
+		fraction: math.Min(fraction, 1),
+		seed:     rand.Uint32(),
+	}
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	return db.newIterator(nil, nil, se.seq, nil, ro, smp)
+}
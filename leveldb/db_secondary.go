@@ -0,0 +1,134 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+)
+
+// Number of attempts of a catch-up racing with the primary.
+const secondaryCatchUpAttempts = 3
+
+var errPrimaryChanged = errors.New("leveldb: primary changed during catch-up")
+
+// OpenAsSecondary opens a secondary instance of the DB at the given
+// primary path, which may be in use by another process. The secondary
+// instance is read-only, it reads the tables, the manifest and the
+// journals of the primary in place, without copying them; the secondary
+// path holds the lock and the LOG of the secondary instance. See
+// storage.OpenFileSecondary.
+//
+// The secondary instance sees the primary state as of when it is opened,
+// call TryCatchUpWithPrimary to follow the primary. The primary removes
+// obsolete files regardless of the secondary instance, reads may fail
+// with a missing file error if the secondary instance lags behind; catch
+// up regularly.
+//
+// The ReadOnly, ErrorIfMissing and ErrorIfExist options are ignored.
+//
+// The returned DB instance is safe for concurrent use.
+// The DB must be closed after use, by calling Close method.
+func OpenAsSecondary(primaryPath, secondaryPath string, o *opt.Options) (db *DB, err error) {
+	stor, err := storage.OpenFileSecondary(primaryPath, secondaryPath)
+	if err != nil {
+		return
+	}
+	so := &opt.Options{}
+	if o != nil {
+		*so = *o
+	}
+	so.ReadOnly = true
+	so.ErrorIfMissing = true
+	so.ErrorIfExist = false
+	db, err = Open(stor, so)
+	if err != nil {
+		stor.Close()
+	} else {
+		db.closer = stor
+		db.secondary = true
+	}
+	return
+}
+
+// Re-reads the primary manifest and journals, and switches to them.
+func (db *DB) catchUpWithPrimary() error {
+	// The primary state is staged, then the version and the memdb are
+	// installed together; the former state is kept on error.
+	m, err := db.s.readManifest()
+	if err != nil {
+		return err
+	}
+	mdb, seq, fds, err := db.replayJournalsRO(m.rec.seqNum, m.rec.journalNum, m.rec.prevJournalNum)
+	if err != nil {
+		return err
+	}
+	// The journal referenced by the manifest is removed only once a newer
+	// manifest record is committed, its absence means the journals were
+	// listed after the manifest moved on.
+	if jnum := m.rec.journalNum; jnum > 0 {
+		var found bool
+		for _, fd := range fds {
+			if fd.Num == jnum {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errPrimaryChanged
+		}
+	}
+
+	mem := &memDB{db: db, DB: mdb, ref: 1}
+	if err := mem.loadRangeDels(); err != nil {
+		return err
+	}
+	db.memMu.Lock()
+	db.s.installManifest(m)
+	old := db.mem
+	db.mem = mem
+	db.memMu.Unlock()
+	old.decref()
+	if seq > db.getSeq() {
+		db.setSeq(seq)
+	}
+	db.log(opt.LogDebug, "db@secondary caught up", "journals", len(fds), "seq", seq)
+	return nil
+}
+
+// TryCatchUpWithPrimary re-reads the primary manifest and journals, so the
+// secondary instance sees the latest primary state. Iterators obtained
+// before keep seeing the former state. Snapshots aren't known to the
+// primary, values older than the latest may be compacted away by the
+// primary once a snapshot reads the new state.
+//
+// The primary may change its files while they are read, the catch-up is
+// retried a few times and the last error is returned if it keeps failing;
+// the secondary instance is left at the former state then.
+//
+// ErrNotSecondary is returned if the DB isn't opened by OpenAsSecondary.
+func (db *DB) TryCatchUpWithPrimary() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	if !db.secondary {
+		return ErrNotSecondary
+	}
+
+	// The session state is only modified by the catch-up.
+	db.compCommitLk.Lock()
+	defer db.compCommitLk.Unlock()
+	var err error
+	for i := 0; i < secondaryCatchUpAttempts; i++ {
+		if err = db.catchUpWithPrimary(); err == nil || err == ErrClosed {
+			break
+		}
+		db.log(opt.LogWarn, "db@secondary catch-up failed", "attempt", i+1, "err", err)
+	}
+	return err
+}
@@ -8,8 +8,10 @@ package leveldb
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 
@@ -45,6 +47,31 @@ func (db *DB) acquireSnapshot() *snapshotElement {
 	return se
 }
 
+// Acquires a snapshot of the given sequence, which may be older than
+// the latest snapshot.
+func (db *DB) acquireSnapshotAt(seq uint64) *snapshotElement {
+	db.snapsMu.Lock()
+	defer db.snapsMu.Unlock()
+
+	e := db.snapsList.Back()
+	for ; e != nil; e = e.Prev() {
+		se := e.Value.(*snapshotElement)
+		if se.seq == seq {
+			se.ref++
+			return se
+		} else if se.seq < seq {
+			break
+		}
+	}
+	se := &snapshotElement{seq: seq, ref: 1}
+	if e == nil {
+		se.e = db.snapsList.PushFront(se)
+	} else {
+		se.e = db.snapsList.InsertAfter(se, e)
+	}
+	return se
+}
+
 // Releases given snapshot element.
 func (db *DB) releaseSnapshot(se *snapshotElement) {
 	db.snapsMu.Lock()
@@ -81,9 +108,14 @@ type Snapshot struct {
 
 // Creates new snapshot object.
 func (db *DB) newSnapshot() *Snapshot {
+	return db.newSnapshotOf(db.acquireSnapshot())
+}
+
+// Creates new snapshot object of the given acquired snapshot element.
+func (db *DB) newSnapshotOf(se *snapshotElement) *Snapshot {
 	snap := &Snapshot{
 		db:   db,
-		elem: db.acquireSnapshot(),
+		elem: se,
 	}
 	atomic.AddInt32(&db.aliveSnaps, 1)
 	runtime.SetFinalizer(snap, (*Snapshot).Release)
@@ -110,12 +142,13 @@ func (snap *Snapshot) Get(key []byte, ro *opt.ReadOptions) (value []byte, err er
 		err = ErrSnapshotReleased
 		return
 	}
-	return snap.db.get(nil, nil, key, snap.elem.seq, ro)
+	return snap.db.get(context.Background(), nil, nil, key, nil, snap.elem.seq, ro)
 }
 
-// Has returns true if the DB does contains the given key.
+// Has returns true if the DB does contains the given key. Unlike Get,
+// the value is never copied, and table lookups stop at the key.
 //
-// It is safe to modify the contents of the argument after Get returns.
+// It is safe to modify the contents of the argument after Has returns.
 func (snap *Snapshot) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error) {
 	err = snap.db.ok()
 	if err != nil {
@@ -127,7 +160,7 @@ func (snap *Snapshot) Has(key []byte, ro *opt.ReadOptions) (ret bool, err error)
 		err = ErrSnapshotReleased
 		return
 	}
-	return snap.db.has(nil, nil, key, snap.elem.seq, ro)
+	return snap.db.has(context.Background(), nil, nil, key, snap.elem.seq, ro)
 }
 
 // NewIterator returns an iterator for the snapshot of the underlying DB.
@@ -158,7 +191,7 @@ func (snap *Snapshot) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterat
 	}
 	// Since iterator already hold version ref, it doesn't need to
 	// hold snapshot ref.
-	return snap.db.newIterator(nil, nil, snap.elem.seq, slice, ro)
+	return snap.db.newIterator(nil, nil, snap.elem.seq, slice, ro, nil)
 }
 
 // Release releases the snapshot. This will not release any returned
@@ -181,3 +214,139 @@ func (snap *Snapshot) Release() {
 		snap.elem = nil
 	}
 }
+
+// Pins the named snapshots recorded in the manifest, so compactions
+// keep their entries.
+func (db *DB) pinNamedSnapshots() {
+	for name, seq := range db.s.stNamedSnaps {
+		// Writes up to the snapshot sequence may be lost if the journal
+		// wasn't synced; don't reuse their sequence numbers.
+		if seq > db.seq {
+			db.seq = seq
+		}
+		db.namedSnaps[name] = db.acquireSnapshotAt(seq)
+	}
+}
+
+// Commits the given named snapshot record; need write lock.
+func (db *DB) commitNamedSnapshot(rec *sessionRecord) error {
+	db.compCommitLk.Lock()
+	defer db.compCommitLk.Unlock()
+	return db.s.commit(rec)
+}
+
+// CreateNamedSnapshot creates a persistent snapshot of the latest DB state
+// with the given name. Unlike snapshots returned by GetSnapshot, the named
+// snapshot survives DB restarts: its sequence number is recorded in the
+// manifest, and compactions keep the entries visible to it until it is
+// released by ReleaseNamedSnapshot. Writes up to the snapshot are synced
+// to the journal, unless NoSync is set.
+//
+// The returned snapshot is an ordinary snapshot of the named snapshot
+// state and must be released after use, releasing it doesn't release the
+// named snapshot. ErrSnapshotExist is returned if the name is in use, and
+// ErrNotCompatible in LevelDB compatible mode.
+//
+// Named snapshots hold obsolete entries back from compactions, long-lived
+// named snapshots grow the DB size.
+func (db *DB) CreateNamedSnapshot(name string) (*Snapshot, error) {
+	if db.s.o.GetLevelDBCompatible() {
+		return nil, ErrNotCompatible
+	}
+	if err := db.lockWriter(); err != nil {
+		return nil, err
+	}
+	defer func() { <-db.writeLockC }()
+
+	db.snapsMu.Lock()
+	_, exist := db.namedSnaps[name]
+	db.snapsMu.Unlock()
+	if exist {
+		return nil, ErrSnapshotExist
+	}
+
+	if err := db.syncJournal(); err != nil {
+		return nil, err
+	}
+
+	// Acquire the snapshot first, so compactions keep its entries while
+	// it is being committed.
+	se := db.acquireSnapshot()
+	rec := &sessionRecord{}
+	rec.addNamedSnapshot(name, se.seq)
+	if err := db.commitNamedSnapshot(rec); err != nil {
+		db.releaseSnapshot(se)
+		return nil, err
+	}
+	db.log(opt.LogDebug, "snapshot@create", "name", name, "seq", se.seq)
+
+	db.snapsMu.Lock()
+	db.namedSnaps[name] = se
+	se.ref++
+	db.snapsMu.Unlock()
+	return db.newSnapshotOf(se), nil
+}
+
+// GetNamedSnapshot returns a snapshot of the named snapshot state. It
+// returns ErrNotFound if there is no such named snapshot.
+//
+// The snapshot must be released after use, by calling Release method.
+func (db *DB) GetNamedSnapshot(name string) (*Snapshot, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+
+	db.snapsMu.Lock()
+	se, ok := db.namedSnaps[name]
+	if ok {
+		se.ref++
+	}
+	db.snapsMu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return db.newSnapshotOf(se), nil
+}
+
+// NamedSnapshots returns names of the named snapshots, sorted.
+func (db *DB) NamedSnapshots() []string {
+	db.snapsMu.Lock()
+	names := make([]string, 0, len(db.namedSnaps))
+	for name := range db.namedSnaps {
+		names = append(names, name)
+	}
+	db.snapsMu.Unlock()
+	sort.Strings(names)
+	return names
+}
+
+// ReleaseNamedSnapshot releases the named snapshot, so compactions may
+// drop the entries it holds back. Snapshots returned for the named
+// snapshot remain valid until released. It returns ErrNotFound if there
+// is no such named snapshot.
+func (db *DB) ReleaseNamedSnapshot(name string) error {
+	if err := db.lockWriter(); err != nil {
+		return err
+	}
+	defer func() { <-db.writeLockC }()
+
+	db.snapsMu.Lock()
+	se, ok := db.namedSnaps[name]
+	db.snapsMu.Unlock()
+	if !ok {
+		return ErrNotFound
+	}
+
+	rec := &sessionRecord{}
+	rec.delNamedSnapshot(name)
+	if err := db.commitNamedSnapshot(rec); err != nil {
+		return err
+	}
+	db.log(opt.LogDebug, "snapshot@release", "name", name, "seq", se.seq)
+
+	db.snapsMu.Lock()
+	delete(db.namedSnaps, name)
+	db.snapsMu.Unlock()
+	db.releaseSnapshot(se)
+	return nil
+}
@@ -8,12 +8,15 @@ package leveldb
 
 import (
 	"errors"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/FactomProject/goleveldb/leveldb/journal"
 	"github.com/FactomProject/goleveldb/leveldb/memdb"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
 	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
 var (
@@ -24,6 +27,13 @@ type memDB struct {
 	db *DB
 	*memdb.DB
 	ref int32
+
+	rdelMu sync.RWMutex
+	rdels  rangeDels
+	// Index of the range tombstones, and the number of tombstones it
+	// was built from.
+	rdelIdx  rangeDelIndex
+	rdelIdxN int
 }
 
 func (m *memDB) getref() int32 {
@@ -48,6 +58,64 @@ func (m *memDB) decref() {
 	}
 }
 
+func (m *memDB) putRangeDel(seq uint64, start, limit []byte) {
+	rd := rangeDel{seq, append([]byte{}, start...), append([]byte{}, limit...)}
+	m.rdelMu.Lock()
+	m.rdels = append(m.rdels, rd)
+	m.rdelMu.Unlock()
+}
+
+// Returns the index of the range tombstones of the memdb, nil if it holds
+// none. The index is rebuilt once tombstones are added.
+func (m *memDB) getRangeDelIndex() rangeDelIndex {
+	m.rdelMu.RLock()
+	idx, n := m.rdelIdx, len(m.rdels)
+	built := m.rdelIdxN == n
+	m.rdelMu.RUnlock()
+	if built {
+		return idx
+	}
+	m.rdelMu.Lock()
+	defer m.rdelMu.Unlock()
+	if m.rdelIdxN != len(m.rdels) {
+		m.rdelIdx = newRangeDelIndex(m.db.s.icmp, m.rdels)
+		m.rdelIdxN = len(m.rdels)
+	}
+	return m.rdelIdx
+}
+
+// Whether the memdb holds a key of the given range; false if the memdb
+// is nil.
+func (m *memDB) overlaps(icmp *iComparer, umin, umax []byte) bool {
+	if m == nil {
+		return false
+	}
+	iter := m.NewIterator(nil)
+	defer iter.Release()
+	return iter.Seek(makeInternalKey(nil, umin, keyMaxSeq, keyTypeSeek)) && icmp.uCompare(internalKey(iter.Key()).ukey(), umax) <= 0
+}
+
+// Loads range tombstones from the memdb contents.
+func (m *memDB) loadRangeDels() error {
+	rds, err := collectRangeDels(m.NewIterator(nil))
+	if err != nil {
+		return err
+	}
+	m.rdelMu.Lock()
+	m.rdels = rds
+	m.rdelIdx, m.rdelIdxN = nil, 0
+	m.rdelMu.Unlock()
+	return nil
+}
+
+func (m *memDB) Reset() {
+	m.DB.Reset()
+	m.rdelMu.Lock()
+	m.rdels = nil
+	m.rdelIdx, m.rdelIdxN = nil, 0
+	m.rdelMu.Unlock()
+}
+
 // Get latest sequence number.
 func (db *DB) getSeq() uint64 {
 	return atomic.LoadUint64(&db.seq)
@@ -120,12 +188,28 @@ func (db *DB) mpoolDrain() {
 // Create new memdb and froze the old one; need external synchronization.
 // newMem only called synchronously by the writer.
 func (db *DB) newMem(n int) (mem *memDB, err error) {
+	// Unsynced writes must be durable before the journal is frozen, since
+	// it won't be synced anymore.
+	if err = db.syncJournal(); err != nil {
+		return
+	}
+
 	fd := storage.FileDesc{Type: storage.TypeJournal, Num: db.s.allocFileNum()}
-	w, err := db.s.stor.Create(fd)
+	w, err := db.createJournal(fd)
 	if err != nil {
 		db.s.reuseFileNum(fd.Num)
 		return
 	}
+	// Sync the storage so the journal is found after a crash, once the
+	// writes to it are synced.
+	if !db.s.o.GetNoSync() {
+		if err = db.s.stor.Sync(); err != nil {
+			w.Close()
+			db.s.stor.Remove(fd)
+			db.s.reuseFileNum(fd.Num)
+			return
+		}
+	}
 
 	db.memMu.Lock()
 	defer db.memMu.Unlock()
@@ -134,14 +218,21 @@ func (db *DB) newMem(n int) (mem *memDB, err error) {
 		return nil, errHasFrozenMem
 	}
 
+	jf := &journalFile{Writer: w}
 	if db.journal == nil {
-		db.journal = journal.NewWriter(w)
+		db.journal = journal.NewWriterSize(jf, db.s.o.GetJournalBlockSize())
+		db.journal.SetChecksum(util.Checksum(db.s.o.GetChecksum()))
 	} else {
-		db.journal.Reset(w)
+		db.journal.Reset(jf)
 		db.journalWriter.Close()
 		db.frozenJournalFd = db.journalFd
 	}
-	db.journalWriter = w
+	if db.journalRecycling() {
+		// The chunks hold the journal number, so the stale chunks of a
+		// recycled journal file are never read.
+		db.journal.SetNumber(fd.Num)
+	}
+	db.journalWriter = jf
 	db.journalFd = fd
 	db.frozenMem = db.mem
 	mem = db.mpoolGet(n)
@@ -151,6 +242,10 @@ func (db *DB) newMem(n int) (mem *memDB, err error) {
 	// The seq only incremented by the writer. And whoever called newMem
 	// should hold write lock, so no need additional synchronization here.
 	db.frozenSeq = db.seq
+	if db.journalRecycling() {
+		// An error is sticky, thus returned by the next journal write.
+		writeJournalHeader(db.journal, fd.Num, db.seq)
+	}
 	return
 }
 
@@ -201,10 +296,12 @@ func (db *DB) getFrozenMem() *memDB {
 // Drop frozen memdb; assume that frozen memdb isn't nil.
 func (db *DB) dropFrozenMem() {
 	db.memMu.Lock()
-	if err := db.s.stor.Remove(db.frozenJournalFd); err != nil {
-		db.logf("journal@remove removing @%d %q", db.frozenJournalFd.Num, err)
-	} else {
-		db.logf("journal@remove removed @%d", db.frozenJournalFd.Num)
+	if db.recycleJournal(db.frozenJournalFd) {
+		db.log(opt.LogDebug, "journal@recycle recycled", "file", db.frozenJournalFd)
+	} else if err := db.removeJournal(db.frozenJournalFd); err != nil {
+		db.log(opt.LogWarn, "journal@remove failed", "file", db.frozenJournalFd, "err", err)
+	} else if !db.journalRetention() {
+		db.log(opt.LogDebug, "journal@remove removed", "file", db.frozenJournalFd)
 	}
 	db.frozenJournalFd = storage.FileDesc{}
 	db.frozenMem.decref()
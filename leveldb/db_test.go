@@ -9,13 +9,19 @@ package leveldb
 import (
 	"bytes"
 	"container/list"
+	"context"
 	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -31,6 +37,7 @@ import (
 	"github.com/FactomProject/goleveldb/leveldb/iterator"
 	"github.com/FactomProject/goleveldb/leveldb/opt"
 	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/table"
 	"github.com/FactomProject/goleveldb/leveldb/testutil"
 	"github.com/FactomProject/goleveldb/leveldb/util"
 )
@@ -79,8 +86,12 @@ func newDbHarness(t *testing.T) *dbHarness {
 
 func (h *dbHarness) init(t *testing.T, o *opt.Options) {
 	gomega.RegisterTestingT(t)
+	h.initStor(t, testutil.NewStorage(), o)
+}
+
+func (h *dbHarness) initStor(t *testing.T, stor *testutil.Storage, o *opt.Options) {
 	h.t = t
-	h.stor = testutil.NewStorage()
+	h.stor = stor
 	h.stor.OnLog(testingLogger(t))
 	h.stor.OnClose(testingPreserveOnFailed(t))
 	h.o = o
@@ -216,6 +227,16 @@ func (h *dbHarness) delete(key string) {
 	}
 }
 
+func (h *dbHarness) deleteRange(start, limit string) {
+	t := h.t
+	db := h.db
+
+	err := db.DeleteRange([]byte(start), []byte(limit), h.wo)
+	if err != nil {
+		t.Error("DeleteRange: got error: ", err)
+	}
+}
+
 func (h *dbHarness) assertNumKeys(want int) {
 	iter := h.db.NewIterator(nil, h.ro)
 	defer iter.Release()
@@ -276,7 +297,7 @@ func (h *dbHarness) allEntriesFor(key, want string) {
 	s := db.s
 
 	ikey := makeInternalKey(nil, []byte(key), keyMaxSeq, keyTypeVal)
-	iter := db.newRawIterator(nil, nil, nil, nil)
+	iter, _ := db.newRawIterator(nil, nil, nil, nil, nil)
 	if !iter.Seek(ikey) && iter.Error() != nil {
 		t.Error("AllEntries: error during seek, err: ", iter.Error())
 		return
@@ -295,8 +316,16 @@ func (h *dbHarness) allEntriesFor(key, want string) {
 			switch kt {
 			case keyTypeVal:
 				res += string(iter.Value())
+			case keyTypeValPtr:
+				value, err := s.tops.readValue(iter.Value(), nil)
+				if err != nil {
+					t.Error("AllEntries: error reading value log, err: ", err)
+				}
+				res += string(value)
 			case keyTypeDel:
 				res += "DEL"
+			case keyTypeRangeDel:
+				res += "RDEL"
 			}
 		} else {
 			if !first {
@@ -392,7 +421,7 @@ func (h *dbHarness) compactRangeAtErr(level int, min, max string, wanterr bool)
 
 	t.Logf("starting table range compaction: level=%d, min=%q, max=%q", level, min, max)
 
-	if err := db.compTriggerRange(db.tcompCmdC, level, _min, _max); err != nil {
+	if err := db.compTriggerRange(db.tcompCmdC, level, _min, _max, nil); err != nil {
 		if wanterr {
 			t.Log("CompactRangeAt: got error (expected): ", err)
 		} else {
@@ -814,6 +843,176 @@ func TestDB_GetEncountersEmptyLevel(t *testing.T) {
 	})
 }
 
+func TestDB_DeleteRange(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		for i := 0; i < 100; i++ {
+			h.put(numKey(i), numKey(i))
+		}
+		snap := h.getSnapshot()
+		h.deleteRange(numKey(10), numKey(20))
+		h.put(numKey(15), "v2")
+
+		check := func() {
+			for i := 0; i < 100; i++ {
+				switch {
+				case i == 15:
+					h.getVal(numKey(i), "v2")
+				case i >= 10 && i < 20:
+					h.get(numKey(i), false)
+				default:
+					h.getVal(numKey(i), numKey(i))
+				}
+			}
+			h.assertNumKeys(91)
+
+			n := 0
+			iter := h.db.NewIterator(nil, h.ro)
+			for ok := iter.Last(); ok; ok = iter.Prev() {
+				n++
+			}
+			iter.Release()
+			if n != 91 {
+				t.Errorf("backward iteration yields %d keys, want 91", n)
+			}
+		}
+
+		check()
+		h.getValr(snap, numKey(12), numKey(12))
+		h.compactMem()
+		check()
+		h.getValr(snap, numKey(12), numKey(12))
+		snap.Release()
+
+		h.reopenDB()
+		check()
+	})
+}
+
+func TestDB_DeleteRangeBatch(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "v1")
+	h.put("b", "v1")
+	h.put("c", "v1")
+
+	b := new(Batch)
+	b.DeleteRange([]byte("a"), []byte("c"))
+	b.Put([]byte("a"), []byte("v2"))
+	h.write(b)
+	h.getKeyVal("(a->v2)(c->v1)")
+
+	h.reopenDB()
+	h.getKeyVal("(a->v2)(c->v1)")
+}
+
+func TestDB_DeleteRangeInvalid(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "v1")
+	h.put("b", "v1")
+	h.put("c", "v1")
+
+	// An empty range deletes nothing.
+	h.deleteRange("b", "b")
+	h.getKeyVal("(a->v1)(b->v1)(c->v1)")
+
+	if err := h.db.DeleteRange([]byte("c"), []byte("a"), h.wo); err != ErrInvalidRange {
+		t.Fatalf("DeleteRange: got error %v, want %v", err, ErrInvalidRange)
+	}
+	b := new(Batch)
+	b.Put([]byte("d"), []byte("v1"))
+	b.DeleteRange([]byte("c"), []byte("a"))
+	if err := h.db.Write(b, h.wo); err != ErrInvalidRange {
+		t.Fatalf("Write: got error %v, want %v", err, ErrInvalidRange)
+	}
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: ", err)
+	}
+	if err := tr.DeleteRange([]byte("c"), []byte("a"), h.wo); err != ErrInvalidRange {
+		t.Fatalf("Transaction.DeleteRange: got error %v, want %v", err, ErrInvalidRange)
+	}
+	if err := tr.Commit(); err != nil {
+		t.Fatal("Commit: ", err)
+	}
+	h.getKeyVal("(a->v1)(b->v1)(c->v1)")
+
+	h.reopenDB()
+	h.getKeyVal("(a->v1)(b->v1)(c->v1)")
+}
+
+func TestDB_DeleteRangeStartKey(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "v1")
+	h.put("b", "v1")
+	h.put("c", "v1")
+
+	// An empty tombstone, as written before the ranges were checked,
+	// mustn't delete its start key.
+	mem := h.db.getEffectiveMem()
+	seq := h.db.getSeq() + 1
+	if err := mem.Put(makeInternalKey(nil, []byte("b"), seq, keyTypeRangeDel), []byte("b")); err != nil {
+		t.Fatal("Put: ", err)
+	}
+	mem.putRangeDel(seq, []byte("b"), []byte("b"))
+	mem.decref()
+	h.db.setSeq(seq)
+
+	check := func() {
+		h.getVal("b", "v1")
+		h.getKeyVal("(a->v1)(b->v1)(c->v1)")
+		iter := h.db.NewIterator(nil, h.ro)
+		var keys []string
+		for ok := iter.Last(); ok; ok = iter.Prev() {
+			keys = append(keys, string(iter.Key()))
+		}
+		iter.Release()
+		if got := strings.Join(keys, ","); got != "c,b,a" {
+			t.Errorf("backward iteration yields %q, want %q", got, "c,b,a")
+		}
+	}
+	check()
+	h.compactMem()
+	check()
+	h.reopenDB()
+	check()
+}
+
+func TestDB_DeleteRangeCompaction(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	value := strings.Repeat("x", 100)
+	for i := 0; i < 1000; i++ {
+		h.put(numKey(i), value)
+	}
+	h.compactMem()
+	h.compactRange("", "")
+
+	h.deleteRange(numKey(100), numKey(900))
+	h.compactMem()
+	h.assertNumKeys(200)
+	h.allEntriesFor(numKey(500), "[ "+value+" ]")
+
+	h.reopenDB()
+	h.assertNumKeys(200)
+
+	// Covered entries and then the tombstone itself should be dropped.
+	h.compactRange("", "")
+	h.allEntriesFor(numKey(500), "[ ]")
+	h.allEntriesFor(numKey(100), "[ ]")
+	h.assertNumKeys(200)
+	h.getVal(numKey(99), value)
+	h.getVal(numKey(900), value)
+
+	h.reopenDB()
+	h.assertNumKeys(200)
+}
+
 func TestDB_IterMultiWithDelete(t *testing.T) {
 	trun(t, func(h *dbHarness) {
 		h.put("a", "va")
@@ -840,1334 +1039,5609 @@ func TestDB_IterMultiWithDelete(t *testing.T) {
 	})
 }
 
-func TestDB_IteratorPinsRef(t *testing.T) {
-	h := newDbHarness(t)
-	defer h.close()
-
-	h.put("foo", "hello")
-
-	// Get iterator that will yield the current contents of the DB.
-	iter := h.db.NewIterator(nil, nil)
-
-	// Write to force compactions
-	h.put("foo", "newvalue1")
-	for i := 0; i < 100; i++ {
-		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), 100000/10))
-	}
-	h.put("foo", "newvalue2")
-
-	iter.First()
-	testKeyVal(t, iter, "foo->hello")
-	if iter.Next() {
-		t.Errorf("expect eof")
-	}
-	iter.Release()
-}
-
-func TestDB_Recover(t *testing.T) {
+func TestDB_IterSeekLE(t *testing.T) {
 	trun(t, func(h *dbHarness) {
-		h.put("foo", "v1")
-		h.put("baz", "v5")
+		h.put("a", "va")
+		h.put("c", "vc1")
+		h.put("e", "ve")
+		h.put("g", "vg")
+		snap := h.getSnapshot()
+		h.put("c", "vc2")
+		h.delete("e")
+		h.deleteRange("f", "h")
+		h.compactMem()
+		h.put("i", "vi")
 
-		h.reopenDB()
-		h.getVal("foo", "v1")
+		test := func(iter iterator.Iterator, key string, want string) {
+			if !iter.SeekLE([]byte(key)) {
+				if want != "" {
+					t.Errorf("SeekLE(%q): want=%q, got none", key, want)
+				}
+			} else {
+				testKeyVal(t, iter, want)
+			}
+			if err := iter.Error(); err != nil {
+				t.Errorf("SeekLE(%q): iterator error: %v", key, err)
+			}
+		}
 
-		h.getVal("foo", "v1")
-		h.getVal("baz", "v5")
-		h.put("bar", "v2")
-		h.put("foo", "v3")
+		iter := h.db.NewIterator(nil, nil)
+		test(iter, "", "")
+		test(iter, "a", "a->va")
+		test(iter, "b", "a->va")
+		test(iter, "c", "c->vc2")
+		test(iter, "e", "c->vc2")
+		test(iter, "h", "c->vc2")
+		test(iter, "z", "i->vi")
+		test(iter, "c", "c->vc2")
+		iter.Prev()
+		testKeyVal(t, iter, "a->va")
+		test(iter, "d", "c->vc2")
+		iter.Next()
+		testKeyVal(t, iter, "i->vi")
+		iter.Release()
 
-		h.reopenDB()
-		h.getVal("foo", "v3")
-		h.put("foo", "v4")
-		h.getVal("foo", "v4")
-		h.getVal("bar", "v2")
-		h.getVal("baz", "v5")
+		iter = snap.NewIterator(nil, nil)
+		test(iter, "d", "c->vc1")
+		test(iter, "f", "e->ve")
+		test(iter, "z", "g->vg")
+		iter.Next()
+		if iter.Valid() {
+			t.Errorf("expect exhausted iterator, got %q", iter.Key())
+		}
+		iter.Release()
+
+		iter = h.db.NewIterator(&util.Range{Start: []byte("b"), Limit: []byte("i")}, nil)
+		test(iter, "a", "")
+		test(iter, "z", "c->vc2")
+		iter.Release()
+		snap.Release()
 	})
 }
 
-func TestDB_RecoverWithEmptyJournal(t *testing.T) {
+func TestDB_IterCursor(t *testing.T) {
 	trun(t, func(h *dbHarness) {
-		h.put("foo", "v1")
-		h.put("foo", "v2")
-
-		h.reopenDB()
-		h.reopenDB()
-		h.put("foo", "v3")
-
-		h.reopenDB()
-		h.getVal("foo", "v3")
-	})
-}
+		for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+			h.put(k, "v"+k)
+		}
+		h.delete("d")
+		snap := h.getSnapshot()
+		defer snap.Release()
+		h.put("d", "vd")
+		h.compactMem()
 
-func TestDB_RecoverDuringMemtableCompaction(t *testing.T) {
-	truno(t, &opt.Options{DisableLargeBatchTransaction: true, WriteBuffer: 1000000}, func(h *dbHarness) {
+		// Scan in chunks of two keys.
+		scan := func(first, next func(iter iterator.Iterator) bool) (got []string) {
+			var cursor []byte
+			for {
+				iter := snap.NewIterator(nil, &opt.ReadOptions{ResumeFrom: cursor})
+				move := next
+				if cursor == nil {
+					move = first
+				}
+				n := 0
+				for n < 2 && move(iter) {
+					move = next
+					got = append(got, string(iter.Key()))
+					n++
+				}
+				if n > 0 {
+					cursor = iter.(CursorIterator).Cursor()
+				}
+				if err := iter.Error(); err != nil {
+					t.Fatal("iterator error: ", err)
+				}
+				iter.Release()
+				if n < 2 {
+					return
+				}
+			}
+		}
+		if got, want := strings.Join(scan(iterator.Iterator.First, iterator.Iterator.Next), ""), "abcef"; got != want {
+			t.Errorf("invalid forward scan, want=%q got=%q", want, got)
+		}
+		if got, want := strings.Join(scan(iterator.Iterator.Last, iterator.Iterator.Prev), ""), "fecba"; got != want {
+			t.Errorf("invalid backward scan, want=%q got=%q", want, got)
+		}
 
-		h.stor.Stall(testutil.ModeSync, storage.TypeTable)
-		h.put("big1", strings.Repeat("x", 10000000))
-		h.put("big2", strings.Repeat("y", 1000))
-		h.put("bar", "v2")
-		h.stor.Release(testutil.ModeSync, storage.TypeTable)
+		// Resume from a key not in the DB, and seeks override the cursor.
+		iter := h.db.NewIterator(nil, &opt.ReadOptions{ResumeFrom: encodeCursor([]byte("cc"))})
+		iter.Next()
+		testKeyVal(t, iter, "d->vd")
+		iter.Release()
+		iter = h.db.NewIterator(nil, &opt.ReadOptions{ResumeFrom: encodeCursor([]byte("cc"))})
+		iter.Prev()
+		testKeyVal(t, iter, "c->vc")
+		iter.Release()
+		iter = h.db.NewIterator(nil, &opt.ReadOptions{ResumeFrom: encodeCursor([]byte("c"))})
+		iter.First()
+		testKeyVal(t, iter, "a->va")
+		iter.Release()
 
-		h.reopenDB()
-		h.getVal("bar", "v2")
-		h.getVal("big1", strings.Repeat("x", 10000000))
-		h.getVal("big2", strings.Repeat("y", 1000))
+		iter = h.db.NewIterator(nil, &opt.ReadOptions{ResumeFrom: []byte("bogus")})
+		if iter.Next() || iter.Error() != ErrInvalidCursor {
+			t.Errorf("expect ErrInvalidCursor, got %v", iter.Error())
+		}
+		iter.Release()
 	})
 }
 
-func TestDB_MinorCompactionsHappen(t *testing.T) {
-	h := newDbHarnessWopt(t, &opt.Options{DisableLargeBatchTransaction: true, WriteBuffer: 10000})
+func TestDB_IterPinData(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		DisableBlockCache:            true,
+		BlockSize:                    256,
+		Compression:                  opt.NoCompression,
+	})
 	defer h.close()
 
-	n := 500
-
-	key := func(i int) string {
-		return fmt.Sprintf("key%06d", i)
+	value := func(i, gen int) string {
+		return fmt.Sprintf("%04d-%d-%s", i, gen, strings.Repeat("v", 100))
 	}
-
-	for i := 0; i < n; i++ {
-		h.put(key(i), key(i)+strings.Repeat("v", 1000))
+	want := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		h.put(key, value(i, 0))
+		want[key] = value(i, 0)
 	}
-
-	for i := 0; i < n; i++ {
-		h.getVal(key(i), key(i)+strings.Repeat("v", 1000))
+	h.compactMem()
+	for i := 0; i < 500; i += 7 {
+		key := fmt.Sprintf("key%04d", i)
+		h.put(key, value(i, 1))
+		want[key] = value(i, 1)
 	}
-
-	h.reopenDB()
-	for i := 0; i < n; i++ {
-		h.getVal(key(i), key(i)+strings.Repeat("v", 1000))
+	h.compactMem()
+	for i := 3; i < 500; i += 11 {
+		key := fmt.Sprintf("key%04d", i)
+		h.put(key, value(i, 2))
+		want[key] = value(i, 2)
 	}
-}
-
-func TestDB_RecoverWithLargeJournal(t *testing.T) {
-	h := newDbHarness(t)
-	defer h.close()
-
-	h.put("big1", strings.Repeat("1", 200000))
-	h.put("big2", strings.Repeat("2", 200000))
-	h.put("small3", strings.Repeat("3", 10))
-	h.put("small4", strings.Repeat("4", 10))
-	h.tablesPerLevel("")
 
-	// Make sure that if we re-open with a small write buffer size that
-	// we flush table files in the middle of a large journal file.
-	h.o.WriteBuffer = 100000
-	h.reopenDB()
-	h.getVal("big1", strings.Repeat("1", 200000))
-	h.getVal("big2", strings.Repeat("2", 200000))
-	h.getVal("small3", strings.Repeat("3", 10))
-	h.getVal("small4", strings.Repeat("4", 10))
-	v := h.db.s.version()
-	if v.tLen(0) <= 1 {
-		t.Errorf("tables-0 less than one")
+	// Reads of other blocks recycle the buffers of unpinned blocks.
+	check := func(iter iterator.Iterator) {
+		for i := 0; i < 500; i += 125 {
+			if _, err := h.db.Get([]byte(fmt.Sprintf("key%04d", i)), nil); err != nil {
+				t.Fatal("Get: got error: ", err)
+			}
+		}
+		if got := string(iter.Value()); got != want[string(iter.Key())] {
+			t.Fatalf("invalid value of key %q, want=%q got=%q", iter.Key(), want[string(iter.Key())], got)
+		}
+	}
+	iter := h.db.NewIterator(nil, &opt.ReadOptions{PinData: true})
+	defer iter.Release()
+	n := 0
+	for iter.Next() {
+		check(iter)
+		n++
+	}
+	for iter.Prev() {
+		check(iter)
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal("iterator error: ", err)
+	}
+	if n != 2*len(want) {
+		t.Errorf("invalid number of iterated keys, want=%d got=%d", 2*len(want), n)
 	}
-	v.release()
 }
 
-func TestDB_CompactionsGenerateMultipleFiles(t *testing.T) {
+func TestDB_SampleIterator(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
-		WriteBuffer:                  10000000,
-		Compression:                  opt.NoCompression,
+		DisableBlockCache:            true,
+		BlockSize:                    256,
 	})
 	defer h.close()
 
-	v := h.db.s.version()
-	if v.tLen(0) > 0 {
-		t.Errorf("level-0 tables more than 0, got %d", v.tLen(0))
+	for i := 0; i < 5000; i++ {
+		h.put(fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i))
 	}
-	v.release()
-
-	n := 80
-
-	// Write 8MB (80 values, each 100K)
-	for i := 0; i < n; i++ {
-		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), 100000/10))
+	h.compactMem()
+	for i := 5000; i < 6000; i++ {
+		h.put(fmt.Sprintf("key%05d", i), fmt.Sprintf("value%05d", i))
 	}
 
-	// Reopening moves updates to level-0
-	h.reopenDB()
-	h.compactRangeAt(0, "", "")
-
-	v = h.db.s.version()
-	if v.tLen(0) > 0 {
-		t.Errorf("level-0 tables more than 0, got %d", v.tLen(0))
+	ioRead := func() uint64 {
+		s, err := h.db.Stats()
+		if err != nil {
+			t.Fatal("Stats: got error: ", err)
+		}
+		return s.IORead
 	}
-	if v.tLen(1) <= 1 {
-		t.Errorf("level-1 tables less than 1, got %d", v.tLen(1))
+	sample := func(fraction float64) (keys []string, read uint64) {
+		read = ioRead()
+		iter := h.db.NewSampleIterator(nil, fraction)
+		defer iter.Release()
+		for iter.Next() {
+			key := string(iter.Key())
+			if want := "value" + key[3:]; string(iter.Value()) != want {
+				t.Fatalf("invalid value of key %q, want=%q got=%q", key, want, iter.Value())
+			}
+			if len(keys) > 0 && key <= keys[len(keys)-1] {
+				t.Fatalf("keys out of order: %q after %q", key, keys[len(keys)-1])
+			}
+			keys = append(keys, key)
+		}
+		// The same keys backward.
+		for n := len(keys) - 1; iter.Prev(); n-- {
+			if n < 0 || string(iter.Key()) != keys[n] {
+				t.Fatalf("invalid backward sample key %q", iter.Key())
+			}
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator error: ", err)
+		}
+		return keys, ioRead() - read
 	}
-	v.release()
 
-	for i := 0; i < n; i++ {
-		h.getVal(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), 100000/10))
+	all, fullRead := sample(1)
+	if len(all) != 6000 {
+		t.Errorf("invalid number of keys with fraction 1, want=6000 got=%d", len(all))
+	}
+	if keys, _ := sample(0); len(keys) != 0 {
+		t.Errorf("expect no keys with fraction 0, got %d", len(keys))
+	}
+	keys, read := sample(0.1)
+	if len(keys) < 200 || len(keys) > 1200 {
+		t.Errorf("invalid number of keys with fraction 0.1, got %d", len(keys))
+	}
+	if read >= fullRead/2 {
+		t.Errorf("sample read too much, got %d bytes read, full scan read %d", read, fullRead)
 	}
 }
 
-func TestDB_RepeatedWritesToSameKey(t *testing.T) {
-	h := newDbHarnessWopt(t, &opt.Options{DisableLargeBatchTransaction: true, WriteBuffer: 100000})
+func TestDB_CacheOnly(t *testing.T) {
+	h := newDbHarness(t)
 	defer h.close()
 
-	maxTables := h.o.GetWriteL0PauseTrigger() + 7
+	for i := 0; i < 10; i++ {
+		h.put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+	h.compactMem()
+	h.reopenDB()
+	h.put("mem", "value")
 
-	value := strings.Repeat("v", 2*h.o.GetWriteBuffer())
-	for i := 0; i < 5*maxTables; i++ {
-		h.put("key", value)
-		n := h.totalTables()
-		if n > maxTables {
-			t.Errorf("total tables exceed %d, got=%d, iter=%d", maxTables, n, i)
+	cacheOnly := &opt.ReadOptions{CacheOnly: true}
+	get := func(key string, ro *opt.ReadOptions, wantErr error) {
+		_, err := h.db.Get([]byte(key), ro)
+		if err != wantErr {
+			t.Fatalf("Get %q: got error %v, want %v", key, err, wantErr)
+		}
+	}
+	iterate := func(wantN int, wantErr error) {
+		iter := h.db.NewIterator(nil, cacheOnly)
+		defer iter.Release()
+		n := 0
+		for iter.Next() {
+			n++
+		}
+		if err := iter.Error(); err != wantErr || n != wantN {
+			t.Fatalf("iterator: got %d keys and error %v, want %d and %v", n, err, wantN, wantErr)
 		}
 	}
+
+	// Nothing of the table is cached.
+	get("mem", cacheOnly, nil)
+	get("key1", cacheOnly, ErrCacheMiss)
+	iterate(0, ErrCacheMiss)
+
+	// The table is opened, but the block isn't cached.
+	get("key1", &opt.ReadOptions{DontFillCache: true}, nil)
+	get("key1", cacheOnly, ErrCacheMiss)
+	iterate(0, ErrCacheMiss)
+
+	get("key1", nil, nil)
+	get("key1", cacheOnly, nil)
+	get("key9", cacheOnly, nil)
+	iterate(11, nil)
 }
 
-func TestDB_RepeatedWritesToSameKeyAfterReopen(t *testing.T) {
+func TestDB_GetTo(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
-		WriteBuffer:                  100000,
+		ValueLogThreshold:            100,
 	})
 	defer h.close()
 
-	h.reopenDB()
+	large := strings.Repeat("v", 200)
+	want := map[string]string{
+		"table":  "table-value",
+		"large":  large,
+		"level0": "level0-new",
+		"mem":    "mem-value",
+		"empty":  "",
+	}
+	h.put("table", "table-value")
+	h.put("large", large)
+	h.put("level0", "level0-old")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.put("level0", "level0-new")
+	h.compactMem()
+	h.put("mem", "mem-value")
+	h.put("empty", "")
 
-	maxTables := h.o.GetWriteL0PauseTrigger() + 7
+	buf := make([]byte, 0, 1024)
+	buf = append(buf, "prefix-"...)
+	for key, value := range want {
+		got, err := h.db.GetTo([]byte(key), buf, nil)
+		if err != nil {
+			t.Fatalf("GetTo %q: got error: %v", key, err)
+		}
+		if string(got) != "prefix-"+value {
+			t.Errorf("GetTo %q: got %q, want %q", key, got, "prefix-"+value)
+		}
+		if &got[0] != &buf[0] {
+			t.Errorf("GetTo %q: value not appended to the given buffer", key)
+		}
+	}
+	if _, err := h.db.GetTo([]byte("missing"), buf, nil); err != ErrNotFound {
+		t.Errorf("GetTo of missing key: got error %v, want %v", err, ErrNotFound)
+	}
+	if got, err := h.db.GetTo([]byte("empty"), nil, nil); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("GetTo of empty value to nil: got %q, error %v", got, err)
+	}
 
-	value := strings.Repeat("v", 2*h.o.GetWriteBuffer())
-	for i := 0; i < 5*maxTables; i++ {
-		h.put("key", value)
-		n := h.totalTables()
-		if n > maxTables {
-			t.Errorf("total tables exceed %d, got=%d, iter=%d", maxTables, n, i)
+	iter := h.db.NewIterator(nil, nil)
+	defer iter.Release()
+	va, ok := iter.(iterator.ValueAppender)
+	if !ok {
+		t.Fatal("iterator doesn't implement ValueAppender")
+	}
+	n := 0
+	for iter.Next() {
+		got := va.ValueTo(buf)
+		if value := want[string(iter.Key())]; string(got) != "prefix-"+value {
+			t.Errorf("ValueTo %q: got %q, want %q", iter.Key(), got, "prefix-"+value)
+		}
+		if &got[0] != &buf[0] {
+			t.Errorf("ValueTo %q: value not appended to the given buffer", iter.Key())
 		}
+		n++
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal("iterator error: ", err)
+	}
+	if n != len(want) {
+		t.Errorf("invalid number of iterated keys, want=%d got=%d", len(want), n)
+	}
+	if got := va.ValueTo(buf); len(got) != len(buf) {
+		t.Errorf("ValueTo at end: got %q, want %q", got, buf)
 	}
 }
 
-func TestDB_SparseMerge(t *testing.T) {
-	h := newDbHarnessWopt(t, &opt.Options{DisableLargeBatchTransaction: true, Compression: opt.NoCompression})
-	defer h.close()
-
-	h.putMulti(7, "A", "Z")
-
-	// Suppose there is:
-	//    small amount of data with prefix A
-	//    large amount of data with prefix B
-	//    small amount of data with prefix C
-	// and that recent updates have made small changes to all three prefixes.
-	// Check that we do not do a compaction that merges all of B in one shot.
-	h.put("A", "va")
-	value := strings.Repeat("x", 1000)
-	for i := 0; i < 100000; i++ {
-		h.put(fmt.Sprintf("B%010d", i), value)
+func TestDB_ReleaseValue(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		h := newDbHarnessWopt(t, &opt.Options{
+			DisableLargeBatchTransaction: true,
+			DisableBufferPool:            disable,
+			ValueLogThreshold:            100,
+		})
+
+		large := strings.Repeat("v", 200)
+		want := map[string]string{
+			"table":  "table-value",
+			"large":  large,
+			"level0": "level0-new",
+			"mem":    "mem-value",
+			"empty":  "",
+		}
+		h.put("table", "table-value")
+		h.put("large", large)
+		h.put("level0", "level0-old")
+		h.compactMem()
+		h.compactRangeAt(0, "", "")
+		h.put("level0", "level0-new")
+		h.compactMem()
+		h.put("mem", "mem-value")
+		h.put("empty", "")
+
+		// Released values are overwritten, which mustn't show through the
+		// values read afterward.
+		ro := &opt.ReadOptions{PoolValues: true}
+		for i := 0; i < 3; i++ {
+			for key, value := range want {
+				got, err := h.db.Get([]byte(key), ro)
+				if err != nil {
+					t.Fatalf("disable=%v: Get %q: got error: %v", disable, key, err)
+				}
+				if got == nil || string(got) != value {
+					t.Fatalf("disable=%v: Get %q: got %q, want %q", disable, key, got, value)
+				}
+				for j := range got {
+					got[j] = 'x'
+				}
+				h.db.ReleaseValue(got)
+			}
+			keys := [][]byte{[]byte("mem"), []byte("missing"), []byte("large"), []byte("table")}
+			values, errs := h.db.GetMany(keys, ro)
+			for j, key := range keys {
+				if string(key) == "missing" {
+					if errs[j] != ErrNotFound {
+						t.Fatalf("disable=%v: GetMany %q: got error %v, want %v", disable, key, errs[j], ErrNotFound)
+					}
+					continue
+				}
+				if errs[j] != nil || string(values[j]) != want[string(key)] {
+					t.Fatalf("disable=%v: GetMany %q: got %q, error %v", disable, key, values[j], errs[j])
+				}
+				h.db.ReleaseValue(values[j])
+			}
+		}
+		h.getVal("table", "table-value")
+		h.getVal("mem", "mem-value")
+		h.get("missing", false)
+
+		// Values of Get without PoolValues are of their own length, even
+		// once the pool holds large buffers.
+		for _, key := range []string{"table", "mem", "level0"} {
+			got, err := h.db.Get([]byte(key), nil)
+			if err != nil {
+				t.Fatalf("disable=%v: Get %q: got error: %v", disable, key, err)
+			}
+			if cap(got) > 2*len(got) {
+				t.Errorf("disable=%v: Get %q: got capacity %d for length %d", disable, key, cap(got), len(got))
+			}
+		}
+		h.close()
 	}
-	h.put("C", "vc")
-	h.compactMem()
-	h.compactRangeAt(0, "", "")
-	h.waitCompaction()
-
-	// Make sparse update
-	h.put("A", "va2")
-	h.put("B100", "bvalue2")
-	h.put("C", "vc2")
-	h.compactMem()
-
-	h.waitCompaction()
-	h.maxNextLevelOverlappingBytes(20 * 1048576)
-	h.compactRangeAt(0, "", "")
-	h.waitCompaction()
-	h.maxNextLevelOverlappingBytes(20 * 1048576)
-	h.compactRangeAt(1, "", "")
-	h.waitCompaction()
-	h.maxNextLevelOverlappingBytes(20 * 1048576)
 }
 
-func TestDB_SizeOf(t *testing.T) {
+func TestDB_GetWithMeta(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
-		Compression:                  opt.NoCompression,
-		WriteBuffer:                  10000000,
+		ValueLogThreshold:            100,
 	})
 	defer h.close()
 
-	h.sizeAssert("", "xyz", 0, 0)
-	h.reopenDB()
-	h.sizeAssert("", "xyz", 0, 0)
-
-	// Write 8MB (80 values, each 100K)
-	n := 80
-	s1 := 100000
-	s2 := 105000
-
-	for i := 0; i < n; i++ {
-		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), s1/10))
+	h.put("a", "v1")
+	h.put("a", "v2")
+	h.put("b", "v1")
+	h.delete("b")
+	h.put("c", "v1")
+	h.deleteRange("c", "d")
+	h.put("large", strings.Repeat("x", 200))
+
+	check := func(key, value string, want EntryMeta) {
+		v, meta, err := h.db.GetWithMeta([]byte(key), h.ro)
+		if value == "" {
+			if err != ErrNotFound {
+				t.Errorf("key %q: got error %v, want ErrNotFound", key, err)
+			}
+		} else if err != nil || string(v) != value {
+			t.Errorf("key %q: got (%q, %v), want %q", key, v, err, value)
+		}
+		if meta != want {
+			t.Errorf("key %q: got meta %+v, want %+v", key, meta, want)
+		}
+	}
+	checkAll := func(large EntryType) {
+		check("a", "v2", EntryMeta{Seq: 2, Type: EntryValue})
+		check("b", "", EntryMeta{Seq: 4, Type: EntryDeletion})
+		check("c", "", EntryMeta{Seq: 6, Type: EntryRangeDeletion})
+		check("large", strings.Repeat("x", 200), EntryMeta{Seq: 7, Type: large})
+		check("missing", "", EntryMeta{})
 	}
+	checkAll(EntryValue)
+	h.compactMem()
+	checkAll(EntryValueLog)
 
-	// 0 because SizeOf() does not account for memtable space
-	h.sizeAssert("", numKey(50), 0, 0)
+	iter := h.db.NewIterator(nil, h.ro)
+	defer iter.Release()
+	var got []uint64
+	for iter.Next() {
+		got = append(got, iter.(iterator.Sequencer).Seq())
+	}
+	if want := []uint64{2, 7}; !reflect.DeepEqual(got, want) {
+		t.Errorf("iterator sequence numbers: got %v, want %v", got, want)
+	}
+	if seq := iter.(iterator.Sequencer).Seq(); seq != 0 {
+		t.Errorf("exhausted iterator sequence number: got %d, want 0", seq)
+	}
+}
 
-	for r := 0; r < 3; r++ {
-		h.reopenDB()
+func TestDB_IterBounds(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		for _, k := range []string{"a", "b", "c", "d", "e"} {
+			h.put(k, "v"+k)
+		}
 
-		for cs := 0; cs < n; cs += 10 {
-			for i := 0; i < n; i += 10 {
-				h.sizeAssert("", numKey(i), int64(s1*i), int64(s2*i))
-				h.sizeAssert("", numKey(i)+".suffix", int64(s1*(i+1)), int64(s2*(i+1)))
-				h.sizeAssert(numKey(i), numKey(i+10), int64(s1*10), int64(s2*10))
+		test := func(slice *util.Range, ro *opt.ReadOptions, want string) {
+			iter := h.db.NewIterator(slice, ro)
+			var got []string
+			for iter.Next() {
+				got = append(got, string(iter.Key()))
+			}
+			if err := iter.Error(); err != nil {
+				t.Error("iterator error: ", err)
+			}
+			iter.Release()
+			if strings.Join(got, ",") != want {
+				t.Errorf("invalid keys: slice=%v ro=%v want=%q got=%q", slice, ro, want, got)
 			}
-
-			h.sizeAssert("", numKey(50), int64(s1*50), int64(s2*50))
-			h.sizeAssert("", numKey(50)+".suffix", int64(s1*50), int64(s2*50))
-
-			h.compactRangeAt(0, numKey(cs), numKey(cs+9))
 		}
 
-		v := h.db.s.version()
-		if v.tLen(0) != 0 {
-			t.Errorf("level-0 tables was not zero, got %d", v.tLen(0))
-		}
-		if v.tLen(1) == 0 {
-			t.Error("level-1 tables was zero")
-		}
-		v.release()
-	}
+		test(nil, &opt.ReadOptions{LowerBound: []byte("b")}, "b,c,d,e")
+		test(nil, &opt.ReadOptions{UpperBound: []byte("d")}, "a,b,c")
+		test(nil, &opt.ReadOptions{LowerBound: []byte("b"), UpperBound: []byte("d")}, "b,c")
+		test(&util.Range{Start: []byte("c")}, &opt.ReadOptions{LowerBound: []byte("b"), UpperBound: []byte("e")}, "c,d")
+		test(&util.Range{Limit: []byte("c")}, &opt.ReadOptions{UpperBound: []byte("e")}, "a,b")
+		test(&util.Range{Start: []byte("d")}, &opt.ReadOptions{UpperBound: []byte("b")}, "")
+	})
 }
 
-func TestDB_SizeOf_MixOfSmallAndLarge(t *testing.T) {
+func TestDB_IterPrefix(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
-		Compression:                  opt.NoCompression,
+		Filter:                       filter.NewBloomFilter(10),
+		Prefixer:                     comparer.NewFixedPrefixer(3),
 	})
 	defer h.close()
 
-	sizes := []int64{
-		10000,
-		10000,
-		100000,
-		10000,
-		100000,
-		10000,
-		300000,
-		10000,
+	for _, p := range []string{"aaa", "bbb", "ddd"} {
+		for i := 0; i < 3; i++ {
+			h.put(fmt.Sprintf("%s%d", p, i), "v")
+		}
+		if p != "ddd" {
+			h.compactMem()
+		}
 	}
 
-	for i, n := range sizes {
-		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), int(n)/10))
+	test := func(prefix, want string) {
+		iter := h.db.NewIterator(nil, &opt.ReadOptions{Prefix: []byte(prefix)})
+		var got []string
+		for iter.Next() {
+			got = append(got, string(iter.Key()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Error("iterator error: ", err)
+		}
+		iter.Release()
+		if strings.Join(got, ",") != want {
+			t.Errorf("invalid keys: prefix=%q want=%q got=%q", prefix, want, got)
+		}
 	}
 
-	for r := 0; r < 3; r++ {
-		h.reopenDB()
+	test("aaa", "aaa0,aaa1,aaa2")
+	test("bbb", "bbb0,bbb1,bbb2")
+	test("ccc", "")
+	test("ddd", "ddd0,ddd1,ddd2")
+	test("bb", "bbb0,bbb1,bbb2")
+	test("bbb1", "bbb1")
+}
 
-		var x int64
-		for i, n := range sizes {
-			y := x
-			if i > 0 {
-				y += 1000
-			}
-			h.sizeAssert("", numKey(i), x, y)
-			x += n
-		}
+func TestDB_IteratorPinsRef(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
 
-		h.sizeAssert(numKey(3), numKey(5), 110000, 111000)
+	h.put("foo", "hello")
 
-		h.compactRangeAt(0, "", "")
+	// Get iterator that will yield the current contents of the DB.
+	iter := h.db.NewIterator(nil, nil)
+
+	// Write to force compactions
+	h.put("foo", "newvalue1")
+	for i := 0; i < 100; i++ {
+		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), 100000/10))
 	}
+	h.put("foo", "newvalue2")
+
+	iter.First()
+	testKeyVal(t, iter, "foo->hello")
+	if iter.Next() {
+		t.Errorf("expect eof")
+	}
+	iter.Release()
 }
 
-func TestDB_Snapshot(t *testing.T) {
+func TestDB_Recover(t *testing.T) {
 	trun(t, func(h *dbHarness) {
 		h.put("foo", "v1")
-		s1 := h.getSnapshot()
-		h.put("foo", "v2")
-		s2 := h.getSnapshot()
-		h.put("foo", "v3")
-		s3 := h.getSnapshot()
-		h.put("foo", "v4")
+		h.put("baz", "v5")
 
-		h.getValr(s1, "foo", "v1")
-		h.getValr(s2, "foo", "v2")
-		h.getValr(s3, "foo", "v3")
-		h.getVal("foo", "v4")
+		h.reopenDB()
+		h.getVal("foo", "v1")
 
-		s3.Release()
-		h.getValr(s1, "foo", "v1")
-		h.getValr(s2, "foo", "v2")
-		h.getVal("foo", "v4")
+		h.getVal("foo", "v1")
+		h.getVal("baz", "v5")
+		h.put("bar", "v2")
+		h.put("foo", "v3")
 
-		s1.Release()
-		h.getValr(s2, "foo", "v2")
+		h.reopenDB()
+		h.getVal("foo", "v3")
+		h.put("foo", "v4")
 		h.getVal("foo", "v4")
+		h.getVal("bar", "v2")
+		h.getVal("baz", "v5")
+	})
+}
 
-		s2.Release()
-		h.getVal("foo", "v4")
+func TestDB_RecoverWithEmptyJournal(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		h.put("foo", "v1")
+		h.put("foo", "v2")
+
+		h.reopenDB()
+		h.reopenDB()
+		h.put("foo", "v3")
+
+		h.reopenDB()
+		h.getVal("foo", "v3")
 	})
 }
 
-func TestDB_SnapshotList(t *testing.T) {
-	db := &DB{snapsList: list.New()}
-	e0a := db.acquireSnapshot()
-	e0b := db.acquireSnapshot()
-	db.seq = 1
-	e1 := db.acquireSnapshot()
-	db.seq = 2
-	e2 := db.acquireSnapshot()
+func TestDB_RecoverDuringMemtableCompaction(t *testing.T) {
+	truno(t, &opt.Options{DisableLargeBatchTransaction: true, WriteBuffer: 1000000}, func(h *dbHarness) {
 
-	if db.minSeq() != 0 {
-		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+		h.stor.Stall(testutil.ModeSync, storage.TypeTable)
+		h.put("big1", strings.Repeat("x", 10000000))
+		h.put("big2", strings.Repeat("y", 1000))
+		h.put("bar", "v2")
+		h.stor.Release(testutil.ModeSync, storage.TypeTable)
+
+		h.reopenDB()
+		h.getVal("bar", "v2")
+		h.getVal("big1", strings.Repeat("x", 10000000))
+		h.getVal("big2", strings.Repeat("y", 1000))
+	})
+}
+
+func TestDB_MinorCompactionsHappen(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{DisableLargeBatchTransaction: true, WriteBuffer: 10000})
+	defer h.close()
+
+	n := 500
+
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
 	}
-	db.releaseSnapshot(e0a)
-	if db.minSeq() != 0 {
-		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+
+	for i := 0; i < n; i++ {
+		h.put(key(i), key(i)+strings.Repeat("v", 1000))
 	}
-	db.releaseSnapshot(e2)
-	if db.minSeq() != 0 {
-		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+
+	for i := 0; i < n; i++ {
+		h.getVal(key(i), key(i)+strings.Repeat("v", 1000))
 	}
-	db.releaseSnapshot(e0b)
-	if db.minSeq() != 1 {
-		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+
+	h.reopenDB()
+	for i := 0; i < n; i++ {
+		h.getVal(key(i), key(i)+strings.Repeat("v", 1000))
 	}
-	e2 = db.acquireSnapshot()
-	if db.minSeq() != 1 {
-		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+}
+
+func TestDB_RecoverWithLargeJournal(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("big1", strings.Repeat("1", 200000))
+	h.put("big2", strings.Repeat("2", 200000))
+	h.put("small3", strings.Repeat("3", 10))
+	h.put("small4", strings.Repeat("4", 10))
+	h.tablesPerLevel("")
+
+	// Make sure that if we re-open with a small write buffer size that
+	// we flush table files in the middle of a large journal file.
+	h.o.WriteBuffer = 100000
+	h.reopenDB()
+	h.getVal("big1", strings.Repeat("1", 200000))
+	h.getVal("big2", strings.Repeat("2", 200000))
+	h.getVal("small3", strings.Repeat("3", 10))
+	h.getVal("small4", strings.Repeat("4", 10))
+	v := h.db.s.version()
+	if v.tLen(0) <= 1 {
+		t.Errorf("tables-0 less than one")
 	}
-	db.releaseSnapshot(e1)
-	if db.minSeq() != 2 {
-		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+	v.release()
+}
+
+func TestDB_CompactionsGenerateMultipleFiles(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteBuffer:                  10000000,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	v := h.db.s.version()
+	if v.tLen(0) > 0 {
+		t.Errorf("level-0 tables more than 0, got %d", v.tLen(0))
+	}
+	v.release()
+
+	n := 80
+
+	// Write 8MB (80 values, each 100K)
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), 100000/10))
+	}
+
+	// Reopening moves updates to level-0
+	h.reopenDB()
+	h.compactRangeAt(0, "", "")
+
+	v = h.db.s.version()
+	if v.tLen(0) > 0 {
+		t.Errorf("level-0 tables more than 0, got %d", v.tLen(0))
+	}
+	if v.tLen(1) <= 1 {
+		t.Errorf("level-1 tables less than 1, got %d", v.tLen(1))
+	}
+	v.release()
+
+	for i := 0; i < n; i++ {
+		h.getVal(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), 100000/10))
+	}
+}
+
+func TestDB_RepeatedWritesToSameKey(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{DisableLargeBatchTransaction: true, WriteBuffer: 100000})
+	defer h.close()
+
+	maxTables := h.o.GetWriteL0PauseTrigger() + 7
+
+	value := strings.Repeat("v", 2*h.o.GetWriteBuffer())
+	for i := 0; i < 5*maxTables; i++ {
+		h.put("key", value)
+		n := h.totalTables()
+		if n > maxTables {
+			t.Errorf("total tables exceed %d, got=%d, iter=%d", maxTables, n, i)
+		}
+	}
+}
+
+func TestDB_RepeatedWritesToSameKeyAfterReopen(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteBuffer:                  100000,
+	})
+	defer h.close()
+
+	h.reopenDB()
+
+	maxTables := h.o.GetWriteL0PauseTrigger() + 7
+
+	value := strings.Repeat("v", 2*h.o.GetWriteBuffer())
+	for i := 0; i < 5*maxTables; i++ {
+		h.put("key", value)
+		n := h.totalTables()
+		if n > maxTables {
+			t.Errorf("total tables exceed %d, got=%d, iter=%d", maxTables, n, i)
+		}
+	}
+}
+
+func TestDB_SparseMerge(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{DisableLargeBatchTransaction: true, Compression: opt.NoCompression})
+	defer h.close()
+
+	h.putMulti(7, "A", "Z")
+
+	// Suppose there is:
+	//    small amount of data with prefix A
+	//    large amount of data with prefix B
+	//    small amount of data with prefix C
+	// and that recent updates have made small changes to all three prefixes.
+	// Check that we do not do a compaction that merges all of B in one shot.
+	h.put("A", "va")
+	value := strings.Repeat("x", 1000)
+	for i := 0; i < 100000; i++ {
+		h.put(fmt.Sprintf("B%010d", i), value)
+	}
+	h.put("C", "vc")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.waitCompaction()
+
+	// Make sparse update
+	h.put("A", "va2")
+	h.put("B100", "bvalue2")
+	h.put("C", "vc2")
+	h.compactMem()
+
+	h.waitCompaction()
+	h.maxNextLevelOverlappingBytes(20 * 1048576)
+	h.compactRangeAt(0, "", "")
+	h.waitCompaction()
+	h.maxNextLevelOverlappingBytes(20 * 1048576)
+	h.compactRangeAt(1, "", "")
+	h.waitCompaction()
+	h.maxNextLevelOverlappingBytes(20 * 1048576)
+}
+
+func TestDB_SizeOf(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		WriteBuffer:                  10000000,
+	})
+	defer h.close()
+
+	h.sizeAssert("", "xyz", 0, 0)
+	h.reopenDB()
+	h.sizeAssert("", "xyz", 0, 0)
+
+	// Write 8MB (80 values, each 100K)
+	n := 80
+	s1 := 100000
+	s2 := 105000
+
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), s1/10))
+	}
+
+	// 0 because SizeOf() does not account for memtable space
+	h.sizeAssert("", numKey(50), 0, 0)
+
+	for r := 0; r < 3; r++ {
+		h.reopenDB()
+
+		for cs := 0; cs < n; cs += 10 {
+			for i := 0; i < n; i += 10 {
+				h.sizeAssert("", numKey(i), int64(s1*i), int64(s2*i))
+				h.sizeAssert("", numKey(i)+".suffix", int64(s1*(i+1)), int64(s2*(i+1)))
+				h.sizeAssert(numKey(i), numKey(i+10), int64(s1*10), int64(s2*10))
+			}
+
+			h.sizeAssert("", numKey(50), int64(s1*50), int64(s2*50))
+			h.sizeAssert("", numKey(50)+".suffix", int64(s1*50), int64(s2*50))
+
+			h.compactRangeAt(0, numKey(cs), numKey(cs+9))
+		}
+
+		v := h.db.s.version()
+		if v.tLen(0) != 0 {
+			t.Errorf("level-0 tables was not zero, got %d", v.tLen(0))
+		}
+		if v.tLen(1) == 0 {
+			t.Error("level-1 tables was zero")
+		}
+		v.release()
+	}
+}
+
+func TestDB_SizeOf_MixOfSmallAndLarge(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	sizes := []int64{
+		10000,
+		10000,
+		100000,
+		10000,
+		100000,
+		10000,
+		300000,
+		10000,
+	}
+
+	for i, n := range sizes {
+		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), int(n)/10))
+	}
+
+	for r := 0; r < 3; r++ {
+		h.reopenDB()
+
+		var x int64
+		for i, n := range sizes {
+			y := x
+			if i > 0 {
+				y += 1000
+			}
+			h.sizeAssert("", numKey(i), x, y)
+			x += n
+		}
+
+		h.sizeAssert(numKey(3), numKey(5), 110000, 111000)
+
+		h.compactRangeAt(0, "", "")
+	}
+}
+
+func TestDB_RangeSizes(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		WriteBuffer:                  10000000,
+	})
+	defer h.close()
+
+	rangeSize := func(start, limit string) RangeSize {
+		sizes, err := h.db.RangeSizes([]util.Range{{Start: []byte(start), Limit: []byte(limit)}})
+		if err != nil {
+			t.Fatal("RangeSizes: got error: ", err)
+		}
+		return sizes[0]
+	}
+	numKeys := func(min, max int64) {
+		n, err := h.db.EstimateNumKeys()
+		if err != nil {
+			t.Fatal("EstimateNumKeys: got error: ", err)
+		}
+		if n < min || n > max {
+			t.Errorf("EstimateNumKeys: got %d, want [%d, %d]", n, min, max)
+		}
+	}
+
+	n := 1000
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), strings.Repeat("v", 1000))
+	}
+
+	// Not flushed yet.
+	s := rangeSize(numKey(100), numKey(200))
+	if s.TableSize != 0 || s.MemTableSize < 100*1000 || s.MemTableSize > 100*1100 || s.Entries != 100 {
+		t.Errorf("before flush: invalid range size %+v", s)
+	}
+	numKeys(int64(n), int64(n))
+
+	h.compactMem()
+	s = rangeSize(numKey(100), numKey(200))
+	if s.MemTableSize != 0 || s.TableSize < 100*1000 || s.TableSize > 100*1100 || s.Entries < 90 || s.Entries > 110 {
+		t.Errorf("after flush: invalid range size %+v", s)
+	}
+	numKeys(int64(n), int64(n))
+
+	// Overwrites are counted until compacted.
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), strings.Repeat("x", 1000))
+	}
+	s = rangeSize(numKey(100), numKey(200))
+	if s.Entries < 190 || s.Entries > 210 {
+		t.Errorf("after overwrite: invalid range size %+v", s)
+	}
+	numKeys(int64(2*n), int64(2*n))
+
+	h.compactMem()
+	h.compactRange("", "")
+	s = rangeSize(numKey(100), numKey(200))
+	if s.MemTableSize != 0 || s.Entries < 90 || s.Entries > 110 {
+		t.Errorf("after compaction: invalid range size %+v", s)
+	}
+	numKeys(int64(n), int64(n))
+
+	if s := rangeSize(numKey(200), numKey(100)); s != (RangeSize{}) {
+		t.Errorf("empty range: invalid range size %+v", s)
+	}
+
+	h.reopenDB()
+	numKeys(int64(n), int64(n))
+}
+
+func TestDB_SizeOfPrefix(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	for _, prefix := range []string{"a", "b", "\xff"} {
+		for i := 0; i < 100; i++ {
+			h.put(prefix+numKey(i), strings.Repeat("v", 1000))
+		}
+	}
+	h.compactMem()
+
+	ranges := []util.Range{
+		*util.BytesPrefix([]byte("a")),
+		*util.BytesPrefix([]byte("b")),
+		*util.BytesPrefix([]byte("\xff")),
+		{Start: []byte("b")},
+		{},
+		{Start: []byte("b"), Limit: []byte("a")},
+	}
+	want := []int64{100, 100, 100, 200, 300, 0}
+	sizes, err := h.db.SizeOf(ranges)
+	if err != nil {
+		t.Fatal("SizeOf: got error: ", err)
+	}
+	rsizes, err := h.db.RangeSizes(ranges)
+	if err != nil {
+		t.Fatal("RangeSizes: got error: ", err)
+	}
+	// Offsets within a table are approximated to the blocks.
+	for i, n := range want {
+		if sizes[i] < n*900 || sizes[i] > n*1100 {
+			t.Errorf("SizeOf %q: got %d, want about %d", ranges[i], sizes[i], n*1000)
+		}
+		if s := rsizes[i]; s.TableSize != sizes[i] || s.Entries < n*9/10 || s.Entries > n*11/10 {
+			t.Errorf("RangeSizes %q: got %+v, want about %d entries", ranges[i], s, n)
+		}
+	}
+}
+
+type testPrefixCounter struct {
+	counts map[string]int
+}
+
+func (c *testPrefixCounter) Add(key, value []byte) {
+	c.counts["count."+string(key[:1])]++
+}
+
+func (c *testPrefixCounter) Finish() map[string][]byte {
+	props := make(map[string][]byte)
+	for name, n := range c.counts {
+		props[name] = []byte(strconv.Itoa(n))
+	}
+	return props
+}
+
+func TestDB_TablePropertiesCollector(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		TablePropertiesCollectors: []func() opt.TablePropertiesCollector{
+			func() opt.TablePropertiesCollector {
+				return &testPrefixCounter{counts: make(map[string]int)}
+			},
+		},
+	})
+	defer h.close()
+
+	counts := func() map[string]int {
+		v := h.db.s.version()
+		defer v.release()
+		counts := make(map[string]int)
+		for _, tables := range v.levels {
+			for _, t0 := range tables {
+				ch, err := h.db.s.tops.open(t0)
+				if err != nil {
+					t.Fatal("open table: ", err)
+				}
+				props := ch.Value().(*table.Reader).Properties()
+				if props == nil {
+					t.Fatalf("table @%d has no properties", t0.fd.Num)
+				}
+				for name, value := range props.User {
+					n, err := strconv.Atoi(string(value))
+					if err != nil {
+						t.Fatalf("table @%d: invalid %q property: %q", t0.fd.Num, name, value)
+					}
+					counts[name] += n
+				}
+				ch.Release()
+			}
+		}
+		return counts
+	}
+
+	for i := 0; i < 100; i++ {
+		h.put(fmt.Sprintf("a%03d", i), "v")
+	}
+	for i := 0; i < 50; i++ {
+		h.put(fmt.Sprintf("b%03d", i), "v")
+	}
+	for i := 0; i < 10; i++ {
+		h.delete(fmt.Sprintf("a%03d", i))
+	}
+	h.compactMem()
+	if got, want := counts(), map[string]int{"count.a": 100, "count.b": 50}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after flush: got %v, want %v", got, want)
+	}
+
+	h.compactRange("", "")
+	if got, want := counts(), map[string]int{"count.a": 90, "count.b": 50}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after compaction: got %v, want %v", got, want)
+	}
+}
+
+func TestDB_Snapshot(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		h.put("foo", "v1")
+		s1 := h.getSnapshot()
+		h.put("foo", "v2")
+		s2 := h.getSnapshot()
+		h.put("foo", "v3")
+		s3 := h.getSnapshot()
+		h.put("foo", "v4")
+
+		h.getValr(s1, "foo", "v1")
+		h.getValr(s2, "foo", "v2")
+		h.getValr(s3, "foo", "v3")
+		h.getVal("foo", "v4")
+
+		s3.Release()
+		h.getValr(s1, "foo", "v1")
+		h.getValr(s2, "foo", "v2")
+		h.getVal("foo", "v4")
+
+		s1.Release()
+		h.getValr(s2, "foo", "v2")
+		h.getVal("foo", "v4")
+
+		s2.Release()
+		h.getVal("foo", "v4")
+	})
+}
+
+func TestDB_SnapshotList(t *testing.T) {
+	db := &DB{snapsList: list.New()}
+	e0a := db.acquireSnapshot()
+	e0b := db.acquireSnapshot()
+	db.seq = 1
+	e1 := db.acquireSnapshot()
+	db.seq = 2
+	e2 := db.acquireSnapshot()
+
+	if db.minSeq() != 0 {
+		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+	}
+	db.releaseSnapshot(e0a)
+	if db.minSeq() != 0 {
+		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+	}
+	db.releaseSnapshot(e2)
+	if db.minSeq() != 0 {
+		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+	}
+	db.releaseSnapshot(e0b)
+	if db.minSeq() != 1 {
+		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+	}
+	e2 = db.acquireSnapshot()
+	if db.minSeq() != 1 {
+		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+	}
+	db.releaseSnapshot(e1)
+	if db.minSeq() != 2 {
+		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+	}
+	db.releaseSnapshot(e2)
+	if db.minSeq() != 2 {
+		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+	}
+}
+
+func TestDB_NamedSnapshot(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	snap, err := h.db.CreateNamedSnapshot("export")
+	if err != nil {
+		t.Fatal("CreateNamedSnapshot: got error: ", err)
+	}
+	h.put("foo", "v2")
+	h.getValr(snap, "foo", "v1")
+	snap.Release()
+	if _, err := h.db.CreateNamedSnapshot("export"); err != ErrSnapshotExist {
+		t.Fatalf("CreateNamedSnapshot: expecting ErrSnapshotExist, got %v", err)
+	}
+
+	h.reopenDB()
+	if names := h.db.NamedSnapshots(); len(names) != 1 || names[0] != "export" {
+		t.Fatalf("invalid named snapshots, got=%v", names)
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	h.allEntriesFor("foo", "[ v2, v1 ]")
+	snap, err = h.db.GetNamedSnapshot("export")
+	if err != nil {
+		t.Fatal("GetNamedSnapshot: got error: ", err)
+	}
+	h.getValr(snap, "foo", "v1")
+	h.getVal("foo", "v2")
+	snap.Release()
+
+	h.reopenDB()
+	if err := h.db.ReleaseNamedSnapshot("export"); err != nil {
+		t.Fatal("ReleaseNamedSnapshot: got error: ", err)
+	}
+	if _, err := h.db.GetNamedSnapshot("export"); err != ErrNotFound {
+		t.Fatalf("GetNamedSnapshot: expecting ErrNotFound, got %v", err)
+	}
+	h.put("foo", "v3")
+	h.compactMem()
+	h.compactRange("", "")
+	h.allEntriesFor("foo", "[ v3 ]")
+
+	h.reopenDB()
+	if names := h.db.NamedSnapshots(); len(names) != 0 {
+		t.Fatalf("invalid named snapshots, got=%v", names)
+	}
+}
+
+func TestDB_DiffIterator(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		h.put(k, "v1")
+	}
+	s1 := h.getSnapshot()
+	defer s1.Release()
+	h.put("a", "v2")
+	h.delete("b")
+	h.put("c", "v1")
+	h.deleteRange("d", "e")
+	h.put("f", "v1")
+	h.put("g", "v1")
+	h.delete("g")
+	s2 := h.getSnapshot()
+	defer s2.Release()
+	h.put("a", "v3")
+	h.put("h", "v1")
+
+	diff := func(from, to *Snapshot) string {
+		iter := h.db.NewDiffIterator(from, to, nil, nil)
+		defer iter.Release()
+		var fwd, bwd []string
+		kv := func() string {
+			if iter.Deleted() {
+				return string(iter.Key()) + "=DEL"
+			}
+			return string(iter.Key()) + "=" + string(iter.Value())
+		}
+		for iter.Next() {
+			fwd = append(fwd, kv())
+		}
+		for iter.Prev() {
+			bwd = append([]string{kv()}, bwd...)
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("DiffIterator: got error: ", err)
+		}
+		if f, b := strings.Join(fwd, " "), strings.Join(bwd, " "); f != b {
+			t.Errorf("DiffIterator: backward iteration mismatch, forward=%q backward=%q", f, b)
+		}
+		var want, got string
+		for _, x := range fwd {
+			if x >= "c" {
+				want = x
+				break
+			}
+		}
+		if iter.Seek([]byte("c")) {
+			got = kv()
+		}
+		if got != want {
+			t.Errorf("DiffIterator: invalid seek result, want=%q got=%q", want, got)
+		}
+		want, got = "", ""
+		for _, x := range fwd {
+			if x < "d" {
+				want = x
+			}
+		}
+		if iter.SeekLE([]byte("c")) {
+			got = kv()
+		}
+		if got != want {
+			t.Errorf("DiffIterator: invalid seek-le result, want=%q got=%q", want, got)
+		}
+		return strings.Join(fwd, " ")
+	}
+	test := func() {
+		if got, want := diff(s1, s2), "a=v2 b=DEL c=v1 d=DEL f=v1"; got != want {
+			t.Errorf("invalid diff, want=%q got=%q", want, got)
+		}
+		if got, want := diff(nil, s1), "a=v1 b=v1 c=v1 d=v1 e=v1"; got != want {
+			t.Errorf("invalid diff, want=%q got=%q", want, got)
+		}
+		if got, want := diff(s2, nil), "a=v3 h=v1"; got != want {
+			t.Errorf("invalid diff, want=%q got=%q", want, got)
+		}
+	}
+	test()
+	h.compactMem()
+	h.compactRange("", "")
+	test()
+}
+
+func TestDB_GetUpdatesSince(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestGetUpdatesSince-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	collect := func(db *DB, seq uint64) (seqs []uint64, recs []string) {
+		iter, err := db.GetUpdatesSince(seq)
+		if err != nil {
+			t.Fatalf("GetUpdatesSince(%d): got error: %v", seq, err)
+		}
+		defer iter.Release()
+		for iter.Next() {
+			seqs = append(seqs, iter.Seq())
+			iter.Batch().replayInternal(func(i int, kt keyType, key, value []byte) error {
+				recs = append(recs, fmt.Sprintf("%d:%s=%s", kt, key, value))
+				return nil
+			})
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatalf("GetUpdatesSince(%d): iterator error: %v", seq, err)
+		}
+		return
+	}
+
+	db, err := OpenFile(dbpath, &opt.Options{JournalRetentionSize: opt.MiB})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer func() { db.Close() }()
+	db.Put([]byte("a"), []byte("v1"), nil)
+	b := new(Batch)
+	b.Put([]byte("b"), []byte("v2"))
+	b.Delete([]byte("a"))
+	db.Write(b, nil)
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	db.Put([]byte("c"), []byte("v3"), nil)
+
+	seqs, recs := collect(db, 0)
+	if want := []uint64{1, 2, 4}; !reflect.DeepEqual(seqs, want) {
+		t.Errorf("invalid seqs, want=%v got=%v", want, seqs)
+	}
+	if want := []string{"1:a=v1", "1:b=v2", "0:a=", "1:c=v3"}; !reflect.DeepEqual(recs, want) {
+		t.Errorf("invalid records, want=%v got=%v", want, recs)
+	}
+	// Seq 3 is within the second batch.
+	if seqs, _ := collect(db, 3); !reflect.DeepEqual(seqs, []uint64{2, 4}) {
+		t.Errorf("invalid seqs since 3, got=%v", seqs)
+	}
+	if seqs, _ := collect(db, 5); len(seqs) != 0 {
+		t.Errorf("expect no update since 5, got=%v", seqs)
+	}
+
+	// Retained journals survive restart.
+	db.Close()
+	db, err = OpenFile(dbpath, &opt.Options{JournalRetentionSize: opt.MiB})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	if seqs, _ := collect(db, 1); !reflect.DeepEqual(seqs, []uint64{1, 2, 4}) {
+		t.Errorf("invalid seqs after reopen, got=%v", seqs)
+	}
+
+	// Without retention the flushed journals are removed.
+	db.Close()
+	db, err = OpenFile(dbpath, nil)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	db.Put([]byte("d"), []byte("v4"), nil)
+	if _, err := db.GetUpdatesSince(1); err != ErrUpdatesUnavailable {
+		t.Errorf("GetUpdatesSince(1): expect ErrUpdatesUnavailable, got %v", err)
+	}
+	// Sequence number 5 is skipped on recovery.
+	if seqs, _ := collect(db, 6); !reflect.DeepEqual(seqs, []uint64{6}) {
+		t.Errorf("invalid seqs since 6, got=%v", seqs)
+	}
+}
+
+func TestDB_JournalArchive(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestJournalArchive-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	archived := func() (names []string) {
+		fis, err := ioutil.ReadDir(filepath.Join(dbpath, storage.ArchiveDir))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal("ReadDir: got error: ", err)
+		}
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		return
+	}
+
+	o := &opt.Options{JournalArchive: true}
+	db, err := OpenFile(dbpath, o)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer func() { db.Close() }()
+	db.Put([]byte("a"), []byte("v1"), nil)
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	if names := archived(); len(names) != 1 {
+		t.Fatalf("expect one archived journal, got=%v", names)
+	}
+
+	// Retained journals are archived once expired.
+	db.Close()
+	o.JournalRetentionTime = time.Hour
+	db, err = OpenFile(dbpath, o)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	db.Put([]byte("b"), []byte("v2"), nil)
+	if err := db.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	if names := archived(); len(names) != 1 {
+		t.Fatalf("expect journals retained, got archived=%v", names)
+	}
+	db.jretainMu.Lock()
+	for i := range db.jretained {
+		db.jretained[i].time = db.jretained[i].time.Add(-2 * time.Hour)
+	}
+	db.jretainMu.Unlock()
+	db.purgeJournals()
+	if names := archived(); len(names) != 3 {
+		t.Fatalf("expect three archived journals, got=%v", names)
+	}
+	if _, err := db.GetUpdatesSince(1); err != ErrUpdatesUnavailable {
+		t.Errorf("GetUpdatesSince(1): expect ErrUpdatesUnavailable, got %v", err)
+	}
+	if v, err := db.Get([]byte("a"), nil); err != nil || string(v) != "v1" {
+		t.Errorf("Get: got value=%q err=%v", v, err)
+	}
+}
+
+func TestDB_ApplyReplicated(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestApplyReplicated-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	leader, err := OpenFile(dbpath, &opt.Options{JournalRetentionSize: opt.MiB})
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer leader.Close()
+	follower, err := Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	defer follower.Close()
+
+	replicate := func(since uint64) uint64 {
+		iter, err := leader.GetUpdatesSince(since)
+		if err != nil {
+			t.Fatalf("GetUpdatesSince(%d): got error: %v", since, err)
+		}
+		defer iter.Release()
+		for iter.Next() {
+			if err := follower.ApplyReplicated(iter.Batch(), iter.Seq(), nil); err != nil {
+				t.Fatalf("ApplyReplicated(%d): got error: %v", iter.Seq(), err)
+			}
+			since = iter.Seq() + uint64(iter.Batch().Len())
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator error: ", err)
+		}
+		return since
+	}
+
+	leader.Put([]byte("a"), []byte("v1"), nil)
+	b := new(Batch)
+	b.Put([]byte("b"), []byte("v2"))
+	b.Put([]byte("c"), []byte("v3"))
+	leader.Write(b, nil)
+	snap, _ := leader.GetSnapshot()
+	defer snap.Release()
+	next := replicate(0)
+	fsnap, _ := follower.GetSnapshot()
+	defer fsnap.Release()
+	leader.Delete([]byte("a"), nil)
+	leader.Put([]byte("b"), []byte("v4"), nil)
+	next = replicate(next)
+	if next != 6 || follower.getSeq() != 5 || follower.getSeq() != leader.getSeq() {
+		t.Fatalf("invalid seqs: next=%d follower=%d leader=%d", next, follower.getSeq(), leader.getSeq())
+	}
+
+	// Snapshots at the same sequence number see the same state.
+	if snap.elem.seq != fsnap.elem.seq {
+		t.Fatalf("invalid snapshot seqs: leader=%d follower=%d", snap.elem.seq, fsnap.elem.seq)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		lv, lerr := snap.Get([]byte(k), nil)
+		fv, ferr := fsnap.Get([]byte(k), nil)
+		if string(lv) != string(fv) || lerr != ferr {
+			t.Errorf("key %q: leader=%q,%v follower=%q,%v", k, lv, lerr, fv, ferr)
+		}
+	}
+	if v, err := follower.Get([]byte("b"), nil); err != nil || string(v) != "v4" {
+		t.Errorf("Get: got value=%q err=%v", v, err)
+	}
+
+	// Replaying an already applied batch fails.
+	b.Reset()
+	b.Put([]byte("d"), []byte("v5"))
+	if err := follower.ApplyReplicated(b, 5, nil); err != ErrSeqOutOfOrder {
+		t.Errorf("ApplyReplicated(5): expect ErrSeqOutOfOrder, got %v", err)
+	}
+	// Gaps are allowed.
+	if err := follower.ApplyReplicated(b, 10, nil); err != nil {
+		t.Errorf("ApplyReplicated(10): got error: %v", err)
+	}
+	if seq := follower.getSeq(); seq != 10 {
+		t.Errorf("invalid follower seq: want=10 got=%d", seq)
+	}
+}
+
+func TestDB_Secondary(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestSecondary-%d", os.Getuid()))
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dir)
+	primaryPath, secondaryPath := filepath.Join(dir, "primary"), filepath.Join(dir, "secondary")
+
+	primary, err := OpenFile(primaryPath, nil)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer primary.Close()
+	if err := primary.TryCatchUpWithPrimary(); err != ErrNotSecondary {
+		t.Errorf("TryCatchUpWithPrimary on primary: expect ErrNotSecondary, got %v", err)
+	}
+	primary.Put([]byte("a"), []byte("v1"), nil)
+	primary.Put([]byte("b"), []byte("v2"), nil)
+	if err := primary.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	primary.Put([]byte("c"), []byte("v3"), nil)
+
+	secondary, err := OpenAsSecondary(primaryPath, secondaryPath, nil)
+	if err != nil {
+		t.Fatal("OpenAsSecondary: got error: ", err)
+	}
+	defer secondary.Close()
+	get := func(key string) string {
+		v, err := secondary.Get([]byte(key), nil)
+		if err == ErrNotFound {
+			return "<nil>"
+		} else if err != nil {
+			t.Fatalf("Get(%q): got error: %v", key, err)
+		}
+		return string(v)
+	}
+	if got := get("a") + get("b") + get("c"); got != "v1v2v3" {
+		t.Errorf("invalid secondary state: got %s", got)
+	}
+	if err := secondary.Put([]byte("d"), []byte("v4"), nil); err != ErrReadOnly {
+		t.Errorf("Put on secondary: expect ErrReadOnly, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(secondaryPath, "LOG")); err != nil {
+		t.Errorf("secondary LOG: got error: %v", err)
+	}
+
+	// The secondary doesn't see new writes until it catches up, also
+	// across memdb flush and compaction of the primary.
+	primary.Delete([]byte("a"), nil)
+	primary.Put([]byte("b"), []byte("v5"), nil)
+	if err := primary.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	primary.Put([]byte("d"), []byte("v6"), nil)
+	if got := get("b") + get("d"); got != "v2<nil>" {
+		t.Errorf("invalid secondary state before catch-up: got %s", got)
+	}
+	if err := secondary.TryCatchUpWithPrimary(); err != nil {
+		t.Fatal("TryCatchUpWithPrimary: got error: ", err)
+	}
+	if got := get("a") + get("b") + get("c") + get("d"); got != "<nil>v5v3v6" {
+		t.Errorf("invalid secondary state after catch-up: got %s", got)
+	}
+
+	// A failed catch-up leaves the former state, the version isn't
+	// installed without its memdb.
+	primary.Put([]byte("e"), []byte("v7"), nil)
+	if err := primary.CompactRange(util.Range{}); err != nil {
+		t.Fatal("CompactRange: got error: ", err)
+	}
+	primary.Put([]byte("f"), []byte("v8"), nil)
+	journalPath := filepath.Join(primaryPath, fmt.Sprintf("%06d.log", primary.journalFd.Num))
+	if err := os.Rename(journalPath, journalPath+".tmp"); err != nil {
+		t.Fatal("Rename: got error: ", err)
+	}
+	if err := secondary.TryCatchUpWithPrimary(); err == nil {
+		t.Error("TryCatchUpWithPrimary without journal: expect error")
+	}
+	if got := get("e") + get("f"); got != "<nil><nil>" {
+		t.Errorf("invalid secondary state after failed catch-up: got %s", got)
+	}
+	if err := os.Rename(journalPath+".tmp", journalPath); err != nil {
+		t.Fatal("Rename: got error: ", err)
+	}
+	if err := secondary.TryCatchUpWithPrimary(); err != nil {
+		t.Fatal("TryCatchUpWithPrimary: got error: ", err)
+	}
+	if got := get("e") + get("f"); got != "v7v8" {
+		t.Errorf("invalid secondary state after catch-up: got %s", got)
+	}
+}
+
+func TestDB_HiddenValuesAreRemoved(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		s := h.db.s
+
+		m := 2
+		h.db.memdbMaxLevel = m
+
+		h.put("foo", "v1")
+		h.compactMem()
+		v := s.version()
+		num := v.tLen(m)
+		v.release()
+		if num != 1 {
+			t.Errorf("invalid level-%d len, want=1 got=%d", m, num)
+		}
+
+		// Place a table at level last-1 to prevent merging with preceding mutation
+		h.put("a", "begin")
+		h.put("z", "end")
+		h.compactMem()
+		v = s.version()
+		if v.tLen(m) != 1 {
+			t.Errorf("invalid level-%d len, want=1 got=%d", m, v.tLen(m))
+		}
+		if v.tLen(m-1) != 1 {
+			t.Errorf("invalid level-%d len, want=1 got=%d", m-1, v.tLen(m-1))
+		}
+		v.release()
+
+		h.delete("foo")
+		h.put("foo", "v2")
+		h.allEntriesFor("foo", "[ v2, DEL, v1 ]")
+		h.compactMem()
+		h.allEntriesFor("foo", "[ v2, DEL, v1 ]")
+		h.compactRangeAt(m-2, "", "z")
+		// DEL eliminated, but v1 remains because we aren't compacting that level
+		// (DEL can be eliminated because v2 hides v1).
+		h.allEntriesFor("foo", "[ v2, v1 ]")
+		h.compactRangeAt(m-1, "", "")
+		// Merging last-1 w/ last, so we are the base level for "foo", so
+		// DEL is removed.  (as is v1).
+		h.allEntriesFor("foo", "[ v2 ]")
+	})
+}
+
+func TestDB_DeletionMarkers2(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+	s := h.db.s
+
+	m := 2
+	h.db.memdbMaxLevel = m
+
+	h.put("foo", "v1")
+	h.compactMem()
+	v := s.version()
+	num := v.tLen(m)
+	v.release()
+	if num != 1 {
+		t.Errorf("invalid level-%d len, want=1 got=%d", m, num)
+	}
+
+	// Place a table at level last-1 to prevent merging with preceding mutation
+	h.put("a", "begin")
+	h.put("z", "end")
+	h.compactMem()
+	v = s.version()
+	if v.tLen(m) != 1 {
+		t.Errorf("invalid level-%d len, want=1 got=%d", m, v.tLen(m))
+	}
+	if v.tLen(m-1) != 1 {
+		t.Errorf("invalid level-%d len, want=1 got=%d", m-1, v.tLen(m-1))
+	}
+	v.release()
+
+	h.delete("foo")
+	h.allEntriesFor("foo", "[ DEL, v1 ]")
+	h.compactMem() // Moves to level last-2
+	h.allEntriesFor("foo", "[ DEL, v1 ]")
+	h.compactRangeAt(m-2, "", "")
+	// DEL kept: "last" file overlaps
+	h.allEntriesFor("foo", "[ DEL, v1 ]")
+	h.compactRangeAt(m-1, "", "")
+	// Merging last-1 w/ last, so we are the base level for "foo", so
+	// DEL is removed.  (as is v1).
+	h.allEntriesFor("foo", "[ ]")
+}
+
+func TestDB_CompactionTableOpenError(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		OpenFilesCacheCapacity:       -1,
+	})
+	defer h.close()
+
+	h.db.memdbMaxLevel = 2
+
+	im := 10
+	jm := 10
+	for r := 0; r < 2; r++ {
+		for i := 0; i < im; i++ {
+			for j := 0; j < jm; j++ {
+				h.put(fmt.Sprintf("k%d,%d", i, j), fmt.Sprintf("v%d,%d", i, j))
+			}
+			h.compactMem()
+		}
+	}
+
+	if n := h.totalTables(); n != im*2 {
+		t.Errorf("total tables is %d, want %d", n, im*2)
+	}
+
+	h.stor.EmulateError(testutil.ModeOpen, storage.TypeTable, errors.New("open error during table compaction"))
+	go h.db.CompactRange(util.Range{})
+	if err := h.db.compTriggerWait(h.db.tcompCmdC); err != nil {
+		t.Log("compaction error: ", err)
+	}
+	h.closeDB0()
+	h.openDB()
+	h.stor.EmulateError(testutil.ModeOpen, storage.TypeTable, nil)
+
+	for i := 0; i < im; i++ {
+		for j := 0; j < jm; j++ {
+			h.getVal(fmt.Sprintf("k%d,%d", i, j), fmt.Sprintf("v%d,%d", i, j))
+		}
+	}
+}
+
+func TestDB_OverlapInLevel0(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		h.db.memdbMaxLevel = 2
+
+		// Fill levels 1 and 2 to disable the pushing of new memtables to levels > 0.
+		h.put("100", "v100")
+		h.put("999", "v999")
+		h.compactMem()
+		h.delete("100")
+		h.delete("999")
+		h.compactMem()
+		h.tablesPerLevel("0,1,1")
+
+		// Make files spanning the following ranges in level-0:
+		//  files[0]  200 .. 900
+		//  files[1]  300 .. 500
+		// Note that files are sorted by min key.
+		h.put("300", "v300")
+		h.put("500", "v500")
+		h.compactMem()
+		h.put("200", "v200")
+		h.put("600", "v600")
+		h.put("900", "v900")
+		h.compactMem()
+		h.tablesPerLevel("2,1,1")
+
+		// Compact away the placeholder files we created initially
+		h.compactRangeAt(1, "", "")
+		h.compactRangeAt(2, "", "")
+		h.tablesPerLevel("2")
+
+		// Do a memtable compaction.  Before bug-fix, the compaction would
+		// not detect the overlap with level-0 files and would incorrectly place
+		// the deletion in a deeper level.
+		h.delete("600")
+		h.compactMem()
+		h.tablesPerLevel("3")
+		h.get("600", false)
+	})
+}
+
+func TestDB_L0_CompactionBug_Issue44_a(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.reopenDB()
+	h.put("b", "v")
+	h.reopenDB()
+	h.delete("b")
+	h.delete("a")
+	h.reopenDB()
+	h.delete("a")
+	h.reopenDB()
+	h.put("a", "v")
+	h.reopenDB()
+	h.reopenDB()
+	h.getKeyVal("(a->v)")
+	h.waitCompaction()
+	h.getKeyVal("(a->v)")
+}
+
+func TestDB_L0_CompactionBug_Issue44_b(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.reopenDB()
+	h.put("", "")
+	h.reopenDB()
+	h.delete("e")
+	h.put("", "")
+	h.reopenDB()
+	h.put("c", "cv")
+	h.reopenDB()
+	h.put("", "")
+	h.reopenDB()
+	h.put("", "")
+	h.waitCompaction()
+	h.reopenDB()
+	h.put("d", "dv")
+	h.reopenDB()
+	h.put("", "")
+	h.reopenDB()
+	h.delete("d")
+	h.delete("b")
+	h.reopenDB()
+	h.getKeyVal("(->)(c->cv)")
+	h.waitCompaction()
+	h.getKeyVal("(->)(c->cv)")
+}
+
+func TestDB_SingleEntryMemCompaction(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		for i := 0; i < 10; i++ {
+			h.put("big", strings.Repeat("v", opt.DefaultWriteBuffer))
+			h.compactMem()
+			h.put("key", strings.Repeat("v", opt.DefaultBlockSize))
+			h.compactMem()
+			h.put("k", "v")
+			h.compactMem()
+			h.put("", "")
+			h.compactMem()
+			h.put("verybig", strings.Repeat("v", opt.DefaultWriteBuffer*2))
+			h.compactMem()
+		}
+	})
+}
+
+func TestDB_ManifestWriteError(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		func() {
+			h := newDbHarness(t)
+			defer h.close()
+
+			h.put("foo", "bar")
+			h.getVal("foo", "bar")
+
+			// Mem compaction (will succeed)
+			h.compactMem()
+			h.getVal("foo", "bar")
+			v := h.db.s.version()
+			if n := v.tLen(0); n != 1 {
+				t.Errorf("invalid total tables, want=1 got=%d", n)
+			}
+			v.release()
+
+			if i == 0 {
+				h.stor.EmulateError(testutil.ModeWrite, storage.TypeManifest, errors.New("manifest write error"))
+			} else {
+				h.stor.EmulateError(testutil.ModeSync, storage.TypeManifest, errors.New("manifest sync error"))
+			}
+
+			// Merging compaction (will fail)
+			h.compactRangeAtErr(0, "", "", true)
+
+			h.db.Close()
+			h.stor.EmulateError(testutil.ModeWrite, storage.TypeManifest, nil)
+			h.stor.EmulateError(testutil.ModeSync, storage.TypeManifest, nil)
+
+			// Should not lose data
+			h.openDB()
+			h.getVal("foo", "bar")
+		}()
+	}
+}
+
+func TestDB_ManifestRollover(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		MaxManifestFileSize:          2 * opt.KiB,
+	})
+	defer h.close()
+
+	manifests := func() []storage.FileDesc {
+		fds, err := h.stor.List(storage.TypeManifest)
+		if err != nil {
+			t.Fatal("List: got error: ", err)
+		}
+		return fds
+	}
+	fill := func(start, n int) {
+		for i := start; i < start+n; i++ {
+			h.put(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%03d", i))
+			h.compactMem()
+		}
+	}
+	check := func(n int) {
+		for i := 0; i < n; i++ {
+			h.getVal(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%03d", i))
+		}
+	}
+
+	h.stor.ResetCounter(testutil.ModeCreate, storage.TypeManifest)
+	fill(0, 50)
+	if n, _ := h.stor.Counter(testutil.ModeCreate, storage.TypeManifest); n == 0 {
+		t.Error("manifest not rolled over")
+	}
+	if fds := manifests(); len(fds) != 1 {
+		t.Errorf("invalid manifest files: got %v, want one", fds)
+	}
+	h.reopenDB()
+	check(50)
+
+	// The records are kept in the old manifest if the new one can't be
+	// created.
+	h.stor.EmulateError(testutil.ModeCreate, storage.TypeManifest, errors.New("manifest create error"))
+	fill(50, 50)
+	h.stor.EmulateError(testutil.ModeCreate, storage.TypeManifest, nil)
+	h.reopenDB()
+	check(100)
+
+	// The old manifest is left behind as if the DB crashed once the new
+	// one is set as current, it is removed by the next open.
+	h.stor.EmulateError(testutil.ModeRemove, storage.TypeManifest, errors.New("manifest remove error"))
+	fill(100, 50)
+	if fds := manifests(); len(fds) < 2 {
+		t.Errorf("invalid manifest files: got %v, want at least two", fds)
+	}
+	h.closeDB()
+	h.stor.EmulateError(testutil.ModeRemove, storage.TypeManifest, nil)
+	h.openDB()
+	check(150)
+	if fds := manifests(); len(fds) != 1 {
+		t.Errorf("invalid manifest files: got %v, want one", fds)
+	}
+}
+
+type syncStorage struct {
+	storage.Storage
+	syncs int32
+}
+
+func (s *syncStorage) Sync() error {
+	atomic.AddInt32(&s.syncs, 1)
+	return nil
+}
+
+func TestDB_StorageSync(t *testing.T) {
+	for _, noSync := range []bool{false, true} {
+		stor := &syncStorage{Storage: storage.NewMemStorage()}
+		db, err := Open(stor, &opt.Options{NoSync: noSync})
+		if err != nil {
+			t.Fatal("Open: got error: ", err)
+		}
+		if err := db.Put([]byte("foo"), []byte("v1"), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+		n := atomic.LoadInt32(&stor.syncs)
+		db.writeLockC <- struct{}{}
+		if _, err := db.rotateMem(0, true); err != nil {
+			t.Fatal("rotateMem: got error: ", err)
+		}
+		<-db.writeLockC
+		// Synced once for the new journal, and once for the flushed table.
+		if m := atomic.LoadInt32(&stor.syncs) - n; !noSync && m != 2 || noSync && m != 0 {
+			t.Errorf("NoSync=%v: invalid storage sync count: %d", noSync, m)
+		}
+		db.Close()
+	}
+}
+
+func TestDB_EncryptedStorage(t *testing.T) {
+	ep, err := storage.NewAESEncryptionProvider(bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatal("NewAESEncryptionProvider: got error: ", err)
+	}
+	base := storage.NewMemStorage()
+	stor := storage.NewEncrypted(base, ep)
+	o := &opt.Options{
+		JournalRecycle: 1,
+		MmapRead:       true,
+		WriteBuffer:    16 * opt.KiB,
+	}
+	db, err := Open(stor, o)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	value := strings.Repeat("secret", 10)
+	for i := 0; i < 1000; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("k%04d", i)), []byte(value), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	db.Close()
+
+	fds, err := base.List(storage.TypeJournal | storage.TypeTable)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	for _, fd := range fds {
+		r, err := base.Open(fd)
+		if err != nil {
+			t.Fatal("Open: got error: ", err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal("Read: got error: ", err)
+		}
+		if bytes.Contains(data, []byte("secret")) {
+			t.Errorf("%s not encrypted", fd)
+		}
+	}
+
+	db, err = Open(stor, o)
+	if err != nil {
+		t.Fatal("Reopen: got error: ", err)
+	}
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		if v, err := db.Get([]byte(fmt.Sprintf("k%04d", i)), nil); err != nil || string(v) != value {
+			t.Fatalf("Get k%04d: got value %q, error %v", i, v, err)
+		}
+	}
+}
+
+type dropCacheStorage struct {
+	storage.Storage
+	drops int32
+}
+
+func (s *dropCacheStorage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	r, err := s.Storage.Open(fd)
+	if err != nil {
+		return nil, err
+	}
+	return dropCacheReader{r, s}, nil
+}
+
+func (s *dropCacheStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	w, err := s.Storage.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	return dropCacheWriter{w, s}, nil
+}
+
+type dropCacheReader struct {
+	storage.Reader
+	s *dropCacheStorage
+}
+
+func (r dropCacheReader) DropCache() error {
+	atomic.AddInt32(&r.s.drops, 1)
+	return nil
+}
+
+type dropCacheWriter struct {
+	storage.Writer
+	s *dropCacheStorage
+}
+
+func (w dropCacheWriter) DropCache() error {
+	atomic.AddInt32(&w.s.drops, 1)
+	return nil
+}
+
+func TestDB_CompactionDropCache(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		stor := &dropCacheStorage{Storage: storage.NewMemStorage()}
+		db, err := Open(stor, &opt.Options{CompactionDropCache: drop})
+		if err != nil {
+			t.Fatal("Open: got error: ", err)
+		}
+		for _, key := range []string{"a", "b", "a", "c"} {
+			if err := db.Put([]byte(key), []byte("v"), nil); err != nil {
+				t.Fatal("Put: got error: ", err)
+			}
+			if key == "b" {
+				db.writeLockC <- struct{}{}
+				_, err = db.rotateMem(0, true)
+				<-db.writeLockC
+				if err != nil {
+					t.Fatal("rotateMem: got error: ", err)
+				}
+			}
+		}
+		if err := db.CompactRange(util.Range{}); err != nil {
+			t.Fatal("CompactRange: got error: ", err)
+		}
+		db.Close()
+
+		// The output table and both input tables.
+		want := int32(0)
+		if drop {
+			want = 3
+		}
+		if got := atomic.LoadInt32(&stor.drops); got != want {
+			t.Errorf("CompactionDropCache=%v: want %d drops, got %d", drop, want, got)
+		}
+	}
+}
+
+type tableIOStorage struct {
+	storage.Storage
+	mu         sync.Mutex
+	prealloc   []int64
+	truncate   []int64
+	syncRanges [][2]int64
+}
+
+func (s *tableIOStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	w, err := s.Storage.Create(fd)
+	if err != nil || fd.Type != storage.TypeTable {
+		return w, err
+	}
+	return tableIOWriter{w, s}, nil
+}
+
+type tableIOWriter struct {
+	storage.Writer
+	s *tableIOStorage
+}
+
+func (w tableIOWriter) Preallocate(size int64) error {
+	w.s.mu.Lock()
+	w.s.prealloc = append(w.s.prealloc, size)
+	w.s.mu.Unlock()
+	return nil
+}
+
+func (w tableIOWriter) Truncate(size int64) error {
+	w.s.mu.Lock()
+	w.s.truncate = append(w.s.truncate, size)
+	w.s.mu.Unlock()
+	return nil
+}
+
+func (w tableIOWriter) SyncRange(off, n int64) error {
+	w.s.mu.Lock()
+	w.s.syncRanges = append(w.s.syncRanges, [2]int64{off, n})
+	w.s.mu.Unlock()
+	return nil
+}
+
+func TestDB_TablePreallocate(t *testing.T) {
+	stor := &tableIOStorage{Storage: storage.NewMemStorage()}
+	o := &opt.Options{
+		CompactionTableSize: 64 * opt.KiB,
+		Compression:         opt.NoCompression,
+		TableBytesPerSync:   opt.KiB,
+		TablePreallocate:    true,
+	}
+	db, err := Open(stor, o)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), bytes.Repeat([]byte{'v'}, 100), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	db.writeLockC <- struct{}{}
+	_, err = db.rotateMem(0, true)
+	<-db.writeLockC
+	if err != nil {
+		t.Fatal("rotateMem: got error: ", err)
+	}
+
+	v := db.s.version()
+	defer v.release()
+	if len(v.levels) == 0 || len(v.levels[0]) != 1 {
+		t.Fatalf("want one table, got %v", v.levels)
+	}
+	size := v.levels[0][0].size
+
+	stor.mu.Lock()
+	defer stor.mu.Unlock()
+	if len(stor.prealloc) != 1 || stor.prealloc[0] != 64*opt.KiB {
+		t.Errorf("invalid preallocations: %v", stor.prealloc)
+	}
+	if len(stor.truncate) != 1 || stor.truncate[0] != size {
+		t.Errorf("invalid truncations: %v, table size is %d", stor.truncate, size)
+	}
+	// The write-back is started as the blocks are written.
+	if len(stor.syncRanges) < 2 {
+		t.Errorf("want at least 2 range syncs, got %d", len(stor.syncRanges))
+	}
+	var off int64
+	for _, r := range stor.syncRanges {
+		if r[0] != off || r[1] < opt.KiB {
+			t.Errorf("invalid range sync: %v, want offset %d", r, off)
+		}
+		off += r[1]
+	}
+}
+
+func TestDB_DumpManifest(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.put("bar", "v2")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.closeDB()
+
+	buf := &bytes.Buffer{}
+	if err := DumpManifest(h.stor, buf); err != nil {
+		t.Fatal("DumpManifest: got error: ", err)
+	}
+	dump := buf.String()
+	for _, want := range []string{
+		"comparer: leveldb.BytewiseComparator\n",
+		"--- record #1\n",
+		"add-table: L0 @",
+		"add-table: L1 @",
+		"del-table: L0 @",
+		`"bar",v2:"foo",v1` + "\n",
+		"tables: [0 1]\n",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("manifest dump doesn't contain %q:\n%s", want, dump)
+		}
+	}
+
+	records, err := ReadManifest(h.stor)
+	if err != nil {
+		t.Fatal("ReadManifest: got error: ", err)
+	}
+	if len(records) < 2 {
+		t.Fatalf("ReadManifest: got %d records, want >= 2", len(records))
+	}
+	last := records[len(records)-1]
+	if fmt.Sprint(last.LevelTables) != "[0 1]" || len(last.AddedTables) != 1 || string(last.AddedTables[0].Max.UserKey) != "foo" {
+		t.Errorf("ReadManifest: invalid last record: %+v", last)
+	}
+
+	buf.Reset()
+	if err := DumpManifestJSON(h.stor, buf); err != nil {
+		t.Fatal("DumpManifestJSON: got error: ", err)
+	}
+	dec := json.NewDecoder(buf)
+	for i := range records {
+		var mr ManifestRecord
+		if err := dec.Decode(&mr); err != nil {
+			t.Fatalf("DumpManifestJSON: record #%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(mr, records[i]) {
+			t.Errorf("DumpManifestJSON: record #%d: got %+v, want %+v", i, mr, records[i])
+		}
+	}
+	if dec.More() {
+		t.Error("DumpManifestJSON: got trailing records")
+	}
+}
+
+func assertErr(t *testing.T, err error, wanterr bool) {
+	if err != nil {
+		if wanterr {
+			t.Log("AssertErr: got error (expected): ", err)
+		} else {
+			t.Error("AssertErr: got error: ", err)
+		}
+	} else if wanterr {
+		t.Error("AssertErr: expect error")
+	}
+}
+
+func TestDB_TransactionCommitError(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	if err := tr.Put([]byte("foo"), []byte("v2"), h.wo); err != nil {
+		t.Fatal("Transaction.Put: got error: ", err)
+	}
+	if err := tr.Put([]byte("bar"), []byte("v2"), h.wo); err != nil {
+		t.Fatal("Transaction.Put: got error: ", err)
+	}
+
+	h.stor.EmulateError(testutil.ModeWrite, storage.TypeManifest, errors.New("manifest write error"))
+	if err := tr.Commit(); err == nil {
+		t.Fatal("Transaction.Commit: expect error")
+	}
+	tr.Discard()
+
+	// Failed commit shouldn't hold the commit lock.
+	h.db.compCommitLk.Lock()
+	h.db.compCommitLk.Unlock()
+
+	// Transaction is discarded, the DB should still be writable.
+	h.getVal("foo", "v1")
+	h.get("bar", false)
+	h.put("foo", "v3")
+	h.getVal("foo", "v3")
+
+	h.closeDB()
+	h.stor.EmulateError(testutil.ModeWrite, storage.TypeManifest, nil)
+	h.openDB()
+	h.getVal("foo", "v3")
+	h.get("bar", false)
+}
+
+// Writes an external table of the given key/value pairs for ingestion.
+func createIngestTable(t *testing.T, path string, kvs ...string) string {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	defer f.Close()
+	w := table.NewWriter(f, nil)
+	for i := 0; i < len(kvs); i += 2 {
+		if err := w.Append([]byte(kvs[i]), []byte(kvs[i+1])); err != nil {
+			t.Fatal("Append: got error: ", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+	return path
+}
+
+func TestDB_IngestTables(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestIngestTables-%d", os.Getuid()))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal("MkdirAll: got error: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	create := func(name string, kvs ...string) string {
+		return createIngestTable(t, filepath.Join(dir, name), kvs...)
+	}
+
+	h.put("a", "v1")
+	h.put("c", "v1")
+	snap := h.getSnapshot()
+	defer snap.Release()
+
+	// Overlapping tables, the latter takes precedence.
+	f1 := create("1.ldb", "a", "v2", "b", "v2")
+	f2 := create("2.ldb", "b", "v3", "d", "v3")
+	if err := h.db.IngestTables([]string{f1, f2}, &opt.IngestOptions{RemoveSource: true}); err != nil {
+		t.Fatal("IngestTables: got error: ", err)
+	}
+	h.tablesPerLevel("3")
+	h.getVal("a", "v2")
+	h.getVal("b", "v3")
+	h.getVal("c", "v1")
+	h.getVal("d", "v3")
+	h.getValr(snap, "a", "v1")
+	h.getr(snap, "b", false)
+	for _, path := range []string{f1, f2} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("source %s is not removed: %v", path, err)
+		}
+	}
+
+	// Non-overlapping table goes to the deepest non-overlapping level.
+	f3 := create("3.ldb", "x", "v4", "y", "v4")
+	if err := h.db.IngestTables([]string{f3}, nil); err != nil {
+		t.Fatal("IngestTables: got error: ", err)
+	}
+	h.tablesPerLevel("3,0,1")
+	h.getVal("x", "v4")
+	if _, err := os.Stat(f3); err != nil {
+		t.Errorf("source %s is removed: %v", f3, err)
+	}
+
+	// Failed ingestion leaves the DB untouched.
+	f4 := create("4.ldb", "a", "v5")
+	if err := h.db.IngestTables([]string{f4, filepath.Join(dir, "missing.ldb")}, nil); err == nil {
+		t.Fatal("IngestTables: expecting error")
+	}
+	h.getVal("a", "v2")
+	h.put("e", "v6")
+
+	h.reopenDB()
+	h.getVal("a", "v2")
+	h.getVal("b", "v3")
+	h.getVal("e", "v6")
+	h.getVal("y", "v4")
+}
+
+func TestDB_IngestTablesGlobalSeq(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestIngestTablesGlobalSeq-%d", os.Getuid()))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal("MkdirAll: got error: ", err)
+	}
+	defer os.RemoveAll(dir)
+	ingest := func(name string, kvs ...string) {
+		if err := h.db.IngestTables([]string{createIngestTable(t, filepath.Join(dir, name), kvs...)}, nil); err != nil {
+			t.Fatal("IngestTables: got error: ", err)
+		}
+	}
+
+	h.put("a", "v1")
+	h.put("m", "v1")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	h.tablesPerLevel("0,0,1")
+	h.put("m", "v2")
+	snap := h.getSnapshot()
+	defer snap.Release()
+
+	// Placed above the overlapping level, the memdb isn't flushed.
+	ingest("1.ldb", "a", "v3", "b", "v3")
+	h.tablesPerLevel("0,1,1")
+	h.getVal("a", "v3")
+	h.getVal("m", "v2")
+	h.getValr(snap, "a", "v1")
+	h.getr(snap, "b", false)
+	h.allEntriesFor("a", "[ v3, v1 ]")
+
+	// Overlapping the memdb, which is flushed first.
+	ingest("2.ldb", "m", "v4")
+	h.tablesPerLevel("2,1,1")
+	h.getVal("m", "v4")
+	h.getValr(snap, "m", "v2")
+	h.allEntriesFor("m", "[ v4, v2, v1 ]")
+
+	h.put("b", "v5")
+	h.getVal("b", "v5")
+	h.reopenDB()
+	h.getVal("a", "v3")
+	h.getVal("b", "v5")
+	h.getVal("m", "v4")
+	h.getKeyVal("(a->v3)(b->v5)(m->v4)")
+	iter := h.db.NewIterator(nil, nil)
+	var res string
+	for ok := iter.Last(); ok; ok = iter.Prev() {
+		res += fmt.Sprintf("(%s->%s)", iter.Key(), iter.Value())
+	}
+	iter.Release()
+	if want := "(m->v4)(b->v5)(a->v3)"; res != want {
+		t.Errorf("reverse iteration: got=%q want=%q", res, want)
+	}
+
+	// Compacted into tables keyed by internal keys.
+	h.compactRange("", "")
+	h.getKeyVal("(a->v3)(b->v5)(m->v4)")
+	v := h.db.s.version()
+	for level, tables := range v.levels {
+		for _, tf := range tables {
+			if tf.gseq != 0 {
+				t.Errorf("table %v at level-%d still has global sequence number %d", tf.fd, level, tf.gseq)
+			}
+		}
+	}
+	v.release()
+}
+
+func TestDB_IngestTablesRecover(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		// The ingested tables aren't compacted in the background.
+		CompactionL0Trigger: 100,
+	})
+	defer h.close()
+
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestIngestTablesRecover-%d", os.Getuid()))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal("MkdirAll: got error: ", err)
+	}
+	defer os.RemoveAll(dir)
+	ingest := func(name string, kvs ...string) {
+		if err := h.db.IngestTables([]string{createIngestTable(t, filepath.Join(dir, name), kvs...)}, nil); err != nil {
+			t.Fatal("IngestTables: got error: ", err)
+		}
+	}
+	recover := func() {
+		db, err := Recover(h.stor, h.o)
+		if err != nil {
+			t.Fatal("Recover: got error: ", err)
+		}
+		h.db = db
+	}
+	globalSeqs := func() (n int) {
+		v := h.db.s.version()
+		defer v.release()
+		for _, tables := range v.levels {
+			for _, tf := range tables {
+				if tf.gseq != 0 {
+					n++
+				}
+			}
+		}
+		return
+	}
+
+	// Keys that all look like internal keys.
+	k1, k2 := "\x00\x00\x00\x00\x00\x00\x00\x01", "\x00\x00\x00\x00\x00\x00\x00\x02"
+
+	h.put("a", "v1")
+	h.put("m", "v1")
+	h.compactMem()
+	ingest("1.ldb", "a", "v2", "b", "v2")
+	ingest("2.ldb", k1, "v2", k2, "v2")
+	ingest("3.ldb", "c", "v2")
+	h.put("b", "v3")
+	h.compactMem()
+	if n := globalSeqs(); n != 2 {
+		t.Errorf("tables with global sequence number: got=%d want=2", n)
+	}
+
+	h.closeDB()
+	recover()
+	if n := globalSeqs(); n != 2 {
+		t.Errorf("recovered tables with global sequence number: got=%d want=2", n)
+	}
+	h.getKeyVal("(" + k1 + "->v2)(" + k2 + "->v2)(a->v2)(b->v3)(c->v2)(m->v1)")
+	h.allEntriesFor("b", "[ v3, v2 ]")
+	h.put("c", "v4")
+	h.getVal("c", "v4")
+	h.reopenDB()
+	h.getKeyVal("(" + k1 + "->v2)(" + k2 + "->v2)(a->v2)(b->v3)(c->v4)(m->v1)")
+
+	// Without the manifests, the ingested tables override the others.
+	h.closeDB()
+	fds, err := h.stor.List(storage.TypeManifest)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	for _, fd := range fds {
+		if err := h.stor.Remove(fd); err != nil {
+			t.Fatal("Remove: got error: ", err)
+		}
+	}
+	recover()
+	h.getVal("a", "v2")
+	h.getVal(k1, "v2")
+	h.getVal("m", "v1")
+	h.compactRange("", "")
+	if n := globalSeqs(); n != 0 {
+		t.Errorf("compacted tables with global sequence number: got=%d want=0", n)
+	}
+	h.getVal("a", "v2")
+	h.getVal(k2, "v2")
+}
+
+func TestDB_IngestTablesLink(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestIngestTablesLink-%d", os.Getuid()))
+	if err := os.RemoveAll(dir); err != nil && !os.IsNotExist(err) {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenFile(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer db.Close()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal("MkdirAll: got error: ", err)
+	}
+	src := createIngestTable(t, filepath.Join(dir, "1.ldb"), "a", "v1")
+	if err := db.IngestTables([]string{src}, nil); err != nil {
+		t.Fatal("IngestTables: got error: ", err)
+	}
+	if v, err := db.Get([]byte("a"), nil); err != nil || string(v) != "v1" {
+		t.Fatalf("Get: got value=%q err=%v", v, err)
+	}
+
+	v := db.s.version()
+	defer v.release()
+	var tf *tFile
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			tf = t
+		}
+	}
+	if tf == nil || tf.gseq == 0 {
+		t.Fatalf("no ingested table: %v", tf)
+	}
+	fi1, err := os.Stat(src)
+	if err != nil {
+		t.Fatal("Stat: got error: ", err)
+	}
+	fi2, err := os.Stat(filepath.Join(dir, "db", fmt.Sprintf("%06d.ldb", tf.fd.Num)))
+	if err != nil {
+		t.Fatal("Stat (db): got error: ", err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Error("ingested table isn't linked")
+	}
+}
+
+func TestDB_IngestRocksDBTables(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	// The tables are generated by testdata/rocksdb/gen.go.
+	path := func(name string) string {
+		return filepath.Join("testdata", "rocksdb", name)
+	}
+
+	for _, key := range []string{"key001", "key050", "key052", "key058", "key100", "key192", "key300", "key500"} {
+		h.put(key, "old")
+	}
+	snap := h.getSnapshot()
+	defer snap.Release()
+
+	if err := h.db.IngestTables([]string{path("v2.sst"), path("v5.sst")}, nil); err != nil {
+		t.Fatal("IngestTables: got error: ", err)
+	}
+	// The latest versions of v2.sst, deletions included.
+	h.get("key000", false)
+	h.getVal("key001", "v2-1")
+	h.get("key007", false)
+	h.getVal("key060", "v2-60")
+	h.getVal("key195", "v2-195")
+	// The range deletions of v5.sst hide the entries of v2.sst and the
+	// existing entries, but not its later entries.
+	for _, key := range []string{"key050", "key052", "key055", "key059", "key190", "key192"} {
+		h.get(key, false)
+	}
+	h.getVal("key058", "v5-58")
+	h.get("key100", false)
+	h.getVal("key300", "v5-300")
+	h.getVal("key399", "v5-399")
+	h.getVal("key500", "old")
+	h.getValr(snap, "key050", "old")
+	h.getr(snap, "key000", false)
+
+	// Merge operands can't be ingested.
+	if err := h.db.IngestTables([]string{path("merge.sst")}, nil); err == nil {
+		t.Fatal("IngestTables: expecting error")
+	}
+	h.get("merge", false)
+
+	h.reopenDB()
+	h.getVal("key001", "v2-1")
+	h.get("key052", false)
+	h.getVal("key058", "v5-58")
+	h.getVal("key500", "old")
+}
+
+func TestDB_ExportImport(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for i := 0; i < 100; i++ {
+		h.put(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+	}
+	h.put("empty", "")
+	h.deleteRange("k050", "k060")
+	snap := h.getSnapshot()
+	defer snap.Release()
+	h.put("k000", "changed")
+	h.put("late", "v")
+
+	var full, part bytes.Buffer
+	if err := snap.ExportTo(&full, nil); err != nil {
+		t.Fatal("ExportTo: got error: ", err)
+	}
+	if err := h.db.ExportTo(&part, &opt.ReadOptions{LowerBound: []byte("k090"), UpperBound: []byte("k095")}); err != nil {
+		t.Fatal("ExportTo: got error: ", err)
+	}
+
+	importDump := func(dump []byte) (*DB, error) {
+		// Small batches, the import spans several writes.
+		db, err := Open(storage.NewMemStorage(), &opt.Options{MaxBatchLen: 7})
+		if err != nil {
+			t.Fatal("Open: got error: ", err)
+		}
+		return db, db.ImportFrom(bytes.NewReader(dump), nil)
+	}
+	dumpKeys := func(r Reader) (kvs []string) {
+		iter := r.NewIterator(nil, nil)
+		defer iter.Release()
+		for iter.Next() {
+			kvs = append(kvs, string(iter.Key())+"="+string(iter.Value()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal("iterator: got error: ", err)
+		}
+		return
+	}
+
+	db, err := importDump(full.Bytes())
+	if err != nil {
+		t.Fatal("ImportFrom: got error: ", err)
+	}
+	want := dumpKeys(snap)
+	if got := dumpKeys(db); len(want) != 91 || !reflect.DeepEqual(got, want) {
+		t.Errorf("imported pairs: got %v, want %v", got, want)
+	}
+	db.Close()
+
+	db, err = importDump(part.Bytes())
+	if err != nil {
+		t.Fatal("ImportFrom: got error: ", err)
+	}
+	if got, want := dumpKeys(db), []string{"k090=v90", "k091=v91", "k092=v92", "k093=v93", "k094=v94"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("imported pairs: got %v, want %v", got, want)
+	}
+	db.Close()
+
+	// Corrupted, truncated and invalid dumps.
+	corrupted := append([]byte{}, full.Bytes()...)
+	corrupted[len(corrupted)/2] ^= 0x80
+	if db, err = importDump(corrupted); !errors.IsCorrupted(err) {
+		t.Errorf("ImportFrom corrupted dump: got %v, want corruption", err)
+	}
+	db.Close()
+	if db, err = importDump(full.Bytes()[:full.Len()-1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("ImportFrom truncated dump: got %v, want io.ErrUnexpectedEOF", err)
+	}
+	db.Close()
+	if db, err = importDump([]byte("not a dump")); err != ErrInvalidDump {
+		t.Errorf("ImportFrom invalid dump: got %v, want ErrInvalidDump", err)
+	}
+	db.Close()
+}
+
+func TestDB_Checkpoint(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "v1")
+	h.put("b", "v1")
+	h.compactMem()
+	h.put("c", "v1")
+	h.delete("a")
+	h.deleteRange("b", "c")
+	h.db.rotateMem(0, false)
+	h.put("d", "v1")
+
+	stor := testutil.NewStorage()
+	defer stor.Close()
+	if err := h.db.Checkpoint(stor); err != nil {
+		t.Fatal("Checkpoint: got error: ", err)
+	}
+	h.put("e", "v1")
+
+	db, err := Open(stor, h.o)
+	if err != nil {
+		t.Fatal("Open (checkpoint): got error: ", err)
+	}
+	h.getr(db, "a", false)
+	h.getr(db, "b", false)
+	h.getValr(db, "c", "v1")
+	h.getValr(db, "d", "v1")
+	h.getr(db, "e", false)
+	if err := db.Put([]byte("f"), []byte("v1"), nil); err != nil {
+		t.Fatal("Put (checkpoint): got error: ", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close (checkpoint): got error: ", err)
+	}
+
+	db, err = Open(stor, h.o)
+	if err != nil {
+		t.Fatal("Reopen (checkpoint): got error: ", err)
+	}
+	h.getValr(db, "c", "v1")
+	h.getValr(db, "f", "v1")
+	db.Close()
+
+	h.getVal("e", "v1")
+	h.get("f", false)
+}
+
+func TestDB_CheckpointLink(t *testing.T) {
+	dir := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCheckpointLink-%d", os.Getuid()))
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := OpenFile(filepath.Join(dir, "db"), nil)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer db.Close()
+	db.Put([]byte("a"), []byte("v1"), nil)
+	db.writeLockC <- struct{}{}
+	_, err = db.rotateMem(0, true)
+	<-db.writeLockC
+	if err != nil {
+		t.Fatal("compaction error: ", err)
+	}
+	db.Put([]byte("b"), []byte("v1"), nil)
+
+	dst, err := storage.OpenFile(filepath.Join(dir, "checkpoint"), false)
+	if err != nil {
+		t.Fatal("OpenFile (checkpoint): got error: ", err)
+	}
+	defer dst.Close()
+	if err := db.Checkpoint(dst); err != nil {
+		t.Fatal("Checkpoint: got error: ", err)
+	}
+
+	// The table is linked, the memdb is written into a new table.
+	var tables tFiles
+	v := db.s.version()
+	for _, lt := range v.levels {
+		tables = append(tables, lt...)
+	}
+	v.release()
+	if len(tables) != 1 {
+		t.Fatalf("invalid tables count: want=1 got=%d", len(tables))
+	}
+	name := fmt.Sprintf("%06d.ldb", tables[0].fd.Num)
+	fi1, err := os.Stat(filepath.Join(dir, "db", name))
+	if err != nil {
+		t.Fatal("Stat: got error: ", err)
+	}
+	fi2, err := os.Stat(filepath.Join(dir, "checkpoint", name))
+	if err != nil {
+		t.Fatal("Stat (checkpoint): got error: ", err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Errorf("table %s isn't linked", name)
+	}
+
+	cdb, err := Open(dst, nil)
+	if err != nil {
+		t.Fatal("Open (checkpoint): got error: ", err)
+	}
+	defer cdb.Close()
+	for _, key := range []string{"a", "b"} {
+		if value, err := cdb.Get([]byte(key), nil); err != nil || string(value) != "v1" {
+			t.Errorf("Get %q (checkpoint): want=v1 got=%q err=%v", key, value, err)
+		}
+	}
+}
+
+func TestDB_CheckpointManifestState(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		ComparerVersion:              2,
+	})
+	defer h.close()
+
+	h.put("a", "v1")
+	snap, err := h.db.CreateNamedSnapshot("backup")
+	if err != nil {
+		t.Fatal("CreateNamedSnapshot: got error: ", err)
+	}
+	snap.Release()
+	h.put("a", "v2")
+
+	stor := testutil.NewStorage()
+	defer stor.Close()
+	if err := h.db.Checkpoint(stor); err != nil {
+		t.Fatal("Checkpoint: got error: ", err)
+	}
+
+	db, err := Open(stor, h.o)
+	if err != nil {
+		t.Fatal("Open (checkpoint): got error: ", err)
+	}
+	defer db.Close()
+	h.getValr(db, "a", "v2")
+	snap, err = db.GetNamedSnapshot("backup")
+	if err != nil {
+		t.Fatal("GetNamedSnapshot (checkpoint): got error: ", err)
+	}
+	h.getValr(snap, "a", "v1")
+	snap.Release()
+}
+
+func TestDB_ClosedIsClosed(t *testing.T) {
+	h := newDbHarness(t)
+	db := h.db
+
+	var iter, iter2 iterator.Iterator
+	var snap *Snapshot
+	func() {
+		defer h.close()
+
+		h.put("k", "v")
+		h.getVal("k", "v")
+
+		iter = db.NewIterator(nil, h.ro)
+		iter.Seek([]byte("k"))
+		testKeyVal(t, iter, "k->v")
+
+		var err error
+		snap, err = db.GetSnapshot()
+		if err != nil {
+			t.Fatal("GetSnapshot: got error: ", err)
+		}
+
+		h.getValr(snap, "k", "v")
+
+		iter2 = snap.NewIterator(nil, h.ro)
+		iter2.Seek([]byte("k"))
+		testKeyVal(t, iter2, "k->v")
+
+		h.put("foo", "v2")
+		h.delete("foo")
+
+		// closing DB
+		iter.Release()
+		iter2.Release()
+	}()
+
+	assertErr(t, db.Put([]byte("x"), []byte("y"), h.wo), true)
+	_, err := db.Get([]byte("k"), h.ro)
+	assertErr(t, err, true)
+
+	if iter.Valid() {
+		t.Errorf("iter.Valid should false")
+	}
+	assertErr(t, iter.Error(), false)
+	testKeyVal(t, iter, "->")
+	if iter.Seek([]byte("k")) {
+		t.Errorf("iter.Seek should false")
+	}
+	assertErr(t, iter.Error(), true)
+
+	assertErr(t, iter2.Error(), false)
+
+	_, err = snap.Get([]byte("k"), h.ro)
+	assertErr(t, err, true)
+
+	_, err = db.GetSnapshot()
+	assertErr(t, err, true)
+
+	iter3 := db.NewIterator(nil, h.ro)
+	assertErr(t, iter3.Error(), true)
+
+	iter3 = snap.NewIterator(nil, h.ro)
+	assertErr(t, iter3.Error(), true)
+
+	assertErr(t, db.Delete([]byte("k"), h.wo), true)
+
+	_, err = db.GetProperty("leveldb.stats")
+	assertErr(t, err, true)
+
+	_, err = db.SizeOf([]util.Range{{[]byte("a"), []byte("z")}})
+	assertErr(t, err, true)
+
+	assertErr(t, db.CompactRange(util.Range{}), true)
+
+	assertErr(t, db.Close(), true)
+}
+
+type numberComparer struct{}
+
+func (numberComparer) num(x []byte) (n int) {
+	fmt.Sscan(string(x[1:len(x)-1]), &n)
+	return
+}
+
+func (numberComparer) Name() string {
+	return "test.NumberComparer"
+}
+
+func (p numberComparer) Compare(a, b []byte) int {
+	return p.num(a) - p.num(b)
+}
+
+func (numberComparer) Separator(dst, a, b []byte) []byte { return nil }
+func (numberComparer) Successor(dst, b []byte) []byte    { return nil }
+
+func TestDB_CustomComparer(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Comparer:                     numberComparer{},
+		WriteBuffer:                  1000,
+	})
+	defer h.close()
+
+	h.put("[10]", "ten")
+	h.put("[0x14]", "twenty")
+	for i := 0; i < 2; i++ {
+		h.getVal("[10]", "ten")
+		h.getVal("[0xa]", "ten")
+		h.getVal("[20]", "twenty")
+		h.getVal("[0x14]", "twenty")
+		h.get("[15]", false)
+		h.get("[0xf]", false)
+		h.compactMem()
+		h.compactRange("[0]", "[9999]")
+	}
+
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 100; i++ {
+			v := fmt.Sprintf("[%d]", i*10)
+			h.put(v, v)
+		}
+		h.compactMem()
+		h.compactRange("[0]", "[1000000]")
+	}
+}
+
+func TestDB_ComparerUpgrade(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteBuffer:                  1000,
+	})
+	defer h.close()
+
+	for i := 0; i < 100; i++ {
+		h.put(fmt.Sprintf("[%d]", i), fmt.Sprintf("v%d", i))
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	for i := 0; i < 100; i += 10 {
+		h.put(fmt.Sprintf("[%d]", i), fmt.Sprintf("w%d", i))
+		h.delete(fmt.Sprintf("[%d]", i+5))
+	}
+	h.compactMem()
+	// Left in the journal.
+	h.put("[7]", "x7")
+	h.delete("[8]")
+	h.closeDB()
+
+	mismatch := func(err error, name string, version uint64, wantName string, wantVersion uint64) {
+		e, ok := err.(*ErrComparerMismatch)
+		if !ok {
+			t.Fatalf("Open: got error %v, want ErrComparerMismatch", err)
+		}
+		if e.Name != name || e.Version != version || e.WantName != wantName || e.WantVersion != wantVersion {
+			t.Errorf("Open: got mismatch %+v", e)
+		}
+	}
+	defaultName := comparer.DefaultComparer.Name()
+	h.o.Comparer = numberComparer{}
+	mismatch(h.openDB0(), defaultName, 0, "test.NumberComparer", 0)
+	h.o.Comparer = nil
+	h.o.ComparerVersion = 1
+	mismatch(h.openDB0(), defaultName, 0, defaultName, 1)
+
+	var called int
+	h.o.Comparer = numberComparer{}
+	h.o.ComparerUpgrade = func(name string, version uint64) bool {
+		called++
+		if name != defaultName || version != 0 {
+			t.Errorf("ComparerUpgrade: got %q version %d", name, version)
+		}
+		return false
+	}
+	h.o.ReadOnly = true
+	mismatch(h.openDB0(), defaultName, 0, "test.NumberComparer", 1)
+	h.o.ReadOnly = false
+	mismatch(h.openDB0(), defaultName, 0, "test.NumberComparer", 1)
+	if called != 1 {
+		t.Fatalf("ComparerUpgrade: called %d times, want 1", called)
+	}
+
+	h.o.ComparerUpgrade = func(name string, version uint64) bool { return true }
+	h.openDB()
+	v := h.db.s.version()
+	if n := len(v.levels[0]); n != 0 {
+		t.Errorf("got %d level-0 tables after upgrade, want 0", n)
+	}
+	v.release()
+	check := func() {
+		var (
+			want []string
+			res  []string
+		)
+		for i := 0; i < 100; i++ {
+			switch {
+			case i%10 == 0:
+				want = append(want, fmt.Sprintf("[%d]=w%d", i, i))
+			case i%10 == 5, i == 8:
+			case i == 7:
+				want = append(want, "[7]=x7")
+			default:
+				want = append(want, fmt.Sprintf("[%d]=v%d", i, i))
+			}
+		}
+		iter := h.db.NewIterator(nil, nil)
+		for iter.Next() {
+			res = append(res, fmt.Sprintf("%s=%s", iter.Key(), iter.Value()))
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			t.Fatal("Iterator: got error: ", err)
+		}
+		if !reflect.DeepEqual(res, want) {
+			t.Fatalf("invalid entries, got=%v want=%v", res, want)
+		}
+		h.getVal("[0x14]", "w20")
+		h.get("[0x19]", false)
+	}
+	check()
+
+	// The new comparer is recorded.
+	h.o.ComparerUpgrade = nil
+	h.reopenDB()
+	check()
+	h.closeDB()
+	h.o.Comparer = nil
+	h.o.ComparerVersion = 0
+	mismatch(h.openDB0(), "test.NumberComparer", 1, defaultName, 0)
+}
+
+func TestDB_ComparerUpgradeRangeDeletion(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("[1]", "v1")
+	h.put("[20]", "v20")
+	if err := h.db.DeleteRange([]byte("[1]"), []byte("[2]"), nil); err != nil {
+		t.Fatal("DeleteRange: got error: ", err)
+	}
+	for i := 0; i < 2; i++ {
+		h.closeDB()
+		h.o.Comparer = numberComparer{}
+		h.o.ComparerUpgrade = func(name string, version uint64) bool { return true }
+		if err := h.openDB0(); err == nil || !strings.Contains(err.Error(), "range deletions") {
+			t.Fatalf("Open: got error %v, want range deletions error", err)
+		}
+		h.o.Comparer = nil
+		h.o.ComparerUpgrade = nil
+		h.openDB()
+		h.get("[1]", false)
+		h.get("[20]", false)
+		h.compactMem()
+	}
+}
+
+func TestDB_CompositeComparer(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Comparer:                     comparer.NewCompositeComparer(8, true),
+		BlockSize:                    256,
+		WriteBuffer:                  4 * opt.KiB,
+	})
+	defer h.close()
+
+	key := func(series string, ts uint64) string {
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, ts)
+		return series + string(b)
+	}
+	series := []string{"cpu", "cpu.idle", "mem"}
+	for ts := uint64(0); ts < 200; ts++ {
+		for _, s := range series {
+			h.put(key(s, ts), fmt.Sprintf("%s@%d", s, ts))
+		}
+	}
+	h.compactMem()
+	h.compactRange("", "")
+
+	for _, s := range series {
+		// Latest first, the keys of a series are contiguous.
+		iter := h.db.NewIterator(&util.Range{Start: []byte(key(s, 1<<64-1)), Limit: []byte(key(s+"\x00", 1<<64-1))}, nil)
+		ts := uint64(200)
+		for iter.Next() {
+			ts--
+			if want := fmt.Sprintf("%s@%d", s, ts); string(iter.Value()) != want {
+				t.Fatalf("Iterator: got %q, want %q", iter.Value(), want)
+			}
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			t.Fatal("Iterator: got error: ", err)
+		}
+		if ts != 0 {
+			t.Fatalf("Iterator: series %q stopped at %d", s, ts)
+		}
+		h.getVal(key(s, 100), fmt.Sprintf("%s@100", s))
+	}
+}
+
+// badSeparatorComparer is the default comparer with a Separator past the
+// next key.
+type badSeparatorComparer struct {
+	comparer.Comparer
+}
+
+func (badSeparatorComparer) Separator(dst, a, b []byte) []byte {
+	return append(dst, b...)
+}
+
+func TestDB_ValidateComparer(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		ValidateComparer:             true,
+	})
+	defer h.close()
+
+	for i := 0; i < 10; i++ {
+		h.put(fmt.Sprintf("k%d", i), "v")
+		h.compactMem()
+	}
+	h.reopenDB()
+	h.closeDB()
+
+	h.o.Comparer = badSeparatorComparer{comparer.DefaultComparer}
+	if err := h.openDB0(); err == nil || !strings.Contains(err.Error(), "Separator") {
+		t.Fatalf("Open: got error %v, want Separator error", err)
+	}
+	h.o.ValidateComparer = false
+	h.openDB()
+	h.getVal("k5", "v")
+}
+
+func TestDB_ManualCompaction(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.db.memdbMaxLevel = 2
+
+	h.putMulti(3, "p", "q")
+	h.tablesPerLevel("1,1,1")
+
+	// Compaction range falls before files
+	h.compactRange("", "c")
+	h.tablesPerLevel("1,1,1")
+
+	// Compaction range falls after files
+	h.compactRange("r", "z")
+	h.tablesPerLevel("1,1,1")
+
+	// Compaction range overlaps files
+	h.compactRange("p1", "p9")
+	h.tablesPerLevel("0,0,1")
+
+	// Populate a different range
+	h.putMulti(3, "c", "e")
+	h.tablesPerLevel("1,1,2")
+
+	// Compact just the new range
+	h.compactRange("b", "f")
+	h.tablesPerLevel("0,0,2")
+
+	// Compact all
+	h.putMulti(1, "a", "z")
+	h.tablesPerLevel("0,1,2")
+	h.compactRange("", "")
+	h.tablesPerLevel("0,0,1")
+}
+
+func TestDB_BloomFilter(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		DisableBlockCache:            true,
+		Filter:                       filter.NewBloomFilter(10),
+	})
+	defer h.close()
+
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
+	}
+
+	const n = 10000
+
+	// Populate multiple layers
+	for i := 0; i < n; i++ {
+		h.put(key(i), key(i))
+	}
+	h.compactMem()
+	h.compactRange("a", "z")
+	for i := 0; i < n; i += 100 {
+		h.put(key(i), key(i))
+	}
+	h.compactMem()
+
+	// Prevent auto compactions triggered by seeks
+	h.stor.Stall(testutil.ModeSync, storage.TypeTable)
+
+	// Lookup present keys. Should rarely read from small sstable.
+	h.stor.ResetCounter(testutil.ModeRead, storage.TypeTable)
+	for i := 0; i < n; i++ {
+		h.getVal(key(i), key(i))
+	}
+	cnt, _ := h.stor.Counter(testutil.ModeRead, storage.TypeTable)
+	t.Logf("lookup of %d present keys yield %d sstable I/O reads", n, cnt)
+	if min, max := n, n+2*n/100; cnt < min || cnt > max {
+		t.Errorf("num of sstable I/O reads of present keys not in range of %d - %d, got %d", min, max, cnt)
+	}
+
+	// Lookup missing keys. Should rarely read from either sstable.
+	h.stor.ResetCounter(testutil.ModeRead, storage.TypeTable)
+	for i := 0; i < n; i++ {
+		h.get(key(i)+".missing", false)
+	}
+	cnt, _ = h.stor.Counter(testutil.ModeRead, storage.TypeTable)
+	t.Logf("lookup of %d missing keys yield %d sstable I/O reads", n, cnt)
+	if max := 3 * n / 100; cnt > max {
+		t.Errorf("num of sstable I/O reads of missing keys was more than %d, got %d", max, cnt)
+	}
+
+	// Existence check of missing keys. Should rarely read from either sstable.
+	h.stor.ResetCounter(testutil.ModeRead, storage.TypeTable)
+	for i := 0; i < n; i++ {
+		if ret, err := h.db.Has([]byte(key(i)+".missing"), h.ro); err != nil {
+			t.Fatalf("Has: got error: %v", err)
+		} else if ret {
+			t.Fatalf("Has: key %q should not exist", key(i)+".missing")
+		}
+	}
+	cnt, _ = h.stor.Counter(testutil.ModeRead, storage.TypeTable)
+	t.Logf("existence check of %d missing keys yield %d sstable I/O reads", n, cnt)
+	if max := 3 * n / 100; cnt > max {
+		t.Errorf("num of sstable I/O reads of missing keys was more than %d, got %d", max, cnt)
+	}
+
+	// Existence check of present keys.
+	for i := 0; i < n; i += 10 {
+		if ret, err := h.db.Has([]byte(key(i)), h.ro); err != nil {
+			t.Fatalf("Has: got error: %v", err)
+		} else if !ret {
+			t.Fatalf("Has: key %q should exist", key(i))
+		}
+	}
+
+	h.stor.Release(testutil.ModeSync, storage.TypeTable)
+}
+
+func TestDB_Concurrent(t *testing.T) {
+	const n, secs, maxkey = 4, 6, 1000
+	h := newDbHarness(t)
+	defer h.close()
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	var (
+		closeWg sync.WaitGroup
+		stop    uint32
+		cnt     [n]uint32
+	)
+
+	for i := 0; i < n; i++ {
+		closeWg.Add(1)
+		go func(i int) {
+			var put, get, found uint
+			defer func() {
+				t.Logf("goroutine %d stopped after %d ops, put=%d get=%d found=%d missing=%d",
+					i, cnt[i], put, get, found, get-found)
+				closeWg.Done()
+			}()
+
+			rnd := rand.New(rand.NewSource(int64(1000 + i)))
+			for atomic.LoadUint32(&stop) == 0 {
+				x := cnt[i]
+
+				k := rnd.Intn(maxkey)
+				kstr := fmt.Sprintf("%016d", k)
+
+				if (rnd.Int() % 2) > 0 {
+					put++
+					h.put(kstr, fmt.Sprintf("%d.%d.%-1000d", k, i, x))
+				} else {
+					get++
+					v, err := h.db.Get([]byte(kstr), h.ro)
+					if err == nil {
+						found++
+						rk, ri, rx := 0, -1, uint32(0)
+						fmt.Sscanf(string(v), "%d.%d.%d", &rk, &ri, &rx)
+						if rk != k {
+							t.Errorf("invalid key want=%d got=%d", k, rk)
+						}
+						if ri < 0 || ri >= n {
+							t.Error("invalid goroutine number: ", ri)
+						} else {
+							tx := atomic.LoadUint32(&(cnt[ri]))
+							if rx > tx {
+								t.Errorf("invalid seq number, %d > %d ", rx, tx)
+							}
+						}
+					} else if err != ErrNotFound {
+						t.Error("Get: got error: ", err)
+						return
+					}
+				}
+				atomic.AddUint32(&cnt[i], 1)
+			}
+		}(i)
+	}
+
+	time.Sleep(secs * time.Second)
+	atomic.StoreUint32(&stop, 1)
+	closeWg.Wait()
+}
+
+func TestDB_ConcurrentIterator(t *testing.T) {
+	const n, n2 = 4, 1000
+	h := newDbHarnessWopt(t, &opt.Options{DisableLargeBatchTransaction: true, WriteBuffer: 30})
+	defer h.close()
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	var (
+		closeWg sync.WaitGroup
+		stop    uint32
+	)
+
+	for i := 0; i < n; i++ {
+		closeWg.Add(1)
+		go func(i int) {
+			for k := 0; atomic.LoadUint32(&stop) == 0; k++ {
+				h.put(fmt.Sprintf("k%d", k), fmt.Sprintf("%d.%d.", k, i)+strings.Repeat("x", 10))
+			}
+			closeWg.Done()
+		}(i)
+	}
+
+	for i := 0; i < n; i++ {
+		closeWg.Add(1)
+		go func(i int) {
+			for k := 1000000; k < 0 || atomic.LoadUint32(&stop) == 0; k-- {
+				h.put(fmt.Sprintf("k%d", k), fmt.Sprintf("%d.%d.", k, i)+strings.Repeat("x", 10))
+			}
+			closeWg.Done()
+		}(i)
+	}
+
+	cmp := comparer.DefaultComparer
+	for i := 0; i < n2; i++ {
+		closeWg.Add(1)
+		go func(i int) {
+			it := h.db.NewIterator(nil, nil)
+			var pk []byte
+			for it.Next() {
+				kk := it.Key()
+				if cmp.Compare(kk, pk) <= 0 {
+					t.Errorf("iter %d: %q is successor of %q", i, pk, kk)
+				}
+				pk = append(pk[:0], kk...)
+				var k, vk, vi int
+				if n, err := fmt.Sscanf(string(it.Key()), "k%d", &k); err != nil {
+					t.Errorf("iter %d: Scanf error on key %q: %v", i, it.Key(), err)
+				} else if n < 1 {
+					t.Errorf("iter %d: Cannot parse key %q", i, it.Key())
+				}
+				if n, err := fmt.Sscanf(string(it.Value()), "%d.%d", &vk, &vi); err != nil {
+					t.Errorf("iter %d: Scanf error on value %q: %v", i, it.Value(), err)
+				} else if n < 2 {
+					t.Errorf("iter %d: Cannot parse value %q", i, it.Value())
+				}
+
+				if vk != k {
+					t.Errorf("iter %d: invalid value i=%d, want=%d got=%d", i, vi, k, vk)
+				}
+			}
+			if err := it.Error(); err != nil {
+				t.Errorf("iter %d: Got error: %v", i, err)
+			}
+			it.Release()
+			closeWg.Done()
+		}(i)
+	}
+
+	atomic.StoreUint32(&stop, 1)
+	closeWg.Wait()
+}
+
+func TestDB_ConcurrentWrite(t *testing.T) {
+	const n, bk, niter = 10, 3, 10000
+	h := newDbHarness(t)
+	defer h.close()
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; k < niter; k++ {
+				kstr := fmt.Sprintf("put-%d.%d", i, k)
+				vstr := fmt.Sprintf("v%d", k)
+				h.put(kstr, vstr)
+				// Key should immediately available after put returns.
+				h.getVal(kstr, vstr)
+			}
+		}(i)
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		batch := &Batch{}
+		go func(i int) {
+			defer wg.Done()
+			for k := 0; k < niter; k++ {
+				batch.Reset()
+				for j := 0; j < bk; j++ {
+					batch.Put([]byte(fmt.Sprintf("batch-%d.%d.%d", i, k, j)), []byte(fmt.Sprintf("v%d", k)))
+				}
+				h.write(batch)
+				// Key should immediately available after put returns.
+				for j := 0; j < bk; j++ {
+					h.getVal(fmt.Sprintf("batch-%d.%d.%d", i, k, j), fmt.Sprintf("v%d", k))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestDB_CreateReopenDbOnFile(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCreateReopenDbOnFile-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	for i := 0; i < 3; i++ {
+		stor, err := storage.OpenFile(dbpath, false)
+		if err != nil {
+			t.Fatalf("(%d) cannot open storage: %s", i, err)
+		}
+		db, err := Open(stor, nil)
+		if err != nil {
+			t.Fatalf("(%d) cannot open db: %s", i, err)
+		}
+		if err := db.Put([]byte("foo"), []byte("bar"), nil); err != nil {
+			t.Fatalf("(%d) cannot write to db: %s", i, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("(%d) cannot close db: %s", i, err)
+		}
+		if err := stor.Close(); err != nil {
+			t.Fatalf("(%d) cannot close storage: %s", i, err)
+		}
+	}
+}
+
+func TestDB_CreateReopenDbOnFile2(t *testing.T) {
+	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCreateReopenDbOnFile2-%d", os.Getuid()))
+	if err := os.RemoveAll(dbpath); err != nil {
+		t.Fatal("cannot remove old db: ", err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	for i := 0; i < 3; i++ {
+		db, err := OpenFile(dbpath, nil)
+		if err != nil {
+			t.Fatalf("(%d) cannot open db: %s", i, err)
+		}
+		if err := db.Put([]byte("foo"), []byte("bar"), nil); err != nil {
+			t.Fatalf("(%d) cannot write to db: %s", i, err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatalf("(%d) cannot close db: %s", i, err)
+		}
+	}
+}
+
+func TestDB_DeletionMarkersOnMemdb(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.compactMem()
+	h.delete("foo")
+	h.get("foo", false)
+	h.getKeyVal("")
+}
+
+func TestDB_LeveldbIssue178(t *testing.T) {
+	nKeys := (opt.DefaultCompactionTableSize / 30) * 5
+	key1 := func(i int) string {
+		return fmt.Sprintf("my_key_%d", i)
+	}
+	key2 := func(i int) string {
+		return fmt.Sprintf("my_key_%d_xxx", i)
+	}
+
+	// Disable compression since it affects the creation of layers and the
+	// code below is trying to test against a very specific scenario.
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	// Create first key range.
+	batch := new(Batch)
+	for i := 0; i < nKeys; i++ {
+		batch.Put([]byte(key1(i)), []byte("value for range 1 key"))
+	}
+	h.write(batch)
+
+	// Create second key range.
+	batch.Reset()
+	for i := 0; i < nKeys; i++ {
+		batch.Put([]byte(key2(i)), []byte("value for range 2 key"))
+	}
+	h.write(batch)
+
+	// Delete second key range.
+	batch.Reset()
+	for i := 0; i < nKeys; i++ {
+		batch.Delete([]byte(key2(i)))
+	}
+	h.write(batch)
+	h.waitMemCompaction()
+
+	// Run manual compaction.
+	h.compactRange(key1(0), key1(nKeys-1))
+
+	// Checking the keys.
+	h.assertNumKeys(nKeys)
+}
+
+func TestDB_LeveldbIssue200(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("1", "b")
+	h.put("2", "c")
+	h.put("3", "d")
+	h.put("4", "e")
+	h.put("5", "f")
+
+	iter := h.db.NewIterator(nil, h.ro)
+
+	// Add an element that should not be reflected in the iterator.
+	h.put("25", "cd")
+
+	iter.Seek([]byte("5"))
+	assertBytes(t, []byte("5"), iter.Key())
+	iter.Prev()
+	assertBytes(t, []byte("4"), iter.Key())
+	iter.Prev()
+	assertBytes(t, []byte("3"), iter.Key())
+	iter.Next()
+	assertBytes(t, []byte("4"), iter.Key())
+	iter.Next()
+	assertBytes(t, []byte("5"), iter.Key())
+}
+
+func TestDB_GoleveldbIssue74(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteBuffer:                  1 * opt.MiB,
+	})
+	defer h.close()
+
+	const n, dur = 10000, 5 * time.Second
+
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	until := time.Now().Add(dur)
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	var done uint32
+	go func() {
+		var i int
+		defer func() {
+			t.Logf("WRITER DONE #%d", i)
+			atomic.StoreUint32(&done, 1)
+			wg.Done()
+		}()
+
+		b := new(Batch)
+		for ; time.Now().Before(until) && atomic.LoadUint32(&done) == 0; i++ {
+			iv := fmt.Sprintf("VAL%010d", i)
+			for k := 0; k < n; k++ {
+				key := fmt.Sprintf("KEY%06d", k)
+				b.Put([]byte(key), []byte(key+iv))
+				b.Put([]byte(fmt.Sprintf("PTR%06d", k)), []byte(key))
+			}
+			h.write(b)
+
+			b.Reset()
+			snap := h.getSnapshot()
+			iter := snap.NewIterator(util.BytesPrefix([]byte("PTR")), nil)
+			var k int
+			for ; iter.Next(); k++ {
+				ptrKey := iter.Key()
+				key := iter.Value()
+
+				if _, err := snap.Get(ptrKey, nil); err != nil {
+					t.Fatalf("WRITER #%d snapshot.Get %q: %v", i, ptrKey, err)
+				}
+				if value, err := snap.Get(key, nil); err != nil {
+					t.Fatalf("WRITER #%d snapshot.Get %q: %v", i, key, err)
+				} else if string(value) != string(key)+iv {
+					t.Fatalf("WRITER #%d snapshot.Get %q got invalid value, want %q got %q", i, key, string(key)+iv, value)
+				}
+
+				b.Delete(key)
+				b.Delete(ptrKey)
+			}
+			h.write(b)
+			iter.Release()
+			snap.Release()
+			if k != n {
+				t.Fatalf("#%d %d != %d", i, k, n)
+			}
+		}
+	}()
+	go func() {
+		var i int
+		defer func() {
+			t.Logf("READER DONE #%d", i)
+			atomic.StoreUint32(&done, 1)
+			wg.Done()
+		}()
+		for ; time.Now().Before(until) && atomic.LoadUint32(&done) == 0; i++ {
+			snap := h.getSnapshot()
+			iter := snap.NewIterator(util.BytesPrefix([]byte("PTR")), nil)
+			var prevValue string
+			var k int
+			for ; iter.Next(); k++ {
+				ptrKey := iter.Key()
+				key := iter.Value()
+
+				if _, err := snap.Get(ptrKey, nil); err != nil {
+					t.Fatalf("READER #%d snapshot.Get %q: %v", i, ptrKey, err)
+				}
+
+				if value, err := snap.Get(key, nil); err != nil {
+					t.Fatalf("READER #%d snapshot.Get %q: %v", i, key, err)
+				} else if prevValue != "" && string(value) != string(key)+prevValue {
+					t.Fatalf("READER #%d snapshot.Get %q got invalid value, want %q got %q", i, key, string(key)+prevValue, value)
+				} else {
+					prevValue = string(value[len(key):])
+				}
+			}
+			iter.Release()
+			snap.Release()
+			if k > 0 && k != n {
+				t.Fatalf("#%d %d != %d", i, k, n)
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+type countingCompressor struct {
+	encoded int32
+}
+
+func (c *countingCompressor) Encode(dst, src []byte) ([]byte, error) {
+	atomic.AddInt32(&c.encoded, 1)
+	return append(dst, src...), nil
+}
+
+func (c *countingCompressor) Decode(dst, src []byte) ([]byte, error) {
+	return append(dst[:0], src...), nil
+}
+
+func TestDB_CompressionPerLevel(t *testing.T) {
+	uc := opt.UserCompression(1)
+	if _, err := Open(storage.NewMemStorage(), &opt.Options{CompressionPerLevel: []opt.Compression{opt.NoCompression, uc}}); err == nil {
+		t.Fatal("Open: expecting error for missing compressor")
+	}
+	for _, o := range []*opt.Options{
+		{Compression: opt.ZstdCompression},
+		{CompressionPerLevel: []opt.Compression{opt.NoCompression, opt.LZ4Compression}},
+		{Compression: opt.UserCompression(opt.MaxUserCompressionID + 1)},
+	} {
+		if db, err := Open(storage.NewMemStorage(), o); err == nil {
+			db.Close()
+			t.Errorf("Open(%+v): expecting error for compression that can't be written", o)
+		}
+	}
+
+	c := &countingCompressor{}
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompressionPerLevel:          []opt.Compression{opt.NoCompression, uc},
+		Compressors:                  map[opt.Compression]opt.Compressor{uc: c},
+	})
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.put("bar", "v1")
+	h.compactMem()
+	h.tablesPerLevel("1")
+	if n := atomic.LoadInt32(&c.encoded); n != 0 {
+		t.Errorf("level-0 table is compressed using %v: N=%d", uc, n)
+	}
+
+	h.compactRangeAt(0, "", "")
+	h.tablesPerLevel("0,1")
+	if n := atomic.LoadInt32(&c.encoded); n == 0 {
+		t.Errorf("level-1 table is not compressed using %v", uc)
+	}
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v1")
+
+	h.reopenDB()
+	h.getVal("foo", "v1")
+}
+
+func TestDB_NumLevel(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		NumLevel:                     2,
+		CompactionTotalSizePerLevel:  []int64{0, 1},
+	})
+	defer h.close()
+	h.db.memdbMaxLevel = 2
+
+	h.put("a", "v1")
+	h.put("b", "v1")
+	h.compactMem()
+	h.tablesPerLevel("0,1")
+
+	h.put("a", "v2")
+	h.put("c", "v2")
+	h.compactMem()
+	h.tablesPerLevel("1,1")
+
+	h.compactRange("", "")
+	h.tablesPerLevel("0,1")
+
+	// Level-1 exceeds its limit, but it is the last level.
+	h.waitCompaction()
+	h.compactRangeAt(1, "", "")
+	h.tablesPerLevel("0,1")
+
+	h.getVal("a", "v2")
+	h.getVal("b", "v1")
+	h.getVal("c", "v2")
+}
+
+func TestDB_CompactRangeWithOptions(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	compact := func(min, max string, o *opt.CompactionOptions) {
+		var r util.Range
+		if min != "" {
+			r.Start = []byte(min)
+		}
+		if max != "" {
+			r.Limit = []byte(max)
+		}
+		if err := h.db.CompactRangeWithOptions(r, o); err != nil {
+			t.Fatal("CompactRangeWithOptions: got error: ", err)
+		}
+	}
+	tableNums := func(level int) (nums []int64) {
+		v := h.db.s.version()
+		defer v.release()
+		for _, t := range v.levels[level] {
+			nums = append(nums, t.fd.Num)
+		}
+		return
+	}
+
+	h.put("a", "v1")
+	h.put("b", "v1")
+	compact("", "", &opt.CompactionOptions{TargetLevel: 3, Exclusive: true})
+	h.tablesPerLevel("0,0,0,1")
+
+	// Move non-overlapping table down without rewriting it.
+	h.put("c", "v1")
+	h.put("d", "v1")
+	h.compactMem()
+	h.tablesPerLevel("1,0,0,1")
+	num := tableNums(0)[0]
+	compact("", "", &opt.CompactionOptions{TargetLevel: 2, MoveOnly: true})
+	h.tablesPerLevel("0,0,1,1")
+	if nums := tableNums(2); nums[0] != num {
+		t.Errorf("table is rewritten: want=%d got=%d", num, nums[0])
+	}
+	compact("", "", &opt.CompactionOptions{MoveOnly: true})
+	h.tablesPerLevel("0,0,0,2")
+
+	// Overlapping table is moved down only as far as possible.
+	h.put("d", "v2")
+	h.compactMem()
+	h.tablesPerLevel("1,0,0,2")
+	compact("", "", &opt.CompactionOptions{MoveOnly: true})
+	h.tablesPerLevel("0,0,1,2")
+
+	compact("", "", nil)
+	h.tablesPerLevel("0,0,0,2")
+	h.getVal("a", "v1")
+	h.getVal("c", "v1")
+	h.getVal("d", "v2")
+}
+
+type testCompactionFilter struct{}
+
+func (testCompactionFilter) Name() string { return "test" }
+
+func (testCompactionFilter) Filter(level int, key, value []byte) (opt.CompactionFilterDecision, []byte) {
+	switch string(value) {
+	case "expired":
+		return opt.CompactionFilterRemove, nil
+	case "old":
+		return opt.CompactionFilterChange, []byte("new")
+	}
+	return opt.CompactionFilterKeep, nil
+}
+
+func TestDB_CompactionFilter(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionFilter:             testCompactionFilter{},
+	})
+	defer h.close()
+
+	h.put("a", "v1")
+	snap := h.getSnapshot()
+	h.put("a", "expired")
+	h.put("b", "old")
+	h.put("c", "v1")
+
+	// Entries newer than live snapshots are not filtered.
+	h.compactMem()
+	h.compactRange("", "")
+	h.tablesPerLevel("0,1")
+	h.getVal("a", "expired")
+	h.getVal("b", "old")
+	h.getValr(snap, "a", "v1")
+	snap.Release()
+
+	h.compactRangeAt(1, "", "")
+	h.tablesPerLevel("0,0,1")
+	h.get("a", false)
+	h.getVal("b", "new")
+	h.getVal("c", "v1")
+}
+
+func TestDB_SyncWAL(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	syncs := func(want int) {
+		if n, _ := h.stor.Counter(testutil.ModeSync, storage.TypeJournal); n != want {
+			t.Errorf("invalid journal sync count: want=%d got=%d", want, n)
+		}
+	}
+
+	h.stor.ResetCounter(testutil.ModeSync, storage.TypeJournal)
+	h.put("foo", "v1")
+	syncs(0)
+	if err := h.db.SyncWAL(); err != nil {
+		t.Fatal("SyncWAL: got error: ", err)
+	}
+	syncs(1)
+	if err := h.db.SyncWAL(); err != nil {
+		t.Fatal("SyncWAL: got error: ", err)
+	}
+	syncs(1)
+
+	// Unsynced journal is synced before frozen.
+	h.put("foo", "v2")
+	h.compactMem()
+	syncs(2)
+
+	h.db.Close()
+	if err := h.db.SyncWAL(); err != ErrClosed {
+		t.Errorf("SyncWAL: want=%v got=%v", ErrClosed, err)
+	}
+}
+
+func TestDB_JournalSyncInterval(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		JournalSyncInterval:          10 * time.Millisecond,
+	})
+	defer h.close()
+
+	h.stor.ResetCounter(testutil.ModeSync, storage.TypeJournal)
+	h.put("foo", "v1")
+	time.Sleep(100 * time.Millisecond)
+	h.closeDB()
+	if n, _ := h.stor.Counter(testutil.ModeSync, storage.TypeJournal); n != 1 {
+		t.Errorf("invalid journal sync count: want=%d got=%d", 1, n)
+	}
+}
+
+func TestDB_JournalBlockSize(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		JournalBlockSize:             4 * opt.KiB,
+		JournalPreallocateSize:       opt.MiB,
+	})
+	defer h.close()
+
+	for i := 0; i < 20; i++ {
+		h.put(fmt.Sprintf("k%02d", i), strings.Repeat(fmt.Sprintf("v%02d", i), 2000))
+	}
+
+	// The journal is recovered with the same block size.
+	h.reopenDB()
+	for i := 0; i < 20; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), strings.Repeat(fmt.Sprintf("v%02d", i), 2000))
+	}
+
+	// Chunks of a journal written with a larger block size cross the
+	// blocks of a smaller one.
+	h.closeDB()
+	h.o.JournalBlockSize = 0
+	h.openDB()
+	for i := 20; i < 40; i++ {
+		h.put(fmt.Sprintf("k%02d", i), strings.Repeat(fmt.Sprintf("v%02d", i), 2000))
+	}
+	h.closeDB()
+	h.o.JournalBlockSize = 4 * opt.KiB
+	h.o.WALRecoveryMode = opt.WALAbsoluteConsistency
+	if err := h.openDB0(); !errors.IsCorrupted(err) {
+		t.Fatalf("Open with smaller block size: got error %v, want corrupted error", err)
+	}
+	h.o.JournalBlockSize = 0
+	h.openDB()
+	for i := 0; i < 40; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), strings.Repeat(fmt.Sprintf("v%02d", i), 2000))
+	}
+}
+
+func TestDB_JournalRecycle(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		JournalRecycle:               1,
+	})
+	defer h.close()
+
+	h.stor.ResetCounter(testutil.ModeCreate|testutil.ModeRename, storage.TypeJournal)
+	for i := 0; i < 20; i++ {
+		h.put(fmt.Sprintf("k%02d", i), strings.Repeat("x", 1000))
+	}
+	h.compactMem()
+
+	// The journal written first is reused, its stale records must not be
+	// recovered over the records written since.
+	h.put("k00", "v00")
+	h.delete("k01")
+	h.compactMem()
+	h.put("k02", "v02")
+	h.delete("k03")
+	if n, _ := h.stor.Counter(testutil.ModeCreate, storage.TypeJournal); n != 1 {
+		t.Errorf("invalid journal create count: got %d, want 1", n)
+	}
+	if n, _ := h.stor.Counter(testutil.ModeRename, storage.TypeJournal); n != 1 {
+		t.Errorf("invalid journal recycle count: got %d, want 1", n)
+	}
+
+	h.reopenDB()
+	h.getVal("k00", "v00")
+	h.get("k01", false)
+	h.getVal("k02", "v02")
+	h.get("k03", false)
+	h.getVal("k04", strings.Repeat("x", 1000))
+
+	// Recycled journals are removed if the DB is closed.
+	h.closeDB()
+	h.o.JournalRecycle = 0
+	h.openDB()
+	h.getVal("k02", "v02")
+	h.get("k03", false)
+}
+
+func TestDB_GetMany(t *testing.T) {
+	trun(t, func(h *dbHarness) {
+		h.put("a", "v1")
+		h.put("c", "v1")
+		h.put("d", "v1")
+		h.compactMem()
+		h.put("b", "v2")
+		h.put("c", "v2")
+		h.delete("d")
+		h.put("e1", "v2")
+		h.deleteRange("e", "e2")
+		h.put("e2", "v2")
+
+		// Empty value means not found.
+		keys := []string{"e2", "d", "a", "x", "c", "e1", "b", "a"}
+		want := []string{"v2", "", "v1", "", "v2", "", "v2", "v1"}
+		bkeys := make([][]byte, len(keys))
+		for i, key := range keys {
+			bkeys[i] = []byte(key)
+		}
+		values, errs := h.db.GetMany(bkeys, h.ro)
+		for i, key := range keys {
+			switch {
+			case want[i] == "" && errs[i] != ErrNotFound:
+				t.Errorf("key %q: want=%v got=%v", key, ErrNotFound, errs[i])
+			case want[i] != "" && (errs[i] != nil || string(values[i]) != want[i]):
+				t.Errorf("key %q: want=%q got=%q err=%v", key, want[i], values[i], errs[i])
+			}
+		}
+	})
+}
+
+func TestDB_WriteMergeOptions(t *testing.T) {
+	test := func(separateSync bool, want int) {
+		h := newDbHarnessWopt(t, &opt.Options{
+			DisableLargeBatchTransaction: true,
+			WriteMergeMaxWait:            100 * time.Millisecond,
+			WriteMergeSeparateSync:       separateSync,
+		})
+		defer h.close()
+
+		h.stor.ResetCounter(testutil.ModeWrite, storage.TypeJournal)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			h.put("foo", "v1")
+		}()
+		// Let the first write take the write lock.
+		time.Sleep(20 * time.Millisecond)
+		go func() {
+			defer wg.Done()
+			if err := h.db.Put([]byte("bar"), []byte("v1"), &opt.WriteOptions{Sync: true}); err != nil {
+				t.Error("Put: got error: ", err)
+			}
+		}()
+		wg.Wait()
+
+		if n, _ := h.stor.Counter(testutil.ModeWrite, storage.TypeJournal); n != want {
+			t.Errorf("invalid journal write count: separateSync=%v want=%d got=%d", separateSync, want, n)
+		}
+		h.getVal("foo", "v1")
+		h.getVal("bar", "v1")
+	}
+
+	test(false, 1)
+	test(true, 2)
+}
+
+func TestDB_PipelinedWrite(t *testing.T) {
+	const n, m, wb = 8, 500, 64 * opt.KiB
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		PipelinedWrite:               true,
+		WriteBuffer:                  wb,
+	})
+	defer h.close()
+
+	value := bytes.Repeat([]byte{'v'}, 512)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			wo := &opt.WriteOptions{Sync: i%2 == 0}
+			for j := 0; j < m; j++ {
+				key := []byte(fmt.Sprintf("%d.%03d", i, j))
+				if err := h.db.Put(key, append(key, value...), wo); err != nil {
+					t.Error("Put: got error: ", err)
+					return
+				}
+				if v, err := h.db.Get(key, nil); err != nil || !bytes.Equal(v, append(key, value...)) {
+					t.Errorf("Get %q: got value=%q err=%v", key, v, err)
+					return
+				}
+				// The memdb is rotated once it reaches the threshold,
+				// including by pipelined writes.
+				if mdb := h.db.getEffectiveMem(); mdb != nil {
+					size := mdb.Size()
+					mdb.decref()
+					if size > wb {
+						t.Errorf("memdb size %d exceeds write buffer %d", size, wb)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if seq := h.db.getSeq(); seq != n*m {
+		t.Errorf("invalid seq number: want=%d got=%d", n*m, seq)
+	}
+	h.reopenDB()
+	for i := 0; i < n; i++ {
+		for j := 0; j < m; j++ {
+			key := fmt.Sprintf("%d.%03d", i, j)
+			h.getVal(key, key+string(value))
+		}
+	}
+}
+
+func TestDB_PipelinedWriteConcurrentInsert(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+	const n, m = 8, 300
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		PipelinedWrite:               true,
+		WriteBuffer:                  256 * opt.KiB,
+		// The writes are passed the lock rather than merged.
+		WriteMergeLimit: 1,
+	})
+	defer h.close()
+
+	// Each batch sets both keys of its writer to the same value, the
+	// batches inserted concurrently must only be seen as a whole.
+	var (
+		wg      sync.WaitGroup
+		done    = make(chan struct{})
+		readers sync.WaitGroup
+	)
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				snap, err := h.db.GetSnapshot()
+				if err != nil {
+					t.Error("GetSnapshot: got error: ", err)
+					return
+				}
+				for i := 0; i < n; i++ {
+					a, aerr := snap.Get([]byte(fmt.Sprintf("a%d", i)), nil)
+					b, berr := snap.Get([]byte(fmt.Sprintf("b%d", i)), nil)
+					if aerr != berr || !bytes.Equal(a, b) {
+						t.Errorf("writer %d: got a=%q (%v) b=%q (%v)", i, a, aerr, b, berr)
+					}
+				}
+				snap.Release()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			batch := new(Batch)
+			for j := 0; j < m; j++ {
+				v := []byte(fmt.Sprintf("%d.%03d", i, j))
+				batch.Reset()
+				batch.Put([]byte(fmt.Sprintf("a%d", i)), v)
+				batch.Put([]byte(fmt.Sprintf("b%d", i)), v)
+				if err := h.db.Write(batch, nil); err != nil {
+					t.Error("Write: got error: ", err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	if seq := h.db.getSeq(); seq != 2*n*m {
+		t.Errorf("invalid seq number: want=%d got=%d", 2*n*m, seq)
+	}
+	for i := 0; i < n; i++ {
+		v := fmt.Sprintf("%d.%03d", i, m-1)
+		h.getVal(fmt.Sprintf("a%d", i), v)
+		h.getVal(fmt.Sprintf("b%d", i), v)
+	}
+}
+
+func TestDB_ValueLog(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		ValueLogThreshold:            100,
+		ValueLogGCRatio:              0.3,
+	})
+	defer h.close()
+
+	vlogs := func() map[int64]bool {
+		fds, err := h.stor.List(storage.TypeValueLog)
+		if err != nil {
+			t.Fatal("List: got error: ", err)
+		}
+		m := make(map[int64]bool)
+		for _, fd := range fds {
+			m[fd.Num] = true
+		}
+		return m
 	}
-	db.releaseSnapshot(e2)
-	if db.minSeq() != 2 {
-		t.Fatalf("invalid sequence number, got=%d", db.minSeq())
+	large := func(s string) string {
+		return strings.Repeat(s, 100)
 	}
-}
 
-func TestDB_HiddenValuesAreRemoved(t *testing.T) {
-	trun(t, func(h *dbHarness) {
-		s := h.db.s
+	h.put("a", large("a1"))
+	h.put("b", "v1")
+	h.put("c", large("c1"))
+	h.put("d", large("d1"))
+	h.compactMem()
+	first := vlogs()
+	if len(first) != 1 {
+		t.Fatalf("invalid value log count after flush: want=1 got=%d", len(first))
+	}
+	h.allEntriesFor("a", "[ "+large("a1")+" ]")
+	h.getVal("b", "v1")
+	h.getVal("c", large("c1"))
 
-		m := 2
-		h.db.memdbMaxLevel = m
+	// Value pointers are copied as is by compaction.
+	h.compactRange("", "")
+	h.tablesPerLevel("0,1")
+	h.reopenDB()
+	if got := vlogs(); len(got) != 1 {
+		t.Fatalf("invalid value log count after compaction: want=1 got=%d", len(got))
+	}
+	h.getKeyVal(fmt.Sprintf("(a->%s)(b->v1)(c->%s)(d->%s)", large("a1"), large("c1"), large("d1")))
 
-		h.put("foo", "v1")
-		h.compactMem()
-		v := s.version()
-		num := v.tLen(m)
-		v.release()
-		if num != 1 {
-			t.Errorf("invalid level-%d len, want=1 got=%d", m, num)
+	// Most of the first value log becomes garbage, the remaining value is
+	// relocated and the value log is removed.
+	h.put("a", large("a2"))
+	h.put("c", "v2")
+	h.compactMem()
+	h.compactRange("", "")
+	h.waitCompaction()
+	for num := range first {
+		if vlogs()[num] {
+			t.Errorf("value log @%d is not collected", num)
 		}
+	}
+	h.getKeyVal(fmt.Sprintf("(a->%s)(b->v1)(c->v2)(d->%s)", large("a2"), large("d1")))
 
-		// Place a table at level last-1 to prevent merging with preceding mutation
-		h.put("a", "begin")
-		h.put("z", "end")
-		h.compactMem()
-		v = s.version()
-		if v.tLen(m) != 1 {
-			t.Errorf("invalid level-%d len, want=1 got=%d", m, v.tLen(m))
-		}
-		if v.tLen(m-1) != 1 {
-			t.Errorf("invalid level-%d len, want=1 got=%d", m-1, v.tLen(m-1))
-		}
-		v.release()
+	// Checkpoint copies the referenced value logs.
+	h.reopenDB()
+	stor := testutil.NewStorage()
+	defer stor.Close()
+	if err := h.db.Checkpoint(stor); err != nil {
+		t.Fatal("Checkpoint: got error: ", err)
+	}
+	db, err := Open(stor, h.o)
+	if err != nil {
+		t.Fatal("Open (checkpoint): got error: ", err)
+	}
+	h.getValr(db, "a", large("a2"))
+	h.getValr(db, "d", large("d1"))
+	db.Close()
 
-		h.delete("foo")
-		h.put("foo", "v2")
-		h.allEntriesFor("foo", "[ v2, DEL, v1 ]")
-		h.compactMem()
-		h.allEntriesFor("foo", "[ v2, DEL, v1 ]")
-		h.compactRangeAt(m-2, "", "z")
-		// DEL eliminated, but v1 remains because we aren't compacting that level
-		// (DEL can be eliminated because v2 hides v1).
-		h.allEntriesFor("foo", "[ v2, v1 ]")
-		h.compactRangeAt(m-1, "", "")
-		// Merging last-1 w/ last, so we are the base level for "foo", so
-		// DEL is removed.  (as is v1).
-		h.allEntriesFor("foo", "[ v2 ]")
-	})
+	h.getVal("a", large("a2"))
+	h.getVal("c", "v2")
+	h.getVal("d", large("d1"))
 }
 
-func TestDB_DeletionMarkers2(t *testing.T) {
-	h := newDbHarness(t)
+func TestDB_ValueLogDiscardPersisted(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		ValueLogThreshold:            100,
+		ValueLogGCRatio:              0.5,
+	})
 	defer h.close()
-	s := h.db.s
 
-	m := 2
-	h.db.memdbMaxLevel = m
-
-	h.put("foo", "v1")
+	large := func(s string) string {
+		return strings.Repeat(s, 100)
+	}
+	h.put("a", large("a1"))
+	h.put("b", large("b1"))
+	h.put("c", large("c1"))
 	h.compactMem()
-	v := s.version()
-	num := v.tLen(m)
-	v.release()
-	if num != 1 {
-		t.Errorf("invalid level-%d len, want=1 got=%d", m, num)
+	fds, err := h.stor.List(storage.TypeValueLog)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	if len(fds) != 1 {
+		t.Fatalf("invalid value log count after flush: want=1 got=%d", len(fds))
 	}
+	num := fds[0].Num
+	h.compactRange("", "")
 
-	// Place a table at level last-1 to prevent merging with preceding mutation
-	h.put("a", "begin")
-	h.put("z", "end")
+	// A third of the value log is discarded, below the ratio.
+	h.put("a", "v2")
 	h.compactMem()
-	v = s.version()
-	if v.tLen(m) != 1 {
-		t.Errorf("invalid level-%d len, want=1 got=%d", m, v.tLen(m))
+	h.compactRange("", "")
+	discard := h.db.s.tops.vlogDiscarded(num)
+	if discard == 0 {
+		t.Fatal("discarded bytes not recorded")
 	}
-	if v.tLen(m-1) != 1 {
-		t.Errorf("invalid level-%d len, want=1 got=%d", m-1, v.tLen(m-1))
+	for i := 0; i < 2; i++ {
+		h.reopenDB()
+		if got := h.db.s.tops.vlogDiscarded(num); got != discard {
+			t.Fatalf("invalid discarded bytes after reopen #%d: want=%d got=%d", i, discard, got)
+		}
 	}
-	v.release()
 
-	h.delete("foo")
-	h.allEntriesFor("foo", "[ DEL, v1 ]")
-	h.compactMem() // Moves to level last-2
-	h.allEntriesFor("foo", "[ DEL, v1 ]")
-	h.compactRangeAt(m-2, "", "")
-	// DEL kept: "last" file overlaps
-	h.allEntriesFor("foo", "[ DEL, v1 ]")
-	h.compactRangeAt(m-1, "", "")
-	// Merging last-1 w/ last, so we are the base level for "foo", so
-	// DEL is removed.  (as is v1).
-	h.allEntriesFor("foo", "[ ]")
+	// The discarded bytes of the former session add up to the ratio.
+	h.put("b", "v2")
+	h.compactMem()
+	h.compactRange("", "")
+	h.waitCompaction()
+	if _, err := h.stor.Open(storage.FileDesc{Type: storage.TypeValueLog, Num: num}); !os.IsNotExist(err) {
+		t.Errorf("value log @%d is not collected", num)
+	}
+	h.getKeyVal(fmt.Sprintf("(a->v2)(b->v2)(c->%s)", large("c1")))
 }
 
-func TestDB_CompactionTableOpenError(t *testing.T) {
+func TestDB_MmapRead(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
-		OpenFilesCacheCapacity:       -1,
+		MmapRead:                     true,
+		Compression:                  opt.NoCompression,
+		OpenFilesCacheCapacity:       2,
 	})
 	defer h.close()
 
-	h.db.memdbMaxLevel = 2
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 100; j++ {
+			h.put(fmt.Sprintf("%d%03d", i, j), fmt.Sprintf("v%d.%d", i, j))
+		}
+		h.compactMem()
+	}
 
-	im := 10
-	jm := 10
-	for r := 0; r < 2; r++ {
-		for i := 0; i < im; i++ {
-			for j := 0; j < jm; j++ {
-				h.put(fmt.Sprintf("k%d,%d", i, j), fmt.Sprintf("v%d,%d", i, j))
+	// Tables are evicted and reopened while their blocks are cached.
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 5; i++ {
+			for j := 0; j < 100; j += 7 {
+				h.getVal(fmt.Sprintf("%d%03d", i, j), fmt.Sprintf("v%d.%d", i, j))
 			}
-			h.compactMem()
 		}
 	}
+	h.assertNumKeys(500)
 
-	if n := h.totalTables(); n != im*2 {
-		t.Errorf("total tables is %d, want %d", n, im*2)
-	}
+	h.compactRange("", "")
+	h.reopenDB()
+	h.getVal("0000", "v0.0")
+	h.getVal("4099", "v4.99")
+	h.assertNumKeys(500)
+}
 
-	h.stor.EmulateError(testutil.ModeOpen, storage.TypeTable, errors.New("open error during table compaction"))
-	go h.db.CompactRange(util.Range{})
-	if err := h.db.compTriggerWait(h.db.tcompCmdC); err != nil {
-		t.Log("compaction error: ", err)
-	}
-	h.closeDB0()
-	h.openDB()
-	h.stor.EmulateError(testutil.ModeOpen, storage.TypeTable, nil)
+func TestDB_Flush(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
 
-	for i := 0; i < im; i++ {
-		for j := 0; j < jm; j++ {
-			h.getVal(fmt.Sprintf("k%d,%d", i, j), fmt.Sprintf("v%d,%d", i, j))
+	flush := func(wait bool) {
+		if err := h.db.Flush(wait); err != nil {
+			t.Fatal("Flush: got error: ", err)
+		}
+	}
+	tables := func(want int) {
+		if n := h.totalTables(); n != want {
+			t.Errorf("invalid table count: want=%d got=%d", want, n)
 		}
 	}
-}
 
-func TestDB_OverlapInLevel0(t *testing.T) {
-	trun(t, func(h *dbHarness) {
-		h.db.memdbMaxLevel = 2
+	// Empty memdb is not flushed.
+	flush(true)
+	tables(0)
 
-		// Fill levels 1 and 2 to disable the pushing of new memtables to levels > 0.
-		h.put("100", "v100")
-		h.put("999", "v999")
-		h.compactMem()
-		h.delete("100")
-		h.delete("999")
-		h.compactMem()
-		h.tablesPerLevel("0,1,1")
+	h.put("foo", "v1")
+	flush(true)
+	tables(1)
+	h.getVal("foo", "v1")
 
-		// Make files spanning the following ranges in level-0:
-		//  files[0]  200 .. 900
-		//  files[1]  300 .. 500
-		// Note that files are sorted by min key.
-		h.put("300", "v300")
-		h.put("500", "v500")
-		h.compactMem()
-		h.put("200", "v200")
-		h.put("600", "v600")
-		h.put("900", "v900")
-		h.compactMem()
-		h.tablesPerLevel("2,1,1")
+	h.put("bar", "v1")
+	flush(false)
+	h.waitMemCompaction()
+	tables(2)
+	h.getVal("bar", "v1")
 
-		// Compact away the placeholder files we created initially
-		h.compactRangeAt(1, "", "")
-		h.compactRangeAt(2, "", "")
-		h.tablesPerLevel("2")
+	h.reopenDB()
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v1")
 
-		// Do a memtable compaction.  Before bug-fix, the compaction would
-		// not detect the overlap with level-0 files and would incorrectly place
-		// the deletion in a deeper level.
-		h.delete("600")
-		h.compactMem()
-		h.tablesPerLevel("3")
-		h.get("600", false)
-	})
+	h.db.Close()
+	if err := h.db.Flush(true); err != ErrClosed {
+		t.Errorf("Flush: want=%v got=%v", ErrClosed, err)
+	}
 }
 
-func TestDB_L0_CompactionBug_Issue44_a(t *testing.T) {
-	h := newDbHarness(t)
+func TestDB_PartitionedFilter(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Filter:                       filter.NewBloomFilter(10),
+		FilterBitsPerKeyPerLevel:     []int{0, 20},
+		FilterPartitionSize:          256,
+	})
 	defer h.close()
 
-	h.reopenDB()
-	h.put("b", "v")
-	h.reopenDB()
-	h.delete("b")
-	h.delete("a")
-	h.reopenDB()
-	h.delete("a")
-	h.reopenDB()
-	h.put("a", "v")
-	h.reopenDB()
-	h.reopenDB()
-	h.getKeyVal("(a->v)")
-	h.waitCompaction()
-	h.getKeyVal("(a->v)")
-}
+	if o0, o1 := h.db.s.o.tableOptions(0), h.db.s.o.tableOptions(1); o0.GetFilter() != h.db.s.o.GetFilter() || o1.GetFilter() == o0.GetFilter() {
+		t.Fatal("per-level bloom filter bits-per-key is not applied")
+	}
 
-func TestDB_L0_CompactionBug_Issue44_b(t *testing.T) {
-	h := newDbHarness(t)
-	defer h.close()
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
+	}
 
+	const n = 5000
+	for i := 0; i < n; i++ {
+		h.put(key(i), key(i))
+	}
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+
+	// Prevent auto compactions triggered by seeks
+	h.stor.Stall(testutil.ModeSync, storage.TypeTable)
+
+	for i := 0; i < n; i++ {
+		h.getVal(key(i), key(i))
+	}
+
+	// Lookup missing keys. Filter partitions are read once then cached.
+	h.stor.ResetCounter(testutil.ModeRead, storage.TypeTable)
+	for i := 0; i < n; i++ {
+		h.get(key(i)+".missing", false)
+	}
+	cnt, _ := h.stor.Counter(testutil.ModeRead, storage.TypeTable)
+	t.Logf("lookup of %d missing keys yield %d sstable I/O reads", n, cnt)
+	if max := 3 * n / 100; cnt > max {
+		t.Errorf("num of sstable I/O reads of missing keys was more than %d, got %d", max, cnt)
+	}
+
+	h.stor.Release(testutil.ModeSync, storage.TypeTable)
 	h.reopenDB()
-	h.put("", "")
-	h.reopenDB()
-	h.delete("e")
-	h.put("", "")
-	h.reopenDB()
-	h.put("c", "cv")
-	h.reopenDB()
-	h.put("", "")
-	h.reopenDB()
-	h.put("", "")
-	h.waitCompaction()
-	h.reopenDB()
-	h.put("d", "dv")
-	h.reopenDB()
-	h.put("", "")
-	h.reopenDB()
-	h.delete("d")
-	h.delete("b")
-	h.reopenDB()
-	h.getKeyVal("(->)(c->cv)")
-	h.waitCompaction()
-	h.getKeyVal("(->)(c->cv)")
+	h.getVal(key(0), key(0))
+	h.get(key(0)+".missing", false)
 }
 
-func TestDB_SingleEntryMemCompaction(t *testing.T) {
-	trun(t, func(h *dbHarness) {
-		for i := 0; i < 10; i++ {
-			h.put("big", strings.Repeat("v", opt.DefaultWriteBuffer))
-			h.compactMem()
-			h.put("key", strings.Repeat("v", opt.DefaultBlockSize))
-			h.compactMem()
-			h.put("k", "v")
-			h.compactMem()
-			h.put("", "")
-			h.compactMem()
-			h.put("verybig", strings.Repeat("v", opt.DefaultWriteBuffer*2))
-			h.compactMem()
-		}
+func TestDB_XorFilter(t *testing.T) {
+	bloom := filter.NewBloomFilter(10)
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		DisableBlockCache:            true,
+		Filter:                       bloom,
 	})
-}
-
-func TestDB_ManifestWriteError(t *testing.T) {
-	for i := 0; i < 2; i++ {
-		func() {
-			h := newDbHarness(t)
-			defer h.close()
+	defer h.close()
 
-			h.put("foo", "bar")
-			h.getVal("foo", "bar")
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
+	}
+	missingReads := func() int {
+		h.stor.ResetCounter(testutil.ModeRead, storage.TypeTable)
+		for i := 0; i < 2000; i++ {
+			h.get(key(i)+".missing", false)
+		}
+		cnt, _ := h.stor.Counter(testutil.ModeRead, storage.TypeTable)
+		return int(cnt)
+	}
 
-			// Mem compaction (will succeed)
-			h.compactMem()
-			h.getVal("foo", "bar")
-			v := h.db.s.version()
-			if n := v.tLen(0); n != 1 {
-				t.Errorf("invalid total tables, want=1 got=%d", n)
-			}
-			v.release()
+	for i := 0; i < 1000; i++ {
+		h.put(key(i), key(i))
+	}
+	h.compactMem()
 
-			if i == 0 {
-				h.stor.EmulateError(testutil.ModeWrite, storage.TypeManifest, errors.New("manifest write error"))
-			} else {
-				h.stor.EmulateError(testutil.ModeSync, storage.TypeManifest, errors.New("manifest sync error"))
-			}
+	// Switch to xor filter, bloom filtered table remains readable.
+	h.closeDB()
+	h.o.Filter = filter.NewXorFilter()
+	h.o.AltFilters = []filter.Filter{bloom}
+	h.openDB()
+	for i := 1000; i < 2000; i++ {
+		h.put(key(i), key(i))
+	}
+	h.compactMem()
+	h.tablesPerLevel("2")
 
-			// Merging compaction (will fail)
-			h.compactRangeAtErr(0, "", "", true)
+	// Prevent auto compactions triggered by seeks
+	h.stor.Stall(testutil.ModeSync, storage.TypeTable)
 
-			h.db.Close()
-			h.stor.EmulateError(testutil.ModeWrite, storage.TypeManifest, nil)
-			h.stor.EmulateError(testutil.ModeSync, storage.TypeManifest, nil)
+	for i := 0; i < 2000; i++ {
+		h.getVal(key(i), key(i))
+	}
+	if cnt, max := missingReads(), 3*2000/100; cnt > max {
+		t.Errorf("num of sstable I/O reads of missing keys was more than %d, got %d", max, cnt)
+	}
 
-			// Should not lose data
-			h.openDB()
-			h.getVal("foo", "bar")
-		}()
+	// Without the alternative filter the bloom filtered table is read.
+	h.stor.Release(testutil.ModeSync, storage.TypeTable)
+	h.closeDB()
+	h.o.AltFilters = nil
+	h.openDB()
+	h.stor.Stall(testutil.ModeSync, storage.TypeTable)
+	if cnt, min := missingReads(), 2000/2; cnt < min {
+		t.Errorf("num of sstable I/O reads of missing keys was less than %d, got %d", min, cnt)
 	}
+	h.stor.Release(testutil.ModeSync, storage.TypeTable)
 }
 
-func assertErr(t *testing.T, err error, wanterr bool) {
-	if err != nil {
-		if wanterr {
-			t.Log("AssertErr: got error (expected): ", err)
-		} else {
-			t.Error("AssertErr: got error: ", err)
+func TestDB_TableFilter(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Filter:                       filter.NewBloomFilter(10),
+		OpenFilesCacheCapacity:       -1,
+		TableFilter:                  true,
+	})
+	defer h.close()
+
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
+	}
+
+	// Level-0 tables with overlapping key ranges.
+	const n, m = 1000, 3
+	for j := 0; j < m; j++ {
+		for i := j; i < n; i += m {
+			h.put(key(i), key(i))
 		}
-	} else if wanterr {
-		t.Error("AssertErr: expect error")
+		h.compactMem()
 	}
-}
+	h.tablesPerLevel("3")
 
-func TestDB_ClosedIsClosed(t *testing.T) {
-	h := newDbHarness(t)
-	db := h.db
+	// Prevent auto compactions triggered by seeks
+	if err := h.db.SetReadOnly(); err != nil {
+		t.Fatal("SetReadOnly: got error: ", err)
+	}
 
-	var iter, iter2 iterator.Iterator
-	var snap *Snapshot
-	func() {
-		defer h.close()
+	// Open the tables, which loads the table filters.
+	h.get(key(n/2)+".missing", false)
 
-		h.put("k", "v")
-		h.getVal("k", "v")
+	// Lookup keys, tables are ruled out by the in-memory table filters
+	// without being opened.
+	h.stor.ResetCounter(testutil.ModeOpen, storage.TypeTable)
+	for i := 0; i < n; i++ {
+		h.getVal(key(i), key(i))
+		h.get(key(i)+".missing", false)
+	}
+	cnt, _ := h.stor.Counter(testutil.ModeOpen, storage.TypeTable)
+	t.Logf("lookup of %d keys and %d missing keys yield %d sstable opens", n, n, cnt)
+	if max := n + m*n/50; cnt > max {
+		t.Errorf("num of sstable opens was more than %d, got %d", max, cnt)
+	}
 
-		iter = db.NewIterator(nil, h.ro)
-		iter.Seek([]byte("k"))
-		testKeyVal(t, iter, "k->v")
+	h.reopenDB()
+	h.getVal(key(0), key(0))
+	h.get(key(0)+".missing", false)
+}
 
-		var err error
-		snap, err = db.GetSnapshot()
-		if err != nil {
-			t.Fatal("GetSnapshot: got error: ", err)
-		}
+func TestDB_Context(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
 
-		h.getValr(snap, "k", "v")
+	h.put("foo", "v1")
+	h.put("bar", "v1")
 
-		iter2 = snap.NewIterator(nil, h.ro)
-		iter2.Seek([]byte("k"))
-		testKeyVal(t, iter2, "k->v")
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.db.GetContext(canceled, []byte("foo"), nil); err != context.Canceled {
+		t.Errorf("GetContext: expecting context.Canceled, got %v", err)
+	}
+	if v, err := h.db.GetContext(context.Background(), []byte("foo"), nil); err != nil || string(v) != "v1" {
+		t.Errorf("GetContext: got value=%q err=%v", v, err)
+	}
 
-		h.put("foo", "v2")
-		h.delete("foo")
+	batch := new(Batch)
+	batch.Put([]byte("foo"), []byte("v2"))
+	if err := h.db.WriteContext(canceled, batch, nil); err != context.Canceled {
+		t.Errorf("WriteContext: expecting context.Canceled, got %v", err)
+	}
+	h.getVal("foo", "v1")
 
-		// closing DB
-		iter.Release()
-		iter2.Release()
-	}()
+	// Write lock is held, the write must give up once the deadline exceeded.
+	h.db.writeLockC <- struct{}{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := h.db.WriteContext(ctx, batch, nil); err != context.DeadlineExceeded {
+		t.Errorf("WriteContext: expecting context.DeadlineExceeded, got %v", err)
+	}
+	<-h.db.writeLockC
+	if err := h.db.WriteContext(context.Background(), batch, nil); err != nil {
+		t.Error("WriteContext: got error: ", err)
+	}
+	h.getVal("foo", "v2")
 
-	assertErr(t, db.Put([]byte("x"), []byte("y"), h.wo), true)
-	_, err := db.Get([]byte("k"), h.ro)
-	assertErr(t, err, true)
+	ctx, cancel = context.WithCancel(context.Background())
+	iter := h.db.NewIteratorContext(ctx, nil, nil)
+	if !iter.Next() || string(iter.Key()) != "bar" {
+		t.Errorf("NewIteratorContext: invalid first key: %q", iter.Key())
+	}
+	cancel()
+	if iter.Next() || iter.Valid() || iter.Key() != nil {
+		t.Error("NewIteratorContext: iterator is valid after cancellation")
+	}
+	if err := iter.Error(); err != context.Canceled {
+		t.Errorf("NewIteratorContext: expecting context.Canceled, got %v", err)
+	}
+	iter.Release()
+}
 
-	if iter.Valid() {
-		t.Errorf("iter.Valid should false")
+func TestDB_EventListener(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(format string, v ...interface{}) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf(format, v...))
+		mu.Unlock()
 	}
-	assertErr(t, iter.Error(), false)
-	testKeyVal(t, iter, "->")
-	if iter.Seek([]byte("k")) {
-		t.Errorf("iter.Seek should false")
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteL0SlowdownTrigger:       1,
+		EventListener: &opt.EventListener{
+			OnCompactionBegin: func(info opt.CompactionInfo) {
+				record("begin L%d T%d", info.SourceLevel, info.InputTables)
+			},
+			OnCompactionEnd: func(info opt.CompactionInfo) {
+				record("end L%d T%d", info.SourceLevel, info.OutputTables)
+			},
+			OnMemFlush: func(info opt.MemFlushInfo) {
+				record("flush L%d N%d", info.Level, info.Entries)
+			},
+			OnTableCreated: func(info opt.TableInfo) {
+				record("table L%d", info.Level)
+			},
+			OnWriteStall: func(info opt.WriteStallInfo) {
+				record("stall %v T%d", info.Condition, info.Level0Tables)
+			},
+		},
+	})
+	defer h.close()
+
+	expect := func(want ...string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if strings.Join(events, ", ") != strings.Join(want, ", ") {
+			t.Errorf("invalid events: want=%q got=%q", want, events)
+		}
+		events = nil
 	}
-	assertErr(t, iter.Error(), true)
 
-	assertErr(t, iter2.Error(), false)
+	h.put("foo", "v1")
+	h.put("bar", "v1")
+	h.compactMem()
+	expect("flush L0 N2", "table L0")
 
-	_, err = snap.Get([]byte("k"), h.ro)
-	assertErr(t, err, true)
+	h.put("baz", "v1")
+	expect("stall slowdown T1", "stall normal T1")
 
-	_, err = db.GetSnapshot()
-	assertErr(t, err, true)
+	h.compactRangeAt(0, "", "")
+	expect("begin L0 T1", "end L0 T1", "table L1")
+}
 
-	iter3 := db.NewIterator(nil, h.ro)
-	assertErr(t, iter3.Error(), true)
+type testLogger struct {
+	mu   sync.Mutex
+	msgs map[string][]interface{}
+}
 
-	iter3 = snap.NewIterator(nil, h.ro)
-	assertErr(t, iter3.Error(), true)
+func (l *testLogger) Log(level opt.LogLevel, msg string, keyvals ...interface{}) {
+	l.mu.Lock()
+	l.msgs[level.String()+" "+msg] = keyvals
+	l.mu.Unlock()
+}
 
-	assertErr(t, db.Delete([]byte("k"), h.wo), true)
+func (l *testLogger) get(msg string) (keyvals []interface{}, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keyvals, ok = l.msgs[msg]
+	return
+}
 
-	_, err = db.GetProperty("leveldb.stats")
-	assertErr(t, err, true)
+type logStorage struct {
+	storage.Storage
+	mu    sync.Mutex
+	lines []string
+}
 
-	_, err = db.SizeOf([]util.Range{{[]byte("a"), []byte("z")}})
-	assertErr(t, err, true)
+func (s *logStorage) Log(str string) {
+	s.mu.Lock()
+	s.lines = append(s.lines, str)
+	s.mu.Unlock()
+}
 
-	assertErr(t, db.CompactRange(util.Range{}), true)
+func TestDB_Logger(t *testing.T) {
+	logger := &testLogger{msgs: make(map[string][]interface{})}
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Logger:                       logger,
+	})
+	h.put("foo", "v1")
+	h.compactMem()
+	h.close()
 
-	assertErr(t, db.Close(), true)
+	for _, msg := range []string{"info db@open done", "info memdb@flush created", "info db@close done"} {
+		keyvals, ok := logger.get(msg)
+		if !ok {
+			t.Errorf("message %q not logged", msg)
+			continue
+		}
+		if len(keyvals)%2 != 0 {
+			t.Errorf("message %q: odd number of key/values %v", msg, keyvals)
+		}
+		for i := 0; i < len(keyvals); i += 2 {
+			if _, ok := keyvals[i].(string); !ok {
+				t.Errorf("message %q: key %v isn't a string", msg, keyvals[i])
+			}
+		}
+	}
+	if keyvals, _ := logger.get("info memdb@flush created"); len(keyvals) < 4 || keyvals[0] != "level" || keyvals[2] != "file" {
+		t.Errorf("invalid memdb@flush key/values %v", keyvals)
+	}
+
+	// Without logger the messages are written to the storage log.
+	stor := &logStorage{Storage: storage.NewMemStorage()}
+	db, err := Open(stor, nil)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	db.Close()
+	found := false
+	for _, line := range stor.lines {
+		if strings.HasPrefix(line, "info  db@open done duration=") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("db@open done not written to the storage log: %q", stor.lines)
+	}
+
+	// DiscardLogger silences the messages.
+	stor = &logStorage{Storage: storage.NewMemStorage()}
+	db, err = Open(stor, &opt.Options{Logger: opt.DiscardLogger})
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	db.Close()
+	if len(stor.lines) != 0 {
+		t.Errorf("storage log written with DiscardLogger: %q", stor.lines)
+	}
 }
 
-type numberComparer struct{}
+type testTraceKey struct{}
 
-func (numberComparer) num(x []byte) (n int) {
-	fmt.Sscan(string(x[1:len(x)-1]), &n)
-	return
+type testSpan struct {
+	info   opt.TraceInfo
+	parent interface{}
+	err    error
 }
 
-func (numberComparer) Name() string {
-	return "test.NumberComparer"
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
 }
 
-func (p numberComparer) Compare(a, b []byte) int {
-	return p.num(a) - p.num(b)
+func (tr *testTracer) Start(ctx context.Context, info opt.TraceInfo) context.Context {
+	span := &testSpan{info: info, parent: ctx.Value(testTraceKey{})}
+	return context.WithValue(ctx, testTraceKey{}, span)
 }
 
-func (numberComparer) Separator(dst, a, b []byte) []byte { return nil }
-func (numberComparer) Successor(dst, b []byte) []byte    { return nil }
+func (tr *testTracer) End(ctx context.Context, info opt.TraceInfo, err error) {
+	span := ctx.Value(testTraceKey{}).(*testSpan)
+	span.info, span.err = info, err
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.mu.Unlock()
+}
 
-func TestDB_CustomComparer(t *testing.T) {
+func (tr *testTracer) reset() (spans []*testSpan) {
+	tr.mu.Lock()
+	spans, tr.spans = tr.spans, nil
+	tr.mu.Unlock()
+	return
+}
+
+func TestDB_Tracer(t *testing.T) {
+	tracer := &testTracer{}
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
-		Comparer:                     numberComparer{},
-		WriteBuffer:                  1000,
+		Tracer:                       tracer,
 	})
 	defer h.close()
 
-	h.put("[10]", "ten")
-	h.put("[0x14]", "twenty")
-	for i := 0; i < 2; i++ {
-		h.getVal("[10]", "ten")
-		h.getVal("[0xa]", "ten")
-		h.getVal("[20]", "twenty")
-		h.getVal("[0x14]", "twenty")
-		h.get("[15]", false)
-		h.get("[0xf]", false)
-		h.compactMem()
-		h.compactRange("[0]", "[9999]")
+	ctx := context.WithValue(context.Background(), testTraceKey{}, "root")
+	b := new(Batch)
+	b.Put([]byte("foo"), []byte("v1"))
+	if err := h.db.WriteContext(ctx, b, h.wo); err != nil {
+		t.Fatal("WriteContext: got error: ", err)
+	}
+	spans := tracer.reset()
+	if len(spans) != 1 || spans[0].info.Op != opt.TraceJournalWrite || spans[0].info.Size == 0 || spans[0].parent != "root" || spans[0].err != nil {
+		t.Fatalf("invalid journal write spans: %+v", spans)
+	}
+
+	h.compactMem()
+	ops := map[opt.TraceOp]*testSpan{}
+	for _, span := range tracer.reset() {
+		ops[span.info.Op] = span
+	}
+	if span := ops[opt.TraceMemFlush]; span == nil || span.info.Level < 0 || span.info.Size == 0 || span.err != nil {
+		t.Errorf("invalid memdb flush span: %+v", span)
+	}
+	if span := ops[opt.TraceCompactionCommit]; span == nil || span.err != nil {
+		t.Errorf("invalid compaction commit span: %+v", span)
+	}
+
+	if _, err := h.db.GetContext(ctx, []byte("foo"), h.ro); err != nil {
+		t.Fatal("GetContext: got error: ", err)
+	}
+	spans = tracer.reset()
+	if len(spans) != 2 {
+		t.Fatalf("got %d get spans, want 2: %+v", len(spans), spans)
+	}
+	table, get := spans[0], spans[1]
+	if get.info.Op != opt.TraceGet || get.info.KeySize != 3 || get.parent != "root" || get.err != nil {
+		t.Errorf("invalid get span: %+v", get)
+	}
+	if table.info.Op != opt.TraceTableGet || table.info.KeySize != 3 || table.info.Level < 0 || table.info.TableNum < 0 || table.parent != get {
+		t.Errorf("invalid table get span: %+v", table)
 	}
 
-	for n := 0; n < 2; n++ {
-		for i := 0; i < 100; i++ {
-			v := fmt.Sprintf("[%d]", i*10)
-			h.put(v, v)
+	h.getr(h.db, "bar", false)
+	if spans = tracer.reset(); len(spans) != 1 || spans[0].info.Op != opt.TraceGet || spans[0].err != ErrNotFound {
+		t.Errorf("invalid missing key get spans: %+v", spans)
+	}
+
+	h.put("bar", "v1")
+	h.compactMem()
+	tracer.reset()
+	h.compactRangeAt(0, "", "")
+	found := false
+	for _, span := range tracer.reset() {
+		if span.info.Op == opt.TraceCompactionBuild {
+			found = true
+			if span.info.Level != 0 || span.info.Size == 0 || span.err != nil {
+				t.Errorf("invalid compaction build span: %+v", span)
+			}
 		}
-		h.compactMem()
-		h.compactRange("[0]", "[1000000]")
+	}
+	if !found {
+		t.Error("compaction build not traced")
 	}
 }
 
-func TestDB_ManualCompaction(t *testing.T) {
-	h := newDbHarness(t)
+func TestDB_Subcompactions(t *testing.T) {
+	var subcompactions int32
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionTableSize:          8 * opt.KiB,
+		Compression:                  opt.NoCompression,
+		MaxSubcompactions:            4,
+		EventListener: &opt.EventListener{
+			OnCompactionBegin: func(info opt.CompactionInfo) {
+				for {
+					n := atomic.LoadInt32(&subcompactions)
+					if int32(info.Subcompactions) <= n || atomic.CompareAndSwapInt32(&subcompactions, n, int32(info.Subcompactions)) {
+						break
+					}
+				}
+			},
+		},
+	})
 	defer h.close()
 
-	h.db.memdbMaxLevel = 2
-
-	h.putMulti(3, "p", "q")
-	h.tablesPerLevel("1,1,1")
-
-	// Compaction range falls before files
-	h.compactRange("", "c")
-	h.tablesPerLevel("1,1,1")
-
-	// Compaction range falls after files
-	h.compactRange("r", "z")
-	h.tablesPerLevel("1,1,1")
+	const n, m = 2000, 3
+	key := func(i int) string {
+		return fmt.Sprintf("key%06d", i)
+	}
+	value := func(i, j int) string {
+		return fmt.Sprintf("%s.%d.%s", key(i), j, strings.Repeat("v", 100))
+	}
 
-	// Compaction range overlaps files
-	h.compactRange("p1", "p9")
-	h.tablesPerLevel("0,0,1")
+	// Level-0 tables with overlapping key ranges, overwriting keys of the
+	// previous ones, the last one also deletes keys.
+	last := func(i int) int {
+		for j := m - 1; ; j-- {
+			if (i+j)%3 != 0 {
+				return j
+			}
+		}
+	}
+	for j := 0; j < m; j++ {
+		for i := 0; i < n; i++ {
+			if j == m-1 && i%7 == 0 {
+				h.delete(key(i))
+			} else if (i+j)%3 != 0 {
+				h.put(key(i), value(i, j))
+			}
+		}
+		h.compactMem()
+	}
+	check := func() {
+		var num int
+		for i := 0; i < n; i++ {
+			if i%7 == 0 {
+				h.get(key(i), false)
+			} else {
+				h.getVal(key(i), value(i, last(i)))
+				num++
+			}
+		}
+		h.assertNumKeys(num)
+	}
+	check()
 
-	// Populate a different range
-	h.putMulti(3, "c", "e")
-	h.tablesPerLevel("1,1,2")
+	h.compactRange("", "")
+	if n := atomic.LoadInt32(&subcompactions); n < 2 {
+		t.Fatalf("compaction is not split, got %d subcompactions", n)
+	}
+	check()
 
-	// Compact just the new range
-	h.compactRange("b", "f")
-	h.tablesPerLevel("0,0,2")
+	v := h.db.s.version()
+	for level, tables := range v.levels[1:] {
+		for i := 1; i < len(tables); i++ {
+			if h.db.s.icmp.uCompare(tables[i-1].imax.ukey(), tables[i].imin.ukey()) >= 0 {
+				t.Errorf("L%d: table @%d overlaps with table @%d", level+1, tables[i-1].fd.Num, tables[i].fd.Num)
+			}
+		}
+	}
+	v.release()
 
-	// Compact all
-	h.putMulti(1, "a", "z")
-	h.tablesPerLevel("0,1,2")
-	h.compactRange("", "")
-	h.tablesPerLevel("0,0,1")
+	h.reopenDB()
+	check()
 }
 
-func TestDB_BloomFilter(t *testing.T) {
+func TestDB_FIFOCompaction(t *testing.T) {
+	const limit = 256 * opt.KiB
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
-		DisableBlockCache:            true,
-		Filter:                       filter.NewBloomFilter(10),
+		Compression:                  opt.NoCompression,
+		FIFOCompactionTotalSize:      limit,
+		WriteBuffer:                  16 * opt.KiB,
 	})
 	defer h.close()
 
 	key := func(i int) string {
 		return fmt.Sprintf("key%06d", i)
 	}
+	value := strings.Repeat("v", 100)
 
-	const n = 10000
-
-	// Populate multiple layers
+	const n = 5000
 	for i := 0; i < n; i++ {
-		h.put(key(i), key(i))
-	}
-	h.compactMem()
-	h.compactRange("a", "z")
-	for i := 0; i < n; i += 100 {
-		h.put(key(i), key(i))
+		h.put(key(i), value)
 	}
 	h.compactMem()
+	h.waitCompaction()
 
-	// Prevent auto compactions triggered by seeks
-	h.stor.Stall(testutil.ModeSync, storage.TypeTable)
-
-	// Lookup present keys. Should rarely read from small sstable.
-	h.stor.ResetCounter(testutil.ModeRead, storage.TypeTable)
-	for i := 0; i < n; i++ {
-		h.getVal(key(i), key(i))
+	tables := func() (nums []int64) {
+		v := h.db.s.version()
+		defer v.release()
+		if size := v.size(); size > limit {
+			t.Errorf("total tables size is %d, want <= %d", size, limit)
+		}
+		for level, tables := range v.levels {
+			for _, t0 := range tables {
+				if level > 0 {
+					t.Errorf("table @%d at level %d", t0.fd.Num, level)
+				}
+				nums = append(nums, t0.fd.Num)
+			}
+		}
+		return
 	}
-	cnt, _ := h.stor.Counter(testutil.ModeRead, storage.TypeTable)
-	t.Logf("lookup of %d present keys yield %d sstable I/O reads", n, cnt)
-	if min, max := n, n+2*n/100; cnt < min || cnt > max {
-		t.Errorf("num of sstable I/O reads of present keys not in range of %d - %d, got %d", min, max, cnt)
+	nums := tables()
+	if len(nums) <= h.o.GetWriteL0PauseTrigger() {
+		t.Fatalf("too few level-0 tables: %d", len(nums))
 	}
 
-	// Lookup missing keys. Should rarely read from either sstable.
-	h.stor.ResetCounter(testutil.ModeRead, storage.TypeTable)
-	for i := 0; i < n; i++ {
-		h.get(key(i)+".missing", false)
+	// The oldest keys are dropped.
+	h.get(key(0), false)
+	h.getVal(key(n-1), value)
+	iter := h.db.NewIterator(nil, nil)
+	if !iter.First() {
+		t.Fatal("DB is empty")
 	}
-	cnt, _ = h.stor.Counter(testutil.ModeRead, storage.TypeTable)
-	t.Logf("lookup of %d missing keys yield %d sstable I/O reads", n, cnt)
-	if max := 3 * n / 100; cnt > max {
-		t.Errorf("num of sstable I/O reads of missing keys was more than %d, got %d", max, cnt)
+	first := string(iter.Key())
+	var num int
+	for ok := true; ok; ok = iter.Next() {
+		num++
+	}
+	iter.Release()
+	if num+1 >= n || first != key(n-num) {
+		t.Errorf("invalid remaining keys: first=%q num=%d", first, num)
 	}
 
-	h.stor.Release(testutil.ModeSync, storage.TypeTable)
-}
+	// Tables are never rewritten.
+	h.compactRange("", "")
+	if nums1 := tables(); fmt.Sprint(nums1) != fmt.Sprint(nums) {
+		t.Errorf("tables changed by range compaction: %v -> %v", nums, nums1)
+	}
 
-func TestDB_Concurrent(t *testing.T) {
-	const n, secs, maxkey = 4, 6, 1000
-	h := newDbHarness(t)
-	defer h.close()
+	h.reopenDB()
+	h.getVal(key(n-1), value)
+}
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
+type testWriteStallPolicy struct {
+	slowdown int
+	delay    time.Duration
+}
 
-	var (
-		closeWg sync.WaitGroup
-		stop    uint32
-		cnt     [n]uint32
-	)
+func (p *testWriteStallPolicy) WriteStall(level0Tables int) (opt.WriteStallCondition, time.Duration) {
+	if level0Tables >= p.slowdown {
+		return opt.WriteStallSlowdown, p.delay
+	}
+	return opt.WriteStallNormal, 0
+}
 
-	for i := 0; i < n; i++ {
-		closeWg.Add(1)
-		go func(i int) {
-			var put, get, found uint
-			defer func() {
-				t.Logf("goroutine %d stopped after %d ops, put=%d get=%d found=%d missing=%d",
-					i, cnt[i], put, get, found, get-found)
-				closeWg.Done()
-			}()
+func TestDB_WriteStallPolicy(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteStallPolicy:             &testWriteStallPolicy{slowdown: 1, delay: delay},
+	})
+	defer h.close()
 
-			rnd := rand.New(rand.NewSource(int64(1000 + i)))
-			for atomic.LoadUint32(&stop) == 0 {
-				x := cnt[i]
+	stall := func(want string) {
+		if v, err := h.db.GetProperty("leveldb.writestall"); err != nil {
+			t.Fatal("GetProperty: got error: ", err)
+		} else if v != want {
+			t.Errorf("invalid write stall property: want=%s got=%s", want, v)
+		}
+	}
 
-				k := rnd.Intn(maxkey)
-				kstr := fmt.Sprintf("%016d", k)
+	h.put("foo", "v1")
+	stall("normal")
+	h.compactMem()
+	stall("slowdown")
 
-				if (rnd.Int() % 2) > 0 {
-					put++
-					h.put(kstr, fmt.Sprintf("%d.%d.%-1000d", k, i, x))
-				} else {
-					get++
-					v, err := h.db.Get([]byte(kstr), h.ro)
-					if err == nil {
-						found++
-						rk, ri, rx := 0, -1, uint32(0)
-						fmt.Sscanf(string(v), "%d.%d.%d", &rk, &ri, &rx)
-						if rk != k {
-							t.Errorf("invalid key want=%d got=%d", k, rk)
-						}
-						if ri < 0 || ri >= n {
-							t.Error("invalid goroutine number: ", ri)
-						} else {
-							tx := atomic.LoadUint32(&(cnt[ri]))
-							if rx > tx {
-								t.Errorf("invalid seq number, %d > %d ", rx, tx)
-							}
-						}
-					} else if err != ErrNotFound {
-						t.Error("Get: got error: ", err)
-						return
-					}
-				}
-				atomic.AddUint32(&cnt[i], 1)
-			}
-		}(i)
+	start := time.Now()
+	h.put("bar", "v1")
+	if d := time.Since(start); d < delay {
+		t.Errorf("write is not delayed: want>=%v got=%v", delay, d)
 	}
 
-	time.Sleep(secs * time.Second)
-	atomic.StoreUint32(&stop, 1)
-	closeWg.Wait()
+	h.compactRangeAt(0, "", "")
+	stall("normal")
 }
 
-func TestDB_ConcurrentIterator(t *testing.T) {
-	const n, n2 = 4, 1000
-	h := newDbHarnessWopt(t, &opt.Options{DisableLargeBatchTransaction: true, WriteBuffer: 30})
+func TestDB_Stats(t *testing.T) {
+	h := newDbHarness(t)
 	defer h.close()
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
-
-	var (
-		closeWg sync.WaitGroup
-		stop    uint32
-	)
+	h.put("foo", "v1")
+	h.put("bar", "v1")
+	h.compactMem()
+	h.put("baz", "v1")
+	h.getVal("foo", "v1")
+	h.getVal("foo", "v1")
 
-	for i := 0; i < n; i++ {
-		closeWg.Add(1)
-		go func(i int) {
-			for k := 0; atomic.LoadUint32(&stop) == 0; k++ {
-				h.put(fmt.Sprintf("k%d", k), fmt.Sprintf("%d.%d.", k, i)+strings.Repeat("x", 10))
-			}
-			closeWg.Done()
-		}(i)
+	s, err := h.db.Stats()
+	if err != nil {
+		t.Fatal("Stats: got error: ", err)
 	}
-
-	for i := 0; i < n; i++ {
-		closeWg.Add(1)
-		go func(i int) {
-			for k := 1000000; k < 0 || atomic.LoadUint32(&stop) == 0; k-- {
-				h.put(fmt.Sprintf("k%d", k), fmt.Sprintf("%d.%d.", k, i)+strings.Repeat("x", 10))
-			}
-			closeWg.Done()
-		}(i)
+	if len(s.LevelTablesCounts) == 0 || s.LevelTablesCounts[0] != 1 {
+		t.Errorf("invalid level tables counts: %v", s.LevelTablesCounts)
 	}
-
-	cmp := comparer.DefaultComparer
-	for i := 0; i < n2; i++ {
-		closeWg.Add(1)
-		go func(i int) {
-			it := h.db.NewIterator(nil, nil)
-			var pk []byte
-			for it.Next() {
-				kk := it.Key()
-				if cmp.Compare(kk, pk) <= 0 {
-					t.Errorf("iter %d: %q is successor of %q", i, pk, kk)
-				}
-				pk = append(pk[:0], kk...)
-				var k, vk, vi int
-				if n, err := fmt.Sscanf(string(it.Key()), "k%d", &k); err != nil {
-					t.Errorf("iter %d: Scanf error on key %q: %v", i, it.Key(), err)
-				} else if n < 1 {
-					t.Errorf("iter %d: Cannot parse key %q", i, it.Key())
-				}
-				if n, err := fmt.Sscanf(string(it.Value()), "%d.%d", &vk, &vi); err != nil {
-					t.Errorf("iter %d: Scanf error on value %q: %v", i, it.Value(), err)
-				} else if n < 2 {
-					t.Errorf("iter %d: Cannot parse value %q", i, it.Value())
-				}
-
-				if vk != k {
-					t.Errorf("iter %d: invalid value i=%d, want=%d got=%d", i, vi, k, vk)
-				}
-			}
-			if err := it.Error(); err != nil {
-				t.Errorf("iter %d: Got error: %v", i, err)
-			}
-			it.Release()
-			closeWg.Done()
-		}(i)
+	if s.LevelSizes[0] == 0 || s.LevelWrite[0] != s.LevelSizes[0] {
+		t.Errorf("invalid level-0 stats: size=%d write=%d", s.LevelSizes[0], s.LevelWrite[0])
+	}
+	if s.MemComp != 1 {
+		t.Errorf("invalid memdb compaction counter: want=%d got=%d", 1, s.MemComp)
+	}
+	if s.MemTableSize == 0 {
+		t.Error("memdb size is zero")
+	}
+	if s.IOWrite == 0 || s.IORead == 0 {
+		t.Errorf("invalid I/O counters: write=%d read=%d", s.IOWrite, s.IORead)
+	}
+	if s.BlockCacheHits == 0 || s.BlockCacheMisses == 0 {
+		t.Errorf("invalid block cache counters: hits=%d misses=%d", s.BlockCacheHits, s.BlockCacheMisses)
+	}
+	if s.OpenedTablesCount != 1 {
+		t.Errorf("invalid opened tables count: want=%d got=%d", 1, s.OpenedTablesCount)
 	}
 
-	atomic.StoreUint32(&stop, 1)
-	closeWg.Wait()
+	snap := h.getSnapshot()
+	if s, _ = h.db.Stats(); s.AliveSnapshots != 1 {
+		t.Errorf("invalid alive snapshots: want=%d got=%d", 1, s.AliveSnapshots)
+	}
+	snap.Release()
 }
 
-func TestDB_ConcurrentWrite(t *testing.T) {
-	const n, bk, niter = 10, 3, 10000
-	h := newDbHarness(t)
+func TestDB_ShardedBlockCache(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		BlockCacher:                  opt.ShardedLRUCacher,
+		BlockCacheCapacity:           16 * opt.KiB,
+		BlockSize:                    256,
+		Compression:                  opt.NoCompression,
+	})
 	defer h.close()
 
-	runtime.GOMAXPROCS(runtime.NumCPU())
+	for i := 0; i < 1000; i++ {
+		h.put(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%04d", i))
+	}
+	h.compactMem()
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 1000; i++ {
+			h.getVal(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%04d", i))
+		}
+	}
 
-	var wg sync.WaitGroup
-	for i := 0; i < n; i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			for k := 0; k < niter; k++ {
-				kstr := fmt.Sprintf("put-%d.%d", i, k)
-				vstr := fmt.Sprintf("v%d", k)
-				h.put(kstr, vstr)
-				// Key should immediately available after put returns.
-				h.getVal(kstr, vstr)
-			}
-		}(i)
+	s, err := h.db.Stats()
+	if err != nil {
+		t.Fatal("Stats: got error: ", err)
 	}
-	for i := 0; i < n; i++ {
-		wg.Add(1)
-		batch := &Batch{}
-		go func(i int) {
-			defer wg.Done()
-			for k := 0; k < niter; k++ {
-				batch.Reset()
-				for j := 0; j < bk; j++ {
-					batch.Put([]byte(fmt.Sprintf("batch-%d.%d.%d", i, k, j)), []byte(fmt.Sprintf("v%d", k)))
-				}
-				h.write(batch)
-				// Key should immediately available after put returns.
-				for j := 0; j < bk; j++ {
-					h.getVal(fmt.Sprintf("batch-%d.%d.%d", i, k, j), fmt.Sprintf("v%d", k))
-				}
-			}
-		}(i)
+	if s.BlockCacheSize == 0 || s.BlockCacheSize > 16*opt.KiB {
+		t.Errorf("invalid block cache size: %d", s.BlockCacheSize)
+	}
+	if s.BlockCacheEvictions == 0 {
+		t.Error("block cache evictions counter is zero")
 	}
-	wg.Wait()
 }
 
-func TestDB_CreateReopenDbOnFile(t *testing.T) {
-	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCreateReopenDbOnFile-%d", os.Getuid()))
-	if err := os.RemoveAll(dbpath); err != nil {
-		t.Fatal("cannot remove old db: ", err)
+func TestDB_S3FIFOBlockCache(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		BlockCacher:                  opt.S3FIFOCacher,
+		BlockCacheCapacity:           8 * opt.KiB,
+		BlockSize:                    256,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	for i := 0; i < 1000; i++ {
+		h.put(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%04d", i))
 	}
-	defer os.RemoveAll(dbpath)
+	h.compactMem()
 
-	for i := 0; i < 3; i++ {
-		stor, err := storage.OpenFile(dbpath, false)
-		if err != nil {
-			t.Fatalf("(%d) cannot open storage: %s", i, err)
-		}
-		db, err := Open(stor, nil)
-		if err != nil {
-			t.Fatalf("(%d) cannot open db: %s", i, err)
-		}
-		if err := db.Put([]byte("foo"), []byte("bar"), nil); err != nil {
-			t.Fatalf("(%d) cannot write to db: %s", i, err)
-		}
-		if err := db.Close(); err != nil {
-			t.Fatalf("(%d) cannot close db: %s", i, err)
-		}
-		if err := stor.Close(); err != nil {
-			t.Fatalf("(%d) cannot close storage: %s", i, err)
+	// Hot keys.
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 20; i++ {
+			h.getVal(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%04d", i))
 		}
 	}
+	h.assertNumKeys(1000)
+
+	s, err := h.db.Stats()
+	if err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	for i := 0; i < 20; i++ {
+		h.getVal(fmt.Sprintf("key%04d", i), fmt.Sprintf("value%04d", i))
+	}
+	s1, err := h.db.Stats()
+	if err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if misses := s1.BlockCacheMisses - s.BlockCacheMisses; misses != 0 {
+		t.Errorf("hot blocks evicted by the iteration: misses=%d", misses)
+	}
 }
 
-func TestDB_CreateReopenDbOnFile2(t *testing.T) {
-	dbpath := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldbtestCreateReopenDbOnFile2-%d", os.Getuid()))
-	if err := os.RemoveAll(dbpath); err != nil {
-		t.Fatal("cannot remove old db: ", err)
+func TestDB_CompressedBlockCache(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		DisableBlockCache:            true,
+		CompressedBlockCacheCapacity: opt.MiB,
+		BlockSize:                    256,
+		Compression:                  opt.SnappyCompression,
+	})
+	defer h.close()
+
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 1000; i++ {
+		h.put(fmt.Sprintf("key%04d", i), value)
+	}
+	h.compactMem()
+	for i := 0; i < 1000; i++ {
+		h.getVal(fmt.Sprintf("key%04d", i), value)
 	}
-	defer os.RemoveAll(dbpath)
 
-	for i := 0; i < 3; i++ {
-		db, err := OpenFile(dbpath, nil)
-		if err != nil {
-			t.Fatalf("(%d) cannot open db: %s", i, err)
-		}
-		if err := db.Put([]byte("foo"), []byte("bar"), nil); err != nil {
-			t.Fatalf("(%d) cannot write to db: %s", i, err)
-		}
-		if err := db.Close(); err != nil {
-			t.Fatalf("(%d) cannot close db: %s", i, err)
-		}
+	s, err := h.db.Stats()
+	if err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if s.CompressedBlockCacheSize == 0 {
+		t.Fatal("compressed block cache is empty")
+	}
+	reads := s.IORead
+	for i := 0; i < 1000; i++ {
+		h.getVal(fmt.Sprintf("key%04d", i), value)
+	}
+	h.assertNumKeys(1000)
+
+	s, err = h.db.Stats()
+	if err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if s.IORead != reads {
+		t.Errorf("blocks read from the storage: got %d bytes read, want %d", s.IORead, reads)
+	}
+	if s.CompressedBlockCacheHits == 0 {
+		t.Error("compressed block cache hits counter is zero")
 	}
 }
 
-func TestDB_DeletionMarkersOnMemdb(t *testing.T) {
-	h := newDbHarness(t)
+func TestDB_Checksum(t *testing.T) {
+	o := &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Checksum:                     opt.XXHash64Checksum,
+	}
+	h := newDbHarnessWopt(t, o)
 	defer h.close()
 
 	h.put("foo", "v1")
 	h.compactMem()
-	h.delete("foo")
-	h.get("foo", false)
-	h.getKeyVal("")
+	h.put("bar", "v2")
+
+	// The tables and the journal are read whatever the checksum.
+	o.Checksum = opt.CRC32CChecksum
+	h.reopenDB()
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v2")
+	h.put("baz", "v3")
+	h.compactMem()
+
+	o.Checksum = opt.XXHash64Checksum
+	h.reopenDB()
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v2")
+	h.getVal("baz", "v3")
+	h.compactRange("", "")
+	h.getVal("foo", "v1")
+	h.getVal("bar", "v2")
+	h.getVal("baz", "v3")
 }
 
-func TestDB_LeveldbIssue178(t *testing.T) {
-	nKeys := (opt.DefaultCompactionTableSize / 30) * 5
-	key1 := func(i int) string {
-		return fmt.Sprintf("my_key_%d", i)
+func TestDB_MetaBlockCache(t *testing.T) {
+	o := &opt.Options{
+		DisableLargeBatchTransaction: true,
+		DisableBlockCache:            true,
+		MetaBlockCacheCapacity:       2 * opt.KiB,
+		BlockSize:                    256,
+		Filter:                       filter.NewBloomFilter(10),
+		// The level-0 tables must stay at level-0 across reopens.
+		CompactionL0Trigger: 8,
 	}
-	key2 := func(i int) string {
-		return fmt.Sprintf("my_key_%d_xxx", i)
+	h := newDbHarnessWopt(t, o)
+	defer h.close()
+
+	value := strings.Repeat("v", 100)
+	for n := 0; n < 4; n++ {
+		for i := 0; i < 250; i++ {
+			h.put(fmt.Sprintf("key%04d", n*250+i), value)
+		}
+		h.compactMem()
 	}
+	for i := 0; i < 1000; i++ {
+		h.getVal(fmt.Sprintf("key%04d", i), value)
+	}
+	h.get("foo", false)
 
-	// Disable compression since it affects the creation of layers and the
-	// code below is trying to test against a very specific scenario.
-	h := newDbHarnessWopt(t, &opt.Options{
-		DisableLargeBatchTransaction: true,
-		Compression:                  opt.NoCompression,
-	})
+	s, err := h.db.Stats()
+	if err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if s.MetaBlockCacheSize == 0 || s.MetaBlockCacheSize > o.MetaBlockCacheCapacity {
+		t.Errorf("meta block cache size: got %d, want between 1 and %d", s.MetaBlockCacheSize, o.MetaBlockCacheCapacity)
+	}
+	if s.MetaBlockCacheMisses == 0 || s.MetaBlockCacheHits == 0 {
+		t.Errorf("meta block cache counters: got %d hits and %d misses", s.MetaBlockCacheHits, s.MetaBlockCacheMisses)
+	}
+
+	// The index and filter blocks of the level-0 tables are kept in the
+	// cache whatever its capacity once pinned.
+	o.MetaBlockCacheCapacity = 1
+	h.reopenDB()
+	h.getVal("key0000", value)
+	if s, _ := h.db.Stats(); s.MetaBlockCacheSize != 0 {
+		t.Errorf("meta block cache size: got %d, want 0", s.MetaBlockCacheSize)
+	}
+	o.MetaBlockCachePinLevel0 = true
+	h.reopenDB()
+	for i := 0; i < 1000; i++ {
+		h.getVal(fmt.Sprintf("key%04d", i), value)
+	}
+	s, err = h.db.Stats()
+	if err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if s.MetaBlockCacheSize == 0 {
+		t.Error("level-0 meta blocks not pinned")
+	}
+	misses := s.MetaBlockCacheMisses
+	for i := 0; i < 1000; i++ {
+		h.getVal(fmt.Sprintf("key%04d", i), value)
+	}
+	if s, _ := h.db.Stats(); s.MetaBlockCacheMisses != misses {
+		t.Errorf("pinned meta blocks read again: got %d misses, want %d", s.MetaBlockCacheMisses, misses)
+	}
+}
+
+func TestDB_GetProperties(t *testing.T) {
+	h := newDbHarness(t)
 	defer h.close()
 
-	// Create first key range.
-	batch := new(Batch)
-	for i := 0; i < nKeys; i++ {
-		batch.Put([]byte(key1(i)), []byte("value for range 1 key"))
+	_, err := h.db.GetProperty("leveldb.num-files-at-level")
+	if err == nil {
+		t.Error("GetProperty() failed to detect missing level")
 	}
-	h.write(batch)
 
-	// Create second key range.
-	batch.Reset()
-	for i := 0; i < nKeys; i++ {
-		batch.Put([]byte(key2(i)), []byte("value for range 2 key"))
+	_, err = h.db.GetProperty("leveldb.num-files-at-level0")
+	if err != nil {
+		t.Error("got unexpected error", err)
 	}
-	h.write(batch)
 
-	// Delete second key range.
-	batch.Reset()
-	for i := 0; i < nKeys; i++ {
-		batch.Delete([]byte(key2(i)))
+	_, err = h.db.GetProperty("leveldb.num-files-at-level0x")
+	if err == nil {
+		t.Error("GetProperty() failed to detect invalid level")
 	}
-	h.write(batch)
-	h.waitMemCompaction()
 
-	// Run manual compaction.
-	h.compactRange(key1(0), key1(nKeys-1))
+	h.put("foo", "v1")
+	h.compactMem()
+	h.put("bar", "v1")
+	snap := h.getSnapshot()
+	defer snap.Release()
 
-	// Checking the keys.
-	h.assertNumKeys(nKeys)
+	prop := func(name string) string {
+		value, err := h.db.GetProperty("leveldb." + name)
+		if err != nil {
+			t.Fatalf("GetProperty(%q): got error: %v", name, err)
+		}
+		return value
+	}
+	var stats DBStats
+	if err := json.Unmarshal([]byte(prop("stats-json")), &stats); err != nil {
+		t.Error("invalid stats-json: ", err)
+	} else if stats.PutCount != 2 || stats.MemComp != 1 {
+		t.Errorf("invalid stats-json: %+v", stats)
+	}
+	if v := prop("num-snapshots"); v != "1" {
+		t.Errorf("num-snapshots: got %s, want 1", v)
+	}
+	if v := prop("oldest-snapshot-seq"); v != "2" {
+		t.Errorf("oldest-snapshot-seq: got %s, want 2", v)
+	}
+	if v, _ := strconv.Atoi(prop("mem-usage")); v == 0 {
+		t.Error("mem-usage is zero")
+	}
+	if v := prop("pending-compaction-bytes"); v != "0" {
+		t.Errorf("pending-compaction-bytes: got %s, want 0", v)
+	}
+	v := h.db.s.version()
+	size := v.size()
+	v.release()
+	if v := prop("live-sst-size"); v != strconv.FormatInt(size, 10) || size == 0 {
+		t.Errorf("live-sst-size: got %s, want %d", v, size)
+	}
 }
 
-func TestDB_LeveldbIssue200(t *testing.T) {
-	h := newDbHarness(t)
+func TestDB_BatchLimits(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		MaxBatchLen:                  10,
+		MaxBatchSize:                 1000,
+	})
 	defer h.close()
 
-	h.put("1", "b")
-	h.put("2", "c")
-	h.put("3", "d")
-	h.put("4", "e")
-	h.put("5", "f")
+	b := new(Batch)
+	for i := 0; i < 11; i++ {
+		b.Put([]byte(fmt.Sprintf("k%02d", i)), []byte("v"))
+	}
+	if err, ok := h.db.Write(b, h.wo).(*ErrBatchTooLarge); !ok || err.Len != 11 {
+		t.Errorf("Write of 11 records: got error %v, want ErrBatchTooLarge", err)
+	}
+	b.Reset()
+	b.Put([]byte("foo"), bytes.Repeat([]byte{'x'}, 1000))
+	if err, ok := h.db.ApplyReplicated(b, 100, h.wo).(*ErrBatchTooLarge); !ok || err.Size != len(b.Dump()) {
+		t.Errorf("ApplyReplicated of %d bytes: got error %v, want ErrBatchTooLarge", len(b.Dump()), err)
+	}
+	h.put("bar", "v1")
+	h.get("foo", false)
+	h.getVal("bar", "v1")
+}
 
-	iter := h.db.NewIterator(nil, h.ro)
+func TestDB_SplitBatchRecovery(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteBuffer:                  16 * opt.MiB,
+	})
+	defer h.close()
 
-	// Add an element that should not be reflected in the iterator.
-	h.put("25", "cd")
+	// Larger than batchSplitSize, so it is split into multiple journal
+	// records.
+	value := bytes.Repeat([]byte{'x'}, 100*1024)
+	b := new(Batch)
+	for i := 0; i < 50; i++ {
+		b.Put([]byte(fmt.Sprintf("k%02d", i)), value)
+	}
+	h.write(b)
+	h.put("foo", "v1")
 
-	iter.Seek([]byte("5"))
-	assertBytes(t, []byte("5"), iter.Key())
-	iter.Prev()
-	assertBytes(t, []byte("4"), iter.Key())
-	iter.Prev()
-	assertBytes(t, []byte("3"), iter.Key())
-	iter.Next()
-	assertBytes(t, []byte("4"), iter.Key())
-	iter.Next()
-	assertBytes(t, []byte("5"), iter.Key())
+	h.reopenDB()
+	for i := 0; i < 50; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), string(value))
+	}
+	h.getVal("foo", "v1")
 }
 
-func TestDB_GoleveldbIssue74(t *testing.T) {
+func TestDB_WriteMulti(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
-		WriteBuffer:                  1 * opt.MiB,
+		MaxBatchLen:                  100,
 	})
 	defer h.close()
 
-	const n, dur = 10000, 5 * time.Second
-
-	runtime.GOMAXPROCS(runtime.NumCPU())
-
-	until := time.Now().Add(dur)
-	wg := new(sync.WaitGroup)
-	wg.Add(2)
-	var done uint32
-	go func() {
-		var i int
-		defer func() {
-			t.Logf("WRITER DONE #%d", i)
-			atomic.StoreUint32(&done, 1)
-			wg.Done()
-		}()
-
-		b := new(Batch)
-		for ; time.Now().Before(until) && atomic.LoadUint32(&done) == 0; i++ {
-			iv := fmt.Sprintf("VAL%010d", i)
-			for k := 0; k < n; k++ {
-				key := fmt.Sprintf("KEY%06d", k)
-				b.Put([]byte(key), []byte(key+iv))
-				b.Put([]byte(fmt.Sprintf("PTR%06d", k)), []byte(key))
+	// Build the batches concurrently.
+	batches := make([]*Batch, 4)
+	var wg sync.WaitGroup
+	for i := range batches {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := new(Batch)
+			for j := 0; j < 10; j++ {
+				b.Put([]byte(fmt.Sprintf("%d-%d", i, j)), []byte(fmt.Sprintf("v%d", i)))
 			}
-			h.write(b)
-
-			b.Reset()
-			snap := h.getSnapshot()
-			iter := snap.NewIterator(util.BytesPrefix([]byte("PTR")), nil)
-			var k int
-			for ; iter.Next(); k++ {
-				ptrKey := iter.Key()
-				key := iter.Value()
+			batches[i] = b
+		}(i)
+	}
+	wg.Wait()
+	// A later batch overwrites an earlier one.
+	overwrite := new(Batch)
+	overwrite.Put([]byte("0-0"), []byte("v4"))
+	batches = append(batches, nil, new(Batch), overwrite)
 
-				if _, err := snap.Get(ptrKey, nil); err != nil {
-					t.Fatalf("WRITER #%d snapshot.Get %q: %v", i, ptrKey, err)
-				}
-				if value, err := snap.Get(key, nil); err != nil {
-					t.Fatalf("WRITER #%d snapshot.Get %q: %v", i, key, err)
-				} else if string(value) != string(key)+iv {
-					t.Fatalf("WRITER #%d snapshot.Get %q got invalid value, want %q got %q", i, key, string(key)+iv, value)
+	seq := h.db.getSeq()
+	if err := h.db.WriteMulti(batches, h.wo); err != nil {
+		t.Fatal("WriteMulti: got error: ", err)
+	}
+	if got := h.db.getSeq(); got != seq+41 {
+		t.Errorf("invalid sequence number: got %d, want %d", got, seq+41)
+	}
+	check := func() {
+		for i := 0; i < 4; i++ {
+			for j := 0; j < 10; j++ {
+				want := fmt.Sprintf("v%d", i)
+				if i == 0 && j == 0 {
+					want = "v4"
 				}
-
-				b.Delete(key)
-				b.Delete(ptrKey)
-			}
-			h.write(b)
-			iter.Release()
-			snap.Release()
-			if k != n {
-				t.Fatalf("#%d %d != %d", i, k, n)
+				h.getVal(fmt.Sprintf("%d-%d", i, j), want)
 			}
 		}
-	}()
-	go func() {
-		var i int
-		defer func() {
-			t.Logf("READER DONE #%d", i)
-			atomic.StoreUint32(&done, 1)
-			wg.Done()
-		}()
-		for ; time.Now().Before(until) && atomic.LoadUint32(&done) == 0; i++ {
-			snap := h.getSnapshot()
-			iter := snap.NewIterator(util.BytesPrefix([]byte("PTR")), nil)
-			var prevValue string
-			var k int
-			for ; iter.Next(); k++ {
-				ptrKey := iter.Key()
-				key := iter.Value()
+	}
+	check()
+	h.reopenDB()
+	check()
 
-				if _, err := snap.Get(ptrKey, nil); err != nil {
-					t.Fatalf("READER #%d snapshot.Get %q: %v", i, ptrKey, err)
-				}
+	if err := h.db.WriteMulti([]*Batch{nil, new(Batch)}, h.wo); err != nil {
+		t.Error("WriteMulti of empty batches: got error: ", err)
+	}
 
-				if value, err := snap.Get(key, nil); err != nil {
-					t.Fatalf("READER #%d snapshot.Get %q: %v", i, key, err)
-				} else if prevValue != "" && string(value) != string(key)+prevValue {
-					t.Fatalf("READER #%d snapshot.Get %q got invalid value, want %q got %q", i, key, string(key)+prevValue, value)
-				} else {
-					prevValue = string(value[len(key):])
-				}
-			}
-			iter.Release()
-			snap.Release()
-			if k > 0 && k != n {
-				t.Fatalf("#%d %d != %d", i, k, n)
-			}
-		}
-	}()
-	wg.Wait()
+	// The batch limits apply to the batches as a whole.
+	big := new(Batch)
+	for j := 0; j < 60; j++ {
+		big.Put([]byte(fmt.Sprintf("big-%d", j)), nil)
+	}
+	if err, ok := h.db.WriteMulti([]*Batch{big, big}, h.wo).(*ErrBatchTooLarge); !ok || err.Len != 120 {
+		t.Errorf("WriteMulti of 120 records: got error %v, want ErrBatchTooLarge", err)
+	}
+	h.get("big-0", false)
 }
 
-func TestDB_GetProperties(t *testing.T) {
+func TestDB_ConditionalWrites(t *testing.T) {
 	h := newDbHarness(t)
 	defer h.close()
 
-	_, err := h.db.GetProperty("leveldb.num-files-at-level")
-	if err == nil {
-		t.Error("GetProperty() failed to detect missing level")
+	if err := h.db.PutIfAbsent([]byte("foo"), []byte("v1"), h.wo); err != nil {
+		t.Fatal("PutIfAbsent: got error: ", err)
+	}
+	err := h.db.PutIfAbsent([]byte("foo"), []byte("v2"), h.wo)
+	if e, ok := err.(*ErrWriteConflict); !ok || string(e.Key) != "foo" || string(e.Value) != "v1" {
+		t.Errorf("PutIfAbsent of existing key: got error %v, want ErrWriteConflict", err)
 	}
+	h.getVal("foo", "v1")
 
-	_, err = h.db.GetProperty("leveldb.num-files-at-level0")
-	if err != nil {
-		t.Error("got unexpected error", err)
+	if err, ok := h.db.CompareAndSwap([]byte("foo"), []byte("v0"), []byte("v2"), h.wo).(*ErrWriteConflict); !ok {
+		t.Errorf("CompareAndSwap of mismatched value: got error %v, want ErrWriteConflict", err)
+	}
+	if err, ok := h.db.CompareAndSwap([]byte("foo"), nil, []byte("v2"), h.wo).(*ErrWriteConflict); !ok {
+		t.Errorf("CompareAndSwap of existing key: got error %v, want ErrWriteConflict", err)
+	}
+	if err := h.db.CompareAndSwap([]byte("foo"), []byte("v1"), []byte("v2"), h.wo); err != nil {
+		t.Error("CompareAndSwap: got error: ", err)
 	}
+	h.getVal("foo", "v2")
 
-	_, err = h.db.GetProperty("leveldb.num-files-at-level0x")
-	if err == nil {
-		t.Error("GetProperty() failed to detect invalid level")
+	// Nil old value means the key must not exist, empty old value matches
+	// an existing empty value.
+	if err := h.db.CompareAndSwap([]byte("bar"), nil, []byte{}, h.wo); err != nil {
+		t.Error("CompareAndSwap of missing key: got error: ", err)
+	}
+	if err, ok := h.db.CompareAndSwap([]byte("bar"), nil, []byte("v1"), h.wo).(*ErrWriteConflict); !ok || err.Value == nil {
+		t.Errorf("CompareAndSwap of existing empty value: got error %v, want ErrWriteConflict", err)
+	}
+	if err := h.db.CompareAndSwap([]byte("bar"), []byte{}, []byte("v1"), h.wo); err != nil {
+		t.Error("CompareAndSwap of empty value: got error: ", err)
+	}
+	h.getVal("bar", "v1")
+
+	// Concurrent increments with compare-and-swap retries don't lose
+	// updates.
+	const n, m = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < m; {
+				old, err := h.db.Get([]byte("counter"), nil)
+				if err == ErrNotFound {
+					old = nil
+				} else if err != nil {
+					t.Error("Get: got error: ", err)
+					return
+				}
+				cnt, _ := strconv.Atoi(string(old))
+				err = h.db.CompareAndSwap([]byte("counter"), old, []byte(strconv.Itoa(cnt+1)), nil)
+				if _, ok := err.(*ErrWriteConflict); ok {
+					continue
+				} else if err != nil {
+					t.Error("CompareAndSwap: got error: ", err)
+					return
+				}
+				j++
+			}
+		}()
 	}
+	wg.Wait()
+	h.getVal("counter", strconv.Itoa(n*m))
 }
 
 func TestDB_GoleveldbIssue72and83(t *testing.T) {
@@ -2539,7 +7013,7 @@ func TestDB_TableCompactionBuilder(t *testing.T) {
 		value      = bytes.Repeat([]byte{'0'}, 100)
 	)
 	for i := 0; i < 2; i++ {
-		tw, err := s.tops.create()
+		tw, err := s.tops.create(0)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -2690,6 +7164,315 @@ func TestDB_TableCompactionBuilder(t *testing.T) {
 	v.release()
 }
 
+func TestDB_CompactionTableSize(t *testing.T) {
+	o := &opt.Options{
+		CompactionTableSize:         opt.MiB,
+		CompactionTableSizePerLevel: []int{0, 0, 8 * opt.MiB},
+		MaxTableSize:                16 * opt.MiB,
+	}
+	for level, want := range []int{opt.MiB, opt.MiB, 8 * opt.MiB, opt.MiB} {
+		if got := o.GetCompactionTableSize(level); got != want {
+			t.Errorf("level-%d table size: want=%d got=%d", level, want, got)
+		}
+	}
+	o.CompactionTableSizeMultiplier = 10
+	if got := o.GetCompactionTableSize(3); got != 16*opt.MiB {
+		t.Errorf("capped table size: want=%d got=%d", 16*opt.MiB, got)
+	}
+
+	s, err := newSession(storage.NewMemStorage(), &opt.Options{CompactionTableSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	ik := func(key string) internalKey {
+		return makeInternalKey(nil, []byte(key), 1, keyTypeVal)
+	}
+	c := &compaction{
+		s: s,
+		gp: tFiles{
+			newTableFile(storage.FileDesc{Type: storage.TypeTable, Num: 1}, 10, ik("a"), ik("c")),
+			newTableFile(storage.FileDesc{Type: storage.TypeTable, Num: 2}, 10, ik("d"), ik("f")),
+			newTableFile(storage.FileDesc{Type: storage.TypeTable, Num: 3}, 10, ik("g"), ik("i")),
+		},
+		maxGPOverlaps: 1000,
+		tableSize:     100,
+	}
+	// The output ends at a grandparent boundary once it's half the target
+	// table size.
+	for _, x := range []struct {
+		key  string
+		size int
+		want bool
+	}{
+		{"a", 0, false},
+		{"b", 10, false},
+		{"d", 10, false},
+		{"e", 60, false},
+		{"g", 60, true},
+	} {
+		if got := c.shouldStopBefore(ik(x.key), x.size); got != x.want {
+			t.Errorf("shouldStopBefore(%q, %d): want=%v got=%v", x.key, x.size, x.want, got)
+		}
+	}
+}
+
+func TestDB_IntraL0Compaction(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionL0Trigger:          100,
+	})
+	defer h.close()
+
+	for i := 0; i < 50; i++ {
+		h.put(fmt.Sprintf("k%03d", i), strings.Repeat("v", 100))
+	}
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.delete("k010")
+	h.compactMem()
+	h.put("k020", "v2")
+	h.compactMem()
+	h.put("k030", "v2")
+	h.compactMem()
+	h.tablesPerLevel("3,1")
+
+	v := h.db.s.version()
+	l1Size := v.levels[1].size()
+	v.release()
+
+	// Level-1 exceeds its limit, though level-0 has the best score.
+	var (
+		mu    sync.Mutex
+		infos []opt.CompactionInfo
+	)
+	h.o = &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionL0IntraTrigger:     3,
+		CompactionL0Trigger:          2,
+		CompactionTotalSizePerLevel:  []int64{0, l1Size * 5 / 6},
+		EventListener: &opt.EventListener{
+			OnCompactionBegin: func(info opt.CompactionInfo) {
+				mu.Lock()
+				infos = append(infos, info)
+				mu.Unlock()
+			},
+		},
+	}
+	h.reopenDB()
+	h.waitCompaction()
+	h.tablesPerLevel("1,0,1")
+
+	mu.Lock()
+	if len(infos) != 2 || !infos[0].IntraL0 || infos[0].InputTables != 3 || infos[1].IntraL0 || infos[1].SourceLevel != 1 {
+		t.Errorf("invalid compactions: %+v", infos)
+	}
+	mu.Unlock()
+
+	// The deletion marker is kept, as the key is in a lower level.
+	h.get("k010", false)
+	h.getVal("k020", "v2")
+	h.getVal("k030", "v2")
+	h.getVal("k040", strings.Repeat("v", 100))
+	h.assertNumKeys(49)
+}
+
+func TestDB_TrivialCompaction(t *testing.T) {
+	s, err := newSession(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+	tf := func(num int64, min, max string) *tFile {
+		return newTableFile(storage.FileDesc{Type: storage.TypeTable, Num: num}, 10,
+			makeInternalKey(nil, []byte(min), 1, keyTypeVal), makeInternalKey(nil, []byte(max), 1, keyTypeVal))
+	}
+	gp := tFiles{tf(1, "a", "b"), tf(2, "c", "d"), tf(3, "e", "f"), tf(4, "g", "h")}
+	for i, x := range []struct {
+		level  int
+		t0, t1 tFiles
+		want   bool
+	}{
+		{1, tFiles{tf(5, "a", "d")}, nil, true},
+		{1, tFiles{tf(5, "a", "d")}, tFiles{tf(6, "b", "c")}, false},
+		{1, tFiles{tf(5, "a", "b"), tf(6, "c", "d")}, nil, true},
+		{1, tFiles{tf(5, "a", "d"), tf(6, "e", "h")}, nil, true},
+		{1, tFiles{tf(5, "a", "f"), tf(6, "g", "h")}, nil, false},
+		{0, tFiles{tf(6, "e", "h"), tf(5, "a", "d")}, nil, true},
+		{0, tFiles{tf(6, "c", "h"), tf(5, "a", "d")}, nil, false},
+	} {
+		imin, imax := x.t0.getRange(s.icmp)
+		c := &compaction{
+			s:             s,
+			sourceLevel:   x.level,
+			levels:        [2]tFiles{x.t0, x.t1},
+			gp:            gp.getOverlaps(nil, s.icmp, imin.ukey(), imax.ukey(), false),
+			maxGPOverlaps: 20,
+		}
+		if got := c.trivial(); got != x.want {
+			t.Errorf("#%d: trivial: want=%v got=%v", i, x.want, got)
+		}
+	}
+}
+
+func TestDB_CompactionPriorityGarbage(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionPriority:           opt.CompactionPriorityGarbage,
+	})
+	defer h.close()
+
+	for i := 0; i < 100; i++ {
+		h.put(fmt.Sprintf("k%03d", i), "v1")
+	}
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.tablesPerLevel("0,1")
+
+	// Level-0 doesn't need compaction, though its table holds mostly
+	// deletion markers and overwritten entries.
+	for i := 0; i < 40; i++ {
+		h.delete(fmt.Sprintf("k%03d", i))
+	}
+	for i := 40; i < 60; i++ {
+		h.put(fmt.Sprintf("k%03d", i), "v2")
+		h.put(fmt.Sprintf("k%03d", i), "v3")
+	}
+	h.compactMem()
+	h.waitCompaction()
+	h.tablesPerLevel("0,1")
+	h.assertNumKeys(60)
+	h.getVal("k050", "v3")
+
+	v := h.db.s.version()
+	defer v.release()
+	if ratio := v.levels[1][0].garbageRatio(); ratio != 0 {
+		t.Errorf("invalid garbage ratio: want=0 got=%v", ratio)
+	}
+	if v.cGarbage != nil {
+		t.Errorf("unexpected garbage compaction of %v", v.cGarbage.table.fd)
+	}
+}
+
+func TestDB_CompactionPending(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionL0Trigger:          100,
+	})
+	defer h.close()
+
+	h.put("foo", "v1")
+	h.compactMem()
+	h.put("bar", "v1")
+	h.compactMem()
+	if size, n := h.db.CompactionPending(); size != 0 || n != 0 {
+		t.Errorf("CompactionPending: want=0,0 got=%d,%d", size, n)
+	}
+	v := h.db.s.version()
+	l0Size := v.levels[0].size()
+	v.release()
+
+	// The level-0 tables reach the trigger, read-only DB doesn't compact.
+	h.o = &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionL0Trigger:          2,
+		ReadOnly:                     true,
+	}
+	h.reopenDB()
+	if size, n := h.db.CompactionPending(); size != l0Size || n != 2 {
+		t.Errorf("CompactionPending: want=%d,2 got=%d,%d", l0Size, size, n)
+	}
+
+	var (
+		mu    sync.Mutex
+		infos []opt.CompactionDebtInfo
+	)
+	h.o = &opt.Options{
+		DisableLargeBatchTransaction: true,
+		CompactionL0Trigger:          2,
+		CompactionDebtThresholds:     []int64{1, opt.MiB},
+		EventListener: &opt.EventListener{
+			OnCompactionDebt: func(info opt.CompactionDebtInfo) {
+				mu.Lock()
+				infos = append(infos, info)
+				mu.Unlock()
+			},
+		},
+	}
+	h.reopenDB()
+	h.waitCompaction()
+	if size, n := h.db.CompactionPending(); size != 0 || n != 0 {
+		t.Errorf("CompactionPending: want=0,0 got=%d,%d", size, n)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []opt.CompactionDebtInfo{
+		{Bytes: l0Size, Tables: 2, Thresholds: 1},
+		{Bytes: 0, Tables: 0, Thresholds: 0},
+	}
+	if !reflect.DeepEqual(infos, want) {
+		t.Errorf("invalid compaction debt events: want=%+v got=%+v", want, infos)
+	}
+}
+
+func TestDB_OpenFilesCachePin(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("a", "v1")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.put("z", "v1")
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.tablesPerLevel("0,2")
+
+	misses := func(keys ...string) (n int64, pinned int) {
+		s0, err := h.db.Stats()
+		if err != nil {
+			t.Fatal("Stats: got error: ", err)
+		}
+		for _, key := range keys {
+			h.getVal(key, "v1")
+		}
+		s1, err := h.db.Stats()
+		if err != nil {
+			t.Fatal("Stats: got error: ", err)
+		}
+		return s1.OpenedTablesMisses - s0.OpenedTablesMisses, s1.OpenedTablesPinned
+	}
+
+	// Tables are reopened by every read without open files caching.
+	h.o = &opt.Options{OpenFilesCacheCapacity: -1}
+	h.reopenDB()
+	if n, pinned := misses("a", "z", "a"); n != 3 || pinned != 0 {
+		t.Errorf("no pinning: want misses=3 pinned=0, got misses=%d pinned=%d", n, pinned)
+	}
+
+	h.o = &opt.Options{OpenFilesCacheCapacity: -1, OpenFilesCachePinBottomLevel: true}
+	h.reopenDB()
+	if n, pinned := misses("a", "z", "a"); n != 2 || pinned != 2 {
+		t.Errorf("bottom level pinning: want misses=2 pinned=2, got misses=%d pinned=%d", n, pinned)
+	}
+
+	h.o = &opt.Options{OpenFilesCacheCapacity: -1, OpenFilesCachePinPerLevel: 1}
+	h.reopenDB()
+	if n, pinned := misses("a", "a", "z", "a"); n != 3 || pinned != 1 {
+		t.Errorf("per level pinning: want misses=3 pinned=1, got misses=%d pinned=%d", n, pinned)
+	}
+
+	// Pinned tables are unpinned once deleted.
+	h.o = &opt.Options{OpenFilesCacheCapacity: -1, OpenFilesCachePinBottomLevel: true}
+	h.reopenDB()
+	misses("a", "z")
+	h.compactRangeAt(1, "", "")
+	h.tablesPerLevel("0,0,1")
+	if n, pinned := misses("a", "z"); n != 1 || pinned != 1 {
+		t.Errorf("after compaction: want misses=1 pinned=1, got misses=%d pinned=%d", n, pinned)
+	}
+}
+
 func testDB_IterTriggeredCompaction(t *testing.T, limitDiv int) {
 	const (
 		vSize = 200 * opt.KiB
@@ -7,8 +7,10 @@
 package leveldb
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/FactomProject/goleveldb/leveldb/iterator"
@@ -43,7 +45,7 @@ func (tr *Transaction) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
 	if tr.closed {
 		return nil, errTransactionDone
 	}
-	return tr.db.get(tr.mem.DB, tr.tables, key, tr.seq, ro)
+	return tr.db.get(context.Background(), tr.mem, tr.tables, key, nil, tr.seq, ro)
 }
 
 // Has returns true if the DB does contains the given key.
@@ -55,7 +57,7 @@ func (tr *Transaction) Has(key []byte, ro *opt.ReadOptions) (bool, error) {
 	if tr.closed {
 		return false, errTransactionDone
 	}
-	return tr.db.has(tr.mem.DB, tr.tables, key, tr.seq, ro)
+	return tr.db.has(context.Background(), tr.mem, tr.tables, key, tr.seq, ro)
 }
 
 // NewIterator returns an iterator for the latest snapshot of the transaction.
@@ -79,7 +81,7 @@ func (tr *Transaction) NewIterator(slice *util.Range, ro *opt.ReadOptions) itera
 		return iterator.NewEmptyIterator(errTransactionDone)
 	}
 	tr.mem.incref()
-	return tr.db.newIterator(tr.mem, tr.tables, tr.seq, slice, ro)
+	return tr.db.newIterator(tr.mem, tr.tables, tr.seq, slice, ro, nil)
 }
 
 func (tr *Transaction) flush() error {
@@ -103,12 +105,17 @@ func (tr *Transaction) flush() error {
 		tr.tables = append(tr.tables, t)
 		tr.rec.addTableFile(0, t)
 		tr.stats.write += t.size
-		tr.db.logf("transaction@flush created L0@%d N·%d S·%s %q:%q", t.fd.Num, n, shortenb(int(t.size)), t.imin, t.imax)
+		tr.db.log(opt.LogInfo, "transaction@flush created", "level", 0, "file", t.fd, "entries", n, "size", t.size, "min", t.imin, "max", t.imax)
 	}
 	return nil
 }
 
 func (tr *Transaction) put(kt keyType, key, value []byte) error {
+	if kt == keyTypeRangeDel {
+		if ok, err := checkRangeDel(tr.db.s.icmp, key, value); !ok {
+			return err
+		}
+	}
 	tr.ikScratch = makeInternalKey(tr.ikScratch, key, tr.seq+1, kt)
 	if tr.mem.Free() < len(tr.ikScratch)+len(value) {
 		if err := tr.flush(); err != nil {
@@ -118,6 +125,9 @@ func (tr *Transaction) put(kt keyType, key, value []byte) error {
 	if err := tr.mem.Put(tr.ikScratch, value); err != nil {
 		return err
 	}
+	if kt == keyTypeRangeDel {
+		tr.mem.putRangeDel(tr.seq+1, key, value)
+	}
 	tr.seq++
 	return nil
 }
@@ -151,6 +161,21 @@ func (tr *Transaction) Delete(key []byte, wo *opt.WriteOptions) error {
 	return tr.put(keyTypeDel, key, nil)
 }
 
+// DeleteRange deletes every key within the given key range, start is
+// included in the range while limit is not. An empty range is ignored,
+// ErrInvalidRange is returned if start is after limit.
+// Please note that the transaction is not compacted until committed.
+//
+// It is safe to modify the contents of the arguments after DeleteRange returns.
+func (tr *Transaction) DeleteRange(start, limit []byte, wo *opt.WriteOptions) error {
+	tr.lk.Lock()
+	defer tr.lk.Unlock()
+	if tr.closed {
+		return errTransactionDone
+	}
+	return tr.put(keyTypeRangeDel, start, limit)
+}
+
 // Write apply the given batch to the transaction. The batch will be applied
 // sequentially.
 // Please note that the transaction is not compacted until committed, so if you
@@ -207,22 +232,24 @@ func (tr *Transaction) Commit() error {
 		for retry := 0; retry < 3; retry++ {
 			cerr = tr.db.s.commit(&tr.rec)
 			if cerr != nil {
-				tr.db.logf("transaction@commit error R·%d %q", retry, cerr)
+				tr.db.log(opt.LogWarn, "transaction@commit error", "retry", retry, "err", cerr)
 				select {
 				case <-time.After(time.Second):
 				case <-tr.db.closeC:
-					tr.db.logf("transaction@commit exiting")
+					tr.db.log(opt.LogWarn, "transaction@commit exiting")
 					tr.db.compCommitLk.Unlock()
 					return cerr
 				}
 			} else {
 				// Success. Set db.seq.
+				atomic.AddUint64(&tr.db.cPuts, tr.seq-tr.db.getSeq())
 				tr.db.setSeq(tr.seq)
 				break
 			}
 		}
 		tr.stats.stopTimer()
 		if cerr != nil {
+			tr.db.compCommitLk.Unlock()
 			// Return error, lets user decide either to retry or discard
 			// transaction.
 			return cerr
@@ -230,6 +257,8 @@ func (tr *Transaction) Commit() error {
 
 		// Update compaction stats. This is safe as long as we hold compCommitLk.
 		tr.db.compStats.addStat(0, &tr.stats)
+		tr.db.onTablesCreated(&tr.rec)
+		tr.db.checkCompactionDebt()
 
 		// Trigger table auto-compaction.
 		tr.db.compTrigger(tr.db.tcompCmdC)
@@ -247,7 +276,8 @@ func (tr *Transaction) Commit() error {
 func (tr *Transaction) discard() {
 	// Discard transaction.
 	for _, t := range tr.tables {
-		tr.db.logf("transaction@discard @%d", t.fd.Num)
+		tr.db.log(opt.LogDebug, "transaction@discard", "file", t.fd)
+		removeTableVlog(tr.db.s.stor, t.fd.Num, t.vlogs)
 		if err1 := tr.db.s.stor.Remove(t.fd); err1 == nil {
 			tr.db.s.reuseFileNum(t.fd.Num)
 		}
@@ -267,7 +297,7 @@ func (tr *Transaction) Discard() {
 }
 
 func (db *DB) waitCompaction() error {
-	if db.s.tLen(0) >= db.s.o.GetWriteL0PauseTrigger() {
+	if cond, _ := db.s.o.GetWriteStallPolicy().WriteStall(db.s.tLen(0)); cond == opt.WriteStallPause {
 		return db.compTriggerWait(db.tcompCmdC)
 	}
 	return nil
@@ -285,6 +315,10 @@ func (db *DB) waitCompaction() error {
 // the transaction.
 // Closing the DB will discard open transaction.
 func (db *DB) OpenTransaction() (*Transaction, error) {
+	return db.openTransaction(context.Background())
+}
+
+func (db *DB) openTransaction(ctx context.Context) (*Transaction, error) {
 	if err := db.ok(); err != nil {
 		return nil, err
 	}
@@ -296,6 +330,8 @@ func (db *DB) OpenTransaction() (*Transaction, error) {
 		return nil, err
 	case <-db.closeC:
 		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
 	if db.tr != nil {
@@ -305,12 +341,14 @@ func (db *DB) OpenTransaction() (*Transaction, error) {
 	// Flush current memdb.
 	if db.mem != nil && db.mem.Len() != 0 {
 		if _, err := db.rotateMem(0, true); err != nil {
+			<-db.writeLockC
 			return nil, err
 		}
 	}
 
 	// Wait compaction when certain threshold reached.
 	if err := db.waitCompaction(); err != nil {
+		<-db.writeLockC
 		return nil, err
 	}
 
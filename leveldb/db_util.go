@@ -33,19 +33,113 @@ func (sizes Sizes) Sum() int64 {
 	return sum
 }
 
+// RangeSize is the approximate size of a key range, see DB.RangeSizes.
+type RangeSize struct {
+	// Approximate size of the tables within the range.
+	TableSize int64
+	// Approximate size of the keys/values within the range that haven't
+	// been flushed to tables.
+	MemTableSize int64
+	// Approximate number of entries within the range. Entries that are
+	// overwritten or deleted are counted until they are compacted.
+	Entries int64
+}
+
 // Logging.
-func (db *DB) log(v ...interface{})                 { db.s.log(v...) }
-func (db *DB) logf(format string, v ...interface{}) { db.s.logf(format, v...) }
+func (db *DB) log(level opt.LogLevel, msg string, keyvals ...interface{}) {
+	db.s.log(level, msg, keyvals...)
+}
+
+// Events.
+func (db *DB) onCompactionBegin(info opt.CompactionInfo) {
+	if el := db.s.o.GetEventListener(); el != nil && el.OnCompactionBegin != nil {
+		el.OnCompactionBegin(info)
+	}
+}
+
+func (db *DB) onCompactionEnd(info opt.CompactionInfo) {
+	if el := db.s.o.GetEventListener(); el != nil && el.OnCompactionEnd != nil {
+		el.OnCompactionEnd(info)
+	}
+}
+
+// Calls the OnCompactionDebt callback if the compaction debt crossed any
+// of the thresholds since it was last called. Must be called with
+// compCommitLk held.
+func (db *DB) checkCompactionDebt() {
+	thresholds := db.s.o.GetCompactionDebtThresholds()
+	el := db.s.o.GetEventListener()
+	if len(thresholds) == 0 || el == nil || el.OnCompactionDebt == nil {
+		return
+	}
+	v := db.s.version()
+	size, n := v.compactionDebt()
+	v.release()
+	info := opt.CompactionDebtInfo{Bytes: size, Tables: n}
+	for _, threshold := range thresholds {
+		if size >= threshold {
+			info.Thresholds++
+		}
+	}
+	if info.Thresholds != db.compDebt {
+		db.compDebt = info.Thresholds
+		el.OnCompactionDebt(info)
+	}
+}
+
+func (db *DB) onMemFlush(info opt.MemFlushInfo) {
+	if el := db.s.o.GetEventListener(); el != nil && el.OnMemFlush != nil {
+		el.OnMemFlush(info)
+	}
+}
+
+func (db *DB) onTablesCreated(rec *sessionRecord) {
+	if el := db.s.o.GetEventListener(); el != nil && el.OnTableCreated != nil {
+		for _, r := range rec.addedTables {
+			el.OnTableCreated(opt.TableInfo{Level: r.level, Num: r.num, Size: r.size})
+		}
+	}
+}
+
+func (db *DB) onWriteStall(info opt.WriteStallInfo) {
+	if el := db.s.o.GetEventListener(); el != nil && el.OnWriteStall != nil {
+		el.OnWriteStall(info)
+	}
+}
+
+func (db *DB) onTableQuarantined(info opt.TableInfo, err error) {
+	if el := db.s.o.GetEventListener(); el != nil && el.OnTableQuarantined != nil {
+		el.OnTableQuarantined(info, err)
+	}
+}
+
+func (db *DB) onCorruption(err error) {
+	if el := db.s.o.GetEventListener(); el != nil && el.OnCorruption != nil {
+		el.OnCorruption(err)
+	}
+}
 
 // Check and clean files.
 func (db *DB) checkAndCleanFiles() error {
 	v := db.s.version()
 	defer v.release()
 
-	tmap := make(map[int64]bool)
+	tmap := make(map[storage.FileDesc]bool)
 	for _, tables := range v.levels {
 		for _, t := range tables {
-			tmap[t.fd.Num] = false
+			tmap[t.fd] = false
+			for _, vnum := range t.vlogs {
+				tmap[storage.FileDesc{Type: storage.TypeValueLog, Num: vnum}] = false
+			}
+		}
+	}
+
+	// Quarantined tables are kept, but aren't required.
+	qmap := make(map[storage.FileDesc]struct{})
+	for _, qt := range db.s.stQuarantined {
+		qmap[storage.FileDesc{Type: storage.TypeTable, Num: qt.num}] = struct{}{}
+		for _, vnum := range qt.vlogs {
+			qmap[storage.FileDesc{Type: storage.TypeValueLog, Num: vnum}] = struct{}{}
 		}
 	}
 
@@ -67,11 +161,19 @@ func (db *DB) checkAndCleanFiles() error {
 			} else {
 				keep = fd.Num >= db.journalFd.Num
 			}
-		case storage.TypeTable:
-			_, keep = tmap[fd.Num]
+			if !keep && db.journalRetention() {
+				if err := db.retainJournal(fd); err != nil {
+					return err
+				}
+				keep = true
+			}
+		case storage.TypeTable, storage.TypeValueLog:
+			_, keep = tmap[fd]
 			if keep {
-				tmap[fd.Num] = true
+				tmap[fd] = true
 				nt++
+			} else {
+				_, keep = qmap[fd]
 			}
 		}
 
@@ -82,19 +184,26 @@ func (db *DB) checkAndCleanFiles() error {
 
 	if nt != len(tmap) {
 		var mfds []storage.FileDesc
-		for num, present := range tmap {
+		for fd, present := range tmap {
 			if !present {
-				mfds = append(mfds, storage.FileDesc{storage.TypeTable, num})
-				db.logf("db@janitor table missing @%d", num)
+				mfds = append(mfds, fd)
+				db.log(opt.LogError, "db@janitor missing", "file", fd)
 			}
 		}
-		return errors.NewErrCorrupted(storage.FileDesc{}, &errors.ErrMissingFiles{Fds: mfds})
+		return &errors.ErrCorrupted{Reason: "file missing", Err: &errors.ErrMissingFiles{Fds: mfds}}
 	}
 
-	db.logf("db@janitor F·%d G·%d", len(fds), len(rem))
+	db.purgeJournals()
+
+	db.log(opt.LogDebug, "db@janitor", "files", len(fds), "garbage", len(rem))
 	for _, fd := range rem {
-		db.logf("db@janitor removing %s-%d", fd.Type, fd.Num)
-		if err := db.s.stor.Remove(fd); err != nil {
+		db.log(opt.LogDebug, "db@janitor removing", "file", fd)
+		if fd.Type == storage.TypeJournal {
+			err = db.dropJournal(fd)
+		} else {
+			err = db.s.stor.Remove(fd)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,186 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/journal"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/table"
+)
+
+// VerifyReport is the result of DB.VerifyChecksums.
+type VerifyReport struct {
+	// Number of the verified tables and journals.
+	Tables   int
+	Journals int
+
+	// Total number of bytes read.
+	Size int64
+
+	// Corruptions found, one per corrupted file. Fd identifies the
+	// corrupted file, and Offset and Size the corrupted block or chunk.
+	Corrupted []*errors.ErrCorrupted
+
+	// Time taken by the verification.
+	Duration time.Duration
+}
+
+// OK returns true if no corruption was found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Corrupted) == 0
+}
+
+type verifier struct {
+	db    *DB
+	rate  int
+	start time.Time
+	rep   *VerifyReport
+}
+
+// Accounts n bytes about to be read, sleeping as needed to keep within
+// the rate limit.
+func (vr *verifier) wait(n int) error {
+	vr.rep.Size += int64(n)
+	if vr.rate <= 0 {
+		return nil
+	}
+	d := time.Duration(vr.rep.Size*int64(time.Second)/int64(vr.rate)) - time.Since(vr.start)
+	if d <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(d):
+		return nil
+	case <-vr.db.closeC:
+		return ErrClosed
+	}
+}
+
+// Records the error if it is a corruption, otherwise returns it.
+func (vr *verifier) check(fd storage.FileDesc, err error) error {
+	if err == nil {
+		return nil
+	}
+	cerr, ok := errors.AsCorrupted(errors.SetFd(err, fd))
+	if !ok {
+		return err
+	}
+	vr.rep.Corrupted = append(vr.rep.Corrupted, cerr)
+	vr.db.log(opt.LogWarn, "db@verify corrupted", "file", fd, "offset", cerr.Offset, "size", cerr.Size, "reason", cerr.Reason)
+	return nil
+}
+
+func (vr *verifier) verifyTable(t *tFile) error {
+	ch, err := vr.db.s.tops.open(t)
+	if err != nil {
+		return vr.check(t.fd, err)
+	}
+	defer ch.Release()
+	vr.rep.Tables++
+	return vr.check(t.fd, ch.Value().(*table.Reader).VerifyChecksums(vr.wait))
+}
+
+// verifyReader calls wait for each read, to limit the read rate.
+type verifyReader struct {
+	r    io.Reader
+	wait func(n int) error
+}
+
+func (r verifyReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.wait(n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Verifies the current journal, up to its size when it is opened.
+func (vr *verifier) verifyJournal() error {
+	db := vr.db
+
+	// Hold the writer off, so the journal holds only whole records.
+	select {
+	case db.writeLockC <- struct{}{}:
+	case err := <-db.compPerErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+	fd := db.journalFd
+	size := db.journalWriter.size
+	r, err := db.s.stor.Open(fd)
+	<-db.writeLockC
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	vr.rep.Journals++
+	jr := journal.NewReaderSize(verifyReader{io.NewSectionReader(r, 0, size), vr.wait}, nil, true, true, vr.db.s.o.GetJournalBlockSize())
+	jr.SetNumber(fd.Num)
+	for {
+		rr, err := jr.Next()
+		if err == nil {
+			_, err = io.Copy(ioutil.Discard, rr)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return vr.check(fd, err)
+		}
+	}
+}
+
+// VerifyChecksums reads all live tables and the journal of the DB, and
+// verifies their checksums. Every block of the tables is read from the
+// files, bypassing the caches, see table.Reader.VerifyChecksums. The
+// verification reads the DB state when it is called, concurrent writes
+// and compactions aren't blocked.
+//
+// Corruptions are not returned as error but reported, verification
+// continues with the next file. The returned error is non-nil if the
+// verification fails, e.g. because of I/O error or the DB is closed.
+//
+// The verify options may be nil.
+func (db *DB) VerifyChecksums(vo *opt.VerifyOptions) (*VerifyReport, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+
+	vr := &verifier{
+		db:    db,
+		rate:  vo.GetBytesPerSec(),
+		start: time.Now(),
+		rep:   &VerifyReport{},
+	}
+	v := db.s.version()
+	defer v.release()
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			if err := vr.verifyTable(t); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !vo.GetSkipJournal() {
+		if err := vr.verifyJournal(); err != nil {
+			return nil, err
+		}
+	}
+	vr.rep.Duration = time.Since(vr.start)
+	db.log(opt.LogInfo, "db@verify done", "tables", vr.rep.Tables, "journals", vr.rep.Journals, "size", vr.rep.Size, "corrupted", len(vr.rep.Corrupted), "duration", vr.rep.Duration)
+	return vr.rep, nil
+}
@@ -7,6 +7,9 @@
 package leveldb
 
 import (
+	"bytes"
+	"context"
+	"sync/atomic"
 	"time"
 
 	"github.com/FactomProject/goleveldb/leveldb/memdb"
@@ -14,24 +17,139 @@ import (
 	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
-func (db *DB) writeJournal(batches []*Batch, seq uint64, sync bool) error {
-	wr, err := db.journal.Next()
-	if err != nil {
-		return err
+func (db *DB) writeJournal(ctx context.Context, batches []*Batch, seq uint64, sync bool) (err error) {
+	if db.s.tracer != nil {
+		tinfo := opt.TraceInfo{Op: opt.TraceJournalWrite, Level: -1, TableNum: -1}
+		for _, batch := range batches {
+			tinfo.Size += int64(len(batch.data))
+		}
+		ctx = db.s.traceStart(ctx, tinfo)
+		defer func() {
+			db.s.traceEnd(ctx, tinfo, err)
+		}()
 	}
-	if err := writeBatchesWithHeader(wr, batches, seq); err != nil {
+
+	if err := writeBatchesToJournal(db.journal, batches, seq, batchSplitSize); err != nil {
 		return err
 	}
 	if err := db.journal.Flush(); err != nil {
 		return err
 	}
 	if sync {
+		db.journalDirty = false
 		return db.journalWriter.Sync()
 	}
+	db.journalDirty = true
+	return nil
+}
+
+// Syncs the journal if it has unsynced writes; need write lock.
+func (db *DB) syncJournal() error {
+	if !db.journalDirty || db.journalWriter == nil || db.s.o.GetNoSync() {
+		return nil
+	}
+	if err := db.journalWriter.Sync(); err != nil {
+		return err
+	}
+	db.journalDirty = false
+	return nil
+}
+
+// Returns ErrBatchTooLarge if the batches together exceed the MaxBatchSize
+// or MaxBatchLen option, and ErrInvalidRange if a range deletion of the
+// batches has its start after its limit.
+func (db *DB) checkBatchLimits(batches ...*Batch) error {
+	size := 0
+	for _, batch := range batches {
+		size += len(batch.data)
+	}
+	maxSize, maxLen := db.s.o.GetMaxBatchSize(), db.s.o.GetMaxBatchLen()
+	if n := batchesLen(batches); (maxSize > 0 && size > maxSize) || (maxLen > 0 && n > maxLen) {
+		return &ErrBatchTooLarge{Size: size, Len: n}
+	}
+	for _, batch := range batches {
+		if !batch.hasRangeDel() {
+			continue
+		}
+		if db.s.o.GetLevelDBCompatible() {
+			return ErrNotCompatible
+		}
+		for _, index := range batch.index {
+			if index.keyType == keyTypeRangeDel {
+				if _, err := checkRangeDel(db.s.icmp, index.k(batch.data), index.v(batch.data)); err != nil {
+					return err
+				}
+			}
+		}
+	}
 	return nil
 }
 
+// Locks the writer, returns error if the DB is closed or in read-only
+// mode.
+func (db *DB) lockWriter() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	select {
+	case db.writeLockC <- struct{}{}:
+		return nil
+	case err := <-db.compPerErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+}
+
+// Periodically syncs the journal.
+func (db *DB) jSync(interval time.Duration) {
+	defer db.closeW.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.closeC:
+			return
+		}
+		select {
+		case db.writeLockC <- struct{}{}:
+		case <-db.closeC:
+			return
+		}
+		if err := db.syncJournal(); err != nil {
+			db.log(opt.LogError, "journal@sync failed", "err", err)
+		}
+		<-db.writeLockC
+	}
+}
+
+// SyncWAL syncs the journal, making all preceding writes durable, including
+// writes without WriteOptions.Sync. It has no effect if Options.NoSync is
+// true.
+func (db *DB) SyncWAL() error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	// Lock writer.
+	select {
+	case db.writeLockC <- struct{}{}:
+	case err := <-db.compPerErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+	defer func() { <-db.writeLockC }()
+
+	return db.syncJournal()
+}
+
 func (db *DB) rotateMem(n int, wait bool) (mem *memDB, err error) {
+	// The memdb must not be frozen before pending writes applied.
+	db.waitWriteApply()
+
 	retryLimit := 3
 retry:
 	// Wait for pending memdb compaction.
@@ -62,10 +180,16 @@ retry:
 	return
 }
 
-func (db *DB) flush(n int) (mdb *memDB, mdbFree int, err error) {
+func (db *DB) flush(ctx context.Context, n int) (mdb *memDB, mdbFree int, err error) {
 	delayed := false
-	slowdownTrigger := db.s.o.GetWriteL0SlowdownTrigger()
-	pauseTrigger := db.s.o.GetWriteL0PauseTrigger()
+	policy := db.s.o.GetWriteStallPolicy()
+	cond := opt.WriteStallNormal
+	stall := func(c opt.WriteStallCondition, tLen int) {
+		if cond != c {
+			cond = c
+			db.onWriteStall(opt.WriteStallInfo{Condition: c, Level0Tables: tLen})
+		}
+	}
 	flush := func() (retry bool) {
 		mdb = db.getEffectiveMem()
 		if mdb == nil {
@@ -79,22 +203,35 @@ func (db *DB) flush(n int) (mdb *memDB, mdbFree int, err error) {
 			}
 		}()
 		tLen := db.s.tLen(0)
-		mdbFree = mdb.Free()
+		tCond, tDelay := policy.WriteStall(tLen)
+		// The batches pending memdb apply are already accounted.
+		mdbFree = mdb.Free() - db.writeApplyLen
 		switch {
-		case tLen >= slowdownTrigger && !delayed:
+		case tCond != opt.WriteStallNormal && tDelay > 0 && !delayed:
 			delayed = true
-			time.Sleep(time.Millisecond)
+			stall(opt.WriteStallSlowdown, tLen)
+			select {
+			case <-time.After(tDelay):
+			case <-ctx.Done():
+				err = ctx.Err()
+				return false
+			}
 		case mdbFree >= n:
 			return false
-		case tLen >= pauseTrigger:
+		case tCond == opt.WriteStallPause:
 			delayed = true
-			err = db.compTriggerWait(db.tcompCmdC)
+			stall(opt.WriteStallPause, tLen)
+			// Set the write paused flag explicitly.
+			atomic.StoreInt32(&db.inWritePaused, 1)
+			err = db.compTriggerWaitContext(ctx, db.tcompCmdC)
+			// Unset the write paused flag.
+			atomic.StoreInt32(&db.inWritePaused, 0)
 			if err != nil {
 				return false
 			}
 		default:
 			// Allow memdb to grow if it has no entry.
-			if mdb.Len() == 0 {
+			if mdb.Len() == 0 && db.writeApplyLen == 0 {
 				mdbFree = n
 			} else {
 				mdb.decref()
@@ -112,17 +249,57 @@ func (db *DB) flush(n int) (mdb *memDB, mdbFree int, err error) {
 	start := time.Now()
 	for flush() {
 	}
+	duration := time.Since(start)
 	if delayed {
-		db.writeDelay += time.Since(start)
+		db.writeDelay += duration
 		db.writeDelayN++
+		atomic.AddInt64(&db.cWriteDelay, int64(duration))
+		atomic.AddInt32(&db.cWriteDelayN, 1)
+		db.onWriteStall(opt.WriteStallInfo{Condition: opt.WriteStallNormal, Level0Tables: db.s.tLen(0), Duration: duration})
 	} else if db.writeDelayN > 0 {
-		db.logf("db@write was delayed N·%d T·%v", db.writeDelayN, db.writeDelay)
+		db.log(opt.LogInfo, "db@write was delayed", "count", db.writeDelayN, "duration", db.writeDelay)
 		db.writeDelay = 0
 		db.writeDelayN = 0
 	}
 	return
 }
 
+// Puts batches into the memdb and increments the seq number.
+func (db *DB) applyBatches(batches []*Batch, seq uint64, mdb *memDB) {
+	db.insertBatches(batches, seq, mdb, false)
+	db.publishBatches(batches)
+}
+
+// Puts batches into the memdb, concurrently with the pending pipelined
+// writes if concurrent is true. The entries aren't visible to reads until
+// the seq number is incremented by publishBatches.
+func (db *DB) insertBatches(batches []*Batch, seq uint64, mdb *memDB, concurrent bool) {
+	for _, batch := range batches {
+		if err := batch.putMem(seq, mdb, concurrent); err != nil {
+			panic(err)
+		}
+		seq += uint64(batch.Len())
+	}
+}
+
+// Increments the seq number past the given inserted batches, which must
+// directly follow the current seq number.
+func (db *DB) publishBatches(batches []*Batch) {
+	n := uint64(batchesLen(batches))
+	atomic.AddUint64(&db.cPuts, n)
+	db.addSeq(n)
+}
+
+// Waits for the memdb apply of the preceding pipelined write; need write
+// lock.
+func (db *DB) waitWriteApply() {
+	if db.writeApplyC != nil {
+		<-db.writeApplyC
+		db.writeApplyC = nil
+		db.writeApplyLen = 0
+	}
+}
+
 type writeMerge struct {
 	sync       bool
 	batch      *Batch
@@ -131,6 +308,7 @@ type writeMerge struct {
 }
 
 func (db *DB) unlockWrite(overflow bool, merged int, err error) {
+	db.waitWriteApply()
 	for i := 0; i < merged; i++ {
 		db.writeAckC <- err
 	}
@@ -144,10 +322,10 @@ func (db *DB) unlockWrite(overflow bool, merged int, err error) {
 }
 
 // ourBatch if defined should equal with batch.
-func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
+func (db *DB) writeLocked(ctx context.Context, batch, ourBatch *Batch, merge, sync bool) error {
 	// Try to flush memdb. This method would also trying to throttle writes
 	// if it is too fast and compaction cannot catch-up.
-	mdb, mdbFree, err := db.flush(batch.internalLen)
+	mdb, mdbFree, err := db.flush(ctx, batch.internalLen)
 	if err != nil {
 		db.unlockWrite(false, 0, err)
 		return err
@@ -160,77 +338,148 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 		batches  = []*Batch{batch}
 	)
 
-	if merge {
+	// Merged writes share the ack channel, so don't merge while memdb apply
+	// of the preceding pipelined write is pending.
+	if db.writeApplyC != nil {
+		select {
+		case <-db.writeApplyC:
+			db.writeApplyC = nil
+			db.writeApplyLen = 0
+		default:
+		}
+	}
+
+	if merge && db.writeApplyC == nil {
 		// Merge limit.
 		var mergeLimit int
-		if batch.internalLen > 128<<10 {
-			mergeLimit = (1 << 20) - batch.internalLen
+		if limit := db.s.o.GetWriteMergeLimit(); batch.internalLen > limit {
+			mergeLimit = 8*limit - batch.internalLen
 		} else {
-			mergeLimit = 128 << 10
+			mergeLimit = limit
 		}
 		mergeCap := mdbFree - batch.internalLen
 		if mergeLimit > mergeCap {
 			mergeLimit = mergeCap
 		}
 
+		// Merge wait.
+		var mergeWaitC <-chan time.Time
+		if wait := db.s.o.GetWriteMergeMaxWait(); wait > 0 {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			mergeWaitC = timer.C
+		}
+		separateSync := db.s.o.GetWriteMergeSeparateSync()
+
 	merge:
 		for mergeLimit > 0 {
-			select {
-			case incoming := <-db.writeMergeC:
-				if incoming.batch != nil {
-					// Merge batch.
-					if incoming.batch.internalLen > mergeLimit {
-						overflow = true
-						break merge
-					}
-					batches = append(batches, incoming.batch)
-					mergeLimit -= incoming.batch.internalLen
-				} else {
-					// Merge put.
-					internalLen := len(incoming.key) + len(incoming.value) + 8
-					if internalLen > mergeLimit {
-						overflow = true
-						break merge
-					}
-					if ourBatch == nil {
-						ourBatch = db.batchPool.Get().(*Batch)
-						ourBatch.Reset()
-						batches = append(batches, ourBatch)
-					}
-					// We can use same batch since concurrent write doesn't
-					// guarantee write order.
-					ourBatch.appendRec(incoming.keyType, incoming.key, incoming.value)
-					mergeLimit -= internalLen
+			var incoming writeMerge
+			if mergeWaitC == nil {
+				select {
+				case incoming = <-db.writeMergeC:
+				default:
+					break merge
 				}
-				sync = sync || incoming.sync
-				merged++
-				db.writeMergedC <- true
+			} else {
+				select {
+				case incoming = <-db.writeMergeC:
+				case <-mergeWaitC:
+					break merge
+				}
+			}
 
-			default:
+			if separateSync && incoming.sync != sync {
+				overflow = true
 				break merge
 			}
+			if incoming.batch != nil {
+				// Merge batch.
+				if incoming.batch.internalLen > mergeLimit {
+					overflow = true
+					break merge
+				}
+				batches = append(batches, incoming.batch)
+				mergeLimit -= incoming.batch.internalLen
+			} else {
+				// Merge put.
+				internalLen := len(incoming.key) + len(incoming.value) + 8
+				if internalLen > mergeLimit {
+					overflow = true
+					break merge
+				}
+				if ourBatch == nil {
+					ourBatch = db.batchPool.Get().(*Batch)
+					ourBatch.Reset()
+					batches = append(batches, ourBatch)
+				}
+				// We can use same batch since concurrent write doesn't
+				// guarantee write order.
+				ourBatch.appendRec(incoming.keyType, incoming.key, incoming.value)
+				mergeLimit -= internalLen
+			}
+			sync = sync || incoming.sync
+			merged++
+			db.writeMergedC <- true
 		}
 	}
 
 	// Seq number.
-	seq := db.seq + 1
+	var seq uint64
+	if db.writeApplyC != nil {
+		seq = db.writeApplySeq + 1
+	} else {
+		seq = db.seq + 1
+	}
 
 	// Write journal.
-	if err := db.writeJournal(batches, seq, sync); err != nil {
+	if err := db.writeJournal(ctx, batches, seq, sync); err != nil {
 		db.unlockWrite(overflow, merged, err)
 		return err
 	}
 
-	// Put batches.
-	for _, batch := range batches {
-		if err := batch.putMem(seq, mdb.DB); err != nil {
-			panic(err)
+	// Pipelined write; pass the lock to the next write once the seq numbers
+	// are reserved and the journal written, so the memdb insertions of the
+	// concurrent writes run in parallel, and overlap with the journal
+	// writes. Not if the memdb reaches the threshold, it's rotated below,
+	// which needs the write lock.
+	if merge && db.s.o.GetPipelinedWrite() && batch.internalLen < mdbFree {
+		handoff := overflow
+		if !handoff {
+			select {
+			case <-db.writeMergeC:
+				handoff = true
+			default:
+			}
+		}
+		if handoff {
+			prevApplyC := db.writeApplyC
+			applyC := make(chan struct{})
+			db.writeApplyC = applyC
+			db.writeApplySeq = seq + uint64(batchesLen(batches)) - 1
+			for _, b := range batches {
+				db.writeApplyLen += b.internalLen
+			}
+			db.writeMergedC <- false
+
+			// The entries of the preceding writes with lower seq numbers
+			// may still be being inserted, the seq numbers are published
+			// in order.
+			db.insertBatches(batches, seq, mdb, true)
+			if prevApplyC != nil {
+				<-prevApplyC
+			}
+			db.publishBatches(batches)
+			for i := 0; i < merged; i++ {
+				db.writeAckC <- nil
+			}
+			close(applyC)
+			return nil
 		}
-		seq += uint64(batch.Len())
 	}
 
-	// Incr seq number.
-	db.addSeq(uint64(batchesLen(batches)))
+	db.insertBatches(batches, seq, mdb, db.writeApplyC != nil)
+	db.waitWriteApply()
+	db.publishBatches(batches)
 
 	// Rotate memdb if it's reach the threshold.
 	if batch.internalLen >= mdbFree {
@@ -244,20 +493,39 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 // Write apply the given batch to the DB. The batch records will be applied
 // sequentially. Write might be used concurrently, when used concurrently and
 // batch is small enough, write will try to merge the batches. Set NoWriteMerge
-// option to true to disable write merge.
+// option to true to disable write merge. The merge behavior can be tuned by
+// WriteMergeLimit, WriteMergeMaxWait and WriteMergeSeparateSync options.
+// Batches exceeding the MaxBatchSize or MaxBatchLen option are rejected
+// with ErrBatchTooLarge.
 //
 // It is safe to modify the contents of the arguments after Write returns but
 // not before. Write will not modify content of the batch.
 func (db *DB) Write(batch *Batch, wo *opt.WriteOptions) error {
+	return db.WriteContext(context.Background(), batch, wo)
+}
+
+// WriteContext is like Write, but gives up once the given context is done.
+// The context is honored while waiting for the write lock and while the
+// write is paused or slowed down by compaction, in which case ctx.Err() is
+// returned and the batch is not applied. Once the batch has been merged
+// into a concurrent write it can no longer be abandoned, and WriteContext
+// waits for that write to complete.
+func (db *DB) WriteContext(ctx context.Context, batch *Batch, wo *opt.WriteOptions) error {
 	if err := db.ok(); err != nil || batch == nil || batch.Len() == 0 {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := db.checkBatchLimits(batch); err != nil {
+		return err
+	}
 
 	// If the batch size is larger than write buffer, it may justified to write
 	// using transaction instead. Using transaction the batch will be written
 	// into tables directly, skipping the journaling.
 	if batch.internalLen > db.s.o.GetWriteBuffer() && !db.s.o.GetDisableLargeBatchTransaction() {
-		tr, err := db.OpenTransaction()
+		tr, err := db.openTransaction(ctx)
 		if err != nil {
 			return err
 		}
@@ -288,6 +556,9 @@ func (db *DB) Write(batch *Batch, wo *opt.WriteOptions) error {
 		case <-db.closeC:
 			// Closed
 			return ErrClosed
+		case <-ctx.Done():
+			// Canceled
+			return ctx.Err()
 		}
 	} else {
 		select {
@@ -299,10 +570,164 @@ func (db *DB) Write(batch *Batch, wo *opt.WriteOptions) error {
 		case <-db.closeC:
 			// Closed
 			return ErrClosed
+		case <-ctx.Done():
+			// Canceled
+			return ctx.Err()
+		}
+	}
+
+	return db.writeLocked(ctx, batch, nil, merge, sync)
+}
+
+// WriteMulti applies the given batches to the DB atomically, as a single
+// batch holding the records of all the batches in order would be, without
+// copying them into such a batch. This allows batches built concurrently,
+// e.g. by several goroutines, to be committed together. The records are
+// given consecutive sequence numbers and the batches are written to the
+// journal as a single record group.
+//
+// The batches are never merged with concurrent writes, the write options
+// are otherwise honored as for Write. The MaxBatchSize and MaxBatchLen
+// options apply to the batches as a whole.
+//
+// It is safe to modify the contents of the arguments after WriteMulti
+// returns but not before. WriteMulti will not modify content of the
+// batches.
+func (db *DB) WriteMulti(batches []*Batch, wo *opt.WriteOptions) error {
+	var (
+		nonEmpty    = make([]*Batch, 0, len(batches))
+		internalLen int
+	)
+	for _, batch := range batches {
+		if batch != nil && batch.Len() > 0 {
+			nonEmpty = append(nonEmpty, batch)
+			internalLen += batch.internalLen
+		}
+	}
+	batches = nonEmpty
+	if len(batches) == 0 {
+		return db.ok()
+	}
+	if err := db.checkBatchLimits(batches...); err != nil {
+		return err
+	}
+
+	// Large batches are written using transaction, as done by Write.
+	if internalLen > db.s.o.GetWriteBuffer() && !db.s.o.GetDisableLargeBatchTransaction() {
+		tr, err := db.OpenTransaction()
+		if err != nil {
+			return err
+		}
+		for _, batch := range batches {
+			if err := tr.Write(batch, wo); err != nil {
+				tr.Discard()
+				return err
+			}
 		}
+		return tr.Commit()
+	}
+
+	if err := db.lockWriter(); err != nil {
+		return err
+	}
+	return db.writeBatchesLocked(batches, wo.GetSync() && !db.s.o.GetNoSync(), nil)
+}
+
+// Writes the batches as a single journal record group without merging
+// concurrent writes; need write lock, which is released. If cond is not
+// nil, it is called once the preceding writes are applied to memdb, and
+// the batches are only written if it returns nil.
+func (db *DB) writeBatchesLocked(batches []*Batch, sync bool, cond func() error) error {
+	internalLen := 0
+	for _, batch := range batches {
+		internalLen += batch.internalLen
+	}
+	mdb, mdbFree, err := db.flush(context.Background(), internalLen)
+	if err != nil {
+		db.unlockWrite(false, 0, err)
+		return err
+	}
+	defer mdb.decref()
+
+	// The preceding pipelined write must be applied to get the latest
+	// sequence number.
+	db.waitWriteApply()
+	if cond != nil {
+		if err := cond(); err != nil {
+			db.unlockWrite(false, 0, nil)
+			return err
+		}
+	}
+	seq := db.seq + 1
+	if err := db.writeJournal(context.Background(), batches, seq, sync); err != nil {
+		db.unlockWrite(false, 0, err)
+		return err
+	}
+	db.applyBatches(batches, seq, mdb)
+
+	// Rotate memdb if it's reach the threshold.
+	if internalLen >= mdbFree {
+		db.rotateMem(0, false)
+	}
+
+	db.unlockWrite(false, 0, nil)
+	return nil
+}
+
+// ApplyReplicated applies the given batch with the given sequence number
+// as the sequence number of its first record, so a follower mirroring a
+// leader's journal, see GetUpdatesSince, assigns the same sequence numbers
+// as the leader, and snapshots are comparable across replicas.
+//
+// The sequence number must be greater than the sequence number of the
+// latest write, otherwise ErrSeqOutOfOrder is returned; gaps are allowed,
+// as the leader's sequence numbers may skip on recovery. The batch is
+// always written to the journal and is never merged with concurrent
+// writes, the write options are otherwise honored as for Write.
+//
+// It is safe to modify the contents of the arguments after ApplyReplicated
+// returns but not before. ApplyReplicated will not modify content of the
+// batch.
+func (db *DB) ApplyReplicated(batch *Batch, seq uint64, wo *opt.WriteOptions) error {
+	if batch == nil || batch.Len() == 0 {
+		return db.ok()
+	}
+	if err := db.checkBatchLimits(batch); err != nil {
+		return err
+	}
+	if err := db.lockWriter(); err != nil {
+		return err
+	}
+	// The preceding pipelined write must be applied to get the latest
+	// sequence number.
+	db.waitWriteApply()
+	if seq <= db.seq || seq+uint64(batch.Len())-1 > keyMaxSeq {
+		db.unlockWrite(false, 0, nil)
+		return ErrSeqOutOfOrder
+	}
+
+	mdb, mdbFree, err := db.flush(context.Background(), batch.internalLen)
+	if err != nil {
+		db.unlockWrite(false, 0, err)
+		return err
+	}
+	defer mdb.decref()
+
+	sync := wo.GetSync() && !db.s.o.GetNoSync()
+	if err := db.writeJournal(context.Background(), []*Batch{batch}, seq, sync); err != nil {
+		db.unlockWrite(false, 0, err)
+		return err
+	}
+	db.setSeq(seq - 1)
+	db.applyBatches([]*Batch{batch}, seq, mdb)
+
+	// Rotate memdb if it's reach the threshold.
+	if batch.internalLen >= mdbFree {
+		db.rotateMem(0, false)
 	}
 
-	return db.writeLocked(batch, nil, merge, sync)
+	db.unlockWrite(false, 0, nil)
+	return nil
 }
 
 func (db *DB) putRec(kt keyType, key, value []byte, wo *opt.WriteOptions) error {
@@ -347,7 +772,7 @@ func (db *DB) putRec(kt keyType, key, value []byte, wo *opt.WriteOptions) error
 	batch := db.batchPool.Get().(*Batch)
 	batch.Reset()
 	batch.appendRec(kt, key, value)
-	return db.writeLocked(batch, batch, merge, sync)
+	return db.writeLocked(context.Background(), batch, batch, merge, sync)
 }
 
 // Put sets the value for the given key. It overwrites any previous value
@@ -369,6 +794,82 @@ func (db *DB) Delete(key []byte, wo *opt.WriteOptions) error {
 	return db.putRec(keyTypeDel, key, nil, wo)
 }
 
+// DeleteRange deletes every key within the given key range, start is
+// included in the range while limit is not. Rather than deleting keys one
+// by one, a single range tombstone is written; entries covered by it are
+// discarded by later compactions. Write merge also applies for DeleteRange,
+// see Write.
+//
+// An empty range, start equal to limit, is ignored, ErrInvalidRange is
+// returned if start is after limit. ErrNotCompatible is returned in
+// LevelDB compatible mode, see opt.Options.LevelDBCompatible.
+//
+// It is safe to modify the contents of the arguments after DeleteRange
+// returns but not before.
+func (db *DB) DeleteRange(start, limit []byte, wo *opt.WriteOptions) error {
+	if db.s.o.GetLevelDBCompatible() {
+		return ErrNotCompatible
+	}
+	if ok, err := checkRangeDel(db.s.icmp, start, limit); !ok {
+		return err
+	}
+	return db.putRec(keyTypeRangeDel, start, limit, wo)
+}
+
+// Puts the given key/value pair if cond returns true for the current value
+// of the key, cur is nil if the key doesn't exist. The condition is checked
+// under the write lock, once the preceding writes are applied.
+func (db *DB) putIf(key, value []byte, wo *opt.WriteOptions, cond func(cur []byte) bool) error {
+	if err := db.lockWriter(); err != nil {
+		return err
+	}
+	batch := new(Batch)
+	batch.Put(key, value)
+	return db.writeBatchesLocked([]*Batch{batch}, wo.GetSync() && !db.s.o.GetNoSync(), func() error {
+		cur, err := db.get(context.Background(), nil, nil, key, nil, db.seq, nil)
+		if err == ErrNotFound {
+			cur = nil
+		} else if err != nil {
+			return err
+		}
+		if !cond(cur) {
+			return &ErrWriteConflict{Key: append([]byte{}, key...), Value: cur}
+		}
+		return nil
+	})
+}
+
+// PutIfAbsent sets the value for the given key only if the DB does not
+// contain the key, otherwise ErrWriteConflict is returned and the DB is
+// left as is. The check and the write are atomic, concurrent writes are
+// ordered either before the check or after the write. PutIfAbsent is never
+// merged with concurrent writes.
+//
+// It is safe to modify the contents of the arguments after PutIfAbsent
+// returns but not before.
+func (db *DB) PutIfAbsent(key, value []byte, wo *opt.WriteOptions) error {
+	return db.putIf(key, value, wo, func(cur []byte) bool {
+		return cur == nil
+	})
+}
+
+// CompareAndSwap sets the value for the given key to new only if its
+// current value is equal to old, otherwise ErrWriteConflict is returned
+// and the DB is left as is. A nil old means the key must not exist, while
+// an empty non-nil old matches an existing empty value. The check and the
+// write are atomic as for PutIfAbsent.
+//
+// It is safe to modify the contents of the arguments after CompareAndSwap
+// returns but not before.
+func (db *DB) CompareAndSwap(key, old, new []byte, wo *opt.WriteOptions) error {
+	return db.putIf(key, new, wo, func(cur []byte) bool {
+		if old == nil || cur == nil {
+			return old == nil && cur == nil
+		}
+		return bytes.Equal(cur, old)
+	})
+}
+
 func isMemOverlaps(icmp *iComparer, mem *memdb.DB, min, max []byte) bool {
 	iter := mem.NewIterator(nil)
 	defer iter.Release()
@@ -384,8 +885,16 @@ func isMemOverlaps(icmp *iComparer, mem *memdb.DB, min, max []byte) bool {
 //
 // A nil Range.Start is treated as a key before all keys in the DB.
 // And a nil Range.Limit is treated as a key after all keys in the DB.
-// Therefore if both is nil then it will compact entire DB.
+// Therefore if both is nil then it will compact entire DB. The keys of a
+// prefix are compacted with the range returned by util.BytesPrefix.
 func (db *DB) CompactRange(r util.Range) error {
+	return db.CompactRangeWithOptions(r, nil)
+}
+
+// CompactRangeWithOptions is like CompactRange, but allows controlling the
+// compaction target level, exclusivity and whether tables are only moved
+// down instead of rewritten. See opt.CompactionOptions.
+func (db *DB) CompactRangeWithOptions(r util.Range, o *opt.CompactionOptions) error {
 	if err := db.ok(); err != nil {
 		return err
 	}
@@ -420,7 +929,48 @@ func (db *DB) CompactRange(r util.Range) error {
 	}
 
 	// Table compaction.
-	return db.compTriggerRange(db.tcompCmdC, -1, r.Start, r.Limit)
+	return db.compTriggerRange(db.tcompCmdC, -1, r.Start, r.Limit, o)
+}
+
+// Flush freezes the current memdb and schedules its compaction into a
+// level-0 table. If wait is true then Flush returns only after the memdb
+// compaction is done. Flush only waits for pending memdb compaction, if
+// wait is true, when the current memdb is empty.
+//
+// Writes are not blocked while waiting for the memdb compaction.
+func (db *DB) Flush(wait bool) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+
+	// Lock writer.
+	select {
+	case db.writeLockC <- struct{}{}:
+	case err := <-db.compPerErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	}
+
+	mdb := db.getEffectiveMem()
+	if mdb == nil {
+		<-db.writeLockC
+		return ErrClosed
+	}
+	empty := mdb.Len() == 0
+	mdb.decref()
+	if !empty {
+		if _, err := db.rotateMem(0, false); err != nil {
+			<-db.writeLockC
+			return err
+		}
+	}
+	<-db.writeLockC
+
+	if wait {
+		return db.compTriggerWait(db.mcompCmdC)
+	}
+	return nil
 }
 
 // SetReadOnly makes DB read-only. It will stay read-only until reopened.
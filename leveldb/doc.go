@@ -89,4 +89,18 @@
 //	...
 //	defer db.Close()
 //	...
+//
+// Compatibility with the C++ LevelDB library:
+//
+// The DB reads the journals, manifests and tables written by the C++
+// library, and by default writes them in the same formats, so a DB can be
+// moved between both as long as the comparer and the filter have the same
+// names and behavior; filter.NewBloomFilter matches the C++ built-in bloom
+// filter. The tables written hold extra metaindex entries, e.g. the table
+// properties, which the C++ library ignores. The formats deviate from the
+// C++ library once a feature it doesn't know is used: range deletions,
+// named snapshots, the value log, journal recycling, quarantined tables,
+// xxHash checksums, user-defined compressions, and journal block sizes
+// other than 32KiB. Use
+// opt.Options.LevelDBCompatible to keep the DB readable by the C++ library.
 package leveldb
@@ -7,14 +7,51 @@
 package leveldb
 
 import (
+	"fmt"
+
 	"github.com/FactomProject/goleveldb/leveldb/errors"
 )
 
 // Common errors.
 var (
-	ErrNotFound         = errors.ErrNotFound
-	ErrReadOnly         = errors.New("leveldb: read-only mode")
-	ErrSnapshotReleased = errors.New("leveldb: snapshot released")
-	ErrIterReleased     = errors.New("leveldb: iterator released")
-	ErrClosed           = errors.New("leveldb: closed")
+	ErrNotFound           = errors.ErrNotFound
+	ErrCacheMiss          = errors.ErrCacheMiss
+	ErrReadOnly           = errors.New("leveldb: read-only mode")
+	ErrSnapshotReleased   = errors.New("leveldb: snapshot released")
+	ErrSnapshotExist      = errors.New("leveldb: named snapshot already exist")
+	ErrSeqOutOfOrder      = errors.New("leveldb: sequence number out of order")
+	ErrIterReleased       = errors.New("leveldb: iterator released")
+	ErrInvalidCursor      = errors.New("leveldb: invalid iterator cursor")
+	ErrUpdatesUnavailable = errors.New("leveldb: updates no longer available")
+	ErrNotSecondary       = errors.New("leveldb: not a secondary instance")
+	ErrNotCompatible      = errors.New("leveldb: not supported in LevelDB compatible mode")
+	ErrInvalidDump        = errors.New("leveldb: invalid or unsupported dump")
+	ErrInvalidRange       = errors.New("leveldb: range deletion start after limit")
+	ErrClosed             = errors.New("leveldb: closed")
 )
+
+// ErrWriteConflict is returned by conditional writes, such as PutIfAbsent,
+// whose condition doesn't hold; the write is not applied.
+type ErrWriteConflict struct {
+	Key   []byte
+	Value []byte // Current value of the key, nil if the key doesn't exist.
+}
+
+func (e *ErrWriteConflict) Error() string {
+	return fmt.Sprintf("leveldb: write conflict on key %q", e.Key)
+}
+
+// ErrComparerMismatch is returned by Open when the comparer recorded in the
+// DB differs from opt.Options.Comparer and opt.Options.ComparerVersion, and
+// the DB isn't upgraded, see opt.Options.ComparerUpgrade.
+type ErrComparerMismatch struct {
+	Name    string // Name of the recorded comparer.
+	Version uint64 // Version of the recorded comparer.
+
+	WantName    string
+	WantVersion uint64
+}
+
+func (e *ErrComparerMismatch) Error() string {
+	return fmt.Sprintf("leveldb: comparer mismatch: want '%s' version %d, got '%s' version %d", e.WantName, e.WantVersion, e.Name, e.Version)
+}
@@ -18,6 +18,7 @@ import (
 // Common errors.
 var (
 	ErrNotFound    = New("leveldb: not found")
+	ErrCacheMiss   = New("leveldb: cache miss")
 	ErrReleased    = util.ErrReleased
 	ErrHasReleaser = util.ErrHasReleaser
 )
@@ -28,22 +29,46 @@ func New(text string) error {
 }
 
 // ErrCorrupted is the type that wraps errors that indicate corruption in
-// the database.
+// the database. Recovery logic should inspect its fields, rather than the
+// error message, to decide whether to repair or fail.
 type ErrCorrupted struct {
-	Fd  storage.FileDesc
+	// Fd is the corrupted file, zero if unknown. Fd.Type is the type of
+	// the file, e.g. storage.TypeTable.
+	Fd storage.FileDesc
+
+	// Offset and Size locate the corrupted block, chunk or record within
+	// the file. Both are zero if unknown.
+	Offset int64
+	Size   int64
+
+	// Reason is a short description of the corruption, e.g. "checksum
+	// mismatch". Empty if unknown.
+	Reason string
+
+	// Err is the underlying error, e.g. *table.ErrCorrupted.
 	Err error
 }
 
 func (e *ErrCorrupted) Error() string {
+	msg := e.Reason
+	if e.Err != nil {
+		msg = e.Err.Error()
+	}
 	if !e.Fd.Zero() {
-		return fmt.Sprintf("%v [file=%v]", e.Err, e.Fd)
+		return fmt.Sprintf("%s [file=%v]", msg, e.Fd)
 	}
-	return e.Err.Error()
+	return msg
 }
 
 // NewErrCorrupted creates new ErrCorrupted error.
 func NewErrCorrupted(fd storage.FileDesc, err error) error {
-	return &ErrCorrupted{fd, err}
+	return &ErrCorrupted{Fd: fd, Err: err}
+}
+
+// NewErrCorruptedAt creates new ErrCorrupted error of the corrupted data
+// at the given offset and size of the given file.
+func NewErrCorruptedAt(fd storage.FileDesc, offset, size int64, reason string, err error) error {
+	return &ErrCorrupted{Fd: fd, Offset: offset, Size: size, Reason: reason, Err: err}
 }
 
 // IsCorrupted returns a boolean indicating whether the error is indicating
@@ -58,6 +83,18 @@ func IsCorrupted(err error) bool {
 	return false
 }
 
+// AsCorrupted returns the given error as *ErrCorrupted if the error is
+// indicating a corruption, see IsCorrupted.
+func AsCorrupted(err error) (*ErrCorrupted, bool) {
+	switch x := err.(type) {
+	case *ErrCorrupted:
+		return x, true
+	case *storage.ErrCorrupted:
+		return &ErrCorrupted{Fd: x.Fd, Reason: x.Err.Error(), Err: x.Err}, true
+	}
+	return nil, false
+}
+
 // ErrMissingFiles is the type that indicating a corruption due to missing
 // files. ErrMissingFiles always wrapped with ErrCorrupted.
 type ErrMissingFiles struct {
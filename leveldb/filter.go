@@ -7,6 +7,9 @@
 package leveldb
 
 import (
+	"bytes"
+
+	"github.com/FactomProject/goleveldb/leveldb/comparer"
 	"github.com/FactomProject/goleveldb/leveldb/filter"
 )
 
@@ -29,3 +32,25 @@ type iFilterGenerator struct {
 func (g iFilterGenerator) Add(key []byte) {
 	g.FilterGenerator.Add(internalKey(key).ukey())
 }
+
+type iPrefixer struct {
+	comparer.Prefixer
+}
+
+func (p iPrefixer) Prefix(key []byte) []byte {
+	prefix := p.Prefixer.Prefix(internalKey(key).ukey())
+	if prefix == nil {
+		return nil
+	}
+	// Filters only take the user key part.
+	return append(append([]byte{}, prefix...), keyMaxNumBytes...)
+}
+
+// Returns the given user prefix in the form returned by Prefix, or nil if
+// it is not a prefix extracted by the prefixer.
+func (p iPrefixer) iPrefix(uprefix []byte) []byte {
+	if !bytes.Equal(p.Prefixer.Prefix(uprefix), uprefix) {
+		return nil
+	}
+	return append(append([]byte{}, uprefix...), keyMaxNumBytes...)
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package filter
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+// The xor filter is as described in "Xor Filters: Faster and Smaller Than
+// Bloom and Cuckoo Filters" [Graf,Lemire 2019], using 8-bit fingerprints.
+//
+// Xor filter serialization:
+//
+//	+-------------------------------+-------------------+
+//	| fingerprints (3 * block len)  | seed (8-bytes)    |
+//	+-------------------------------+-------------------+
+
+const (
+	xorSeedLen  = 8
+	xorMaxTries = 100
+)
+
+func xorHash(key []byte) uint64 {
+	return uint64(util.Hash(key, 0x9e3779b9))<<32 | uint64(util.Hash(key, 0x85ebca6b))
+}
+
+// Mixes hash with the seed, this is the finalizer of murmur3.
+func xorMix(h, seed uint64) uint64 {
+	h += seed
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
+
+func xorReduce(h uint32, n uint32) uint32 {
+	return uint32((uint64(h) * uint64(n)) >> 32)
+}
+
+func xorFingerprint(h uint64) uint8 {
+	return uint8(h ^ h>>32)
+}
+
+// Returns location of the hash within each of the three blocks.
+func xorLocations(h uint64, blockLen uint32) (h0, h1, h2 uint32) {
+	h0 = xorReduce(uint32(h), blockLen)
+	h1 = xorReduce(uint32(h<<21|h>>43), blockLen) + blockLen
+	h2 = xorReduce(uint32(h<<42|h>>22), blockLen) + 2*blockLen
+	return
+}
+
+type xorFilter struct{}
+
+func (xorFilter) Name() string {
+	return "leveldb.BuiltinXorFilter"
+}
+
+func (xorFilter) Contains(filter, key []byte) bool {
+	n := len(filter) - xorSeedLen
+	if n < 3 {
+		return false
+	}
+	blockLen := uint32(n / 3)
+	seed := binary.LittleEndian.Uint64(filter[n:])
+	h := xorMix(xorHash(key), seed)
+	h0, h1, h2 := xorLocations(h, blockLen)
+	return xorFingerprint(h) == filter[h0]^filter[h1]^filter[h2]
+}
+
+func (xorFilter) NewGenerator() FilterGenerator {
+	return &xorFilterGenerator{}
+}
+
+type uint64Slice []uint64
+
+func (p uint64Slice) Len() int           { return len(p) }
+func (p uint64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p uint64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type xorStackEntry struct {
+	h   uint64
+	loc uint32
+}
+
+type xorFilterGenerator struct {
+	keyHashes []uint64
+
+	// Scratch reused across generations.
+	count []uint8
+	mask  []uint64
+	queue []uint32
+	stack []xorStackEntry
+}
+
+func (g *xorFilterGenerator) Add(key []byte) {
+	g.keyHashes = append(g.keyHashes, xorHash(key))
+}
+
+// Peels the keys using the given seed, returns false if the keys can't be
+// fully peeled.
+func (g *xorFilterGenerator) peel(seed uint64, blockLen uint32) bool {
+	size := 3 * blockLen
+	if uint32(cap(g.count)) < size {
+		g.count = make([]uint8, size)
+		g.mask = make([]uint64, size)
+	} else {
+		g.count = g.count[:size]
+		g.mask = g.mask[:size]
+		for i := range g.count {
+			g.count[i] = 0
+			g.mask[i] = 0
+		}
+	}
+	for _, kh := range g.keyHashes {
+		h := xorMix(kh, seed)
+		h0, h1, h2 := xorLocations(h, blockLen)
+		for _, loc := range [3]uint32{h0, h1, h2} {
+			if g.count[loc] == 0xff {
+				return false
+			}
+			g.count[loc]++
+			g.mask[loc] ^= h
+		}
+	}
+
+	g.queue = g.queue[:0]
+	for loc, c := range g.count {
+		if c == 1 {
+			g.queue = append(g.queue, uint32(loc))
+		}
+	}
+	g.stack = g.stack[:0]
+	for len(g.queue) > 0 {
+		loc := g.queue[len(g.queue)-1]
+		g.queue = g.queue[:len(g.queue)-1]
+		if g.count[loc] != 1 {
+			continue
+		}
+		h := g.mask[loc]
+		g.stack = append(g.stack, xorStackEntry{h, loc})
+		h0, h1, h2 := xorLocations(h, blockLen)
+		for _, x := range [3]uint32{h0, h1, h2} {
+			g.count[x]--
+			g.mask[x] ^= h
+			if g.count[x] == 1 {
+				g.queue = append(g.queue, x)
+			}
+		}
+	}
+	return len(g.stack) == len(g.keyHashes)
+}
+
+func (g *xorFilterGenerator) Generate(b Buffer) {
+	// Duplicate keys can't be peeled.
+	sort.Sort(uint64Slice(g.keyHashes))
+	n := 0
+	for i, kh := range g.keyHashes {
+		if i == 0 || kh != g.keyHashes[n-1] {
+			g.keyHashes[n] = kh
+			n++
+		}
+	}
+	g.keyHashes = g.keyHashes[:n]
+	if n == 0 {
+		return
+	}
+
+	blockLen := uint32(32+n*123/100+2) / 3
+	seed := uint64(0x2545f4914f6cdd1d)
+	for i := 0; !g.peel(seed, blockLen); i++ {
+		if i == xorMaxTries {
+			// Unlikely to happen, grow the filter instead.
+			blockLen += blockLen/10 + 1
+			i = 0
+		}
+		seed = xorMix(seed, 0x9e3779b97f4a7c15)
+	}
+
+	dest := b.Alloc(int(3*blockLen) + xorSeedLen)
+	fingerprints := dest[:3*blockLen]
+	for i := range fingerprints {
+		fingerprints[i] = 0
+	}
+	for i := len(g.stack) - 1; i >= 0; i-- {
+		e := g.stack[i]
+		h0, h1, h2 := xorLocations(e.h, blockLen)
+		fingerprints[e.loc] = 0
+		fingerprints[e.loc] = xorFingerprint(e.h) ^ fingerprints[h0] ^ fingerprints[h1] ^ fingerprints[h2]
+	}
+	binary.LittleEndian.PutUint64(dest[3*blockLen:], seed)
+
+	g.keyHashes = g.keyHashes[:0]
+}
+
+// NewXorFilter creates a new initialized xor filter.
+//
+// The xor filter uses about 9.84 bits per key and has false positive rate
+// of about 0.39%, while a bloom filter needs about 12 bits per key for the
+// same false positive rate. Generating the filter is slower than generating
+// a bloom filter, but lookups only probe three bytes.
+//
+// The xor filter name differ from the bloom filter, tables written using
+// the bloom filter are not read using the xor filter. To switch an
+// existing DB, put the bloom filter to opt.Options.AltFilters so the filter
+// of old tables remains in use until they are compacted.
+func NewXorFilter() Filter {
+	return xorFilter{}
+}
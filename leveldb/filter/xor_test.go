@@ -0,0 +1,71 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package filter
+
+import (
+	"testing"
+)
+
+func newXorHarness(t *testing.T) *harness {
+	xor := NewXorFilter()
+	return &harness{
+		t:         t,
+		bloom:     xor,
+		generator: xor.NewGenerator(),
+	}
+}
+
+func TestXorFilter_Empty(t *testing.T) {
+	h := newXorHarness(t)
+	h.build()
+	h.assert([]byte("hello"), false, false)
+	h.assert([]byte("world"), false, false)
+}
+
+func TestXorFilter_Small(t *testing.T) {
+	h := newXorHarness(t)
+	h.add([]byte("hello"))
+	h.add([]byte("world"))
+	h.add([]byte("hello"))
+	h.build()
+	h.assert([]byte("hello"), true, false)
+	h.assert([]byte("world"), true, false)
+	h.assert([]byte("x"), false, false)
+	h.assert([]byte("foo"), false, false)
+}
+
+func TestXorFilter_VaryingLengths(t *testing.T) {
+	h := newXorHarness(t)
+	for n := 1; n < 10000; n = nextN(n) {
+		h.reset()
+		for i := 0; i < n; i++ {
+			h.addNum(uint32(i))
+		}
+		h.build()
+
+		got := h.filterLen()
+		want := (n * 10 / 8) + 48
+		if got > want {
+			t.Errorf("filter len test failed, '%d' > '%d'", got, want)
+		}
+
+		for i := 0; i < n; i++ {
+			h.assertNum(uint32(i), true, false)
+		}
+
+		var rate float32
+		for i := 0; i < 10000; i++ {
+			if h.assertNum(uint32(i+1000000000), true, true) {
+				rate++
+			}
+		}
+		rate /= 10000
+		if rate > 0.01 {
+			t.Errorf("false positive rate is more than 1%%, got %v, at len %d", rate, n)
+		}
+	}
+}
@@ -7,6 +7,8 @@
 package iterator
 
 import (
+	"bytes"
+
 	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
@@ -28,7 +30,11 @@ type Array interface {
 	Index(i int) (key, value []byte)
 }
 
-// Array is the interface that wraps BasicArray and basic Get method.
+// ArrayIndexer is the interface that wraps BasicArray and basic Get method.
+// An ArrayIndexer is an array of non-overlapping 'data iterator', ordered by
+// key, e.g. a set of sorted files; Search then finds the smallest index of
+// the data iterator whose last key is greater than or equal to the given
+// key.
 type ArrayIndexer interface {
 	BasicArray
 
@@ -94,6 +100,27 @@ func (i *basicArrayIterator) Seek(key []byte) bool {
 	return true
 }
 
+// SeekLE moves to the element that may hold the given key, or the last
+// element if none; the basic array knows no keys. Iterators over arrays with
+// keys refine it.
+func (i *basicArrayIterator) SeekLE(key []byte) bool {
+	if i.Released() {
+		i.err = ErrIterReleased
+		return false
+	}
+
+	n := i.array.Len()
+	if n == 0 {
+		i.pos = -1
+		return false
+	}
+	i.pos = i.array.Search(key)
+	if i.pos >= n {
+		i.pos = n - 1
+	}
+	return true
+}
+
 func (i *basicArrayIterator) Next() bool {
 	if i.Released() {
 		i.err = ErrIterReleased
@@ -144,6 +171,21 @@ func (i *arrayIterator) updateKV() {
 	}
 }
 
+// SeekLE assumes keys ordered as equal by the array are equal bytes.
+func (i *arrayIterator) SeekLE(key []byte) bool {
+	if !i.basicArrayIterator.Seek(key) {
+		if i.Released() {
+			return false
+		}
+		// All keys are less than the given key.
+		return i.Last()
+	}
+	if k, _ := i.array.Index(i.basicArrayIterator.pos); !bytes.Equal(k, key) {
+		return i.Prev()
+	}
+	return true
+}
+
 func (i *arrayIterator) Key() []byte {
 	i.updateKV()
 	return i.key
@@ -175,7 +217,8 @@ func NewArrayIterator(array Array) Iterator {
 	}
 }
 
-// NewArrayIndexer returns an index iterator from the given array.
+// NewArrayIndexer returns an index iterator from the given array, to be
+// used with NewIndexedIterator.
 func NewArrayIndexer(array ArrayIndexer) IteratorIndexer {
 	return &arrayIteratorIndexer{
 		basicArrayIterator: basicArrayIterator{array: array, pos: -1},
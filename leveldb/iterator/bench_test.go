@@ -0,0 +1,66 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package iterator_test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/FactomProject/goleveldb/leveldb/comparer"
+	. "github.com/FactomProject/goleveldb/leveldb/iterator"
+	"github.com/FactomProject/goleveldb/leveldb/testutil"
+)
+
+// Returns a merged iterator over n input iterators with interleaved keys,
+// so every step moves to another input iterator.
+func newBenchMergedIterator(n int) Iterator {
+	const keysPerIter = 100
+	kvs := make([]testutil.KeyValue, n)
+	for i := 0; i < n*keysPerIter; i++ {
+		key := make([]byte, 4)
+		binary.BigEndian.PutUint32(key, uint32(i))
+		kvs[i%n].Put(key, nil)
+	}
+	iters := make([]Iterator, n)
+	for i := range iters {
+		iters[i] = NewArrayIterator(kvs[i])
+	}
+	return NewMergedIterator(iters, comparer.DefaultComparer, true)
+}
+
+func BenchmarkMergedIteratorNext(b *testing.B) {
+	for _, n := range []int{2, 16, 128, 1024} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			iter := newBenchMergedIterator(n)
+			defer iter.Release()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !iter.Next() {
+					iter.First()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMergedIteratorPrev(b *testing.B) {
+	for _, n := range []int{2, 16, 128, 1024} {
+		b.Run(fmt.Sprintf("n=%d", n), func(b *testing.B) {
+			iter := newBenchMergedIterator(n)
+			defer iter.Release()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !iter.Prev() {
+					iter.Last()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package iterator_test
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/FactomProject/goleveldb/leveldb/iterator"
+)
+
+// segment is a sorted run of keys, e.g. the content of a file.
+type segment []string
+
+func (s segment) Len() int                        { return len(s) }
+func (s segment) Search(key []byte) int           { return sort.SearchStrings(s, string(key)) }
+func (s segment) Index(i int) (key, value []byte) { return []byte(s[i]), []byte("@" + s[i]) }
+
+// segments is a set of non-overlapping segments, ordered by key.
+type segments []segment
+
+func (s segments) Len() int { return len(s) }
+
+func (s segments) Search(key []byte) int {
+	return sort.Search(len(s), func(i int) bool {
+		return s[i][len(s[i])-1] >= string(key)
+	})
+}
+
+func (s segments) Get(i int) iterator.Iterator {
+	// A segment would be opened here, only once the iteration reaches it.
+	return iterator.NewArrayIterator(s[i])
+}
+
+func ExampleNewIndexedIterator() {
+	set := segments{{"a", "b"}, {"d", "e", "f"}, {"h"}}
+	iter := iterator.NewIndexedIterator(iterator.NewArrayIndexer(set), true)
+	defer iter.Release()
+
+	var kvs []string
+	for iter.Next() {
+		kvs = append(kvs, fmt.Sprintf("%s=%s", iter.Key(), iter.Value()))
+	}
+	fmt.Println(strings.Join(kvs, " "))
+
+	var keys []string
+	for ok := iter.Seek([]byte("c")); ok; ok = iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	fmt.Println(strings.Join(keys, " "))
+	// Output:
+	// a=@a b=@b d=@d e=@e f=@f h=@h
+	// d e f h
+}
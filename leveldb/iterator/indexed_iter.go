@@ -25,23 +25,30 @@ type indexedIterator struct {
 	util.BasicReleaser
 	index  IteratorIndexer
 	strict bool
+	pin    bool
 
 	data   Iterator
+	pinned []Iterator
 	err    error
 	errf   func(err error)
 	closed bool
 }
 
 func (i *indexedIterator) setData() {
-	if i.data != nil {
-		i.data.Release()
-	}
+	i.clearData()
 	i.data = i.index.Get()
+	if ecs, ok := i.data.(ErrorCallbackSetter); ok && i.errf != nil {
+		ecs.SetErrorCallback(i.errf)
+	}
 }
 
 func (i *indexedIterator) clearData() {
 	if i.data != nil {
-		i.data.Release()
+		if i.pin {
+			i.pinned = append(i.pinned, i.data)
+		} else {
+			i.data.Release()
+		}
 	}
 	i.data = nil
 }
@@ -57,7 +64,8 @@ func (i *indexedIterator) indexErr() {
 
 func (i *indexedIterator) dataErr() bool {
 	if err := i.data.Error(); err != nil {
-		if i.errf != nil {
+		// The data iterator reports the error itself.
+		if _, ok := i.data.(ErrorCallbackSetter); !ok && i.errf != nil {
 			i.errf(err)
 		}
 		if i.strict || !errors.IsCorrupted(err) {
@@ -137,6 +145,32 @@ func (i *indexedIterator) Seek(key []byte) bool {
 	return true
 }
 
+func (i *indexedIterator) SeekLE(key []byte) bool {
+	if i.err != nil {
+		return false
+	} else if i.Released() {
+		i.err = ErrIterReleased
+		return false
+	}
+
+	// The data iterator holding the first key greater than or equal to the
+	// given key, if any, holds the sought key or follows it.
+	if !i.index.Seek(key) {
+		i.indexErr()
+		i.clearData()
+		return i.Last()
+	}
+	i.setData()
+	if !i.data.SeekLE(key) {
+		if i.dataErr() {
+			return false
+		}
+		i.clearData()
+		return i.Prev()
+	}
+	return true
+}
+
 func (i *indexedIterator) Next() bool {
 	if i.err != nil {
 		return false
@@ -209,8 +243,19 @@ func (i *indexedIterator) Value() []byte {
 	return i.data.Value()
 }
 
+func (i *indexedIterator) Unpin() {
+	for _, data := range i.pinned {
+		data.Release()
+	}
+	i.pinned = nil
+	if p, ok := i.data.(Pinner); ok {
+		p.Unpin()
+	}
+}
+
 func (i *indexedIterator) Release() {
 	i.clearData()
+	i.Unpin()
 	i.index.Release()
 	i.BasicReleaser.Release()
 }
@@ -227,12 +272,21 @@ func (i *indexedIterator) Error() error {
 
 func (i *indexedIterator) SetErrorCallback(f func(err error)) {
 	i.errf = f
+	if ecs, ok := i.data.(ErrorCallbackSetter); ok {
+		ecs.SetErrorCallback(f)
+	}
 }
 
 // NewIndexedIterator returns an 'indexed iterator'. An index is iterator
 // that returns another iterator, a 'data iterator'. A 'data iterator' is the
 // iterator that contains actual key/value pairs.
 //
+// The 'indexed iterator' concatenates the 'data iterator' in index order,
+// creating each only when the iteration reaches it and releasing it when
+// leaving it; this is how the DB iterates a level of 'sorted table'. Use
+// NewArrayIndexer to index a custom set of non-overlapping sorted runs,
+// e.g. files.
+//
 // If strict is true the any 'corruption errors' (i.e errors.IsCorrupted(err) == true)
 // won't be ignored and will halt 'indexed iterator', otherwise the iterator will
 // continue to the next 'data iterator'. Corruption on 'index iterator' will not be
@@ -240,3 +294,11 @@ func (i *indexedIterator) SetErrorCallback(f func(err error)) {
 func NewIndexedIterator(index IteratorIndexer, strict bool) Iterator {
 	return &indexedIterator{index: index, strict: strict}
 }
+
+// NewPinningIndexedIterator returns an 'indexed iterator' in pinning mode,
+// see Pinner. The key/value slices returned by the iterator stay valid
+// until Unpin or Release is called, the caller should call Unpin
+// periodically to bound the memory held by the iterator.
+func NewPinningIndexedIterator(index IteratorIndexer, strict bool) Iterator {
+	return &indexedIterator{index: index, strict: strict, pin: true}
+}
@@ -44,23 +44,28 @@ var _ = testutil.Defer(func() {
 				}
 			}
 
+			// Build key/value.
+			build := func() (keyValueIndex, *testutil.KeyValue) {
+				index := make(keyValueIndex, len(n))
+				sum := 0
+				for _, x := range n {
+					sum += x
+				}
+				kv := testutil.KeyValue_Generate(nil, sum, 1, 1, 10, 4, 4)
+				for i, j := 0, 0; i < len(n); i++ {
+					for x := n[i]; x > 0; x-- {
+						key, value := kv.Index(j)
+						index[i].key = key
+						index[i].Put(key, value)
+						j++
+					}
+				}
+				return index, kv
+			}
+
 			return func() {
 				It("Should iterates and seeks correctly", func(done Done) {
-					// Build key/value.
-					index := make(keyValueIndex, len(n))
-					sum := 0
-					for _, x := range n {
-						sum += x
-					}
-					kv := testutil.KeyValue_Generate(nil, sum, 1, 1, 10, 4, 4)
-					for i, j := 0, 0; i < len(n); i++ {
-						for x := n[i]; x > 0; x-- {
-							key, value := kv.Index(j)
-							index[i].key = key
-							index[i].Put(key, value)
-							j++
-						}
-					}
+					index, kv := build()
 
 					// Test the iterator.
 					t := testutil.IteratorTesting{
@@ -70,6 +75,23 @@ var _ = testutil.Defer(func() {
 					testutil.DoIteratorTesting(&t)
 					done <- true
 				}, 15.0)
+
+				It("Should iterates and seeks correctly in pinning mode", func(done Done) {
+					index, kv := build()
+
+					// Test the iterator.
+					iter := NewPinningIndexedIterator(NewArrayIndexer(index), true)
+					t := testutil.IteratorTesting{
+						KeyValue: kv.Clone(),
+						Iter:     iter,
+					}
+					testutil.DoIteratorTesting(&t)
+					iter.(Pinner).Unpin()
+					t.First()
+					t.NextAll()
+					t.EOI()
+					done <- true
+				}, 15.0)
 			}
 		}
 
@@ -39,6 +39,13 @@ type IteratorSeeker interface {
 	// It is safe to modify the contents of the argument after Seek returns.
 	Seek(key []byte) bool
 
+	// SeekLE moves the iterator to the last key/value pair whose key is less
+	// than or equal to the given key.
+	// It returns whether such pair exist.
+	//
+	// It is safe to modify the contents of the argument after SeekLE returns.
+	SeekLE(key []byte) bool
+
 	// Next moves the iterator to the next key/value pair.
 	// It returns whether the iterator is exhausted.
 	Next() bool
@@ -97,13 +104,48 @@ type Iterator interface {
 // ErrorCallbackSetter is the interface that wraps basic SetErrorCallback
 // method.
 //
-// ErrorCallbackSetter implemented by indexed and merged iterator.
+// ErrorCallbackSetter implemented by indexed and merged iterator. The
+// callback is also set on their 'data iterator' and input iterators that
+// implement ErrorCallbackSetter, each error is then only passed to the
+// callback by the innermost iterator hitting it.
 type ErrorCallbackSetter interface {
 	// SetErrorCallback allows set an error callback of the corresponding
 	// iterator. Use nil to clear the callback.
 	SetErrorCallback(f func(err error))
 }
 
+// Pinner is the interface that wraps basic Unpin method.
+//
+// Pinner implemented by indexed and merged iterator. An indexed iterator
+// in pinning mode keeps the 'data iterator' it moved past, and so the
+// blocks holding their key/value pairs, until Unpin is called.
+type Pinner interface {
+	// Unpin releases the 'data iterator' kept by the iterator, the contents
+	// of key/value slices returned before may change after Unpin returns.
+	Unpin()
+}
+
+// ValueAppender is the interface that wraps basic ValueTo method.
+//
+// ValueAppender implemented by the DB iterators of the leveldb package.
+type ValueAppender interface {
+	// ValueTo appends the value of the current key/value pair to dst and
+	// returns the extended slice, e.g. to reuse a buffer across
+	// iterations instead of copying each value into a new slice. It
+	// returns dst as is if the iterator is done or has an error.
+	ValueTo(dst []byte) []byte
+}
+
+// Sequencer is the interface that wraps basic Seq method.
+//
+// Sequencer implemented by the DB iterators of the leveldb package.
+type Sequencer interface {
+	// Seq returns the sequence number of the write of the current
+	// key/value pair, e.g. to learn the version of a value. It returns
+	// zero if the iterator is done or has an error.
+	Seq() uint64
+}
+
 type emptyIterator struct {
 	util.BasicReleaser
 	err error
@@ -115,15 +157,16 @@ func (i *emptyIterator) rErr() {
 	}
 }
 
-func (*emptyIterator) Valid() bool            { return false }
-func (i *emptyIterator) First() bool          { i.rErr(); return false }
-func (i *emptyIterator) Last() bool           { i.rErr(); return false }
-func (i *emptyIterator) Seek(key []byte) bool { i.rErr(); return false }
-func (i *emptyIterator) Next() bool           { i.rErr(); return false }
-func (i *emptyIterator) Prev() bool           { i.rErr(); return false }
-func (*emptyIterator) Key() []byte            { return nil }
-func (*emptyIterator) Value() []byte          { return nil }
-func (i *emptyIterator) Error() error         { return i.err }
+func (*emptyIterator) Valid() bool              { return false }
+func (i *emptyIterator) First() bool            { i.rErr(); return false }
+func (i *emptyIterator) Last() bool             { i.rErr(); return false }
+func (i *emptyIterator) Seek(key []byte) bool   { i.rErr(); return false }
+func (i *emptyIterator) SeekLE(key []byte) bool { i.rErr(); return false }
+func (i *emptyIterator) Next() bool             { i.rErr(); return false }
+func (i *emptyIterator) Prev() bool             { i.rErr(); return false }
+func (*emptyIterator) Key() []byte              { return nil }
+func (*emptyIterator) Value() []byte            { return nil }
+func (i *emptyIterator) Error() error           { return i.err }
 
 // NewEmptyIterator creates an empty iterator. The err parameter can be
 // nil, but if not nil the given err will be returned by Error method.
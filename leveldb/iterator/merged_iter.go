@@ -7,6 +7,8 @@
 package iterator
 
 import (
+	"container/heap"
+
 	"github.com/FactomProject/goleveldb/leveldb/comparer"
 	"github.com/FactomProject/goleveldb/leveldb/errors"
 	"github.com/FactomProject/goleveldb/leveldb/util"
@@ -33,6 +35,11 @@ type mergedIterator struct {
 	err      error
 	errf     func(err error)
 	releaser util.Releaser
+
+	// Heap of the indexes of the input iterators with a key, except the
+	// current one. It is a max-heap if reverse is true.
+	indexes []int
+	reverse bool
 }
 
 func assertKey(key []byte) []byte {
@@ -44,7 +51,8 @@ func assertKey(key []byte) []byte {
 
 func (i *mergedIterator) iterErr(iter Iterator) bool {
 	if err := iter.Error(); err != nil {
-		if i.errf != nil {
+		// The input iterator reports the error itself.
+		if _, ok := iter.(ErrorCallbackSetter); !ok && i.errf != nil {
 			i.errf(err)
 		}
 		if i.strict || !errors.IsCorrupted(err) {
@@ -67,16 +75,20 @@ func (i *mergedIterator) First() bool {
 		return false
 	}
 
+	h := i.indexHeap()
+	h.Reset(false)
 	for x, iter := range i.iters {
 		switch {
 		case iter.First():
 			i.keys[x] = assertKey(iter.Key())
+			h.Push(x)
 		case i.iterErr(iter):
 			return false
 		default:
 			i.keys[x] = nil
 		}
 	}
+	heap.Init(h)
 	i.dir = dirSOI
 	return i.next()
 }
@@ -89,16 +101,20 @@ func (i *mergedIterator) Last() bool {
 		return false
 	}
 
+	h := i.indexHeap()
+	h.Reset(true)
 	for x, iter := range i.iters {
 		switch {
 		case iter.Last():
 			i.keys[x] = assertKey(iter.Key())
+			h.Push(x)
 		case i.iterErr(iter):
 			return false
 		default:
 			i.keys[x] = nil
 		}
 	}
+	heap.Init(h)
 	i.dir = dirEOI
 	return i.prev()
 }
@@ -111,35 +127,57 @@ func (i *mergedIterator) Seek(key []byte) bool {
 		return false
 	}
 
+	h := i.indexHeap()
+	h.Reset(false)
 	for x, iter := range i.iters {
 		switch {
 		case iter.Seek(key):
 			i.keys[x] = assertKey(iter.Key())
+			h.Push(x)
 		case i.iterErr(iter):
 			return false
 		default:
 			i.keys[x] = nil
 		}
 	}
+	heap.Init(h)
 	i.dir = dirSOI
 	return i.next()
 }
 
-func (i *mergedIterator) next() bool {
-	var key []byte
-	if i.dir == dirForward {
-		key = i.keys[i.index]
+func (i *mergedIterator) SeekLE(key []byte) bool {
+	if i.err != nil {
+		return false
+	} else if i.dir == dirReleased {
+		i.err = ErrIterReleased
+		return false
 	}
-	for x, tkey := range i.keys {
-		if tkey != nil && (key == nil || i.cmp.Compare(tkey, key) < 0) {
-			key = tkey
-			i.index = x
+
+	h := i.indexHeap()
+	h.Reset(true)
+	for x, iter := range i.iters {
+		switch {
+		case iter.SeekLE(key):
+			i.keys[x] = assertKey(iter.Key())
+			h.Push(x)
+		case i.iterErr(iter):
+			return false
+		default:
+			i.keys[x] = nil
 		}
 	}
-	if key == nil {
+	heap.Init(h)
+	i.dir = dirEOI
+	return i.prev()
+}
+
+func (i *mergedIterator) next() bool {
+	h := i.indexHeap()
+	if h.Len() == 0 {
 		i.dir = dirEOI
 		return false
 	}
+	i.index = heap.Pop(h).(int)
 	i.dir = dirForward
 	return true
 }
@@ -168,6 +206,7 @@ func (i *mergedIterator) Next() bool {
 	switch {
 	case iter.Next():
 		i.keys[x] = assertKey(iter.Key())
+		heap.Push(i.indexHeap(), x)
 	case i.iterErr(iter):
 		return false
 	default:
@@ -177,20 +216,12 @@ func (i *mergedIterator) Next() bool {
 }
 
 func (i *mergedIterator) prev() bool {
-	var key []byte
-	if i.dir == dirBackward {
-		key = i.keys[i.index]
-	}
-	for x, tkey := range i.keys {
-		if tkey != nil && (key == nil || i.cmp.Compare(tkey, key) > 0) {
-			key = tkey
-			i.index = x
-		}
-	}
-	if key == nil {
+	h := i.indexHeap()
+	if h.Len() == 0 {
 		i.dir = dirSOI
 		return false
 	}
+	i.index = heap.Pop(h).(int)
 	i.dir = dirBackward
 	return true
 }
@@ -208,6 +239,8 @@ func (i *mergedIterator) Prev() bool {
 		return i.Last()
 	case dirForward:
 		key := append([]byte{}, i.keys[i.index]...)
+		h := i.indexHeap()
+		h.Reset(true)
 		for x, iter := range i.iters {
 			if x == i.index {
 				continue
@@ -216,12 +249,14 @@ func (i *mergedIterator) Prev() bool {
 			switch {
 			case seek && iter.Prev(), !seek && iter.Last():
 				i.keys[x] = assertKey(iter.Key())
+				h.Push(x)
 			case i.iterErr(iter):
 				return false
 			default:
 				i.keys[x] = nil
 			}
 		}
+		heap.Init(h)
 	}
 
 	x := i.index
@@ -229,6 +264,7 @@ func (i *mergedIterator) Prev() bool {
 	switch {
 	case iter.Prev():
 		i.keys[x] = assertKey(iter.Key())
+		heap.Push(i.indexHeap(), x)
 	case i.iterErr(iter):
 		return false
 	default:
@@ -251,6 +287,14 @@ func (i *mergedIterator) Value() []byte {
 	return i.iters[i.index].Value()
 }
 
+func (i *mergedIterator) Unpin() {
+	for _, iter := range i.iters {
+		if p, ok := iter.(Pinner); ok {
+			p.Unpin()
+		}
+	}
+}
+
 func (i *mergedIterator) Release() {
 	if i.dir != dirReleased {
 		i.dir = dirReleased
@@ -259,6 +303,7 @@ func (i *mergedIterator) Release() {
 		}
 		i.iters = nil
 		i.keys = nil
+		i.indexes = nil
 		if i.releaser != nil {
 			i.releaser.Release()
 			i.releaser = nil
@@ -282,6 +327,54 @@ func (i *mergedIterator) Error() error {
 
 func (i *mergedIterator) SetErrorCallback(f func(err error)) {
 	i.errf = f
+	for _, iter := range i.iters {
+		if ecs, ok := iter.(ErrorCallbackSetter); ok {
+			ecs.SetErrorCallback(f)
+		}
+	}
+}
+
+// indexHeap implements heap.Interface over the merged iterator indexes.
+// Ties are broken by the index, the lower index first.
+type indexHeap mergedIterator
+
+func (h *indexHeap) Len() int { return len(h.indexes) }
+
+func (h *indexHeap) Less(i, j int) bool {
+	i, j = h.indexes[i], h.indexes[j]
+	r := h.cmp.Compare(h.keys[i], h.keys[j])
+	if r == 0 {
+		return i < j
+	}
+	if h.reverse {
+		return r > 0
+	}
+	return r < 0
+}
+
+func (h *indexHeap) Swap(i, j int) {
+	h.indexes[i], h.indexes[j] = h.indexes[j], h.indexes[i]
+}
+
+func (h *indexHeap) Push(value interface{}) {
+	h.indexes = append(h.indexes, value.(int))
+}
+
+func (h *indexHeap) Pop() interface{} {
+	e := len(h.indexes) - 1
+	popped := h.indexes[e]
+	h.indexes = h.indexes[:e]
+	return popped
+}
+
+// Reset empties the heap, the heap is a max-heap if reverse is true.
+func (h *indexHeap) Reset(reverse bool) {
+	h.reverse = reverse
+	h.indexes = h.indexes[:0]
+}
+
+func (i *mergedIterator) indexHeap() *indexHeap {
+	return (*indexHeap)(i)
 }
 
 // NewMergedIterator returns an iterator that merges its input. Walking the
@@ -289,16 +382,18 @@ func (i *mergedIterator) SetErrorCallback(f func(err error)) {
 // in strictly increasing key order, as defined by cmp.
 // The input's key ranges may overlap, but there are assumed to be no duplicate
 // keys: if iters[i] contains a key k then iters[j] will not contain that key k.
-// None of the iters may be nil.
+// None of the iters may be nil. The input iterators are kept in a binary
+// heap, stepping the resultant iterator takes O(log n) key comparisons.
 //
 // If strict is true the any 'corruption errors' (i.e errors.IsCorrupted(err) == true)
 // won't be ignored and will halt 'merged iterator', otherwise the iterator will
 // continue to the next 'input iterator'.
 func NewMergedIterator(iters []Iterator, cmp comparer.Comparer, strict bool) Iterator {
 	return &mergedIterator{
-		iters:  iters,
-		cmp:    cmp,
-		strict: strict,
-		keys:   make([][]byte, len(iters)),
+		iters:   iters,
+		cmp:     cmp,
+		strict:  strict,
+		keys:    make([][]byte, len(iters)),
+		indexes: make([]int, 0, len(iters)),
 	}
 }
@@ -62,16 +62,32 @@
 // The wire format is that the stream is divided into 32KiB blocks, and each
 // block contains a number of tightly packed chunks. Chunks cannot cross block
 // boundaries. The last block may be shorter than 32 KiB. Any unused bytes in a
-// block must be zero.
+// block must be zero. Other block sizes can be used with NewReaderSize and
+// NewWriterSize, a journal must be read with the block size it was written
+// with.
 //
 // A journal maps to one or more chunks. Each chunk has a 7 byte header (a 4
 // byte checksum, a 2 byte little-endian uint16 length, and a 1 byte chunk type)
 // followed by a payload. The checksum is over the chunk type and the payload.
+// The checksum is a CRC-32 computed using Castagnoli's polynomial, unless the
+// chunk type is offset by a multiple of four giving the checksum algorithm,
+// see util.Checksum and Writer.SetChecksum; e.g. the chunk types of xxHash
+// checksummed chunks are 5 to 8.
 //
 // There are four chunk types: whether the chunk is the full journal, or the
 // first, middle or last chunk of a multi-chunk journal. A multi-chunk journal
 // has one first chunk, zero or more middle chunks, and one last chunk.
 //
+// Recyclable chunks, written once the journal file number is set with
+// Writer.SetNumber, have the 0x80 bit of the chunk type set and an 11 byte
+// header: the 7 byte header followed by the low 32 bits of the journal file
+// number as a 4 byte little-endian uint32. The checksum is over the chunk
+// type, the file number and the payload. A file reused for another journal
+// holds the chunks of its previous use past the written ones; a reader given
+// the file number with Reader.SetNumber stops at the recyclable chunks of
+// other file numbers, so they are never read as part of the journal. The
+// unused bytes at the end of a block are zero if fewer than 11.
+//
 // The wire format allows for limited recovery in the face of data corruption:
 // on a format error (such as a checksum mismatch), the reader moves to the
 // next block and looks for the next full or first chunk.
@@ -93,25 +109,51 @@ const (
 	firstChunkType  = 2
 	middleChunkType = 3
 	lastChunkType   = 4
+
+	// The chunk types are offset by the checksum algorithm times the
+	// number of chunk types.
+	numChunkTypes = 4
+
+	// The chunk type of recyclable chunks is flagged.
+	recyclableChunkFlag = 0x80
+)
+
+const (
+	blockSize            = 32 * 1024
+	headerSize           = 7
+	recyclableHeaderSize = headerSize + 4
 )
 
 const (
-	blockSize  = 32 * 1024
-	headerSize = 7
+	// DefaultBlockSize is the block size of NewReader and NewWriter.
+	DefaultBlockSize = blockSize
+
+	// MinBlockSize and MaxBlockSize are the bounds of the block size. The
+	// chunk length is stored as uint16, which bounds the block size.
+	MinBlockSize = 1024
+	MaxBlockSize = 64 * 1024
 )
 
+func checkBlockSize(blockSize int) {
+	if blockSize < MinBlockSize || blockSize > MaxBlockSize {
+		panic(fmt.Sprintf("leveldb/journal: invalid block size %d", blockSize))
+	}
+}
+
 type flusher interface {
 	Flush() error
 }
 
 // ErrCorrupted is the error type that generated by corrupted block or chunk.
 type ErrCorrupted struct {
+	// Offset of the corrupted block or chunk within the journal file.
+	Offset int64
 	Size   int
 	Reason string
 }
 
 func (e *ErrCorrupted) Error() string {
-	return fmt.Sprintf("leveldb/journal: block/chunk corrupted: %s (%d bytes)", e.Reason, e.Size)
+	return fmt.Sprintf("leveldb/journal: block/chunk corrupted: %s (%d bytes at offset %d)", e.Reason, e.Size, e.Offset)
 }
 
 // Dropper is the interface that wrap simple Drop method. The Drop
@@ -130,43 +172,74 @@ type Reader struct {
 	strict bool
 	// checksum flag.
 	checksum bool
+	// num is the file number of the recyclable chunks, if hasNum.
+	num    uint32
+	hasNum bool
 	// seq is the sequence number of the current journal.
 	seq int
 	// buf[i:j] is the unread portion of the current chunk's payload.
 	// The low bound, i, excludes the chunk header.
 	i, j int
 	// n is the number of bytes of buf that are valid. Once reading has started,
-	// only the final block can have n < blockSize.
+	// only the final block can have n < len(buf).
 	n int
+	// off is the offset of buf within the underlying reader.
+	off int64
 	// last is whether the current chunk is the last chunk of the journal.
 	last bool
 	// err is any accumulated error.
 	err error
-	// buf is the buffer.
-	buf [blockSize]byte
+	// buf is the buffer, of the block size.
+	buf []byte
 }
 
 // NewReader returns a new reader. The dropper may be nil, and if
 // strict is true then corrupted or invalid chunk will halt the journal
 // reader entirely.
 func NewReader(r io.Reader, dropper Dropper, strict, checksum bool) *Reader {
+	return NewReaderSize(r, dropper, strict, checksum, DefaultBlockSize)
+}
+
+// NewReaderSize is like NewReader but reads journals written with the
+// given block size. It panics if the block size is not within
+// MinBlockSize and MaxBlockSize.
+func NewReaderSize(r io.Reader, dropper Dropper, strict, checksum bool, blockSize int) *Reader {
+	checkBlockSize(blockSize)
+	return NewReaderBuffer(r, dropper, strict, checksum, make([]byte, blockSize))
+}
+
+// NewReaderBuffer is like NewReaderSize but uses buf as the block buffer,
+// the block size is the length of buf. It allows the buffer to come from
+// a pool, the buffer may be recycled once the reader is no longer used.
+func NewReaderBuffer(r io.Reader, dropper Dropper, strict, checksum bool, buf []byte) *Reader {
+	checkBlockSize(len(buf))
 	return &Reader{
 		r:        r,
 		dropper:  dropper,
 		strict:   strict,
 		checksum: checksum,
 		last:     true,
+		buf:      buf,
 	}
 }
 
 var errSkip = errors.New("leveldb/journal: skipped")
 
-func (r *Reader) corrupt(n int, reason string, skip bool) error {
+// SetNumber sets the journal file number, the recyclable chunks of other
+// file numbers are stale and end the journals. The chunks that aren't
+// recyclable are read regardless of the number. Reset unsets the number.
+func (r *Reader) SetNumber(num int64) {
+	r.num, r.hasNum = uint32(num), true
+}
+
+// Reports n corrupted bytes at the given offset of the current block.
+func (r *Reader) corrupt(offset, n int, reason string, skip bool) error {
 	if r.dropper != nil {
-		r.dropper.Drop(&ErrCorrupted{n, reason})
+		r.dropper.Drop(&ErrCorrupted{r.off + int64(offset), n, reason})
 	}
 	if r.strict && !skip {
-		r.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrCorrupted{n, reason})
+		off := r.off + int64(offset)
+		r.err = errors.NewErrCorruptedAt(storage.FileDesc{}, off, int64(n), reason, &ErrCorrupted{off, n, reason})
 		return r.err
 	}
 	return errSkip
@@ -180,63 +253,87 @@ func (r *Reader) nextChunk(first bool) error {
 			checksum := binary.LittleEndian.Uint32(r.buf[r.j+0 : r.j+4])
 			length := binary.LittleEndian.Uint16(r.buf[r.j+4 : r.j+6])
 			chunkType := r.buf[r.j+6]
+			start := r.j
 			unprocBlock := r.n - r.j
 			if checksum == 0 && length == 0 && chunkType == 0 {
 				// Drop entire block.
 				r.i = r.n
 				r.j = r.n
-				return r.corrupt(unprocBlock, "zero header", false)
+				if unprocBlock < recyclableHeaderSize && r.n == len(r.buf) {
+					// Block trailer of recyclable chunks.
+					continue
+				}
+				return r.corrupt(start, unprocBlock, "zero header", false)
+			}
+			hsize := headerSize
+			if chunkType&recyclableChunkFlag != 0 {
+				chunkType &^= recyclableChunkFlag
+				hsize = recyclableHeaderSize
 			}
-			if chunkType < fullChunkType || chunkType > lastChunkType {
+			checksumType := util.Checksum((chunkType - 1) / numChunkTypes)
+			if chunkType < fullChunkType || !checksumType.Valid() || r.j+hsize > r.n {
 				// Drop entire block.
 				r.i = r.n
 				r.j = r.n
-				return r.corrupt(unprocBlock, fmt.Sprintf("invalid chunk type %#x", chunkType), false)
+				return r.corrupt(start, unprocBlock, fmt.Sprintf("invalid chunk type %#x", r.buf[start+6]), false)
 			}
-			r.i = r.j + headerSize
-			r.j = r.j + headerSize + int(length)
+			if hsize == recyclableHeaderSize && r.hasNum && binary.LittleEndian.Uint32(r.buf[r.j+7:r.j+11]) != r.num {
+				// Stale chunk of the previous use of the file, the journals
+				// end.
+				r.i = r.n
+				r.j = r.n
+				r.err = io.EOF
+				if !first {
+					return r.corrupt(start, 0, "missing chunk part", false)
+				}
+				return r.err
+			}
+			r.i = r.j + hsize
+			r.j = r.j + hsize + int(length)
 			if r.j > r.n {
 				// Drop entire block.
 				r.i = r.n
 				r.j = r.n
-				return r.corrupt(unprocBlock, "chunk length overflows block", false)
-			} else if r.checksum && checksum != util.NewCRC(r.buf[r.i-1:r.j]).Value() {
+				return r.corrupt(start, unprocBlock, "chunk length overflows block", false)
+			} else if r.checksum && checksum != checksumType.Sum(r.buf[start+6:r.j]) {
 				// Drop entire block.
 				r.i = r.n
 				r.j = r.n
-				return r.corrupt(unprocBlock, "checksum mismatch", false)
+				return r.corrupt(start, unprocBlock, "checksum mismatch", false)
 			}
+			chunkType = (chunkType-1)%numChunkTypes + 1
 			if first && chunkType != fullChunkType && chunkType != firstChunkType {
 				chunkLength := (r.j - r.i) + headerSize
 				r.i = r.j
 				// Report the error, but skip it.
-				return r.corrupt(chunkLength, "orphan chunk", true)
+				return r.corrupt(start, chunkLength, "orphan chunk", true)
 			}
 			r.last = chunkType == fullChunkType || chunkType == lastChunkType
 			return nil
 		}
 
 		// The last block.
-		if r.n < blockSize && r.n > 0 {
+		if r.n < len(r.buf) && r.n > 0 {
 			if !first {
-				return r.corrupt(0, "missing chunk part", false)
+				return r.corrupt(r.n, 0, "missing chunk part", false)
 			}
 			r.err = io.EOF
 			return r.err
 		}
 
 		// Read block.
-		n, err := io.ReadFull(r.r, r.buf[:])
+		n, err := io.ReadFull(r.r, r.buf)
 		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return err
 		}
 		if n == 0 {
 			if !first {
-				return r.corrupt(0, "missing chunk part", false)
+				return r.corrupt(r.n, 0, "missing chunk part", false)
 			}
 			r.err = io.EOF
 			return r.err
 		}
+		r.off += int64(r.n)
 		r.i, r.j, r.n = 0, 0, n
 	}
 }
@@ -270,9 +367,11 @@ func (r *Reader) Reset(reader io.Reader, dropper Dropper, strict, checksum bool)
 	r.dropper = dropper
 	r.strict = strict
 	r.checksum = checksum
+	r.hasNum = false
 	r.i = 0
 	r.j = 0
 	r.n = 0
+	r.off = 0
 	r.last = true
 	r.err = nil
 	return err
@@ -358,24 +457,62 @@ type Writer struct {
 	first bool
 	// pending is whether a chunk is buffered but not yet written.
 	pending bool
+	// checksum is the checksum algorithm of the chunks.
+	checksum util.Checksum
+	// num is the file number of the recyclable chunks, and hsize the
+	// chunk header size.
+	num   uint32
+	hsize int
 	// err is any accumulated error.
 	err error
-	// buf is the buffer.
-	buf [blockSize]byte
+	// buf is the buffer, of the block size.
+	buf []byte
 }
 
 // NewWriter returns a new Writer.
 func NewWriter(w io.Writer) *Writer {
+	return NewWriterSize(w, DefaultBlockSize)
+}
+
+// NewWriterSize returns a new Writer writing journals with the given block
+// size. It panics if the block size is not within MinBlockSize and
+// MaxBlockSize.
+func NewWriterSize(w io.Writer, blockSize int) *Writer {
+	checkBlockSize(blockSize)
 	f, _ := w.(flusher)
 	return &Writer{
-		w: w,
-		f: f,
+		w:     w,
+		f:     f,
+		hsize: headerSize,
+		buf:   make([]byte, blockSize),
 	}
 }
 
+// SetChecksum sets the checksum algorithm of the chunks written next, it
+// panics if the algorithm is unknown. The default is util.CRC32CChecksum,
+// which is the only one readable by older versions. The readers detect the
+// checksum algorithm of each chunk.
+func (w *Writer) SetChecksum(checksum util.Checksum) {
+	if !checksum.Valid() {
+		panic(fmt.Sprintf("leveldb/journal: invalid checksum %d", checksum))
+	}
+	w.checksum = checksum
+}
+
+// SetNumber sets the journal file number, the chunks written next are
+// recyclable and hold the number, see Reader.SetNumber. It must be called
+// before writing to the underlying writer, or after Reset, which makes the
+// chunks written next not recyclable.
+func (w *Writer) SetNumber(num int64) {
+	if w.j != 0 {
+		panic("leveldb/journal: number set after writing")
+	}
+	w.num, w.hsize = uint32(num), recyclableHeaderSize
+}
+
 // fillHeader fills in the header for the pending chunk.
 func (w *Writer) fillHeader(last bool) {
-	if w.i+headerSize > w.j || w.j > blockSize {
+	if w.i+w.hsize > w.j || w.j > len(w.buf) {
 		panic("leveldb/journal: bad writer state")
 	}
 	if last {
@@ -391,8 +528,13 @@ func (w *Writer) fillHeader(last bool) {
 			w.buf[w.i+6] = middleChunkType
 		}
 	}
-	binary.LittleEndian.PutUint32(w.buf[w.i+0:w.i+4], util.NewCRC(w.buf[w.i+6:w.j]).Value())
-	binary.LittleEndian.PutUint16(w.buf[w.i+4:w.i+6], uint16(w.j-w.i-headerSize))
+	w.buf[w.i+6] += byte(w.checksum) * numChunkTypes
+	if w.hsize == recyclableHeaderSize {
+		w.buf[w.i+6] |= recyclableChunkFlag
+		binary.LittleEndian.PutUint32(w.buf[w.i+7:w.i+11], w.num)
+	}
+	binary.LittleEndian.PutUint32(w.buf[w.i+0:w.i+4], w.checksum.Sum(w.buf[w.i+6:w.j]))
+	binary.LittleEndian.PutUint16(w.buf[w.i+4:w.i+6], uint16(w.j-w.i-w.hsize))
 }
 
 // writeBlock writes the buffered block to the underlying writer, and reserves
@@ -400,7 +542,7 @@ func (w *Writer) fillHeader(last bool) {
 func (w *Writer) writeBlock() {
 	_, w.err = w.w.Write(w.buf[w.written:])
 	w.i = 0
-	w.j = headerSize
+	w.j = w.hsize
 	w.written = 0
 }
 
@@ -459,6 +601,7 @@ func (w *Writer) Reset(writer io.Writer) (err error) {
 	w.written = 0
 	w.first = false
 	w.pending = false
+	w.hsize = headerSize
 	w.err = nil
 	return
 }
@@ -474,11 +617,11 @@ func (w *Writer) Next() (io.Writer, error) {
 		w.fillHeader(true)
 	}
 	w.i = w.j
-	w.j = w.j + headerSize
+	w.j = w.j + w.hsize
 	// Check if there is room in the block for the header.
-	if w.j > blockSize {
+	if w.j > len(w.buf) {
 		// Fill in the rest of the block with zeroes.
-		for k := w.i; k < blockSize; k++ {
+		for k := w.i; k < len(w.buf); k++ {
 			w.buf[k] = 0
 		}
 		w.writeBlock()
@@ -507,7 +650,7 @@ func (x singleWriter) Write(p []byte) (int, error) {
 	n0 := len(p)
 	for len(p) > 0 {
 		// Write a block, if it is full.
-		if w.j == blockSize {
+		if w.j == len(w.buf) {
 			w.fillHeader(false)
 			w.writeBlock()
 			if w.err != nil {
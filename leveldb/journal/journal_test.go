@@ -17,8 +17,12 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"reflect"
 	"strings"
 	"testing"
+
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
 type dropper struct {
@@ -165,6 +169,197 @@ func TestBoundary(t *testing.T) {
 	}
 }
 
+func TestBlockSize(t *testing.T) {
+	const bs = 4 * 1024
+	ss := []string{
+		big("abcd", bs-headerSize),
+		"",
+		big("ABCDE", 3*bs),
+		"x",
+	}
+	buf := new(bytes.Buffer)
+	w := NewWriterSize(buf, bs)
+	for i, s := range ss {
+		ww, err := w.Next()
+		if err != nil {
+			t.Fatalf("#%d: next: %v", i, err)
+		}
+		if _, err := ww.Write([]byte(s)); err != nil {
+			t.Fatalf("#%d: write: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Full blocks are written, and a block ends on the block size boundary.
+	if n := buf.Len(); n <= 4*bs || n >= 5*bs {
+		t.Fatalf("journal length: got %d, want within (%d, %d)", n, 4*bs, 5*bs)
+	}
+
+	// The reader of a given buffer reads the same, whatever the buffer
+	// held before.
+	dirty := []byte(big("dirty", bs))
+	for _, r := range []*Reader{
+		NewReaderSize(bytes.NewReader(buf.Bytes()), dropper{t}, true, true, bs),
+		NewReaderBuffer(bytes.NewReader(buf.Bytes()), dropper{t}, true, true, dirty),
+	} {
+		for i, s := range ss {
+			rr, err := r.Next()
+			if err != nil {
+				t.Fatalf("#%d: next: %v", i, err)
+			}
+			x, err := ioutil.ReadAll(rr)
+			if err != nil {
+				t.Fatalf("#%d: read: %v", i, err)
+			}
+			if string(x) != s {
+				t.Fatalf("#%d: got %d bytes, want %d bytes", i, len(x), len(s))
+			}
+		}
+		if _, err := r.Next(); err != io.EOF {
+			t.Fatalf("last next: got %v, want io.EOF", err)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	ss := []string{
+		"crc32c",
+		big("xxhash", 2*blockSize),
+		"xxhash",
+		"crc32c again",
+	}
+	checksums := []util.Checksum{util.CRC32CChecksum, util.XXHash64Checksum, util.XXHash64Checksum, util.CRC32CChecksum}
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for i, s := range ss {
+		w.SetChecksum(checksums[i])
+		ww, err := w.Next()
+		if err != nil {
+			t.Fatalf("#%d: next: %v", i, err)
+		}
+		if _, err := ww.Write([]byte(s)); err != nil {
+			t.Fatalf("#%d: write: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The chunk types give the checksum algorithm.
+	if ct := buf.Bytes()[headerSize+len(ss[0])+6]; ct != firstChunkType+numChunkTypes {
+		t.Fatalf("chunk type: got %d, want %d", ct, firstChunkType+numChunkTypes)
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()), dropper{t}, true, true)
+	for i, s := range ss {
+		rr, err := r.Next()
+		if err != nil {
+			t.Fatalf("#%d: next: %v", i, err)
+		}
+		x, err := ioutil.ReadAll(rr)
+		if err != nil {
+			t.Fatalf("#%d: read: %v", i, err)
+		}
+		if string(x) != s {
+			t.Fatalf("#%d: got %d bytes, want %d bytes", i, len(x), len(s))
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("last next: got %v, want io.EOF", err)
+	}
+
+	// A corrupted xxHash checksummed chunk is detected.
+	data := append([]byte{}, buf.Bytes()...)
+	data[2*headerSize+len(ss[0])] ^= 0xff
+	r = NewReader(bytes.NewReader(data), dropper{t}, true, true)
+	var err error
+	for i := 0; err == nil && i < len(ss); i++ {
+		var rr io.Reader
+		if rr, err = r.Next(); err == nil {
+			_, err = ioutil.ReadAll(rr)
+		}
+	}
+	if !errors.IsCorrupted(err) {
+		t.Fatalf("corrupted chunk: got %v, want corrupted error", err)
+	}
+}
+
+func TestRecyclable(t *testing.T) {
+	write := func(num int64, ss []string) []byte {
+		buf := new(bytes.Buffer)
+		w := NewWriter(buf)
+		w.SetNumber(num)
+		for i, s := range ss {
+			ww, err := w.Next()
+			if err != nil {
+				t.Fatalf("#%d: next: %v", i, err)
+			}
+			if _, err := ww.Write([]byte(s)); err != nil {
+				t.Fatalf("#%d: write: %v", i, err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	read := func(data []byte, num int64, strict bool) (ss []string, err error) {
+		r := NewReader(bytes.NewReader(data), dropper{t}, strict, true)
+		if num >= 0 {
+			r.SetNumber(num)
+		}
+		for {
+			var rr io.Reader
+			if rr, err = r.Next(); err != nil {
+				break
+			}
+			var x []byte
+			if x, err = ioutil.ReadAll(rr); err == io.ErrUnexpectedEOF {
+				// Torn journal, skipped.
+				continue
+			} else if err != nil {
+				break
+			}
+			ss = append(ss, string(x))
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		return
+	}
+
+	// The block trailers are shorter than the recyclable chunk header.
+	ss := []string{"abc", big("x", blockSize-2*recyclableHeaderSize-3-8), "def", big("y", 3*blockSize)}
+	stale := write(1, ss)
+	if got, err := read(stale, 1, true); err != nil || !reflect.DeepEqual(got, ss) {
+		t.Fatalf("read: got %d journals, error %v", len(got), err)
+	}
+	// Readers without the number read recyclable chunks.
+	if got, err := read(stale, -1, true); err != nil || !reflect.DeepEqual(got, ss) {
+		t.Fatalf("read without number: got %d journals, error %v", len(got), err)
+	}
+
+	// The file is reused for another journal, the last one is torn after
+	// its first block. The stale chunks of the same layout that follow
+	// mustn't be read as its remaining chunks.
+	ss2 := []string{"ABC", big("X", blockSize-2*recyclableHeaderSize-3-8), "DEF", big("Y", 3*blockSize)}
+	data := append([]byte{}, stale...)
+	copy(data, write(2, ss2)[:2*blockSize])
+	got, err := read(data, 2, false)
+	if err != nil || !reflect.DeepEqual(got, ss2[:3]) {
+		t.Fatalf("read reused: got %d journals, error %v", len(got), err)
+	}
+	if _, err := read(data, 2, true); !errors.IsCorrupted(err) {
+		t.Fatalf("read reused strict: got %v, want corrupted error", err)
+	}
+	// The stale chunks end the journals.
+	data = append(data[:0], stale...)
+	copy(data, write(2, ss2[:1]))
+	if got, err := read(data, 2, true); err != nil || !reflect.DeepEqual(got, ss2[:1]) {
+		t.Fatalf("read reused: got %d journals, error %v", len(got), err)
+	}
+}
+
 func TestFlush(t *testing.T) {
 	buf := new(bytes.Buffer)
 	w := NewWriter(buf)
@@ -816,3 +1011,52 @@ func TestCorrupt_MiddleChuckLengthOverflow(t *testing.T) {
 		t.Fatalf("last next: unexpected error: %v", err)
 	}
 }
+
+func TestCorrupt_Offset(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	w := NewWriter(buf)
+	for i := 0; i < 3; i++ {
+		ww, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ww.Write(bytes.Repeat([]byte("0"), blockSize-headerSize)); err != nil {
+			t.Fatalf("write #%d: unexpected error: %v", i, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := buf.Bytes()
+	// Corrupting block #2 payload.
+	b[2*blockSize+headerSize+10] = '1'
+
+	r := NewReader(bytes.NewReader(b), dropper{t}, true, true)
+	for i := 0; i < 2; i++ {
+		rr, err := r.Next()
+		if err != nil {
+			t.Fatalf("next #%d: %v", i, err)
+		}
+		if _, err := io.Copy(ioutil.Discard, rr); err != nil {
+			t.Fatalf("read #%d: %v", i, err)
+		}
+	}
+
+	_, err := r.Next()
+	cerr, ok := err.(*errors.ErrCorrupted)
+	if !ok {
+		t.Fatalf("next #2: got %v, want corrupted error", err)
+	}
+	jerr, ok := cerr.Err.(*ErrCorrupted)
+	if !ok {
+		t.Fatalf("next #2: got %T, want *ErrCorrupted", cerr.Err)
+	}
+	if jerr.Offset != 2*blockSize || jerr.Size != blockSize {
+		t.Fatalf("next #2: got offset=%d size=%d, want offset=%d size=%d", jerr.Offset, jerr.Size, 2*blockSize, blockSize)
+	}
+	if cerr.Offset != jerr.Offset || cerr.Size != int64(jerr.Size) || cerr.Reason != "checksum mismatch" {
+		t.Fatalf("next #2: got offset=%d size=%d reason=%q, want as %v", cerr.Offset, cerr.Size, cerr.Reason, jerr)
+	}
+}
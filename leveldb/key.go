@@ -11,7 +11,6 @@ import (
 	"fmt"
 
 	"github.com/FactomProject/goleveldb/leveldb/errors"
-	"github.com/FactomProject/goleveldb/leveldb/storage"
 )
 
 // ErrInternalKeyCorrupted records internal key corruption.
@@ -25,7 +24,7 @@ func (e *ErrInternalKeyCorrupted) Error() string {
 }
 
 func newErrInternalKeyCorrupted(ikey []byte, reason string) error {
-	return errors.NewErrCorrupted(storage.FileDesc{}, &ErrInternalKeyCorrupted{append([]byte{}, ikey...), reason})
+	return &errors.ErrCorrupted{Reason: reason, Err: &ErrInternalKeyCorrupted{append([]byte{}, ikey...), reason}}
 }
 
 type keyType uint
@@ -36,6 +35,10 @@ func (kt keyType) String() string {
 		return "d"
 	case keyTypeVal:
 		return "v"
+	case keyTypeRangeDel:
+		return "r"
+	case keyTypeValPtr:
+		return "p"
 	}
 	return fmt.Sprintf("<invalid:%#x>", uint(kt))
 }
@@ -43,8 +46,10 @@ func (kt keyType) String() string {
 // Value types encoded as the last component of internal keys.
 // Don't modify; this value are saved to disk.
 const (
-	keyTypeDel = keyType(0)
-	keyTypeVal = keyType(1)
+	keyTypeDel      = keyType(0)
+	keyTypeVal      = keyType(1)
+	keyTypeRangeDel = keyType(2)
+	keyTypeValPtr   = keyType(3)
 )
 
 // keyTypeSeek defines the keyType that should be passed when constructing an
@@ -52,7 +57,7 @@ const (
 // sort sequence numbers in decreasing order and the value type is
 // embedded as the low 8 bits in the sequence number in internal keys,
 // we need to use the highest-numbered ValueType, not the lowest).
-const keyTypeSeek = keyTypeVal
+const keyTypeSeek = keyTypeValPtr
 
 const (
 	// Maximum value possible for sequence number; the 8-bits are
@@ -75,7 +80,7 @@ type internalKey []byte
 func makeInternalKey(dst, ukey []byte, seq uint64, kt keyType) internalKey {
 	if seq > keyMaxSeq {
 		panic("leveldb: invalid sequence number")
-	} else if kt > keyTypeVal {
+	} else if kt > keyTypeValPtr {
 		panic("leveldb: invalid type")
 	}
 
@@ -85,13 +90,30 @@ func makeInternalKey(dst, ukey []byte, seq uint64, kt keyType) internalKey {
 	return internalKey(dst)
 }
 
+// Scratch buffer of the internal keys of the lookups, pooled so point
+// lookups don't allocate their internal key.
+type ikeyBuffer struct {
+	b internalKey
+}
+
+func newIkeyBuffer() interface{} {
+	return &ikeyBuffer{}
+}
+
+// Encodes the internal key into the buffer, which is valid until the
+// next call.
+func (buf *ikeyBuffer) make(ukey []byte, seq uint64, kt keyType) internalKey {
+	buf.b = makeInternalKey(buf.b, ukey, seq, kt)
+	return buf.b
+}
+
 func parseInternalKey(ik []byte) (ukey []byte, seq uint64, kt keyType, err error) {
 	if len(ik) < 8 {
 		return nil, 0, 0, newErrInternalKeyCorrupted(ik, "invalid length")
 	}
 	num := binary.LittleEndian.Uint64(ik[len(ik)-8:])
 	seq, kt = uint64(num>>8), keyType(num&0xff)
-	if kt > keyTypeVal {
+	if kt > keyTypeValPtr {
 		return nil, 0, 0, newErrInternalKeyCorrupted(ik, "invalid type")
 	}
 	ukey = ik[:len(ik)-8]
@@ -125,7 +147,7 @@ func (ik internalKey) num() uint64 {
 func (ik internalKey) parseNum() (seq uint64, kt keyType) {
 	num := ik.num()
 	seq, kt = uint64(num>>8), keyType(num&0xff)
-	if kt > keyTypeVal {
+	if kt > keyTypeValPtr {
 		panic(fmt.Sprintf("leveldb: internal key %q, len=%d: invalid type %#x", []byte(ik), len(ik), kt))
 	}
 	return
@@ -131,3 +131,19 @@ func TestInternalKeyShortestSuccessor(t *testing.T) {
 	assertBytes(t, ikey("\xff\xff", 100, keyTypeVal),
 		shortSuccessor(ikey("\xff\xff", 100, keyTypeVal)))
 }
+
+func TestInternalKey_Buffer(t *testing.T) {
+	buf := newIkeyBuffer().(*ikeyBuffer)
+	for _, key := range []string{"long-key", "", "k", "longer-key-x"} {
+		got := buf.make([]byte(key), 5, keyTypeSeek)
+		if want := ikey(key, 5, keyTypeSeek); !bytes.Equal(got, want) {
+			t.Errorf("make %q: got %x, want %x", key, got, want)
+		}
+	}
+
+	// The buffer is reused once large enough.
+	key := []byte("key")
+	if n := testing.AllocsPerRun(100, func() { buf.make(key, 10, keyTypeDel) }); n != 0 {
+		t.Errorf("make: got %v allocations, want 0", n)
+	}
+}
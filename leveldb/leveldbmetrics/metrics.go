@@ -0,0 +1,110 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package leveldbmetrics publishes statistics of LevelDB databases with the
+// expvar package.
+//
+// The statistics of all published DBs are exported as the "leveldb" expvar
+// variable, a JSON object keyed by the name given to Publish:
+//
+//	"leveldb": {"users": {"gets": 1024, "puts": 16, ...}, "index": {...}}
+//
+// The statistics are collected on each read of the variable, e.g. by the
+// /debug/vars HTTP handler.
+package leveldbmetrics
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+
+	"github.com/FactomProject/goleveldb/leveldb"
+)
+
+// ErrNameExist is returned by Publish if the name is already published.
+var ErrNameExist = errors.New("leveldbmetrics: name already published")
+
+// Metrics holds the published statistics of a DB, see leveldb.DBStats.
+// The counters are cumulative since the DB was opened.
+type Metrics struct {
+	Gets              uint64  `json:"gets"`
+	Puts              uint64  `json:"puts"`
+	BytesRead         uint64  `json:"bytes_read"`
+	BytesWritten      uint64  `json:"bytes_written"`
+	CompactionSeconds float64 `json:"compaction_seconds"`
+	BlockCacheHitRate float64 `json:"block_cache_hit_rate"`
+	OpenTables        int     `json:"open_tables"`
+}
+
+// Collect returns the statistics of the given DB.
+func Collect(db *leveldb.DB) (*Metrics, error) {
+	s, err := db.Stats()
+	if err != nil {
+		return nil, err
+	}
+	m := &Metrics{
+		Gets:         s.GetCount,
+		Puts:         s.PutCount,
+		BytesRead:    s.IORead,
+		BytesWritten: s.IOWrite,
+		OpenTables:   s.OpenedTablesCount,
+	}
+	for _, d := range s.LevelDurations {
+		m.CompactionSeconds += d.Seconds()
+	}
+	if n := s.BlockCacheHits + s.BlockCacheMisses; n > 0 {
+		m.BlockCacheHitRate = float64(s.BlockCacheHits) / float64(n)
+	}
+	return m, nil
+}
+
+var (
+	mu      sync.Mutex
+	dbs     = make(map[string]*leveldb.DB)
+	publish sync.Once
+)
+
+// Returns the statistics of the published DBs, closed DBs are skipped.
+func collectAll() interface{} {
+	mu.Lock()
+	defer mu.Unlock()
+	all := make(map[string]*Metrics, len(dbs))
+	for name, db := range dbs {
+		if m, err := Collect(db); err == nil {
+			all[name] = m
+		}
+	}
+	return all
+}
+
+// Publish publishes the statistics of the given DB under the given name,
+// usually right after the DB is opened. Each DB of the process must be
+// given a distinct name, it returns ErrNameExist otherwise.
+//
+// The "leveldb" expvar variable is published on the first call, it panics
+// if the variable name is already in use.
+func Publish(name string, db *leveldb.DB) error {
+	publish.Do(func() {
+		expvar.Publish("leveldb", expvar.Func(collectAll))
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := dbs[name]; ok {
+		return ErrNameExist
+	}
+	dbs[name] = db
+	return nil
+}
+
+// Unpublish removes the DB published under the given name, so the name can
+// be reused, e.g. once the DB is closed. It is a no-op if the name isn't
+// published.
+func Unpublish(name string) {
+	mu.Lock()
+	delete(dbs, name)
+	mu.Unlock()
+}
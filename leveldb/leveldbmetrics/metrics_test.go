@@ -0,0 +1,81 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldbmetrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+
+	"github.com/FactomProject/goleveldb/leveldb"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+)
+
+func openDB(t *testing.T) *leveldb.DB {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	return db
+}
+
+func published(t *testing.T) map[string]Metrics {
+	v := expvar.Get("leveldb")
+	if v == nil {
+		t.Fatal("leveldb variable not published")
+	}
+	var all map[string]Metrics
+	if err := json.Unmarshal([]byte(v.String()), &all); err != nil {
+		t.Fatal("invalid leveldb variable: ", err)
+	}
+	return all
+}
+
+func TestPublish(t *testing.T) {
+	db1, db2 := openDB(t), openDB(t)
+	defer db2.Close()
+
+	if err := Publish("db1", db1); err != nil {
+		t.Fatal("Publish: got error: ", err)
+	}
+	if err := Publish("db2", db2); err != nil {
+		t.Fatal("Publish: got error: ", err)
+	}
+	defer Unpublish("db2")
+	if err := Publish("db1", db2); err != ErrNameExist {
+		t.Fatalf("Publish of existing name: got error %v, want %v", err, ErrNameExist)
+	}
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := db1.Put([]byte(key), []byte("value"), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	db1.Get([]byte("a"), nil)
+	db1.Get([]byte("missing"), nil)
+	db2.Has([]byte("a"), nil)
+
+	all := published(t)
+	if m := all["db1"]; m.Gets != 2 || m.Puts != 3 || m.BytesWritten == 0 {
+		t.Errorf("invalid db1 metrics: %+v", m)
+	}
+	if m := all["db2"]; m.Gets != 1 || m.Puts != 0 {
+		t.Errorf("invalid db2 metrics: %+v", m)
+	}
+
+	// Closed DBs are skipped.
+	db1.Close()
+	if _, ok := published(t)["db1"]; ok {
+		t.Error("closed db1 still published")
+	}
+
+	Unpublish("db1")
+	if err := Publish("db1", db2); err != nil {
+		t.Fatal("Publish of unpublished name: got error: ", err)
+	}
+	Unpublish("db1")
+}
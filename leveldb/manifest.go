@@ -0,0 +1,329 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/journal"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+)
+
+// ManifestKey is a decoded internal key of a manifest record.
+type ManifestKey struct {
+	UserKey []byte `json:"ukey"`
+	Seq     uint64 `json:"seq"`
+	Type    string `json:"type"`
+}
+
+func newManifestKey(ikey internalKey) ManifestKey {
+	ukey, seq, kt, err := parseInternalKey(ikey)
+	if err != nil {
+		return ManifestKey{UserKey: append([]byte{}, ikey...), Type: "invalid"}
+	}
+	return ManifestKey{append([]byte{}, ukey...), seq, kt.String()}
+}
+
+func (k ManifestKey) String() string {
+	return fmt.Sprintf("%q,%s%d", k.UserKey, k.Type, k.Seq)
+}
+
+// ManifestCompPtr is a compaction pointer of a manifest record.
+type ManifestCompPtr struct {
+	Level int         `json:"level"`
+	Key   ManifestKey `json:"key"`
+}
+
+// ManifestRangeDel is a range tombstone of a table added by a manifest
+// record.
+type ManifestRangeDel struct {
+	Start []byte `json:"start"`
+	Limit []byte `json:"limit"`
+	Seq   uint64 `json:"seq"`
+}
+
+// ManifestTable is a table added, deleted or quarantined by a manifest
+// record. Only level and number are known of deleted tables, and only
+// number and value logs of quarantined tables.
+type ManifestTable struct {
+	Level     int                `json:"level"`
+	Num       int64              `json:"num"`
+	Size      int64              `json:"size,omitempty"`
+	Min       *ManifestKey       `json:"min,omitempty"`
+	Max       *ManifestKey       `json:"max,omitempty"`
+	RangeDels []ManifestRangeDel `json:"rangeDels,omitempty"`
+	ValueLogs []int64            `json:"valueLogs,omitempty"`
+}
+
+// ManifestNamedSnapshot is a named snapshot created by a manifest record.
+type ManifestNamedSnapshot struct {
+	Name string `json:"name"`
+	Seq  uint64 `json:"seq"`
+}
+
+// ManifestRecord is a decoded manifest record. Each record is a version
+// edit, the first record of a manifest holds the whole version.
+type ManifestRecord struct {
+	// Index of the record within the manifest, negative if the record
+	// is dropped by the journal reader.
+	Index int `json:"index"`
+
+	// Non-empty if the record is corrupted, the record is skipped and
+	// other fields are not set.
+	Error string `json:"error,omitempty"`
+
+	// Fields of the record, nil if absent.
+	Comparer        *string `json:"comparer,omitempty"`
+	ComparerVersion *uint64 `json:"comparerVersion,omitempty"`
+	JournalNum      *int64  `json:"journalNum,omitempty"`
+	PrevJournalNum  *int64  `json:"prevJournalNum,omitempty"`
+	NextFileNum     *int64  `json:"nextFileNum,omitempty"`
+	SeqNum          *uint64 `json:"seqNum,omitempty"`
+
+	CompPtrs      []ManifestCompPtr `json:"compPtrs,omitempty"`
+	DeletedTables []ManifestTable   `json:"deletedTables,omitempty"`
+	AddedTables   []ManifestTable   `json:"addedTables,omitempty"`
+
+	// Corrupted tables excluded from the version, see
+	// opt.CorruptionQuarantine.
+	QuarantinedTables []ManifestTable `json:"quarantinedTables,omitempty"`
+
+	// Named snapshots created and released, see DB.CreateNamedSnapshot.
+	NamedSnapshots         []ManifestNamedSnapshot `json:"namedSnapshots,omitempty"`
+	ReleasedNamedSnapshots []string                `json:"releasedNamedSnapshots,omitempty"`
+
+	// Number of tables of each level of the version once the record
+	// is applied.
+	LevelTables []int `json:"levelTables"`
+}
+
+func (p *sessionRecord) export(index int) ManifestRecord {
+	mr := ManifestRecord{Index: index}
+	if p.has(recComparer) {
+		comparer := p.comparer
+		mr.Comparer = &comparer
+	}
+	if p.has(recComparerVersion) {
+		version := p.comparerVersion
+		mr.ComparerVersion = &version
+	}
+	if p.has(recJournalNum) {
+		num := p.journalNum
+		mr.JournalNum = &num
+	}
+	if p.has(recPrevJournalNum) {
+		num := p.prevJournalNum
+		mr.PrevJournalNum = &num
+	}
+	if p.has(recNextFileNum) {
+		num := p.nextFileNum
+		mr.NextFileNum = &num
+	}
+	if p.has(recSeqNum) {
+		seq := p.seqNum
+		mr.SeqNum = &seq
+	}
+	for _, r := range p.compPtrs {
+		mr.CompPtrs = append(mr.CompPtrs, ManifestCompPtr{r.level, newManifestKey(r.ikey)})
+	}
+	for _, r := range p.deletedTables {
+		mr.DeletedTables = append(mr.DeletedTables, ManifestTable{Level: r.level, Num: r.num})
+	}
+	for _, r := range p.addedTables {
+		min, max := newManifestKey(r.imin), newManifestKey(r.imax)
+		t := ManifestTable{
+			Level:     r.level,
+			Num:       r.num,
+			Size:      r.size,
+			Min:       &min,
+			Max:       &max,
+			ValueLogs: r.vlogs,
+		}
+		for _, rd := range r.rdels {
+			t.RangeDels = append(t.RangeDels, ManifestRangeDel{rd.start, rd.limit, rd.seq})
+		}
+		mr.AddedTables = append(mr.AddedTables, t)
+	}
+	for _, r := range p.qTables {
+		mr.QuarantinedTables = append(mr.QuarantinedTables, ManifestTable{Num: r.num, ValueLogs: r.vlogs})
+	}
+	for _, name := range p.delNamedSnaps {
+		mr.ReleasedNamedSnapshots = append(mr.ReleasedNamedSnapshots, name)
+	}
+	for _, r := range p.namedSnaps {
+		mr.NamedSnapshots = append(mr.NamedSnapshots, ManifestNamedSnapshot{r.name, r.seq})
+	}
+	return mr
+}
+
+// Writes human-readable form of the record to w.
+func (mr *ManifestRecord) dump(w io.Writer) {
+	if mr.Index < 0 {
+		fmt.Fprintf(w, "%s\n", mr.Error)
+		return
+	}
+	fmt.Fprintf(w, "--- record #%d\n", mr.Index)
+	if mr.Error != "" {
+		fmt.Fprintf(w, "error: %s\n", mr.Error)
+		return
+	}
+	if mr.Comparer != nil {
+		fmt.Fprintf(w, "comparer: %s\n", *mr.Comparer)
+	}
+	if mr.ComparerVersion != nil {
+		fmt.Fprintf(w, "comparer-version: %d\n", *mr.ComparerVersion)
+	}
+	if mr.JournalNum != nil {
+		fmt.Fprintf(w, "journal-num: %d\n", *mr.JournalNum)
+	}
+	if mr.PrevJournalNum != nil {
+		fmt.Fprintf(w, "prev-journal-num: %d\n", *mr.PrevJournalNum)
+	}
+	if mr.NextFileNum != nil {
+		fmt.Fprintf(w, "next-file-num: %d\n", *mr.NextFileNum)
+	}
+	if mr.SeqNum != nil {
+		fmt.Fprintf(w, "seq-num: %d\n", *mr.SeqNum)
+	}
+	for _, r := range mr.CompPtrs {
+		fmt.Fprintf(w, "comp-ptr: L%d %v\n", r.Level, r.Key)
+	}
+	for _, t := range mr.DeletedTables {
+		fmt.Fprintf(w, "del-table: L%d @%d\n", t.Level, t.Num)
+	}
+	for _, t := range mr.AddedTables {
+		fmt.Fprintf(w, "add-table: L%d @%d S·%s %v:%v\n", t.Level, t.Num, shortenb(int(t.Size)), t.Min, t.Max)
+		for _, rd := range t.RangeDels {
+			fmt.Fprintf(w, "  range-del: %q:%q #%d\n", rd.Start, rd.Limit, rd.Seq)
+		}
+		for _, vnum := range t.ValueLogs {
+			fmt.Fprintf(w, "  value-log: @%d\n", vnum)
+		}
+	}
+	for _, t := range mr.QuarantinedTables {
+		fmt.Fprintf(w, "quarantined-table: @%d\n", t.Num)
+		for _, vnum := range t.ValueLogs {
+			fmt.Fprintf(w, "  value-log: @%d\n", vnum)
+		}
+	}
+	for _, name := range mr.ReleasedNamedSnapshots {
+		fmt.Fprintf(w, "del-named-snapshot: %q\n", name)
+	}
+	for _, ns := range mr.NamedSnapshots {
+		fmt.Fprintf(w, "named-snapshot: %q #%d\n", ns.Name, ns.Seq)
+	}
+	fmt.Fprintf(w, "tables: %v\n", mr.LevelTables)
+}
+
+type manifestDropper struct {
+	fn func(mr ManifestRecord) error
+}
+
+func (d manifestDropper) Drop(err error) {
+	d.fn(ManifestRecord{Index: -1, Error: fmt.Sprintf("dropped: %v", err)})
+}
+
+// Reads the manifest of the given file descriptor, calls fn for each
+// record in order. Corrupted records are passed with Error set, records
+// dropped by the journal reader are passed with negative index.
+func readManifest(stor storage.Storage, fd storage.FileDesc, fn func(mr ManifestRecord) error) error {
+	reader, err := stor.Open(fd)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// Tables of the version, to count tables per level.
+	var levels []map[int64]struct{}
+	jr := journal.NewReader(reader, manifestDropper{fn}, false, true)
+	for i := 0; ; i++ {
+		r, err := jr.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.SetFd(err, fd)
+		}
+		rec := &sessionRecord{}
+		if err := rec.decode(r); err != nil {
+			if err := fn(ManifestRecord{Index: i, Error: errors.SetFd(err, fd).Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		mr := rec.export(i)
+		for _, t := range mr.DeletedTables {
+			if t.Level < len(levels) {
+				delete(levels[t.Level], t.Num)
+			}
+		}
+		for _, t := range mr.AddedTables {
+			for len(levels) <= t.Level {
+				levels = append(levels, make(map[int64]struct{}))
+			}
+			levels[t.Level][t.Num] = struct{}{}
+		}
+		mr.LevelTables = make([]int, len(levels))
+		for level, tables := range levels {
+			mr.LevelTables[level] = len(tables)
+		}
+		if err := fn(mr); err != nil {
+			return err
+		}
+	}
+}
+
+// ReadManifest returns records of the current manifest of the given storage,
+// which is the history of version edits since the manifest is created.
+// Corrupted records are returned with Error set.
+func ReadManifest(stor storage.Storage) ([]ManifestRecord, error) {
+	fd, err := stor.GetMeta()
+	if err != nil {
+		return nil, err
+	}
+	var records []ManifestRecord
+	err = readManifest(stor, fd, func(mr ManifestRecord) error {
+		records = append(records, mr)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DumpManifest writes human-readable form of the current manifest of the
+// given storage to w. Each manifest record, a version edit, is written in
+// order, followed by number of tables per level of the resulting version.
+// Corrupted records are reported and skipped.
+func DumpManifest(stor storage.Storage, w io.Writer) error {
+	fd, err := stor.GetMeta()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s\n", fd)
+	return readManifest(stor, fd, func(mr ManifestRecord) error {
+		mr.dump(w)
+		return nil
+	})
+}
+
+// DumpManifestJSON is like DumpManifest, but writes the records as JSON
+// objects, one per line. See ManifestRecord for the fields.
+func DumpManifestJSON(stor storage.Storage, w io.Writer) error {
+	fd, err := stor.GetMeta()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	return readManifest(stor, fd, func(mr ManifestRecord) error {
+		return enc.Encode(mr)
+	})
+}
@@ -9,6 +9,7 @@ package memdb
 import (
 	"encoding/binary"
 	"math/rand"
+	"sync/atomic"
 	"testing"
 
 	"github.com/FactomProject/goleveldb/leveldb/comparer"
@@ -40,6 +41,22 @@ func BenchmarkPutRandom(b *testing.B) {
 	}
 }
 
+func BenchmarkPutConcurrent(b *testing.B) {
+	buf := make([][4]byte, b.N)
+	for i := range buf {
+		binary.LittleEndian.PutUint32(buf[i][:], uint32(rand.Int()))
+	}
+
+	b.ResetTimer()
+	p := New(comparer.DefaultComparer, 0)
+	var i int64 = -1
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			p.PutConcurrent(buf[atomic.AddInt64(&i, 1)][:], nil)
+		}
+	})
+}
+
 func BenchmarkGet(b *testing.B) {
 	buf := make([][4]byte, b.N)
 	for i := range buf {
@@ -8,8 +8,11 @@
 package memdb
 
 import (
+	"encoding/binary"
 	"math/rand"
 	"sync"
+	"sync/atomic"
+	"unsafe"
 
 	"github.com/FactomProject/goleveldb/leveldb/comparer"
 	"github.com/FactomProject/goleveldb/leveldb/errors"
@@ -23,7 +26,16 @@ var (
 	ErrIterReleased = errors.New("leveldb/memdb: iterator released")
 )
 
-const tMaxHeight = 12
+const (
+	tMaxHeight = 12
+
+	// Node arena chunk length bounds, as shift; a node never spans chunks.
+	nodeMinChunkShift = 12
+	nodeMaxChunkShift = 20
+
+	// Minimum length of a key/value arena chunk.
+	kvMinChunkLen = 4096
+)
 
 type dbIter struct {
 	util.BasicReleaser
@@ -37,19 +49,18 @@ type dbIter struct {
 
 func (i *dbIter) fill(checkStart, checkLimit bool) bool {
 	if i.node != 0 {
-		n := i.p.nodeData[i.node]
-		m := n + i.p.nodeData[i.node+nKey]
-		i.key = i.p.kvData[n:m]
+		key, value := i.p.kv(i.node)
 		if i.slice != nil {
 			switch {
-			case checkLimit && i.slice.Limit != nil && i.p.cmp.Compare(i.key, i.slice.Limit) >= 0:
+			case checkLimit && i.slice.Limit != nil && i.p.cmp.Compare(key, i.slice.Limit) >= 0:
 				fallthrough
-			case checkStart && i.slice.Start != nil && i.p.cmp.Compare(i.key, i.slice.Start) < 0:
+			case checkStart && i.slice.Start != nil && i.p.cmp.Compare(key, i.slice.Start) < 0:
 				i.node = 0
 				goto bail
 			}
 		}
-		i.value = i.p.kvData[m : m+i.p.nodeData[i.node+nVal]]
+		i.key = key
+		i.value = value
 		return true
 	}
 bail:
@@ -69,12 +80,10 @@ func (i *dbIter) First() bool {
 	}
 
 	i.forward = true
-	i.p.mu.RLock()
-	defer i.p.mu.RUnlock()
 	if i.slice != nil && i.slice.Start != nil {
 		i.node, _ = i.p.findGE(i.slice.Start, false)
 	} else {
-		i.node = i.p.nodeData[nNext]
+		i.node = i.p.load(0, nNext)
 	}
 	return i.fill(false, true)
 }
@@ -86,8 +95,6 @@ func (i *dbIter) Last() bool {
 	}
 
 	i.forward = false
-	i.p.mu.RLock()
-	defer i.p.mu.RUnlock()
 	if i.slice != nil && i.slice.Limit != nil {
 		i.node = i.p.findLT(i.slice.Limit)
 	} else {
@@ -103,8 +110,6 @@ func (i *dbIter) Seek(key []byte) bool {
 	}
 
 	i.forward = true
-	i.p.mu.RLock()
-	defer i.p.mu.RUnlock()
 	if i.slice != nil && i.slice.Start != nil && i.p.cmp.Compare(key, i.slice.Start) < 0 {
 		key = i.slice.Start
 	}
@@ -112,6 +117,21 @@ func (i *dbIter) Seek(key []byte) bool {
 	return i.fill(false, true)
 }
 
+func (i *dbIter) SeekLE(key []byte) bool {
+	if i.Released() {
+		i.err = ErrIterReleased
+		return false
+	}
+
+	i.forward = false
+	if i.slice != nil && i.slice.Limit != nil && i.p.cmp.Compare(key, i.slice.Limit) >= 0 {
+		i.node = i.p.findLT(i.slice.Limit)
+	} else {
+		i.node = i.p.findLE(key)
+	}
+	return i.fill(true, false)
+}
+
 func (i *dbIter) Next() bool {
 	if i.Released() {
 		i.err = ErrIterReleased
@@ -125,9 +145,7 @@ func (i *dbIter) Next() bool {
 		return false
 	}
 	i.forward = true
-	i.p.mu.RLock()
-	defer i.p.mu.RUnlock()
-	i.node = i.p.nodeData[i.node+nNext]
+	i.node = i.p.load(i.node, nNext)
 	return i.fill(false, true)
 }
 
@@ -144,8 +162,6 @@ func (i *dbIter) Prev() bool {
 		return false
 	}
 	i.forward = false
-	i.p.mu.RLock()
-	defer i.p.mu.RUnlock()
 	i.node = i.p.findLT(i.key)
 	return i.fill(true, false)
 }
@@ -173,31 +189,177 @@ func (i *dbIter) Release() {
 const (
 	nKV = iota
 	nKey
-	nVal
 	nHeight
 	nNext
 )
 
+// arena holds the nodes and key/value records of a DB in fixed chunks.
+// A chunk is never moved, new chunks are added by publishing a new arena,
+// which allows readers to access the arena without holding the lock.
+type arena struct {
+	// Node data:
+	// [0]         : KV record; chunk index << 32 | offset
+	// [1]         : Key length
+	// [2]         : Height
+	// [3..height] : Next nodes
+	nodes [][]int64
+	// KV record:
+	// key | uvarint(len(value)) | value
+	kvs [][]byte
+}
+
 // DB is an in-memory key/value database.
+//
+// The DB is a skiplist; reads are lock-free, while writes are serialized,
+// except for PutConcurrent. Nodes are linked and their key/value records
+// are replaced atomically, so reads may run concurrently with writes.
 type DB struct {
 	cmp comparer.BasicComparer
-	rnd *rand.Rand
 
-	mu     sync.RWMutex
-	kvData []byte
-	// Node data:
-	// [0]         : KV offset
-	// [1]         : Key length
-	// [2]         : Value length
-	// [3]         : Height
-	// [3..height] : Next nodes
-	nodeData  []int
-	prevNode  [tMaxHeight]int
-	maxHeight int
-	n         int
-	kvSize    int
+	arena     unsafe.Pointer // *arena
+	maxHeight int32
+	nodeShift uint
+	nodeMask  int
+
+	// Writer state. Put and Delete hold the lock exclusively, while
+	// PutConcurrent holds it shared.
+	mu       sync.RWMutex
+	prevNode [tMaxHeight]int
+	n        int64
+	kvSize   int64
+
+	// Allocation state.
+	allocMu sync.Mutex
+	rnd     *rand.Rand
+	nodeLen int // Used length of the node arena.
+	kvLen   int // Used length of the last key/value arena chunk.
+}
+
+// Returns the node arena chunk shift for the given key/value capacity. The
+// chunk is sized to half of the capacity, so that a DB filled up to its
+// capacity mostly needs a single node chunk.
+func nodeChunkShift(capacity int) uint {
+	shift := uint(nodeMinChunkShift)
+	for shift < nodeMaxChunkShift && 16<<shift < capacity {
+		shift++
+	}
+	return shift
+}
+
+func (p *DB) getArena() *arena {
+	return (*arena)(atomic.LoadPointer(&p.arena))
+}
+
+func (p *DB) setArena(a *arena) {
+	atomic.StorePointer(&p.arena, unsafe.Pointer(a))
+}
+
+func (p *DB) load(node, field int) int {
+	c := p.getArena().nodes[node>>p.nodeShift]
+	return int(atomic.LoadInt64(&c[node&p.nodeMask+field]))
+}
+
+func (p *DB) store(node, field int, v int64) {
+	c := p.getArena().nodes[node>>p.nodeShift]
+	atomic.StoreInt64(&c[node&p.nodeMask+field], v)
+}
+
+func (p *DB) cas(node, field, old, new int) bool {
+	c := p.getArena().nodes[node>>p.nodeShift]
+	return atomic.CompareAndSwapInt64(&c[node&p.nodeMask+field], int64(old), int64(new))
+}
+
+// Returns the KV record of the given node. The node must be loaded before
+// the arena, as the record may be in a chunk added after the node.
+func (p *DB) record(node int) []byte {
+	c := p.getArena().nodes[node>>p.nodeShift]
+	kv := atomic.LoadInt64(&c[node&p.nodeMask+nKV])
+	return p.getArena().kvs[kv>>32][kv&0xffffffff:]
+}
+
+func (p *DB) key(node int) []byte {
+	return p.record(node)[:p.load(node, nKey)]
+}
+
+func (p *DB) kv(node int) (key, value []byte) {
+	r := p.record(node)
+	n := p.load(node, nKey)
+	m, x := binary.Uvarint(r[n:])
+	return r[:n], r[n+x : n+x+int(m)]
+}
+
+// Appends a KV record to the arena; need alloc lock.
+func (p *DB) appendKV(key, value []byte) int64 {
+	var buf [binary.MaxVarintLen64]byte
+	x := binary.PutUvarint(buf[:], uint64(len(value)))
+	n := len(key) + x + len(value)
+
+	a := p.getArena()
+	i := len(a.kvs) - 1
+	c := a.kvs[i]
+	if p.kvLen+n > len(c) {
+		size := 2 * len(c)
+		if size < kvMinChunkLen {
+			size = kvMinChunkLen
+		}
+		if size < n {
+			size = n
+		}
+		c = make([]byte, size)
+		p.setArena(&arena{nodes: a.nodes, kvs: append(a.kvs, c)})
+		i++
+		p.kvLen = 0
+	}
+	o := p.kvLen
+	copy(c[o:], key)
+	copy(c[o+len(key):], buf[:x])
+	copy(c[o+len(key)+x:], value)
+	p.kvLen += n
+	return int64(i)<<32 | int64(o)
+}
+
+// Allocates a node from the arena; need alloc lock.
+func (p *DB) allocNode(h int) int {
+	n := nNext + h
+	if o := p.nodeLen & p.nodeMask; o+n > p.nodeMask+1 {
+		p.nodeLen += p.nodeMask + 1 - o
+	}
+	if a := p.getArena(); p.nodeLen>>p.nodeShift == len(a.nodes) {
+		p.setArena(&arena{nodes: append(a.nodes, make([]int64, p.nodeMask+1)), kvs: a.kvs})
+	}
+	node := p.nodeLen
+	p.nodeLen += n
+	return node
+}
+
+// Allocates a node of random height holding the given key/value, the node
+// isn't linked.
+func (p *DB) newNode(key, value []byte) (node, h int) {
+	p.allocMu.Lock()
+	h = p.randHeight()
+	kv := p.appendKV(key, value)
+	node = p.allocNode(h)
+	p.allocMu.Unlock()
+
+	c := p.getArena().nodes[node>>p.nodeShift]
+	o := node & p.nodeMask
+	c[o+nKV] = kv
+	c[o+nKey] = int64(len(key))
+	c[o+nHeight] = int64(h)
+	return
+}
+
+// Replaces the key/value record of the given node.
+func (p *DB) setValue(node int, key, value []byte) {
+	_, m := p.kv(node)
+	p.allocMu.Lock()
+	kv := p.appendKV(key, value)
+	p.allocMu.Unlock()
+	p.store(node, nKV, kv)
+	atomic.AddInt64(&p.kvSize, int64(len(value)-len(m)))
 }
 
+// Need alloc lock.
 func (p *DB) randHeight() (h int) {
 	const branching = 4
 	h = 1
@@ -210,13 +372,12 @@ func (p *DB) randHeight() (h int) {
 // Must hold RW-lock if prev == true, as it use shared prevNode slice.
 func (p *DB) findGE(key []byte, prev bool) (int, bool) {
 	node := 0
-	h := p.maxHeight - 1
+	h := int(atomic.LoadInt32(&p.maxHeight)) - 1
 	for {
-		next := p.nodeData[node+nNext+h]
+		next := p.load(node, nNext+h)
 		cmp := 1
 		if next != 0 {
-			o := p.nodeData[next]
-			cmp = p.cmp.Compare(p.kvData[o:o+p.nodeData[next+nKey]], key)
+			cmp = p.cmp.Compare(p.key(next), key)
 		}
 		if cmp < 0 {
 			// Keep searching in this list
@@ -235,13 +396,50 @@ func (p *DB) findGE(key []byte, prev bool) (int, bool) {
 	}
 }
 
+// Finds the nodes before and at or after the given key at each level.
+func (p *DB) findSplice(key []byte, prev, next *[tMaxHeight]int) {
+	node := 0
+	for h := int(atomic.LoadInt32(&p.maxHeight)) - 1; h >= 0; h-- {
+		prev[h], next[h] = p.findSpliceAt(key, node, h)
+		node = prev[h]
+	}
+}
+
+// Finds the nodes before and at or after the given key at the given level,
+// starting from the given node that is before the key.
+func (p *DB) findSpliceAt(key []byte, node, h int) (int, int) {
+	for {
+		next := p.load(node, nNext+h)
+		if next == 0 || p.cmp.Compare(p.key(next), key) >= 0 {
+			return node, next
+		}
+		node = next
+	}
+}
+
 func (p *DB) findLT(key []byte) int {
 	node := 0
-	h := p.maxHeight - 1
+	h := int(atomic.LoadInt32(&p.maxHeight)) - 1
+	for {
+		next := p.load(node, nNext+h)
+		if next == 0 || p.cmp.Compare(p.key(next), key) >= 0 {
+			if h == 0 {
+				break
+			}
+			h--
+		} else {
+			node = next
+		}
+	}
+	return node
+}
+
+func (p *DB) findLE(key []byte) int {
+	node := 0
+	h := int(atomic.LoadInt32(&p.maxHeight)) - 1
 	for {
-		next := p.nodeData[node+nNext+h]
-		o := p.nodeData[next]
-		if next == 0 || p.cmp.Compare(p.kvData[o:o+p.nodeData[next+nKey]], key) >= 0 {
+		next := p.load(node, nNext+h)
+		if next == 0 || p.cmp.Compare(p.key(next), key) > 0 {
 			if h == 0 {
 				break
 			}
@@ -255,9 +453,9 @@ func (p *DB) findLT(key []byte) int {
 
 func (p *DB) findLast() int {
 	node := 0
-	h := p.maxHeight - 1
+	h := int(atomic.LoadInt32(&p.maxHeight)) - 1
 	for {
-		next := p.nodeData[node+nNext+h]
+		next := p.load(node, nNext+h)
 		if next == 0 {
 			if h == 0 {
 				break
@@ -279,38 +477,67 @@ func (p *DB) Put(key []byte, value []byte) error {
 	defer p.mu.Unlock()
 
 	if node, exact := p.findGE(key, true); exact {
-		kvOffset := len(p.kvData)
-		p.kvData = append(p.kvData, key...)
-		p.kvData = append(p.kvData, value...)
-		p.nodeData[node] = kvOffset
-		m := p.nodeData[node+nVal]
-		p.nodeData[node+nVal] = len(value)
-		p.kvSize += len(value) - m
+		p.setValue(node, key, value)
 		return nil
 	}
 
-	h := p.randHeight()
-	if h > p.maxHeight {
-		for i := p.maxHeight; i < h; i++ {
+	node, h := p.newNode(key, value)
+	if h > int(p.maxHeight) {
+		for i := int(p.maxHeight); i < h; i++ {
 			p.prevNode[i] = 0
 		}
-		p.maxHeight = h
+		atomic.StoreInt32(&p.maxHeight, int32(h))
 	}
 
-	kvOffset := len(p.kvData)
-	p.kvData = append(p.kvData, key...)
-	p.kvData = append(p.kvData, value...)
-	// Node
-	node := len(p.nodeData)
-	p.nodeData = append(p.nodeData, kvOffset, len(key), len(value), h)
 	for i, n := range p.prevNode[:h] {
-		m := n + nNext + i
-		p.nodeData = append(p.nodeData, p.nodeData[m])
-		p.nodeData[m] = node
+		p.store(node, nNext+i, int64(p.load(n, nNext+i)))
+		p.store(n, nNext+i, int64(node))
+	}
+
+	atomic.AddInt64(&p.kvSize, int64(len(key)+len(value)))
+	atomic.AddInt64(&p.n, 1)
+	return nil
+}
+
+// PutConcurrent is like Put, but may be called concurrently with other
+// PutConcurrent calls, which then insert into the DB in parallel; the new
+// node is linked level by level with compare-and-swap, starting from the
+// bottom level. It is serialized with Put and Delete.
+//
+// It is safe to modify the contents of the arguments after PutConcurrent
+// returns.
+func (p *DB) PutConcurrent(key []byte, value []byte) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	node, h := p.newNode(key, value)
+	for {
+		maxHeight := atomic.LoadInt32(&p.maxHeight)
+		if int(maxHeight) >= h || atomic.CompareAndSwapInt32(&p.maxHeight, maxHeight, int32(h)) {
+			break
+		}
+	}
+
+	var prev, next [tMaxHeight]int
+	p.findSplice(key, &prev, &next)
+	for i := 0; i < h; i++ {
+		for {
+			if i == 0 && next[0] != 0 && p.cmp.Compare(p.key(next[0]), key) == 0 {
+				// Overwrite, the new node is left unlinked.
+				p.setValue(next[0], key, value)
+				return nil
+			}
+			p.store(node, nNext+i, int64(next[i]))
+			if p.cas(prev[i], nNext+i, next[i], node) {
+				break
+			}
+			// Lost the race, find the splice again from the node before.
+			prev[i], next[i] = p.findSpliceAt(key, prev[i], i)
+		}
 	}
 
-	p.kvSize += len(key) + len(value)
-	p.n++
+	atomic.AddInt64(&p.kvSize, int64(len(key)+len(value)))
+	atomic.AddInt64(&p.n, 1)
 	return nil
 }
 
@@ -327,14 +554,14 @@ func (p *DB) Delete(key []byte) error {
 		return ErrNotFound
 	}
 
-	h := p.nodeData[node+nHeight]
+	h := p.load(node, nHeight)
 	for i, n := range p.prevNode[:h] {
-		m := n + 4 + i
-		p.nodeData[m] = p.nodeData[p.nodeData[m]+nNext+i]
+		p.store(n, nNext+i, int64(p.load(node, nNext+i)))
 	}
 
-	p.kvSize -= p.nodeData[node+nKey] + p.nodeData[node+nVal]
-	p.n--
+	key, value := p.kv(node)
+	atomic.AddInt64(&p.kvSize, -int64(len(key)+len(value)))
+	atomic.AddInt64(&p.n, -1)
 	return nil
 }
 
@@ -342,9 +569,7 @@ func (p *DB) Delete(key []byte) error {
 //
 // It is safe to modify the contents of the arguments after Contains returns.
 func (p *DB) Contains(key []byte) bool {
-	p.mu.RLock()
 	_, exact := p.findGE(key, false)
-	p.mu.RUnlock()
 	return exact
 }
 
@@ -354,14 +579,11 @@ func (p *DB) Contains(key []byte) bool {
 // The caller should not modify the contents of the returned slice, but
 // it is safe to modify the contents of the argument after Get returns.
 func (p *DB) Get(key []byte) (value []byte, err error) {
-	p.mu.RLock()
 	if node, exact := p.findGE(key, false); exact {
-		o := p.nodeData[node] + p.nodeData[node+nKey]
-		value = p.kvData[o : o+p.nodeData[node+nVal]]
+		_, value = p.kv(node)
 	} else {
 		err = ErrNotFound
 	}
-	p.mu.RUnlock()
 	return
 }
 
@@ -372,16 +594,11 @@ func (p *DB) Get(key []byte) (value []byte, err error) {
 // The caller should not modify the contents of the returned slice, but
 // it is safe to modify the contents of the argument after Find returns.
 func (p *DB) Find(key []byte) (rkey, value []byte, err error) {
-	p.mu.RLock()
 	if node, _ := p.findGE(key, false); node != 0 {
-		n := p.nodeData[node]
-		m := n + p.nodeData[node+nKey]
-		rkey = p.kvData[n:m]
-		value = p.kvData[m : m+p.nodeData[node+nVal]]
+		rkey, value = p.kv(node)
 	} else {
 		err = ErrNotFound
 	}
-	p.mu.RUnlock()
 	return
 }
 
@@ -408,7 +625,11 @@ func (p *DB) NewIterator(slice *util.Range) iterator.Iterator {
 func (p *DB) Capacity() int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return cap(p.kvData)
+	n := 0
+	for _, c := range p.getArena().kvs {
+		n += len(c)
+	}
+	return n
 }
 
 // Size returns sum of keys and values length. Note that deleted
@@ -417,38 +638,44 @@ func (p *DB) Capacity() int {
 func (p *DB) Size() int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return p.kvSize
+	return int(atomic.LoadInt64(&p.kvSize))
 }
 
 // Free returns keys/values free buffer before need to grow.
 func (p *DB) Free() int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return cap(p.kvData) - len(p.kvData)
+	p.allocMu.Lock()
+	defer p.allocMu.Unlock()
+	kvs := p.getArena().kvs
+	return len(kvs[len(kvs)-1]) - p.kvLen
 }
 
 // Len returns the number of entries in the DB.
 func (p *DB) Len() int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return p.n
+	return int(atomic.LoadInt64(&p.n))
 }
 
 // Reset resets the DB to initial empty state. Allows reuse the buffer.
+//
+// Reset must not be called concurrently with reads or iterators.
 func (p *DB) Reset() {
 	p.mu.Lock()
+	a := p.getArena()
+	p.setArena(&arena{nodes: a.nodes, kvs: a.kvs[len(a.kvs)-1:]})
 	p.rnd = rand.New(rand.NewSource(0xdeadbeef))
-	p.maxHeight = 1
-	p.n = 0
-	p.kvSize = 0
-	p.kvData = p.kvData[:0]
-	p.nodeData = p.nodeData[:nNext+tMaxHeight]
-	p.nodeData[nKV] = 0
-	p.nodeData[nKey] = 0
-	p.nodeData[nVal] = 0
-	p.nodeData[nHeight] = tMaxHeight
+	atomic.StoreInt32(&p.maxHeight, 1)
+	p.nodeLen = nNext + tMaxHeight
+	p.kvLen = 0
+	atomic.StoreInt64(&p.n, 0)
+	atomic.StoreInt64(&p.kvSize, 0)
+	p.store(0, nKV, 0)
+	p.store(0, nKey, 0)
+	p.store(0, nHeight, tMaxHeight)
 	for n := 0; n < tMaxHeight; n++ {
-		p.nodeData[nNext+n] = 0
+		p.store(0, nNext+n, 0)
 		p.prevNode[n] = 0
 	}
 	p.mu.Unlock()
@@ -461,15 +688,24 @@ func (p *DB) Reset() {
 // This DB is append-only, deleting an entry would remove entry node but not
 // reclaim KV buffer.
 //
+// Nodes and key/values are allocated from arenas sized by the capacity, so
+// filling the DB only takes a few large allocations, and Reset retains them.
+//
 // The returned DB instance is safe for concurrent use.
 func New(cmp comparer.BasicComparer, capacity int) *DB {
+	shift := nodeChunkShift(capacity)
 	p := &DB{
 		cmp:       cmp,
 		rnd:       rand.New(rand.NewSource(0xdeadbeef)),
 		maxHeight: 1,
-		kvData:    make([]byte, 0, capacity),
-		nodeData:  make([]int, 4+tMaxHeight),
+		nodeShift: shift,
+		nodeMask:  1<<shift - 1,
+		nodeLen:   nNext + tMaxHeight,
 	}
-	p.nodeData[nHeight] = tMaxHeight
+	p.setArena(&arena{
+		nodes: [][]int64{make([]int64, 1<<shift)},
+		kvs:   [][]byte{make([]byte, capacity)},
+	})
+	p.store(0, nHeight, tMaxHeight)
 	return p
 }
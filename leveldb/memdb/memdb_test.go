@@ -7,6 +7,11 @@
 package memdb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
@@ -17,30 +22,20 @@ import (
 )
 
 func (p *DB) TestFindLT(key []byte) (rkey, value []byte, err error) {
-	p.mu.RLock()
 	if node := p.findLT(key); node != 0 {
-		n := p.nodeData[node]
-		m := n + p.nodeData[node+nKey]
-		rkey = p.kvData[n:m]
-		value = p.kvData[m : m+p.nodeData[node+nVal]]
+		rkey, value = p.kv(node)
 	} else {
 		err = ErrNotFound
 	}
-	p.mu.RUnlock()
 	return
 }
 
 func (p *DB) TestFindLast() (rkey, value []byte, err error) {
-	p.mu.RLock()
 	if node := p.findLast(); node != 0 {
-		n := p.nodeData[node]
-		m := n + p.nodeData[node+nKey]
-		rkey = p.kvData[n:m]
-		value = p.kvData[m : m+p.nodeData[node+nVal]]
+		rkey, value = p.kv(node)
 	} else {
 		err = ErrNotFound
 	}
-	p.mu.RUnlock()
 	return
 }
 
@@ -89,6 +84,136 @@ var _ = testutil.Defer(func() {
 			})
 		})
 
+		Describe("arena test", func() {
+			It("should allocate from arena sized by capacity", func() {
+				const capacity = 1 << 20
+				db := New(comparer.DefaultComparer, capacity)
+				fill := func() {
+					key := make([]byte, 16)
+					value := bytes.Repeat([]byte{'v'}, 100)
+					for i := 0; db.Free() > len(key)+len(value)+binary.MaxVarintLen64; i++ {
+						binary.BigEndian.PutUint64(key, uint64(i))
+						Expect(db.Put(key, value)).ShouldNot(HaveOccurred())
+					}
+				}
+
+				fill()
+				a := db.getArena()
+				Expect(a.nodes).Should(HaveLen(1))
+				Expect(a.kvs).Should(HaveLen(1))
+				Expect(db.Capacity()).Should(Equal(capacity))
+
+				// Reset should retain the arena.
+				db.Reset()
+				Expect(db.Len()).Should(Equal(0))
+				fill()
+				b := db.getArena()
+				Expect(b.nodes).Should(HaveLen(1))
+				Expect(&b.nodes[0][0]).Should(BeIdenticalTo(&a.nodes[0][0]))
+				Expect(&b.kvs[0][0]).Should(BeIdenticalTo(&a.kvs[0][0]))
+			})
+		})
+
+		Describe("concurrent read test", func() {
+			It("should read consistently while writing", func() {
+				const n, readers = 3000, 4
+				db := New(comparer.DefaultComparer, 0)
+				keys := testutil.KeyValue_Generate(nil, n, 1, 1, 30, 5, 5)
+				var (
+					wg      sync.WaitGroup
+					written int32
+				)
+				for i := 0; i < readers; i++ {
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+						for atomic.LoadInt32(&written) < n {
+							// Values are prefixed with their keys.
+							iter := db.NewIterator(nil)
+							var prev []byte
+							for iter.Next() {
+								key, value := iter.Key(), iter.Value()
+								if prev != nil {
+									Expect(bytes.Compare(prev, key)).Should(BeNumerically("<", 0))
+								}
+								Expect(bytes.HasPrefix(value, key)).Should(BeTrue(), "Value for key %q", key)
+								prev = append(prev[:0], key...)
+							}
+							iter.Release()
+
+							for j := int(atomic.LoadInt32(&written)) - 1; j >= 0; j -= 7 {
+								key, _ := keys.Index(j)
+								value, err := db.Get(key)
+								Expect(err).ShouldNot(HaveOccurred(), "Get key %q", key)
+								Expect(bytes.HasPrefix(value, key)).Should(BeTrue(), "Value for key %q", key)
+								rkey, _, err := db.Find(key)
+								Expect(err).ShouldNot(HaveOccurred(), "Find key %q", key)
+								Expect(rkey).Should(Equal(key))
+							}
+						}
+					}()
+				}
+				for i := 0; i < n; i++ {
+					key, _ := keys.Index(i)
+					db.Put(key, append(append([]byte{}, key...), 'x'))
+					if i > 0 {
+						// Overwrite a preceding key.
+						key, _ = keys.Index(i / 2)
+						db.Put(key, append(append([]byte{}, key...), bytes.Repeat([]byte{'y'}, i%16)...))
+					}
+					atomic.StoreInt32(&written, int32(i+1))
+				}
+				wg.Wait()
+				Expect(db.Len()).Should(Equal(n))
+			})
+		})
+
+		Describe("concurrent write test", func() {
+			It("should insert concurrently", func() {
+				const n, writers = 3000, 4
+				db := New(comparer.DefaultComparer, 0)
+				keys := testutil.KeyValue_Generate(nil, n, 1, 1, 30, 5, 5)
+				var wg sync.WaitGroup
+				for i := 0; i < writers; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+						for j := i; j < n; j += writers {
+							key, value := keys.Index(j)
+							Expect(db.PutConcurrent(key, value)).ShouldNot(HaveOccurred())
+						}
+						// Overwrite keys inserted by other writers.
+						for j := (i + 1) % writers; j < n; j += 5 * writers {
+							key, _ := keys.Index(j)
+							Expect(db.PutConcurrent(key, append(append([]byte{}, key...), 'x'))).ShouldNot(HaveOccurred())
+						}
+					}(i)
+				}
+				// Serialized with the concurrent inserts.
+				for j := 0; j < n; j += 3 * writers {
+					key, _ := keys.Index(j)
+					db.Put(key, append(append([]byte{}, key...), 'x'))
+				}
+				wg.Wait()
+
+				Expect(db.Len()).Should(Equal(n))
+				iter := db.NewIterator(nil)
+				size := 0
+				for j := 0; iter.Next(); j++ {
+					key, value := keys.Index(j)
+					Expect(iter.Key()).Should(Equal(key))
+					if !bytes.Equal(iter.Value(), value) {
+						Expect(iter.Value()).Should(Equal(append(append([]byte{}, key...), 'x')))
+					}
+					size += len(iter.Key()) + len(iter.Value())
+				}
+				iter.Release()
+				Expect(db.Size()).Should(Equal(size))
+			})
+		})
+
 		Describe("read test", func() {
 			testutil.AllKeyValueTesting(nil, func(kv testutil.KeyValue) testutil.DB {
 				// Building the DB.
@@ -8,7 +8,10 @@
 package opt
 
 import (
+	"context"
+	"fmt"
 	"math"
+	"time"
 
 	"github.com/FactomProject/goleveldb/leveldb/cache"
 	"github.com/FactomProject/goleveldb/leveldb/comparer"
@@ -28,6 +31,7 @@ var (
 	DefaultBlockSize                     = 4 * KiB
 	DefaultCompactionExpandLimitFactor   = 25
 	DefaultCompactionGPOverlapsFactor    = 10
+	DefaultCompactionGarbageRatio        = 0.5
 	DefaultCompactionL0Trigger           = 4
 	DefaultCompactionSourceLimitFactor   = 1
 	DefaultCompactionTableSize           = 2 * MiB
@@ -35,12 +39,17 @@ var (
 	DefaultCompactionTotalSize           = 10 * MiB
 	DefaultCompactionTotalSizeMultiplier = 10.0
 	DefaultCompressionType               = SnappyCompression
+	DefaultIndexBlockRestartInterval     = 1
 	DefaultIteratorSamplingRate          = 1 * MiB
+	DefaultJournalBlockSize              = 32 * KiB
+	DefaultMaxManifestFileSize           = 64 * MiB
 	DefaultOpenFilesCacher               = LRUCacher
 	DefaultOpenFilesCacheCapacity        = 500
+	DefaultValueLogGCRatio               = 0.5
 	DefaultWriteBuffer                   = 4 * MiB
 	DefaultWriteL0PauseTrigger           = 12
 	DefaultWriteL0SlowdownTrigger        = 8
+	DefaultWriteMergeLimit               = 128 * KiB
 )
 
 // Cacher is a caching algorithm.
@@ -61,14 +70,51 @@ func (f *CacherFunc) New(capacity int) cache.Cacher {
 
 func noCacher(int) cache.Cacher { return nil }
 
+func newShardedLRU(capacity int) cache.Cacher { return cache.NewShardedLRU(capacity, 0) }
+
 var (
 	// LRUCacher is the LRU-cache algorithm.
 	LRUCacher = &CacherFunc{cache.NewLRU}
 
+	// ShardedLRUCacher is the LRU-cache algorithm split into
+	// cache.DefaultLRUShards shards, which reduces lock contention under
+	// highly concurrent reads. See cache.NewShardedLRU.
+	ShardedLRUCacher = &CacherFunc{newShardedLRU}
+
+	// S3FIFOCacher is the S3-FIFO cache algorithm, which unlike LRU-cache
+	// is scan resistant. See cache.NewS3FIFO.
+	S3FIFOCacher = &CacherFunc{cache.NewS3FIFO}
+
 	// NoCacher is the value to disable caching algorithm.
 	NoCacher = &CacherFunc{}
 )
 
+// Checksum is the checksum algorithm of the 'sorted table' blocks and
+// the journal chunks. The algorithm is recorded in each table and journal
+// chunk, so they're read whatever the algorithm used to write them.
+type Checksum uint
+
+func (c Checksum) String() string {
+	switch c {
+	case CRC32CChecksum:
+		return "crc32c"
+	case XXHash64Checksum:
+		return "xxhash64"
+	}
+	return "invalid"
+}
+
+const (
+	// CRC32CChecksum is the CRC-32 computed using Castagnoli's polynomial,
+	// which is hardware accelerated where supported, e.g. by SSE 4.2.
+	CRC32CChecksum Checksum = iota
+	// XXHash64Checksum is the lower 32 bits of the 64-bit xxHash, which is
+	// faster than CRC32CChecksum without hardware acceleration. Tables and
+	// journals written with it can't be read by older versions.
+	XXHash64Checksum
+	nChecksum
+)
+
 // Compression is the 'sorted table' block compression algorithm to use.
 type Compression uint
 
@@ -80,17 +126,172 @@ func (c Compression) String() string {
 		return "none"
 	case SnappyCompression:
 		return "snappy"
+	case ZstdCompression:
+		return "zstd"
+	case LZ4Compression:
+		return "lz4"
+	}
+	if c.IsUser() {
+		return fmt.Sprintf("user(%d)", c-userCompression)
 	}
 	return "invalid"
 }
 
+// IsUser returns whether c is a user-defined compression, see
+// UserCompression.
+func (c Compression) IsUser() bool {
+	return c >= userCompression && c <= userCompression+MaxUserCompressionID
+}
+
+// Writable returns whether tables can be written using c, that is
+// NoCompression, SnappyCompression or a user-defined compression.
+func (c Compression) Writable() bool {
+	return c == NoCompression || c == SnappyCompression || c.IsUser()
+}
+
 const (
 	DefaultCompression Compression = iota
 	NoCompression
 	SnappyCompression
+	// ZstdCompression and LZ4Compression only identify the zstd and lz4
+	// decompressors used to read RocksDB tables, see table.RocksDBReader;
+	// an implementation must be provided using Options.Compressors. They
+	// can't be used to write tables, opening a DB configured to write with
+	// them fails. To write zstd or lz4 blocks, register the codec under a
+	// user-defined compression and select it, e.g.:
+	//
+	//	zstd := opt.UserCompression(1)
+	//	o := &opt.Options{
+	//		Compression: zstd,
+	//		Compressors: map[opt.Compression]opt.Compressor{zstd: zstdCodec},
+	//	}
+	//
+	// Where zstdCodec implements Compressor. The same registration is
+	// needed to read the tables back.
+	ZstdCompression
+	LZ4Compression
 	nCompression
+
+	userCompression Compression = 0x80
+)
+
+// MaxUserCompressionID is the maximum ID of a user-defined compression.
+const MaxUserCompressionID = 0x7e
+
+// UserCompression returns the user-defined compression of the given ID,
+// from 0 to MaxUserCompressionID, or an invalid compression if the ID is
+// out of range. Its implementation must be provided using
+// Options.Compressors, both for writing and reading tables.
+//
+// The blocks are tagged by the block type 0x80 plus the ID, which no
+// other implementation of the format assigns, so the tables can only be
+// read given the same compressor registered under the same ID.
+func UserCompression(id int) Compression {
+	if id < 0 || id > MaxUserCompressionID {
+		return Compression(0xff)
+	}
+	return userCompression + Compression(id)
+}
+
+// Compressor is the block compression algorithm implementation.
+// An implementation must be safe for concurrent use.
+type Compressor interface {
+	// Encode appends the compressed src to dst and returns the resulting
+	// slice.
+	Encode(dst, src []byte) ([]byte, error)
+
+	// Decode returns the decompressed src. It may use dst storage if it
+	// is large enough, dst may be nil.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+// CompactionFilterDecision is the decision of a CompactionFilter.
+type CompactionFilterDecision int
+
+const (
+	// CompactionFilterKeep keeps the entry as is.
+	CompactionFilterKeep CompactionFilterDecision = iota
+
+	// CompactionFilterRemove removes the entry, as if it was deleted.
+	CompactionFilterRemove
+
+	// CompactionFilterChange replaces value of the entry.
+	CompactionFilterChange
+)
+
+// CompactionFilter allows inspecting key/value entries during table
+// compaction, and to remove or modify them.
+//
+// Only the latest entry of a key that is older than all live snapshots is
+// passed to the filter, so snapshots always read consistent data. Range
+// tombstones and deletion markers are not passed to the filter.
+type CompactionFilter interface {
+	// Name returns name of the compaction filter.
+	Name() string
+
+	// Filter decides what to do with the given entry. Level is the level
+	// the compaction writes into. The new value is only used when the
+	// decision is CompactionFilterChange.
+	//
+	// The filter is called from the compaction goroutine and may be called
+	// more than once for the same entry, if the compaction is retried.
+	// Contents of key and value should not by any means modified, and
+	// should not be retained after Filter returns.
+	Filter(level int, key, value []byte) (decision CompactionFilterDecision, newValue []byte)
+}
+
+// CompactionPriority defines how table compaction picks the 'sorted table'
+// to compact, see Options.CompactionPriority.
+type CompactionPriority int
+
+const (
+	// CompactionPriorityRoundRobin picks the tables of a level in turn,
+	// once the level exceeds its size limit.
+	CompactionPriorityRoundRobin CompactionPriority = iota
+
+	// CompactionPriorityGarbage picks the table of a level with the
+	// highest ratio of deletion markers and overwritten entries, once the
+	// level exceeds its size limit. A table whose ratio reaches
+	// Options.CompactionGarbageRatio is compacted even if no level exceeds
+	// its size limit. The ratio of a table is recorded in its properties,
+	// it is only known once the table is written or opened.
+	CompactionPriorityGarbage
+)
+
+// CorruptionPolicy defines how table compaction handles corrupted input
+// 'sorted table', see Options.CorruptionPolicy.
+type CorruptionPolicy int
+
+const (
+	// CorruptionDrop skips corrupted blocks of the input tables, entries of
+	// the corrupted blocks are lost once the compaction is committed.
+	CorruptionDrop CorruptionPolicy = iota
+
+	// CorruptionQuarantine aborts the compaction and excludes the corrupted
+	// input table from the DB. The table file is kept as is, so its entries
+	// can be salvaged by leveldb.Repair.
+	CorruptionQuarantine
 )
 
+// TablePropertiesCollector collects user properties of a table while the
+// table is being built. The properties are stored in the table properties
+// block, see table.Properties. A new collector is created for each table.
+//
+// When used by DB, the key passed to Add is the user key. Deletion markers
+// and range tombstones are not passed to the collector, and values stored
+// in the value log are passed as nil.
+type TablePropertiesCollector interface {
+	// Add is called for each key/value pair appended to the table, in
+	// key order. Contents of key and value should not by any means
+	// modified, and should not be retained after Add returns.
+	Add(key, value []byte)
+
+	// Finish returns the collected properties. It is called once the
+	// table is finished. Property names prefixed with "leveldb." are
+	// reserved and ignored.
+	Finish() map[string][]byte
+}
+
 // Strict is the DB 'strict level'.
 type Strict uint
 
@@ -106,6 +307,7 @@ const (
 	// If present then a corrupted or invalid chunk or block in journal
 	// will cause an error instead of being dropped.
 	// This will prevent database with corrupted journal to be opened.
+	// Ignored by the journal recovery if Options.WALRecoveryMode is set.
 	StrictJournal
 
 	// If present then 'sorted table' block checksum will be verified.
@@ -122,12 +324,22 @@ const (
 	// If present then leveldb.Recover will drop corrupted 'sorted table'.
 	StrictRecovery
 
+	// If present then checksum of every 'sorted table' block and journal
+	// chunk read will be verified, implies StrictBlockChecksum and
+	// StrictJournalChecksum. When present in ReadOptions, blocks read by
+	// the 'read operation' are verified even if StrictBlockChecksum is
+	// disabled, bypassing block cache that may hold unverified blocks.
+	// Corruption is reported as *errors.ErrCorrupted, which holds the
+	// file and the offset and size of the corrupted block. The order of
+	// the keys written to 'sorted table' is verified as well.
+	StrictParanoidChecks
+
 	// This only applicable for ReadOptions, if present then this ReadOptions
 	// 'strict level' will override global ones.
 	StrictOverride
 
 	// StrictAll enables all strict flags.
-	StrictAll = StrictManifest | StrictJournalChecksum | StrictJournal | StrictBlockChecksum | StrictCompaction | StrictReader | StrictRecovery
+	StrictAll = StrictManifest | StrictJournalChecksum | StrictJournal | StrictBlockChecksum | StrictCompaction | StrictReader | StrictRecovery | StrictParanoidChecks
 
 	// DefaultStrict is the default strict flags. Specify any strict flags
 	// will override default strict flags as whole (i.e. not OR'ed).
@@ -137,6 +349,353 @@ const (
 	NoStrict = ^StrictAll
 )
 
+// WALRecoveryMode defines how the journal recovery handles corrupted
+// journal records, see Options.WALRecoveryMode.
+type WALRecoveryMode int
+
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case WALRecoveryDefault:
+		return "default"
+	case WALTolerateCorruptedTailRecords:
+		return "tolerate-corrupted-tail-records"
+	case WALAbsoluteConsistency:
+		return "absolute-consistency"
+	case WALPointInTimeRecovery:
+		return "point-in-time-recovery"
+	case WALSkipAnyCorruptedRecords:
+		return "skip-any-corrupted-records"
+	}
+	return "invalid"
+}
+
+const (
+	// WALRecoveryDefault means the recovery mode is derived from the strict
+	// level: WALAbsoluteConsistency if StrictJournal is set, otherwise
+	// WALSkipAnyCorruptedRecords.
+	WALRecoveryDefault WALRecoveryMode = iota
+
+	// WALTolerateCorruptedTailRecords drops corrupted or truncated records
+	// at the tail of a journal, as left by a crash during a journal write.
+	// A corrupted record followed by valid records fails the recovery.
+	WALTolerateCorruptedTailRecords
+
+	// WALAbsoluteConsistency fails the recovery on any corrupted or
+	// truncated record, including at the tail of a journal.
+	WALAbsoluteConsistency
+
+	// WALPointInTimeRecovery stops the recovery at the first corrupted or
+	// truncated record; records after it, including these of the following
+	// journals, are dropped. The DB is recovered to a consistent point in
+	// time, at the cost of the writes after the corruption.
+	WALPointInTimeRecovery
+
+	// WALSkipAnyCorruptedRecords skips corrupted or truncated records and
+	// recovers all valid records, the DB may miss writes in between.
+	WALSkipAnyCorruptedRecords
+)
+
+// CompactionInfo describes a table compaction.
+type CompactionInfo struct {
+	// SourceLevel is the level being compacted into SourceLevel+1, or
+	// into itself if IntraL0 is true.
+	SourceLevel int
+
+	// IntraL0 is true if the compaction merges level-0 tables into
+	// level-0, see Options.CompactionL0IntraTrigger.
+	IntraL0 bool
+
+	// Trivial is true if the compaction only moves a table to the next
+	// level without rewriting it.
+	Trivial bool
+
+	// Subcompactions is the number of key ranges the compaction is split
+	// into, see Options.MaxSubcompactions. It is zero if the compaction is
+	// not split.
+	Subcompactions int
+
+	// InputTables and InputSize describe the compacted tables of both
+	// levels.
+	InputTables int
+	InputSize   int64
+
+	// OutputTables and OutputSize describe the created tables. Only set
+	// once the compaction ends.
+	OutputTables int
+	OutputSize   int64
+
+	// Duration is the time spent by the compaction. Only set once the
+	// compaction ends.
+	Duration time.Duration
+}
+
+// CompactionDebtInfo describes a change of the estimated compaction debt,
+// see Options.CompactionDebtThresholds.
+type CompactionDebtInfo struct {
+	// Bytes and Tables are the size and number of the tables pending
+	// compaction, see DB.CompactionPending.
+	Bytes  int64
+	Tables int
+
+	// Thresholds is the number of Options.CompactionDebtThresholds the
+	// debt reaches.
+	Thresholds int
+}
+
+// MemFlushInfo describes a flush of a 'memdb' into a 'sorted table'.
+type MemFlushInfo struct {
+	Level    int
+	Entries  int
+	Size     int64
+	Duration time.Duration
+}
+
+// TableInfo describes a newly created 'sorted table'.
+type TableInfo struct {
+	Level int
+	Num   int64
+	Size  int64
+}
+
+// WriteStallCondition is the write stall condition.
+type WriteStallCondition uint
+
+func (c WriteStallCondition) String() string {
+	switch c {
+	case WriteStallNormal:
+		return "normal"
+	case WriteStallSlowdown:
+		return "slowdown"
+	case WriteStallPause:
+		return "pause"
+	}
+	return "invalid"
+}
+
+const (
+	// WriteStallNormal means writes are not delayed.
+	WriteStallNormal WriteStallCondition = iota
+
+	// WriteStallSlowdown means writes are delayed because number of level-0
+	// tables reached WriteL0SlowdownTrigger, or as decided by the
+	// WriteStallPolicy.
+	WriteStallSlowdown
+
+	// WriteStallPause means writes are paused until level-0 compaction is
+	// done because number of level-0 tables reached WriteL0PauseTrigger, or
+	// as decided by the WriteStallPolicy.
+	WriteStallPause
+)
+
+// WriteStallPolicy decides write backpressure from the number of level-0
+// tables.
+type WriteStallPolicy interface {
+	// WriteStall returns the write stall condition for the given number of
+	// level-0 tables, and how long a write should be delayed once when the
+	// condition is not WriteStallNormal. A write under WriteStallPause
+	// condition is paused only if the 'memdb' is full.
+	WriteStall(level0Tables int) (cond WriteStallCondition, delay time.Duration)
+}
+
+// TriggerWriteStallPolicy is a WriteStallPolicy that slowdown and pause
+// writes when number of level-0 tables reached the given triggers. This is
+// the default policy.
+type TriggerWriteStallPolicy struct {
+	SlowdownTrigger int
+	PauseTrigger    int
+
+	// Delay is the time a write is delayed on slowdown. Zero value
+	// means 1 millisecond.
+	Delay time.Duration
+}
+
+func (p *TriggerWriteStallPolicy) WriteStall(level0Tables int) (WriteStallCondition, time.Duration) {
+	delay := p.Delay
+	if delay == 0 {
+		delay = time.Millisecond
+	}
+	switch {
+	case level0Tables >= p.PauseTrigger:
+		return WriteStallPause, delay
+	case level0Tables >= p.SlowdownTrigger:
+		return WriteStallSlowdown, delay
+	}
+	return WriteStallNormal, 0
+}
+
+// WriteStallInfo describes a change of write stall condition.
+type WriteStallInfo struct {
+	Condition    WriteStallCondition
+	Level0Tables int
+
+	// Duration is the time the write has been delayed. Only set when the
+	// condition goes back to WriteStallNormal.
+	Duration time.Duration
+}
+
+// EventListener holds callbacks that are invoked on DB events. Any of the
+// callbacks may be nil.
+//
+// The callbacks are invoked synchronously from the compaction and write
+// goroutines, they should return quickly and must not call the DB.
+type EventListener struct {
+	// OnCompactionBegin is called before a table compaction starts.
+	OnCompactionBegin func(info CompactionInfo)
+
+	// OnCompactionEnd is called once a table compaction is committed.
+	OnCompactionEnd func(info CompactionInfo)
+
+	// OnCompactionDebt is called when the estimated compaction debt
+	// crosses any of Options.CompactionDebtThresholds, either way.
+	OnCompactionDebt func(info CompactionDebtInfo)
+
+	// OnMemFlush is called once a 'memdb' flush is committed.
+	OnMemFlush func(info MemFlushInfo)
+
+	// OnTableCreated is called for each committed 'sorted table' created
+	// by 'memdb' flush, table compaction, table ingestion or transaction.
+	OnTableCreated func(info TableInfo)
+
+	// OnWriteStall is called when write stall condition changes.
+	OnWriteStall func(info WriteStallInfo)
+
+	// OnCorruption is called when compaction hits a corruption error, the
+	// DB will then refuse writes.
+	OnCorruption func(err error)
+
+	// OnTableQuarantined is called once a corrupted 'sorted table' is
+	// excluded from the DB, see CorruptionQuarantine. The error is the
+	// corruption error hit by the compaction.
+	OnTableQuarantined func(info TableInfo, err error)
+}
+
+// LogLevel is the severity of a log message, see Logger.
+type LogLevel int
+
+const (
+	// LogDebug is for detailed events, such as each removed file.
+	LogDebug LogLevel = iota
+
+	// LogInfo is for the DB lifecycle and background work, such as
+	// compactions.
+	LogInfo
+
+	// LogWarn is for errors the DB recovers from, such as skipped
+	// corrupted records or retried compactions.
+	LogWarn
+
+	// LogError is for errors the DB doesn't recover from.
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// Logger receives the log messages of the DB, e.g. to route them into an
+// application logger, see Options.Logger.
+//
+// The message is a short description of the event prefixed with its
+// subsystem, such as "table@compaction committed". The details are given
+// as alternating key/value pairs, the keys are strings, e.g. "level", 1,
+// "table", 42. Log may be called concurrently.
+type Logger interface {
+	Log(level LogLevel, msg string, keyvals ...interface{})
+}
+
+type discardLogger struct{}
+
+func (discardLogger) Log(LogLevel, string, ...interface{}) {}
+
+// DiscardLogger is a Logger that discards all messages.
+var DiscardLogger Logger = discardLogger{}
+
+// TraceOp is the operation traced by a span, see Tracer.
+type TraceOp int
+
+const (
+	// TraceGet is a key lookup by Get, Has or GetMany; KeySize is set.
+	TraceGet TraceOp = iota
+
+	// TraceTableGet is a lookup of a 'sorted table' within a TraceGet
+	// span, including its index, filter and data block reads; KeySize,
+	// Level and TableNum are set.
+	TraceTableGet
+
+	// TraceJournalWrite is a journal write of a batch or of merged batches,
+	// including the journal sync if any; Size is the batch size.
+	TraceJournalWrite
+
+	// TraceMemFlush is a 'memdb' flush into 'sorted table'; Size is the
+	// 'memdb' size, Level is set at End to the level the tables are
+	// flushed to.
+	TraceMemFlush
+
+	// TraceCompactionBuild is the table building phase of a table
+	// compaction; Level is the source level, Size is the input size.
+	TraceCompactionBuild
+
+	// TraceCompactionCommit is the commit of a 'memdb' flush or of a table
+	// compaction into the manifest.
+	TraceCompactionCommit
+)
+
+func (op TraceOp) String() string {
+	switch op {
+	case TraceGet:
+		return "get"
+	case TraceTableGet:
+		return "table-get"
+	case TraceJournalWrite:
+		return "journal-write"
+	case TraceMemFlush:
+		return "memdb-flush"
+	case TraceCompactionBuild:
+		return "compaction-build"
+	case TraceCompactionCommit:
+		return "compaction-commit"
+	}
+	return fmt.Sprintf("TraceOp(%d)", int(op))
+}
+
+// TraceInfo describes a traced span, see TraceOp for the fields set by each
+// operation.
+type TraceInfo struct {
+	Op       TraceOp
+	KeySize  int
+	Level    int   // -1 if not set.
+	TableNum int64 // -1 if not set.
+	Size     int64
+}
+
+// Tracer receives the spans of the DB operations, e.g. to record them as
+// OpenTelemetry spans, see Options.Tracer.
+//
+// Start is called when the operation starts and returns the context of the
+// span, which is then given to End and is the parent context of the nested
+// spans. The parent context of Get spans is the one given to GetContext,
+// and of journal write spans the one given to WriteContext, otherwise it is
+// context.Background(). The error given to End is the error of the
+// operation, lookups of missing keys end with ErrNotFound. A compaction
+// phase that fails is retried, each attempt is its own span.
+//
+// Start and End are called synchronously and may be called concurrently,
+// they should return quickly and must not call the DB.
+type Tracer interface {
+	Start(ctx context.Context, info TraceInfo) context.Context
+	End(ctx context.Context, info TraceInfo, err error)
+}
+
 // Options holds the optional parameters for the DB at large.
 type Options struct {
 	// AltFilters defines one or more 'alternative filters'.
@@ -159,7 +718,8 @@ type Options struct {
 	BlockCacheCapacity int
 
 	// BlockRestartInterval is the number of keys between restart points for
-	// delta encoding of keys.
+	// delta encoding of keys of the 'sorted table' data blocks. See also
+	// IndexBlockRestartInterval.
 	//
 	// The default value is 16.
 	BlockRestartInterval int
@@ -170,12 +730,49 @@ type Options struct {
 	// The default value is 4KiB.
 	BlockSize int
 
+	// BreakStaleLock allows OpenFile to break the lock of the DB if its
+	// owner is verifiably dead, see storage.FileOptions.
+	//
+	// The default value is false.
+	BreakStaleLock bool
+
+	// Checksum defines the checksum algorithm of the 'sorted table' blocks
+	// and the journal chunks written. Existing tables and journals are read
+	// whatever their checksum algorithm.
+	//
+	// The default value is CRC32CChecksum.
+	Checksum Checksum
+
+	// CompactionDebtThresholds defines the estimated compaction debt, in
+	// bytes, at which EventListener.OnCompactionDebt is called, so writers
+	// may throttle themselves before writes are stalled. The thresholds
+	// must be in ascending order. See DB.CompactionPending.
+	//
+	// The default value is nil.
+	CompactionDebtThresholds []int64
+
+	// CompactionDropCache defines whether the table compactions advise the
+	// OS to drop the tables they read and write from the page cache, so
+	// that the compactions don't evict the pages serving the reads. The
+	// pages are dropped once a table is written and synced, and once the
+	// input tables are compacted. This is a no-op where the storage or the
+	// platform doesn't support it, see storage.CacheDropper.
+	//
+	// The default value is false.
+	CompactionDropCache bool
+
 	// CompactionExpandLimitFactor limits compaction size after expanded.
 	// This will be multiplied by table size limit at compaction target level.
 	//
 	// The default value is 25.
 	CompactionExpandLimitFactor int
 
+	// CompactionFilter defines a filter that is applied on entries during
+	// table compaction. See CompactionFilter.
+	//
+	// The default value is nil.
+	CompactionFilter CompactionFilter
+
 	// CompactionGPOverlapsFactor limits overlaps in grandparent (Level + 2) that a
 	// single 'sorted table' generates.
 	// This will be multiplied by table size limit at grandparent level.
@@ -183,12 +780,36 @@ type Options struct {
 	// The default value is 10.
 	CompactionGPOverlapsFactor int
 
+	// CompactionGarbageRatio defines the ratio of deletion markers and
+	// overwritten entries of a 'sorted table' that will trigger compaction
+	// of the table, if CompactionPriority is CompactionPriorityGarbage.
+	//
+	// The default value is 0.5.
+	CompactionGarbageRatio float64
+
+	// CompactionL0IntraTrigger defines number of 'sorted table' at level-0
+	// that will trigger an intra level-0 compaction, instead of a level-0
+	// compaction, while level-1 exceeds its total size limit. An intra
+	// level-0 compaction merges the newest level-0 tables, up to the
+	// compaction source limit of level-0, into a level-0 table, reducing
+	// the tables merged on every read without adding to level-1.
+	// Values less than 2 disable intra level-0 compaction.
+	//
+	// The default value is 0.
+	CompactionL0IntraTrigger int
+
 	// CompactionL0Trigger defines number of 'sorted table' at level-0 that will
 	// trigger compaction.
 	//
 	// The default value is 4.
 	CompactionL0Trigger int
 
+	// CompactionPriority defines how table compaction picks the 'sorted
+	// table' to compact. See CompactionPriority.
+	//
+	// The default value is CompactionPriorityRoundRobin.
+	CompactionPriority CompactionPriority
+
 	// CompactionSourceLimitFactor limits compaction source size. This doesn't apply to
 	// level-0.
 	// This will be multiplied by table size limit at compaction target level.
@@ -216,6 +837,15 @@ type Options struct {
 	// The default value is nil.
 	CompactionTableSizeMultiplierPerLevel []float64
 
+	// CompactionTableSizePerLevel defines per-level limit of the tables
+	// size, overriding the limit calculated from CompactionTableSize and
+	// its multipliers. The limits typically grow by level, so the deep
+	// levels aren't made of many small tables.
+	// Use zero to keep the calculated limit for a level.
+	//
+	// The default value is nil.
+	CompactionTableSizePerLevel []int
+
 	// CompactionTotalSize limits total size of 'sorted table' for each level.
 	// The limits for each level will be calculated as:
 	//   CompactionTotalSize * (CompactionTotalSizeMultiplier ^ Level)
@@ -237,6 +867,14 @@ type Options struct {
 	// The default value is nil.
 	CompactionTotalSizeMultiplierPerLevel []float64
 
+	// CompactionTotalSizePerLevel defines per-level total size limit,
+	// overriding the limit calculated from CompactionTotalSize and its
+	// multipliers.
+	// Use zero to keep the calculated limit for a level.
+	//
+	// The default value is nil.
+	CompactionTotalSizePerLevel []int64
+
 	// Comparer defines a total ordering over the space of []byte keys: a 'less
 	// than' relationship. The same comparison algorithm must be used for reads
 	// and writes over the lifetime of the DB.
@@ -244,12 +882,82 @@ type Options struct {
 	// The default value uses the same ordering as bytes.Compare.
 	Comparer comparer.Comparer
 
+	// ComparerUpgrade is called on open when the comparer name or version
+	// recorded in the DB differ from Comparer and ComparerVersion, with the
+	// recorded ones. Returning true upgrades the DB to the new comparer:
+	// the tables are rewritten under the new ordering, followed by a full
+	// compaction, and the new comparer is recorded. Otherwise the open
+	// fails with leveldb.ErrComparerMismatch.
+	//
+	// The upgrade fails if the DB holds range deletions, whose ranges
+	// can't be carried over to another ordering. It is never done in
+	// read-only mode.
+	//
+	// The default value is nil.
+	ComparerUpgrade func(name string, version uint64) bool
+
+	// ComparerVersion defines the version of the Comparer, recorded in the
+	// DB along with the comparer name. The version should be bumped
+	// whenever the comparer ordering changes without a name change; the
+	// DB then fails to open unless upgraded, see ComparerUpgrade.
+	//
+	// The default value is 0, which isn't recorded.
+	ComparerVersion uint64
+
+	// CompressedBlockCacheCapacity defines the capacity of the compressed
+	// 'sorted table' block caching. Compressed blocks read from the files
+	// are kept as is in this cache, in addition to the block caching which
+	// holds the blocks uncompressed. A block found in this cache only needs
+	// to be decompressed, which allows to hold far more of the working set
+	// in memory at the cost of CPU. Uncompressed blocks are never kept in
+	// this cache. The cache algorithm is the same as of the block caching.
+	//
+	// The default value is 0, which means the compressed block caching is
+	// disabled.
+	CompressedBlockCacheCapacity int
+
 	// Compression defines the 'sorted table' block compression to use.
+	// Opening the DB fails if the compression can't be used to write
+	// tables, see Compression.Writable.
 	//
 	// The default value (DefaultCompression) uses snappy compression.
 	Compression Compression
 
+	// CompressionPerLevel defines per-level 'sorted table' block
+	// compression. Use DefaultCompression to use Compression for a level.
+	// Opening the DB fails if a compression can't be used to write tables,
+	// see Compression.Writable. Tables created by 'memdb' flush, table ingestion and transaction are
+	// compressed as level-0 tables.
+	//
+	// The block compression is recorded per block, so the compression can
+	// be changed at any time.
+	//
+	// The default value is nil.
+	CompressionPerLevel []Compression
+
+	// Compressors provides block compression implementations that are not
+	// built-in, i.e. for user-defined compressions, see UserCompression,
+	// and ZstdCompression and LZ4Compression to read RocksDB tables. It
+	// is needed both for writing and reading such blocks.
+	//
+	// The default value is nil.
+	Compressors map[Compression]Compressor
+
+	// CorruptionPolicy defines how table compaction handles corrupted input
+	// 'sorted table' when StrictCompaction is not set. With CorruptionDrop
+	// the corrupted blocks are silently dropped. With CorruptionQuarantine
+	// the table is excluded from the DB, and reported via
+	// EventListener.OnTableQuarantined, while the DB keeps serving from
+	// other tables; operators then may run leveldb.Repair to salvage the
+	// table.
+	//
+	// The default value is CorruptionDrop.
+	CorruptionPolicy CorruptionPolicy
+
 	// DisableBufferPool allows disable use of util.BufferPool functionality.
+	// The buffer pool recycles the buffers of table block reads and journal
+	// reads, and may hold the value copies of Get, see
+	// ReadOptions.PoolValues.
 	//
 	// The default value is false.
 	DisableBufferPool bool
@@ -265,6 +973,15 @@ type Options struct {
 	// The default value is false.
 	DisableCompactionBackoff bool
 
+	// DisableIndexBlockDeltaEncoding allows writing the keys of the 'sorted
+	// table' index blocks whole, instead of delta encoded from the previous
+	// key. It only matters if IndexBlockRestartInterval is greater than 1,
+	// the index entries between restart points are then scanned without
+	// rebuilding their keys, at the cost of larger index blocks.
+	//
+	// The default value is false.
+	DisableIndexBlockDeltaEncoding bool
+
 	// DisableLargeBatchTransaction allows disabling switch-to-transaction mode
 	// on large batch write. If enable batch writes large than WriteBuffer will
 	// use transaction.
@@ -285,6 +1002,24 @@ type Options struct {
 	// The default value is false.
 	ErrorIfMissing bool
 
+	// EventListener defines callbacks for DB events.
+	//
+	// The default value is nil.
+	EventListener *EventListener
+
+	// FIFOCompactionTotalSize enables FIFO compaction, which suits log and
+	// cache data. With FIFO compaction 'sorted table' are never rewritten,
+	// 'memdb' are always flushed to level-0 and the oldest 'sorted table'
+	// are dropped once the total size of the 'sorted table' exceeds this
+	// value. Manual range compaction also only drops the oldest 'sorted
+	// table'.
+	//
+	// Since level-0 tables are never compacted, the write stall triggers
+	// only apply if WriteStallPolicy is set explicitly.
+	//
+	// The default value is 0, which means FIFO compaction is disabled.
+	FIFOCompactionTotalSize int64
+
 	// Filter defines an 'effective filter' to use. An 'effective filter'
 	// if defined will be used to generate per-table filter block.
 	// The filter name will be stored on disk.
@@ -300,6 +1035,35 @@ type Options struct {
 	// The default value is nil.
 	Filter filter.Filter
 
+	// FilterBitsPerKeyPerLevel defines per-level bits-per-key of the
+	// 'sorted table' bloom filter. It only applies if Filter is the builtin
+	// bloom filter, see filter.NewBloomFilter. This allows e.g. spending
+	// less memory on the filters of the last levels, which hold most of
+	// the keys. Levels beyond the slice or with zero value use Filter
+	// as is.
+	//
+	// The default value is nil.
+	FilterBitsPerKeyPerLevel []int
+
+	// FilterPartitionSize defines the target size of a filter partition.
+	// If greater than zero, the filter of a 'sorted table' is split into
+	// partitions of about this size plus an index over them, so a point
+	// lookup only needs to read and cache a single small partition instead
+	// of the whole filter block of the table.
+	//
+	// The default value is 0, which means the filter is not partitioned.
+	FilterPartitionSize int
+
+	// IndexBlockRestartInterval is the number of keys between restart points
+	// for delta encoding of keys of the 'sorted table' index blocks. Each
+	// restart point is found by binary search, the entries in between are
+	// scanned; a larger interval makes the index blocks smaller but seeks
+	// slower.
+	//
+	// The default value is 1, which means the index keys aren't delta
+	// encoded and every index entry is found by binary search.
+	IndexBlockRestartInterval int
+
 	// IteratorSamplingRate defines approximate gap (in bytes) between read
 	// sampling of an iterator. The samples will be used to determine when
 	// compaction should be triggered.
@@ -307,6 +1071,164 @@ type Options struct {
 	// The default is 1MiB.
 	IteratorSamplingRate int
 
+	// JournalArchive defines whether obsolete journals are archived instead
+	// of removed, once they are no longer retained, see
+	// JournalRetentionSize. The journals are archived if the storage
+	// implements storage.Archiver, the file-system backed storage moves
+	// them into its 'archive' directory; the archived journals are never
+	// removed by the DB, that is left to the archive consumers.
+	//
+	// The default value is false.
+	JournalArchive bool
+
+	// JournalBlockSize defines the block size of the journal, e.g. to align
+	// the journal blocks to the erase block of the storage. The journals
+	// must be read with the block size they were written with, thus the
+	// block size of an existing DB must not be changed. The block size is
+	// bounded to the 1KiB to 64KiB range. Doesn't apply to the manifest.
+	//
+	// The default value is 32KiB.
+	JournalBlockSize int
+
+	// JournalPreallocateSize defines the disk space preallocated for each
+	// new journal, which avoids fragmentation of the journal on file systems
+	// such as XFS. The file size isn't changed. This has effect only if the
+	// storage supports it, see storage.Preallocator.
+	//
+	// The default value is 0, which means no preallocation.
+	JournalPreallocateSize int
+
+	// JournalRecycle defines the number of obsolete journal files kept for
+	// reuse as new journals, instead of being removed once their memdb is
+	// flushed. A recycled journal file is overwritten in place, which saves
+	// the file creation and removal, and the file system metadata updates
+	// of extending the file. This has effect only if the storage implements
+	// storage.Recycler, and is disabled if journals are retained or
+	// archived, see JournalRetentionSize and JournalArchive.
+	//
+	// The default value is 0, which means journals aren't recycled.
+	JournalRecycle int
+
+	// JournalRetentionSize defines the total size of obsolete journals
+	// retained, so they remain readable by DB.GetUpdatesSince. A journal is
+	// obsolete once its memdb is flushed; the oldest retained journals are
+	// removed once the total size is exceeded.
+	//
+	// The default value is 0, which means no size limit if
+	// JournalRetentionTime is set, otherwise journals aren't retained.
+	JournalRetentionSize int
+
+	// JournalRetentionTime defines how long obsolete journals are retained
+	// after they became obsolete, see JournalRetentionSize. Journals
+	// retained across DB restart are aged from the DB open.
+	//
+	// The default value is 0, which means no time limit if
+	// JournalRetentionSize is set, otherwise journals aren't retained.
+	JournalRetentionTime time.Duration
+
+	// JournalSyncInterval defines the interval at which the journal is
+	// synced in the background, which bounds the window of writes that may
+	// be lost on machine crash for writes without WriteOptions.Sync.
+	// The journal is only synced if there were unsynced writes. This has
+	// no effect if NoSync is true.
+	//
+	// The default value is 0, which means no periodic sync.
+	JournalSyncInterval time.Duration
+
+	// Logger defines the logger of the DB. If nil, the messages are
+	// written to the log of the storage, i.e. the LOG file of a file
+	// storage. Use DiscardLogger to silence them.
+	//
+	// The default value is nil.
+	Logger Logger
+
+	// LevelDBCompatible restricts the files written by the DB to the formats
+	// of the C++ LevelDB library, so the DB can be opened by it. Opening the
+	// DB fails if the options select a format the C++ library can't read,
+	// that is a Checksum other than CRC32CChecksum, a JournalBlockSize other
+	// than the default, a user-defined Compression, JournalRecycle,
+	// ValueLogThreshold or CorruptionQuarantine. Range deletions and named
+	// snapshots are rejected. The DB still reads the files of any format.
+	//
+	// The default value is false.
+	LevelDBCompatible bool
+
+	// MaxBatchLen defines the maximum number of records of a written batch.
+	// Writes of larger batches fail with leveldb.ErrBatchTooLarge.
+	//
+	// The default value is 0, which means no limit.
+	MaxBatchLen int
+
+	// MaxBatchSize defines the maximum size in bytes of the data of a
+	// written batch, see leveldb.Batch.Dump. Writes of larger batches fail
+	// with leveldb.ErrBatchTooLarge.
+	//
+	// The default value is 0, which means no limit.
+	MaxBatchSize int
+
+	// MaxManifestFileSize defines the size of the manifest file at which a
+	// new manifest file is written, holding a snapshot of the current
+	// state; the old manifest file is then removed. Otherwise the manifest
+	// file grows with each table compaction and memdb flush until the DB
+	// is reopened, and so does the time it takes to open the DB. The new
+	// manifest file isn't written while the manifest file is less than
+	// twice the size of its snapshot.
+	//
+	// The default value is 64MiB. Use -1 to never write a new manifest
+	// file while the DB is open.
+	MaxManifestFileSize int
+
+	// MaxSubcompactions defines the maximum number of subcompactions a
+	// table compaction may be split into. A table compaction whose input
+	// is at least twice the target table size of the compacted level is
+	// split by key range, each range is compacted concurrently into its
+	// own tables, and all of the created tables are committed at once.
+	// Compactions involving range deletions are never split.
+	//
+	// CompactionFilter must be safe for concurrent use if this is greater
+	// than 1.
+	//
+	// The default value is 1, which means no subcompaction.
+	MaxSubcompactions int
+
+	// MaxTableSize caps the limit of the tables size of every level, see
+	// CompactionTableSize, so the tables of the deep levels don't grow
+	// unbounded with the multipliers.
+	//
+	// The default value is 0, which means no cap.
+	MaxTableSize int
+
+	// MetaBlockCacheCapacity defines the capacity of the caching of the
+	// 'sorted table' index and filter blocks, which is then separate from
+	// the block caching. By default the index and filter blocks share the
+	// block caching, or are held by the opened tables for as long as they
+	// are open if the block caching is disabled. With this caching the
+	// memory taken by the index and filter blocks is bounded whatever the
+	// number of tables, they are read on demand once evicted. The cache
+	// algorithm is the same as of the block caching.
+	//
+	// The default value is 0, which means the index and filter blocks are
+	// cached like data blocks.
+	MetaBlockCacheCapacity int
+
+	// MetaBlockCachePinLevel0 allows keeping in memory the index and filter
+	// blocks of the level-0 tables for as long as the tables are open,
+	// whatever the caching of those blocks, as the level-0 tables are
+	// checked by every lookup. The pinned blocks still count toward the
+	// capacity of the cache holding them.
+	//
+	// The default is false.
+	MetaBlockCachePinLevel0 bool
+
+	// MmapRead allows reading 'sorted table' through memory mapping, if
+	// supported by the storage. Uncompressed blocks are then used in place,
+	// including by the block cache, instead of being read into buffers.
+	// This saves copies and allocations for read-heavy workloads whose
+	// 'sorted table' fit in the OS page cache.
+	//
+	// The default is false.
+	MmapRead bool
+
 	// NoSync allows completely disable fsync.
 	//
 	// The default is false.
@@ -317,6 +1239,15 @@ type Options struct {
 	// The default is false.
 	NoWriteMerge bool
 
+	// NumLevel limits the number of levels. Tables are never compacted
+	// beyond the last level, which size is then unbounded. Tables that
+	// already exist beyond the last level are kept where they are.
+	// The minimum value is 2.
+	//
+	// The default value is 0, which means the number of levels is not
+	// limited.
+	NumLevel int
+
 	// OpenFilesCacher provides cache algorithm for open files caching.
 	// Specify NoCacher to disable caching algorithm.
 	//
@@ -329,6 +1260,44 @@ type Options struct {
 	// The default value is 500.
 	OpenFilesCacheCapacity int
 
+	// OpenFilesCachePinBottomLevel pins the opened 'sorted table' of the
+	// bottom level, that is the deepest level holding tables, so they're
+	// never reopened. Pinned tables are kept open beyond the capacity of
+	// the open files caching, until they're deleted or the level is no
+	// longer the bottom level.
+	//
+	// The default value is false.
+	OpenFilesCachePinBottomLevel bool
+
+	// OpenFilesCachePinPerLevel defines number of the most recently opened
+	// 'sorted table' of each level that are pinned, so they're never
+	// reopened. Pinned tables are kept open beyond the capacity of the
+	// open files caching, until they're deleted or unpinned by tables
+	// opened later.
+	//
+	// The default value is 0.
+	OpenFilesCachePinPerLevel int
+
+	// PipelinedWrite allows a write to pass the write lock to the next
+	// concurrent write as soon as its sequence numbers are reserved and its
+	// journal is written. The concurrent writes then insert into the
+	// 'memdb' in parallel, overlapping with the journal write of the next
+	// write, and their sequence numbers are published in order, so a write
+	// is only visible to reads once the preceding writes are. A write
+	// filling the 'memdb' doesn't pass the lock before the 'memdb' is
+	// rotated. This has no effect if write merge is disabled.
+	//
+	// The default value is false.
+	PipelinedWrite bool
+
+	// Prefixer defines the key prefix extractor. If both Prefixer and Filter
+	// are set then key prefixes are also added to the table filters, which
+	// allows iterators with ReadOptions.Prefix to skip tables that doesn't
+	// contain such prefix.
+	//
+	// The default value is nil.
+	Prefixer comparer.Prefixer
+
 	// If true then opens DB in read-only mode.
 	//
 	// The default value is false.
@@ -337,6 +1306,88 @@ type Options struct {
 	// Strict defines the DB strict level.
 	Strict Strict
 
+	// TableBytesPerSync defines the number of bytes written to a table
+	// after which its write-back is started, without waiting for it, so
+	// the sync at the completion of the table has less to write and
+	// doesn't stall the other writes. This has effect only if the storage
+	// supports it, see storage.RangeSyncer.
+	//
+	// The default value is 0, which means the write-back is left to the OS.
+	TableBytesPerSync int
+
+	// TableFilter allows writing a whole table filter along with the
+	// 'sorted table' filter. The whole table filter covers all keys of
+	// the table and is kept in memory once the table is opened, so a
+	// lookup of an absent key skips the table without reading any of its
+	// blocks, even if the table is no longer held by the open files
+	// caching. This is most useful for lookups of absent keys on level-0
+	// heavy DBs, at the cost of memory held by the whole table filters.
+	// This has no effect if Filter is nil.
+	//
+	// The default value is false.
+	TableFilter bool
+
+	// TablePreallocate defines whether the disk space of each new table
+	// is preallocated to the target table size, see CompactionTableSize,
+	// and the unused space released once the table is written. This
+	// avoids fragmentation of the tables on file systems such as ext4.
+	// This has effect only if the storage supports it, see
+	// storage.Preallocator and storage.Truncater.
+	//
+	// The default value is false.
+	TablePreallocate bool
+
+	// TablePropertiesCollectors defines the constructors of the table
+	// properties collectors. Each constructor is called once for each
+	// table written, the properties of all collectors are stored in
+	// the table.
+	//
+	// The default value is nil.
+	TablePropertiesCollectors []func() TablePropertiesCollector
+
+	// Tracer defines the tracer receiving the spans of lookups, journal
+	// writes and compaction phases, see Tracer.
+	//
+	// The default value is nil, which means no tracing.
+	Tracer Tracer
+
+	// ValidateComparer defines whether Open validates the Comparer with
+	// comparer.Validate, over a sample of the smallest and largest keys of
+	// the DB tables. A comparer violating its contracts may misplace keys
+	// at the table index boundaries, making them unreachable.
+	//
+	// The default value is false.
+	ValidateComparer bool
+
+	// ValueLogGCRatio defines the ratio of garbage in a value log file at
+	// which the file is collected; its live values are moved to new value
+	// log files, after which the file is removed. Garbage is accounted as
+	// compaction drops entries pointing into the file, and is not kept
+	// across reopen.
+	//
+	// The default value is 0.5.
+	ValueLogGCRatio float64
+
+	// ValueLogThreshold defines the value length at which values are stored
+	// in append-only value log files, while 'sorted table' only hold pointers
+	// to them. This cuts compaction write amplification for large values,
+	// at the cost of an additional read per value and of the space held by
+	// overwritten values until their value log file is collected, see
+	// ValueLogGCRatio.
+	//
+	// Values are moved when 'sorted table' are written; the journal and
+	// 'memdb' always hold whole values.
+	//
+	// The default value is 0, which means value log is disabled.
+	ValueLogThreshold int
+
+	// WALRecoveryMode defines how corrupted or truncated journal records
+	// are handled when the journals are replayed on open.
+	//
+	// The default value is WALRecoveryDefault, which derives the mode from
+	// StrictJournal.
+	WALRecoveryMode WALRecoveryMode
+
 	// WriteBuffer defines maximum size of a 'memdb' before flushed to
 	// 'sorted table'. 'memdb' is an in-memory DB backed by an on-disk
 	// unsorted journal.
@@ -357,6 +1408,36 @@ type Options struct {
 	//
 	// The default value is 8.
 	WriteL0SlowdownTrigger int
+
+	// WriteMergeLimit defines the maximum size of concurrent writes that
+	// will be merged into a single journal write. If the write is itself
+	// larger than the limit, it will only be merged with up to 8 times
+	// of the limit in total.
+	//
+	// The default value is 128KiB.
+	WriteMergeLimit int
+
+	// WriteMergeMaxWait defines how long a write may wait for concurrent
+	// writes to merge with, before writing the journal. Longer wait allows
+	// larger merges, at the cost of the write latency.
+	//
+	// The default value is 0, which means only merge writes that are
+	// already pending.
+	WriteMergeMaxWait time.Duration
+
+	// WriteMergeSeparateSync defines whether writes with different
+	// WriteOptions.Sync shouldn't be merged together. By default a sync
+	// write merges non-sync writes, which then wait for the fsync as well.
+	//
+	// The default value is false.
+	WriteMergeSeparateSync bool
+
+	// WriteStallPolicy defines the write backpressure policy. When set,
+	// WriteL0PauseTrigger and WriteL0SlowdownTrigger are ignored.
+	//
+	// The default value is a TriggerWriteStallPolicy using
+	// WriteL0SlowdownTrigger and WriteL0PauseTrigger.
+	WriteStallPolicy WriteStallPolicy
 }
 
 func (o *Options) GetAltFilters() []filter.Filter {
@@ -398,14 +1479,49 @@ func (o *Options) GetBlockSize() int {
 	return o.BlockSize
 }
 
-func (o *Options) GetCompactionExpandLimit(level int) int {
-	factor := DefaultCompactionExpandLimitFactor
+func (o *Options) GetBreakStaleLock() bool {
+	if o == nil {
+		return false
+	}
+	return o.BreakStaleLock
+}
+
+func (o *Options) GetChecksum() Checksum {
+	if o == nil || o.Checksum >= nChecksum {
+		return CRC32CChecksum
+	}
+	return o.Checksum
+}
+
+func (o *Options) GetCompactionDebtThresholds() []int64 {
+	if o == nil {
+		return nil
+	}
+	return o.CompactionDebtThresholds
+}
+
+func (o *Options) GetCompactionDropCache() bool {
+	if o == nil {
+		return false
+	}
+	return o.CompactionDropCache
+}
+
+func (o *Options) GetCompactionExpandLimit(level int) int {
+	factor := DefaultCompactionExpandLimitFactor
 	if o != nil && o.CompactionExpandLimitFactor > 0 {
 		factor = o.CompactionExpandLimitFactor
 	}
 	return o.GetCompactionTableSize(level+1) * factor
 }
 
+func (o *Options) GetCompactionFilter() CompactionFilter {
+	if o == nil {
+		return nil
+	}
+	return o.CompactionFilter
+}
+
 func (o *Options) GetCompactionGPOverlaps(level int) int {
 	factor := DefaultCompactionGPOverlapsFactor
 	if o != nil && o.CompactionGPOverlapsFactor > 0 {
@@ -414,6 +1530,20 @@ func (o *Options) GetCompactionGPOverlaps(level int) int {
 	return o.GetCompactionTableSize(level+2) * factor
 }
 
+func (o *Options) GetCompactionGarbageRatio() float64 {
+	if o == nil || o.CompactionGarbageRatio <= 0 {
+		return DefaultCompactionGarbageRatio
+	}
+	return o.CompactionGarbageRatio
+}
+
+func (o *Options) GetCompactionL0IntraTrigger() int {
+	if o == nil || o.CompactionL0IntraTrigger < 2 {
+		return 0
+	}
+	return o.CompactionL0IntraTrigger
+}
+
 func (o *Options) GetCompactionL0Trigger() int {
 	if o == nil || o.CompactionL0Trigger == 0 {
 		return DefaultCompactionL0Trigger
@@ -421,6 +1551,13 @@ func (o *Options) GetCompactionL0Trigger() int {
 	return o.CompactionL0Trigger
 }
 
+func (o *Options) GetCompactionPriority() CompactionPriority {
+	if o == nil {
+		return CompactionPriorityRoundRobin
+	}
+	return o.CompactionPriority
+}
+
 func (o *Options) GetCompactionSourceLimit(level int) int {
 	factor := DefaultCompactionSourceLimitFactor
 	if o != nil && o.CompactionSourceLimitFactor > 0 {
@@ -435,6 +1572,9 @@ func (o *Options) GetCompactionTableSize(level int) int {
 		mult float64
 	)
 	if o != nil {
+		if level < len(o.CompactionTableSizePerLevel) && o.CompactionTableSizePerLevel[level] > 0 {
+			return o.capTableSize(o.CompactionTableSizePerLevel[level])
+		}
 		if o.CompactionTableSize > 0 {
 			base = o.CompactionTableSize
 		}
@@ -447,7 +1587,14 @@ func (o *Options) GetCompactionTableSize(level int) int {
 	if mult == 0 {
 		mult = math.Pow(DefaultCompactionTableSizeMultiplier, float64(level))
 	}
-	return int(float64(base) * mult)
+	return o.capTableSize(int(float64(base) * mult))
+}
+
+func (o *Options) capTableSize(size int) int {
+	if max := o.GetMaxTableSize(); max > 0 && size > max {
+		return max
+	}
+	return size
 }
 
 func (o *Options) GetCompactionTotalSize(level int) int64 {
@@ -456,6 +1603,9 @@ func (o *Options) GetCompactionTotalSize(level int) int64 {
 		mult float64
 	)
 	if o != nil {
+		if level < len(o.CompactionTotalSizePerLevel) && o.CompactionTotalSizePerLevel[level] > 0 {
+			return o.CompactionTotalSizePerLevel[level]
+		}
 		if o.CompactionTotalSize > 0 {
 			base = o.CompactionTotalSize
 		}
@@ -478,13 +1628,57 @@ func (o *Options) GetComparer() comparer.Comparer {
 	return o.Comparer
 }
 
+func (o *Options) GetComparerUpgrade() func(name string, version uint64) bool {
+	if o == nil {
+		return nil
+	}
+	return o.ComparerUpgrade
+}
+
+func (o *Options) GetComparerVersion() uint64 {
+	if o == nil {
+		return 0
+	}
+	return o.ComparerVersion
+}
+
+func (o *Options) GetCompressedBlockCacheCapacity() int {
+	if o == nil || o.CompressedBlockCacheCapacity <= 0 {
+		return 0
+	}
+	return o.CompressedBlockCacheCapacity
+}
+
 func (o *Options) GetCompression() Compression {
-	if o == nil || o.Compression <= DefaultCompression || o.Compression >= nCompression {
+	if o == nil || !o.Compression.Writable() {
 		return DefaultCompressionType
 	}
 	return o.Compression
 }
 
+func (o *Options) GetCompressionPerLevel(level int) Compression {
+	if o != nil && level < len(o.CompressionPerLevel) {
+		if c := o.CompressionPerLevel[level]; c.Writable() {
+			return c
+		}
+	}
+	return o.GetCompression()
+}
+
+func (o *Options) GetCompressor(c Compression) Compressor {
+	if o == nil {
+		return nil
+	}
+	return o.Compressors[c]
+}
+
+func (o *Options) GetCorruptionPolicy() CorruptionPolicy {
+	if o == nil {
+		return CorruptionDrop
+	}
+	return o.CorruptionPolicy
+}
+
 func (o *Options) GetDisableBufferPool() bool {
 	if o == nil {
 		return false
@@ -506,6 +1700,13 @@ func (o *Options) GetDisableCompactionBackoff() bool {
 	return o.DisableCompactionBackoff
 }
 
+func (o *Options) GetDisableIndexBlockDeltaEncoding() bool {
+	if o == nil {
+		return false
+	}
+	return o.DisableIndexBlockDeltaEncoding
+}
+
 func (o *Options) GetDisableLargeBatchTransaction() bool {
 	if o == nil {
 		return false
@@ -527,6 +1728,20 @@ func (o *Options) GetErrorIfMissing() bool {
 	return o.ErrorIfMissing
 }
 
+func (o *Options) GetEventListener() *EventListener {
+	if o == nil {
+		return nil
+	}
+	return o.EventListener
+}
+
+func (o *Options) GetFIFOCompactionTotalSize() int64 {
+	if o == nil || o.FIFOCompactionTotalSize <= 0 {
+		return 0
+	}
+	return o.FIFOCompactionTotalSize
+}
+
 func (o *Options) GetFilter() filter.Filter {
 	if o == nil {
 		return nil
@@ -534,6 +1749,27 @@ func (o *Options) GetFilter() filter.Filter {
 	return o.Filter
 }
 
+func (o *Options) GetFilterBitsPerKeyPerLevel(level int) int {
+	if o == nil || level < 0 || level >= len(o.FilterBitsPerKeyPerLevel) || o.FilterBitsPerKeyPerLevel[level] <= 0 {
+		return 0
+	}
+	return o.FilterBitsPerKeyPerLevel[level]
+}
+
+func (o *Options) GetFilterPartitionSize() int {
+	if o == nil || o.FilterPartitionSize <= 0 {
+		return 0
+	}
+	return o.FilterPartitionSize
+}
+
+func (o *Options) GetIndexBlockRestartInterval() int {
+	if o == nil || o.IndexBlockRestartInterval <= 0 {
+		return DefaultIndexBlockRestartInterval
+	}
+	return o.IndexBlockRestartInterval
+}
+
 func (o *Options) GetIteratorSamplingRate() int {
 	if o == nil || o.IteratorSamplingRate <= 0 {
 		return DefaultIteratorSamplingRate
@@ -541,6 +1777,132 @@ func (o *Options) GetIteratorSamplingRate() int {
 	return o.IteratorSamplingRate
 }
 
+func (o *Options) GetJournalArchive() bool {
+	if o == nil {
+		return false
+	}
+	return o.JournalArchive
+}
+
+func (o *Options) GetJournalBlockSize() int {
+	switch {
+	case o == nil || o.JournalBlockSize <= 0:
+		return DefaultJournalBlockSize
+	case o.JournalBlockSize < 1*KiB:
+		return 1 * KiB
+	case o.JournalBlockSize > 64*KiB:
+		return 64 * KiB
+	}
+	return o.JournalBlockSize
+}
+
+func (o *Options) GetJournalPreallocateSize() int {
+	if o == nil || o.JournalPreallocateSize < 0 {
+		return 0
+	}
+	return o.JournalPreallocateSize
+}
+
+func (o *Options) GetJournalRecycle() int {
+	if o == nil || o.JournalRecycle < 0 {
+		return 0
+	}
+	return o.JournalRecycle
+}
+
+func (o *Options) GetJournalRetentionSize() int {
+	if o == nil || o.JournalRetentionSize < 0 {
+		return 0
+	}
+	return o.JournalRetentionSize
+}
+
+func (o *Options) GetJournalRetentionTime() time.Duration {
+	if o == nil || o.JournalRetentionTime < 0 {
+		return 0
+	}
+	return o.JournalRetentionTime
+}
+
+func (o *Options) GetJournalSyncInterval() time.Duration {
+	if o == nil || o.JournalSyncInterval < 0 {
+		return 0
+	}
+	return o.JournalSyncInterval
+}
+
+func (o *Options) GetLogger() Logger {
+	if o == nil {
+		return nil
+	}
+	return o.Logger
+}
+
+func (o *Options) GetLevelDBCompatible() bool {
+	if o == nil {
+		return false
+	}
+	return o.LevelDBCompatible
+}
+
+func (o *Options) GetMaxBatchLen() int {
+	if o == nil || o.MaxBatchLen < 0 {
+		return 0
+	}
+	return o.MaxBatchLen
+}
+
+func (o *Options) GetMaxBatchSize() int {
+	if o == nil || o.MaxBatchSize < 0 {
+		return 0
+	}
+	return o.MaxBatchSize
+}
+
+func (o *Options) GetMaxManifestFileSize() int {
+	if o == nil || o.MaxManifestFileSize == 0 {
+		return DefaultMaxManifestFileSize
+	} else if o.MaxManifestFileSize < 0 {
+		return 0
+	}
+	return o.MaxManifestFileSize
+}
+
+func (o *Options) GetMaxSubcompactions() int {
+	if o == nil || o.MaxSubcompactions <= 0 {
+		return 1
+	}
+	return o.MaxSubcompactions
+}
+
+func (o *Options) GetMaxTableSize() int {
+	if o == nil || o.MaxTableSize < 0 {
+		return 0
+	}
+	return o.MaxTableSize
+}
+
+func (o *Options) GetMetaBlockCacheCapacity() int {
+	if o == nil || o.MetaBlockCacheCapacity <= 0 {
+		return 0
+	}
+	return o.MetaBlockCacheCapacity
+}
+
+func (o *Options) GetMetaBlockCachePinLevel0() bool {
+	if o == nil {
+		return false
+	}
+	return o.MetaBlockCachePinLevel0
+}
+
+func (o *Options) GetMmapRead() bool {
+	if o == nil {
+		return false
+	}
+	return o.MmapRead
+}
+
 func (o *Options) GetNoSync() bool {
 	if o == nil {
 		return false
@@ -555,6 +1917,15 @@ func (o *Options) GetNoWriteMerge() bool {
 	return o.NoWriteMerge
 }
 
+func (o *Options) GetNumLevel() int {
+	if o == nil || o.NumLevel <= 0 {
+		return 0
+	} else if o.NumLevel < 2 {
+		return 2
+	}
+	return o.NumLevel
+}
+
 func (o *Options) GetOpenFilesCacher() Cacher {
 	if o == nil || o.OpenFilesCacher == nil {
 		return DefaultOpenFilesCacher
@@ -574,6 +1945,34 @@ func (o *Options) GetOpenFilesCacheCapacity() int {
 	return o.OpenFilesCacheCapacity
 }
 
+func (o *Options) GetOpenFilesCachePinBottomLevel() bool {
+	if o == nil {
+		return false
+	}
+	return o.OpenFilesCachePinBottomLevel
+}
+
+func (o *Options) GetOpenFilesCachePinPerLevel() int {
+	if o == nil || o.OpenFilesCachePinPerLevel < 0 {
+		return 0
+	}
+	return o.OpenFilesCachePinPerLevel
+}
+
+func (o *Options) GetPipelinedWrite() bool {
+	if o == nil {
+		return false
+	}
+	return o.PipelinedWrite
+}
+
+func (o *Options) GetPrefixer() comparer.Prefixer {
+	if o == nil {
+		return nil
+	}
+	return o.Prefixer
+}
+
 func (o *Options) GetReadOnly() bool {
 	if o == nil {
 		return false
@@ -585,9 +1984,78 @@ func (o *Options) GetStrict(strict Strict) bool {
 	if o == nil || o.Strict == 0 {
 		return DefaultStrict&strict != 0
 	}
+	if o.Strict&StrictParanoidChecks != 0 {
+		return (o.Strict|StrictBlockChecksum|StrictJournalChecksum)&strict != 0
+	}
 	return o.Strict&strict != 0
 }
 
+func (o *Options) GetTableBytesPerSync() int {
+	if o == nil || o.TableBytesPerSync < 0 {
+		return 0
+	}
+	return o.TableBytesPerSync
+}
+
+func (o *Options) GetTableFilter() bool {
+	if o == nil {
+		return false
+	}
+	return o.TableFilter
+}
+
+func (o *Options) GetTablePreallocate() bool {
+	if o == nil {
+		return false
+	}
+	return o.TablePreallocate
+}
+
+func (o *Options) GetTablePropertiesCollectors() []func() TablePropertiesCollector {
+	if o == nil {
+		return nil
+	}
+	return o.TablePropertiesCollectors
+}
+
+func (o *Options) GetTracer() Tracer {
+	if o == nil {
+		return nil
+	}
+	return o.Tracer
+}
+
+func (o *Options) GetValidateComparer() bool {
+	if o == nil {
+		return false
+	}
+	return o.ValidateComparer
+}
+
+func (o *Options) GetValueLogGCRatio() float64 {
+	if o == nil || o.ValueLogGCRatio <= 0 {
+		return DefaultValueLogGCRatio
+	}
+	return o.ValueLogGCRatio
+}
+
+func (o *Options) GetValueLogThreshold() int {
+	if o == nil || o.ValueLogThreshold < 0 {
+		return 0
+	}
+	return o.ValueLogThreshold
+}
+
+func (o *Options) GetWALRecoveryMode() WALRecoveryMode {
+	if o == nil || o.WALRecoveryMode <= WALRecoveryDefault || o.WALRecoveryMode > WALSkipAnyCorruptedRecords {
+		if o.GetStrict(StrictJournal) {
+			return WALAbsoluteConsistency
+		}
+		return WALSkipAnyCorruptedRecords
+	}
+	return o.WALRecoveryMode
+}
+
 func (o *Options) GetWriteBuffer() int {
 	if o == nil || o.WriteBuffer <= 0 {
 		return DefaultWriteBuffer
@@ -609,9 +2077,51 @@ func (o *Options) GetWriteL0SlowdownTrigger() int {
 	return o.WriteL0SlowdownTrigger
 }
 
+func (o *Options) GetWriteMergeLimit() int {
+	if o == nil || o.WriteMergeLimit <= 0 {
+		return DefaultWriteMergeLimit
+	}
+	return o.WriteMergeLimit
+}
+
+func (o *Options) GetWriteMergeMaxWait() time.Duration {
+	if o == nil || o.WriteMergeMaxWait < 0 {
+		return 0
+	}
+	return o.WriteMergeMaxWait
+}
+
+func (o *Options) GetWriteMergeSeparateSync() bool {
+	if o == nil {
+		return false
+	}
+	return o.WriteMergeSeparateSync
+}
+
+func (o *Options) GetWriteStallPolicy() WriteStallPolicy {
+	if o == nil || o.WriteStallPolicy == nil {
+		return &TriggerWriteStallPolicy{
+			SlowdownTrigger: o.GetWriteL0SlowdownTrigger(),
+			PauseTrigger:    o.GetWriteL0PauseTrigger(),
+		}
+	}
+	return o.WriteStallPolicy
+}
+
 // ReadOptions holds the optional parameters for 'read operation'. The
 // 'read operation' includes Get, Find and NewIterator.
 type ReadOptions struct {
+	// CacheOnly defines whether this 'read operation' may only be served
+	// by the caches, i.e. the opened tables, the block cache and the
+	// compressed block cache, and the memdb. If true then a read that
+	// would need to read a table file fails with ErrCacheMiss instead,
+	// e.g. for latency-critical reads that would rather miss than wait
+	// for the disk. Reads of a mmapped table file and paranoid checks also
+	// count as misses.
+	//
+	// The default value is false.
+	CacheOnly bool
+
 	// DontFillCache defines whether block reads for this 'read operation'
 	// should be cached. If false then the block will be cached. This does
 	// not affects already cached block.
@@ -619,9 +2129,91 @@ type ReadOptions struct {
 	// The default value is false.
 	DontFillCache bool
 
+	// LowerBound defines inclusive lower bound of keys returned by
+	// iterators. It is intersected with the iterator slice range, if any,
+	// and pushed down to skip 'sorted table' and blocks outside the range.
+	//
+	// The default value is nil, which means no lower bound.
+	LowerBound []byte
+
+	// OnSkipCorrupted is called by iterators for each corrupted block or
+	// 'sorted table' skipped, see SkipCorrupted. It is called from the
+	// goroutine using the iterator.
+	OnSkipCorrupted func(err error)
+
+	// PinData defines whether iterators should pin the blocks holding the
+	// values they return instead of copying the values. The slice returned
+	// by the iterator Value method is then valid until the next call to
+	// any 'seeks method' or Release, and must not be modified. This avoids
+	// a copy per entry for scans that look at each value once.
+	//
+	// The default value is false.
+	PinData bool
+
+	// PoolValues defines whether the values returned by Get are copied into
+	// buffers of the DB buffer pool, to be handed back with DB.ReleaseValue
+	// once no longer used. The buffers are of the size classes of the pool,
+	// and may be much larger than the values; a value kept without being
+	// released retains the whole buffer. Otherwise each value is a new slice
+	// of its own length. This has no effect if the buffer pool is disabled,
+	// see Options.DisableBufferPool.
+	//
+	// The default value is false.
+	PoolValues bool
+
+	// Prefix limits iterators to keys with the given prefix, the range is
+	// as returned by util.BytesPrefix. If the prefix is as extracted by
+	// Options.Prefixer then 'sorted table' whose filter rules the prefix
+	// out are skipped.
+	//
+	// The default value is nil.
+	Prefix []byte
+
+	// ReadaheadSize defines the size of the 'sorted table' data iterators
+	// read ahead on a background goroutine once they detect sequential
+	// block reads, so large scans aren't bound by the latency of the
+	// per-block reads. Half of the size is read while the other half is
+	// consumed. This has no effect on tables read through memory mapping,
+	// see Options.MmapRead.
+	//
+	// The default value is 0, which means readahead is disabled.
+	ReadaheadSize int
+
+	// ResumeFrom defines the cursor, as returned by the iterator Cursor
+	// method, an iterator resumes from. The first call to Next moves the
+	// iterator to the first key after the cursor key, and the first call
+	// to Prev to the last key before it; other 'seeks method' are
+	// unaffected.
+	//
+	// The default value is nil.
+	ResumeFrom []byte
+
+	// SkipCorrupted defines whether iterators should skip corrupted blocks
+	// and 'sorted table' instead of halting, e.g. to export what is left of
+	// a partially corrupted DB. This overrides StrictReader. The skipped
+	// corruptions are passed to OnSkipCorrupted, and the first one is
+	// returned by the iterator Error method; the iteration proceeds anyway.
+	//
+	// The default value is false.
+	SkipCorrupted bool
+
 	// Strict will be OR'ed with global DB 'strict level' unless StrictOverride
-	// is present. Currently only StrictReader that has effect here.
+	// is present. Currently only StrictReader and StrictParanoidChecks that
+	// have effect here.
 	Strict Strict
+
+	// UpperBound defines exclusive upper bound of keys returned by
+	// iterators. See LowerBound.
+	//
+	// The default value is nil, which means no upper bound.
+	UpperBound []byte
+}
+
+func (ro *ReadOptions) GetCacheOnly() bool {
+	if ro == nil {
+		return false
+	}
+	return ro.CacheOnly
 }
 
 func (ro *ReadOptions) GetDontFillCache() bool {
@@ -631,6 +2223,62 @@ func (ro *ReadOptions) GetDontFillCache() bool {
 	return ro.DontFillCache
 }
 
+func (ro *ReadOptions) GetLowerBound() []byte {
+	if ro == nil {
+		return nil
+	}
+	return ro.LowerBound
+}
+
+func (ro *ReadOptions) GetOnSkipCorrupted() func(err error) {
+	if ro == nil {
+		return nil
+	}
+	return ro.OnSkipCorrupted
+}
+
+func (ro *ReadOptions) GetPinData() bool {
+	if ro == nil {
+		return false
+	}
+	return ro.PinData
+}
+
+func (ro *ReadOptions) GetPoolValues() bool {
+	if ro == nil {
+		return false
+	}
+	return ro.PoolValues
+}
+
+func (ro *ReadOptions) GetPrefix() []byte {
+	if ro == nil {
+		return nil
+	}
+	return ro.Prefix
+}
+
+func (ro *ReadOptions) GetReadaheadSize() int {
+	if ro == nil || ro.ReadaheadSize < 0 {
+		return 0
+	}
+	return ro.ReadaheadSize
+}
+
+func (ro *ReadOptions) GetResumeFrom() []byte {
+	if ro == nil {
+		return nil
+	}
+	return ro.ResumeFrom
+}
+
+func (ro *ReadOptions) GetSkipCorrupted() bool {
+	if ro == nil {
+		return false
+	}
+	return ro.SkipCorrupted
+}
+
 func (ro *ReadOptions) GetStrict(strict Strict) bool {
 	if ro == nil {
 		return false
@@ -638,6 +2286,13 @@ func (ro *ReadOptions) GetStrict(strict Strict) bool {
 	return ro.Strict&strict != 0
 }
 
+func (ro *ReadOptions) GetUpperBound() []byte {
+	if ro == nil {
+		return nil
+	}
+	return ro.UpperBound
+}
+
 // WriteOptions holds the optional parameters for 'write operation'. The
 // 'write operation' includes Write, Put and Delete.
 type WriteOptions struct {
@@ -657,6 +2312,10 @@ type WriteOptions struct {
 	// In other words, Sync being false has the same semantics as a write
 	// system call. Sync being true means write followed by fsync.
 	//
+	// Writes without Sync can be made durable later by DB.SyncWAL, or
+	// periodically by setting Options.JournalSyncInterval. Sync has no
+	// effect if Options.NoSync is true.
+	//
 	// The default value is false.
 	Sync bool
 }
@@ -675,7 +2334,105 @@ func (wo *WriteOptions) GetSync() bool {
 	return wo.Sync
 }
 
+// IngestOptions holds the optional parameters for the DB table ingestion
+// operation.
+type IngestOptions struct {
+	// RemoveSource defines whether the source files should be removed
+	// once they are successfully ingested.
+	//
+	// The default value is false.
+	RemoveSource bool
+}
+
+func (io *IngestOptions) GetRemoveSource() bool {
+	if io == nil {
+		return false
+	}
+	return io.RemoveSource
+}
+
+// CompactionOptions holds the optional parameters for the DB manual range
+// compaction.
+type CompactionOptions struct {
+	// Exclusive defines whether 'memdb' flushes should be held off until the
+	// manual compaction is done, instead of interleaving with it. Writes may
+	// stall once the 'memdb' is full.
+	//
+	// The default value is false.
+	Exclusive bool
+
+	// MoveOnly defines whether the compaction should only move tables that
+	// doesn't overlap with the next level down, without rewriting them.
+	// Tables that do overlap are left as is.
+	//
+	// The default value is false.
+	MoveOnly bool
+
+	// TargetLevel defines the level the range is compacted into; the range
+	// will be compacted level by level from level-0 down to that level.
+	//
+	// The default value is 0, which means compacting down to the deepest
+	// level that overlaps with the range.
+	TargetLevel int
+}
+
+func (co *CompactionOptions) GetExclusive() bool {
+	if co == nil {
+		return false
+	}
+	return co.Exclusive
+}
+
+func (co *CompactionOptions) GetMoveOnly() bool {
+	if co == nil {
+		return false
+	}
+	return co.MoveOnly
+}
+
+func (co *CompactionOptions) GetTargetLevel() int {
+	if co == nil || co.TargetLevel < 0 {
+		return 0
+	}
+	return co.TargetLevel
+}
+
+// VerifyOptions holds the optional parameters for the DB checksums
+// verification.
+type VerifyOptions struct {
+	// BytesPerSec limits the rate the verified files are read at, in
+	// bytes per second, so the verification doesn't starve foreground
+	// reads and compactions of I/O.
+	//
+	// The default value is 0, which means no limit.
+	BytesPerSec int
+
+	// SkipJournal defines whether the journal should not be verified.
+	// The journal is read while it is open for writing; this must be
+	// set if the storage doesn't allow that, e.g. the memory storage.
+	//
+	// The default value is false.
+	SkipJournal bool
+}
+
+func (vo *VerifyOptions) GetBytesPerSec() int {
+	if vo == nil || vo.BytesPerSec < 0 {
+		return 0
+	}
+	return vo.BytesPerSec
+}
+
+func (vo *VerifyOptions) GetSkipJournal() bool {
+	if vo == nil {
+		return false
+	}
+	return vo.SkipJournal
+}
+
 func GetStrict(o *Options, ro *ReadOptions, strict Strict) bool {
+	if ro.GetSkipCorrupted() {
+		strict &= ^StrictReader
+	}
 	if ro.GetStrict(StrictOverride) {
 		return ro.GetStrict(strict)
 	} else {
@@ -7,6 +7,9 @@
 package leveldb
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/FactomProject/goleveldb/leveldb/filter"
 	"github.com/FactomProject/goleveldb/leveldb/opt"
 )
@@ -38,9 +41,50 @@ func (s *session) setOptions(o *opt.Options) {
 	if filter := o.GetFilter(); filter != nil {
 		no.Filter = &iFilter{filter}
 	}
+	// Prefixer.
+	if prefixer := o.GetPrefixer(); prefixer != nil {
+		no.Prefixer = &iPrefixer{prefixer}
+	}
+	// Table properties collectors.
+	if collectors := o.GetTablePropertiesCollectors(); len(collectors) > 0 {
+		no.TablePropertiesCollectors = make([]func() opt.TablePropertiesCollector, len(collectors))
+		for i, newCollector := range collectors {
+			newCollector := newCollector
+			no.TablePropertiesCollectors[i] = func() opt.TablePropertiesCollector {
+				return iPropertiesCollector{newCollector()}
+			}
+		}
+	}
 
 	s.o = &cachedOptions{Options: no}
 	s.o.cache()
+
+	// Tables keyed by user keys.
+	uo := *no
+	uo.Comparer = o.GetComparer()
+	uo.Filter = o.GetFilter()
+	uo.AltFilters = o.GetAltFilters()
+	uo.Prefixer = o.GetPrefixer()
+	uo.TablePropertiesCollectors = nil
+	s.uo = &uo
+}
+
+// iPropertiesCollector passes user keys to the table properties collector.
+type iPropertiesCollector struct {
+	opt.TablePropertiesCollector
+}
+
+func (c iPropertiesCollector) Add(key, value []byte) {
+	ukey, _, kt, kerr := parseInternalKey(key)
+	if kerr != nil {
+		return
+	}
+	switch kt {
+	case keyTypeVal:
+		c.TablePropertiesCollector.Add(ukey, value)
+	case keyTypeValPtr:
+		c.TablePropertiesCollector.Add(ukey, nil)
+	}
 }
 
 const optCachedLevel = 7
@@ -53,6 +97,7 @@ type cachedOptions struct {
 	compactionSourceLimit []int
 	compactionTableSize   []int
 	compactionTotalSize   []int64
+	writeStallPolicy      opt.WriteStallPolicy
 }
 
 func (co *cachedOptions) cache() {
@@ -69,6 +114,18 @@ func (co *cachedOptions) cache() {
 		co.compactionTableSize[level] = co.Options.GetCompactionTableSize(level)
 		co.compactionTotalSize[level] = co.Options.GetCompactionTotalSize(level)
 	}
+	co.writeStallPolicy = co.Options.GetWriteStallPolicy()
+	if co.Options.GetFIFOCompactionTotalSize() > 0 && co.Options.WriteStallPolicy == nil {
+		// Level-0 tables are never compacted.
+		co.writeStallPolicy = noWriteStallPolicy{}
+	}
+}
+
+// noWriteStallPolicy never stalls writes.
+type noWriteStallPolicy struct{}
+
+func (noWriteStallPolicy) WriteStall(level0Tables int) (opt.WriteStallCondition, time.Duration) {
+	return opt.WriteStallNormal, 0
 }
 
 func (co *cachedOptions) GetCompactionExpandLimit(level int) int {
@@ -105,3 +162,89 @@ func (co *cachedOptions) GetCompactionTotalSize(level int) int64 {
 	}
 	return co.Options.GetCompactionTotalSize(level)
 }
+
+func (co *cachedOptions) GetWriteStallPolicy() opt.WriteStallPolicy {
+	return co.writeStallPolicy
+}
+
+var bloomFilterName = filter.NewBloomFilter(0).Name()
+
+// Returns options for writing a table at the given level.
+func (co *cachedOptions) tableOptions(level int) *opt.Options {
+	c := co.GetCompressionPerLevel(level)
+	f := co.GetFilter()
+	if bits := co.GetFilterBitsPerKeyPerLevel(level); bits > 0 && f != nil && f.Name() == bloomFilterName {
+		f = &iFilter{filter.NewBloomFilter(bits)}
+	}
+	if c != co.GetCompression() || f != co.GetFilter() {
+		o := *co.Options
+		o.Compression = c
+		o.Filter = f
+		return &o
+	}
+	return co.Options
+}
+
+// Returns an error if the options select a format the C++ LevelDB library
+// can't read in LevelDB compatible mode, see opt.Options.LevelDBCompatible.
+func (co *cachedOptions) checkLevelDBCompatible() error {
+	if !co.GetLevelDBCompatible() {
+		return nil
+	}
+	incompatible := func(option string) error {
+		return fmt.Errorf("leveldb: %s is not compatible with LevelDB", option)
+	}
+	switch {
+	case co.GetChecksum() != opt.CRC32CChecksum:
+		return incompatible(co.GetChecksum().String() + " checksum")
+	case co.GetJournalBlockSize() != opt.DefaultJournalBlockSize:
+		return incompatible("journal block size")
+	case co.GetJournalRecycle() > 0:
+		return incompatible("journal recycling")
+	case co.GetValueLogThreshold() > 0:
+		return incompatible("value log")
+	case co.GetCorruptionPolicy() == opt.CorruptionQuarantine:
+		return incompatible("quarantine corruption policy")
+	case co.GetComparerVersion() > 0:
+		return incompatible("comparer version")
+	}
+	check := func(c opt.Compression) error {
+		if c.IsUser() {
+			return incompatible(c.String() + " compression")
+		}
+		return nil
+	}
+	if err := check(co.GetCompression()); err != nil {
+		return err
+	}
+	for level := range co.CompressionPerLevel {
+		if err := check(co.GetCompressionPerLevel(level)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns error if the configured compression can't be used to write
+// tables, or no compressor provided for it.
+func (co *cachedOptions) checkCompression() error {
+	check := func(c opt.Compression) error {
+		switch {
+		case c == opt.DefaultCompression:
+		case !c.Writable():
+			return fmt.Errorf("leveldb: %v compression can't be used to write tables", c)
+		case c.IsUser() && co.GetCompressor(c) == nil:
+			return fmt.Errorf("leveldb: no compressor for %v compression", c)
+		}
+		return nil
+	}
+	if err := check(co.Compression); err != nil {
+		return err
+	}
+	for _, c := range co.CompressionPerLevel {
+		if err := check(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"sort"
+
+	"github.com/FactomProject/goleveldb/leveldb/iterator"
+)
+
+// rangeDel is a range tombstone. It hides every entry whose user key falls
+// within [start, limit) and whose sequence number is lower than seq.
+//
+// Range tombstones are stored as regular entries keyed by start and
+// typed keyTypeRangeDel, the value holds the limit. Since they cover
+// more than their own user key, each memdb and table also keeps a
+// separate list of its tombstones.
+type rangeDel struct {
+	seq          uint64
+	start, limit []byte
+}
+
+func (rd *rangeDel) covers(icmp *iComparer, ukey []byte, seq uint64) bool {
+	return rd.seq > seq && icmp.uCompare(ukey, rd.start) >= 0 && icmp.uCompare(ukey, rd.limit) < 0
+}
+
+type rangeDels []rangeDel
+
+// Returns true if the entry with given user key and sequence number is
+// hidden by any tombstone visible at snapshot sequence number snap.
+func (rds rangeDels) covers(icmp *iComparer, ukey []byte, seq, snap uint64) bool {
+	for i := range rds {
+		if rd := &rds[i]; rd.seq <= snap && rd.covers(icmp, ukey, seq) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the largest limit of the tombstones, or umax if it is larger.
+func (rds rangeDels) maxLimit(icmp *iComparer, umax []byte) []byte {
+	for i := range rds {
+		if umax != nil && icmp.uCompare(rds[i].limit, umax) > 0 {
+			umax = rds[i].limit
+		}
+	}
+	return umax
+}
+
+// Checks the key range of a range deletion to be written. Returns false if
+// the range is empty, so the deletion is ignored, and ErrInvalidRange if
+// start is after limit.
+func checkRangeDel(icmp *iComparer, start, limit []byte) (bool, error) {
+	switch c := icmp.uCompare(start, limit); {
+	case c > 0:
+		return false, ErrInvalidRange
+	case c == 0:
+		return false, nil
+	}
+	return true, nil
+}
+
+// Collects range tombstones of the given iterator, the iterator will be
+// released.
+func collectRangeDels(iter iterator.Iterator) (rds rangeDels, err error) {
+	defer iter.Release()
+	for iter.Next() {
+		ukey, seq, kt, kerr := parseInternalKey(iter.Key())
+		if kerr == nil && kt == keyTypeRangeDel {
+			rds = append(rds, rangeDel{seq, append([]byte{}, ukey...), append([]byte{}, iter.Value()...)})
+		}
+	}
+	return rds, iter.Error()
+}
+
+// rangeDelFrag is a fragment of the range tombstones, the key range
+// [start, limit) is covered by the tombstones of the given sequence
+// numbers, in decreasing order.
+type rangeDelFrag struct {
+	start, limit []byte
+	seqs         []uint64
+}
+
+// rangeDelIndex holds range tombstones split into non-overlapping
+// fragments sorted by start, so the tombstones covering a user key are
+// found by binary search. Empty and inverted tombstones cover nothing and
+// are left out.
+type rangeDelIndex []rangeDelFrag
+
+type uint64sDesc []uint64
+
+func (p uint64sDesc) Len() int           { return len(p) }
+func (p uint64sDesc) Less(i, j int) bool { return p[i] > p[j] }
+func (p uint64sDesc) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+type bytesSortByUkey struct {
+	keys [][]byte
+	icmp *iComparer
+}
+
+func (x *bytesSortByUkey) Len() int           { return len(x.keys) }
+func (x *bytesSortByUkey) Less(i, j int) bool { return x.icmp.uCompare(x.keys[i], x.keys[j]) < 0 }
+func (x *bytesSortByUkey) Swap(i, j int)      { x.keys[i], x.keys[j] = x.keys[j], x.keys[i] }
+
+// Fragments the given range tombstones, which are left unmodified.
+func newRangeDelIndex(icmp *iComparer, rds rangeDels) rangeDelIndex {
+	if len(rds) == 0 {
+		return nil
+	}
+	sorted := append(rangeDels{}, rds...)
+	sort.Sort(&rangeDelsSortByStart{rangeDels: sorted, icmp: icmp})
+
+	// Fragment boundaries are the starts and limits of the tombstones.
+	bounds := make([][]byte, 0, 2*len(rds))
+	for i := range rds {
+		bounds = append(bounds, rds[i].start, rds[i].limit)
+	}
+	sort.Sort(&bytesSortByUkey{bounds, icmp})
+	n := 0
+	for i := range bounds {
+		if i == 0 || icmp.uCompare(bounds[i], bounds[n-1]) != 0 {
+			bounds[n] = bounds[i]
+			n++
+		}
+	}
+	bounds = bounds[:n]
+
+	var (
+		idx    rangeDelIndex
+		active rangeDels
+		next   int
+	)
+	for i := 0; i+1 < len(bounds); i++ {
+		start := bounds[i]
+		// Drop the tombstones ending at the fragment start, add the ones
+		// starting there.
+		n := 0
+		for _, rd := range active {
+			if icmp.uCompare(rd.limit, start) > 0 {
+				active[n] = rd
+				n++
+			}
+		}
+		active = active[:n]
+		for ; next < len(sorted) && icmp.uCompare(sorted[next].start, start) <= 0; next++ {
+			if icmp.uCompare(sorted[next].limit, start) > 0 {
+				active = append(active, sorted[next])
+			}
+		}
+		if len(active) == 0 {
+			continue
+		}
+		seqs := make([]uint64, len(active))
+		for j := range active {
+			seqs[j] = active[j].seq
+		}
+		sort.Sort(uint64sDesc(seqs))
+		idx = append(idx, rangeDelFrag{start, bounds[i+1], seqs})
+	}
+	return idx
+}
+
+// Returns the sequence number of the latest tombstone visible at snapshot
+// sequence number snap covering the given user key; ok is false if there
+// is no such tombstone.
+func (idx rangeDelIndex) latest(icmp *iComparer, ukey []byte, snap uint64) (tseq uint64, ok bool) {
+	i := sort.Search(len(idx), func(i int) bool {
+		return icmp.uCompare(idx[i].limit, ukey) > 0
+	})
+	if i == len(idx) || icmp.uCompare(idx[i].start, ukey) > 0 {
+		return 0, false
+	}
+	seqs := idx[i].seqs
+	j := sort.Search(len(seqs), func(j int) bool {
+		return seqs[j] <= snap
+	})
+	if j == len(seqs) {
+		return 0, false
+	}
+	return seqs[j], true
+}
+
+// rangeDelSet is the range tombstones of the memdbs, tables and version a
+// read goes through, indexed per source.
+type rangeDelSet []rangeDelIndex
+
+// Returns true if the entry with given user key and sequence number is
+// hidden by any tombstone visible at snapshot sequence number snap.
+func (s rangeDelSet) covers(icmp *iComparer, ukey []byte, seq, snap uint64) bool {
+	_, ok := s.coveredBy(icmp, ukey, seq, snap)
+	return ok
+}
+
+// Returns the sequence number of the latest tombstone visible at snapshot
+// sequence number snap hiding the entry with given user key and sequence
+// number; ok is false if the entry isn't hidden.
+func (s rangeDelSet) coveredBy(icmp *iComparer, ukey []byte, seq, snap uint64) (tseq uint64, ok bool) {
+	for _, idx := range s {
+		if rseq, rok := idx.latest(icmp, ukey, snap); rok && rseq > seq && rseq > tseq {
+			tseq, ok = rseq, true
+		}
+	}
+	return
+}
+
+// Returns range tombstones of the given memdbs, tables and version.
+func (db *DB) getRangeDels(v *version, auxt tFiles, mems ...*memDB) (s rangeDelSet) {
+	for _, m := range mems {
+		if m != nil {
+			if idx := m.getRangeDelIndex(); idx != nil {
+				s = append(s, idx)
+			}
+		}
+	}
+	for _, t := range auxt {
+		if idx := t.rangeDelIndex(db.s.icmp); idx != nil {
+			s = append(s, idx)
+		}
+	}
+	if v.rdelIdx != nil {
+		s = append(s, v.rdelIdx)
+	}
+	return
+}
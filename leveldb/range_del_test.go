@@ -0,0 +1,48 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestRangeDelIndex(t *testing.T) {
+	icmp := defaultIComparer
+	rnd := rand.New(rand.NewSource(0))
+	key := func(i int) []byte { return []byte(fmt.Sprintf("%02d", i)) }
+
+	for n := 0; n < 100; n++ {
+		var rds rangeDels
+		for i := rnd.Intn(10); i > 0; i-- {
+			// Empty and inverted tombstones are included, they cover
+			// nothing.
+			rds = append(rds, rangeDel{uint64(rnd.Intn(20)), key(rnd.Intn(30)), key(rnd.Intn(30))})
+		}
+		s := rangeDelSet{newRangeDelIndex(icmp, rds[:len(rds)/2]), newRangeDelIndex(icmp, rds[len(rds)/2:])}
+		for k := 0; k < 32; k++ {
+			for seq := uint64(0); seq < 21; seq++ {
+				for snap := uint64(0); snap < 21; snap++ {
+					var want uint64
+					for _, rd := range rds {
+						if rd.seq <= snap && rd.covers(icmp, key(k), seq) && rd.seq > want {
+							want = rd.seq
+						}
+					}
+					got, ok := s.coveredBy(icmp, key(k), seq, snap)
+					if ok != (want > 0) || got != want {
+						t.Fatalf("%v: coveredBy(%s, %d, %d): got %d/%v, want %d", rds, key(k), seq, snap, got, ok, want)
+					}
+					if covers := rds.covers(icmp, key(k), seq, snap); covers != ok {
+						t.Fatalf("%v: covers(%s, %d, %d): got %v, want %v", rds, key(k), seq, snap, covers, ok)
+					}
+				}
+			}
+		}
+	}
+}
@@ -30,7 +30,7 @@ func (e *ErrManifestCorrupted) Error() string {
 }
 
 func newErrManifestCorrupted(fd storage.FileDesc, field, reason string) error {
-	return errors.NewErrCorrupted(fd, &ErrManifestCorrupted{field, reason})
+	return &errors.ErrCorrupted{Fd: fd, Reason: reason, Err: &ErrManifestCorrupted{field, reason}}
 }
 
 // session represent a persistent database session.
@@ -42,20 +42,29 @@ type session struct {
 	stTempFileNum    int64
 	stSeqNum         uint64 // last mem compacted seq; need external synchronization
 
-	stor     storage.Storage
+	stor     *iStorage
 	storLock storage.Locker
 	o        *cachedOptions
+	uo       *opt.Options // options of the tables keyed by user keys, see tFile.gseq
 	icmp     *iComparer
 	tops     *tOps
-	fileRef  map[int64]int
+	logger   opt.Logger
+	tracer   opt.Tracer
+	fileRef  map[storage.FileDesc]int
 
 	manifest       *journal.Writer
-	manifestWriter storage.Writer
+	manifestWriter *journalFile
 	manifestFd     storage.FileDesc
+	manifestBase   int64 // size of the manifest snapshot record
 
-	stCompPtrs []internalKey // compaction pointers; need external synchronization
-	stVersion  *version      // current version
-	vmu        sync.Mutex
+	stCompPtrs    []internalKey     // compaction pointers; need external synchronization
+	stQuarantined []qtRecord        // quarantined tables; need external synchronization
+	stNamedSnaps  map[string]uint64 // named snapshots; need external synchronization
+	stVersion     *version          // current version
+	vmu           sync.Mutex
+
+	// Comparer upgrade allowed on recovery, see DB.upgradeComparer.
+	cmpUpgrade *ErrComparerMismatch
 }
 
 // Creates new initialized session instance.
@@ -68,14 +77,25 @@ func newSession(stor storage.Storage, o *opt.Options) (s *session, err error) {
 		return
 	}
 	s = &session{
-		stor:     stor,
+		stor:     newIStorage(stor),
 		storLock: storLock,
-		fileRef:  make(map[int64]int),
+		fileRef:  make(map[storage.FileDesc]int),
 	}
 	s.setOptions(o)
+	if err = s.o.checkCompression(); err != nil {
+		storLock.Unlock()
+		return nil, err
+	}
+	if err = s.o.checkLevelDBCompatible(); err != nil {
+		storLock.Unlock()
+		return nil, err
+	}
+	if s.logger = o.GetLogger(); s.logger == nil {
+		s.logger = storageLogger{s.stor}
+	}
+	s.tracer = o.GetTracer()
 	s.tops = newTableOps(s)
 	s.setVersion(newVersion(s))
-	s.log("log@legend F·NumFile S·FileSize N·Entry C·BadEntry B·BadBlock Ke·KeyError D·DroppedEntry L·Level Q·SeqNum T·TimeElapsed")
 	return
 }
 
@@ -104,14 +124,38 @@ func (s *session) create() error {
 	return s.newManifest(nil, nil)
 }
 
+// The session state read from the manifest by readManifest, installed by
+// installManifest.
+type manifestState struct {
+	fd         storage.FileDesc
+	rec        *sessionRecord
+	v          *version
+	compPtrs   []internalKey
+	qTables    []qtRecord
+	namedSnaps map[string]uint64
+	vdiscards  map[int64]int64
+	cmpUpgrade *ErrComparerMismatch
+}
+
 // Recover a database session; need external synchronization.
-func (s *session) recover() (err error) {
+func (s *session) recover() error {
+	m, err := s.readManifest()
+	if err != nil {
+		return err
+	}
+	s.installManifest(m)
+	return nil
+}
+
+// Reads the manifest the storage points to, without changing the session
+// state; need external synchronization.
+func (s *session) readManifest() (m *manifestState, err error) {
 	defer func() {
 		if os.IsNotExist(err) {
 			// Don't return os.ErrNotExist if the underlying storage contains
 			// other files that belong to LevelDB. So the DB won't get trashed.
 			if fds, _ := s.stor.List(storage.TypeAll); len(fds) > 0 {
-				err = &errors.ErrCorrupted{Fd: storage.FileDesc{Type: storage.TypeManifest}, Err: &errors.ErrMissingFiles{}}
+				err = &errors.ErrCorrupted{Fd: storage.FileDesc{Type: storage.TypeManifest}, Reason: "file missing", Err: &errors.ErrMissingFiles{}}
 			}
 		}
 	}()
@@ -133,8 +177,9 @@ func (s *session) recover() (err error) {
 
 		jr      = journal.NewReader(reader, dropper{s, fd}, strict, true)
 		rec     = &sessionRecord{}
-		staging = s.stVersion.newStaging()
+		staging = newVersion(s).newStaging()
 	)
+	m = &manifestState{fd: fd, rec: rec}
 	for {
 		var r io.Reader
 		r, err = jr.Next()
@@ -143,47 +188,138 @@ func (s *session) recover() (err error) {
 				err = nil
 				break
 			}
-			return errors.SetFd(err, fd)
+			return nil, errors.SetFd(err, fd)
 		}
 
 		err = rec.decode(r)
 		if err == nil {
 			// save compact pointers
 			for _, r := range rec.compPtrs {
-				s.setCompPtr(r.level, internalKey(r.ikey))
+				if r.level >= len(m.compPtrs) {
+					compPtrs := make([]internalKey, r.level+1)
+					copy(compPtrs, m.compPtrs)
+					m.compPtrs = compPtrs
+				}
+				m.compPtrs[r.level] = append(internalKey{}, r.ikey...)
+			}
+			// save quarantined tables
+			m.qTables = append(m.qTables, rec.qTables...)
+			// save named snapshots
+			for _, name := range rec.delNamedSnaps {
+				delete(m.namedSnaps, name)
+			}
+			for _, r := range rec.namedSnaps {
+				if m.namedSnaps == nil {
+					m.namedSnaps = make(map[string]uint64)
+				}
+				m.namedSnaps[r.name] = r.seq
+			}
+			// save value log discarded bytes
+			for _, r := range rec.vlogDiscards {
+				if m.vdiscards == nil {
+					m.vdiscards = make(map[int64]int64)
+				}
+				m.vdiscards[r.num] = r.discard
 			}
 			// commit record to version staging
 			staging.commit(rec)
 		} else {
 			err = errors.SetFd(err, fd)
 			if strict || !errors.IsCorrupted(err) {
-				return
+				return nil, err
 			}
-			s.logf("manifest error: %v (skipped)", errors.SetFd(err, fd))
+			s.log(opt.LogWarn, "manifest@recovery skipped", "err", errors.SetFd(err, fd))
 		}
 		rec.resetCompPtrs()
 		rec.resetAddedTables()
 		rec.resetDeletedTables()
+		rec.resetQuarantinedTables()
+		rec.resetNamedSnapshots()
+		rec.resetValueLogDiscards()
 	}
 
 	switch {
 	case !rec.has(recComparer):
-		return newErrManifestCorrupted(fd, "comparer", "missing")
-	case rec.comparer != s.icmp.uName():
-		return newErrManifestCorrupted(fd, "comparer", fmt.Sprintf("mismatch: want '%s', got '%s'", s.icmp.uName(), rec.comparer))
+		return nil, newErrManifestCorrupted(fd, "comparer", "missing")
 	case !rec.has(recNextFileNum):
-		return newErrManifestCorrupted(fd, "next-file-num", "missing")
+		return nil, newErrManifestCorrupted(fd, "next-file-num", "missing")
 	case !rec.has(recJournalNum):
-		return newErrManifestCorrupted(fd, "journal-file-num", "missing")
+		return nil, newErrManifestCorrupted(fd, "journal-file-num", "missing")
 	case !rec.has(recSeqNum):
-		return newErrManifestCorrupted(fd, "seq-num", "missing")
+		return nil, newErrManifestCorrupted(fd, "seq-num", "missing")
 	}
 
-	s.manifestFd = fd
-	s.setVersion(staging.finish())
-	s.setNextFileNum(rec.nextFileNum)
-	s.recordCommited(rec)
-	return nil
+	if rec.comparer != s.icmp.uName() || rec.comparerVersion != s.o.GetComparerVersion() {
+		mismatch := &ErrComparerMismatch{rec.comparer, rec.comparerVersion, s.icmp.uName(), s.o.GetComparerVersion()}
+		upgrade := s.o.GetComparerUpgrade()
+		if upgrade == nil || s.o.GetReadOnly() || !upgrade(rec.comparer, rec.comparerVersion) {
+			return nil, mismatch
+		}
+		m.cmpUpgrade = mismatch
+	}
+
+	m.v = staging.finish()
+	return m, nil
+}
+
+// Reads the global sequence numbers of the tables keyed by user keys, see
+// tFile.gseq, from all manifests of the storage. Used by table recovery,
+// the manifests are read as far as possible, corrupted records are skipped.
+func (s *session) readGlobalSeqs() map[int64]uint64 {
+	gseqs := make(map[int64]uint64)
+	fds, _ := s.stor.List(storage.TypeManifest)
+	for _, fd := range fds {
+		reader, err := s.stor.Open(fd)
+		if err != nil {
+			continue
+		}
+		jr := journal.NewReader(reader, nil, false, true)
+		for {
+			r, err := jr.Next()
+			if err != nil {
+				break
+			}
+			rec := &sessionRecord{}
+			rec.decode(r)
+			for _, at := range rec.addedTables {
+				if at.gseq > 0 {
+					gseqs[at.num] = at.gseq
+				}
+			}
+		}
+		reader.Close()
+	}
+	return gseqs
+}
+
+// Installs the manifest state read by readManifest; need external
+// synchronization.
+func (s *session) installManifest(m *manifestState) {
+	s.cmpUpgrade = m.cmpUpgrade
+	s.manifestFd = m.fd
+	for level, ik := range m.compPtrs {
+		if ik != nil {
+			s.setCompPtr(level, ik)
+		}
+	}
+	for _, r := range m.qTables {
+		s.setQuarantined(r)
+	}
+	s.stNamedSnaps = m.namedSnaps
+	// The discarded bytes of the removed value logs are dropped.
+	for _, tables := range m.v.levels {
+		for _, t := range tables {
+			for _, vnum := range t.vlogs {
+				if discard, ok := m.vdiscards[vnum]; ok {
+					s.tops.vlogDiscard(vnum, discard)
+					delete(m.vdiscards, vnum)
+				}
+			}
+		}
+	}
+	s.setVersion(m.v)
+	s.setNextFileNum(m.rec.nextFileNum)
+	s.recordCommited(m.rec)
 }
 
 // Commit session; need external synchronization.
@@ -204,6 +340,7 @@ func (s *session) commit(r *sessionRecord) (err error) {
 	// finally, apply new version if no error rise
 	if err == nil {
 		s.setVersion(nv)
+		s.rolloverManifest()
 	}
 
 	return
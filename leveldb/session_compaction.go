@@ -7,13 +7,23 @@
 package leveldb
 
 import (
+	"sort"
 	"sync/atomic"
 
 	"github.com/FactomProject/goleveldb/leveldb/iterator"
 	"github.com/FactomProject/goleveldb/leveldb/memdb"
 	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
+// Returns true if tables at the given level must not be compacted into
+// the next level, see opt.Options.NumLevel.
+func (s *session) isLastLevel(level int) bool {
+	n := s.o.GetNumLevel()
+	return n > 0 && level >= n-1
+}
+
 func (s *session) pickMemdbLevel(umin, umax []byte, maxLevel int) int {
 	v := s.version()
 	defer v.release()
@@ -40,7 +50,7 @@ func (s *session) flushMemdb(rec *sessionRecord, mdb *memdb.DB, maxLevel int) (i
 	flushLevel := s.pickMemdbLevel(t.imin.ukey(), t.imax.ukey(), maxLevel)
 	rec.addTableFile(flushLevel, t)
 
-	s.logf("memdb@flush created L%d@%d N·%d S·%s %q:%q", flushLevel, t.fd.Num, n, shortenb(int(t.size)), t.imin, t.imax)
+	s.log(opt.LogInfo, "memdb@flush created", "level", flushLevel, "file", t.fd, "entries", n, "size", t.size, "min", t.imin, "max", t.imax)
 	return flushLevel, nil
 }
 
@@ -52,12 +62,24 @@ func (s *session) pickCompaction() *compaction {
 	var t0 tFiles
 	if v.cScore >= 1 {
 		sourceLevel = v.cLevel
+		if sourceLevel == 0 {
+			if c := s.pickIntraL0Compaction(v); c != nil {
+				return c
+			}
+		}
 		cptr := s.getCompPtr(sourceLevel)
 		tables := v.levels[sourceLevel]
-		for _, t := range tables {
-			if cptr == nil || s.icmp.Compare(t.imax, cptr) > 0 {
+		if s.o.GetCompactionPriority() == opt.CompactionPriorityGarbage {
+			if t := tables.maxGarbage(); t != nil {
 				t0 = append(t0, t)
-				break
+			}
+		}
+		if len(t0) == 0 {
+			for _, t := range tables {
+				if cptr == nil || s.icmp.Compare(t.imax, cptr) > 0 {
+					t0 = append(t0, t)
+					break
+				}
 			}
 		}
 		if len(t0) == 0 {
@@ -66,8 +88,18 @@ func (s *session) pickCompaction() *compaction {
 	} else {
 		if p := atomic.LoadPointer(&v.cSeek); p != nil {
 			ts := (*tSet)(p)
+			if s.isLastLevel(ts.level) {
+				v.release()
+				return nil
+			}
 			sourceLevel = ts.level
 			t0 = append(t0, ts.table)
+		} else if ts := v.cGarbage; ts != nil {
+			s.log(opt.LogDebug, "table@compaction garbage", "level", ts.level, "file", ts.table.fd, "ratio", ts.table.garbageRatio())
+			c := newCompaction(s, v, ts.level, tFiles{ts.table})
+			// Moving the table won't drop its garbage.
+			c.garbage = true
+			return c
 		} else {
 			v.release()
 			return nil
@@ -77,11 +109,53 @@ func (s *session) pickCompaction() *compaction {
 	return newCompaction(s, v, sourceLevel, t0)
 }
 
+// Pick an intra level-0 compaction if level-1 is busy, that is it exceeds
+// its total size limit; need external synchronization.
+func (s *session) pickIntraL0Compaction(v *version) *compaction {
+	trigger := s.o.GetCompactionL0IntraTrigger()
+	if trigger == 0 || len(v.levels[0]) < trigger || len(v.levels) < 2 || s.isLastLevel(1) ||
+		v.levels[1].size() < int64(s.o.GetCompactionTotalSize(1)) {
+		return nil
+	}
+
+	// Level-0 tables are sorted newest first, the newest ones are the
+	// small flushed tables.
+	limit := int64(s.o.GetCompactionSourceLimit(0))
+	total := int64(0)
+	var t0 tFiles
+	for _, t := range v.levels[0] {
+		if total+t.size > limit {
+			break
+		}
+		total += t.size
+		t0 = append(t0, t)
+	}
+	if len(t0) < trigger {
+		return nil
+	}
+
+	s.log(opt.LogDebug, "table@compaction intra level-0", "files", len(t0), "size", total)
+	c := &compaction{
+		s:             s,
+		v:             v,
+		sourceLevel:   0,
+		intraL0:       true,
+		levels:        [2]tFiles{t0, nil},
+		maxGPOverlaps: int64(s.o.GetCompactionGPOverlaps(0)),
+		// Merged into a single table.
+		tableSize: int(total) + 1,
+		tPtrs:     make([]int, len(v.levels)),
+	}
+	c.imin, c.imax = t0.getRange(s.icmp)
+	c.save()
+	return c
+}
+
 // Create compaction from given level and range; need external synchronization.
 func (s *session) getCompactionRange(sourceLevel int, umin, umax []byte, noLimit bool) *compaction {
 	v := s.version()
 
-	if sourceLevel >= len(v.levels) {
+	if sourceLevel >= len(v.levels) || s.isLastLevel(sourceLevel) {
 		v.release()
 		return nil
 	}
@@ -102,7 +176,7 @@ func (s *session) getCompactionRange(sourceLevel int, umin, umax []byte, noLimit
 		for i, t := range t0 {
 			total += t.size
 			if total >= limit {
-				s.logf("table@compaction limiting F·%d -> F·%d", len(t0), i+1)
+				s.log(opt.LogDebug, "table@compaction limiting", "files", len(t0), "limitedFiles", i+1)
 				t0 = t0[:i+1]
 				break
 			}
@@ -119,6 +193,7 @@ func newCompaction(s *session, v *version, sourceLevel int, t0 tFiles) *compacti
 		sourceLevel:   sourceLevel,
 		levels:        [2]tFiles{t0, nil},
 		maxGPOverlaps: int64(s.o.GetCompactionGPOverlaps(sourceLevel)),
+		tableSize:     s.o.GetCompactionTableSize(sourceLevel + 1),
 		tPtrs:         make([]int, len(v.levels)),
 	}
 	c.expand()
@@ -132,8 +207,12 @@ type compaction struct {
 	v *version
 
 	sourceLevel   int
+	intraL0       bool
+	garbage       bool
 	levels        [2]tFiles
 	maxGPOverlaps int64
+	tableSize     int
+	exclusive     bool
 
 	gp                tFiles
 	gpi               int
@@ -149,6 +228,26 @@ type compaction struct {
 	snapTPtrs             []int
 }
 
+// Returns the level the compaction outputs to.
+func (c *compaction) outputLevel() int {
+	if c.intraL0 {
+		return c.sourceLevel
+	}
+	return c.sourceLevel + 1
+}
+
+// Returns the input table of the given file descriptor and its level.
+func (c *compaction) inputTable(fd storage.FileDesc) (level int, t *tFile) {
+	for i, tables := range c.levels {
+		for _, t := range tables {
+			if t.fd == fd {
+				return c.sourceLevel + i, t
+			}
+		}
+	}
+	return -1, nil
+}
+
 func (c *compaction) save() {
 	c.snapGPI = c.gpi
 	c.snapSeenKey = c.seenKey
@@ -186,7 +285,8 @@ func (c *compaction) expand() {
 	if len(t0) != len(c.levels[0]) {
 		imin, imax = t0.getRange(c.s.icmp)
 	}
-	t1 = vt1.getOverlaps(t1, c.s.icmp, imin.ukey(), imax.ukey(), false)
+	// Range tombstones may reach beyond imax.
+	t1 = vt1.getOverlaps(t1, c.s.icmp, imin.ukey(), t0.rangeDelLimit(c.s.icmp, imax.ukey()), false)
 	// Get entire range covered by compaction.
 	amin, amax := append(t0, t1...).getRange(c.s.icmp)
 
@@ -196,11 +296,11 @@ func (c *compaction) expand() {
 		exp0 := vt0.getOverlaps(nil, c.s.icmp, amin.ukey(), amax.ukey(), c.sourceLevel == 0)
 		if len(exp0) > len(t0) && t1.size()+exp0.size() < limit {
 			xmin, xmax := exp0.getRange(c.s.icmp)
-			exp1 := vt1.getOverlaps(nil, c.s.icmp, xmin.ukey(), xmax.ukey(), false)
+			exp1 := vt1.getOverlaps(nil, c.s.icmp, xmin.ukey(), exp0.rangeDelLimit(c.s.icmp, xmax.ukey()), false)
 			if len(exp1) == len(t1) {
-				c.s.logf("table@compaction expanding L%d+L%d (F·%d S·%s)+(F·%d S·%s) -> (F·%d S·%s)+(F·%d S·%s)",
-					c.sourceLevel, c.sourceLevel+1, len(t0), shortenb(int(t0.size())), len(t1), shortenb(int(t1.size())),
-					len(exp0), shortenb(int(exp0.size())), len(exp1), shortenb(int(exp1.size())))
+				c.s.log(opt.LogDebug, "table@compaction expanding", "level", c.sourceLevel,
+					"files", len(t0), "size", t0.size(), "targetFiles", len(t1), "targetSize", t1.size(),
+					"expandedFiles", len(exp0), "expandedSize", exp0.size(), "expandedTargetFiles", len(exp1), "expandedTargetSize", exp1.size())
 				imin, imax = xmin, xmax
 				t0, t1 = exp0, exp1
 				amin, amax = append(t0, t1...).getRange(c.s.icmp)
@@ -218,13 +318,59 @@ func (c *compaction) expand() {
 	c.imin, c.imax = imin, imax
 }
 
-// Check whether compaction is trivial.
+// Returns true if any of the compacted tables holds range tombstones.
+func (c *compaction) hasRangeDels() bool {
+	for _, tables := range c.levels {
+		for _, t := range tables {
+			if len(t.rdels) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check whether compaction is trivial, that is the source tables can be
+// moved into the next level as is. They must not overlap the next level nor
+// each other, and each must not overlap too much of the grandparent level.
 func (c *compaction) trivial() bool {
-	return len(c.levels[0]) == 1 && len(c.levels[1]) == 0 && c.gp.size() <= c.maxGPOverlaps
+	if c.intraL0 || c.garbage || len(c.levels[0]) == 0 || len(c.levels[1]) > 0 {
+		return false
+	}
+	if len(c.levels[0]) == 1 {
+		return c.gp.size() <= c.maxGPOverlaps
+	}
+	for i, t := range c.levels[0] {
+		if c.sourceLevel == 0 {
+			for _, x := range c.levels[0][i+1:] {
+				if t.overlaps(c.s.icmp, x.imin.ukey(), x.imax.ukey()) {
+					return false
+				}
+			}
+		}
+		if c.gp.getOverlaps(nil, c.s.icmp, t.imin.ukey(), t.imax.ukey(), false).size() > c.maxGPOverlaps {
+			return false
+		}
+	}
+	return true
 }
 
 func (c *compaction) baseLevelForKey(ukey []byte) bool {
-	for level := c.sourceLevel + 2; level < len(c.v.levels); level++ {
+	if c.intraL0 {
+		// The other level-0 tables may hold the key as well.
+	nextTable:
+		for _, t := range c.v.levels[0] {
+			for _, ct := range c.levels[0] {
+				if ct == t {
+					continue nextTable
+				}
+			}
+			if t.overlaps(c.s.icmp, ukey, ukey) {
+				return false
+			}
+		}
+	}
+	for level := c.outputLevel() + 1; level < len(c.v.levels); level++ {
 		tables := c.v.levels[level]
 		for c.tPtrs[level] < len(tables) {
 			t := tables[c.tPtrs[level]]
@@ -242,7 +388,33 @@ func (c *compaction) baseLevelForKey(ukey []byte) bool {
 	return true
 }
 
-func (c *compaction) shouldStopBefore(ikey internalKey) bool {
+// Returns true if no table outside of this compaction overlaps given
+// range, so the range tombstone covering it is no longer needed once its
+// covered entries being dropped by this compaction.
+func (c *compaction) rangeDelObsolete(start, limit []byte) bool {
+	for level, tables := range c.v.levels {
+	nextTable:
+		for _, t := range tables {
+			if c.s.icmp.uCompare(t.imin.ukey(), limit) >= 0 || c.s.icmp.uCompare(t.imax.ukey(), start) < 0 {
+				continue
+			}
+			if i := level - c.sourceLevel; i == 0 || i == 1 {
+				for _, ct := range c.levels[i] {
+					if ct == t {
+						continue nextTable
+					}
+				}
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if the current output, of the given size, should end before
+// the given key.
+func (c *compaction) shouldStopBefore(ikey internalKey, size int) bool {
+	var gpBoundary bool
 	for ; c.gpi < len(c.gp); c.gpi++ {
 		gp := c.gp[c.gpi]
 		if c.s.icmp.Compare(ikey, gp.imax) <= 0 {
@@ -250,20 +422,94 @@ func (c *compaction) shouldStopBefore(ikey internalKey) bool {
 		}
 		if c.seenKey {
 			c.gpOverlappedBytes += gp.size
+			gpBoundary = true
 		}
 	}
 	c.seenKey = true
 
-	if c.gpOverlappedBytes > c.maxGPOverlaps {
-		// Too much overlap for current output; start new output.
+	// Too much overlap for current output, or the output is large enough
+	// to end at the boundary of a grandparent table, so it overlaps fewer
+	// grandparent tables; start new output.
+	if c.gpOverlappedBytes > c.maxGPOverlaps || (gpBoundary && size >= c.tableSize/2) {
 		c.gpOverlappedBytes = 0
 		return true
 	}
 	return false
 }
 
+// Creates a compaction of a key range of this compaction, to be compacted
+// concurrently with other key ranges. The subcompaction shares the version
+// of this compaction, and should not be released.
+func (c *compaction) subcompaction() *compaction {
+	sc := *c
+	sc.gpi, sc.seenKey, sc.gpOverlappedBytes = 0, false, 0
+	sc.tPtrs = make([]int, len(c.tPtrs))
+	sc.snapTPtrs = nil
+	sc.save()
+	return &sc
+}
+
+type splitPoint struct {
+	ukey []byte
+	size int64
+}
+
+type splitPoints struct {
+	icmp   *iComparer
+	points []splitPoint
+}
+
+func (p *splitPoints) Len() int {
+	return len(p.points)
+}
+
+func (p *splitPoints) Less(i, j int) bool {
+	return p.icmp.uCompare(p.points[i].ukey, p.points[j].ukey) < 0
+}
+
+func (p *splitPoints) Swap(i, j int) {
+	p.points[i], p.points[j] = p.points[j], p.points[i]
+}
+
+// Returns up to n-1 user keys splitting the compaction into key ranges of
+// about the same input size. Tables are assumed to be evenly distributed
+// over their key range.
+func (c *compaction) split(n int) (ukeys [][]byte) {
+	p := &splitPoints{icmp: c.s.icmp}
+	var total int64
+	for _, tables := range c.levels {
+		for _, t := range tables {
+			p.points = append(p.points, splitPoint{t.imin.ukey(), t.size})
+			total += t.size
+		}
+	}
+	sort.Sort(p)
+
+	var (
+		size   int64
+		target = total / int64(n)
+	)
+	for i, pt := range p.points {
+		if i > 0 && size >= target*int64(len(ukeys)+1) {
+			// The split key must be greater than the previous one.
+			prev := p.points[0].ukey
+			if len(ukeys) > 0 {
+				prev = ukeys[len(ukeys)-1]
+			}
+			if c.s.icmp.uCompare(pt.ukey, prev) > 0 {
+				ukeys = append(ukeys, pt.ukey)
+				if len(ukeys) == n-1 {
+					break
+				}
+			}
+		}
+		size += pt.size
+	}
+	return
+}
+
 // Creates an iterator.
-func (c *compaction) newIterator() iterator.Iterator {
+func (c *compaction) newIterator(slice *util.Range) iterator.Iterator {
 	// Creates iterator slice.
 	icap := len(c.levels)
 	if c.sourceLevel == 0 {
@@ -277,7 +523,8 @@ func (c *compaction) newIterator() iterator.Iterator {
 		DontFillCache: true,
 		Strict:        opt.StrictOverride,
 	}
-	strict := c.s.o.GetStrict(opt.StrictCompaction)
+	// Corrupted block fails the compaction, unless it is to be dropped.
+	strict := c.s.o.GetStrict(opt.StrictCompaction) || c.s.o.GetCorruptionPolicy() == opt.CorruptionQuarantine
 	if strict {
 		ro.Strict |= opt.StrictReader
 	}
@@ -290,10 +537,10 @@ func (c *compaction) newIterator() iterator.Iterator {
 		// Level-0 is not sorted and may overlaps each other.
 		if c.sourceLevel+i == 0 {
 			for _, t := range tables {
-				its = append(its, c.s.tops.newIterator(t, nil, ro))
+				its = append(its, c.s.tops.newIterator(t, slice, ro))
 			}
 		} else {
-			it := iterator.NewIndexedIterator(tables.newIndexIterator(c.s.tops, c.s.icmp, nil, ro), strict)
+			it := iterator.NewIndexedIterator(tables.newIndexIterator(c.s.tops, c.s.icmp, slice, ro, nil), strict)
 			its = append(its, it)
 		}
 	}
@@ -12,7 +12,6 @@ import (
 	"io"
 	"strings"
 
-	"github.com/FactomProject/goleveldb/leveldb/errors"
 	"github.com/FactomProject/goleveldb/leveldb/storage"
 )
 
@@ -31,7 +30,15 @@ const (
 	recDelTable    = 6
 	recAddTable    = 7
 	// 8 was used for large value refs
-	recPrevJournalNum = 9
+	recPrevJournalNum   = 9
+	recRangeDel         = 10
+	recValueLogRef      = 11
+	recQuarantinedTable = 12
+	recNamedSnapshot    = 13
+	recDelNamedSnapshot = 14
+	recComparerVersion  = 15
+	recValueLogDiscard  = 16
+	recTableGlobalSeq   = 17
 )
 
 type cpRecord struct {
@@ -45,6 +52,11 @@ type atRecord struct {
 	size  int64
 	imin  internalKey
 	imax  internalKey
+	rdels rangeDels
+	vlogs []int64
+	gseq  uint64
+	// Not persisted, see tFile.garbageRatio.
+	garbage float64
 }
 
 type dtRecord struct {
@@ -52,16 +64,40 @@ type dtRecord struct {
 	num   int64
 }
 
+// qtRecord is a table excluded from the version due to corruption, the
+// table file and its value logs are kept for repair.
+type qtRecord struct {
+	num   int64
+	vlogs []int64
+}
+
+// vdRecord is the bytes of a value log discarded by compactions so far.
+type vdRecord struct {
+	num     int64
+	discard int64
+}
+
+// nsRecord is a named snapshot, see DB.CreateNamedSnapshot.
+type nsRecord struct {
+	name string
+	seq  uint64
+}
+
 type sessionRecord struct {
-	hasRec         int
-	comparer       string
-	journalNum     int64
-	prevJournalNum int64
-	nextFileNum    int64
-	seqNum         uint64
-	compPtrs       []cpRecord
-	addedTables    []atRecord
-	deletedTables  []dtRecord
+	hasRec          int
+	comparer        string
+	comparerVersion uint64
+	journalNum      int64
+	prevJournalNum  int64
+	nextFileNum     int64
+	seqNum          uint64
+	compPtrs        []cpRecord
+	addedTables     []atRecord
+	deletedTables   []dtRecord
+	qTables         []qtRecord
+	namedSnaps      []nsRecord
+	delNamedSnaps   []string
+	vlogDiscards    []vdRecord
 
 	scratch [binary.MaxVarintLen64]byte
 	err     error
@@ -76,6 +112,11 @@ func (p *sessionRecord) setComparer(name string) {
 	p.comparer = name
 }
 
+func (p *sessionRecord) setComparerVersion(version uint64) {
+	p.hasRec |= 1 << recComparerVersion
+	p.comparerVersion = version
+}
+
 func (p *sessionRecord) setJournalNum(num int64) {
 	p.hasRec |= 1 << recJournalNum
 	p.journalNum = num
@@ -108,11 +149,59 @@ func (p *sessionRecord) resetCompPtrs() {
 
 func (p *sessionRecord) addTable(level int, num, size int64, imin, imax internalKey) {
 	p.hasRec |= 1 << recAddTable
-	p.addedTables = append(p.addedTables, atRecord{level, num, size, imin, imax})
+	p.addedTables = append(p.addedTables, atRecord{level, num, size, imin, imax, nil, nil, 0, 0})
 }
 
 func (p *sessionRecord) addTableFile(level int, t *tFile) {
 	p.addTable(level, t.fd.Num, t.size, t.imin, t.imax)
+	p.addedTables[len(p.addedTables)-1].rdels = t.rdels
+	p.addedTables[len(p.addedTables)-1].vlogs = t.vlogs
+	p.addedTables[len(p.addedTables)-1].gseq = t.gseq
+	p.addedTables[len(p.addedTables)-1].garbage = t.garbageRatio()
+}
+
+// Attaches range tombstone to the added table, returns false if
+// there is no such table.
+func (p *sessionRecord) addRangeDel(level int, num int64, rd rangeDel) bool {
+	for i := len(p.addedTables) - 1; i >= 0; i-- {
+		if r := &p.addedTables[i]; r.level == level && r.num == num {
+			r.rdels = append(r.rdels, rd)
+			return true
+		}
+	}
+	return false
+}
+
+// Attaches value log reference to the added table, returns false if
+// there is no such table.
+func (p *sessionRecord) addValueLogRef(level int, num, vnum int64) bool {
+	for i := len(p.addedTables) - 1; i >= 0; i-- {
+		if r := &p.addedTables[i]; r.level == level && r.num == num {
+			r.vlogs = append(r.vlogs, vnum)
+			return true
+		}
+	}
+	return false
+}
+
+// Sets global sequence number of the added table, returns false if
+// there is no such table.
+func (p *sessionRecord) setTableGlobalSeq(level int, num int64, gseq uint64) bool {
+	for i := len(p.addedTables) - 1; i >= 0; i-- {
+		if r := &p.addedTables[i]; r.level == level && r.num == num {
+			r.gseq = gseq
+			return true
+		}
+	}
+	return false
+}
+
+// Appends the added tables of the given record.
+func (p *sessionRecord) addTables(r *sessionRecord) {
+	if len(r.addedTables) > 0 {
+		p.hasRec |= 1 << recAddTable
+		p.addedTables = append(p.addedTables, r.addedTables...)
+	}
 }
 
 func (p *sessionRecord) resetAddedTables() {
@@ -130,6 +219,53 @@ func (p *sessionRecord) resetDeletedTables() {
 	p.deletedTables = p.deletedTables[:0]
 }
 
+func (p *sessionRecord) addQuarantinedTable(num int64, vlogs []int64) {
+	p.hasRec |= 1 << recQuarantinedTable
+	p.qTables = append(p.qTables, qtRecord{num, vlogs})
+}
+
+func (p *sessionRecord) resetQuarantinedTables() {
+	p.hasRec &= ^(1 << recQuarantinedTable)
+	p.qTables = p.qTables[:0]
+}
+
+func (p *sessionRecord) addNamedSnapshot(name string, seq uint64) {
+	p.hasRec |= 1 << recNamedSnapshot
+	p.namedSnaps = append(p.namedSnaps, nsRecord{name, seq})
+}
+
+func (p *sessionRecord) delNamedSnapshot(name string) {
+	p.hasRec |= 1 << recDelNamedSnapshot
+	p.delNamedSnaps = append(p.delNamedSnaps, name)
+}
+
+func (p *sessionRecord) resetNamedSnapshots() {
+	p.hasRec &= ^(1<<recNamedSnapshot | 1<<recDelNamedSnapshot)
+	p.namedSnaps = p.namedSnaps[:0]
+	p.delNamedSnaps = p.delNamedSnaps[:0]
+}
+
+func (p *sessionRecord) addValueLogDiscard(num, discard int64) {
+	p.hasRec |= 1 << recValueLogDiscard
+	p.vlogDiscards = append(p.vlogDiscards, vdRecord{num, discard})
+}
+
+// Returns true if the record holds the discarded bytes of the given value
+// log.
+func (p *sessionRecord) hasValueLogDiscard(num int64) bool {
+	for _, r := range p.vlogDiscards {
+		if r.num == num {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *sessionRecord) resetValueLogDiscards() {
+	p.hasRec &= ^(1 << recValueLogDiscard)
+	p.vlogDiscards = p.vlogDiscards[:0]
+}
+
 func (p *sessionRecord) putUvarint(w io.Writer, x uint64) {
 	if p.err != nil {
 		return
@@ -162,6 +298,10 @@ func (p *sessionRecord) encode(w io.Writer) error {
 		p.putUvarint(w, recComparer)
 		p.putBytes(w, []byte(p.comparer))
 	}
+	if p.has(recComparerVersion) {
+		p.putUvarint(w, recComparerVersion)
+		p.putUvarint(w, p.comparerVersion)
+	}
 	if p.has(recJournalNum) {
 		p.putUvarint(w, recJournalNum)
 		p.putVarint(w, p.journalNum)
@@ -191,6 +331,48 @@ func (p *sessionRecord) encode(w io.Writer) error {
 		p.putVarint(w, r.size)
 		p.putBytes(w, r.imin)
 		p.putBytes(w, r.imax)
+		for _, rd := range r.rdels {
+			p.putUvarint(w, recRangeDel)
+			p.putUvarint(w, uint64(r.level))
+			p.putVarint(w, r.num)
+			p.putUvarint(w, rd.seq)
+			p.putBytes(w, rd.start)
+			p.putBytes(w, rd.limit)
+		}
+		for _, vnum := range r.vlogs {
+			p.putUvarint(w, recValueLogRef)
+			p.putUvarint(w, uint64(r.level))
+			p.putVarint(w, r.num)
+			p.putVarint(w, vnum)
+		}
+		if r.gseq > 0 {
+			p.putUvarint(w, recTableGlobalSeq)
+			p.putUvarint(w, uint64(r.level))
+			p.putVarint(w, r.num)
+			p.putUvarint(w, r.gseq)
+		}
+	}
+	for _, r := range p.qTables {
+		p.putUvarint(w, recQuarantinedTable)
+		p.putVarint(w, r.num)
+		p.putUvarint(w, uint64(len(r.vlogs)))
+		for _, vnum := range r.vlogs {
+			p.putVarint(w, vnum)
+		}
+	}
+	for _, name := range p.delNamedSnaps {
+		p.putUvarint(w, recDelNamedSnapshot)
+		p.putBytes(w, []byte(name))
+	}
+	for _, r := range p.namedSnaps {
+		p.putUvarint(w, recNamedSnapshot)
+		p.putBytes(w, []byte(r.name))
+		p.putUvarint(w, r.seq)
+	}
+	for _, r := range p.vlogDiscards {
+		p.putUvarint(w, recValueLogDiscard)
+		p.putVarint(w, r.num)
+		p.putVarint(w, r.discard)
 	}
 	return p.err
 }
@@ -202,9 +384,9 @@ func (p *sessionRecord) readUvarintMayEOF(field string, r io.ByteReader, mayEOF
 	x, err := binary.ReadUvarint(r)
 	if err != nil {
 		if err == io.ErrUnexpectedEOF || (mayEOF == false && err == io.EOF) {
-			p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{field, "short read"})
+			p.err = newErrManifestCorrupted(storage.FileDesc{}, field, "short read")
 		} else if strings.HasPrefix(err.Error(), "binary:") {
-			p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{field, err.Error()})
+			p.err = newErrManifestCorrupted(storage.FileDesc{}, field, err.Error())
 		} else {
 			p.err = err
 		}
@@ -220,7 +402,7 @@ func (p *sessionRecord) readUvarint(field string, r io.ByteReader) uint64 {
 func (p *sessionRecord) readVarint(field string, r io.ByteReader) int64 {
 	x := int64(p.readUvarintMayEOF(field, r, false))
 	if x < 0 {
-		p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{field, "invalid negative value"})
+		p.err = newErrManifestCorrupted(storage.FileDesc{}, field, "invalid negative value")
 	}
 	return x
 }
@@ -237,7 +419,7 @@ func (p *sessionRecord) readBytes(field string, r byteReader) []byte {
 	_, p.err = io.ReadFull(r, x)
 	if p.err != nil {
 		if p.err == io.ErrUnexpectedEOF {
-			p.err = errors.NewErrCorrupted(storage.FileDesc{}, &ErrManifestCorrupted{field, "short read"})
+			p.err = newErrManifestCorrupted(storage.FileDesc{}, field, "short read")
 		}
 		return nil
 	}
@@ -275,6 +457,11 @@ func (p *sessionRecord) decode(r io.Reader) error {
 			if p.err == nil {
 				p.setComparer(string(x))
 			}
+		case recComparerVersion:
+			x := p.readUvarint("comparer-version", br)
+			if p.err == nil {
+				p.setComparerVersion(x)
+			}
 		case recJournalNum:
 			x := p.readVarint("journal-num", br)
 			if p.err == nil {
@@ -310,12 +497,62 @@ func (p *sessionRecord) decode(r io.Reader) error {
 			if p.err == nil {
 				p.addTable(level, num, size, imin, imax)
 			}
+		case recRangeDel:
+			level := p.readLevel("range-del.level", br)
+			num := p.readVarint("range-del.num", br)
+			seq := p.readUvarint("range-del.seq", br)
+			start := p.readBytes("range-del.start", br)
+			limit := p.readBytes("range-del.limit", br)
+			if p.err == nil && !p.addRangeDel(level, num, rangeDel{seq, start, limit}) {
+				p.err = newErrManifestCorrupted(storage.FileDesc{}, "range-del", "no such table")
+			}
+		case recValueLogRef:
+			level := p.readLevel("value-log-ref.level", br)
+			num := p.readVarint("value-log-ref.num", br)
+			vnum := p.readVarint("value-log-ref.vnum", br)
+			if p.err == nil && !p.addValueLogRef(level, num, vnum) {
+				p.err = newErrManifestCorrupted(storage.FileDesc{}, "value-log-ref", "no such table")
+			}
+		case recTableGlobalSeq:
+			level := p.readLevel("table-global-seq.level", br)
+			num := p.readVarint("table-global-seq.num", br)
+			gseq := p.readUvarint("table-global-seq.seq", br)
+			if p.err == nil && !p.setTableGlobalSeq(level, num, gseq) {
+				p.err = newErrManifestCorrupted(storage.FileDesc{}, "table-global-seq", "no such table")
+			}
 		case recDelTable:
 			level := p.readLevel("del-table.level", br)
 			num := p.readVarint("del-table.num", br)
 			if p.err == nil {
 				p.delTable(level, num)
 			}
+		case recQuarantinedTable:
+			num := p.readVarint("quarantined-table.num", br)
+			n := p.readUvarint("quarantined-table.vlogs", br)
+			var vlogs []int64
+			for i := uint64(0); i < n && p.err == nil; i++ {
+				vlogs = append(vlogs, p.readVarint("quarantined-table.vnum", br))
+			}
+			if p.err == nil {
+				p.addQuarantinedTable(num, vlogs)
+			}
+		case recNamedSnapshot:
+			name := p.readBytes("named-snapshot.name", br)
+			seq := p.readUvarint("named-snapshot.seq", br)
+			if p.err == nil {
+				p.addNamedSnapshot(string(name), seq)
+			}
+		case recDelNamedSnapshot:
+			name := p.readBytes("del-named-snapshot.name", br)
+			if p.err == nil {
+				p.delNamedSnapshot(string(name))
+			}
+		case recValueLogDiscard:
+			num := p.readVarint("value-log-discard.num", br)
+			discard := p.readVarint("value-log-discard.discard", br)
+			if p.err == nil {
+				p.addValueLogDiscard(num, discard)
+			}
 		}
 	}
 
@@ -8,6 +8,7 @@ package leveldb
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 )
 
@@ -49,11 +50,18 @@ func TestSessionRecord_EncodeDecode(t *testing.T) {
 		v.addTable(3, big+300+i, big+400+i,
 			makeInternalKey(nil, []byte("foo"), uint64(big+500+1), keyTypeVal),
 			makeInternalKey(nil, []byte("zoo"), uint64(big+600+1), keyTypeDel))
+		v.addRangeDel(3, big+300+i, rangeDel{uint64(big + 800 + i), []byte("goo"), []byte("moo")})
+		v.setTableGlobalSeq(3, big+300+i, uint64(big+850+i))
 		v.delTable(4, big+700+i)
+		v.addQuarantinedTable(big+1000+i, []int64{big + 1100 + i})
+		v.addNamedSnapshot(fmt.Sprintf("snap%d", i), uint64(big+1200+i))
+		v.delNamedSnapshot(fmt.Sprintf("snap%d", i+1))
+		v.addValueLogDiscard(big+1300+i, big+1400+i)
 		v.addCompPtr(int(i), makeInternalKey(nil, []byte("x"), uint64(big+900+1), keyTypeVal))
 	}
 
 	v.setComparer("foo")
+	v.setComparerVersion(uint64(big + 50))
 	v.setJournalNum(big + 100)
 	v.setPrevJournalNum(big + 99)
 	v.setNextFileNum(big + 200)
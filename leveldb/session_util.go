@@ -7,10 +7,14 @@
 package leveldb
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"sort"
 	"sync/atomic"
 
 	"github.com/FactomProject/goleveldb/leveldb/journal"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
 	"github.com/FactomProject/goleveldb/leveldb/storage"
 )
 
@@ -23,14 +27,67 @@ type dropper struct {
 
 func (d dropper) Drop(err error) {
 	if e, ok := err.(*journal.ErrCorrupted); ok {
-		d.s.logf("journal@drop %s-%d S·%s %q", d.fd.Type, d.fd.Num, shortenb(e.Size), e.Reason)
+		d.s.log(opt.LogWarn, "journal@drop", "file", d.fd, "offset", e.Offset, "size", e.Size, "reason", e.Reason)
 	} else {
-		d.s.logf("journal@drop %s-%d %q", d.fd.Type, d.fd.Num, err)
+		d.s.log(opt.LogWarn, "journal@drop", "file", d.fd, "err", err)
 	}
 }
 
-func (s *session) log(v ...interface{})                 { s.stor.Log(fmt.Sprint(v...)) }
-func (s *session) logf(format string, v ...interface{}) { s.stor.Log(fmt.Sprintf(format, v...)) }
+// recoveryDropper is the dropper of the journal recovery, it records the
+// first dropped chunk so it can be handled, and logged, by the
+// journalReplay.
+type recoveryDropper struct {
+	err error
+}
+
+func (d *recoveryDropper) Drop(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// storageLogger writes the log messages to the storage log, one line per
+// message formatted as 'level msg key=value ...'.
+type storageLogger struct {
+	stor storage.Storage
+}
+
+func (l storageLogger) Log(level opt.LogLevel, msg string, keyvals ...interface{}) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%-5s %s", level, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		var v interface{} = "(missing)"
+		if i+1 < len(keyvals) {
+			v = keyvals[i+1]
+		}
+		switch v.(type) {
+		case string, error, internalKey:
+			fmt.Fprintf(&buf, " %v=%q", keyvals[i], v)
+		default:
+			fmt.Fprintf(&buf, " %v=%v", keyvals[i], v)
+		}
+	}
+	l.stor.Log(buf.String())
+}
+
+func (s *session) log(level opt.LogLevel, msg string, keyvals ...interface{}) {
+	s.logger.Log(level, msg, keyvals...)
+}
+
+// Tracing.
+
+func (s *session) traceStart(ctx context.Context, info opt.TraceInfo) context.Context {
+	if s.tracer == nil {
+		return ctx
+	}
+	return s.tracer.Start(ctx, info)
+}
+
+func (s *session) traceEnd(ctx context.Context, info opt.TraceInfo, err error) {
+	if s.tracer != nil {
+		s.tracer.End(ctx, info, err)
+	}
+}
 
 // File utils.
 
@@ -40,11 +97,11 @@ func (s *session) newTemp() storage.FileDesc {
 }
 
 func (s *session) addFileRef(fd storage.FileDesc, ref int) int {
-	ref += s.fileRef[fd.Num]
+	ref += s.fileRef[fd]
 	if ref > 0 {
-		s.fileRef[fd.Num] = ref
+		s.fileRef[fd] = ref
 	} else if ref == 0 {
-		delete(s.fileRef, fd.Num)
+		delete(s.fileRef, fd)
 	} else {
 		panic(fmt.Sprintf("negative ref: %v", fd))
 	}
@@ -80,6 +137,7 @@ func (s *session) setVersion(v *version) {
 		s.stVersion.releaseNB()
 	}
 	s.stVersion = v
+	s.tops.setBottomLevel(v.bottomLevel())
 }
 
 // Get current unused file number.
@@ -164,7 +222,25 @@ func (s *session) fillRecord(r *sessionRecord, snapshot bool) {
 			}
 		}
 
+		for _, qt := range s.stQuarantined {
+			r.addQuarantinedTable(qt.num, qt.vlogs)
+		}
+
+		names := make([]string, 0, len(s.stNamedSnaps))
+		for name := range s.stNamedSnaps {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			r.addNamedSnapshot(name, s.stNamedSnaps[name])
+		}
+
 		r.setComparer(s.icmp.uName())
+		if version := s.o.GetComparerVersion(); version > 0 {
+			r.setComparerVersion(version)
+		}
+
+		s.tops.fillVlogDiscards(r)
 	}
 }
 
@@ -186,15 +262,58 @@ func (s *session) recordCommited(rec *sessionRecord) {
 	for _, r := range rec.compPtrs {
 		s.setCompPtr(r.level, internalKey(r.ikey))
 	}
+
+	for _, r := range rec.qTables {
+		s.setQuarantined(r)
+	}
+
+	s.setNamedSnapshots(rec)
+
+	for _, r := range rec.vlogDiscards {
+		s.tops.vlogDiscard(r.num, r.discard)
+	}
+}
+
+// Applies named snapshots created or released by the given record; need
+// external synchronization.
+func (s *session) setNamedSnapshots(rec *sessionRecord) {
+	for _, name := range rec.delNamedSnaps {
+		delete(s.stNamedSnaps, name)
+	}
+	for _, r := range rec.namedSnaps {
+		if s.stNamedSnaps == nil {
+			s.stNamedSnaps = make(map[string]uint64)
+		}
+		s.stNamedSnaps[r.name] = r.seq
+	}
+}
+
+// Marks the table as quarantined. Quarantined table file and its value
+// logs are held, so they are never removed; need external synchronization.
+func (s *session) setQuarantined(r qtRecord) {
+	for _, qt := range s.stQuarantined {
+		if qt.num == r.num {
+			return
+		}
+	}
+	s.stQuarantined = append(s.stQuarantined, r)
+
+	s.vmu.Lock()
+	s.addFileRef(storage.FileDesc{Type: storage.TypeTable, Num: r.num}, 1)
+	for _, vnum := range r.vlogs {
+		s.addFileRef(storage.FileDesc{Type: storage.TypeValueLog, Num: vnum}, 1)
+	}
+	s.vmu.Unlock()
 }
 
 // Create a new manifest file; need external synchronization.
 func (s *session) newManifest(rec *sessionRecord, v *version) (err error) {
 	fd := storage.FileDesc{storage.TypeManifest, s.allocFileNum()}
-	writer, err := s.stor.Create(fd)
+	w0, err := s.stor.Create(fd)
 	if err != nil {
 		return
 	}
+	writer := &journalFile{Writer: w0}
 	jw := journal.NewWriter(writer)
 
 	if v == nil {
@@ -221,6 +340,7 @@ func (s *session) newManifest(rec *sessionRecord, v *version) (err error) {
 			}
 			s.manifestFd = fd
 			s.manifestWriter = writer
+			s.manifestBase = writer.size
 			s.manifest = jw
 		} else {
 			writer.Close()
@@ -241,12 +361,46 @@ func (s *session) newManifest(rec *sessionRecord, v *version) (err error) {
 	if err != nil {
 		return
 	}
+	// The manifest must be durable before it is made current, regardless
+	// of NoSync, otherwise the DB may not open after a crash.
+	err = writer.Sync()
+	if err != nil {
+		return
+	}
 	err = s.stor.SetMeta(fd)
 	return
 }
 
+// Writes a new manifest file holding a snapshot of the current state if the
+// manifest file is too large, see opt.Options.MaxManifestFileSize; need
+// external synchronization. The manifest file is replaced only once the
+// new one is written and set as current, failure is not fatal as the
+// records are already written to the old one.
+func (s *session) rolloverManifest() {
+	max := int64(s.o.GetMaxManifestFileSize())
+	size := s.manifestWriter.size
+	if max <= 0 || size < max || size < 2*s.manifestBase {
+		return
+	}
+	oldFd := s.manifestFd
+	if err := s.newManifest(nil, nil); err != nil {
+		s.log(opt.LogWarn, "manifest@rollover failed", "file", oldFd, "size", size, "err", err)
+		return
+	}
+	s.log(opt.LogInfo, "manifest@rollover done", "file", oldFd, "size", size, "newFile", s.manifestFd, "newSize", s.manifestBase)
+}
+
 // Flush record to disk.
 func (s *session) flushManifest(rec *sessionRecord) (err error) {
+	// Sync the storage so the added tables are found after a crash once
+	// the record is. The storage is synced even if no table is added, so
+	// the tables closed before the previous record was synced, which may
+	// be added by a concurrent compaction, are always synced by now.
+	if !s.o.GetNoSync() {
+		if err = s.stor.Sync(); err != nil {
+			return
+		}
+	}
 	s.fillRecord(rec, false)
 	w, err := s.manifest.Next()
 	if err != nil {
@@ -0,0 +1,140 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"sync/atomic"
+
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+)
+
+// iStorage wraps storage.Storage and counts the bytes read from and
+// written to its files.
+type iStorage struct {
+	read  uint64
+	write uint64
+	storage.Storage
+}
+
+func (c *iStorage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	r, err := c.Storage.Open(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &iStorageReader{r, c}, nil
+}
+
+func (c *iStorage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	w, err := c.Storage.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &iStorageWriter{w, c}, nil
+}
+
+func (c *iStorage) Recycle(oldfd, newfd storage.FileDesc) (storage.Writer, error) {
+	rs, ok := c.Storage.(storage.Recycler)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	w, err := rs.Recycle(oldfd, newfd)
+	if err != nil {
+		return nil, err
+	}
+	return &iStorageWriter{w, c}, nil
+}
+
+// Sync syncs the storage if it implements storage.Syncer, otherwise it is
+// a no-op.
+func (c *iStorage) Sync() error {
+	if s, ok := c.Storage.(storage.Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+func (c *iStorage) reads() uint64 {
+	return atomic.LoadUint64(&c.read)
+}
+
+func (c *iStorage) writes() uint64 {
+	return atomic.LoadUint64(&c.write)
+}
+
+func newIStorage(s storage.Storage) *iStorage {
+	return &iStorage{Storage: s}
+}
+
+type iStorageReader struct {
+	storage.Reader
+	c *iStorage
+}
+
+func (r *iStorageReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	atomic.AddUint64(&r.c.read, uint64(n))
+	return n, err
+}
+
+func (r *iStorageReader) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = r.Reader.ReadAt(p, off)
+	atomic.AddUint64(&r.c.read, uint64(n))
+	return n, err
+}
+
+func (r *iStorageReader) Mmap() ([]byte, error) {
+	if mr, ok := r.Reader.(storage.MmapReader); ok {
+		return mr.Mmap()
+	}
+	return nil, storage.ErrNotSupported
+}
+
+func (r *iStorageReader) DropCache() error {
+	if cd, ok := r.Reader.(storage.CacheDropper); ok {
+		return cd.DropCache()
+	}
+	return storage.ErrNotSupported
+}
+
+type iStorageWriter struct {
+	storage.Writer
+	c *iStorage
+}
+
+func (w *iStorageWriter) Write(p []byte) (n int, err error) {
+	n, err = w.Writer.Write(p)
+	atomic.AddUint64(&w.c.write, uint64(n))
+	return n, err
+}
+
+func (w *iStorageWriter) DropCache() error {
+	if cd, ok := w.Writer.(storage.CacheDropper); ok {
+		return cd.DropCache()
+	}
+	return storage.ErrNotSupported
+}
+
+func (w *iStorageWriter) Truncate(size int64) error {
+	if tw, ok := w.Writer.(storage.Truncater); ok {
+		return tw.Truncate(size)
+	}
+	return storage.ErrNotSupported
+}
+
+func (w *iStorageWriter) SyncRange(off, n int64) error {
+	if rw, ok := w.Writer.(storage.RangeSyncer); ok {
+		return rw.SyncRange(off, n)
+	}
+	return storage.ErrNotSupported
+}
+
+func (w *iStorageWriter) Preallocate(size int64) error {
+	if pw, ok := w.Writer.(storage.Preallocator); ok {
+		return pw.Preallocate(size)
+	}
+	return storage.ErrNotSupported
+}
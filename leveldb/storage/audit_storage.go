@@ -0,0 +1,257 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"fmt"
+	"sync"
+)
+
+type auditOp int
+
+const (
+	auditCreate auditOp = iota
+	auditRename
+	auditRemove
+)
+
+func (op auditOp) String() string {
+	switch op {
+	case auditCreate:
+		return "created"
+	case auditRename:
+		return "renamed"
+	}
+	return "removed"
+}
+
+type auditStorage struct {
+	Storage
+	onViolation func(msg string)
+
+	mu sync.Mutex
+	// The files created, renamed or removed since the directory was
+	// last synced.
+	pending map[FileDesc]auditOp
+	// The manifest syncs before which the tables were closed.
+	closed map[FileDesc]int
+	meta   FileDesc
+	syncs  int
+}
+
+// NewDurabilityAudit returns a storage that audits whether the creation,
+// renaming and removal of the files of the given base storage is made
+// durable, by syncing the directory, before the DB depends on it. That is:
+//
+//   - A journal is synced only after its creation is.
+//   - A table is referenced by the current manifest, once the manifest is
+//     synced, only after its creation is. As the tables referenced by a
+//     record may be closed while the previous record is synced, a table is
+//     checked at the second manifest sync after it is closed.
+//   - All the changes are synced before the storage is closed.
+//
+// The directory is synced by the Sync method of the base storage, see
+// Syncer, and by SetMeta, which is expected to sync the directory like
+// the file-system backed storage does.
+//
+// The given onViolation is called with a description of each violation,
+// e.g. a test may fail or panic; if nil the violations are logged to the
+// base storage. The audit is meant for tests, as it keeps track of every
+// file changed.
+func NewDurabilityAudit(base Storage, onViolation func(msg string)) Storage {
+	return &auditStorage{
+		Storage:     base,
+		onViolation: onViolation,
+		pending:     make(map[FileDesc]auditOp),
+		closed:      make(map[FileDesc]int),
+	}
+}
+
+func (s *auditStorage) violation(format string, args ...interface{}) {
+	msg := "leveldb/storage: durability violation: " + fmt.Sprintf(format, args...)
+	if s.onViolation != nil {
+		s.onViolation(msg)
+	} else {
+		s.Storage.Log(msg)
+	}
+}
+
+// Must be called with the mutex held.
+func (s *auditStorage) change(fd FileDesc, op auditOp) {
+	s.pending[fd] = op
+	delete(s.closed, fd)
+}
+
+// Must be called with the mutex held.
+func (s *auditStorage) synced() {
+	s.pending = make(map[FileDesc]auditOp)
+	s.closed = make(map[FileDesc]int)
+}
+
+func (s *auditStorage) SetMeta(fd FileDesc) error {
+	if err := s.Storage.SetMeta(fd); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.meta = fd
+	s.synced()
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *auditStorage) Create(fd FileDesc) (Writer, error) {
+	w, err := s.Storage.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.change(fd, auditCreate)
+	s.mu.Unlock()
+	return &auditWriter{Writer: w, s: s, fd: fd}, nil
+}
+
+func (s *auditStorage) Remove(fd FileDesc) error {
+	if err := s.Storage.Remove(fd); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.change(fd, auditRemove)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *auditStorage) Rename(oldfd, newfd FileDesc) error {
+	if err := s.Storage.Rename(oldfd, newfd); err != nil {
+		return err
+	}
+	if oldfd != newfd {
+		s.mu.Lock()
+		s.change(oldfd, auditRemove)
+		s.change(newfd, auditRename)
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+func (s *auditStorage) Recycle(oldfd, newfd FileDesc) (Writer, error) {
+	rs, ok := s.Storage.(Recycler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	w, err := rs.Recycle(oldfd, newfd)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.change(oldfd, auditRemove)
+	s.change(newfd, auditRename)
+	s.mu.Unlock()
+	return &auditWriter{Writer: w, s: s, fd: newfd}, nil
+}
+
+func (s *auditStorage) Archive(fd FileDesc) error {
+	as, ok := s.Storage.(Archiver)
+	if !ok {
+		return ErrNotSupported
+	}
+	if err := as.Archive(fd); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.change(fd, auditRemove)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *auditStorage) Link(fd FileDesc, dst Storage) error {
+	ls, ok := s.Storage.(Linker)
+	if !ok {
+		return ErrNotSupported
+	}
+	return ls.Link(fd, dst)
+}
+
+func (s *auditStorage) Sync() error {
+	if ss, ok := s.Storage.(Syncer); ok {
+		if err := ss.Sync(); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	s.synced()
+	s.mu.Unlock()
+	return nil
+}
+
+// Close reports the changes that were never synced.
+func (s *auditStorage) Close() error {
+	s.mu.Lock()
+	for fd, op := range s.pending {
+		s.violation("%s %s but never synced", fd, op)
+	}
+	s.synced()
+	s.mu.Unlock()
+	return s.Storage.Close()
+}
+
+// Called once the given file is closed.
+func (s *auditStorage) fileClosed(fd FileDesc) {
+	s.mu.Lock()
+	if _, ok := s.pending[fd]; ok && fd.Type == TypeTable {
+		s.closed[fd] = s.syncs
+	}
+	s.mu.Unlock()
+}
+
+// Called once the given file is synced.
+func (s *auditStorage) fileSynced(fd FileDesc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case fd.Type == TypeJournal:
+		if op, ok := s.pending[fd]; ok && op != auditRemove {
+			s.violation("%s synced before the directory it was %s in", fd, op)
+		}
+	case fd == s.meta:
+		for tfd, syncs := range s.closed {
+			if syncs < s.syncs {
+				s.violation("%s referenced by %s before its creation is synced", tfd, fd)
+				delete(s.closed, tfd)
+			}
+		}
+		s.syncs++
+	}
+}
+
+type auditWriter struct {
+	Writer
+	s  *auditStorage
+	fd FileDesc
+}
+
+func (w *auditWriter) Sync() error {
+	if err := w.Writer.Sync(); err != nil {
+		return err
+	}
+	w.s.fileSynced(w.fd)
+	return nil
+}
+
+func (w *auditWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	w.s.fileClosed(w.fd)
+	return nil
+}
+
+func (w *auditWriter) Preallocate(size int64) error {
+	if pw, ok := w.Writer.(Preallocator); ok {
+		return pw.Preallocate(size)
+	}
+	return ErrNotSupported
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDurabilityAudit(t *testing.T) {
+	var violations []string
+	expect := func(want ...string) {
+		if len(violations) != len(want) {
+			t.Fatalf("violations: want=%q got=%q", want, violations)
+		}
+		for i, v := range violations {
+			if !strings.Contains(v, want[i]) {
+				t.Errorf("violation #%d: want=%q got=%q", i, want[i], v)
+			}
+		}
+		violations = nil
+	}
+	s := NewDurabilityAudit(NewMemStorage(), func(msg string) {
+		violations = append(violations, msg)
+	})
+
+	// A journal synced before the directory.
+	journal := FileDesc{TypeJournal, 1}
+	w, err := s.Create(journal)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal("Sync: got error: ", err)
+	}
+	expect("000001.log synced before the directory it was created in")
+	if err := s.(Syncer).Sync(); err != nil {
+		t.Fatal("Sync: got error: ", err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal("Sync: got error: ", err)
+	}
+	w.Close()
+	expect()
+
+	manifest := FileDesc{TypeManifest, 2}
+	mw, err := s.Create(manifest)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	if err := s.SetMeta(manifest); err != nil {
+		t.Fatal("SetMeta: got error: ", err)
+	}
+
+	// A table is only checked at the second manifest sync after it is
+	// closed.
+	writeFile(t, s, FileDesc{TypeTable, 3}, "table")
+	mw.Sync()
+	expect()
+	mw.Sync()
+	expect("000003.ldb referenced by MANIFEST-000002 before its creation is synced")
+
+	writeFile(t, s, FileDesc{TypeTable, 4}, "table")
+	mw.Sync()
+	s.(Syncer).Sync()
+	mw.Sync()
+	mw.Close()
+	expect()
+
+	if err := s.Remove(journal); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	s.Close()
+	expect("000001.log removed but never synced")
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+var (
+	errCipherBlockSize = errors.New("leveldb/storage: cipher block size less than 16 bytes")
+	errEncryptedHeader = errors.New("leveldb/storage: invalid encrypted file header")
+	errEncryptedOffset = errors.New("leveldb/storage: offset before start of file")
+)
+
+const (
+	// The header of an encrypted file holds the magic followed by the
+	// nonce of the file.
+	encMagic      = "LDBENC01"
+	encNonceSize  = 16
+	encHeaderSize = len(encMagic) + encNonceSize
+)
+
+// EncryptionProvider provides the ciphers the files of an encrypted storage
+// are encrypted with, see NewEncrypted. An EncryptionProvider must be safe
+// for concurrent use.
+type EncryptionProvider interface {
+	// Cipher returns the block cipher of the file with the given 'file
+	// descriptor', e.g. an AES cipher. The block size must be at least 16
+	// bytes. The cipher of a file must not change while the file exists.
+	Cipher(fd FileDesc) (cipher.Block, error)
+}
+
+type aesProvider struct {
+	block cipher.Block
+}
+
+func (p aesProvider) Cipher(FileDesc) (cipher.Block, error) { return p.block, nil }
+
+// NewAESEncryptionProvider returns an EncryptionProvider encrypting all
+// files with AES using the given key, which must be either 16, 24 or 32
+// bytes long to select AES-128, AES-192 or AES-256.
+func NewAESEncryptionProvider(key []byte) (EncryptionProvider, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return aesProvider{block}, nil
+}
+
+type encryptedStorage struct {
+	Storage
+	ep EncryptionProvider
+}
+
+// NewEncrypted returns a storage that encrypts the content of the files
+// of the given base storage, so the files are unreadable without the
+// keys of the given EncryptionProvider.
+//
+// The files are encrypted with the block cipher in counter (CTR) mode, the
+// initial counter is a random nonce generated when the file is created, and
+// the counter of each block is the nonce plus the block offset divided by
+// the block size; a file is read and written at any offset. The nonce is
+// stored unencrypted in a header at the start of the file, the offsets and
+// sizes seen through the storage exclude the header. As every created or
+// recycled file gets a new nonce, the key stream is never reused, and the
+// files are renamed as is.
+//
+// The meta, that is the name of the current manifest, and the log aren't
+// encrypted; the log may hold keys of the DB, so it should be discarded,
+// e.g. with opt.Options.Logger. The files can't be memory mapped.
+func NewEncrypted(base Storage, ep EncryptionProvider) Storage {
+	return &encryptedStorage{Storage: base, ep: ep}
+}
+
+// Returns the cipher of the given file, with the given nonce or a new
+// random one if nonce is nil.
+func (s *encryptedStorage) cipher(fd FileDesc, nonce []byte) (*fileCipher, error) {
+	block, err := s.ep.Cipher(fd)
+	if err != nil {
+		return nil, err
+	}
+	if block.BlockSize() < 16 {
+		return nil, errCipherBlockSize
+	}
+	c := &fileCipher{block: block, nonce: make([]byte, block.BlockSize())}
+	if nonce != nil {
+		copy(c.nonce, nonce)
+	} else if _, err := io.ReadFull(rand.Reader, c.nonce[:encNonceSize]); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *encryptedStorage) Open(fd FileDesc) (Reader, error) {
+	r, err := s.Storage.Open(fd)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, encHeaderSize)
+	if _, err := r.ReadAt(hdr, 0); err != nil || !bytes.Equal(hdr[:len(encMagic)], []byte(encMagic)) {
+		r.Close()
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		return nil, &ErrCorrupted{Fd: fd, Err: errEncryptedHeader}
+	}
+	c, err := s.cipher(fd, hdr[len(encMagic):])
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if _, err := r.Seek(int64(encHeaderSize), io.SeekStart); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &encryptedReader{Reader: r, c: c}, nil
+}
+
+// Returns an encrypted writer of the given file, the header is written
+// first with a new nonce.
+func (s *encryptedStorage) newWriter(fd FileDesc, w Writer) (Writer, error) {
+	c, err := s.cipher(fd, nil)
+	if err == nil {
+		hdr := make([]byte, 0, encHeaderSize)
+		hdr = append(append(hdr, encMagic...), c.nonce[:encNonceSize]...)
+		_, err = w.Write(hdr)
+	}
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return &encryptedWriter{Writer: w, c: c, stream: c.stream(0)}, nil
+}
+
+func (s *encryptedStorage) Create(fd FileDesc) (Writer, error) {
+	w, err := s.Storage.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	return s.newWriter(fd, w)
+}
+
+// Recycle recycles the file of the base storage, if it implements
+// Recycler. The recycled file is overwritten from its header on, with a
+// new nonce.
+func (s *encryptedStorage) Recycle(oldfd, newfd FileDesc) (Writer, error) {
+	rs, ok := s.Storage.(Recycler)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	w, err := rs.Recycle(oldfd, newfd)
+	if err != nil {
+		return nil, err
+	}
+	return s.newWriter(newfd, w)
+}
+
+func (s *encryptedStorage) Archive(fd FileDesc) error {
+	if as, ok := s.Storage.(Archiver); ok {
+		return as.Archive(fd)
+	}
+	return ErrNotSupported
+}
+
+func (s *encryptedStorage) Sync() error {
+	if ss, ok := s.Storage.(Syncer); ok {
+		return ss.Sync()
+	}
+	return nil
+}
+
+type fileCipher struct {
+	block cipher.Block
+	nonce []byte
+}
+
+// Returns the key stream starting at the given offset, excluding the
+// header.
+func (c *fileCipher) stream(off int64) cipher.Stream {
+	bs := c.block.BlockSize()
+	iv := append([]byte{}, c.nonce...)
+	// Adds the block offset to the nonce, as a big-endian integer.
+	for i, n := bs-1, uint64(off/int64(bs)); i >= 0 && n > 0; i-- {
+		n += uint64(iv[i])
+		iv[i] = byte(n)
+		n >>= 8
+	}
+	s := cipher.NewCTR(c.block, iv)
+	if skip := int(off % int64(bs)); skip > 0 {
+		buf := make([]byte, skip)
+		s.XORKeyStream(buf, buf)
+	}
+	return s
+}
+
+type encryptedReader struct {
+	Reader
+	c   *fileCipher
+	off int64
+}
+
+func (r *encryptedReader) Read(p []byte) (n int, err error) {
+	n, err = r.Reader.Read(p)
+	r.c.stream(r.off).XORKeyStream(p[:n], p[:n])
+	r.off += int64(n)
+	return
+}
+
+func (r *encryptedReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errEncryptedOffset
+	}
+	n, err = r.Reader.ReadAt(p, off+int64(encHeaderSize))
+	r.c.stream(off).XORKeyStream(p[:n], p[:n])
+	return
+}
+
+func (r *encryptedReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += int64(encHeaderSize)
+	}
+	off, err := r.Reader.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	off -= int64(encHeaderSize)
+	if off < 0 {
+		// Seeked into the header.
+		r.Reader.Seek(int64(encHeaderSize), io.SeekStart)
+		off = 0
+		err = errEncryptedOffset
+	}
+	r.off = off
+	return off, err
+}
+
+type encryptedWriter struct {
+	Writer
+	c      *fileCipher
+	stream cipher.Stream
+	off    int64
+	buf    []byte
+}
+
+func (w *encryptedWriter) Write(p []byte) (int, error) {
+	if cap(w.buf) < len(p) {
+		w.buf = make([]byte, len(p))
+	}
+	buf := w.buf[:len(p)]
+	w.stream.XORKeyStream(buf, p)
+	n, err := w.Writer.Write(buf)
+	w.off += int64(n)
+	if n < len(p) {
+		// Partially written, the rest may be written again.
+		w.stream = w.c.stream(w.off)
+	}
+	return n, err
+}
+
+func (w *encryptedWriter) Preallocate(size int64) error {
+	if pw, ok := w.Writer.(Preallocator); ok {
+		return pw.Preallocate(size + int64(encHeaderSize))
+	}
+	return ErrNotSupported
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	ep, err := NewAESEncryptionProvider(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal("NewAESEncryptionProvider: got error: ", err)
+	}
+	base := NewMemStorage()
+	s := NewEncrypted(base, ep)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64)
+	data = data[:len(data)-5]
+	fd := FileDesc{TypeTable, 1}
+	w, err := s.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	// Writes of any size, not aligned with the cipher blocks.
+	for p := data; len(p) > 0; {
+		n := 7
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal("Write: got error: ", err)
+		}
+		p = p[n:]
+	}
+	w.Close()
+
+	raw := readFile(t, base, fd)
+	if len(raw) != encHeaderSize+len(data) || bytes.Contains([]byte(raw), []byte("0123456789")) {
+		t.Fatalf("file not encrypted: %q", raw)
+	}
+	if got := readFile(t, s, fd); got != string(data) {
+		t.Fatalf("Read: invalid data %q", got)
+	}
+
+	r, err := s.Open(fd)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	p := make([]byte, 21)
+	for _, off := range []int64{0, 5, 16, 33, int64(len(data) - 21)} {
+		if _, err := r.ReadAt(p, off); err != nil {
+			t.Fatalf("ReadAt %d: got error: %v", off, err)
+		}
+		if !bytes.Equal(p, data[off:off+21]) {
+			t.Errorf("ReadAt %d: invalid data %q", off, p)
+		}
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			t.Fatalf("Seek %d: got error: %v", off, err)
+		}
+		if _, err := io.ReadFull(r, p); err != nil {
+			t.Fatalf("Read %d: got error: %v", off, err)
+		}
+		if !bytes.Equal(p, data[off:off+21]) {
+			t.Errorf("Read %d: invalid data %q", off, p)
+		}
+	}
+	r.Close()
+
+	// The same content is encrypted differently in another file, even of
+	// the same number.
+	if err := s.Remove(fd); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	w, err = s.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	w.Write(data)
+	w.Close()
+	if raw2 := readFile(t, base, fd); raw2[encHeaderSize:] == raw[encHeaderSize:] {
+		t.Error("same key stream used for two files")
+	}
+	if got := readFile(t, s, fd); got != string(data) {
+		t.Fatalf("Read: invalid data %q", got)
+	}
+
+	fd2 := FileDesc{TypeTable, 2}
+	if err := s.Rename(fd, fd2); err != nil {
+		t.Fatal("Rename: got error: ", err)
+	}
+	if got := readFile(t, s, fd2); got != string(data) {
+		t.Fatalf("Read renamed: invalid data %q", got)
+	}
+	if fds, _ := base.List(TypeAll); len(fds) != 1 || fds[0] != fd2 {
+		t.Errorf("invalid files: %v", fds)
+	}
+
+	// A recycled file is overwritten with a new nonce.
+	journal := FileDesc{TypeJournal, 3}
+	w, err = s.(Recycler).Recycle(fd2, journal)
+	if err != nil {
+		t.Fatal("Recycle: got error: ", err)
+	}
+	w.Write([]byte("foobar"))
+	w.Close()
+	if got := readFile(t, s, journal); got[:6] != "foobar" || got[6:] == string(data[6:]) {
+		t.Errorf("Read recycled: invalid data %q", got)
+	}
+
+	// Files without the header aren't read.
+	plain := FileDesc{TypeTable, 4}
+	w, _ = base.Create(plain)
+	w.Write(data)
+	w.Close()
+	if _, err := s.Open(plain); err == nil {
+		t.Error("Open plain file: got no error")
+	} else if _, ok := err.(*ErrCorrupted); !ok {
+		t.Errorf("Open plain file: got error %v, want corruption", err)
+	}
+
+	// Other keys can't decrypt the files.
+	ep2, _ := NewAESEncryptionProvider(bytes.Repeat([]byte{2}, 32))
+	if got := readFile(t, NewEncrypted(base, ep2), journal); got[:6] == "foobar" {
+		t.Error("file decrypted with another key")
+	}
+}
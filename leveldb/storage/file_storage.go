@@ -26,6 +26,148 @@ var (
 
 type fileLock interface {
 	release() error
+	setOwner(b []byte) error
+}
+
+// LockOwner identifies the process holding the lock of a file-system
+// backed storage, as recorded in its LOCK file.
+type LockOwner struct {
+	PID       int
+	Hostname  string
+	MachineID string // Machine ID of the host, empty if unknown.
+	BootID    string // Boot ID of the host, empty if unknown.
+}
+
+func (o *LockOwner) String() string {
+	return fmt.Sprintf("pid %d on %s", o.PID, o.Hostname)
+}
+
+func (o *LockOwner) encode() []byte {
+	return []byte(fmt.Sprintf("pid=%d\nhost=%s\nmachine_id=%s\nboot_id=%s\n", o.PID, o.Hostname, o.MachineID, o.BootID))
+}
+
+// Reports whether the owner is verifiably dead: the owner ran on this host
+// before it was rebooted, or its process no longer exists. Process IDs are
+// only compared within the same boot of the host. A different boot ID only
+// tells a reboot if the host is identified by its machine ID, hostnames
+// aren't unique; otherwise the owner may run on another host, its state is
+// unknown.
+func (o *LockOwner) dead() bool {
+	host, err := os.Hostname()
+	if err != nil || o.Hostname != host {
+		return false
+	}
+	if boot := bootID(); o.BootID != boot {
+		if o.BootID == "" || boot == "" {
+			return false
+		}
+		machine := machineID()
+		return machine != "" && o.MachineID == machine
+	}
+	alive, ok := processAlive(o.PID)
+	return ok && !alive
+}
+
+func currentLockOwner() *LockOwner {
+	host, _ := os.Hostname()
+	return &LockOwner{PID: os.Getpid(), Hostname: host, MachineID: machineID(), BootID: bootID()}
+}
+
+// Reads the owner recorded in the given LOCK file, returns nil if there is
+// none.
+func readLockOwner(path string) *LockOwner {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	o := &LockOwner{}
+	for _, line := range strings.Split(string(b), "\n") {
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			continue
+		}
+		switch v := line[i+1:]; line[:i] {
+		case "pid":
+			o.PID, _ = strconv.Atoi(v)
+		case "host":
+			o.Hostname = v
+		case "machine_id":
+			o.MachineID = v
+		case "boot_id":
+			o.BootID = v
+		}
+	}
+	if o.PID <= 0 {
+		return nil
+	}
+	return o
+}
+
+// Returns the machine ID of the host, or an empty string if unknown.
+func machineID() string {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if b, err := ioutil.ReadFile(path); err == nil {
+			if id := strings.TrimSpace(string(b)); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// Returns the boot ID of the host, or an empty string if unknown.
+func bootID() string {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// ErrLocked is the type of the error returned by OpenFile if the storage is
+// locked by another process, and by the Lock method of Storage if the
+// storage is already locked, in which case Path is empty. Owner is nil if
+// the owner of the lock isn't recorded or can't be read, e.g. on Windows.
+type ErrLocked struct {
+	Path  string
+	Owner *LockOwner
+	Err   error
+}
+
+func (e *ErrLocked) Error() string {
+	switch {
+	case e.Path == "":
+		return "leveldb/storage: already locked"
+	case e.Owner != nil:
+		return fmt.Sprintf("leveldb/storage: %s locked by %v: %v", e.Path, e.Owner, e.Err)
+	}
+	return fmt.Sprintf("leveldb/storage: %s locked: %v", e.Path, e.Err)
+}
+
+// Locks the given LOCK file and records the owner of the lock in it. If
+// the file is locked by another process and breakStale is true, a lock
+// whose recorded owner is verifiably dead is broken by replacing the file.
+func lockFile(path string, readOnly, breakStale bool) (fileLock, error) {
+	flock, err := newFileLock(path, readOnly)
+	if err != nil && isErrLocked(err) {
+		owner := readLockOwner(path)
+		if breakStale && !readOnly && owner != nil && owner.dead() {
+			if rerr := os.Remove(path); rerr == nil {
+				flock, err = newFileLock(path, readOnly)
+			}
+		}
+		if err != nil && isErrLocked(err) {
+			return nil, &ErrLocked{Path: path, Owner: owner, Err: err}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !readOnly {
+		// The owner is informational, failing to record it isn't fatal.
+		flock.setOwner(currentLockOwner().encode())
+	}
+	return flock, nil
 }
 
 type fileStorageLock struct {
@@ -44,6 +186,10 @@ func (lock *fileStorageLock) Unlock() {
 
 const logSizeThreshold = 1024 * 1024 // 1 MiB
 
+// ArchiveDir is the name of the directory, under the storage path, the
+// file-system backed storage moves archived files into.
+const ArchiveDir = "archive"
+
 // fileStorage is a file-system backed storage.
 type fileStorage struct {
 	path     string
@@ -54,18 +200,50 @@ type fileStorage struct {
 	slock   *fileStorageLock
 	logw    *os.File
 	logSize int64
+	// Directory of the LOG file; empty if logging is disabled.
+	logPath string
 	buf     []byte
 	// Opened file counter; if open < 0 means closed.
 	open int
 	day  int
 }
 
+// FileOptions holds the optional parameters of the file-system backed
+// storage, see OpenFileWithOptions.
+type FileOptions struct {
+	// ReadOnly opens the storage in read-only mode.
+	ReadOnly bool
+
+	// BreakStaleLock allows to break the lock of the storage if the owner
+	// recorded in the LOCK file is verifiably dead: it ran on this host,
+	// identified by its machine ID, before it was rebooted, or its process
+	// no longer exists. Such a lock
+	// may be left behind by a network file system. The lock is broken by
+	// replacing the LOCK file, which is only safe if the storage isn't
+	// opened by several processes at once. Has no effect in read-only mode.
+	BreakStaleLock bool
+}
+
 // OpenFile returns a new filesytem-backed storage implementation with the given
 // path. This also acquire a file lock, so any subsequent attempt to open the
 // same path will fail.
 //
 // The storage must be closed after use, by calling Close method.
 func OpenFile(path string, readOnly bool) (Storage, error) {
+	return OpenFileWithOptions(path, &FileOptions{ReadOnly: readOnly})
+}
+
+// OpenFileWithOptions is like OpenFile but with the given options, o may be
+// nil. The process holding the lock, see LockOwner, is recorded in the LOCK
+// file; if the storage is locked by another process an error of type
+// *ErrLocked is returned.
+//
+// The storage must be closed after use, by calling Close method.
+func OpenFileWithOptions(path string, o *FileOptions) (Storage, error) {
+	var readOnly, breakStale bool
+	if o != nil {
+		readOnly, breakStale = o.ReadOnly, o.BreakStaleLock
+	}
 	if fi, err := os.Stat(path); err == nil {
 		if !fi.IsDir() {
 			return nil, fmt.Errorf("leveldb/storage: open %s: not a directory", path)
@@ -78,7 +256,7 @@ func OpenFile(path string, readOnly bool) (Storage, error) {
 		return nil, err
 	}
 
-	flock, err := newFileLock(filepath.Join(path, "LOCK"), readOnly)
+	flock, err := lockFile(filepath.Join(path, "LOCK"), readOnly, breakStale)
 	if err != nil {
 		return nil, err
 	}
@@ -92,17 +270,14 @@ func OpenFile(path string, readOnly bool) (Storage, error) {
 	var (
 		logw    *os.File
 		logSize int64
+		logPath string
 	)
 	if !readOnly {
-		logw, err = os.OpenFile(filepath.Join(path, "LOG"), os.O_WRONLY|os.O_CREATE, 0644)
+		logw, logSize, err = openLog(path)
 		if err != nil {
 			return nil, err
 		}
-		logSize, err = logw.Seek(0, os.SEEK_END)
-		if err != nil {
-			logw.Close()
-			return nil, err
-		}
+		logPath = path
 	}
 
 	fs := &fileStorage{
@@ -111,11 +286,70 @@ func OpenFile(path string, readOnly bool) (Storage, error) {
 		flock:    flock,
 		logw:     logw,
 		logSize:  logSize,
+		logPath:  logPath,
 	}
 	runtime.SetFinalizer(fs, (*fileStorage).Close)
 	return fs, nil
 }
 
+// OpenFileSecondary returns a new read-only filesytem-backed storage
+// implementation for the given primary path, which may be in use by another
+// process. The primary path is not locked; the secondary path, created if
+// not exist, is locked instead and holds the LOG file.
+//
+// Files of the primary may be removed or replaced at any time, the DB
+// reading the storage must be prepared for that, see
+// leveldb.OpenAsSecondary.
+//
+// The storage must be closed after use, by calling Close method.
+func OpenFileSecondary(primaryPath, secondaryPath string) (Storage, error) {
+	fi, err := os.Stat(primaryPath)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("leveldb/storage: open %s: not a directory", primaryPath)
+	}
+	if err := os.MkdirAll(secondaryPath, 0755); err != nil {
+		return nil, err
+	}
+
+	flock, err := lockFile(filepath.Join(secondaryPath, "LOCK"), false, false)
+	if err != nil {
+		return nil, err
+	}
+	logw, logSize, err := openLog(secondaryPath)
+	if err != nil {
+		flock.release()
+		return nil, err
+	}
+
+	fs := &fileStorage{
+		path:     primaryPath,
+		readOnly: true,
+		flock:    flock,
+		logw:     logw,
+		logSize:  logSize,
+		logPath:  secondaryPath,
+	}
+	runtime.SetFinalizer(fs, (*fileStorage).Close)
+	return fs, nil
+}
+
+// Opens the LOG file under the given directory for appending.
+func openLog(dir string) (*os.File, int64, error) {
+	logw, err := os.OpenFile(filepath.Join(dir, "LOG"), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	logSize, err := logw.Seek(0, os.SEEK_END)
+	if err != nil {
+		logw.Close()
+		return nil, 0, err
+	}
+	return logw, logSize, nil
+}
+
 func (fs *fileStorage) Lock() (Locker, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -126,7 +360,7 @@ func (fs *fileStorage) Lock() (Locker, error) {
 		return &fileStorageLock{}, nil
 	}
 	if fs.slock != nil {
-		return nil, ErrLocked
+		return nil, &ErrLocked{}
 	}
 	fs.slock = &fileStorageLock{fs: fs}
 	return fs.slock, nil
@@ -163,11 +397,11 @@ func (fs *fileStorage) doLog(t time.Time, str string) {
 		fs.logw.Close()
 		fs.logw = nil
 		fs.logSize = 0
-		rename(filepath.Join(fs.path, "LOG"), filepath.Join(fs.path, "LOG.old"))
+		rename(filepath.Join(fs.logPath, "LOG"), filepath.Join(fs.logPath, "LOG.old"))
 	}
 	if fs.logw == nil {
 		var err error
-		fs.logw, err = os.OpenFile(filepath.Join(fs.path, "LOG"), os.O_WRONLY|os.O_CREATE, 0644)
+		fs.logw, err = os.OpenFile(filepath.Join(fs.logPath, "LOG"), os.O_WRONLY|os.O_CREATE, 0644)
 		if err != nil {
 			return
 		}
@@ -193,7 +427,7 @@ func (fs *fileStorage) doLog(t time.Time, str string) {
 }
 
 func (fs *fileStorage) Log(str string) {
-	if !fs.readOnly {
+	if fs.logPath != "" {
 		t := time.Now()
 		fs.mu.Lock()
 		defer fs.mu.Unlock()
@@ -205,7 +439,7 @@ func (fs *fileStorage) Log(str string) {
 }
 
 func (fs *fileStorage) log(str string) {
-	if !fs.readOnly {
+	if fs.logPath != "" {
 		fs.doLog(time.Now(), str)
 	}
 }
@@ -249,6 +483,12 @@ func (fs *fileStorage) SetMeta(fd FileDesc) (err error) {
 	if err != nil {
 		return
 	}
+	// Sync root directory, so the manifest and the pending CURRENT file
+	// are found once CURRENT points to them.
+	if err = syncDir(fs.path); err != nil {
+		fs.log(fmt.Sprintf("syncDir: %v", err))
+		return
+	}
 	if err = rename(path, filepath.Join(fs.path, "CURRENT")); err != nil {
 		fs.log(fmt.Sprintf("rename CURRENT.%d: %v", fd.Num, err))
 		return
@@ -260,6 +500,22 @@ func (fs *fileStorage) SetMeta(fd FileDesc) (err error) {
 	return
 }
 
+func (fs *fileStorage) Sync() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.open < 0 {
+		return ErrClosed
+	}
+	if fs.readOnly {
+		return nil
+	}
+	if err := syncDir(fs.path); err != nil {
+		fs.log(fmt.Sprintf("syncDir: %v", err))
+		return err
+	}
+	return nil
+}
+
 func (fs *fileStorage) GetMeta() (fd FileDesc, err error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -483,6 +739,124 @@ func (fs *fileStorage) Rename(oldfd, newfd FileDesc) error {
 	return rename(filepath.Join(fs.path, fsGenName(oldfd)), filepath.Join(fs.path, fsGenName(newfd)))
 }
 
+func (fs *fileStorage) Recycle(oldfd, newfd FileDesc) (Writer, error) {
+	if !FileDescOk(oldfd) || !FileDescOk(newfd) {
+		return nil, ErrInvalidFile
+	}
+	if fs.readOnly {
+		return nil, errReadOnly
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.open < 0 {
+		return nil, ErrClosed
+	}
+	path := filepath.Join(fs.path, fsGenName(newfd))
+	if oldfd != newfd {
+		if err := rename(filepath.Join(fs.path, fsGenName(oldfd)), path); err != nil {
+			fs.log(fmt.Sprintf("recycle %s: %v", oldfd, err))
+			return nil, err
+		}
+	}
+	of, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	fs.open++
+	return &fileWrap{File: of, fs: fs, fd: newfd}, nil
+}
+
+// Link hard-links the file into the destination storage, which must be
+// another file storage on the same file system.
+func (fs *fileStorage) Link(fd FileDesc, dst Storage) error {
+	if !FileDescOk(fd) {
+		return ErrInvalidFile
+	}
+	dfs, ok := dst.(*fileStorage)
+	if !ok || dfs == fs {
+		return ErrNotSupported
+	}
+	if dfs.readOnly {
+		return errReadOnly
+	}
+	dfs.mu.Lock()
+	closed := dfs.open < 0
+	dfs.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.open < 0 {
+		return ErrClosed
+	}
+	oldpath := filepath.Join(fs.path, fsGenName(fd))
+	if _, err := os.Stat(oldpath); err != nil && fsHasOldName(fd) && os.IsNotExist(err) {
+		oldpath = filepath.Join(fs.path, fsGenOldName(fd))
+	}
+	if err := os.Link(oldpath, filepath.Join(dfs.path, fsGenName(fd))); err != nil {
+		if le, ok := err.(*os.LinkError); ok && !os.IsNotExist(le.Err) && !os.IsExist(le.Err) {
+			// Cross-device links and file systems without hard links.
+			return ErrNotSupported
+		}
+		return err
+	}
+	return nil
+}
+
+// Import hard-links the external file into the storage path, which must
+// be on the same file system.
+func (fs *fileStorage) Import(path string, fd FileDesc) error {
+	if !FileDescOk(fd) {
+		return ErrInvalidFile
+	}
+	if fs.readOnly {
+		return errReadOnly
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.open < 0 {
+		return ErrClosed
+	}
+	if err := os.Link(path, filepath.Join(fs.path, fsGenName(fd))); err != nil {
+		if le, ok := err.(*os.LinkError); ok && !os.IsNotExist(le.Err) && !os.IsExist(le.Err) {
+			// Cross-device links and file systems without hard links.
+			return ErrNotSupported
+		}
+		return err
+	}
+	return syncDir(fs.path)
+}
+
+// Archive moves the file into the 'archive' directory under the storage
+// path, creating the directory if needed.
+func (fs *fileStorage) Archive(fd FileDesc) error {
+	if !FileDescOk(fd) {
+		return ErrInvalidFile
+	}
+	if fs.readOnly {
+		return errReadOnly
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.open < 0 {
+		return ErrClosed
+	}
+	dir := filepath.Join(fs.path, ArchiveDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := rename(filepath.Join(fs.path, fsGenName(fd)), filepath.Join(dir, fsGenName(fd))); err != nil {
+		fs.log(fmt.Sprintf("archive %s: %v", fd, err))
+		return err
+	}
+	return syncDir(dir)
+}
+
 func (fs *fileStorage) Close() error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
@@ -499,6 +873,9 @@ func (fs *fileStorage) Close() error {
 	if fs.logw != nil {
 		fs.logw.Close()
 	}
+	// Clear the owner, so only a lock left behind records one. This fails
+	// harmlessly for a read-only lock.
+	fs.flock.setOwner(nil)
 	return fs.flock.release()
 }
 
@@ -507,6 +884,7 @@ type fileWrap struct {
 	fs     *fileStorage
 	fd     FileDesc
 	closed bool
+	mmap   []byte
 }
 
 func (fw *fileWrap) Sync() error {
@@ -532,6 +910,12 @@ func (fw *fileWrap) Close() error {
 	}
 	fw.closed = true
 	fw.fs.open--
+	if fw.mmap != nil {
+		if err := munmapFile(fw.mmap); err != nil {
+			fw.fs.log(fmt.Sprintf("munmap %s: %v", fw.fd, err))
+		}
+		fw.mmap = nil
+	}
 	err := fw.File.Close()
 	if err != nil {
 		fw.fs.log(fmt.Sprintf("close %s: %v", fw.fd, err))
@@ -539,6 +923,64 @@ func (fw *fileWrap) Close() error {
 	return err
 }
 
+func (fw *fileWrap) Mmap() ([]byte, error) {
+	fw.fs.mu.Lock()
+	defer fw.fs.mu.Unlock()
+	if fw.closed {
+		return nil, ErrClosed
+	}
+	if fw.mmap == nil {
+		fi, err := fw.File.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if fi.Size() == 0 || int64(int(fi.Size())) != fi.Size() {
+			return nil, ErrNotSupported
+		}
+		fw.mmap, err = mmapFile(fw.File, int(fi.Size()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fw.mmap, nil
+}
+
+func (fw *fileWrap) DropCache() error {
+	fw.fs.mu.Lock()
+	defer fw.fs.mu.Unlock()
+	if fw.closed {
+		return ErrClosed
+	}
+	return dropFileCache(fw.File)
+}
+
+func (fw *fileWrap) Truncate(size int64) error {
+	fw.fs.mu.Lock()
+	defer fw.fs.mu.Unlock()
+	if fw.closed {
+		return ErrClosed
+	}
+	return fw.File.Truncate(size)
+}
+
+func (fw *fileWrap) SyncRange(off, n int64) error {
+	fw.fs.mu.Lock()
+	defer fw.fs.mu.Unlock()
+	if fw.closed {
+		return ErrClosed
+	}
+	return syncFileRange(fw.File, off, n)
+}
+
+func (fw *fileWrap) Preallocate(size int64) error {
+	fw.fs.mu.Lock()
+	defer fw.fs.mu.Unlock()
+	if fw.closed {
+		return ErrClosed
+	}
+	return preallocFile(fw.File, size)
+}
+
 func fsGenName(fd FileDesc) string {
 	switch fd.Type {
 	case TypeManifest:
@@ -549,6 +991,8 @@ func fsGenName(fd FileDesc) string {
 		return fmt.Sprintf("%06d.ldb", fd.Num)
 	case TypeTemp:
 		return fmt.Sprintf("%06d.tmp", fd.Num)
+	case TypeValueLog:
+		return fmt.Sprintf("%06d.vlog", fd.Num)
 	default:
 		panic("invalid file type")
 	}
@@ -577,6 +1021,8 @@ func fsParseName(name string) (fd FileDesc, ok bool) {
 			fd.Type = TypeTable
 		case "tmp":
 			fd.Type = TypeTemp
+		case "vlog":
+			fd.Type = TypeValueLog
 		default:
 			return
 		}
@@ -0,0 +1,28 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE, see fallocate(2).
+const fallocKeepSize = 0x1
+
+func preallocFile(f *os.File, size int64) error {
+	for {
+		err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+		switch err {
+		case syscall.EINTR:
+			continue
+		case syscall.ENOSYS, syscall.EOPNOTSUPP:
+			return ErrNotSupported
+		}
+		return err
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// +build linux,amd64 linux,arm64
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	// POSIX_FADV_DONTNEED, see posix_fadvise(2).
+	fadvDontNeed = 4
+	// SYNC_FILE_RANGE_WRITE, see sync_file_range(2).
+	syncFileRangeWrite = 2
+)
+
+func dropFileCache(f *os.File) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	if errno != 0 {
+		if errno == syscall.ENOSYS {
+			return ErrNotSupported
+		}
+		return errno
+	}
+	return nil
+}
+
+func syncFileRange(f *os.File, off, n int64) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_SYNC_FILE_RANGE, f.Fd(), uintptr(off), uintptr(n), syncFileRangeWrite, 0, 0)
+	if errno != 0 {
+		if errno == syscall.ENOSYS {
+			return ErrNotSupported
+		}
+		return errno
+	}
+	return nil
+}
@@ -21,6 +21,18 @@ func setFileLock(f *os.File, readOnly, lock bool) error {
 	return syscall.ENOTSUP
 }
 
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
+
+func isErrLocked(err error) bool { return false }
+
+func processAlive(pid int) (alive, ok bool) { return false, false }
+
 func rename(oldpath, newpath string) error {
 	return syscall.ENOTSUP
 }
@@ -0,0 +1,21 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// +build !linux !amd64,!arm64
+
+package storage
+
+import (
+	"os"
+)
+
+func dropFileCache(f *os.File) error {
+	return ErrNotSupported
+}
+
+func syncFileRange(f *os.File, off, n int64) error {
+	return ErrNotSupported
+}
@@ -19,6 +19,14 @@ func (fl *plan9FileLock) release() error {
 	return fl.f.Close()
 }
 
+func (fl *plan9FileLock) setOwner(b []byte) error {
+	if err := fl.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := fl.f.WriteAt(b, 0)
+	return err
+}
+
 func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	var (
 		flag int
@@ -41,6 +49,20 @@ func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	return
 }
 
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
+
+// The exclusive use file can't be opened, it is reported as any other
+// error.
+func isErrLocked(err error) bool { return false }
+
+func processAlive(pid int) (alive, ok bool) { return false, false }
+
 func rename(oldpath, newpath string) error {
 	if _, err := os.Stat(newpath); err == nil {
 		if err := os.Remove(newpath); err != nil {
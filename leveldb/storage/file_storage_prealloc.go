@@ -0,0 +1,17 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// +build !linux
+
+package storage
+
+import (
+	"os"
+)
+
+func preallocFile(f *os.File, size int64) error {
+	return ErrNotSupported
+}
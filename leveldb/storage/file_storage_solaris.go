@@ -24,6 +24,14 @@ func (fl *unixFileLock) release() error {
 	return fl.f.Close()
 }
 
+func (fl *unixFileLock) setOwner(b []byte) error {
+	if err := fl.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := fl.f.WriteAt(b, 0)
+	return err
+}
+
 func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	var flag int
 	if readOnly {
@@ -64,6 +72,28 @@ func setFileLock(f *os.File, readOnly, lock bool) error {
 	return syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &flock)
 }
 
+func isErrLocked(err error) bool {
+	return err == syscall.EAGAIN || err == syscall.EACCES
+}
+
+func processAlive(pid int) (alive, ok bool) {
+	switch err := syscall.Kill(pid, 0); err {
+	case nil, syscall.EPERM:
+		return true, true
+	case syscall.ESRCH:
+		return false, true
+	}
+	return false, false
+}
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
+
 func rename(oldpath, newpath string) error {
 	return os.Rename(oldpath, newpath)
 }
@@ -8,8 +8,11 @@ package storage
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"testing"
 )
 
@@ -26,6 +29,7 @@ var cases = []struct {
 	{nil, "MANIFEST-000007", TypeManifest, 7},
 	{nil, "9223372036854775807.log", TypeJournal, 9223372036854775807},
 	{nil, "000100.tmp", TypeTemp, 100},
+	{nil, "000100.vlog", TypeValueLog, 100},
 }
 
 var invalidCases = []string{
@@ -174,3 +178,378 @@ func TestFileStorage_ReadOnlyLocking(t *testing.T) {
 	p3.Close()
 	p4.Close()
 }
+
+func TestFileStorage_StaleLock(t *testing.T) {
+	switch runtime.GOOS {
+	case "windows", "plan9", "nacl":
+		t.Skip("lock owner not supported")
+	}
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldb-teststalelock-%d", os.Getuid()))
+	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(path)
+
+	p1, err := OpenFile(path, false)
+	if err != nil {
+		t.Fatal("OpenFile(1): got error: ", err)
+	}
+	defer p1.Close()
+
+	_, err = OpenFileWithOptions(path, &FileOptions{BreakStaleLock: true})
+	if e, ok := err.(*ErrLocked); !ok || e.Owner == nil || e.Owner.PID != os.Getpid() {
+		t.Fatalf("OpenFile(2): want lock held by this process, got error %v", err)
+	}
+
+	// Record an owner whose process no longer exists, as if the lock was
+	// left behind.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal("Run: got error: ", err)
+	}
+	owner := currentLockOwner()
+	owner.PID = cmd.Process.Pid
+	if err := ioutil.WriteFile(filepath.Join(path, "LOCK"), owner.encode(), 0644); err != nil {
+		t.Fatal("WriteFile: got error: ", err)
+	}
+
+	_, err = OpenFile(path, false)
+	if e, ok := err.(*ErrLocked); !ok || e.Owner == nil || e.Owner.PID != owner.PID {
+		t.Fatalf("OpenFile(3): want lock held by pid %d, got error %v", owner.PID, err)
+	}
+	p2, err := OpenFileWithOptions(path, &FileOptions{BreakStaleLock: true})
+	if err != nil {
+		t.Fatal("OpenFile(4): got error: ", err)
+	}
+	defer p2.Close()
+	if o := readLockOwner(filepath.Join(path, "LOCK")); o == nil || o.PID != os.Getpid() {
+		t.Errorf("invalid lock owner: %v", o)
+	}
+}
+
+func TestFileStorage_LockOwnerRebooted(t *testing.T) {
+	if bootID() == "" {
+		t.Skip("boot ID not supported")
+	}
+	owner := currentLockOwner()
+	owner.BootID = "00000000-0000-0000-0000-000000000000"
+
+	// The host isn't verifiably the same without a machine ID.
+	owner.MachineID = ""
+	if owner.dead() {
+		t.Error("owner without machine ID reported dead")
+	}
+	owner.MachineID = "0123456789abcdef"
+	if owner.dead() {
+		t.Error("owner of another machine reported dead")
+	}
+	if owner.MachineID = machineID(); owner.MachineID != "" && !owner.dead() {
+		t.Error("owner of a previous boot reported alive")
+	}
+}
+
+func TestFileStorage_Mmap(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldb-testmmap-%d", os.Getuid()))
+	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(path)
+
+	fs, err := OpenFile(path, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := FileDesc{Type: TypeTable, Num: 1}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	if _, err := w.Write([]byte("foobar")); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	w.Close()
+
+	r, err := fs.Open(fd)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	data, err := r.(MmapReader).Mmap()
+	if err == ErrNotSupported {
+		r.Close()
+		t.Skip("mmap not supported")
+	} else if err != nil {
+		t.Fatal("Mmap: got error: ", err)
+	}
+	if string(data) != "foobar" {
+		t.Errorf("invalid mapped content: want=%q got=%q", "foobar", data)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+	if _, err := r.(MmapReader).Mmap(); err != ErrClosed {
+		t.Errorf("Mmap after close: want=%v got=%v", ErrClosed, err)
+	}
+}
+
+func TestFileStorage_Preallocate(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldb-testprealloc-%d", os.Getuid()))
+	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(path)
+
+	fs, err := OpenFile(path, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := FileDesc{Type: TypeJournal, Num: 1}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	err = w.(Preallocator).Preallocate(1 << 20)
+	if err == ErrNotSupported {
+		w.Close()
+		t.Skip("preallocate not supported")
+	} else if err != nil {
+		t.Fatal("Preallocate: got error: ", err)
+	}
+	if _, err := w.Write([]byte("foobar")); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+	if err := w.(Preallocator).Preallocate(1 << 20); err != ErrClosed {
+		t.Errorf("Preallocate after close: want=%v got=%v", ErrClosed, err)
+	}
+
+	// The file size isn't changed by the preallocation.
+	fi, err := os.Stat(filepath.Join(path, fsGenName(fd)))
+	if err != nil {
+		t.Fatal("Stat: got error: ", err)
+	}
+	if fi.Size() != 6 {
+		t.Errorf("invalid file size: want=%d got=%d", 6, fi.Size())
+	}
+}
+
+func TestFileStorage_Sync(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldb-testsync-%d", os.Getuid()))
+	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(path)
+
+	fs, err := OpenFile(path, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+
+	fd := FileDesc{Type: TypeManifest, Num: 2}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	w.Close()
+	if err := fs.(Syncer).Sync(); err != nil {
+		t.Fatal("Sync: got error: ", err)
+	}
+	if err := fs.SetMeta(fd); err != nil {
+		t.Fatal("SetMeta: got error: ", err)
+	}
+
+	// The pending CURRENT file is renamed to CURRENT.
+	names, err := filepath.Glob(filepath.Join(path, "CURRENT*"))
+	if err != nil {
+		t.Fatal("Glob: got error: ", err)
+	}
+	if len(names) != 1 || filepath.Base(names[0]) != "CURRENT" {
+		t.Errorf("invalid CURRENT files: %v", names)
+	}
+	if mfd, err := fs.GetMeta(); err != nil || mfd != fd {
+		t.Errorf("GetMeta: want=%v got=%v err=%v", fd, mfd, err)
+	}
+
+	fs.Close()
+	if err := fs.(Syncer).Sync(); err != ErrClosed {
+		t.Errorf("Sync after close: want=%v got=%v", ErrClosed, err)
+	}
+}
+
+func TestFileStorage_Archive(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldb-testarchive-%d", os.Getuid()))
+	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(path)
+
+	fs, err := OpenFile(path, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := FileDesc{Type: TypeJournal, Num: 3}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	if _, err := w.Write([]byte("foobar")); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	w.Close()
+
+	if err := fs.(Archiver).Archive(fd); err != nil {
+		t.Fatal("Archive: got error: ", err)
+	}
+	fds, err := fs.List(TypeAll)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	if len(fds) != 0 {
+		t.Errorf("archived file still listed: %v", fds)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(path, ArchiveDir, "000003.log"))
+	if err != nil {
+		t.Fatal("ReadFile: got error: ", err)
+	}
+	if string(data) != "foobar" {
+		t.Errorf("invalid archived content: want=%q got=%q", "foobar", data)
+	}
+	if err := fs.(Archiver).Archive(fd); !os.IsNotExist(err) {
+		t.Errorf("Archive of missing file: want not exist error, got=%v", err)
+	}
+}
+
+func TestFileStorage_Link(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldb-testlink-%d", os.Getuid()))
+	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(path)
+
+	fs, err := OpenFile(filepath.Join(path, "src"), false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+	dst, err := OpenFile(filepath.Join(path, "dst"), false)
+	if err != nil {
+		t.Fatal("OpenFile (dst): got error: ", err)
+	}
+	defer dst.Close()
+
+	fd := FileDesc{Type: TypeTable, Num: 3}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	if _, err := w.Write([]byte("foobar")); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	w.Close()
+
+	if err := fs.(Linker).Link(fd, dst); err != nil {
+		t.Fatal("Link: got error: ", err)
+	}
+	fi1, err := os.Stat(filepath.Join(path, "src", "000003.ldb"))
+	if err != nil {
+		t.Fatal("Stat: got error: ", err)
+	}
+	fi2, err := os.Stat(filepath.Join(path, "dst", "000003.ldb"))
+	if err != nil {
+		t.Fatal("Stat (dst): got error: ", err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Error("linked file isn't the same file")
+	}
+	if err := fs.(Linker).Link(fd, dst); !os.IsExist(err) {
+		t.Errorf("Link of existing file: want exist error, got=%v", err)
+	}
+	if err := fs.(Linker).Link(fd, NewMemStorage()); err != ErrNotSupported {
+		t.Errorf("Link into memory storage: want=%v got=%v", ErrNotSupported, err)
+	}
+}
+
+func TestFileStorage_Import(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldb-testimport-%d", os.Getuid()))
+	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(path)
+
+	fs, err := OpenFile(filepath.Join(path, "db"), false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+	src := filepath.Join(path, "src.ldb")
+	if err := ioutil.WriteFile(src, []byte("foobar"), 0644); err != nil {
+		t.Fatal("WriteFile: got error: ", err)
+	}
+
+	fd := FileDesc{Type: TypeTable, Num: 3}
+	if err := fs.(Importer).Import(src, fd); err != nil {
+		t.Fatal("Import: got error: ", err)
+	}
+	fi1, err := os.Stat(src)
+	if err != nil {
+		t.Fatal("Stat: got error: ", err)
+	}
+	fi2, err := os.Stat(filepath.Join(path, "db", "000003.ldb"))
+	if err != nil {
+		t.Fatal("Stat (db): got error: ", err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Error("imported file isn't the same file")
+	}
+	if err := fs.(Importer).Import(src, fd); !os.IsExist(err) {
+		t.Errorf("Import of existing file: want exist error, got=%v", err)
+	}
+	if err := fs.(Importer).Import(filepath.Join(path, "missing.ldb"), FileDesc{Type: TypeTable, Num: 4}); !os.IsNotExist(err) {
+		t.Errorf("Import of missing file: want not exist error, got=%v", err)
+	}
+}
+
+func TestFileStorage_DropCache(t *testing.T) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("goleveldb-testdropcache-%d", os.Getuid()))
+	if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+		t.Fatal("RemoveAll: got error: ", err)
+	}
+	defer os.RemoveAll(path)
+
+	fs, err := OpenFile(path, false)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	defer fs.Close()
+
+	fd := FileDesc{Type: TypeTable, Num: 1}
+	w, err := fs.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	w.Write([]byte("foobar"))
+	w.Sync()
+	if err := w.(CacheDropper).DropCache(); err != nil && err != ErrNotSupported {
+		t.Error("DropCache: got error: ", err)
+	}
+	w.Close()
+	if err := w.(CacheDropper).DropCache(); err != ErrClosed {
+		t.Errorf("DropCache on closed file: want=%v got=%v", ErrClosed, err)
+	}
+
+	r, err := fs.Open(fd)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	defer r.Close()
+	if err := r.(CacheDropper).DropCache(); err != nil && err != ErrNotSupported {
+		t.Error("DropCache: got error: ", err)
+	}
+}
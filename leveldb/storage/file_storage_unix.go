@@ -24,6 +24,14 @@ func (fl *unixFileLock) release() error {
 	return fl.f.Close()
 }
 
+func (fl *unixFileLock) setOwner(b []byte) error {
+	if err := fl.f.Truncate(0); err != nil {
+		return err
+	}
+	_, err := fl.f.WriteAt(b, 0)
+	return err
+}
+
 func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	var flag int
 	if readOnly {
@@ -59,6 +67,28 @@ func setFileLock(f *os.File, readOnly, lock bool) error {
 	return syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
 }
 
+func isErrLocked(err error) bool {
+	return err == syscall.EWOULDBLOCK
+}
+
+func processAlive(pid int) (alive, ok bool) {
+	switch err := syscall.Kill(pid, 0); err {
+	case nil, syscall.EPERM:
+		return true, true
+	case syscall.ESRCH:
+		return false, true
+	}
+	return false, false
+}
+
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(b []byte) error {
+	return syscall.Munmap(b)
+}
+
 func rename(oldpath, newpath string) error {
 	return os.Rename(oldpath, newpath)
 }
@@ -7,6 +7,7 @@
 package storage
 
 import (
+	"os"
 	"syscall"
 	"unsafe"
 )
@@ -19,6 +20,9 @@ var (
 
 const (
 	_MOVEFILE_REPLACE_EXISTING = 1
+	_MOVEFILE_WRITE_THROUGH    = 8
+
+	_ERROR_SHARING_VIOLATION syscall.Errno = 32
 )
 
 type windowsFileLock struct {
@@ -29,6 +33,17 @@ func (fl *windowsFileLock) release() error {
 	return syscall.Close(fl.fd)
 }
 
+func (fl *windowsFileLock) setOwner(b []byte) error {
+	if err := syscall.Ftruncate(fl.fd, 0); err != nil {
+		return err
+	}
+	if _, err := syscall.Seek(fl.fd, 0, 0); err != nil {
+		return err
+	}
+	_, err := syscall.Write(fl.fd, b)
+	return err
+}
+
 func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	pathp, err := syscall.UTF16PtrFromString(path)
 	if err != nil {
@@ -52,6 +67,14 @@ func newFileLock(path string, readOnly bool) (fl fileLock, err error) {
 	return
 }
 
+func isErrLocked(err error) bool {
+	return err == _ERROR_SHARING_VIOLATION
+}
+
+// The lock file is opened for exclusive use, so its owner can't be read
+// while it is locked anyway.
+func processAlive(pid int) (alive, ok bool) { return false, false }
+
 func moveFileEx(from *uint16, to *uint16, flags uint32) error {
 	r1, _, e1 := syscall.Syscall(procMoveFileExW.Addr(), 3, uintptr(unsafe.Pointer(from)), uintptr(unsafe.Pointer(to)), uintptr(flags))
 	if r1 == 0 {
@@ -63,6 +86,14 @@ func moveFileEx(from *uint16, to *uint16, flags uint32) error {
 	return nil
 }
 
+func mmapFile(f *os.File, size int) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
+
 func rename(oldpath, newpath string) error {
 	from, err := syscall.UTF16PtrFromString(oldpath)
 	if err != nil {
@@ -72,7 +103,8 @@ func rename(oldpath, newpath string) error {
 	if err != nil {
 		return err
 	}
-	return moveFileEx(from, to, _MOVEFILE_REPLACE_EXISTING)
+	// The directory can't be synced, so the rename is written through.
+	return moveFileEx(from, to, _MOVEFILE_REPLACE_EXISTING|_MOVEFILE_WRITE_THROUGH)
 }
 
 func syncDir(name string) error { return nil }
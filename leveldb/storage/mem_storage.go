@@ -12,7 +12,7 @@ import (
 	"sync"
 )
 
-const typeShift = 3
+const typeShift = 5
 
 type memStorageLock struct {
 	ms *memStorage
@@ -47,7 +47,7 @@ func (ms *memStorage) Lock() (Locker, error) {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 	if ms.slock != nil {
-		return nil, ErrLocked
+		return nil, &ErrLocked{}
 	}
 	ms.slock = &memStorageLock{ms: ms}
 	return ms.slock, nil
@@ -143,7 +143,7 @@ func (ms *memStorage) Remove(fd FileDesc) error {
 }
 
 func (ms *memStorage) Rename(oldfd, newfd FileDesc) error {
-	if FileDescOk(oldfd) || FileDescOk(newfd) {
+	if !FileDescOk(oldfd) || !FileDescOk(newfd) {
 		return ErrInvalidFile
 	}
 	if oldfd == newfd {
@@ -167,6 +167,24 @@ func (ms *memStorage) Rename(oldfd, newfd FileDesc) error {
 	return nil
 }
 
+func (ms *memStorage) Recycle(oldfd, newfd FileDesc) (Writer, error) {
+	if err := ms.Rename(oldfd, newfd); err != nil {
+		return nil, err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	m, exist := ms.files[packFile(newfd)]
+	if !exist {
+		return nil, os.ErrNotExist
+	}
+	if m.open {
+		return nil, errFileOpen
+	}
+	m.open = true
+	return &memWriter{memFile: m, ms: ms}, nil
+}
+
 func (*memStorage) Close() error { return nil }
 
 type memFile struct {
@@ -187,16 +205,37 @@ func (mr *memReader) Close() error {
 	if mr.closed {
 		return ErrClosed
 	}
+	mr.closed = true
 	mr.m.open = false
 	return nil
 }
 
+func (mr *memReader) Mmap() ([]byte, error) {
+	mr.ms.mu.Lock()
+	defer mr.ms.mu.Unlock()
+	if mr.closed {
+		return nil, ErrClosed
+	}
+	b := mr.m.Bytes()
+	return b[:len(b):len(b)], nil
+}
+
 type memWriter struct {
 	*memFile
 	ms     *memStorage
+	off    int
 	closed bool
 }
 
+// Write overwrites the file from the current offset, the file is only
+// extended once the offset reaches its end.
+func (mw *memWriter) Write(p []byte) (int, error) {
+	n := copy(mw.Bytes()[mw.off:], p)
+	mw.memFile.Write(p[n:])
+	mw.off += len(p)
+	return len(p), nil
+}
+
 func (*memWriter) Sync() error { return nil }
 
 func (mw *memWriter) Close() error {
@@ -205,6 +244,7 @@ func (mw *memWriter) Close() error {
 	if mw.closed {
 		return ErrClosed
 	}
+	mw.closed = true
 	mw.memFile.open = false
 	return nil
 }
@@ -63,3 +63,45 @@ func TestMemStorage(t *testing.T) {
 		t.Fatal("expecting error")
 	}
 }
+
+func TestMemStorageRename(t *testing.T) {
+	m := NewMemStorage()
+
+	fd1 := FileDesc{TypeTemp, 1}
+	fd2 := FileDesc{TypeTable, 2}
+	w, err := m.Create(fd1)
+	if err != nil {
+		t.Fatal("Storage.Create: ", err)
+	}
+	w.Write([]byte("abc"))
+	if err := m.Rename(fd1, fd2); err == nil {
+		t.Fatal("Rename: expecting error on open file")
+	}
+	w.Close()
+	if err := w.Close(); err != ErrClosed {
+		t.Fatalf("Close: expecting ErrClosed, got %v", err)
+	}
+
+	if err := m.Rename(fd1, fd2); err != nil {
+		t.Fatal("Rename: got error: ", err)
+	}
+	if _, err := m.Open(fd1); err == nil {
+		t.Fatal("Open: expecting error on renamed file")
+	}
+	r, err := m.Open(fd2)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	buf := new(bytes.Buffer)
+	buf.ReadFrom(r)
+	r.Close()
+	if got := buf.String(); got != "abc" {
+		t.Fatalf("Read: invalid value, want=abc got=%s", got)
+	}
+	if err := r.Close(); err != ErrClosed {
+		t.Fatalf("Close: expecting ErrClosed, got %v", err)
+	}
+	if err := m.Rename(fd2, FileDesc{}); err != ErrInvalidFile {
+		t.Fatalf("Rename: expecting ErrInvalidFile, got %v", err)
+	}
+}
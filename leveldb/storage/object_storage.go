@@ -0,0 +1,301 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ObjectStore is the interface of an object store, such as Amazon S3 or
+// Google Cloud Storage, see NewObjectStorage. An object is written whole
+// and never modified. An ObjectStore must be safe for concurrent use.
+//
+// An implementation backed by Amazon S3 could read the objects with
+// ranged GET requests:
+//
+//	func (s *s3Store) ReadAt(name string, p []byte, off int64) (int, error) {
+//		out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+//			Bucket: aws.String(s.bucket),
+//			Key:    aws.String(name),
+//			Range:  aws.String(fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1)),
+//		})
+//		if err != nil {
+//			return 0, err
+//		}
+//		defer out.Body.Close()
+//		return io.ReadFull(out.Body, p)
+//	}
+type ObjectStore interface {
+	// Put stores the object with the given name, whose content of the
+	// given size is read from r. An existing object with the same name
+	// is replaced.
+	Put(name string, r io.Reader, size int64) error
+
+	// Size returns the size of the object with the given name.
+	// Returns os.ErrNotExist if the object doesn't exist.
+	Size(name string) (int64, error)
+
+	// ReadAt reads len(p) bytes of the object with the given name starting
+	// at offset off. It is only called within the size of the object.
+	ReadAt(name string, p []byte, off int64) (n int, err error)
+
+	// Delete deletes the object with the given name. Deleting a
+	// nonexistent object isn't an error.
+	Delete(name string) error
+
+	// List returns the names of the objects with the given prefix.
+	List(prefix string) ([]string, error)
+}
+
+type objectStorage struct {
+	store  ObjectStore
+	prefix string
+	cache  Storage
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewObjectStorage returns a storage that keeps its files as objects of
+// the given object store, named with the given prefix, e.g. "db/". It is
+// meant for immutable files such as the tables, usually as the secondary
+// storage of NewTieredStorage.
+//
+// The files are written through the given local cache storage: a file is
+// created on the cache storage and is stored as an object once closed.
+// A file is read from the cache storage if it is found there, otherwise
+// it is read from the object store, so the cache storage may be emptied
+// or replaced, e.g. on another host. The lock, the meta and the log are
+// kept by the cache storage.
+//
+// Closing the object storage closes the cache storage.
+func NewObjectStorage(store ObjectStore, prefix string, cache Storage) Storage {
+	return &objectStorage{store: store, prefix: prefix, cache: cache}
+}
+
+func (s *objectStorage) name(fd FileDesc) string {
+	return s.prefix + fsGenName(fd)
+}
+
+func (s *objectStorage) ok() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+func (s *objectStorage) Lock() (Locker, error) {
+	return s.cache.Lock()
+}
+
+func (s *objectStorage) Log(str string) {
+	s.cache.Log(str)
+}
+
+func (s *objectStorage) SetMeta(fd FileDesc) error {
+	return s.cache.SetMeta(fd)
+}
+
+func (s *objectStorage) GetMeta() (FileDesc, error) {
+	return s.cache.GetMeta()
+}
+
+// List lists the files of the object store and the files of the cache
+// storage that aren't stored yet, e.g. left behind by a crash.
+func (s *objectStorage) List(ft FileType) (fds []FileDesc, err error) {
+	if err := s.ok(); err != nil {
+		return nil, err
+	}
+	names, err := s.store.List(s.prefix)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[FileDesc]bool)
+	for _, name := range names {
+		if fd, ok := fsParseName(strings.TrimPrefix(name, s.prefix)); ok && fd.Type&ft != 0 && !seen[fd] {
+			seen[fd] = true
+			fds = append(fds, fd)
+		}
+	}
+	cached, err := s.cache.List(ft)
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range cached {
+		if !seen[fd] {
+			seen[fd] = true
+			fds = append(fds, fd)
+		}
+	}
+	return fds, nil
+}
+
+func (s *objectStorage) Open(fd FileDesc) (Reader, error) {
+	if !FileDescOk(fd) {
+		return nil, ErrInvalidFile
+	}
+	if err := s.ok(); err != nil {
+		return nil, err
+	}
+	r, err := s.cache.Open(fd)
+	if err == nil || !os.IsNotExist(err) {
+		return r, err
+	}
+	return newObjectReader(s.store, s.name(fd))
+}
+
+func (s *objectStorage) Create(fd FileDesc) (Writer, error) {
+	if !FileDescOk(fd) {
+		return nil, ErrInvalidFile
+	}
+	if err := s.ok(); err != nil {
+		return nil, err
+	}
+	w, err := s.cache.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{Writer: w, s: s, fd: fd}, nil
+}
+
+// Stores the file of the cache storage as an object.
+func (s *objectStorage) put(fd FileDesc) error {
+	r, err := s.cache.Open(fd)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.store.Put(s.name(fd), r, size)
+}
+
+func (s *objectStorage) Remove(fd FileDesc) error {
+	if !FileDescOk(fd) {
+		return ErrInvalidFile
+	}
+	if err := s.ok(); err != nil {
+		return err
+	}
+	err := s.store.Delete(s.name(fd))
+	if cerr := s.cache.Remove(fd); err == nil && cerr != nil && !os.IsNotExist(cerr) {
+		err = cerr
+	}
+	return err
+}
+
+// Rename stores the file as an object with the new name, and deletes the
+// object with the old name; objects can't be renamed.
+func (s *objectStorage) Rename(oldfd, newfd FileDesc) error {
+	if !FileDescOk(oldfd) || !FileDescOk(newfd) {
+		return ErrInvalidFile
+	}
+	if err := s.ok(); err != nil {
+		return err
+	}
+	if oldfd == newfd {
+		return nil
+	}
+	err := s.cache.Rename(oldfd, newfd)
+	if err == nil {
+		err = s.put(newfd)
+	} else if os.IsNotExist(err) {
+		// Not cached, copy the object.
+		var r *objectReader
+		if r, err = newObjectReader(s.store, s.name(oldfd)); err == nil {
+			err = s.store.Put(s.name(newfd), r, r.size)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.store.Delete(s.name(oldfd))
+}
+
+// Sync syncs the cache storage, if it implements Syncer.
+func (s *objectStorage) Sync() error {
+	if ss, ok := s.cache.(Syncer); ok {
+		return ss.Sync()
+	}
+	return nil
+}
+
+func (s *objectStorage) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+	return s.cache.Close()
+}
+
+type objectReader struct {
+	*io.SectionReader
+	store ObjectStore
+	name  string
+	size  int64
+}
+
+func newObjectReader(store ObjectStore, name string) (*objectReader, error) {
+	size, err := store.Size(name)
+	if err != nil {
+		return nil, err
+	}
+	r := &objectReader{store: store, name: name, size: size}
+	r.SectionReader = io.NewSectionReader(r, 0, size)
+	return r, nil
+}
+
+// ReadAt reads from the object, the reads past the end of the object are
+// cut to return io.EOF.
+func (r *objectReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var eof bool
+	if rem := r.size - off; int64(len(p)) > rem {
+		p, eof = p[:rem], true
+	}
+	n, err = r.store.ReadAt(r.name, p, off)
+	if err == nil && eof {
+		err = io.EOF
+	}
+	return
+}
+
+func (*objectReader) Close() error { return nil }
+
+type objectWriter struct {
+	Writer
+	s      *objectStorage
+	fd     FileDesc
+	closed bool
+}
+
+// Close closes the file of the cache storage and stores it as an object.
+func (w *objectWriter) Close() error {
+	if w.closed {
+		return ErrClosed
+	}
+	w.closed = true
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	return w.s.put(w.fd)
+}
@@ -0,0 +1,229 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type memObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemObjectStore() *memObjectStore {
+	return &memObjectStore{objects: make(map[string][]byte)}
+}
+
+func (s *memObjectStore) Put(name string, r io.Reader, size int64) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != size {
+		return io.ErrUnexpectedEOF
+	}
+	s.mu.Lock()
+	s.objects[name] = b
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memObjectStore) get(name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.objects[name]
+	return b, ok
+}
+
+func (s *memObjectStore) Size(name string) (int64, error) {
+	b, ok := s.get(name)
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	return int64(len(b)), nil
+}
+
+func (s *memObjectStore) ReadAt(name string, p []byte, off int64) (int, error) {
+	b, ok := s.get(name)
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	if off+int64(len(p)) > int64(len(b)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(p, b[off:]), nil
+}
+
+func (s *memObjectStore) Delete(name string) error {
+	s.mu.Lock()
+	delete(s.objects, name)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memObjectStore) List(prefix string) (names []string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name := range s.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+func writeFile(t *testing.T, s Storage, fd FileDesc, data string) {
+	w, err := s.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	if _, err := w.Write([]byte(data)); err != nil {
+		t.Fatal("Write: got error: ", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+}
+
+func readFile(t *testing.T, s Storage, fd FileDesc) string {
+	r, err := s.Open(fd)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read: got error: ", err)
+	}
+	return string(b)
+}
+
+func TestObjectStorage(t *testing.T) {
+	store := newMemObjectStore()
+	cache := NewMemStorage()
+	s := NewObjectStorage(store, "db/", cache)
+	defer s.Close()
+
+	fd1, fd2 := FileDesc{TypeTable, 1}, FileDesc{TypeTable, 2}
+	writeFile(t, s, fd1, "foobar")
+	if b, ok := store.get("db/000001.ldb"); !ok || string(b) != "foobar" {
+		t.Fatalf("invalid object: %q (exist=%v)", b, ok)
+	}
+
+	// The file is read from the object store once removed from the cache.
+	if err := cache.Remove(fd1); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	if got := readFile(t, s, fd1); got != "foobar" {
+		t.Errorf("Read: want=foobar got=%q", got)
+	}
+	r, err := s.Open(fd1)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	p := make([]byte, 4)
+	if n, err := r.ReadAt(p, 3); n != 3 || err != io.EOF || string(p[:n]) != "bar" {
+		t.Errorf("ReadAt past the end: got n=%d err=%v data=%q", n, err, p[:n])
+	}
+	r.Close()
+
+	// Uncached files are renamed by copying the object.
+	if err := s.Rename(fd1, fd2); err != nil {
+		t.Fatal("Rename: got error: ", err)
+	}
+	if _, ok := store.get("db/000001.ldb"); ok {
+		t.Error("old object not deleted")
+	}
+	if got := readFile(t, s, fd2); got != "foobar" {
+		t.Errorf("Read: want=foobar got=%q", got)
+	}
+
+	writeFile(t, s, FileDesc{TypeTemp, 3}, "baz")
+	if err := s.Rename(FileDesc{TypeTemp, 3}, fd1); err != nil {
+		t.Fatal("Rename: got error: ", err)
+	}
+	fds, err := s.List(TypeTable)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	if len(fds) != 2 || fds[0] != fd1 || fds[1] != fd2 {
+		t.Errorf("invalid files: %v", fds)
+	}
+
+	if err := s.Remove(fd1); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	if fds, _ := cache.List(TypeAll); len(fds) != 0 {
+		t.Errorf("cached files not removed: %v", fds)
+	}
+	if names, _ := store.List(""); len(names) != 1 || names[0] != "db/000002.ldb" {
+		t.Errorf("invalid objects: %v", names)
+	}
+}
+
+func TestTieredStorage(t *testing.T) {
+	primary, secondary := NewMemStorage(), NewMemStorage()
+	s := NewTieredStorage(primary, secondary, TypeTable)
+	defer s.Close()
+
+	journal, table := FileDesc{TypeJournal, 1}, FileDesc{TypeTable, 2}
+	writeFile(t, s, journal, "journal")
+	writeFile(t, s, table, "table")
+	if fds, _ := primary.List(TypeAll); len(fds) != 1 || fds[0] != journal {
+		t.Errorf("invalid primary files: %v", fds)
+	}
+	if fds, _ := secondary.List(TypeAll); len(fds) != 1 || fds[0] != table {
+		t.Errorf("invalid secondary files: %v", fds)
+	}
+	if fds, _ := s.List(TypeAll); len(fds) != 2 {
+		t.Errorf("invalid files: %v", fds)
+	}
+	if fds, _ := s.List(TypeTable); len(fds) != 1 || fds[0] != table {
+		t.Errorf("invalid table files: %v", fds)
+	}
+
+	// A temporary file is copied to the secondary storage once renamed to
+	// a table.
+	tmp, table2 := FileDesc{TypeTemp, 3}, FileDesc{TypeTable, 3}
+	writeFile(t, s, tmp, "table2")
+	if err := s.Rename(tmp, table2); err != nil {
+		t.Fatal("Rename: got error: ", err)
+	}
+	if fds, _ := primary.List(TypeAll); len(fds) != 1 {
+		t.Errorf("temporary file not removed: %v", fds)
+	}
+	if got := readFile(t, secondary, table2); got != "table2" {
+		t.Errorf("Read: want=table2 got=%q", got)
+	}
+
+	manifest := FileDesc{TypeManifest, 4}
+	writeFile(t, s, manifest, "manifest")
+	if err := s.SetMeta(manifest); err != nil {
+		t.Fatal("SetMeta: got error: ", err)
+	}
+	if fd, err := primary.GetMeta(); err != nil || fd != manifest {
+		t.Errorf("GetMeta: want=%v got=%v err=%v", manifest, fd, err)
+	}
+
+	if err := s.Remove(table); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	if _, err := secondary.Open(table); !os.IsNotExist(err) {
+		t.Errorf("Open removed table: want not exist error, got %v", err)
+	}
+	if got := readFile(t, s, journal); got != "journal" {
+		t.Errorf("Read: want=journal got=%q", got)
+	}
+}
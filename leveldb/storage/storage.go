@@ -22,8 +22,9 @@ const (
 	TypeJournal
 	TypeTable
 	TypeTemp
+	TypeValueLog
 
-	TypeAll = TypeManifest | TypeJournal | TypeTable | TypeTemp
+	TypeAll = TypeManifest | TypeJournal | TypeTable | TypeTemp | TypeValueLog
 )
 
 func (t FileType) String() string {
@@ -36,15 +37,17 @@ func (t FileType) String() string {
 		return "table"
 	case TypeTemp:
 		return "temp"
+	case TypeValueLog:
+		return "value-log"
 	}
 	return fmt.Sprintf("<unknown:%d>", t)
 }
 
 // Common error.
 var (
-	ErrInvalidFile = errors.New("leveldb/storage: invalid file for argument")
-	ErrLocked      = errors.New("leveldb/storage: already locked")
-	ErrClosed      = errors.New("leveldb/storage: closed")
+	ErrInvalidFile  = errors.New("leveldb/storage: invalid file for argument")
+	ErrClosed       = errors.New("leveldb/storage: closed")
+	ErrNotSupported = errors.New("leveldb/storage: not supported")
 )
 
 // ErrCorrupted is the type that wraps errors that indicate corruption of
@@ -63,6 +66,12 @@ func (e *ErrCorrupted) Error() string {
 }
 
 // Syncer is the interface that wraps basic Sync method.
+//
+// A Storage may implement Syncer as well; its Sync commits the creation,
+// removal and renaming of files to stable storage, e.g. by syncing the
+// directory of the files. The DB syncs the storage before it depends on a
+// created file to be found after a crash, such as a journal or a table
+// referenced by the manifest.
 type Syncer interface {
 	// Sync commits the current contents of the file to stable storage.
 	Sync() error
@@ -76,6 +85,16 @@ type Reader interface {
 	io.Closer
 }
 
+// MmapReader is the interface that wraps Reader with the Mmap method.
+//
+// Mmap maps the whole file into memory and returns it. The returned slice
+// must not be modified and is valid until the reader is closed. Mmap
+// returns ErrNotSupported if the platform or the file doesn't support it.
+type MmapReader interface {
+	Reader
+	Mmap() ([]byte, error)
+}
+
 // Writer is the interface that groups the basic Write, Sync and Close
 // methods.
 type Writer interface {
@@ -83,6 +102,48 @@ type Writer interface {
 	Syncer
 }
 
+// Preallocator is the interface that wraps Writer with the Preallocate
+// method.
+//
+// Preallocate reserves disk space for the file up to the given size,
+// without changing the file size. Preallocate returns ErrNotSupported if
+// the platform or the file system doesn't support it.
+type Preallocator interface {
+	Writer
+	Preallocate(size int64) error
+}
+
+// Truncater is the interface that wraps Writer with the Truncate method.
+//
+// Truncate changes the size of the file, which releases the disk space
+// preallocated past the size, see Preallocator.
+type Truncater interface {
+	Writer
+	Truncate(size int64) error
+}
+
+// RangeSyncer is the interface that wraps Writer with the SyncRange method.
+//
+// SyncRange starts writing back the given range of the file, without
+// waiting for it to complete, so a later Sync has less to write. It
+// doesn't make the range durable. SyncRange returns ErrNotSupported if
+// the platform doesn't support it.
+type RangeSyncer interface {
+	Writer
+	SyncRange(off, n int64) error
+}
+
+// CacheDropper is the interface that wraps the DropCache method, it may be
+// implemented by a Reader or a Writer.
+//
+// DropCache advises the OS that the cached pages of the file won't be
+// needed soon, e.g. once the file is sequentially read, or written and
+// synced. DropCache returns ErrNotSupported if the platform doesn't
+// support it.
+type CacheDropper interface {
+	DropCache() error
+}
+
 // Locker is the interface that wraps Unlock method.
 type Locker interface {
 	Unlock()
@@ -104,6 +165,8 @@ func (fd FileDesc) String() string {
 		return fmt.Sprintf("%06d.ldb", fd.Num)
 	case TypeTemp:
 		return fmt.Sprintf("%06d.tmp", fd.Num)
+	case TypeValueLog:
+		return fmt.Sprintf("%06d.vlog", fd.Num)
 	default:
 		return fmt.Sprintf("%#x-%d", fd.Type, fd.Num)
 	}
@@ -121,6 +184,7 @@ func FileDescOk(fd FileDesc) bool {
 	case TypeJournal:
 	case TypeTable:
 	case TypeTemp:
+	case TypeValueLog:
 	default:
 		return false
 	}
@@ -177,3 +241,52 @@ type Storage interface {
 	// called after the storage has been closed.
 	Close() error
 }
+
+// Archiver is the interface that wraps Storage with the Archive method.
+//
+// Archive moves the file with the given 'file descriptor' out of the
+// storage into its archive, where it is no longer listed nor opened by
+// the storage. The archive is left for external consumers, which are
+// responsible for removing the archived files.
+// Returns ErrClosed if the underlying storage is closed.
+type Archiver interface {
+	Storage
+	Archive(fd FileDesc) error
+}
+
+// Linker is the interface that wraps Storage with the Link method.
+//
+// Link makes the file with the given 'file descriptor' available in the
+// destination storage under the same 'file descriptor' without copying
+// its content, e.g. by hard-linking it. The linked file must not be
+// written afterwards. Returns ErrNotSupported if the file can't be linked
+// into the destination storage, e.g. it resides on another file system.
+// Returns ErrClosed if the underlying storage is closed.
+type Linker interface {
+	Storage
+	Link(fd FileDesc, dst Storage) error
+}
+
+// Importer is the interface that wraps Storage with the Import method.
+//
+// Import makes the external file at the given path available in the
+// storage under the given 'file descriptor' without copying its content,
+// e.g. by hard-linking it. The imported file must not be written
+// afterwards. Returns ErrNotSupported if the file can't be imported, e.g.
+// it resides on another file system.
+// Returns ErrClosed if the underlying storage is closed.
+type Importer interface {
+	Storage
+	Import(path string, fd FileDesc) error
+}
+
+// Recycler is the interface that wraps Storage with the Recycle method.
+//
+// Recycle renames the file from oldfd to newfd and opens it write-only,
+// without truncating it. Writes overwrite the file from its start, reusing
+// its allocated space; the content past the written bytes is left as is.
+// Returns ErrClosed if the underlying storage is closed.
+type Recycler interface {
+	Storage
+	Recycle(oldfd, newfd FileDesc) (Writer, error)
+}
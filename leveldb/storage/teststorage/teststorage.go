@@ -0,0 +1,496 @@
+// Copyright (c) 2014, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package teststorage provides a storage that injects faults into the
+// operations of another storage, so that applications can test how they
+// recover from storage errors and power cuts.
+//
+// For example, to fail the second sync of a journal:
+//
+//	stor := teststorage.New(storage.NewMemStorage())
+//	stor.Inject(teststorage.Fault{
+//		Ops:   teststorage.OpSync,
+//		Types: storage.TypeJournal,
+//		Skip:  1,
+//		Count: 1,
+//		Err:   errors.New("disk failure"),
+//	})
+//	db, err := leveldb.Open(stor, nil)
+package teststorage
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+)
+
+// SectorSize is the size of the sectors, a write torn by a power cut is
+// persisted up to a sector boundary.
+const SectorSize = 512
+
+var (
+	// ErrInjected is returned by a faulted operation whose fault doesn't
+	// specify an error.
+	ErrInjected = errors.New("leveldb/storage/teststorage: injected fault")
+	// ErrPowerCut is returned by the operations while the power is cut.
+	ErrPowerCut = errors.New("leveldb/storage/teststorage: power cut")
+)
+
+// Op is a set of storage operations.
+type Op int
+
+const (
+	OpOpen Op = 1 << iota
+	OpCreate
+	OpRemove
+	OpRename
+	OpRead
+	OpWrite
+	OpSync
+	OpClose
+
+	OpAll = OpOpen | OpCreate | OpRemove | OpRename | OpRead | OpWrite | OpSync | OpClose
+)
+
+// Fault describes a fault injected into the operations on files.
+type Fault struct {
+	// Ops are the faulted operations. Renaming and recycling a file, and
+	// setting the meta are OpRename; listing the files and getting the
+	// meta are OpOpen; archiving a file is OpRemove.
+	Ops Op
+
+	// Types are the types of the faulted files, zero means all types. The
+	// Sync method of the storage, which syncs the directory, is an OpSync
+	// of any type.
+	Types storage.FileType
+
+	// Err is the error returned by the faulted operations. If nil the
+	// operations return ErrInjected, or io.ErrShortWrite for ShortWrite,
+	// unless only Latency is set.
+	Err error
+
+	// ShortWrite makes a faulted write write only half of the data before
+	// failing.
+	ShortWrite bool
+
+	// Latency delays the faulted operations. If Latency is set and Err is
+	// nil the operations succeed once delayed.
+	Latency time.Duration
+
+	// Probability is the probability that a matching operation is faulted,
+	// zero means always.
+	Probability float64
+
+	// Skip is the number of matching operations to let through before
+	// faulting any.
+	Skip int
+
+	// Count is the number of operations to fault, after which the fault
+	// is removed; zero means unlimited.
+	Count int
+}
+
+func (f *Fault) match(op Op, ft storage.FileType) bool {
+	return f.Ops&op != 0 && (f.Types == 0 || f.Types&ft != 0)
+}
+
+func (f *Fault) err() error {
+	if f.Err != nil {
+		return f.Err
+	}
+	if f.ShortWrite {
+		return io.ErrShortWrite
+	}
+	if f.Latency > 0 {
+		return nil
+	}
+	return ErrInjected
+}
+
+type fileSize struct {
+	synced, size int64
+}
+
+// Storage is a storage that injects faults into the operations of the
+// underlying storage. It is safe for concurrent use.
+type Storage struct {
+	storage.Storage
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	faults   []*Fault
+	sizes    map[storage.FileDesc]fileSize
+	powerCut bool
+}
+
+// New returns a storage injecting faults into the operations of the given
+// storage.
+func New(base storage.Storage) *Storage {
+	return &Storage{
+		Storage: base,
+		rand:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		sizes:   make(map[storage.FileDesc]fileSize),
+	}
+}
+
+// Seed seeds the source of the faults with a Probability and of the torn
+// writes, to make them reproducible.
+func (s *Storage) Seed(seed int64) {
+	s.mu.Lock()
+	s.rand.Seed(seed)
+	s.mu.Unlock()
+}
+
+// Inject injects the given fault. The faults are matched in the order they
+// are injected, the first matching fault applies.
+func (s *Storage) Inject(f Fault) {
+	s.mu.Lock()
+	s.faults = append(s.faults, &f)
+	s.mu.Unlock()
+}
+
+// Clear removes all the injected faults.
+func (s *Storage) Clear() {
+	s.mu.Lock()
+	s.faults = nil
+	s.mu.Unlock()
+}
+
+// Returns the fault to inject into the given operation, if any.
+func (s *Storage) fault(op Op, ft storage.FileType) (*Fault, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.powerCut && op != OpClose {
+		return nil, ErrPowerCut
+	}
+	for i, f := range s.faults {
+		if !f.match(op, ft) {
+			continue
+		}
+		if f.Skip > 0 {
+			f.Skip--
+			return nil, nil
+		}
+		if f.Probability > 0 && s.rand.Float64() >= f.Probability {
+			return nil, nil
+		}
+		if f.Count > 0 {
+			if f.Count--; f.Count == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return f, nil
+	}
+	return nil, nil
+}
+
+// Injects the fault into the given operation, returns the error of the
+// operation.
+func (s *Storage) inject(op Op, ft storage.FileType) error {
+	f, err := s.fault(op, ft)
+	if f == nil {
+		return err
+	}
+	if f.Latency > 0 {
+		time.Sleep(f.Latency)
+	}
+	return f.err()
+}
+
+// PowerCut cuts the power: all the operations but closing the files fail
+// with ErrPowerCut until Restart is called.
+func (s *Storage) PowerCut() {
+	s.mu.Lock()
+	s.powerCut = true
+	s.mu.Unlock()
+}
+
+// Restart restores the power cut by PowerCut, once all the files are
+// closed, e.g. once the DB is closed. The data written to each file since
+// it was last synced is lost, except for a random number of whole sectors
+// that were persisted before the power was cut, see SectorSize.
+func (s *Storage) Restart() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for fd, sz := range s.sizes {
+		if sz.size <= sz.synced {
+			continue
+		}
+		n := sz.synced + s.rand.Int63n((sz.size-sz.synced)/SectorSize+1)*SectorSize
+		if n > sz.size {
+			n = sz.size
+		}
+		if err := s.truncate(fd, n); err != nil {
+			return err
+		}
+	}
+	s.sizes = make(map[storage.FileDesc]fileSize)
+	s.powerCut = false
+	return nil
+}
+
+// Truncates the given file to the given size, by rewriting it as the
+// storage can't truncate.
+func (s *Storage) truncate(fd storage.FileDesc, size int64) error {
+	r, err := s.Storage.Open(fd)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, size))
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if err := s.Storage.Remove(fd); err != nil {
+		return err
+	}
+	w, err := s.Storage.Create(fd)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Sync()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *Storage) written(fd storage.FileDesc, n int) {
+	s.mu.Lock()
+	if sz, ok := s.sizes[fd]; ok {
+		sz.size += int64(n)
+		s.sizes[fd] = sz
+	}
+	s.mu.Unlock()
+}
+
+func (s *Storage) synced(fd storage.FileDesc) {
+	s.mu.Lock()
+	if sz, ok := s.sizes[fd]; ok {
+		sz.synced = sz.size
+		s.sizes[fd] = sz
+	}
+	s.mu.Unlock()
+}
+
+func (s *Storage) SetMeta(fd storage.FileDesc) error {
+	if err := s.inject(OpRename, fd.Type); err != nil {
+		return err
+	}
+	return s.Storage.SetMeta(fd)
+}
+
+func (s *Storage) GetMeta() (storage.FileDesc, error) {
+	if err := s.inject(OpOpen, storage.TypeManifest); err != nil {
+		return storage.FileDesc{}, err
+	}
+	return s.Storage.GetMeta()
+}
+
+func (s *Storage) List(ft storage.FileType) ([]storage.FileDesc, error) {
+	if err := s.inject(OpOpen, ft); err != nil {
+		return nil, err
+	}
+	return s.Storage.List(ft)
+}
+
+func (s *Storage) Open(fd storage.FileDesc) (storage.Reader, error) {
+	if err := s.inject(OpOpen, fd.Type); err != nil {
+		return nil, err
+	}
+	r, err := s.Storage.Open(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{Reader: r, s: s, fd: fd}, nil
+}
+
+func (s *Storage) Create(fd storage.FileDesc) (storage.Writer, error) {
+	if err := s.inject(OpCreate, fd.Type); err != nil {
+		return nil, err
+	}
+	w, err := s.Storage.Create(fd)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.sizes[fd] = fileSize{}
+	s.mu.Unlock()
+	return &writer{Writer: w, s: s, fd: fd}, nil
+}
+
+func (s *Storage) Remove(fd storage.FileDesc) error {
+	if err := s.inject(OpRemove, fd.Type); err != nil {
+		return err
+	}
+	if err := s.Storage.Remove(fd); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.sizes, fd)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Storage) Rename(oldfd, newfd storage.FileDesc) error {
+	if err := s.inject(OpRename, oldfd.Type); err != nil {
+		return err
+	}
+	if err := s.Storage.Rename(oldfd, newfd); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	if sz, ok := s.sizes[oldfd]; ok && oldfd != newfd {
+		delete(s.sizes, oldfd)
+		s.sizes[newfd] = sz
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Recycle recycles the file of the underlying storage, if it implements
+// storage.Recycler.
+func (s *Storage) Recycle(oldfd, newfd storage.FileDesc) (storage.Writer, error) {
+	rs, ok := s.Storage.(storage.Recycler)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	if err := s.inject(OpRename, oldfd.Type); err != nil {
+		return nil, err
+	}
+	w, err := rs.Recycle(oldfd, newfd)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	delete(s.sizes, oldfd)
+	s.sizes[newfd] = fileSize{}
+	s.mu.Unlock()
+	return &writer{Writer: w, s: s, fd: newfd}, nil
+}
+
+// Archive archives the file of the underlying storage, if it implements
+// storage.Archiver.
+func (s *Storage) Archive(fd storage.FileDesc) error {
+	as, ok := s.Storage.(storage.Archiver)
+	if !ok {
+		return storage.ErrNotSupported
+	}
+	if err := s.inject(OpRemove, fd.Type); err != nil {
+		return err
+	}
+	if err := as.Archive(fd); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.sizes, fd)
+	s.mu.Unlock()
+	return nil
+}
+
+// Sync syncs the underlying storage, if it implements storage.Syncer.
+func (s *Storage) Sync() error {
+	if err := s.inject(OpSync, storage.TypeAll); err != nil {
+		return err
+	}
+	if ss, ok := s.Storage.(storage.Syncer); ok {
+		return ss.Sync()
+	}
+	return nil
+}
+
+// The readers aren't memory mapped, so the reads can be faulted.
+type reader struct {
+	storage.Reader
+	s  *Storage
+	fd storage.FileDesc
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if err := r.s.inject(OpRead, r.fd.Type); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+func (r *reader) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.s.inject(OpRead, r.fd.Type); err != nil {
+		return 0, err
+	}
+	return r.Reader.ReadAt(p, off)
+}
+
+func (r *reader) Close() error {
+	err := r.s.inject(OpClose, r.fd.Type)
+	if cerr := r.Reader.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+type writer struct {
+	storage.Writer
+	s  *Storage
+	fd storage.FileDesc
+}
+
+func (w *writer) Write(p []byte) (n int, err error) {
+	f, err := w.s.fault(OpWrite, w.fd.Type)
+	if err != nil {
+		return 0, err
+	}
+	if f != nil {
+		if f.Latency > 0 {
+			time.Sleep(f.Latency)
+		}
+		if err = f.err(); err != nil {
+			if f.ShortWrite {
+				n, _ = w.Writer.Write(p[:len(p)/2])
+				w.s.written(w.fd, n)
+			}
+			return
+		}
+	}
+	n, err = w.Writer.Write(p)
+	w.s.written(w.fd, n)
+	return
+}
+
+func (w *writer) Sync() error {
+	if err := w.s.inject(OpSync, w.fd.Type); err != nil {
+		return err
+	}
+	if err := w.Writer.Sync(); err != nil {
+		return err
+	}
+	w.s.synced(w.fd)
+	return nil
+}
+
+// Close closes the file even if the close is faulted, so a faulted close
+// doesn't leak the file.
+func (w *writer) Close() error {
+	err := w.s.inject(OpClose, w.fd.Type)
+	if cerr := w.Writer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (w *writer) Preallocate(size int64) error {
+	if pw, ok := w.Writer.(storage.Preallocator); ok {
+		return pw.Preallocate(size)
+	}
+	return storage.ErrNotSupported
+}
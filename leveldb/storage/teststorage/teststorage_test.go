@@ -0,0 +1,136 @@
+// Copyright (c) 2014, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package teststorage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/FactomProject/goleveldb/leveldb"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+)
+
+func TestFault(t *testing.T) {
+	s := New(storage.NewMemStorage())
+	defer s.Close()
+
+	errSync := errors.New("sync error")
+	s.Inject(Fault{Ops: OpSync, Types: storage.TypeJournal, Skip: 1, Count: 1, Err: errSync})
+	s.Inject(Fault{Ops: OpWrite, Types: storage.TypeTable, ShortWrite: true})
+
+	w, err := s.Create(storage.FileDesc{Type: storage.TypeJournal, Num: 1})
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	for i, want := range []error{nil, errSync, nil} {
+		if err := w.Sync(); err != want {
+			t.Errorf("Sync #%d: want=%v got=%v", i, want, err)
+		}
+	}
+	w.Close()
+
+	table := storage.FileDesc{Type: storage.TypeTable, Num: 2}
+	w, err = s.Create(table)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	if n, err := w.Write([]byte("foobar")); n != 3 || err != io.ErrShortWrite {
+		t.Errorf("Write: want short write, got n=%d err=%v", n, err)
+	}
+	w.Close()
+
+	s.Clear()
+	s.Inject(Fault{Ops: OpRead})
+	r, err := s.Open(table)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	if _, err := r.Read(make([]byte, 3)); err != ErrInjected {
+		t.Errorf("Read: want=%v got=%v", ErrInjected, err)
+	}
+	r.Close()
+}
+
+func TestPowerCut(t *testing.T) {
+	s := New(storage.NewMemStorage())
+	defer s.Close()
+
+	fd := storage.FileDesc{Type: storage.TypeJournal, Num: 1}
+	w, err := s.Create(fd)
+	if err != nil {
+		t.Fatal("Create: got error: ", err)
+	}
+	synced := bytes.Repeat([]byte{'x'}, 1000)
+	w.Write(synced)
+	w.Sync()
+	w.Write(bytes.Repeat([]byte{'y'}, 5*SectorSize))
+	s.PowerCut()
+	if _, err := w.Write([]byte{'z'}); err != ErrPowerCut {
+		t.Errorf("Write: want=%v got=%v", ErrPowerCut, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: got error: %v", err)
+	}
+	if err := s.Restart(); err != nil {
+		t.Fatal("Restart: got error: ", err)
+	}
+
+	r, err := s.Open(fd)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal("Read: got error: ", err)
+	}
+	if n := len(b) - len(synced); n < 0 || n%SectorSize != 0 || !bytes.Equal(b[:len(synced)], synced) {
+		t.Errorf("invalid file after power cut, size=%d", len(b))
+	}
+}
+
+func TestPowerCut_DB(t *testing.T) {
+	s := New(storage.NewMemStorage())
+	defer s.Close()
+	s.Seed(1)
+
+	db, err := leveldb.Open(s, nil)
+	if err != nil {
+		t.Fatal("Open: got error: ", err)
+	}
+	wo := &opt.WriteOptions{Sync: true}
+	for i := 0; i < 100; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value"), wo); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	for i := 100; i < 200; i++ {
+		db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("value"), nil)
+	}
+	s.PowerCut()
+	db.Close()
+	if err := s.Restart(); err != nil {
+		t.Fatal("Restart: got error: ", err)
+	}
+
+	// The synced writes survive the power cut.
+	db, err = leveldb.Open(s, nil)
+	if err != nil {
+		t.Fatal("Open after power cut: got error: ", err)
+	}
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key%03d", i)), nil); err != nil {
+			t.Errorf("Get key%03d: got error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package storage
+
+import (
+	"io"
+)
+
+type tieredStorage struct {
+	primary   Storage
+	secondary Storage
+	types     FileType
+}
+
+// NewTieredStorage returns a storage that keeps the files of the given
+// types on the secondary storage, and the other files on the primary
+// storage. The lock, the meta and the log are kept by the primary storage.
+//
+// This is typically used to keep the tables, which are immutable once
+// written, on a larger and cheaper storage, such as an object store, see
+// NewObjectStorage, while the journals and the manifest stay on the local
+// file system:
+//
+//	local, err := storage.OpenFile(path, false)
+//	...
+//	tables := storage.NewObjectStorage(store, "db/", cache)
+//	stor := storage.NewTieredStorage(local, tables, storage.TypeTable)
+//	db, err := leveldb.Open(stor, o)
+//
+// Closing the tiered storage closes both storages.
+func NewTieredStorage(primary, secondary Storage, types FileType) Storage {
+	return &tieredStorage{primary: primary, secondary: secondary, types: types & TypeAll}
+}
+
+func (ts *tieredStorage) tier(t FileType) Storage {
+	if t&ts.types != 0 {
+		return ts.secondary
+	}
+	return ts.primary
+}
+
+func (ts *tieredStorage) Lock() (Locker, error) {
+	return ts.primary.Lock()
+}
+
+func (ts *tieredStorage) Log(str string) {
+	ts.primary.Log(str)
+}
+
+func (ts *tieredStorage) SetMeta(fd FileDesc) error {
+	return ts.primary.SetMeta(fd)
+}
+
+func (ts *tieredStorage) GetMeta() (FileDesc, error) {
+	return ts.primary.GetMeta()
+}
+
+func (ts *tieredStorage) List(ft FileType) (fds []FileDesc, err error) {
+	if t := ft &^ ts.types; t != 0 {
+		if fds, err = ts.primary.List(t); err != nil {
+			return nil, err
+		}
+	}
+	if t := ft & ts.types; t != 0 {
+		fds1, err := ts.secondary.List(t)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, fds1...)
+	}
+	return fds, nil
+}
+
+func (ts *tieredStorage) Open(fd FileDesc) (Reader, error) {
+	return ts.tier(fd.Type).Open(fd)
+}
+
+func (ts *tieredStorage) Create(fd FileDesc) (Writer, error) {
+	return ts.tier(fd.Type).Create(fd)
+}
+
+func (ts *tieredStorage) Remove(fd FileDesc) error {
+	return ts.tier(fd.Type).Remove(fd)
+}
+
+// Rename renames the file within its storage, a file renamed to a type of
+// the other storage is copied and then removed.
+func (ts *tieredStorage) Rename(oldfd, newfd FileDesc) error {
+	src, dst := ts.tier(oldfd.Type), ts.tier(newfd.Type)
+	if src == dst {
+		return src.Rename(oldfd, newfd)
+	}
+
+	r, err := src.Open(oldfd)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := dst.Create(newfd)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		dst.Remove(newfd)
+		return err
+	}
+	r.Close()
+	return src.Remove(oldfd)
+}
+
+// Sync syncs both storages, if they implement Syncer.
+func (ts *tieredStorage) Sync() error {
+	for _, s := range []Storage{ts.primary, ts.secondary} {
+		if ss, ok := s.(Syncer); ok {
+			if err := ss.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ts *tieredStorage) Archive(fd FileDesc) error {
+	if as, ok := ts.tier(fd.Type).(Archiver); ok {
+		return as.Archive(fd)
+	}
+	return ErrNotSupported
+}
+
+func (ts *tieredStorage) Recycle(oldfd, newfd FileDesc) (Writer, error) {
+	s := ts.tier(oldfd.Type)
+	if rs, ok := s.(Recycler); ok && s == ts.tier(newfd.Type) {
+		return rs.Recycle(oldfd, newfd)
+	}
+	return nil, ErrNotSupported
+}
+
+func (ts *tieredStorage) Close() error {
+	err := ts.secondary.Close()
+	if perr := ts.primary.Close(); perr != nil {
+		err = perr
+	}
+	return err
+}
@@ -7,9 +7,13 @@
 package leveldb
 
 import (
+	"bufio"
+	"encoding/binary"
 	"fmt"
 	"sort"
+	"sync"
 	"sync/atomic"
+	"unsafe"
 
 	"github.com/FactomProject/goleveldb/leveldb/cache"
 	"github.com/FactomProject/goleveldb/leveldb/iterator"
@@ -22,9 +26,74 @@ import (
 // tFile holds basic information about a table.
 type tFile struct {
 	fd         storage.FileDesc
+	level      int // The level of the version holding the table.
 	seekLeft   int32
 	size       int64
 	imin, imax internalKey
+	rdels      rangeDels
+	vlogs      []int64
+	// Global sequence number of an ingested table, which is keyed by user
+	// keys, all of its entries are values of that sequence number. Zero if
+	// the table is keyed by internal keys.
+	gseq uint64
+	// Table filter, set once the table is opened.
+	tfilter unsafe.Pointer
+	// Garbage ratio, set once the table is written or opened.
+	garbage unsafe.Pointer
+	// Index of the range tombstones, built on first use.
+	rdelIdx unsafe.Pointer
+}
+
+// Returns the index of the range tombstones of the table, nil if the table
+// holds none.
+func (t *tFile) rangeDelIndex(icmp *iComparer) rangeDelIndex {
+	if len(t.rdels) == 0 {
+		return nil
+	}
+	if idx := (*rangeDelIndex)(atomic.LoadPointer(&t.rdelIdx)); idx != nil {
+		return *idx
+	}
+	idx := newRangeDelIndex(icmp, t.rdels)
+	atomic.StorePointer(&t.rdelIdx, unsafe.Pointer(&idx))
+	return idx
+}
+
+// Returns false if the table filter rules out the given key. The table
+// filter is only known once the table has been opened.
+func (t *tFile) mayContain(ikey internalKey) bool {
+	tf := (*table.TableFilter)(atomic.LoadPointer(&t.tfilter))
+	if tf != nil && t.gseq > 0 {
+		return tf.Contains(ikey.ukey())
+	}
+	return tf == nil || tf.Contains(ikey)
+}
+
+// Returns the size of the table filter held in memory, zero if the table
+// hasn't been opened.
+func (t *tFile) filterSize() int {
+	if tf := (*table.TableFilter)(atomic.LoadPointer(&t.tfilter)); tf != nil {
+		return tf.Size()
+	}
+	return 0
+}
+
+// Sets the ratio of deletion markers and overwritten entries to the
+// entries of the table.
+func (t *tFile) setGarbage(entries, garbage int64) {
+	if entries > 0 {
+		ratio := float64(garbage) / float64(entries)
+		atomic.StorePointer(&t.garbage, unsafe.Pointer(&ratio))
+	}
+}
+
+// Returns the ratio of deletion markers and overwritten entries to the
+// entries of the table, zero if the table hasn't been written or opened
+// since the DB is opened.
+func (t *tFile) garbageRatio() float64 {
+	if p := (*float64)(atomic.LoadPointer(&t.garbage)); p != nil {
+		return *p
+	}
+	return 0
 }
 
 // Returns true if given key is after largest key of this table.
@@ -78,7 +147,16 @@ func newTableFile(fd storage.FileDesc, size int64, imin, imax internalKey) *tFil
 }
 
 func tableFileFromRecord(r atRecord) *tFile {
-	return newTableFile(storage.FileDesc{storage.TypeTable, r.num}, r.size, r.imin, r.imax)
+	t := newTableFile(storage.FileDesc{storage.TypeTable, r.num}, r.size, r.imin, r.imax)
+	t.level = r.level
+	t.rdels = r.rdels
+	t.vlogs = r.vlogs
+	t.gseq = r.gseq
+	if r.garbage > 0 {
+		ratio := r.garbage
+		t.garbage = unsafe.Pointer(&ratio)
+	}
+	return t
 }
 
 // tFiles hold multiple tFile.
@@ -87,6 +165,18 @@ type tFiles []*tFile
 func (tf tFiles) Len() int      { return len(tf) }
 func (tf tFiles) Swap(i, j int) { tf[i], tf[j] = tf[j], tf[i] }
 
+// Returns the table with the highest garbage ratio, nil if none of the
+// tables is known to hold garbage.
+func (tf tFiles) maxGarbage() (t *tFile) {
+	var max float64
+	for _, x := range tf {
+		if ratio := x.garbageRatio(); ratio > max {
+			t, max = x, ratio
+		}
+	}
+	return
+}
+
 func (tf tFiles) nums() string {
 	x := "[ "
 	for i, f := range tf {
@@ -208,6 +298,15 @@ func (tf tFiles) getOverlaps(dst tFiles, icmp *iComparer, umin, umax []byte, ove
 	return dst
 }
 
+// Returns the largest limit of tables range tombstones, or umax if it is
+// larger.
+func (tf tFiles) rangeDelLimit(icmp *iComparer, umax []byte) []byte {
+	for _, t := range tf {
+		umax = t.rdels.maxLimit(icmp, umax)
+	}
+	return umax
+}
+
 // Returns tables key range.
 func (tf tFiles) getRange(icmp *iComparer) (imin, imax internalKey) {
 	for i, t := range tf {
@@ -227,7 +326,7 @@ func (tf tFiles) getRange(icmp *iComparer) (imin, imax internalKey) {
 }
 
 // Creates iterator index from tables.
-func (tf tFiles) newIndexIterator(tops *tOps, icmp *iComparer, slice *util.Range, ro *opt.ReadOptions) iterator.IteratorIndexer {
+func (tf tFiles) newIndexIterator(tops *tOps, icmp *iComparer, slice *util.Range, ro *opt.ReadOptions, smp *sampler) iterator.IteratorIndexer {
 	if slice != nil {
 		var start, limit int
 		if slice.Start != nil {
@@ -246,6 +345,7 @@ func (tf tFiles) newIndexIterator(tops *tOps, icmp *iComparer, slice *util.Range
 		icmp:   icmp,
 		slice:  slice,
 		ro:     ro,
+		smp:    smp,
 	})
 }
 
@@ -256,6 +356,7 @@ type tFilesArrayIndexer struct {
 	icmp  *iComparer
 	slice *util.Range
 	ro    *opt.ReadOptions
+	smp   *sampler
 }
 
 func (a *tFilesArrayIndexer) Search(key []byte) int {
@@ -264,9 +365,9 @@ func (a *tFilesArrayIndexer) Search(key []byte) int {
 
 func (a *tFilesArrayIndexer) Get(i int) iterator.Iterator {
 	if i == 0 || i == a.Len()-1 {
-		return a.tops.newIterator(a.tFiles[i], a.slice, a.ro)
+		return a.tops.newSampleIterator(a.tFiles[i], a.slice, a.ro, a.smp)
 	}
-	return a.tops.newIterator(a.tFiles[i], nil, a.ro)
+	return a.tops.newSampleIterator(a.tFiles[i], nil, a.ro, a.smp)
 }
 
 // Helper type for sortByKey.
@@ -294,27 +395,62 @@ type tOps struct {
 	noSync bool
 	cache  *cache.Cache
 	bcache *cache.Cache
+	ccache *cache.Cache
+	mcache *cache.Cache
 	bpool  *util.BufferPool
+
+	// Whether to pin the index and filter blocks of level-0 tables.
+	pinMetaL0 bool
+
+	vlogThreshold int
+	vlogGCRatio   float64
+	vmu           sync.Mutex
+	vstats        map[int64]*vlogStat
+
+	// Pinned tables.
+	pinBottom   bool
+	pinPerLevel int
+	pmu         sync.Mutex
+	pinned      map[int64]*tPin
+	pinOrder    [][]int64 // Tables pinned per level, the oldest first.
+	bottom      int
+}
+
+// tPin holds a pinned table open.
+type tPin struct {
+	h      *cache.Handle
+	level  int
+	bottom bool
 }
 
-// Creates an empty table and returns table writer.
-func (t *tOps) create() (*tWriter, error) {
+// Creates an empty table for the given level and returns table writer.
+func (t *tOps) create(level int) (*tWriter, error) {
 	fd := storage.FileDesc{storage.TypeTable, t.s.allocFileNum()}
 	fw, err := t.s.stor.Create(fd)
 	if err != nil {
 		return nil, err
 	}
-	return &tWriter{
+	w := &tWriter{
 		t:  t,
 		fd: fd,
 		w:  fw,
-		tw: table.NewWriter(fw, t.s.o.Options),
-	}, nil
+		tw: table.NewWriter(fw, t.s.o.tableOptions(level)),
+
+		checkOrder: t.s.o.GetStrict(opt.StrictParanoidChecks),
+	}
+	if p, ok := fw.(storage.Preallocator); ok && t.s.o.GetTablePreallocate() {
+		err := p.Preallocate(int64(t.s.o.GetCompactionTableSize(level)))
+		if err != nil && err != storage.ErrNotSupported {
+			t.s.log(opt.LogWarn, "table@preallocate", "file", fd, "err", err)
+		}
+		w.preallocated = err == nil
+	}
+	return w, nil
 }
 
 // Builds table from src iterator.
 func (t *tOps) createFrom(src iterator.Iterator) (f *tFile, n int, err error) {
-	w, err := t.create()
+	w, err := t.create(0)
 	if err != nil {
 		return
 	}
@@ -344,6 +480,7 @@ func (t *tOps) createFrom(src iterator.Iterator) (f *tFile, n int, err error) {
 // Opens table. It returns a cache handle, which should
 // be released after use.
 func (t *tOps) open(f *tFile) (ch *cache.Handle, err error) {
+	var opened bool
 	ch = t.cache.Get(0, uint64(f.fd.Num), func() (size int, value cache.Value) {
 		var r storage.Reader
 		r, err = t.s.stor.Open(f.fd)
@@ -356,40 +493,234 @@ func (t *tOps) open(f *tFile) (ch *cache.Handle, err error) {
 			bcache = &cache.NamespaceGetter{Cache: t.bcache, NS: uint64(f.fd.Num)}
 		}
 
+		o := t.s.o.Options
+		if f.gseq > 0 {
+			o = t.s.uo
+		}
 		var tr *table.Reader
-		tr, err = table.NewReader(r, f.size, f.fd, bcache, t.bpool, t.s.o.Options)
+		tr, err = table.NewReader(r, f.size, f.fd, bcache, t.bpool, o)
 		if err != nil {
 			r.Close()
 			return 0, nil
 		}
+		if tf := tr.TableFilter(); tf != nil {
+			atomic.StorePointer(&f.tfilter, unsafe.Pointer(tf))
+		}
+		if props := tr.Properties(); props != nil {
+			f.setGarbage(props.NumEntries, props.NumDeletions+props.NumOverwrites)
+		}
+		if t.ccache != nil {
+			tr.SetCompressedCache(&cache.NamespaceGetter{Cache: t.ccache, NS: uint64(f.fd.Num)})
+		}
+		if t.mcache != nil {
+			tr.SetMetaCache(&cache.NamespaceGetter{Cache: t.mcache, NS: uint64(f.fd.Num)})
+		}
+		if t.pinMetaL0 && f.level == 0 {
+			// On failure the blocks are read on demand, which reports the
+			// error if it persists.
+			if err := tr.PinMetaBlocks(); err != nil {
+				t.s.log(opt.LogWarn, "table@open pinning meta blocks failed", "file", f.fd, "err", err)
+			}
+		}
+		opened = true
 		return 1, tr
 
 	})
 	if ch == nil && err == nil {
 		err = ErrClosed
 	}
+	if opened && ch != nil {
+		t.pin(f)
+	}
+	return
+}
+
+// Pins the opened table, if it's to be pinned.
+func (t *tOps) pin(f *tFile) {
+	if !t.pinBottom && t.pinPerLevel == 0 {
+		return
+	}
+	var unpinned []*cache.Handle
+	t.pmu.Lock()
+	if _, ok := t.pinned[f.fd.Num]; !ok {
+		bottom := t.pinBottom && f.level == t.bottom
+		if bottom || t.pinPerLevel > 0 {
+			if h := t.cache.Get(0, uint64(f.fd.Num), nil); h != nil {
+				t.pinned[f.fd.Num] = &tPin{h: h, level: f.level, bottom: bottom}
+				if !bottom {
+					for len(t.pinOrder) <= f.level {
+						t.pinOrder = append(t.pinOrder, nil)
+					}
+					order := append(t.pinOrder[f.level], f.fd.Num)
+					for ; len(order) > t.pinPerLevel; order = order[1:] {
+						if p, ok := t.pinned[order[0]]; ok {
+							delete(t.pinned, order[0])
+							unpinned = append(unpinned, p.h)
+						}
+					}
+					t.pinOrder[f.level] = order
+				}
+			}
+		}
+	}
+	t.pmu.Unlock()
+	for _, h := range unpinned {
+		h.Release()
+	}
+}
+
+// Unpins the given table, if pinned.
+func (t *tOps) unpin(num int64) {
+	t.pmu.Lock()
+	p, ok := t.pinned[num]
+	if ok {
+		delete(t.pinned, num)
+		if !p.bottom {
+			order := t.pinOrder[p.level]
+			for i, x := range order {
+				if x == num {
+					t.pinOrder[p.level] = append(order[:i:i], order[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	t.pmu.Unlock()
+	if ok {
+		p.h.Release()
+	}
+}
+
+// Sets the bottom level, unpinning the tables pinned for being in the
+// former bottom level.
+func (t *tOps) setBottomLevel(level int) {
+	if !t.pinBottom {
+		return
+	}
+	var unpinned []*cache.Handle
+	t.pmu.Lock()
+	if level != t.bottom {
+		t.bottom = level
+		for num, p := range t.pinned {
+			if p.bottom && p.level != level {
+				delete(t.pinned, num)
+				unpinned = append(unpinned, p.h)
+			}
+		}
+	}
+	t.pmu.Unlock()
+	for _, h := range unpinned {
+		h.Release()
+	}
+}
+
+// Returns number of the pinned tables.
+func (t *tOps) pinnedLen() int {
+	t.pmu.Lock()
+	defer t.pmu.Unlock()
+	return len(t.pinned)
+}
+
+// Opens table for the 'read operation'. If the 'read operation' may only
+// be served by the caches, it fails with ErrCacheMiss unless the table is
+// already opened.
+func (t *tOps) openRO(f *tFile, ro *opt.ReadOptions) (ch *cache.Handle, err error) {
+	if !ro.GetCacheOnly() {
+		return t.open(f)
+	}
+	if ch = t.cache.Get(0, uint64(f.fd.Num), nil); ch == nil {
+		err = ErrCacheMiss
+	}
 	return
 }
 
 // Finds key/value pair whose key is greater than or equal to the
-// given key.
-func (t *tOps) find(f *tFile, key []byte, ro *opt.ReadOptions) (rkey, rvalue []byte, err error) {
-	ch, err := t.open(f)
+// given key, the value is appended to dst.
+func (t *tOps) find(f *tFile, key, dst []byte, ro *opt.ReadOptions) (rkey, rvalue []byte, err error) {
+	ch, err := t.openRO(f, ro)
 	if err != nil {
 		return nil, nil, err
 	}
 	defer ch.Release()
-	return ch.Value().(*table.Reader).Find(key, true, ro)
+	tr := ch.Value().(*table.Reader)
+	if f.gseq > 0 {
+		return t.findGlobal(f, tr, key, dst, ro, false)
+	}
+	return tr.FindTo(key, dst, true, ro)
+}
+
+// Like find, but for the table keyed by user keys of an ingested table.
+func (t *tOps) findGlobal(f *tFile, tr *table.Reader, key, dst []byte, ro *opt.ReadOptions, noValue bool) (rkey, rvalue []byte, err error) {
+	ukey, seq, _, err := parseInternalKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if noValue {
+		rkey, err = tr.FindKey(ukey, true, ro)
+	} else {
+		rkey, rvalue, err = tr.FindTo(ukey, dst, true, ro)
+	}
+	if err == nil && seq < f.gseq && t.s.icmp.uCompare(rkey, ukey) == 0 {
+		// The entry of the key is newer, thus sorted before the given
+		// key; the next entry is looked up.
+		iter := tr.NewIterator(nil, ro)
+		defer iter.Release()
+		if iter.Seek(ukey) && t.s.icmp.uCompare(iter.Key(), ukey) == 0 && !iter.Next() {
+			err = iter.Error()
+			if err == nil {
+				err = ErrNotFound
+			}
+			return nil, nil, err
+		} else if err = iter.Error(); err != nil {
+			return nil, nil, err
+		}
+		rkey = iter.Key()
+		if !noValue {
+			rvalue = t.copyValue(dst, iter.Value())
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return makeInternalKey(nil, rkey, f.gseq, keyTypeVal), rvalue, nil
+}
+
+// Returns the dst the values read for the caller are appended to, when the
+// caller gives none. It is nil if the values are copied into buffers of the
+// pool, see opt.ReadOptions.PoolValues; the table readers and the value
+// logs then copy the values into buffers of the pool too.
+func (t *tOps) valueDst(ro *opt.ReadOptions) []byte {
+	if t.bpool == nil || !ro.GetPoolValues() {
+		// The value is never nil, even if empty.
+		return []byte{}
+	}
+	return nil
+}
+
+// Appends the value to dst, or copies it into a buffer of the pool if dst
+// is nil, see valueDst.
+func (t *tOps) copyValue(dst, value []byte) []byte {
+	if dst == nil {
+		dst = t.bpool.Get(len(value))
+		copy(dst, value)
+		return dst
+	}
+	return append(dst, value...)
 }
 
 // Finds key that is greater than or equal to the given key.
 func (t *tOps) findKey(f *tFile, key []byte, ro *opt.ReadOptions) (rkey []byte, err error) {
-	ch, err := t.open(f)
+	ch, err := t.openRO(f, ro)
 	if err != nil {
 		return nil, err
 	}
 	defer ch.Release()
-	return ch.Value().(*table.Reader).FindKey(key, true, ro)
+	tr := ch.Value().(*table.Reader)
+	if f.gseq > 0 {
+		rkey, _, err = t.findGlobal(f, tr, key, nil, ro, true)
+		return
+	}
+	return tr.FindKey(key, true, ro)
 }
 
 // Returns approximate offset of the given key.
@@ -399,43 +730,191 @@ func (t *tOps) offsetOf(f *tFile, key []byte) (offset int64, err error) {
 		return
 	}
 	defer ch.Release()
+	if f.gseq > 0 {
+		key = internalKey(key).ukey()
+	}
 	return ch.Value().(*table.Reader).OffsetOf(key)
 }
 
+// Returns number of entries of the given table, ok is false if the table
+// doesn't record it.
+func (t *tOps) numEntries(f *tFile) (n int64, ok bool, err error) {
+	ch, err := t.open(f)
+	if err != nil {
+		return
+	}
+	defer ch.Release()
+	n, ok = ch.Value().(*table.Reader).NumEntries()
+	return
+}
+
 // Creates an iterator from the given table.
 func (t *tOps) newIterator(f *tFile, slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
-	ch, err := t.open(f)
+	return t.newSampleIterator(f, slice, ro, nil)
+}
+
+// Creates an iterator from the given table that yields only the keys picked
+// by the given sampler, or all keys if the sampler is nil.
+func (t *tOps) newSampleIterator(f *tFile, slice *util.Range, ro *opt.ReadOptions, smp *sampler) iterator.Iterator {
+	ch, err := t.openRO(f, ro)
 	if err != nil {
 		return iterator.NewEmptyIterator(err)
 	}
-	iter := ch.Value().(*table.Reader).NewIterator(slice, ro)
+	tr := ch.Value().(*table.Reader)
+	if f.gseq > 0 {
+		// The prefix filter isn't consulted, the slice bounds apply to
+		// the user keys.
+		var uslice *util.Range
+		if slice != nil {
+			uslice = &util.Range{}
+			if slice.Start != nil {
+				uslice.Start = internalKey(slice.Start).ukey()
+			}
+			if slice.Limit != nil {
+				uslice.Limit = internalKey(slice.Limit).ukey()
+			}
+		}
+		var iter iterator.Iterator
+		if smp != nil {
+			iter = tr.NewSampleIterator(uslice, ro, smp.fraction, smp.seed)
+		} else {
+			iter = tr.NewIterator(uslice, ro)
+		}
+		iter.SetReleaser(ch)
+		return &globalSeqIter{Iterator: iter, icmp: t.s.icmp, gseq: f.gseq}
+	}
+	if uprefix := ro.GetPrefix(); uprefix != nil {
+		if p, ok := t.s.o.GetPrefixer().(*iPrefixer); ok {
+			if prefix := p.iPrefix(uprefix); prefix != nil && !tr.PrefixMayMatch(prefix, slice) {
+				ch.Release()
+				return iterator.NewEmptyIterator(nil)
+			}
+		}
+	}
+	var iter iterator.Iterator
+	if smp != nil {
+		iter = tr.NewSampleIterator(slice, ro, smp.fraction, smp.seed)
+	} else {
+		iter = tr.NewIterator(slice, ro)
+	}
 	iter.SetReleaser(ch)
 	return iter
 }
 
+// globalSeqIter iterates a table keyed by user keys as if keyed by
+// internal keys of the given sequence number.
+type globalSeqIter struct {
+	iterator.Iterator
+	icmp *iComparer
+	gseq uint64
+	key  []byte
+}
+
+func (i *globalSeqIter) ukeyEq(ikey []byte) bool {
+	return i.icmp.uCompare(i.Iterator.Key(), internalKey(ikey).ukey()) == 0
+}
+
+func (i *globalSeqIter) move(ok bool) bool {
+	// Not reused, the key may be pinned.
+	i.key = nil
+	return ok
+}
+
+func (i *globalSeqIter) First() bool { return i.move(i.Iterator.First()) }
+func (i *globalSeqIter) Last() bool  { return i.move(i.Iterator.Last()) }
+func (i *globalSeqIter) Next() bool  { return i.move(i.Iterator.Next()) }
+func (i *globalSeqIter) Prev() bool  { return i.move(i.Iterator.Prev()) }
+
+func (i *globalSeqIter) Seek(key []byte) bool {
+	ok := i.Iterator.Seek(internalKey(key).ukey())
+	if ok && i.ukeyEq(key) && internalKey(key).num()>>8 < i.gseq {
+		ok = i.Iterator.Next()
+	}
+	return i.move(ok)
+}
+
+func (i *globalSeqIter) SeekLE(key []byte) bool {
+	ok := i.Iterator.SeekLE(internalKey(key).ukey())
+	if ok && i.ukeyEq(key) && internalKey(key).num()>>8 > i.gseq {
+		ok = i.Iterator.Prev()
+	}
+	return i.move(ok)
+}
+
+func (i *globalSeqIter) Key() []byte {
+	if i.key == nil {
+		if ukey := i.Iterator.Key(); ukey != nil {
+			i.key = makeInternalKey(nil, ukey, i.gseq, keyTypeVal)
+		}
+	}
+	return i.key
+}
+
+func (i *globalSeqIter) Unpin() {
+	if p, ok := i.Iterator.(iterator.Pinner); ok {
+		p.Unpin()
+	}
+}
+
+func (i *globalSeqIter) SetErrorCallback(f func(err error)) {
+	if ecs, ok := i.Iterator.(iterator.ErrorCallbackSetter); ok {
+		ecs.SetErrorCallback(f)
+	}
+}
+
+// Advises the storage to drop the cached pages of the given table, see
+// opt.Options.CompactionDropCache.
+func (t *tOps) dropCache(f *tFile) {
+	ch, err := t.open(f)
+	if err != nil {
+		return
+	}
+	ch.Value().(*table.Reader).DropCache()
+	ch.Release()
+}
+
 // Removes table from persistent storage. It waits until
 // no one use the the table.
 func (t *tOps) remove(f *tFile) {
+	t.unpin(f.fd.Num)
 	t.cache.Delete(0, uint64(f.fd.Num), func() {
 		if err := t.s.stor.Remove(f.fd); err != nil {
-			t.s.logf("table@remove removing @%d %q", f.fd.Num, err)
+			t.s.log(opt.LogWarn, "table@remove failed", "file", f.fd, "err", err)
 		} else {
-			t.s.logf("table@remove removed @%d", f.fd.Num)
+			t.s.log(opt.LogDebug, "table@remove removed", "file", f.fd)
 		}
 		if t.bcache != nil {
 			t.bcache.EvictNS(uint64(f.fd.Num))
 		}
+		if t.ccache != nil {
+			t.ccache.EvictNS(uint64(f.fd.Num))
+		}
+		if t.mcache != nil {
+			t.mcache.EvictNS(uint64(f.fd.Num))
+		}
 	})
 }
 
 // Closes the table ops instance. It will close all tables,
 // regadless still used or not.
 func (t *tOps) close() {
+	t.pmu.Lock()
+	for num, p := range t.pinned {
+		delete(t.pinned, num)
+		p.h.Release()
+	}
+	t.pmu.Unlock()
 	t.bpool.Close()
 	t.cache.Close()
 	if t.bcache != nil {
 		t.bcache.CloseWeak()
 	}
+	if t.ccache != nil {
+		t.ccache.CloseWeak()
+	}
+	if t.mcache != nil {
+		t.mcache.CloseWeak()
+	}
 }
 
 // Creates new initialized table ops instance.
@@ -443,18 +922,26 @@ func newTableOps(s *session) *tOps {
 	var (
 		cacher cache.Cacher
 		bcache *cache.Cache
+		ccache *cache.Cache
+		mcache *cache.Cache
 		bpool  *util.BufferPool
 	)
-	if s.o.GetOpenFilesCacheCapacity() > 0 {
-		cacher = cache.NewLRU(s.o.GetOpenFilesCacheCapacity())
+	if c := s.o.GetOpenFilesCacher(); c != nil && s.o.GetOpenFilesCacheCapacity() > 0 {
+		cacher = c.New(s.o.GetOpenFilesCacheCapacity())
 	}
 	if !s.o.GetDisableBlockCache() {
 		var bcacher cache.Cacher
-		if s.o.GetBlockCacheCapacity() > 0 {
-			bcacher = cache.NewLRU(s.o.GetBlockCacheCapacity())
+		if c := s.o.GetBlockCacher(); c != nil && s.o.GetBlockCacheCapacity() > 0 {
+			bcacher = c.New(s.o.GetBlockCacheCapacity())
 		}
 		bcache = cache.NewCache(bcacher)
 	}
+	if c := s.o.GetBlockCacher(); c != nil && s.o.GetCompressedBlockCacheCapacity() > 0 {
+		ccache = cache.NewCache(c.New(s.o.GetCompressedBlockCacheCapacity()))
+	}
+	if c := s.o.GetBlockCacher(); c != nil && s.o.GetMetaBlockCacheCapacity() > 0 {
+		mcache = cache.NewCache(c.New(s.o.GetMetaBlockCacheCapacity()))
+	}
 	if !s.o.GetDisableBufferPool() {
 		bpool = util.NewBufferPool(s.o.GetBlockSize() + 5)
 	}
@@ -463,7 +950,20 @@ func newTableOps(s *session) *tOps {
 		noSync: s.o.GetNoSync(),
 		cache:  cache.NewCache(cacher),
 		bcache: bcache,
+		ccache: ccache,
+		mcache: mcache,
 		bpool:  bpool,
+
+		pinMetaL0: s.o.GetMetaBlockCachePinLevel0(),
+
+		vlogThreshold: s.o.GetValueLogThreshold(),
+		vlogGCRatio:   s.o.GetValueLogGCRatio(),
+		vstats:        make(map[int64]*vlogStat),
+
+		pinBottom:   s.o.GetOpenFilesCachePinBottomLevel(),
+		pinPerLevel: s.o.GetOpenFilesCachePinPerLevel(),
+		pinned:      make(map[int64]*tPin),
+		bottom:      -1,
 	}
 }
 
@@ -477,15 +977,136 @@ type tWriter struct {
 	tw *table.Writer
 
 	first, last []byte
+	rdels       rangeDels
+	dropCache   bool
+	// Whether the key order is checked by the table writer, the callers
+	// append keys in order.
+	checkOrder bool
+
+	// Deletion markers and entries overwritten by the next entry.
+	ndels, noverwrites int64
+
+	preallocated bool
+	syncedLen    int // The length whose write-back is started.
+
+	// Value log.
+	vw    storage.Writer
+	vbuf  *bufio.Writer
+	voff  int64
+	vlogs map[int64]struct{}
+	kbuf  []byte
+	vptr  []byte
+	vcrc  [vlogRecordTrailerLen]byte
+}
+
+// Appends value to the value log and returns the value pointer.
+func (w *tWriter) appendValue(value []byte) ([]byte, error) {
+	if w.vw == nil {
+		vw, err := w.t.s.stor.Create(storage.FileDesc{Type: storage.TypeValueLog, Num: w.fd.Num})
+		if err != nil {
+			return nil, err
+		}
+		w.vw = vw
+		w.vbuf = bufio.NewWriter(vw)
+	}
+	if _, err := w.vbuf.Write(value); err != nil {
+		return nil, err
+	}
+	binary.LittleEndian.PutUint32(w.vcrc[:], util.NewCRC(value).Value())
+	if _, err := w.vbuf.Write(w.vcrc[:]); err != nil {
+		return nil, err
+	}
+	p := valuePtr{w.fd.Num, w.voff, int64(len(value))}
+	w.voff += p.size()
+	w.addVlogRef(w.fd.Num)
+	w.vptr = p.encode(w.vptr[:0])
+	return w.vptr, nil
+}
+
+func (w *tWriter) addVlogRef(num int64) {
+	if w.vlogs == nil {
+		w.vlogs = make(map[int64]struct{})
+	}
+	w.vlogs[num] = struct{}{}
 }
 
 // Append key/value pair to the table.
 func (w *tWriter) append(key, value []byte) error {
+	if ukey, seq, kt, kerr := parseInternalKey(key); kerr == nil {
+		if kt != keyTypeRangeDel && w.last != nil && w.t.s.icmp.uCompare(internalKey(w.last).ukey(), ukey) == 0 {
+			w.noverwrites++
+		}
+		switch kt {
+		case keyTypeDel:
+			w.ndels++
+		case keyTypeRangeDel:
+			w.rdels = append(w.rdels, rangeDel{seq, append([]byte{}, ukey...), append([]byte{}, value...)})
+		case keyTypeVal:
+			// Separate large value into the value log.
+			if w.t.vlogThreshold > 0 && len(value) >= w.t.vlogThreshold {
+				ptr, err := w.appendValue(value)
+				if err != nil {
+					return err
+				}
+				w.kbuf = makeInternalKey(w.kbuf, ukey, seq, keyTypeValPtr)
+				key, value = w.kbuf, ptr
+			}
+		case keyTypeValPtr:
+			p, err := decodeValuePtr(value)
+			if err != nil {
+				return err
+			}
+			if !w.t.vlogCollecting(p.num) {
+				w.addVlogRef(p.num)
+				break
+			}
+			// Relocate value out of the value log being collected.
+			rvalue, err := w.t.readValuePtr(p, nil)
+			if err != nil {
+				return err
+			}
+			if w.t.vlogThreshold > 0 && len(rvalue) >= w.t.vlogThreshold {
+				if value, err = w.appendValue(rvalue); err != nil {
+					return err
+				}
+			} else {
+				w.kbuf = makeInternalKey(w.kbuf, ukey, seq, keyTypeVal)
+				key, value = w.kbuf, rvalue
+			}
+		}
+	}
 	if w.first == nil {
 		w.first = append([]byte{}, key...)
 	}
 	w.last = append(w.last[:0], key...)
-	return w.tw.Append(key, value)
+	var err error
+	if w.checkOrder {
+		err = w.tw.Append(key, value)
+	} else {
+		err = w.tw.AppendOrdered(key, value)
+	}
+	if err != nil {
+		return err
+	}
+	return w.syncRange()
+}
+
+// Starts the write-back of the table once TableBytesPerSync bytes are
+// written since it was last started.
+func (w *tWriter) syncRange() error {
+	n := w.tw.BytesLen() - w.syncedLen
+	if perSync := w.t.s.o.GetTableBytesPerSync(); perSync <= 0 || n < perSync {
+		return nil
+	}
+	rs, ok := w.w.(storage.RangeSyncer)
+	if !ok {
+		return nil
+	}
+	if err := rs.SyncRange(int64(w.syncedLen), int64(n)); err != nil && err != storage.ErrNotSupported {
+		return err
+	}
+	w.syncedLen += n
+	return nil
 }
 
 // Returns true if the table is empty.
@@ -499,22 +1120,65 @@ func (w *tWriter) close() {
 		w.w.Close()
 		w.w = nil
 	}
+	if w.vw != nil {
+		w.vw.Close()
+		w.vw = nil
+	}
+}
+
+// Finalizes the value log, if any.
+func (w *tWriter) finishVlog() error {
+	if w.vw == nil {
+		return nil
+	}
+	if err := w.vbuf.Flush(); err != nil {
+		return err
+	}
+	if !w.t.noSync {
+		if err := w.vw.Sync(); err != nil {
+			return err
+		}
+	}
+	w.t.vlogWritten(w.fd.Num, w.voff)
+	return nil
 }
 
 // Finalizes the table and returns table file.
 func (w *tWriter) finish() (f *tFile, err error) {
 	defer w.close()
+	err = w.finishVlog()
+	if err != nil {
+		return
+	}
+	w.tw.SetKeyStats(w.ndels, w.noverwrites)
 	err = w.tw.Close()
 	if err != nil {
 		return
 	}
+	if w.preallocated {
+		// Release the preallocated space past the table.
+		if tw, ok := w.w.(storage.Truncater); ok {
+			if err := tw.Truncate(int64(w.tw.BytesLen())); err != nil {
+				w.t.s.log(opt.LogWarn, "table@truncate", "file", w.fd, "err", err)
+			}
+		}
+	}
 	if !w.t.noSync {
 		err = w.w.Sync()
 		if err != nil {
 			return
 		}
 	}
+	if cd, ok := w.w.(storage.CacheDropper); ok && w.dropCache {
+		cd.DropCache()
+	}
 	f = newTableFile(w.fd, int64(w.tw.BytesLen()), internalKey(w.first), internalKey(w.last))
+	f.rdels = w.rdels
+	f.setGarbage(int64(w.tw.EntriesLen()), w.ndels+w.noverwrites)
+	for num := range w.vlogs {
+		f.vlogs = append(f.vlogs, num)
+	}
+	sort.Sort(int64Slice(f.vlogs))
 	return
 }
 
@@ -522,8 +1186,13 @@ func (w *tWriter) finish() (f *tFile, err error) {
 func (w *tWriter) drop() {
 	w.close()
 	w.t.s.stor.Remove(w.fd)
+	if _, ok := w.vlogs[w.fd.Num]; ok {
+		w.t.s.stor.Remove(storage.FileDesc{Type: storage.TypeValueLog, Num: w.fd.Num})
+	}
 	w.t.s.reuseFileNum(w.fd.Num)
 	w.tw = nil
 	w.first = nil
 	w.last = nil
+	w.rdels = nil
+	w.vlogs = nil
 }
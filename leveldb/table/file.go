@@ -0,0 +1,177 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+)
+
+// KeyType is the type of a DB internal key, see InternalKey.
+type KeyType uint
+
+func (kt KeyType) String() string {
+	switch kt {
+	case KeyTypeDel:
+		return "del"
+	case KeyTypeVal:
+		return "val"
+	case KeyTypeRangeDel:
+		return "rangedel"
+	case KeyTypeValPtr:
+		return "valptr"
+	}
+	return fmt.Sprintf("<invalid:%#x>", uint(kt))
+}
+
+// Key types of DB internal keys. These are the values saved to disk.
+const (
+	KeyTypeDel      = KeyType(0)
+	KeyTypeVal      = KeyType(1)
+	KeyTypeRangeDel = KeyType(2)
+	KeyTypeValPtr   = KeyType(3)
+)
+
+// InternalKey is a decoded DB internal key. Tables written by DB hold
+// internal keys, which are the user key followed by 8-bytes little-endian
+// packed sequence number and key type.
+type InternalKey struct {
+	UserKey []byte
+	Seq     uint64
+	Type    KeyType
+}
+
+// ParseInternalKey decodes the given DB internal key. The returned user key
+// refers to the given key.
+func ParseInternalKey(ikey []byte) (InternalKey, error) {
+	if len(ikey) < 8 {
+		return InternalKey{}, fmt.Errorf("leveldb/table: invalid internal key %q: invalid length", ikey)
+	}
+	num := binary.LittleEndian.Uint64(ikey[len(ikey)-8:])
+	ik := InternalKey{
+		UserKey: ikey[:len(ikey)-8],
+		Seq:     num >> 8,
+		Type:    KeyType(num & 0xff),
+	}
+	if ik.Type > KeyTypeValPtr {
+		return InternalKey{}, fmt.Errorf("leveldb/table: invalid internal key %q: invalid type", ikey)
+	}
+	return ik, nil
+}
+
+// File is a standalone table file opened for inspection, see OpenFile.
+type File struct {
+	*Reader
+	size int64
+}
+
+// FileInfo describes a table file, see File.Info.
+type FileInfo struct {
+	// Size of the table file.
+	Size int64
+
+	// Number of the data blocks.
+	DataBlocks int
+
+	// Keys of the metaindex block, e.g. "filter.<name>".
+	MetaIndex []string
+
+	// Properties of the table, nil if the table has no properties block.
+	Properties *Properties
+}
+
+// OpenFile opens the table file of the given path for inspection, e.g. to
+// scan a table of a corrupted DB. Keys of a table written by DB can be
+// decoded using ParseInternalKey.
+//
+// The options should provide compressors used by the table, filters are
+// not used. The options may be nil. The returned file should be closed
+// after use.
+func OpenFile(path string, o *opt.Options) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	no := &opt.Options{}
+	if o != nil {
+		*no = *o
+	}
+	no.Filter = nil
+	no.AltFilters = nil
+	no.Prefixer = nil
+
+	fd := storage.FileDesc{Type: storage.TypeTable}
+	name := filepath.Base(path)
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		fd.Num, _ = strconv.ParseInt(name[:i], 10, 64)
+	}
+	r, err := NewReader(f, fi.Size(), fd, nil, nil, no)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &File{Reader: r, size: fi.Size()}, nil
+}
+
+// Info returns description of the table file.
+func (f *File) Info() (*FileInfo, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	info := &FileInfo{Size: f.size, Properties: f.props}
+
+	metaBlock, err := f.readBlock(f.metaBH, true, false)
+	if err != nil {
+		return nil, err
+	}
+	metaIter := f.newBlockIter(metaBlock, nil, nil, true)
+	for metaIter.Next() {
+		info.MetaIndex = append(info.MetaIndex, string(metaIter.Key()))
+	}
+	err = metaIter.Error()
+	metaIter.Release()
+	metaBlock.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	indexBlock, rel, err := f.getIndexBlock(f.reader, false)
+	if err != nil {
+		return nil, err
+	}
+	indexIter := f.newBlockIter(indexBlock, rel, nil, true)
+	for indexIter.Next() {
+		info.DataBlocks++
+	}
+	err = indexIter.Error()
+	indexIter.Release()
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Close releases the table reader, which also closes the file.
+func (f *File) Close() error {
+	f.Reader.Release()
+	return nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package table
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Names of the builtin properties, see the properties block section of the
+// table format. Names with this prefix are reserved.
+const (
+	propReservedPrefix = "leveldb."
+
+	propNumEntries    = "leveldb.num.entries"
+	propNumDeletions  = "leveldb.num.deletions"
+	propNumOverwrites = "leveldb.num.overwrites"
+	propRawKeySize    = "leveldb.raw.key.size"
+	propRawValueSize  = "leveldb.raw.value.size"
+	propDataSize      = "leveldb.data.size"
+	propMinKey        = "leveldb.min.key"
+	propMaxKey        = "leveldb.max.key"
+	propCreationTime  = "leveldb.creation.time"
+)
+
+// Properties holds the table properties, recorded when the table is written.
+type Properties struct {
+	// Number of entries.
+	NumEntries int64
+
+	// Number of deletion markers, and of entries overwritten by a later
+	// entry of the same key, as counted by the table user, see
+	// Writer.SetKeyStats. Zero if not counted.
+	NumDeletions  int64
+	NumOverwrites int64
+
+	// Total length of the keys and of the values appended to the table.
+	RawKeySize   int64
+	RawValueSize int64
+
+	// Total size of the data blocks, after compression.
+	DataSize int64
+
+	// The smallest and the largest key appended to the table, nil if the
+	// table is empty.
+	MinKey, MaxKey []byte
+
+	// Time the table was written, in second precision.
+	CreationTime time.Time
+
+	// Properties collected by opt.Options.TablePropertiesCollectors.
+	User map[string][]byte
+}
+
+// CompressionRatio returns ratio of the keys/values length to the data
+// blocks size, or zero if the table is empty.
+func (p *Properties) CompressionRatio() float64 {
+	if p.DataSize == 0 {
+		return 0
+	}
+	return float64(p.RawKeySize+p.RawValueSize) / float64(p.DataSize)
+}
+
+func (p *Properties) encode(w *blockWriter) {
+	props := make(map[string][]byte, 9+len(p.User))
+	for name, value := range p.User {
+		if !strings.HasPrefix(name, propReservedPrefix) {
+			props[name] = value
+		}
+	}
+	putUvarint := func(name string, x int64) {
+		buf := make([]byte, binary.MaxVarintLen64)
+		props[name] = buf[:binary.PutUvarint(buf, uint64(x))]
+	}
+	putUvarint(propNumEntries, p.NumEntries)
+	putUvarint(propNumDeletions, p.NumDeletions)
+	putUvarint(propNumOverwrites, p.NumOverwrites)
+	putUvarint(propRawKeySize, p.RawKeySize)
+	putUvarint(propRawValueSize, p.RawValueSize)
+	putUvarint(propDataSize, p.DataSize)
+	putUvarint(propCreationTime, p.CreationTime.Unix())
+	if p.NumEntries > 0 {
+		props[propMinKey] = p.MinKey
+		props[propMaxKey] = p.MaxKey
+	}
+
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.append([]byte(name), props[name])
+	}
+}
+
+// Decodes a single property, returns false if the value is invalid.
+// Unknown builtin properties are ignored.
+func (p *Properties) decode(name string, value []byte) bool {
+	if !strings.HasPrefix(name, propReservedPrefix) {
+		if p.User == nil {
+			p.User = make(map[string][]byte)
+		}
+		p.User[name] = append([]byte{}, value...)
+		return true
+	}
+	uvarint := func(dst *int64) bool {
+		x, n := binary.Uvarint(value)
+		if n <= 0 || n != len(value) || int64(x) < 0 {
+			return false
+		}
+		*dst = int64(x)
+		return true
+	}
+	switch name {
+	case propNumEntries:
+		return uvarint(&p.NumEntries)
+	case propNumDeletions:
+		return uvarint(&p.NumDeletions)
+	case propNumOverwrites:
+		return uvarint(&p.NumOverwrites)
+	case propRawKeySize:
+		return uvarint(&p.RawKeySize)
+	case propRawValueSize:
+		return uvarint(&p.RawValueSize)
+	case propDataSize:
+		return uvarint(&p.DataSize)
+	case propMinKey:
+		p.MinKey = append([]byte{}, value...)
+	case propMaxKey:
+		p.MaxKey = append([]byte{}, value...)
+	case propCreationTime:
+		var sec int64
+		if !uvarint(&sec) {
+			return false
+		}
+		p.CreationTime = time.Unix(sec, 0)
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package table
+
+import (
+	"io"
+	"sync"
+)
+
+// Number of consecutive sequential reads that starts the readahead.
+const readaheadMinSeq = 2
+
+// readaheadWindow is a range of the table file read on a background
+// goroutine. The buf and err fields are only valid once done is closed.
+type readaheadWindow struct {
+	off, end int64
+	buf      []byte
+	err      error
+	done     chan struct{}
+}
+
+// readahead reads the data blocks of a table for a single iterator. Once
+// it detects sequential reads, it reads the following data on a background
+// goroutine, two windows ahead, so the reads are served from memory.
+type readahead struct {
+	r     io.ReaderAt
+	size  int64
+	limit int64
+
+	next int64
+	seqN int
+	wins []*readaheadWindow
+	wg   sync.WaitGroup
+}
+
+func newReadahead(r io.ReaderAt, size int, limit int64) *readahead {
+	// Half of the size in flight while the other half is consumed.
+	size /= 2
+	if size < 1 {
+		size = 1
+	}
+	return &readahead{r: r, size: int64(size), limit: limit}
+}
+
+// Starts reading the windows following the last one, if any, or the last
+// read.
+func (ra *readahead) fill() {
+	for len(ra.wins) < 2 {
+		off := ra.next
+		if len(ra.wins) > 0 {
+			off = ra.wins[len(ra.wins)-1].end
+		}
+		if off >= ra.limit {
+			return
+		}
+		end := off + ra.size
+		if end > ra.limit {
+			end = ra.limit
+		}
+		w := &readaheadWindow{
+			off:  off,
+			end:  end,
+			done: make(chan struct{}),
+		}
+		ra.wg.Add(1)
+		go func() {
+			defer ra.wg.Done()
+			buf := make([]byte, w.end-w.off)
+			n, err := ra.r.ReadAt(buf, w.off)
+			if err == io.EOF {
+				err = nil
+			}
+			w.buf, w.err = buf[:n], err
+			close(w.done)
+		}()
+		ra.wins = append(ra.wins, w)
+	}
+}
+
+func (ra *readahead) ReadAt(p []byte, off int64) (n int, err error) {
+	if off == ra.next {
+		ra.seqN++
+	} else {
+		// Not sequential, drop the windows.
+		ra.seqN = 0
+		ra.wins = nil
+	}
+	ra.next = off + int64(len(p))
+
+	for n < len(p) && len(ra.wins) > 0 {
+		w := ra.wins[0]
+		pos := off + int64(n)
+		if pos >= w.end {
+			ra.wins = ra.wins[1:]
+			continue
+		}
+		<-w.done
+		if w.err != nil || pos < w.off || pos >= w.off+int64(len(w.buf)) {
+			// Read directly instead, the error is returned by the
+			// read if persists.
+			ra.wins = nil
+			break
+		}
+		n += copy(p[n:], w.buf[pos-w.off:])
+	}
+	if n < len(p) {
+		var m int
+		m, err = ra.r.ReadAt(p[n:], off+int64(n))
+		n += m
+	}
+
+	if ra.seqN >= readaheadMinSeq && err == nil {
+		ra.fill()
+	}
+	return
+}
+
+// Waits for the background reads, the readahead must not be used after.
+func (ra *readahead) release() {
+	ra.wins = nil
+	ra.wg.Wait()
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"sort"
 	"strings"
 	"sync"
@@ -29,6 +30,7 @@ import (
 // Reader errors.
 var (
 	ErrNotFound       = errors.ErrNotFound
+	ErrCacheMiss      = errors.ErrCacheMiss
 	ErrReaderReleased = errors.New("leveldb/table: reader released")
 	ErrIterReleased   = errors.New("leveldb/table: iterator released")
 )
@@ -247,6 +249,20 @@ func (i *blockIter) Seek(key []byte) bool {
 	return false
 }
 
+func (i *blockIter) SeekLE(key []byte) bool {
+	if !i.Seek(key) {
+		if i.err != nil {
+			return false
+		}
+		// All keys are less than the given key.
+		return i.Last()
+	}
+	if i.tr.cmp.Compare(i.key, key) > 0 {
+		return i.Prev()
+	}
+	return true
+}
+
 func (i *blockIter) Next() bool {
 	if i.dir == dirEOI || i.err != nil {
 		return false
@@ -482,12 +498,92 @@ func (b *filterBlock) Release() {
 	b.data = nil
 }
 
+type filterIndex struct {
+	bpool *util.BufferPool
+	data  []byte
+}
+
+// Returns the start offset and block handle of the filter partition
+// covering data block at the given offset.
+func (b *filterIndex) find(offset uint64) (start uint64, bh blockHandle, ok bool) {
+	n := len(b.data) / filterIndexEntryLen
+	i := sort.Search(n, func(i int) bool {
+		return binary.LittleEndian.Uint64(b.data[i*filterIndexEntryLen:]) > offset
+	}) - 1
+	if i < 0 {
+		return
+	}
+	x := b.data[i*filterIndexEntryLen:]
+	start = binary.LittleEndian.Uint64(x)
+	bh.offset = binary.LittleEndian.Uint64(x[8:])
+	bh.length = binary.LittleEndian.Uint64(x[16:])
+	return start, bh, true
+}
+
+func (b *filterIndex) Release() {
+	b.bpool.Put(b.data)
+	b.bpool = nil
+	b.data = nil
+}
+
+// tableFilter checks keys against either the filter block or the filter
+// partitions of a table.
+type tableFilter struct {
+	tr        *Reader
+	src       io.ReaderAt
+	fillCache bool
+
+	block    *filterBlock
+	blockRel util.Releaser
+
+	// Partitioned filter, the block is the last used partition.
+	index    *filterIndex
+	indexRel util.Releaser
+	start    uint64
+}
+
+func (f *tableFilter) contains(offset uint64, key []byte) (bool, error) {
+	if f.index != nil {
+		start, bh, ok := f.index.find(offset)
+		if !ok {
+			return true, nil
+		}
+		if f.block == nil || f.start != start {
+			if f.block != nil {
+				f.blockRel.Release()
+				f.block, f.blockRel = nil, nil
+			}
+			b, rel, err := f.tr.readFilterBlockCached(f.src, bh, f.fillCache)
+			if err != nil {
+				return true, err
+			}
+			f.block, f.blockRel, f.start = b, rel, start
+		}
+		offset -= start
+	}
+	return f.block.contains(f.tr.filter, offset, key), nil
+}
+
+func (f *tableFilter) Release() {
+	if f.block != nil {
+		f.blockRel.Release()
+		f.block, f.blockRel = nil, nil
+	}
+	if f.index != nil {
+		f.indexRel.Release()
+		f.index, f.indexRel = nil, nil
+	}
+}
+
 type indexIter struct {
 	*blockIter
 	tr    *Reader
 	slice *util.Range
+	src   io.ReaderAt
+	ra    *readahead
 	// Options
-	fillCache bool
+	verifyChecksum bool
+	fillCache      bool
 }
 
 func (i *indexIter) Get() iterator.Iterator {
@@ -504,7 +600,39 @@ func (i *indexIter) Get() iterator.Iterator {
 	if i.slice != nil && (i.blockIter.isFirst() || i.blockIter.isLast()) {
 		slice = i.slice
 	}
-	return i.tr.getDataIterErr(dataBH, slice, i.tr.verifyChecksum, i.fillCache)
+	return i.tr.getDataIterErr(i.src, i.ra, dataBH, slice, i.verifyChecksum, i.fillCache)
+}
+
+func (i *indexIter) Release() {
+	if i.ra != nil {
+		i.ra.release()
+		i.ra = nil
+	}
+	i.blockIter.Release()
+}
+
+// sampleIndexIter skips the data blocks whose position hash is not below
+// the threshold.
+type sampleIndexIter struct {
+	*indexIter
+	threshold uint64
+	seed      uint32
+	buf       [16]byte
+}
+
+func (i *sampleIndexIter) Get() iterator.Iterator {
+	value := i.Value()
+	if value == nil {
+		return nil
+	}
+	if dataBH, n := decodeBlockHandle(value); n != 0 {
+		binary.LittleEndian.PutUint64(i.buf[:], uint64(i.tr.fd.Num))
+		binary.LittleEndian.PutUint64(i.buf[8:], dataBH.offset)
+		if uint64(util.Hash(i.buf[:], i.seed)) >= i.threshold {
+			return iterator.NewEmptyIterator(nil)
+		}
+	}
+	return i.indexIter.Get()
 }
 
 // Reader is a table reader.
@@ -512,19 +640,51 @@ type Reader struct {
 	mu     sync.RWMutex
 	fd     storage.FileDesc
 	reader io.ReaderAt
+	mmap   []byte
 	cache  *cache.NamespaceGetter
+	ccache *cache.NamespaceGetter
+	mcache *cache.NamespaceGetter
 	err    error
 	bpool  *util.BufferPool
 	// Options
 	o              *opt.Options
 	cmp            comparer.Comparer
 	filter         filter.Filter
+	prefixer       comparer.Prefixer
 	verifyChecksum bool
+	checksum       util.Checksum
 
 	dataEnd                   int64
 	metaBH, indexBH, filterBH blockHandle
 	indexBlock                *block
 	filterBlock               *filterBlock
+	// Partitioned filter, filterBH is the filter partition index and
+	// filterStart is the offset of the first filter partition.
+	filterPartitioned bool
+	filterStart       uint64
+	filterIndex       *filterIndex
+	// The cache handles of the pinned index and filter blocks.
+	metaPins    []util.Releaser
+	tableFilter *TableFilter
+	props       *Properties
+}
+
+// TableFilter is an in-memory filter covering all keys of a table.
+// It remains valid after the table reader is released.
+type TableFilter struct {
+	filter filter.Filter
+	data   []byte
+}
+
+// Contains returns false if the table doesn't contain the given key.
+// The key must be in the form passed to Reader.Find.
+func (f *TableFilter) Contains(key []byte) bool {
+	return f.filter.Contains(f.data, key)
+}
+
+// Size returns the size of the filter data.
+func (f *TableFilter) Size() int {
+	return len(f.data)
 }
 
 func (r *Reader) blockKind(bh blockHandle) string {
@@ -535,14 +695,20 @@ func (r *Reader) blockKind(bh blockHandle) string {
 		return "index-block"
 	case r.filterBH.offset:
 		if r.filterBH.length > 0 {
+			if r.filterPartitioned {
+				return "filter-partition-index"
+			}
 			return "filter-block"
 		}
 	}
+	if r.filterPartitioned && bh.offset >= r.filterStart && bh.offset < r.filterBH.offset {
+		return "filter-partition"
+	}
 	return "data-block"
 }
 
 func (r *Reader) newErrCorrupted(pos, size int64, kind, reason string) error {
-	return &errors.ErrCorrupted{Fd: r.fd, Err: &ErrCorrupted{Pos: pos, Size: size, Kind: kind, Reason: reason}}
+	return errors.NewErrCorruptedAt(r.fd, pos, size, reason, &ErrCorrupted{Pos: pos, Size: size, Kind: kind, Reason: reason})
 }
 
 func (r *Reader) newErrCorruptedBH(bh blockHandle, reason string) error {
@@ -554,24 +720,64 @@ func (r *Reader) fixErrCorruptedBH(bh blockHandle, err error) error {
 		cerr.Pos = int64(bh.offset)
 		cerr.Size = int64(bh.length)
 		cerr.Kind = r.blockKind(bh)
-		return &errors.ErrCorrupted{Fd: r.fd, Err: cerr}
+		return errors.NewErrCorruptedAt(r.fd, cerr.Pos, cerr.Size, cerr.Reason, cerr)
 	}
 	return err
 }
 
-func (r *Reader) readRawBlock(bh blockHandle, verifyChecksum bool) ([]byte, error) {
-	data := r.bpool.Get(int(bh.length + blockTrailerLen))
-	if _, err := r.reader.ReadAt(data, int64(bh.offset)); err != nil && err != io.EOF {
-		return nil, err
+// compressedBlock is a compressed block kept by the compressed block
+// cache, including its trailer.
+type compressedBlock []byte
+
+// Reads block data. The returned buffer pool owns the data, it is nil if
+// the data is a slice of the mapped file.
+func (r *Reader) readRawBlock(bh blockHandle, verifyChecksum, fillCache bool) ([]byte, *util.BufferPool, error) {
+	return r.readRawBlockFrom(r.reader, bh, verifyChecksum, fillCache)
+}
+
+// Like readRawBlock, but reads the table file through the given reader,
+// e.g. a readahead.
+func (r *Reader) readRawBlockFrom(src io.ReaderAt, bh blockHandle, verifyChecksum, fillCache bool) ([]byte, *util.BufferPool, error) {
+	var (
+		data           []byte
+		bpool          = r.bpool
+		n              = bh.length + blockTrailerLen
+		fillCompressed bool
+	)
+	if r.mmap != nil {
+		if _, ok := src.(cacheOnlyReader); ok {
+			return nil, nil, ErrCacheMiss
+		}
+		if bh.offset > uint64(len(r.mmap)) || n > uint64(len(r.mmap))-bh.offset {
+			return nil, nil, r.newErrCorruptedBH(bh, "block out of range")
+		}
+		data, bpool = r.mmap[bh.offset:bh.offset+n:bh.offset+n], nil
+	} else if ch := r.getCompressedBlock(bh); ch != nil {
+		// The checksum was verified before caching, the cached block
+		// is only ever decompressed.
+		defer ch.Release()
+		data, bpool = ch.Value().(compressedBlock), nil
+		verifyChecksum = false
+	} else {
+		data = r.bpool.Get(int(n))
+		if _, err := src.ReadAt(data, int64(bh.offset)); err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+		// Don't let corrupted block into the compressed block cache.
+		fillCompressed = fillCache && r.ccache != nil
+		verifyChecksum = verifyChecksum || fillCompressed
 	}
 
 	if verifyChecksum {
 		n := bh.length + 1
 		checksum0 := binary.LittleEndian.Uint32(data[n:])
-		checksum1 := util.NewCRC(data[:n]).Value()
+		checksum1 := r.checksum.Sum(data[:n])
 		if checksum0 != checksum1 {
-			r.bpool.Put(data)
-			return nil, r.newErrCorruptedBH(bh, fmt.Sprintf("checksum mismatch, want=%#x got=%#x", checksum0, checksum1))
+			bpool.Put(data)
+			return nil, nil, r.newErrCorruptedBH(bh, fmt.Sprintf("checksum mismatch, want=%#x got=%#x", checksum0, checksum1))
+		}
+		if fillCompressed {
+			r.putCompressedBlock(bh, data)
 		}
 	}
 
@@ -581,32 +787,73 @@ func (r *Reader) readRawBlock(bh blockHandle, verifyChecksum bool) ([]byte, erro
 	case blockTypeSnappyCompression:
 		decLen, err := snappy.DecodedLen(data[:bh.length])
 		if err != nil {
-			r.bpool.Put(data)
-			return nil, r.newErrCorruptedBH(bh, err.Error())
+			bpool.Put(data)
+			return nil, nil, r.newErrCorruptedBH(bh, err.Error())
 		}
 		decData := r.bpool.Get(decLen)
 		decData, err = snappy.Decode(decData, data[:bh.length])
-		r.bpool.Put(data)
+		bpool.Put(data)
 		if err != nil {
 			r.bpool.Put(decData)
-			return nil, r.newErrCorruptedBH(bh, err.Error())
+			return nil, nil, r.newErrCorruptedBH(bh, err.Error())
 		}
-		data = decData
+		data, bpool = decData, r.bpool
 	default:
-		r.bpool.Put(data)
-		return nil, r.newErrCorruptedBH(bh, fmt.Sprintf("unknown compression type %#x", data[bh.length]))
+		compression := opt.Compression(data[bh.length])
+		if !compression.IsUser() {
+			bpool.Put(data)
+			return nil, nil, r.newErrCorruptedBH(bh, fmt.Sprintf("unknown compression type %#x", data[bh.length]))
+		}
+		c := r.o.GetCompressor(compression)
+		if c == nil {
+			bpool.Put(data)
+			return nil, nil, fmt.Errorf("leveldb/table: no compressor for %v compression", compression)
+		}
+		decData, err := c.Decode(nil, data[:bh.length])
+		bpool.Put(data)
+		if err != nil {
+			return nil, nil, r.newErrCorruptedBH(bh, err.Error())
+		}
+		data, bpool = decData, r.bpool
 	}
-	return data, nil
+	return data, bpool, nil
 }
 
-func (r *Reader) readBlock(bh blockHandle, verifyChecksum bool) (*block, error) {
-	data, err := r.readRawBlock(bh, verifyChecksum)
+// Returns the compressed block from the compressed block cache, if any.
+func (r *Reader) getCompressedBlock(bh blockHandle) *cache.Handle {
+	if r.ccache == nil {
+		return nil
+	}
+	return r.ccache.Get(bh.offset, nil)
+}
+
+// Keeps a copy of the block in the compressed block cache if the block is
+// compressed.
+func (r *Reader) putCompressedBlock(bh blockHandle, data []byte) {
+	if data[bh.length] == blockTypeNoCompression {
+		return
+	}
+	ch := r.ccache.Get(bh.offset, func() (size int, value cache.Value) {
+		b := append(compressedBlock(nil), data[:bh.length+blockTrailerLen]...)
+		return cap(b), b
+	})
+	if ch != nil {
+		ch.Release()
+	}
+}
+
+func (r *Reader) readBlock(bh blockHandle, verifyChecksum, fillCache bool) (*block, error) {
+	return r.readBlockFrom(r.reader, bh, verifyChecksum, fillCache)
+}
+
+func (r *Reader) readBlockFrom(src io.ReaderAt, bh blockHandle, verifyChecksum, fillCache bool) (*block, error) {
+	data, bpool, err := r.readRawBlockFrom(src, bh, verifyChecksum, fillCache)
 	if err != nil {
 		return nil, err
 	}
 	restartsLen := int(binary.LittleEndian.Uint32(data[len(data)-4:]))
 	b := &block{
-		bpool:          r.bpool,
+		bpool:          bpool,
 		bh:             bh,
 		data:           data,
 		restartsLen:    restartsLen,
@@ -616,22 +863,30 @@ func (r *Reader) readBlock(bh blockHandle, verifyChecksum bool) (*block, error)
 }
 
 func (r *Reader) readBlockCached(bh blockHandle, verifyChecksum, fillCache bool) (*block, util.Releaser, error) {
-	if r.cache != nil {
+	return r.readBlockCachedFrom(r.reader, bh, verifyChecksum, fillCache)
+}
+
+func (r *Reader) readBlockCachedFrom(src io.ReaderAt, bh blockHandle, verifyChecksum, fillCache bool) (*block, util.Releaser, error) {
+	return r.readBlockCachedIn(r.cache, src, bh, verifyChecksum, fillCache)
+}
+
+func (r *Reader) readBlockCachedIn(c *cache.NamespaceGetter, src io.ReaderAt, bh blockHandle, verifyChecksum, fillCache bool) (*block, util.Releaser, error) {
+	if c != nil {
 		var (
 			err error
 			ch  *cache.Handle
 		)
 		if fillCache {
-			ch = r.cache.Get(bh.offset, func() (size int, value cache.Value) {
+			ch = c.Get(bh.offset, func() (size int, value cache.Value) {
 				var b *block
-				b, err = r.readBlock(bh, verifyChecksum)
+				b, err = r.readBlockFrom(src, bh, verifyChecksum, true)
 				if err != nil {
 					return 0, nil
 				}
 				return cap(b.data), b
 			})
 		} else {
-			ch = r.cache.Get(bh.offset, nil)
+			ch = c.Get(bh.offset, nil)
 		}
 		if ch != nil {
 			b, ok := ch.Value().(*block)
@@ -645,12 +900,12 @@ func (r *Reader) readBlockCached(bh blockHandle, verifyChecksum, fillCache bool)
 		}
 	}
 
-	b, err := r.readBlock(bh, verifyChecksum)
+	b, err := r.readBlockFrom(src, bh, verifyChecksum, fillCache)
 	return b, b, err
 }
 
-func (r *Reader) readFilterBlock(bh blockHandle) (*filterBlock, error) {
-	data, err := r.readRawBlock(bh, true)
+func (r *Reader) readFilterBlock(src io.ReaderAt, bh blockHandle) (*filterBlock, error) {
+	data, bpool, err := r.readRawBlockFrom(src, bh, true, true)
 	if err != nil {
 		return nil, err
 	}
@@ -664,7 +919,7 @@ func (r *Reader) readFilterBlock(bh blockHandle) (*filterBlock, error) {
 		return nil, r.newErrCorruptedBH(bh, "invalid data-offsets offset")
 	}
 	b := &filterBlock{
-		bpool:      r.bpool,
+		bpool:      bpool,
 		data:       data,
 		oOffset:    oOffset,
 		baseLg:     uint(data[n-1]),
@@ -673,23 +928,23 @@ func (r *Reader) readFilterBlock(bh blockHandle) (*filterBlock, error) {
 	return b, nil
 }
 
-func (r *Reader) readFilterBlockCached(bh blockHandle, fillCache bool) (*filterBlock, util.Releaser, error) {
-	if r.cache != nil {
+func (r *Reader) readFilterBlockCached(src io.ReaderAt, bh blockHandle, fillCache bool) (*filterBlock, util.Releaser, error) {
+	if c := r.metaCache(); c != nil {
 		var (
 			err error
 			ch  *cache.Handle
 		)
 		if fillCache {
-			ch = r.cache.Get(bh.offset, func() (size int, value cache.Value) {
+			ch = c.Get(bh.offset, func() (size int, value cache.Value) {
 				var b *filterBlock
-				b, err = r.readFilterBlock(bh)
+				b, err = r.readFilterBlock(src, bh)
 				if err != nil {
 					return 0, nil
 				}
 				return cap(b.data), b
 			})
 		} else {
-			ch = r.cache.Get(bh.offset, nil)
+			ch = c.Get(bh.offset, nil)
 		}
 		if ch != nil {
 			b, ok := ch.Value().(*filterBlock)
@@ -703,24 +958,120 @@ func (r *Reader) readFilterBlockCached(bh blockHandle, fillCache bool) (*filterB
 		}
 	}
 
-	b, err := r.readFilterBlock(bh)
+	b, err := r.readFilterBlock(src, bh)
 	return b, b, err
 }
 
-func (r *Reader) getIndexBlock(fillCache bool) (b *block, rel util.Releaser, err error) {
+func (r *Reader) readProperties(bh blockHandle) error {
+	b, err := r.readBlock(bh, true, false)
+	if err != nil {
+		return err
+	}
+	defer b.Release()
+	props := &Properties{}
+	iter := r.newBlockIter(b, nil, nil, true)
+	defer iter.Release()
+	for iter.Next() {
+		if !props.decode(string(iter.Key()), iter.Value()) {
+			return r.newErrCorruptedBH(bh, fmt.Sprintf("invalid %q property", iter.Key()))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	r.props = props
+	return nil
+}
+
+func (r *Reader) readFilterIndex(src io.ReaderAt, bh blockHandle) (*filterIndex, error) {
+	data, bpool, err := r.readRawBlockFrom(src, bh, true, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%filterIndexEntryLen != 0 {
+		bpool.Put(data)
+		return nil, r.newErrCorruptedBH(bh, "invalid filter partition index length")
+	}
+	return &filterIndex{bpool: bpool, data: data}, nil
+}
+
+func (r *Reader) readFilterIndexCached(src io.ReaderAt, bh blockHandle, fillCache bool) (*filterIndex, util.Releaser, error) {
+	if c := r.metaCache(); c != nil {
+		var (
+			err error
+			ch  *cache.Handle
+		)
+		if fillCache {
+			ch = c.Get(bh.offset, func() (size int, value cache.Value) {
+				var b *filterIndex
+				b, err = r.readFilterIndex(src, bh)
+				if err != nil {
+					return 0, nil
+				}
+				return cap(b.data), b
+			})
+		} else {
+			ch = c.Get(bh.offset, nil)
+		}
+		if ch != nil {
+			b, ok := ch.Value().(*filterIndex)
+			if !ok {
+				ch.Release()
+				return nil, nil, errors.New("leveldb/table: inconsistent block type")
+			}
+			return b, ch, err
+		} else if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	b, err := r.readFilterIndex(src, bh)
+	return b, b, err
+}
+
+// Returns the cache holding the index and filter blocks.
+func (r *Reader) metaCache() *cache.NamespaceGetter {
+	if r.mcache != nil {
+		return r.mcache
+	}
+	return r.cache
+}
+
+func (r *Reader) getIndexBlock(src io.ReaderAt, fillCache bool) (b *block, rel util.Releaser, err error) {
 	if r.indexBlock == nil {
-		return r.readBlockCached(r.indexBH, true, fillCache)
+		return r.readBlockCachedIn(r.metaCache(), src, r.indexBH, true, fillCache)
 	}
 	return r.indexBlock, util.NoopReleaser{}, nil
 }
 
-func (r *Reader) getFilterBlock(fillCache bool) (*filterBlock, util.Releaser, error) {
+func (r *Reader) getFilterBlock(src io.ReaderAt, fillCache bool) (*filterBlock, util.Releaser, error) {
 	if r.filterBlock == nil {
-		return r.readFilterBlockCached(r.filterBH, fillCache)
+		return r.readFilterBlockCached(src, r.filterBH, fillCache)
 	}
 	return r.filterBlock, util.NoopReleaser{}, nil
 }
 
+func (r *Reader) getFilterIndex(src io.ReaderAt, fillCache bool) (*filterIndex, util.Releaser, error) {
+	if r.filterIndex == nil {
+		return r.readFilterIndexCached(src, r.filterBH, fillCache)
+	}
+	return r.filterIndex, util.NoopReleaser{}, nil
+}
+
+// Returns the table filter, the caller should release it after use.
+func (r *Reader) getFilter(src io.ReaderAt, fillCache bool) (f *tableFilter, err error) {
+	f = &tableFilter{tr: r, src: src, fillCache: fillCache}
+	if r.filterPartitioned {
+		f.index, f.indexRel, err = r.getFilterIndex(src, fillCache)
+	} else {
+		f.block, f.blockRel, err = r.getFilterBlock(src, fillCache)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
 func (r *Reader) newBlockIter(b *block, bReleaser util.Releaser, slice *util.Range, inclLimit bool) *blockIter {
 	bi := &blockIter{
 		tr:            r,
@@ -761,15 +1112,46 @@ func (r *Reader) newBlockIter(b *block, bReleaser util.Releaser, slice *util.Ran
 	return bi
 }
 
-func (r *Reader) getDataIter(dataBH blockHandle, slice *util.Range, verifyChecksum, fillCache bool) iterator.Iterator {
-	b, rel, err := r.readBlockCached(dataBH, verifyChecksum, fillCache)
+func (r *Reader) getDataIter(src io.ReaderAt, dataBH blockHandle, slice *util.Range, verifyChecksum, fillCache bool) iterator.Iterator {
+	if verifyChecksum && !r.verifyChecksum {
+		// Paranoid read, the block cache may hold unverified block.
+		b, err := r.readBlockFrom(src, dataBH, true, false)
+		if err != nil {
+			return iterator.NewEmptyIterator(err)
+		}
+		return r.newBlockIter(b, b, slice, false)
+	}
+	b, rel, err := r.readBlockCachedFrom(src, dataBH, verifyChecksum, fillCache)
 	if err != nil {
 		return iterator.NewEmptyIterator(err)
 	}
 	return r.newBlockIter(b, rel, slice, false)
 }
 
-func (r *Reader) getDataIterErr(dataBH blockHandle, slice *util.Range, verifyChecksum, fillCache bool) iterator.Iterator {
+// Returns whether data blocks read by the 'read operation' should be
+// verified.
+func (r *Reader) verifyChecksumRO(ro *opt.ReadOptions) bool {
+	return r.verifyChecksum || opt.GetStrict(r.o, ro, opt.StrictParanoidChecks)
+}
+
+// Returns the table file reader for the 'read operation', it fails all
+// reads if the 'read operation' may only be served by the caches.
+func (r *Reader) readerRO(ro *opt.ReadOptions) io.ReaderAt {
+	if ro.GetCacheOnly() {
+		return cacheOnlyReader{}
+	}
+	return r.reader
+}
+
+// cacheOnlyReader is the table file reader of a cache only 'read
+// operation', see opt.ReadOptions.CacheOnly.
+type cacheOnlyReader struct{}
+
+func (cacheOnlyReader) ReadAt(p []byte, off int64) (int, error) {
+	return 0, ErrCacheMiss
+}
+
+func (r *Reader) getDataIterErr(src io.ReaderAt, ra *readahead, dataBH blockHandle, slice *util.Range, verifyChecksum, fillCache bool) iterator.Iterator {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -777,7 +1159,10 @@ func (r *Reader) getDataIterErr(dataBH blockHandle, slice *util.Range, verifyChe
 		return iterator.NewEmptyIterator(r.err)
 	}
 
-	return r.getDataIter(dataBH, slice, verifyChecksum, fillCache)
+	if ra != nil {
+		return r.getDataIter(ra, dataBH, slice, verifyChecksum, fillCache)
+	}
+	return r.getDataIter(src, dataBH, slice, verifyChecksum, fillCache)
 }
 
 // NewIterator creates an iterator from the table.
@@ -788,10 +1173,24 @@ func (r *Reader) getDataIterErr(dataBH blockHandle, slice *util.Range, verifyChe
 // the table.
 //
 // The returned iterator is not safe for concurrent use and should be released
-// after use.
+// after use. If ro.PinData is true the iterator is in pinning mode, see
+// iterator.Pinner. If ro.ReadaheadSize is positive the iterator reads
+// ahead of sequential data block reads.
 //
 // Also read Iterator documentation of the leveldb/iterator package.
 func (r *Reader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	return r.NewSampleIterator(slice, ro, 1, 0)
+}
+
+// NewSampleIterator creates an iterator from the table that only reads
+// approximately the given fraction of its data blocks, and so yields
+// approximately the fraction of its keys. The data blocks are picked by
+// hashing their position with the given seed, iterators with the same
+// seed pick the same data blocks. A fraction of 1 or greater yields all
+// keys, as NewIterator.
+//
+// Also read NewIterator documentation.
+func (r *Reader) NewSampleIterator(slice *util.Range, ro *opt.ReadOptions, fraction float64, seed uint32) iterator.Iterator {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -799,21 +1198,72 @@ func (r *Reader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.It
 		return iterator.NewEmptyIterator(r.err)
 	}
 
-	fillCache := !ro.GetDontFillCache()
-	indexBlock, rel, err := r.getIndexBlock(fillCache)
+	src, fillCache := r.readerRO(ro), !ro.GetDontFillCache()
+	indexBlock, rel, err := r.getIndexBlock(src, fillCache)
 	if err != nil {
 		return iterator.NewEmptyIterator(err)
 	}
 	index := &indexIter{
-		blockIter: r.newBlockIter(indexBlock, rel, slice, true),
-		tr:        r,
-		slice:     slice,
-		fillCache: !ro.GetDontFillCache(),
+		blockIter:      r.newBlockIter(indexBlock, rel, slice, true),
+		tr:             r,
+		slice:          slice,
+		src:            src,
+		verifyChecksum: r.verifyChecksumRO(ro),
+		fillCache:      fillCache,
+	}
+	if n := ro.GetReadaheadSize(); n > 0 && r.mmap == nil && !ro.GetCacheOnly() {
+		index.ra = newReadahead(r.reader, n, r.dataEnd)
+	}
+	var indexer iterator.IteratorIndexer = index
+	if fraction < 1 {
+		indexer = &sampleIndexIter{
+			indexIter: index,
+			threshold: uint64(math.Max(fraction, 0) * (1 << 32)),
+			seed:      seed,
+		}
 	}
-	return iterator.NewIndexedIterator(index, opt.GetStrict(r.o, ro, opt.StrictReader))
+	if ro.GetPinData() {
+		return iterator.NewPinningIndexedIterator(indexer, opt.GetStrict(r.o, ro, opt.StrictReader))
+	}
+	return iterator.NewIndexedIterator(indexer, opt.GetStrict(r.o, ro, opt.StrictReader))
 }
 
-func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bool) (rkey, value []byte, err error) {
+// PrefixMayMatch returns false if 'filter data' indicates that the table
+// doesn't contain any key with the given prefix within the given slice.
+// The prefix must be as extracted by the Options.Prefixer, and is only
+// checked if the table was written with the same prefixer and filter.
+func (r *Reader) PrefixMayMatch(prefix []byte, slice *util.Range) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil || r.filter == nil || r.prefixer == nil {
+		return true
+	}
+
+	filter, err := r.getFilter(r.reader, true)
+	if err != nil {
+		return true
+	}
+	defer filter.Release()
+	indexBlock, rel, err := r.getIndexBlock(r.reader, true)
+	if err != nil {
+		return true
+	}
+	index := r.newBlockIter(indexBlock, rel, slice, true)
+	defer index.Release()
+	for index.Next() {
+		dataBH, n := decodeBlockHandle(index.Value())
+		if n == 0 {
+			return true
+		}
+		if ok, err := filter.contains(dataBH.offset, prefix); ok || err != nil {
+			return true
+		}
+	}
+	return index.Error() != nil
+}
+
+func (r *Reader) find(key, dst []byte, filtered bool, ro *opt.ReadOptions, noValue bool) (rkey, value []byte, err error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -822,7 +1272,8 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 		return
 	}
 
-	indexBlock, rel, err := r.getIndexBlock(true)
+	src, fillCache := r.readerRO(ro), !ro.GetDontFillCache()
+	indexBlock, rel, err := r.getIndexBlock(src, fillCache)
 	if err != nil {
 		return
 	}
@@ -845,20 +1296,25 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 	}
 
 	// The filter should only used for exact match.
+	if filtered && r.tableFilter != nil && !r.tableFilter.Contains(key) {
+		return nil, nil, ErrNotFound
+	}
 	if filtered && r.filter != nil {
-		filterBlock, frel, ferr := r.getFilterBlock(true)
+		filter, ferr := r.getFilter(src, fillCache)
 		if ferr == nil {
-			if !filterBlock.contains(r.filter, dataBH.offset, key) {
-				frel.Release()
+			var ok bool
+			ok, ferr = filter.contains(dataBH.offset, key)
+			filter.Release()
+			if ferr == nil && !ok {
 				return nil, nil, ErrNotFound
 			}
-			frel.Release()
-		} else if !errors.IsCorrupted(ferr) {
+		}
+		if ferr != nil && !errors.IsCorrupted(ferr) {
 			return nil, nil, ferr
 		}
 	}
 
-	data := r.getDataIter(dataBH, nil, r.verifyChecksum, !ro.GetDontFillCache())
+	data := r.getDataIter(src, dataBH, nil, r.verifyChecksumRO(ro), fillCache)
 	if !data.Seek(key) {
 		data.Release()
 		if err = data.Error(); err != nil {
@@ -879,7 +1335,7 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 			return nil, nil, r.err
 		}
 
-		data = r.getDataIter(dataBH, nil, r.verifyChecksum, !ro.GetDontFillCache())
+		data = r.getDataIter(src, dataBH, nil, r.verifyChecksumRO(ro), fillCache)
 		if !data.Next() {
 			data.Release()
 			if err = data.Error(); err == nil {
@@ -892,12 +1348,20 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 	// Key doesn't use block buffer, no need to copy the buffer.
 	rkey = data.Key()
 	if !noValue {
-		if r.bpool == nil {
+		switch {
+		case dst != nil:
+			value = append(dst, data.Value()...)
+		case r.bpool == nil && r.mmap == nil:
 			value = data.Value()
-		} else {
+		default:
 			// Value does use block buffer, and since the buffer will be
-			// recycled, it need to be copied.
-			value = append([]byte{}, data.Value()...)
+			// recycled or unmapped, it need to be copied.
+			if ro.GetPoolValues() {
+				value = r.bpool.Get(len(data.Value()))
+				copy(value, data.Value())
+			} else {
+				value = append([]byte{}, data.Value()...)
+			}
 		}
 	}
 	data.Release()
@@ -915,7 +1379,13 @@ func (r *Reader) find(key []byte, filtered bool, ro *opt.ReadOptions, noValue bo
 // own copy.
 // It is safe to modify the contents of the argument after Find returns.
 func (r *Reader) Find(key []byte, filtered bool, ro *opt.ReadOptions) (rkey, value []byte, err error) {
-	return r.find(key, filtered, ro, false)
+	return r.find(key, nil, filtered, ro, false)
+}
+
+// FindTo is like Find, but appends the value to dst and returns the
+// extended slice as value, e.g. to reuse a buffer across lookups.
+func (r *Reader) FindTo(key, dst []byte, filtered bool, ro *opt.ReadOptions) (rkey, value []byte, err error) {
+	return r.find(key, dst, filtered, ro, false)
 }
 
 // FindKey finds key that is greater than or equal to the given key.
@@ -928,7 +1398,7 @@ func (r *Reader) Find(key []byte, filtered bool, ro *opt.ReadOptions) (rkey, val
 // own copy.
 // It is safe to modify the contents of the argument after Find returns.
 func (r *Reader) FindKey(key []byte, filtered bool, ro *opt.ReadOptions) (rkey []byte, err error) {
-	rkey, _, err = r.find(key, filtered, ro, true)
+	rkey, _, err = r.find(key, nil, filtered, ro, true)
 	return
 }
 
@@ -947,7 +1417,7 @@ func (r *Reader) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error)
 		return
 	}
 
-	rkey, value, err := r.find(key, false, ro, false)
+	rkey, value, err := r.find(key, nil, false, ro, false)
 	if err == nil && r.cmp.Compare(rkey, key) != 0 {
 		value = nil
 		err = ErrNotFound
@@ -967,7 +1437,7 @@ func (r *Reader) OffsetOf(key []byte) (offset int64, err error) {
 		return
 	}
 
-	indexBlock, rel, err := r.readBlockCached(r.indexBH, true, true)
+	indexBlock, rel, err := r.getIndexBlock(r.reader, true)
 	if err != nil {
 		return
 	}
@@ -991,32 +1461,315 @@ func (r *Reader) OffsetOf(key []byte) (offset int64, err error) {
 	return
 }
 
+// Reads the block of the given handle from the file, bypassing the caches,
+// and verifies its checksum.
+func (r *Reader) verifyBlock(bh blockHandle) error {
+	var (
+		data []byte
+		n    = bh.length + blockTrailerLen
+	)
+	if r.mmap != nil {
+		if bh.offset > uint64(len(r.mmap)) || n > uint64(len(r.mmap))-bh.offset {
+			return r.newErrCorruptedBH(bh, "block out of range")
+		}
+		data = r.mmap[bh.offset : bh.offset+n]
+	} else {
+		data = r.bpool.Get(int(n))
+		defer r.bpool.Put(data)
+		if m, err := r.reader.ReadAt(data, int64(bh.offset)); m < len(data) {
+			if err != nil && err != io.EOF {
+				return err
+			}
+			return r.newErrCorruptedBH(bh, "block out of range")
+		}
+	}
+	checksum0 := binary.LittleEndian.Uint32(data[bh.length+1:])
+	checksum1 := r.checksum.Sum(data[:bh.length+1])
+	if checksum0 != checksum1 {
+		return r.newErrCorruptedBH(bh, fmt.Sprintf("checksum mismatch, want=%#x got=%#x", checksum0, checksum1))
+	}
+	return nil
+}
+
+// VerifyChecksums reads every block of the table from the file, bypassing
+// the block caches, and verifies its checksum. The data blocks, the index
+// block, the metaindex block, and the blocks referenced by the metaindex
+// block, including the filter partitions, are verified.
+//
+// If wait isn't nil, it is called with the size of each block before the
+// block is read, e.g. to limit the read rate. Verification stops at the
+// first error returned by wait, which is returned as is.
+//
+// The returned error will be of type errors.ErrCorrupted if a block is
+// corrupted, only the first corrupted block is reported.
+func (r *Reader) VerifyChecksums(wait func(n int) error) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	verify := func(bh blockHandle) error {
+		if wait != nil {
+			if err := wait(int(bh.length + blockTrailerLen)); err != nil {
+				return err
+			}
+		}
+		return r.verifyBlock(bh)
+	}
+
+	// Metaindex block.
+	if err := verify(r.metaBH); err != nil {
+		return err
+	}
+	metaBlock, err := r.readBlock(r.metaBH, false, false)
+	if err != nil {
+		return err
+	}
+	var metaBHs, filterIndexBHs []blockHandle
+	metaIter := r.newBlockIter(metaBlock, nil, nil, true)
+	for metaIter.Next() {
+		bh, n := decodeBlockHandle(metaIter.Value())
+		if n == 0 {
+			continue
+		}
+		metaBHs = append(metaBHs, bh)
+		if strings.HasPrefix(string(metaIter.Key()), "partitionedfilter.") {
+			filterIndexBHs = append(filterIndexBHs, bh)
+		}
+	}
+	err = metaIter.Error()
+	metaIter.Release()
+	metaBlock.Release()
+	if err != nil {
+		return err
+	}
+
+	// Index block and data blocks.
+	if err := verify(r.indexBH); err != nil {
+		return err
+	}
+	indexBlock, err := r.readBlock(r.indexBH, false, false)
+	if err != nil {
+		return err
+	}
+	defer indexBlock.Release()
+	indexIter := r.newBlockIter(indexBlock, nil, nil, true)
+	defer indexIter.Release()
+	for indexIter.Next() {
+		dataBH, n := decodeBlockHandle(indexIter.Value())
+		if n == 0 {
+			return r.newErrCorruptedBH(r.indexBH, "bad data block handle")
+		}
+		if err := verify(dataBH); err != nil {
+			return err
+		}
+	}
+	if err := indexIter.Error(); err != nil {
+		return err
+	}
+
+	// Meta blocks.
+	for _, bh := range metaBHs {
+		if err := verify(bh); err != nil {
+			return err
+		}
+	}
+
+	// Filter partitions.
+	for _, bh := range filterIndexBHs {
+		data, bpool, err := r.readRawBlock(bh, false, false)
+		if err != nil {
+			return err
+		}
+		if len(data)%filterIndexEntryLen != 0 {
+			bpool.Put(data)
+			return r.newErrCorruptedBH(bh, "invalid filter partition index length")
+		}
+		for x := data; len(x) > 0; x = x[filterIndexEntryLen:] {
+			partBH := blockHandle{
+				offset: binary.LittleEndian.Uint64(x[8:]),
+				length: binary.LittleEndian.Uint64(x[16:]),
+			}
+			if err := verify(partBH); err != nil {
+				bpool.Put(data)
+				return err
+			}
+		}
+		bpool.Put(data)
+	}
+	return nil
+}
+
 // Release implements util.Releaser.
 // It also close the file if it is an io.Closer.
 func (r *Reader) Release() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.mmap != nil && r.cache != nil {
+		// Cached blocks may be slices of the mapped file, which is
+		// unmapped once the file is closed.
+		r.cache.Cache.EvictNS(r.cache.NS)
+	}
 	if closer, ok := r.reader.(io.Closer); ok {
 		closer.Close()
 	}
-	if r.indexBlock != nil {
-		r.indexBlock.Release()
-		r.indexBlock = nil
-	}
-	if r.filterBlock != nil {
-		r.filterBlock.Release()
-		r.filterBlock = nil
+	r.releaseMetaBlocks()
+	if r.mmap != nil && r.mcache != nil {
+		r.mcache.Cache.EvictNS(r.mcache.NS)
 	}
 	r.reader = nil
+	r.mmap = nil
 	r.cache = nil
+	r.ccache = nil
+	r.mcache = nil
 	r.bpool = nil
 	r.err = ErrReaderReleased
 }
 
+// DropCache advises the OS to drop the cached pages of the table file, if
+// it implements storage.CacheDropper, see storage.CacheDropper.
+func (r *Reader) DropCache() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	if cd, ok := r.reader.(storage.CacheDropper); ok {
+		return cd.DropCache()
+	}
+	return storage.ErrNotSupported
+}
+
+// TableFilter returns the table filter, or nil if the table doesn't have
+// one usable with the filters given by the options.
+func (r *Reader) TableFilter() *TableFilter {
+	return r.tableFilter
+}
+
+// NumEntries returns number of entries of the table. It returns false if
+// the table doesn't record its number of entries, e.g. tables written by
+// older versions.
+func (r *Reader) NumEntries() (n int64, ok bool) {
+	if r.props == nil {
+		return 0, false
+	}
+	return r.props.NumEntries, true
+}
+
+// Properties returns the table properties, or nil if the table doesn't
+// have properties block, e.g. tables written by older versions.
+// The returned properties should not be modified.
+func (r *Reader) Properties() *Properties {
+	return r.props
+}
+
+// SetCompressedCache sets the compressed block cache, which holds blocks
+// as read from the file before decompression. The compressed block cache
+// is not used if the blocks are read from the mapped file.
+//
+// It must be called before the reader is used.
+func (r *Reader) SetCompressedCache(ccache *cache.NamespaceGetter) {
+	r.ccache = ccache
+}
+
+// Releases the index and filter blocks held by the reader.
+func (r *Reader) releaseMetaBlocks() {
+	if r.metaPins != nil {
+		// Held by the cache handles.
+		for _, rel := range r.metaPins {
+			rel.Release()
+		}
+		r.metaPins = nil
+	} else {
+		if r.indexBlock != nil {
+			r.indexBlock.Release()
+		}
+		if r.filterBlock != nil {
+			r.filterBlock.Release()
+		}
+		if r.filterIndex != nil {
+			r.filterIndex.Release()
+		}
+	}
+	r.indexBlock = nil
+	r.filterBlock = nil
+	r.filterIndex = nil
+}
+
+// SetMetaCache sets the cache holding the index and filter blocks, and
+// the filter partition index, instead of the block cache. Those blocks
+// are then read on demand and kept in memory only as long as the cache
+// holds them; the blocks held by a reader without block cache are
+// released.
+//
+// It must be called before the reader is used.
+func (r *Reader) SetMetaCache(mcache *cache.NamespaceGetter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if mcache == nil || r.err != nil {
+		return
+	}
+	r.releaseMetaBlocks()
+	r.mcache = mcache
+}
+
+// PinMetaBlocks reads the index and filter blocks, or the filter partition
+// index, through the cache and keeps them in memory until the reader is
+// released. The cache still accounts for the pinned blocks. It does
+// nothing if the blocks are already held by the reader.
+//
+// It must be called before the reader is used.
+func (r *Reader) PinMetaBlocks() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	if r.indexBlock != nil {
+		return nil
+	}
+	indexBlock, rel, err := r.getIndexBlock(r.reader, true)
+	if err != nil {
+		return err
+	}
+	r.indexBlock = indexBlock
+	r.metaPins = append(r.metaPins, rel)
+	if r.filter != nil {
+		if r.filterPartitioned {
+			var filterIndex *filterIndex
+			if filterIndex, rel, err = r.getFilterIndex(r.reader, true); err == nil {
+				r.filterIndex = filterIndex
+			}
+		} else {
+			var filterBlock *filterBlock
+			if filterBlock, rel, err = r.getFilterBlock(r.reader, true); err == nil {
+				r.filterBlock = filterBlock
+			}
+		}
+		if err != nil {
+			if !errors.IsCorrupted(err) {
+				return err
+			}
+			// The filter is read on demand then.
+			return nil
+		}
+		r.metaPins = append(r.metaPins, rel)
+	}
+	return nil
+}
+
 // NewReader creates a new initialized table reader for the file.
 // The fi, cache and bpool is optional and can be nil.
 //
+// If o.MmapRead is true and f implements storage.MmapReader, the blocks
+// are read in place from the mapped file.
+//
 // The returned table reader instance is safe for concurrent use.
 func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.NamespaceGetter, bpool *util.BufferPool, o *opt.Options) (*Reader, error) {
 	if f == nil {
@@ -1038,6 +1791,16 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 		return r, nil
 	}
 
+	// Read blocks in place if the file can be mapped, otherwise fallback
+	// to ReadAt.
+	if o.GetMmapRead() {
+		if mr, ok := f.(storage.MmapReader); ok {
+			if data, err := mr.Mmap(); err == nil && int64(len(data)) >= size {
+				r.mmap = data[:size:size]
+			}
+		}
+	}
+
 	footerPos := size - footerLen
 	var footer [footerLen]byte
 	if _, err := r.reader.ReadAt(footer[:], footerPos); err != nil && err != io.EOF {
@@ -1047,6 +1810,15 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 		r.err = r.newErrCorrupted(footerPos, footerLen, "table-footer", "bad magic number")
 		return r, nil
 	}
+	if version := footer[footerLen-len(magic)-2]; version > formatVersion {
+		r.err = r.newErrCorrupted(footerPos, footerLen, "table-footer", fmt.Sprintf("unsupported format version %d", version))
+		return r, nil
+	}
+	r.checksum = util.Checksum(footer[footerLen-len(magic)-1])
+	if !r.checksum.Valid() {
+		r.err = r.newErrCorrupted(footerPos, footerLen, "table-footer", fmt.Sprintf("unknown checksum type %d", r.checksum))
+		return r, nil
+	}
 
 	var n int
 	// Decode the metaindex block handle.
@@ -1064,7 +1836,7 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 	}
 
 	// Read metaindex block.
-	metaBlock, err := r.readBlock(r.metaBH, true)
+	metaBlock, err := r.readBlock(r.metaBH, true, false)
 	if err != nil {
 		if errors.IsCorrupted(err) {
 			r.err = err
@@ -1076,41 +1848,113 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 	// Set data end.
 	r.dataEnd = int64(r.metaBH.offset)
 
+	getFilter := func(name string) filter.Filter {
+		if f0 := o.GetFilter(); f0 != nil && f0.Name() == name {
+			return f0
+		}
+		for _, f0 := range o.GetAltFilters() {
+			if f0.Name() == name {
+				return f0
+			}
+		}
+		return nil
+	}
+
 	// Read metaindex.
+	var (
+		tableFilter   filter.Filter
+		tableFilterBH blockHandle
+		propsBH       blockHandle
+	)
 	metaIter := r.newBlockIter(metaBlock, nil, nil, true)
 	for metaIter.Next() {
 		key := string(metaIter.Key())
-		if !strings.HasPrefix(key, "filter.") {
+		if key == "properties" {
+			if bh, n := decodeBlockHandle(metaIter.Value()); n > 0 {
+				propsBH = bh
+			}
 			continue
 		}
-		fn := key[7:]
-		if f0 := o.GetFilter(); f0 != nil && f0.Name() == fn {
-			r.filter = f0
-		} else {
-			for _, f0 := range o.GetAltFilters() {
-				if f0.Name() == fn {
-					r.filter = f0
-					break
+		if strings.HasPrefix(key, "prefix.") {
+			if p0 := o.GetPrefixer(); p0 != nil && p0.Name() == key[7:] {
+				r.prefixer = p0
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "tablefilter.") {
+			if filter := getFilter(key[12:]); filter != nil {
+				if bh, n := decodeBlockHandle(metaIter.Value()); n > 0 {
+					tableFilter, tableFilterBH = filter, bh
 				}
 			}
+			continue
 		}
-		if r.filter != nil {
-			filterBH, n := decodeBlockHandle(metaIter.Value())
+		var fn string
+		partitioned := false
+		switch {
+		case strings.HasPrefix(key, "filter."):
+			fn = key[7:]
+		case strings.HasPrefix(key, "partitionedfilter."):
+			fn, partitioned = key[18:], true
+		}
+		if r.filter != nil || fn == "" {
+			continue
+		}
+		if filter := getFilter(fn); filter != nil {
+			value := metaIter.Value()
+			filterBH, n := decodeBlockHandle(value)
 			if n == 0 {
 				continue
 			}
+			filterStart := filterBH.offset
+			if partitioned {
+				var m int
+				filterStart, m = binary.Uvarint(value[n:])
+				if m <= 0 {
+					continue
+				}
+			}
+			r.filter = filter
 			r.filterBH = filterBH
+			r.filterPartitioned = partitioned
+			r.filterStart = filterStart
 			// Update data end.
-			r.dataEnd = int64(filterBH.offset)
-			break
+			r.dataEnd = int64(filterStart)
 		}
 	}
 	metaIter.Release()
 	metaBlock.Release()
 
+	// Properties are informational only, corrupted properties are ignored.
+	if propsBH.length > 0 {
+		if err := r.readProperties(propsBH); err != nil && !errors.IsCorrupted(err) {
+			return nil, err
+		}
+		if offset := int64(propsBH.offset); offset < r.dataEnd {
+			r.dataEnd = offset
+		}
+	}
+
+	// The table filter is always kept in memory.
+	if tableFilter != nil {
+		data, bpool, err := r.readRawBlock(tableFilterBH, true, false)
+		if err == nil {
+			r.tableFilter = &TableFilter{
+				filter: tableFilter,
+				data:   append([]byte{}, data...),
+			}
+			bpool.Put(data)
+			if offset := int64(tableFilterBH.offset); offset < r.dataEnd {
+				r.dataEnd = offset
+			}
+		} else if !errors.IsCorrupted(err) {
+			return nil, err
+		}
+	}
+
 	// Cache index and filter block locally, since we don't have global cache.
 	if cache == nil {
-		r.indexBlock, err = r.readBlock(r.indexBH, true)
+		r.indexBlock, err = r.readBlock(r.indexBH, true, false)
 		if err != nil {
 			if errors.IsCorrupted(err) {
 				r.err = err
@@ -1119,7 +1963,12 @@ func NewReader(f io.ReaderAt, size int64, fd storage.FileDesc, cache *cache.Name
 			return nil, err
 		}
 		if r.filter != nil {
-			r.filterBlock, err = r.readFilterBlock(r.filterBH)
+			if r.filterPartitioned {
+				// Filter partitions are read on demand.
+				r.filterIndex, err = r.readFilterIndex(r.reader, r.filterBH)
+			} else {
+				r.filterBlock, err = r.readFilterBlock(r.reader, r.filterBH)
+			}
 			if err != nil {
 				if !errors.IsCorrupted(err) {
 					return nil, err
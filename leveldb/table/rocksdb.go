@@ -0,0 +1,702 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package table
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+
+	snappy "github.com/FactomProject/snappy-go"
+
+	"github.com/FactomProject/goleveldb/leveldb/comparer"
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/iterator"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+/*
+RocksDB block-based table format, as read by RocksDBReader:
+
+The layout of the blocks is the same as the table format above, the
+footer is extended to carry the checksum type and format version:
+
+    +-----------------+------------------------+--------------------+---------+
+    | checksum type   | metaindex block handle | index block handle | padding |
+    | (1-byte)        | (varints)              | (varints)          |         |
+    +-----------------+------------------------+--------------------+---------+
+    | format version (4-bytes) | magic (8-bytes)                              |
+    +--------------------------+----------------------------------------------+
+
+The footer is 53 bytes long. The checksum types are none (0), masked
+CRC-32C (1), xxHash (2), xxHash64 (3) and XXH3 (4). Format versions 2 and
+later prefix zlib, bzip2, lz4 and zstd compressed blocks with the varint
+decompressed length, 4 and later may delta encode the index block values,
+and 5 only changes the filter format.
+
+The metaindex block maps 'rocksdb.properties' to the properties block and
+'rocksdb.range_del' to the range deletion block, whose entries are keyed
+by the internal key of the range start and hold the range limit. The
+properties block maps property names to raw values, e.g. the comparator
+name and how the index block is encoded.
+*/
+
+const (
+	rocksdbFooterLen = 53
+	rocksdbMagic     = 0x88e241b785f4cff7
+
+	// Supported format versions.
+	rocksdbMinFormatVersion = 1
+	rocksdbMaxFormatVersion = 5
+
+	rocksdbChecksumNone     = 0
+	rocksdbChecksumCRC32C   = 1
+	rocksdbChecksumXXHash   = 2
+	rocksdbChecksumXXHash64 = 3
+
+	rocksdbBlockTypeZlib  = 2
+	rocksdbBlockTypeBZip2 = 3
+	rocksdbBlockTypeLZ4   = 4
+	rocksdbBlockTypeLZ4HC = 5
+	rocksdbBlockTypeZstd  = 7
+	// Written by RocksDB versions predating the final zstd format.
+	rocksdbBlockTypeZstdNotFinal = 0x40
+
+	// The index block types.
+	rocksdbIndexBinarySearch          = 0
+	rocksdbIndexHashSearch            = 1
+	rocksdbIndexTwoLevel              = 2
+	rocksdbIndexBinarySearchWithFirst = 3
+
+	// The data block may carry a hash index, flagged by the top bit of
+	// the restarts length.
+	rocksdbDataBlockHashIndexFlag = 1 << 31
+
+	rocksdbPropComparator     = "rocksdb.comparator"
+	rocksdbPropIndexType      = "rocksdb.block.based.table.index.type"
+	rocksdbPropIndexUserKey   = "rocksdb.index.key.is.user.key"
+	rocksdbPropIndexDeltaEnc  = "rocksdb.index.value.is.delta.encoded"
+	rocksdbMetaProperties     = "rocksdb.properties"
+	rocksdbMetaRangeDeletions = "rocksdb.range_del"
+)
+
+// RocksDB internal key types, see ParseRocksDBKey. Entries of other types,
+// e.g. blob indexes and wide-column entities, have no equivalent.
+const (
+	RocksDBTypeDeletion       byte = 0x0
+	RocksDBTypeValue          byte = 0x1
+	RocksDBTypeMerge          byte = 0x2
+	RocksDBTypeSingleDeletion byte = 0x7
+	RocksDBTypeRangeDeletion  byte = 0xf
+)
+
+// ParseRocksDBKey splits the given RocksDB internal key into its user key,
+// sequence number and key type.
+func ParseRocksDBKey(ikey []byte) (ukey []byte, seq uint64, kt byte, err error) {
+	if len(ikey) < 8 {
+		return nil, 0, 0, errors.New("leveldb/table: RocksDB internal key too short")
+	}
+	num := binary.LittleEndian.Uint64(ikey[len(ikey)-8:])
+	return ikey[:len(ikey)-8], num >> 8, byte(num), nil
+}
+
+// rocksdbComparer orders RocksDB internal keys; by user key, then by
+// decreasing sequence number and type. A key shorter than 8 bytes is
+// taken as a user key, ordered before all its internal keys.
+type rocksdbComparer struct {
+	ucmp comparer.Comparer
+}
+
+func (c rocksdbComparer) split(key []byte) ([]byte, uint64) {
+	if len(key) < 8 {
+		return key, 1<<64 - 1
+	}
+	return key[:len(key)-8], binary.LittleEndian.Uint64(key[len(key)-8:])
+}
+
+func (c rocksdbComparer) Compare(a, b []byte) int {
+	ua, na := c.split(a)
+	ub, nb := c.split(b)
+	if x := c.ucmp.Compare(ua, ub); x != 0 {
+		return x
+	}
+	switch {
+	case na > nb:
+		return -1
+	case na < nb:
+		return 1
+	}
+	return 0
+}
+
+// IsRocksDBTable returns whether the given file has the footer of a RocksDB
+// block-based table, see RocksDBReader.
+func IsRocksDBTable(f io.ReaderAt, size int64) bool {
+	if size < rocksdbFooterLen {
+		return false
+	}
+	var magic [8]byte
+	if _, err := f.ReadAt(magic[:], size-8); err != nil && err != io.EOF {
+		return false
+	}
+	return binary.LittleEndian.Uint64(magic[:]) == rocksdbMagic
+}
+
+// rocksdbBlock is a decoded block, an iterator.Array.
+type rocksdbBlock struct {
+	cmp          comparer.BasicComparer
+	keys, values [][]byte
+}
+
+func (b *rocksdbBlock) Len() int {
+	return len(b.keys)
+}
+
+func (b *rocksdbBlock) Search(key []byte) int {
+	return sort.Search(len(b.keys), func(i int) bool {
+		return b.cmp.Compare(b.keys[i], key) >= 0
+	})
+}
+
+func (b *rocksdbBlock) Index(i int) (key, value []byte) {
+	return b.keys[i], b.values[i]
+}
+
+// Returns the entries within the given slice, the limit is exclusive.
+func (b *rocksdbBlock) slice(slice *util.Range) *rocksdbBlock {
+	if slice == nil {
+		return b
+	}
+	start, limit := 0, len(b.keys)
+	if slice.Start != nil {
+		start = b.Search(slice.Start)
+	}
+	if slice.Limit != nil {
+		limit = b.Search(slice.Limit)
+	}
+	if start > limit {
+		start = limit
+	}
+	return &rocksdbBlock{b.cmp, b.keys[start:limit], b.values[start:limit]}
+}
+
+// rocksdbIndex is the flattened index of the data blocks, an
+// iterator.ArrayIndexer.
+type rocksdbIndex struct {
+	tr             *RocksDBReader
+	keys           [][]byte
+	bhs            []blockHandle
+	slice          *util.Range
+	verifyChecksum bool
+}
+
+func (i *rocksdbIndex) Len() int {
+	return len(i.keys)
+}
+
+func (i *rocksdbIndex) Search(key []byte) int {
+	return sort.Search(len(i.keys), func(n int) bool {
+		return i.tr.compareIndexKey(i.keys[n], key) >= 0
+	})
+}
+
+func (i *rocksdbIndex) Get(n int) iterator.Iterator {
+	b, err := i.tr.readDataBlock(i.bhs[n], i.verifyChecksum)
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	return iterator.NewArrayIterator(b.slice(i.slice))
+}
+
+// RocksDBReader is a reader of RocksDB block-based tables, of format
+// version 1 to 5, e.g. to migrate a RocksDB dataset. It yields the entries
+// keyed by RocksDB internal keys, see ParseRocksDBKey; merge operands,
+// blob indexes and other RocksDB specific entries are yielded as is.
+//
+// The filter blocks and the hash indexes are ignored. Blocks compressed
+// with lz4 and zstd are decompressed by the Options.Compressors, given
+// the raw lz4 block or zstd frame and a dst of the decompressed length.
+// Blocks compressed with XPRESS, and the XXH3 checksum are not supported.
+//
+// The index is loaded into memory when the reader is created.
+type RocksDBReader struct {
+	mu     sync.RWMutex
+	fd     storage.FileDesc
+	reader io.ReaderAt
+	o      *opt.Options
+	cmp    rocksdbComparer
+	err    error
+
+	verifyChecksum bool
+	formatVersion  uint32
+	checksum       byte
+	// The index encoding.
+	indexUserKey  bool
+	indexDeltaEnc bool
+	indexFirstKey bool
+
+	indexKeys  [][]byte
+	indexBHs   []blockHandle
+	rangeDelBH blockHandle
+	props      map[string][]byte
+}
+
+func (r *RocksDBReader) newErrCorrupted(pos, size int64, kind, reason string) error {
+	return errors.NewErrCorruptedAt(r.fd, pos, size, reason, &ErrCorrupted{Pos: pos, Size: size, Kind: kind, Reason: reason})
+}
+
+func (r *RocksDBReader) newErrCorruptedBH(bh blockHandle, kind, reason string) error {
+	return r.newErrCorrupted(int64(bh.offset), int64(bh.length), kind, reason)
+}
+
+func (r *RocksDBReader) compareIndexKey(ikey, key []byte) int {
+	if r.indexUserKey {
+		ukey, _ := r.cmp.split(key)
+		return r.cmp.ucmp.Compare(ikey, ukey)
+	}
+	return r.cmp.Compare(ikey, key)
+}
+
+// Returns the decompressed contents of the given block.
+func (r *RocksDBReader) readRawBlock(bh blockHandle, kind string, verifyChecksum bool) ([]byte, error) {
+	data := make([]byte, bh.length+blockTrailerLen)
+	if n, err := r.reader.ReadAt(data, int64(bh.offset)); n < len(data) {
+		if err == nil || err == io.EOF {
+			return nil, r.newErrCorruptedBH(bh, kind, "block out of range")
+		}
+		return nil, err
+	}
+
+	if verifyChecksum && r.checksum != rocksdbChecksumNone {
+		n := bh.length + 1
+		checksum0 := binary.LittleEndian.Uint32(data[n:])
+		var checksum1 uint32
+		switch r.checksum {
+		case rocksdbChecksumCRC32C:
+			checksum1 = util.NewCRC(data[:n]).Value()
+		case rocksdbChecksumXXHash:
+			checksum1 = util.XXHash32(data[:n])
+		case rocksdbChecksumXXHash64:
+			checksum1 = uint32(util.XXHash64(data[:n]))
+		}
+		if checksum0 != checksum1 {
+			return nil, r.newErrCorruptedBH(bh, kind, fmt.Sprintf("checksum mismatch, want=%#x got=%#x", checksum0, checksum1))
+		}
+	}
+
+	blockType, data := data[bh.length], data[:bh.length]
+	switch blockType {
+	case blockTypeNoCompression:
+		return data, nil
+	case blockTypeSnappyCompression:
+		decData, err := snappy.Decode(nil, data)
+		if err != nil {
+			return nil, r.newErrCorruptedBH(bh, kind, err.Error())
+		}
+		return decData, nil
+	}
+	if r.formatVersion < 2 {
+		return nil, fmt.Errorf("leveldb/table: RocksDB table: compression type %#x of format version %d not supported", blockType, r.formatVersion)
+	}
+	decLen, n := binary.Uvarint(data)
+	if n <= 0 || decLen > math.MaxUint32 {
+		return nil, r.newErrCorruptedBH(bh, kind, "bad decompressed length")
+	}
+	data = data[n:]
+	var (
+		decData []byte
+		err     error
+	)
+	switch blockType {
+	case rocksdbBlockTypeZlib, rocksdbBlockTypeBZip2:
+		var rd io.Reader
+		if blockType == rocksdbBlockTypeZlib {
+			// Raw deflate stream, without zlib header.
+			rd = flate.NewReader(bytes.NewReader(data))
+		} else {
+			rd = bzip2.NewReader(bytes.NewReader(data))
+		}
+		decData = make([]byte, decLen)
+		_, err = io.ReadFull(rd, decData)
+	case rocksdbBlockTypeLZ4, rocksdbBlockTypeLZ4HC, rocksdbBlockTypeZstd, rocksdbBlockTypeZstdNotFinal:
+		compression := opt.ZstdCompression
+		if blockType == rocksdbBlockTypeLZ4 || blockType == rocksdbBlockTypeLZ4HC {
+			compression = opt.LZ4Compression
+		}
+		c := r.o.GetCompressor(compression)
+		if c == nil {
+			return nil, fmt.Errorf("leveldb/table: no compressor for %v compression", compression)
+		}
+		decData, err = c.Decode(make([]byte, decLen), data)
+	default:
+		return nil, fmt.Errorf("leveldb/table: RocksDB table: compression type %#x not supported", blockType)
+	}
+	if err == nil && uint64(len(decData)) != decLen {
+		err = fmt.Errorf("decompressed length mismatch, want=%d got=%d", decLen, len(decData))
+	}
+	if err != nil {
+		return nil, r.newErrCorruptedBH(bh, kind, err.Error())
+	}
+	return decData, nil
+}
+
+// Decodes the entries of the given block. If handles is true the values
+// are block handles, which may be delta encoded; they are decoded and
+// returned instead of the values.
+func (r *RocksDBReader) decodeBlock(data []byte, bh blockHandle, kind string, handles bool) (keys, values [][]byte, bhs []blockHandle, err error) {
+	if len(data) < 4 {
+		return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "block too short")
+	}
+	restartsLen := binary.LittleEndian.Uint32(data[len(data)-4:])
+	end := len(data) - 4
+	if restartsLen&rocksdbDataBlockHashIndexFlag != 0 {
+		restartsLen &^= rocksdbDataBlockHashIndexFlag
+		if end < 2 {
+			return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "bad hash index")
+		}
+		end -= 2 + int(binary.LittleEndian.Uint16(data[end-2:]))
+	}
+	if end -= 4 * int(restartsLen); end < 0 {
+		return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "bad restarts length")
+	}
+
+	var (
+		key    []byte
+		prevBH blockHandle
+	)
+	for off := 0; off < end; {
+		shared, n0 := binary.Uvarint(data[off:end])
+		unshared, n1 := binary.Uvarint(data[off+max(n0, 0) : end])
+		if n0 <= 0 || n1 <= 0 {
+			return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "bad entry")
+		}
+		off += n0 + n1
+		var vlen uint64
+		if !handles || !r.indexDeltaEnc {
+			var n2 int
+			if vlen, n2 = binary.Uvarint(data[off:end]); n2 <= 0 {
+				return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "bad entry")
+			}
+			off += n2
+		}
+		if shared > uint64(len(key)) || unshared > uint64(end-off) {
+			return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "bad entry")
+		}
+		key = append(key[:shared:shared], data[off:off+int(unshared)]...)
+		off += int(unshared)
+		keys = append(keys, key)
+
+		if !handles {
+			if vlen > uint64(end-off) {
+				return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "bad entry")
+			}
+			values = append(values, data[off:off+int(vlen)])
+			off += int(vlen)
+			continue
+		}
+
+		value := data[off:end]
+		if !r.indexDeltaEnc {
+			if vlen > uint64(end-off) {
+				return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "bad entry")
+			}
+			value = data[off : off+int(vlen)]
+			off += int(vlen)
+		}
+		// Only the entries sharing a key prefix have their handle delta
+		// encoded, the offset follows the previous block.
+		var n int
+		if r.indexDeltaEnc && shared > 0 {
+			delta, m := binary.Varint(value)
+			prevBH = blockHandle{prevBH.offset + prevBH.length + blockTrailerLen, uint64(int64(prevBH.length) + delta)}
+			n = m
+		} else {
+			prevBH, n = decodeBlockHandle(value)
+		}
+		if n <= 0 {
+			return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "bad block handle")
+		}
+		if r.indexFirstKey {
+			firstKeyLen, m := binary.Uvarint(value[n:])
+			if m <= 0 || firstKeyLen > uint64(len(value)-n-m) {
+				return nil, nil, nil, r.newErrCorruptedBH(bh, kind, "bad first key")
+			}
+			n += m + int(firstKeyLen)
+		}
+		if r.indexDeltaEnc {
+			off += n
+		}
+		bhs = append(bhs, prevBH)
+	}
+	return
+}
+
+func (r *RocksDBReader) readDataBlock(bh blockHandle, verifyChecksum bool) (*rocksdbBlock, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	data, err := r.readRawBlock(bh, "data-block", verifyChecksum)
+	if err != nil {
+		return nil, err
+	}
+	keys, values, _, err := r.decodeBlock(data, bh, "data-block", false)
+	if err != nil {
+		return nil, err
+	}
+	return &rocksdbBlock{r.cmp, keys, values}, nil
+}
+
+// Reads the index blocks, flattening the partitioned index.
+func (r *RocksDBReader) readIndex(indexBH blockHandle, indexType uint32) error {
+	data, err := r.readRawBlock(indexBH, "index-block", true)
+	if err != nil {
+		return err
+	}
+	keys, _, bhs, err := r.decodeBlock(data, indexBH, "index-block", true)
+	if err != nil {
+		return err
+	}
+	if indexType != rocksdbIndexTwoLevel {
+		r.indexKeys, r.indexBHs = keys, bhs
+		return nil
+	}
+	for _, bh := range bhs {
+		data, err := r.readRawBlock(bh, "index-partition", true)
+		if err != nil {
+			return err
+		}
+		keys, _, bhs, err := r.decodeBlock(data, bh, "index-partition", true)
+		if err != nil {
+			return err
+		}
+		r.indexKeys = append(r.indexKeys, keys...)
+		r.indexBHs = append(r.indexBHs, bhs...)
+	}
+	return nil
+}
+
+// NewIterator creates an iterator over the table entries, keyed by RocksDB
+// internal keys. Range deletions are not included, see
+// NewRangeDelIterator.
+//
+// Slice allows slicing the iterator to only contains keys in the given
+// range. A nil Range.Start is treated as a key before all keys in the
+// table. And a nil Range.Limit is treated as a key after all keys in
+// the table.
+//
+// The returned iterator is not safe for concurrent use and should be released
+// after use.
+func (r *RocksDBReader) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Iterator {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return iterator.NewEmptyIterator(r.err)
+	}
+	index := &rocksdbIndex{
+		tr:             r,
+		keys:           r.indexKeys,
+		bhs:            r.indexBHs,
+		slice:          slice,
+		verifyChecksum: r.verifyChecksum || opt.GetStrict(r.o, ro, opt.StrictParanoidChecks),
+	}
+	if slice != nil {
+		start, limit := 0, len(index.keys)
+		if slice.Start != nil {
+			start = index.Search(slice.Start)
+		}
+		if slice.Limit != nil {
+			if n := index.Search(slice.Limit); n < limit {
+				limit = n + 1
+			}
+		}
+		if start > limit {
+			start = limit
+		}
+		index.keys, index.bhs = index.keys[start:limit], index.bhs[start:limit]
+	}
+	return iterator.NewIndexedIterator(iterator.NewArrayIndexer(index), opt.GetStrict(r.o, ro, opt.StrictReader))
+}
+
+// NewRangeDelIterator creates an iterator over the range deletions of the
+// table. The keys are the RocksDB internal keys of the range starts, the
+// values are the exclusive range limits.
+//
+// The returned iterator is not safe for concurrent use and should be released
+// after use.
+func (r *RocksDBReader) NewRangeDelIterator() iterator.Iterator {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.err != nil {
+		return iterator.NewEmptyIterator(r.err)
+	}
+	if r.rangeDelBH.length == 0 {
+		return iterator.NewEmptyIterator(nil)
+	}
+	data, err := r.readRawBlock(r.rangeDelBH, "range-deletion-block", true)
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	keys, values, _, err := r.decodeBlock(data, r.rangeDelBH, "range-deletion-block", false)
+	if err != nil {
+		return iterator.NewEmptyIterator(err)
+	}
+	return iterator.NewArrayIterator(&rocksdbBlock{r.cmp, keys, values})
+}
+
+// Property returns the raw value of the given table property, e.g.
+// 'rocksdb.num.entries'.
+func (r *RocksDBReader) Property(name string) (value []byte, ok bool) {
+	value, ok = r.props[name]
+	return
+}
+
+// FormatVersion returns the format version of the table.
+func (r *RocksDBReader) FormatVersion() int {
+	return int(r.formatVersion)
+}
+
+// Release implements util.Releaser.
+// It also close the file if it is an io.Closer.
+func (r *RocksDBReader) Release() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if closer, ok := r.reader.(io.Closer); ok {
+		closer.Close()
+	}
+	r.reader = nil
+	r.indexKeys = nil
+	r.indexBHs = nil
+	r.err = ErrReaderReleased
+}
+
+// NewRocksDBReader creates a new initialized RocksDB table reader for the
+// file.
+//
+// The table must be ordered by the Options.Comparer, which name must match
+// the comparator recorded by RocksDB, e.g. 'leveldb.BytewiseComparator'
+// for the default comparer.
+//
+// The returned table reader instance is safe for concurrent use.
+func NewRocksDBReader(f io.ReaderAt, size int64, fd storage.FileDesc, o *opt.Options) (*RocksDBReader, error) {
+	if f == nil {
+		return nil, errors.New("leveldb/table: nil file")
+	}
+
+	r := &RocksDBReader{
+		fd:             fd,
+		reader:         f,
+		o:              o,
+		cmp:            rocksdbComparer{o.GetComparer()},
+		verifyChecksum: o.GetStrict(opt.StrictBlockChecksum),
+	}
+
+	if size < rocksdbFooterLen {
+		return nil, r.newErrCorrupted(0, size, "table", "too small")
+	}
+	footerPos := size - rocksdbFooterLen
+	var footer [rocksdbFooterLen]byte
+	if _, err := r.reader.ReadAt(footer[:], footerPos); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint64(footer[rocksdbFooterLen-8:]) != rocksdbMagic {
+		return nil, r.newErrCorrupted(footerPos, rocksdbFooterLen, "table-footer", "bad magic number")
+	}
+	r.formatVersion = binary.LittleEndian.Uint32(footer[rocksdbFooterLen-12:])
+	if r.formatVersion < rocksdbMinFormatVersion || r.formatVersion > rocksdbMaxFormatVersion {
+		return nil, fmt.Errorf("leveldb/table: RocksDB table: format version %d not supported", r.formatVersion)
+	}
+	r.checksum = footer[0]
+	if r.checksum > rocksdbChecksumXXHash64 {
+		return nil, fmt.Errorf("leveldb/table: RocksDB table: checksum type %d not supported", r.checksum)
+	}
+	metaBH, n := decodeBlockHandle(footer[1:])
+	if n == 0 {
+		return nil, r.newErrCorrupted(footerPos, rocksdbFooterLen, "table-footer", "bad metaindex block handle")
+	}
+	indexBH, m := decodeBlockHandle(footer[1+n:])
+	if m == 0 {
+		return nil, r.newErrCorrupted(footerPos, rocksdbFooterLen, "table-footer", "bad index block handle")
+	}
+
+	// Read metaindex.
+	data, err := r.readRawBlock(metaBH, "meta-block", true)
+	if err != nil {
+		return nil, err
+	}
+	keys, values, _, err := r.decodeBlock(data, metaBH, "meta-block", false)
+	if err != nil {
+		return nil, err
+	}
+	var propsBH blockHandle
+	for i, key := range keys {
+		switch string(key) {
+		case rocksdbMetaProperties:
+			propsBH, n = decodeBlockHandle(values[i])
+		case rocksdbMetaRangeDeletions:
+			r.rangeDelBH, n = decodeBlockHandle(values[i])
+		default:
+			continue
+		}
+		if n == 0 {
+			return nil, r.newErrCorruptedBH(metaBH, "meta-block", fmt.Sprintf("bad %q block handle", key))
+		}
+	}
+
+	// Read properties, they are needed to decode the index.
+	r.props = make(map[string][]byte)
+	if propsBH.length > 0 {
+		data, err := r.readRawBlock(propsBH, "properties-block", true)
+		if err != nil {
+			return nil, err
+		}
+		keys, values, _, err := r.decodeBlock(data, propsBH, "properties-block", false)
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			r.props[string(key)] = values[i]
+		}
+	}
+	if name, ok := r.props[rocksdbPropComparator]; ok && string(name) != r.cmp.ucmp.Name() {
+		return nil, fmt.Errorf("leveldb/table: RocksDB table: comparator %q doesn't match %q", name, r.cmp.ucmp.Name())
+	}
+	propBool := func(name string) bool {
+		v, n := binary.Uvarint(r.props[name])
+		return n > 0 && v != 0
+	}
+	r.indexUserKey = propBool(rocksdbPropIndexUserKey)
+	r.indexDeltaEnc = propBool(rocksdbPropIndexDeltaEnc)
+	var indexType uint32
+	if v := r.props[rocksdbPropIndexType]; len(v) == 4 {
+		indexType = binary.LittleEndian.Uint32(v)
+	}
+	switch indexType {
+	case rocksdbIndexBinarySearch, rocksdbIndexHashSearch, rocksdbIndexTwoLevel:
+	case rocksdbIndexBinarySearchWithFirst:
+		r.indexFirstKey = true
+	default:
+		return nil, fmt.Errorf("leveldb/table: RocksDB table: index type %d not supported", indexType)
+	}
+	if err := r.readIndex(indexBH, indexType); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
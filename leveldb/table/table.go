@@ -39,18 +39,24 @@ Table block trailer:
     | compression type (1-byte) | checksum (4-byte) |
     +---------------------------+-------------------+
 
-    The checksum is a CRC-32 computed using Castagnoli's polynomial. Compression
-    type also included in the checksum.
+    The checksum is a masked CRC-32 computed using Castagnoli's polynomial, or
+    the lower 32-bits of the 64-bit xxHash, as given by the table footer.
+    Compression type also included in the checksum.
 
 Table footer:
 
-      +------------------- 40-bytes -------------------+
+      +------------------- 38-bytes -------------------+
      /                                                  \
-    +------------------------+--------------------+------+-----------------+
-    | metaindex block handle / index block handle / ---- | magic (8-bytes) |
-    +------------------------+--------------------+------+-----------------+
+    +------------------------+--------------------+------+-------------------------+------------------------+-----------------+
+    | metaindex block handle / index block handle / ---- | format version (1-byte) | checksum type (1-byte) | magic (8-bytes) |
+    +------------------------+--------------------+------+-------------------------+------------------------+-----------------+
 
     The magic are first 64-bit of SHA-1 sum of "http://code.google.com/p/leveldb/".
+    The format version is bumped by the format changes older readers can't
+    read, a reader rejects tables of a format version newer than it knows.
+    The checksum type is the algorithm of the block checksums, zero for CRC-32
+    and one for xxHash. The padding is zero, so are the format version and the
+    checksum type of tables written by older versions.
 
 NOTE: All fixed-length integer are little-endian.
 */
@@ -137,6 +143,52 @@ Filter block trailer:
     | data 1 offset |      ....     | data n offset | data-offsets offset (4-bytes) | base Lg (1-byte) |
     +-------------- +---------------+---------------+-------------------------------+------------------+
 
+Partitioned filter:
+
+The filter may instead be split into one or more filter partitions, each
+is a filter block covering data blocks starting at the partition start
+offset. Filter data offsets within a partition are relative to the
+partition start offset. The partitions are followed by a filter partition
+index, which is keyed "partitionedfilter.<name>" in the metaindex block
+instead of "filter.<name>". The metaindex value is the filter partition
+index block handle followed by the offset of the first partition (varint).
+
+Filter partition index data structure:
+
+    +-----------------+------------------+------------------+-----+
+    | start (8-bytes) | offset (8-bytes) | length (8-bytes) | ... |
+    +-----------------+------------------+------------------+-----+
+     \                \                                   /
+      \                +--- partition 1 block handle ---+
+       + partition 1 start offset
+
+    Partitions are sorted by start offset, the first start offset is zero.
+
+Table filter:
+
+The table may also have a table filter, which is a single filter data
+generated from all keys of the table. It is written after the filter
+block, and is keyed "tablefilter.<name>" in the metaindex block.
+
+Properties block:
+
+The properties block is a block of table properties sorted by property
+name, it is written after the table filter and is keyed "properties" in
+the metaindex block. Names prefixed with "leveldb." are reserved for the
+builtin properties, builtin properties unknown to the reader are ignored.
+Other names are user properties.
+
+    +------------------------+--------------------------------------------+
+    | name                   | value                                      |
+    +------------------------+--------------------------------------------+
+    | leveldb.creation.time  | unix time the table is written (varint)    |
+    | leveldb.data.size      | total size of the data blocks (varint)     |
+    | leveldb.max.key        | the largest key, absent if table is empty  |
+    | leveldb.min.key        | the smallest key, absent if table is empty |
+    | leveldb.num.entries    | number of entries (varint)                 |
+    | leveldb.raw.key.size   | total length of the keys (varint)          |
+    | leveldb.raw.value.size | total length of the values (varint)        |
+    +------------------------+--------------------------------------------+
 
 NOTE: All fixed-length integer are little-endian.
 */
@@ -147,14 +199,22 @@ const (
 
 	magic = "\x57\xfb\x80\x8b\x24\x75\x47\xdb"
 
+	// The format version written to the table footer, see the table
+	// footer format above.
+	formatVersion = 0
+
 	// The block type gives the per-block compression format.
 	// These constants are part of the file format and should not be changed.
+	// The block type of a user-defined compression is the compression
+	// itself, from 0x80 up, see opt.UserCompression.
 	blockTypeNoCompression     = 0
 	blockTypeSnappyCompression = 1
 
 	// Generate new filter every 2KB of data
 	filterBaseLg = 11
 	filterBase   = 1 << filterBaseLg
+
+	filterIndexEntryLen = 24
 )
 
 type blockHandle struct {
@@ -8,10 +8,23 @@ package table
 
 import (
 	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"github.com/FactomProject/goleveldb/leveldb/cache"
+	"github.com/FactomProject/goleveldb/leveldb/comparer"
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/filter"
 	"github.com/FactomProject/goleveldb/leveldb/iterator"
 	"github.com/FactomProject/goleveldb/leveldb/opt"
 	"github.com/FactomProject/goleveldb/leveldb/storage"
@@ -35,6 +48,45 @@ func (t tableWrapper) TestNewIterator(slice *util.Range) iterator.Iterator {
 	return t.Reader.NewIterator(slice, nil)
 }
 
+type mmapReader struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (mmapReader) Close() error            { return nil }
+func (r mmapReader) Mmap() ([]byte, error) { return r.data, nil }
+
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int64
+}
+
+func (r *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	atomic.AddInt64(&r.reads, 1)
+	return r.r.ReadAt(p, off)
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) Encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := flate.NewWriter(buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decode(dst, src []byte) ([]byte, error) {
+	return ioutil.ReadAll(flate.NewReader(bytes.NewReader(src)))
+}
+
 var _ = testutil.Defer(func() {
 	Describe("Table", func() {
 		Describe("approximate offset test", func() {
@@ -81,6 +133,882 @@ var _ = testutil.Defer(func() {
 			})
 		})
 
+		Describe("compressor test", func() {
+			var (
+				flateCompression = opt.UserCompression(1)
+				o                = &opt.Options{
+					Compression: flateCompression,
+					Compressors: map[opt.Compression]opt.Compressor{flateCompression: flateCompressor{}},
+				}
+				value = bytes.Repeat([]byte{'x'}, 1000)
+			)
+			build := func(o *opt.Options) (*bytes.Buffer, error) {
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 100; i++ {
+					if err := tw.Append([]byte(fmt.Sprintf("k%03d", i)), value); err != nil {
+						return nil, err
+					}
+				}
+				return buf, tw.Close()
+			}
+
+			It("Should read back compressed blocks", func() {
+				buf, err := build(o)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(buf.Len()).Should(BeNumerically("<", 100*len(value)/10))
+
+				// The block type is the user-defined compression, not one
+				// assigned by another implementation of the format.
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(buf.Bytes()[tr.indexBH.offset+tr.indexBH.length]).Should(Equal(byte(0x81)))
+				tr.Release()
+				tr, err = NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				iter := tr.NewIterator(nil, nil)
+				n := 0
+				for ; iter.Next(); n++ {
+					Expect(iter.Key()).Should(Equal([]byte(fmt.Sprintf("k%03d", n))))
+					Expect(iter.Value()).Should(Equal(value))
+				}
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				Expect(n).Should(Equal(100))
+				iter.Release()
+
+				// Reading requires the compressor as well.
+				_, err = NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, nil)
+				Expect(err).Should(HaveOccurred())
+			})
+
+			It("Should fail writing without compressor", func() {
+				_, err := build(&opt.Options{Compression: opt.UserCompression(2)})
+				Expect(err).Should(HaveOccurred())
+			})
+
+			It("Should fail writing zstd or lz4 blocks", func() {
+				for _, c := range []opt.Compression{opt.ZstdCompression, opt.LZ4Compression, opt.UserCompression(opt.MaxUserCompressionID + 1)} {
+					Expect(c.Writable()).Should(BeFalse())
+					_, err := build(&opt.Options{Compression: c})
+					Expect(err).Should(HaveOccurred())
+				}
+			})
+		})
+
+		Describe("checksum test", func() {
+			build := func(o *opt.Options) []byte {
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 100; i++ {
+					Expect(tw.Append([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%03d", i)))).ShouldNot(HaveOccurred())
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				return buf.Bytes()
+			}
+
+			It("Should detect the checksum algorithm from the footer", func() {
+				for _, c := range []opt.Checksum{opt.CRC32CChecksum, opt.XXHash64Checksum} {
+					data := build(&opt.Options{Checksum: c, BlockSize: 64})
+					Expect(data[len(data)-len(magic)-1]).Should(Equal(byte(c)))
+
+					tr, err := NewReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, nil, nil, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(tr.VerifyChecksums(nil)).ShouldNot(HaveOccurred())
+					value, err := tr.Get([]byte("k050"), nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(value).Should(Equal([]byte("v050")))
+					tr.Release()
+
+					// A corrupted block is detected.
+					data[0] ^= 0xff
+					tr, err = NewReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, nil, nil, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					_, err = tr.Get([]byte("k000"), nil)
+					Expect(errors.IsCorrupted(err)).Should(BeTrue())
+					tr.Release()
+				}
+			})
+
+			It("Should reject unknown checksum algorithm", func() {
+				data := build(nil)
+				data[len(data)-len(magic)-1] = 0xff
+				tr, err := NewReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, nil, nil, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = tr.Get([]byte("k000"), nil)
+				Expect(errors.IsCorrupted(err)).Should(BeTrue())
+			})
+		})
+
+		Describe("index block test", func() {
+			build := func(o *opt.Options) []byte {
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 1000; i++ {
+					Expect(tw.Append([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("v%04d", i)))).ShouldNot(HaveOccurred())
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				return buf.Bytes()
+			}
+			indexSize := func(data []byte) int {
+				tr, err := NewReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, nil, nil, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer tr.Release()
+				return int(tr.indexBH.length)
+			}
+
+			It("Should read index blocks written with any restart interval", func() {
+				for _, o := range []*opt.Options{
+					{BlockSize: 64},
+					{BlockSize: 64, IndexBlockRestartInterval: 8},
+					{BlockSize: 64, IndexBlockRestartInterval: 8, DisableIndexBlockDeltaEncoding: true},
+				} {
+					data := build(o)
+					tr, err := NewReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, nil, nil, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					for i := 0; i < 1000; i += 7 {
+						value, err := tr.Get([]byte(fmt.Sprintf("key%04d", i)), nil)
+						Expect(err).ShouldNot(HaveOccurred())
+						Expect(value).Should(Equal([]byte(fmt.Sprintf("v%04d", i))))
+					}
+					iter := tr.NewIterator(nil, nil)
+					Expect(iter.Seek([]byte("key0500a"))).Should(BeTrue())
+					Expect(iter.Key()).Should(Equal([]byte("key0501")))
+					iter.Release()
+					tr.Release()
+				}
+
+				// Delta encoding with sparse restart points shrinks the index.
+				size := indexSize(build(&opt.Options{BlockSize: 64}))
+				Expect(indexSize(build(&opt.Options{BlockSize: 64, IndexBlockRestartInterval: 8}))).Should(BeNumerically("<", size))
+			})
+
+			It("Should reject newer format version", func() {
+				data := build(nil)
+				Expect(data[len(data)-len(magic)-2]).Should(Equal(byte(formatVersion)))
+				data[len(data)-len(magic)-2] = formatVersion + 1
+				tr, err := NewReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, nil, nil, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				_, err = tr.Get([]byte("key0000"), nil)
+				Expect(errors.IsCorrupted(err)).Should(BeTrue())
+			})
+		})
+
+		Describe("ordered append test", func() {
+			It("Should write the same table as Append", func() {
+				var tables [2]bytes.Buffer
+				for i := range tables {
+					tw := NewWriter(&tables[i], &opt.Options{BlockSize: 64})
+					for j := 0; j < 100; j++ {
+						key, value := []byte(fmt.Sprintf("k%03d", j)), []byte(fmt.Sprintf("v%03d", j))
+						if i == 0 {
+							Expect(tw.Append(key, value)).ShouldNot(HaveOccurred())
+						} else {
+							Expect(tw.AppendOrdered(key, value)).ShouldNot(HaveOccurred())
+						}
+					}
+					Expect(tw.Close()).ShouldNot(HaveOccurred())
+				}
+				// The tables differ only by their creation time.
+				Expect(tables[1].Len()).Should(Equal(tables[0].Len()))
+
+				data := tables[1].Bytes()
+				tr, err := NewReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, nil, nil, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer tr.Release()
+				value, err := tr.Get([]byte("k042"), nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(value).Should(Equal([]byte("v042")))
+			})
+
+			It("Should only check the order with Append", func() {
+				tw := NewWriter(&bytes.Buffer{}, nil)
+				Expect(tw.Append([]byte("b"), nil)).ShouldNot(HaveOccurred())
+				Expect(tw.AppendOrdered([]byte("a"), nil)).ShouldNot(HaveOccurred())
+				Expect(tw.Append([]byte("a"), nil)).Should(HaveOccurred())
+			})
+		})
+
+		Describe("split test", func() {
+			It("Should split the output into tables", func() {
+				var tables []*bytes.Buffer
+				next := func() (io.Writer, error) {
+					buf := &bytes.Buffer{}
+					tables = append(tables, buf)
+					return buf, nil
+				}
+				f, _ := next()
+				// Uncompressed, so the table sizes follow the entries.
+				tw := NewWriter(f, &opt.Options{BlockSize: 256, Compression: opt.NoCompression})
+				tw.SetSplit(4096, next)
+				value := bytes.Repeat([]byte{'x'}, 100)
+				for i := 0; i < 1000; i++ {
+					Expect(tw.Append([]byte(fmt.Sprintf("k%04d", i)), value)).ShouldNot(HaveOccurred())
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				Expect(len(tables)).Should(BeNumerically(">", 10))
+
+				// The tables hold all entries, in order, without overlap.
+				n := 0
+				for _, buf := range tables {
+					Expect(buf.Len()).Should(BeNumerically("<", 2*4096))
+					tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					iter := tr.NewIterator(nil, nil)
+					for ; iter.Next(); n++ {
+						Expect(iter.Key()).Should(Equal([]byte(fmt.Sprintf("k%04d", n))))
+						Expect(iter.Value()).Should(Equal(value))
+					}
+					Expect(iter.Error()).ShouldNot(HaveOccurred())
+					iter.Release()
+					tr.Release()
+				}
+				Expect(n).Should(Equal(1000))
+			})
+
+			It("Should stop on split error", func() {
+				tw := NewWriter(&bytes.Buffer{}, &opt.Options{BlockSize: 256})
+				splitErr := errors.New("split error")
+				tw.SetSplit(1, func() (io.Writer, error) { return nil, splitErr })
+				value := bytes.Repeat([]byte{'x'}, 300)
+				Expect(tw.Append([]byte("k0"), value)).ShouldNot(HaveOccurred())
+				Expect(tw.Append([]byte("k1"), value)).Should(Equal(splitErr))
+				Expect(tw.Close()).Should(Equal(splitErr))
+			})
+		})
+
+		Describe("RocksDB table test", func() {
+			read := func(name string) []byte {
+				data, err := ioutil.ReadFile(filepath.Join("..", "testdata", "rocksdb", name))
+				Expect(err).ShouldNot(HaveOccurred())
+				return data
+			}
+			open := func(data []byte, o *opt.Options) *RocksDBReader {
+				Expect(IsRocksDBTable(bytes.NewReader(data), int64(len(data)))).Should(BeTrue())
+				tr, err := NewRocksDBReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				return tr
+			}
+			ukeys := func(iter iterator.Iterator) (keys []string) {
+				defer iter.Release()
+				var prev []byte
+				for iter.Next() {
+					ukey, _, _, err := ParseRocksDBKey(iter.Key())
+					Expect(err).ShouldNot(HaveOccurred())
+					if prev != nil {
+						Expect(rocksdbComparer{comparer.DefaultComparer}.Compare(prev, iter.Key())).Should(BeNumerically("<", 0))
+					}
+					prev = append(prev[:0], iter.Key()...)
+					keys = append(keys, string(ukey))
+				}
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				return
+			}
+
+			It("Should read all entries", func() {
+				for _, x := range []struct {
+					name          string
+					formatVersion int
+					n             int
+					first, last   string
+				}{
+					{"v2.sst", 2, 249, "key000", "key199"},
+					{"v3f.sst", 3, 50, "first00", "first49"},
+					{"v4p.sst", 4, 300, "part000", "part299"},
+					{"v5.sst", 5, 103, "key055", "key399"},
+					{"merge.sst", 2, 1, "merge", "merge"},
+				} {
+					tr := open(read(x.name), &opt.Options{Strict: opt.StrictBlockChecksum})
+					Expect(tr.FormatVersion()).Should(Equal(x.formatVersion))
+					keys := ukeys(tr.NewIterator(nil, nil))
+					Expect(keys).Should(HaveLen(x.n), x.name)
+					Expect(keys[0]).Should(Equal(x.first), x.name)
+					Expect(keys[len(keys)-1]).Should(Equal(x.last), x.name)
+					tr.Release()
+				}
+
+				tr := open(read("v4p.sst"), nil)
+				iter := tr.NewIterator(nil, nil)
+				for i := 0; iter.Next(); i++ {
+					ukey, seq, kt, _ := ParseRocksDBKey(iter.Key())
+					Expect(string(ukey)).Should(Equal(fmt.Sprintf("part%03d", i)))
+					Expect(seq).Should(BeZero())
+					Expect(kt).Should(Equal(RocksDBTypeValue))
+					Expect(string(iter.Value())).Should(Equal(fmt.Sprintf("p-%d", i)))
+				}
+				iter.Release()
+				tr.Release()
+			})
+
+			It("Should yield all versions of a key", func() {
+				tr := open(read("v2.sst"), nil)
+				defer tr.Release()
+				iter := tr.NewIterator(nil, nil)
+				defer iter.Release()
+				for _, x := range []struct {
+					seq   uint64
+					kt    byte
+					value string
+				}{
+					{2000, RocksDBTypeDeletion, ""},
+					{1000, RocksDBTypeValue, "v2-0"},
+					{10, RocksDBTypeValue, "old"},
+				} {
+					Expect(iter.Next()).Should(BeTrue())
+					ukey, seq, kt, err := ParseRocksDBKey(iter.Key())
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(ukey)).Should(Equal("key000"))
+					Expect(seq).Should(Equal(x.seq))
+					Expect(kt).Should(Equal(x.kt))
+					Expect(string(iter.Value())).Should(Equal(x.value))
+				}
+			})
+
+			It("Should seek and slice", func() {
+				tr := open(read("v2.sst"), nil)
+				iter := tr.NewIterator(nil, nil)
+				Expect(iter.Seek([]byte("key050"))).Should(BeTrue())
+				Expect(string(iter.Value())).Should(Equal("v2-50"))
+				Expect(iter.Seek([]byte("key0505"))).Should(BeTrue())
+				Expect(string(iter.Value())).Should(Equal("v2-51"))
+				Expect(iter.Seek([]byte("key2"))).Should(BeFalse())
+				Expect(iter.Last()).Should(BeTrue())
+				Expect(iter.Prev()).Should(BeTrue())
+				Expect(string(iter.Value())).Should(Equal("v2-198"))
+				iter.Release()
+				tr.Release()
+
+				for _, name := range []string{"v3f.sst", "v4p.sst", "v5.sst"} {
+					tr := open(read(name), nil)
+					all := ukeys(tr.NewIterator(nil, nil))
+					start, limit := all[len(all)/3], all[2*len(all)/3]
+					keys := ukeys(tr.NewIterator(&util.Range{Start: []byte(start), Limit: []byte(limit)}, nil))
+					Expect(keys).Should(Equal(all[len(all)/3:2*len(all)/3]), name)
+					tr.Release()
+				}
+			})
+
+			It("Should read range deletions", func() {
+				tr := open(read("v5.sst"), nil)
+				defer tr.Release()
+				iter := tr.NewRangeDelIterator()
+				defer iter.Release()
+				for _, x := range []struct {
+					start, limit string
+					seq          uint64
+				}{
+					{"key050", "key060", 50},
+					{"key190", "key195", 90},
+				} {
+					Expect(iter.Next()).Should(BeTrue())
+					ukey, seq, kt, err := ParseRocksDBKey(iter.Key())
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(ukey)).Should(Equal(x.start))
+					Expect(seq).Should(Equal(x.seq))
+					Expect(kt).Should(Equal(RocksDBTypeRangeDeletion))
+					Expect(string(iter.Value())).Should(Equal(x.limit))
+				}
+				Expect(iter.Next()).Should(BeFalse())
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+
+				tr2 := open(read("v2.sst"), nil)
+				defer tr2.Release()
+				Expect(ukeys(tr2.NewRangeDelIterator())).Should(BeEmpty())
+				v, ok := tr2.Property("rocksdb.comparator")
+				Expect(ok).Should(BeTrue())
+				Expect(string(v)).Should(Equal("leveldb.BytewiseComparator"))
+			})
+
+			It("Should detect corrupted data blocks", func() {
+				for _, name := range []string{"v2.sst", "v4p.sst", "v5.sst"} {
+					data := read(name)
+					data[10] ^= 0x80
+					tr := open(data, &opt.Options{Strict: opt.StrictAll})
+					iter := tr.NewIterator(nil, nil)
+					for iter.Next() {
+					}
+					Expect(errors.IsCorrupted(iter.Error())).Should(BeTrue(), name)
+					iter.Release()
+					tr.Release()
+				}
+			})
+
+			It("Should reject unsupported tables", func() {
+				data := read("v2.sst")
+				_, err := NewRocksDBReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, &opt.Options{Comparer: rocksdbTestComparer{comparer.DefaultComparer}})
+				Expect(err).Should(HaveOccurred())
+
+				// Unknown format version.
+				data[len(data)-12] = 6
+				_, err = NewRocksDBReader(bytes.NewReader(data), int64(len(data)), storage.FileDesc{}, nil)
+				Expect(err).Should(HaveOccurred())
+
+				// Not a RocksDB table.
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, nil)
+				Expect(tw.Append([]byte("k"), []byte("v"))).ShouldNot(HaveOccurred())
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				Expect(IsRocksDBTable(bytes.NewReader(buf.Bytes()), int64(buf.Len()))).Should(BeFalse())
+				_, err = NewRocksDBReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil)
+				Expect(errors.IsCorrupted(err)).Should(BeTrue())
+			})
+		})
+
+		Describe("prefix filter test", func() {
+			o := &opt.Options{
+				Filter:   filter.NewBloomFilter(10),
+				Prefixer: comparer.NewFixedPrefixer(3),
+			}
+			build := func(wo *opt.Options) *Reader {
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, wo)
+				for _, p := range []string{"aaa", "bbb", "ddd"} {
+					for i := 0; i < 10; i++ {
+						Expect(tw.Append([]byte(fmt.Sprintf("%s%03d", p, i)), []byte("v"))).ShouldNot(HaveOccurred())
+					}
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				return tr
+			}
+
+			It("Should rule out absent prefixes", func() {
+				tr := build(o)
+				Expect(tr.PrefixMayMatch([]byte("aaa"), nil)).Should(BeTrue())
+				Expect(tr.PrefixMayMatch([]byte("ddd"), nil)).Should(BeTrue())
+				Expect(tr.PrefixMayMatch([]byte("ccc"), nil)).Should(BeFalse())
+			})
+
+			It("Should not rule out tables written without prefixer", func() {
+				tr := build(&opt.Options{Filter: filter.NewBloomFilter(10)})
+				Expect(tr.PrefixMayMatch([]byte("ccc"), nil)).Should(BeTrue())
+			})
+		})
+
+		Describe("partitioned filter test", func() {
+			o := &opt.Options{
+				BlockSize:           512,
+				Filter:              filter.NewBloomFilter(10),
+				FilterPartitionSize: 256,
+				Prefixer:            comparer.NewFixedPrefixer(3),
+			}
+			build := func(bcache *cache.Cache) *Reader {
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 2000; i++ {
+					Expect(tw.Append([]byte(fmt.Sprintf("k%05d", i*2)), []byte(fmt.Sprintf("v%05d", i*2)))).ShouldNot(HaveOccurred())
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				var ns *cache.NamespaceGetter
+				if bcache != nil {
+					ns = &cache.NamespaceGetter{Cache: bcache, NS: 1}
+				}
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, ns, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(tr.filterPartitioned).Should(BeTrue())
+				return tr
+			}
+			check := func(tr *Reader) {
+				for i := 0; i < 2000; i++ {
+					key := fmt.Sprintf("k%05d", i*2)
+					rkey, value, err := tr.Find([]byte(key), true, nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(rkey)).Should(Equal(key))
+					Expect(string(value)).Should(Equal(fmt.Sprintf("v%05d", i*2)))
+				}
+				var fp int
+				for i := 0; i < 2000; i++ {
+					if _, _, err := tr.Find([]byte(fmt.Sprintf("k%05d", i*2+1)), true, nil); err != ErrNotFound {
+						fp++
+					}
+				}
+				Expect(fp).Should(BeNumerically("<", 100))
+				Expect(tr.PrefixMayMatch([]byte("k00"), nil)).Should(BeTrue())
+				Expect(tr.PrefixMayMatch([]byte("zzz"), nil)).Should(BeFalse())
+			}
+
+			It("Should split filter into partitions", func() {
+				tr := build(nil)
+				Expect(tr.filterIndex).ShouldNot(BeNil())
+				Expect(len(tr.filterIndex.data) / filterIndexEntryLen).Should(BeNumerically(">", 1))
+				check(tr)
+			})
+
+			It("Should read filter partitions through block cache", func() {
+				bcache := cache.NewCache(cache.NewLRU(opt.MiB))
+				tr := build(bcache)
+				Expect(tr.filterIndex).Should(BeNil())
+				check(tr)
+				tr.Release()
+			})
+		})
+
+		Describe("compressed block cache test", func() {
+			build := func(compression opt.Compression) (*countingReaderAt, *cache.Cache, *Reader) {
+				o := &opt.Options{
+					BlockSize:   512,
+					Compression: compression,
+				}
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 100; i++ {
+					Expect(tw.Append([]byte(fmt.Sprintf("k%03d", i)), bytes.Repeat([]byte{'v'}, 50))).ShouldNot(HaveOccurred())
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				f := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+				tr, err := NewReader(f, int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				ccache := cache.NewCache(cache.NewLRU(opt.MiB))
+				tr.SetCompressedCache(&cache.NamespaceGetter{Cache: ccache, NS: 1})
+				return f, ccache, tr
+			}
+			readAll := func(tr *Reader) {
+				iter := tr.NewIterator(nil, nil)
+				var n int
+				for iter.Next() {
+					Expect(string(iter.Key())).Should(Equal(fmt.Sprintf("k%03d", n)))
+					Expect(iter.Value()).Should(Equal(bytes.Repeat([]byte{'v'}, 50)))
+					n++
+				}
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				iter.Release()
+				Expect(n).Should(Equal(100))
+			}
+
+			It("Should serve compressed blocks from the cache", func() {
+				f, ccache, tr := build(opt.SnappyCompression)
+				readAll(tr)
+				Expect(ccache.Size()).Should(BeNumerically(">", 0))
+				reads := f.reads
+				readAll(tr)
+				Expect(f.reads).Should(Equal(reads))
+				tr.Release()
+			})
+
+			It("Should not cache uncompressed blocks", func() {
+				f, ccache, tr := build(opt.NoCompression)
+				readAll(tr)
+				Expect(ccache.Size()).Should(Equal(0))
+				reads := f.reads
+				readAll(tr)
+				Expect(f.reads).Should(BeNumerically(">", reads))
+				tr.Release()
+			})
+		})
+
+		Describe("readahead test", func() {
+			build := func() (*countingReaderAt, *Reader) {
+				o := &opt.Options{
+					BlockSize:   512,
+					Compression: opt.NoCompression,
+				}
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 1000; i++ {
+					Expect(tw.Append([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprintf("%050d", i)))).ShouldNot(HaveOccurred())
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				f := &countingReaderAt{r: bytes.NewReader(buf.Bytes())}
+				tr, err := NewReader(f, int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				return f, tr
+			}
+			readAll := func(f *countingReaderAt, tr *Reader, ro *opt.ReadOptions) int64 {
+				reads := f.reads
+				iter := tr.NewIterator(nil, ro)
+				var n int
+				for iter.Next() {
+					Expect(string(iter.Key())).Should(Equal(fmt.Sprintf("k%04d", n)))
+					Expect(string(iter.Value())).Should(Equal(fmt.Sprintf("%050d", n)))
+					n++
+				}
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				iter.Release()
+				Expect(n).Should(Equal(1000))
+				return f.reads - reads
+			}
+
+			It("Should read ahead of sequential reads", func() {
+				f, tr := build()
+				reads := readAll(f, tr, nil)
+				Expect(readAll(f, tr, &opt.ReadOptions{ReadaheadSize: 8 * opt.KiB})).Should(BeNumerically("<", reads/4))
+				tr.Release()
+			})
+
+			It("Should read correctly with small window", func() {
+				f, tr := build()
+				readAll(f, tr, &opt.ReadOptions{ReadaheadSize: 100})
+				tr.Release()
+			})
+
+			It("Should seek correctly", func() {
+				_, tr := build()
+				iter := tr.NewIterator(nil, &opt.ReadOptions{ReadaheadSize: 4 * opt.KiB})
+				for _, i := range []int{500, 10, 990, 300, 301, 0} {
+					Expect(iter.Seek([]byte(fmt.Sprintf("k%04d", i)))).Should(BeTrue())
+					for j := i; j < i+30 && j < 1000; j++ {
+						Expect(string(iter.Value())).Should(Equal(fmt.Sprintf("%050d", j)))
+						iter.Next()
+					}
+				}
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				iter.Release()
+				tr.Release()
+			})
+		})
+
+		Describe("table filter test", func() {
+			build := func(tableFilter bool) *Reader {
+				o := &opt.Options{
+					BlockSize:   512,
+					Filter:      filter.NewBloomFilter(10),
+					TableFilter: tableFilter,
+				}
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 1000; i++ {
+					Expect(tw.Append([]byte(fmt.Sprintf("k%05d", i*2)), []byte(fmt.Sprintf("v%05d", i*2)))).ShouldNot(HaveOccurred())
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				return tr
+			}
+
+			It("Should rule out absent keys", func() {
+				tr := build(true)
+				tf := tr.TableFilter()
+				Expect(tf).ShouldNot(BeNil())
+				tr.Release()
+
+				// The table filter remains valid after the reader is released.
+				var fp int
+				for i := 0; i < 1000; i++ {
+					Expect(tf.Contains([]byte(fmt.Sprintf("k%05d", i*2)))).Should(BeTrue())
+					if tf.Contains([]byte(fmt.Sprintf("k%05d", i*2+1))) {
+						fp++
+					}
+				}
+				Expect(fp).Should(BeNumerically("<", 50))
+			})
+
+			It("Should not affect reading the table", func() {
+				tr := build(true)
+				for i := 0; i < 1000; i++ {
+					key := fmt.Sprintf("k%05d", i*2)
+					value, err := tr.Get([]byte(key), nil)
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(value)).Should(Equal(fmt.Sprintf("v%05d", i*2)))
+				}
+				offset, err := tr.OffsetOf([]byte("zzz"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(offset).Should(Equal(int64(tr.filterBH.offset)))
+				tr.Release()
+			})
+
+			It("Should only be written if enabled", func() {
+				tr := build(false)
+				Expect(tr.TableFilter()).Should(BeNil())
+				tr.Release()
+			})
+		})
+
+		Describe("properties test", func() {
+			It("Should record the table properties", func() {
+				o := &opt.Options{
+					BlockSize:   512,
+					Compression: opt.NoCompression,
+					TablePropertiesCollectors: []func() opt.TablePropertiesCollector{
+						func() opt.TablePropertiesCollector { return &testPropertiesCollector{} },
+					},
+				}
+				start := time.Now().Unix()
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 1000; i++ {
+					Expect(tw.Append([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte{'v'}, 100))).ShouldNot(HaveOccurred())
+				}
+				tw.SetKeyStats(10, 20)
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer tr.Release()
+
+				props := tr.Properties()
+				Expect(props).ShouldNot(BeNil())
+				Expect(props.NumEntries).Should(Equal(int64(1000)))
+				Expect(props.NumDeletions).Should(Equal(int64(10)))
+				Expect(props.NumOverwrites).Should(Equal(int64(20)))
+				Expect(props.RawKeySize).Should(Equal(int64(6 * 1000)))
+				Expect(props.RawValueSize).Should(Equal(int64(100 * 1000)))
+				Expect(props.DataSize).Should(BeNumerically(">", props.RawKeySize+props.RawValueSize))
+				Expect(props.CompressionRatio()).Should(BeNumerically("~", 0.95, 0.05))
+				Expect(string(props.MinKey)).Should(Equal("k00000"))
+				Expect(string(props.MaxKey)).Should(Equal("k00999"))
+				Expect(props.CreationTime.Unix()).Should(BeNumerically(">=", start))
+				Expect(props.CreationTime.Unix()).Should(BeNumerically("<=", time.Now().Unix()))
+				Expect(props.User).Should(Equal(map[string][]byte{
+					"test.count": []byte("1000"),
+					"test.last":  []byte("k00999"),
+				}))
+
+				n, ok := tr.NumEntries()
+				Expect(ok).Should(BeTrue())
+				Expect(n).Should(Equal(int64(1000)))
+
+				// The properties block is not part of the data.
+				offset, err := tr.OffsetOf([]byte("zzz"))
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(offset).Should(Equal(props.DataSize))
+			})
+
+			It("Should record properties of empty table", func() {
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, nil)
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				tr, err := NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), storage.FileDesc{}, nil, nil, nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer tr.Release()
+
+				props := tr.Properties()
+				Expect(props).ShouldNot(BeNil())
+				Expect(props.NumEntries).Should(BeZero())
+				Expect(props.MinKey).Should(BeNil())
+				Expect(props.MaxKey).Should(BeNil())
+				Expect(props.User).Should(BeNil())
+			})
+		})
+
+		Describe("file test", func() {
+			ikey := func(ukey string, seq uint64, kt KeyType) []byte {
+				b := make([]byte, len(ukey)+8)
+				copy(b, ukey)
+				binary.LittleEndian.PutUint64(b[len(ukey):], seq<<8|uint64(kt))
+				return b
+			}
+
+			It("Should open and scan a table file", func() {
+				dir, err := ioutil.TempDir("", "goleveldb-table")
+				Expect(err).ShouldNot(HaveOccurred())
+				defer os.RemoveAll(dir)
+
+				o := &opt.Options{
+					BlockSize: 512,
+					Filter:    filter.NewBloomFilter(10),
+				}
+				path := filepath.Join(dir, "000123.ldb")
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 100; i++ {
+					kt := KeyTypeVal
+					if i%10 == 0 {
+						kt = KeyTypeDel
+					}
+					Expect(tw.Append(ikey(fmt.Sprintf("k%03d", i), uint64(1000-i), kt), []byte("v"))).ShouldNot(HaveOccurred())
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				Expect(ioutil.WriteFile(path, buf.Bytes(), 0644)).ShouldNot(HaveOccurred())
+
+				f, err := OpenFile(path, o)
+				Expect(err).ShouldNot(HaveOccurred())
+				defer f.Close()
+
+				Expect(f.fd.Num).Should(Equal(int64(123)))
+				info, err := f.Info()
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(info.Size).Should(Equal(int64(buf.Len())))
+				Expect(info.DataBlocks).Should(Equal(tw.BlocksLen()))
+				Expect(info.MetaIndex).Should(Equal([]string{"filter.leveldb.BuiltinBloomFilter", "properties"}))
+				Expect(info.Properties.NumEntries).Should(Equal(int64(100)))
+
+				iter := f.NewIterator(nil, nil)
+				var i int
+				for ; iter.Next(); i++ {
+					ik, err := ParseInternalKey(iter.Key())
+					Expect(err).ShouldNot(HaveOccurred())
+					Expect(string(ik.UserKey)).Should(Equal(fmt.Sprintf("k%03d", i)))
+					Expect(ik.Seq).Should(Equal(uint64(1000 - i)))
+					if i%10 == 0 {
+						Expect(ik.Type).Should(Equal(KeyTypeDel))
+					} else {
+						Expect(ik.Type).Should(Equal(KeyTypeVal))
+					}
+				}
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				iter.Release()
+				Expect(i).Should(Equal(100))
+			})
+
+			It("Should reject invalid internal keys", func() {
+				_, err := ParseInternalKey([]byte("short"))
+				Expect(err).Should(HaveOccurred())
+				_, err = ParseInternalKey(ikey("k", 1, KeyType(9)))
+				Expect(err).Should(HaveOccurred())
+			})
+		})
+
+		Describe("mmap read test", func() {
+			build := func(compression opt.Compression) ([]byte, *cache.Cache, *Reader) {
+				o := &opt.Options{
+					BlockSize:   512,
+					Compression: compression,
+					MmapRead:    true,
+				}
+				buf := &bytes.Buffer{}
+				tw := NewWriter(buf, o)
+				for i := 0; i < 100; i++ {
+					Expect(tw.Append([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprintf("v%03d", i)))).ShouldNot(HaveOccurred())
+				}
+				Expect(tw.Close()).ShouldNot(HaveOccurred())
+				data := buf.Bytes()
+				bcache := cache.NewCache(cache.NewLRU(opt.MiB))
+				tr, err := NewReader(mmapReader{bytes.NewReader(data), data}, int64(len(data)), storage.FileDesc{}, &cache.NamespaceGetter{Cache: bcache, NS: 1}, util.NewBufferPool(o.GetBlockSize()+5), o)
+				Expect(err).ShouldNot(HaveOccurred())
+				return data, bcache, tr
+			}
+			check := func(tr *Reader) {
+				iter := tr.NewIterator(nil, nil)
+				n := 0
+				for ; iter.Next(); n++ {
+					Expect(string(iter.Key())).Should(Equal(fmt.Sprintf("k%03d", n)))
+					Expect(string(iter.Value())).Should(Equal(fmt.Sprintf("v%03d", n)))
+				}
+				Expect(iter.Error()).ShouldNot(HaveOccurred())
+				iter.Release()
+				Expect(n).Should(Equal(100))
+
+				// Returned value is a copy.
+				value, err := tr.Get([]byte("k050"), nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(value)).Should(Equal("v050"))
+				value[0] = 'x'
+				value, err = tr.Get([]byte("k050"), nil)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(string(value)).Should(Equal("v050"))
+			}
+
+			It("Should read uncompressed blocks in place", func() {
+				data, bcache, tr := build(opt.NoCompression)
+				check(tr)
+				b, err := tr.readBlock(tr.indexBH, true, false)
+				Expect(err).ShouldNot(HaveOccurred())
+				Expect(b.bpool).Should(BeNil())
+				Expect(&b.data[0]).Should(BeIdenticalTo(&data[tr.indexBH.offset]))
+				b.Release()
+
+				// Cached blocks are evicted before the file is unmapped.
+				Expect(bcache.Nodes()).ShouldNot(BeZero())
+				tr.Release()
+				Expect(bcache.Nodes()).Should(BeZero())
+			})
+
+			It("Should read compressed blocks", func() {
+				_, _, tr := build(opt.SnappyCompression)
+				check(tr)
+				tr.Release()
+			})
+		})
+
 		Describe("read test", func() {
 			Build := func(kv testutil.KeyValue) testutil.DB {
 				o := &opt.Options{
@@ -113,7 +1041,7 @@ var _ = testutil.Defer(func() {
 			testutil.AllKeyValueTesting(nil, Build, nil, nil)
 			Describe("with one key per block", Test(testutil.KeyValue_Generate(nil, 9, 1, 1, 10, 512, 512), func(r *Reader) {
 				It("should have correct blocks number", func() {
-					indexBlock, err := r.readBlock(r.indexBH, true)
+					indexBlock, err := r.readBlock(r.indexBH, true, false)
 					Expect(err).To(BeNil())
 					Expect(indexBlock.restartsLen).Should(Equal(9))
 				})
@@ -121,3 +1049,29 @@ var _ = testutil.Defer(func() {
 		})
 	})
 })
+
+type testPropertiesCollector struct {
+	count int
+	last  []byte
+}
+
+func (c *testPropertiesCollector) Add(key, value []byte) {
+	c.count++
+	c.last = append(c.last[:0], key...)
+}
+
+func (c *testPropertiesCollector) Finish() map[string][]byte {
+	return map[string][]byte{
+		"test.count":   []byte(fmt.Sprint(c.count)),
+		"test.last":    c.last,
+		"leveldb.test": []byte("reserved"),
+	}
+}
+
+type rocksdbTestComparer struct {
+	comparer.Comparer
+}
+
+func (rocksdbTestComparer) Name() string {
+	return "rocksdb.ReverseBytewiseComparator"
+}
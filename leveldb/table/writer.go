@@ -7,10 +7,12 @@
 package table
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	snappy "github.com/FactomProject/snappy-go"
 
@@ -33,6 +35,7 @@ func sharedPrefixLen(a, b []byte) int {
 
 type blockWriter struct {
 	restartInterval int
+	noDelta         bool // Whether keys are written whole.
 	buf             util.Buffer
 	nEntries        int
 	prevKey         []byte
@@ -44,7 +47,7 @@ func (w *blockWriter) append(key, value []byte) {
 	nShared := 0
 	if w.nEntries%w.restartInterval == 0 {
 		w.restarts = append(w.restarts, uint32(w.buf.Len()))
-	} else {
+	} else if !w.noDelta {
 		nShared = sharedPrefixLen(w.prevKey, key)
 	}
 	n := binary.PutUvarint(w.scratch[0:], uint64(nShared))
@@ -84,11 +87,24 @@ func (w *blockWriter) bytesLen() int {
 	return w.buf.Len() + 4*restartsLen + 4
 }
 
+type filterPartition struct {
+	start uint64
+	data  []byte
+}
+
 type filterWriter struct {
 	generator filter.FilterGenerator
 	buf       util.Buffer
 	nKeys     int
 	offsets   []uint32
+	// Last prefix added to the current filter.
+	prefix    []byte
+	hasPrefix bool
+	// Partitioning, the current partition covers data blocks starting
+	// at base offset.
+	partitionSize int
+	base          uint64
+	partitions    []filterPartition
 }
 
 func (w *filterWriter) add(key []byte) {
@@ -99,13 +115,40 @@ func (w *filterWriter) add(key []byte) {
 	w.nKeys++
 }
 
+func (w *filterWriter) addPrefix(prefix []byte) {
+	if w.generator == nil || (w.hasPrefix && bytes.Equal(w.prefix, prefix)) {
+		return
+	}
+	w.add(prefix)
+	w.prefix = append(w.prefix[:0], prefix...)
+	w.hasPrefix = true
+}
+
 func (w *filterWriter) flush(offset uint64) {
 	if w.generator == nil {
 		return
 	}
-	for x := int(offset / filterBase); x > len(w.offsets); {
+	for x := int((offset - w.base) / filterBase); x > len(w.offsets); {
 		w.generate()
 	}
+	if w.partitionSize > 0 && w.buf.Len() >= w.partitionSize {
+		w.cut(offset)
+	}
+}
+
+// Finishes the current filter partition, the next partition starts at
+// the given data offset.
+func (w *filterWriter) cut(offset uint64) {
+	w.finish()
+	w.partitions = append(w.partitions, filterPartition{
+		start: w.base,
+		data:  w.buf.Bytes(),
+	})
+	// Don't reuse the buffer, filter generator may expect allocated
+	// filter data to be zeroed.
+	w.buf = util.Buffer{}
+	w.offsets = w.offsets[:0]
+	w.base = offset
 }
 
 func (w *filterWriter) finish() {
@@ -133,24 +176,35 @@ func (w *filterWriter) generate() {
 		w.generator.Generate(&w.buf)
 		w.nKeys = 0
 	}
+	w.hasPrefix = false
 }
 
 // Writer is a table writer.
 type Writer struct {
 	writer io.Writer
 	err    error
+	o      *opt.Options
+	// Splitting, see SetSplit.
+	splitSize int
+	split     func() (io.Writer, error)
 	// Options
 	cmp         comparer.Comparer
 	filter      filter.Filter
+	prefixer    comparer.Prefixer
 	compression opt.Compression
+	compressor  opt.Compressor
+	checksum    util.Checksum
 	blockSize   int
 
 	dataBlock   blockWriter
 	indexBlock  blockWriter
 	filterBlock filterWriter
+	tableFilter filter.FilterGenerator
+	collectors  []opt.TablePropertiesCollector
 	pendingBH   blockHandle
 	offset      uint64
 	nEntries    int
+	props       Properties
 	// Scratch allocated enough for 5 uvarint. Block writer should not use
 	// first 20-bytes since it will be used to encode block handle, which
 	// then passed to the block writer itself.
@@ -162,7 +216,8 @@ type Writer struct {
 func (w *Writer) writeBlock(buf *util.Buffer, compression opt.Compression) (bh blockHandle, err error) {
 	// Compress the buffer if necessary.
 	var b []byte
-	if compression == opt.SnappyCompression {
+	switch {
+	case compression == opt.SnappyCompression:
 		// Allocate scratch enough for compression and block trailer.
 		if n := snappy.MaxEncodedLen(buf.Len()) + blockTrailerLen; len(w.compressionScratch) < n {
 			w.compressionScratch = make([]byte, n)
@@ -171,7 +226,17 @@ func (w *Writer) writeBlock(buf *util.Buffer, compression opt.Compression) (bh b
 		n := len(compressed)
 		b = compressed[:n+blockTrailerLen]
 		b[n] = blockTypeSnappyCompression
-	} else {
+	case compression.IsUser():
+		// The block type is the compression.
+		compressed, err := w.compressor.Encode(w.compressionScratch[:0], buf.Bytes())
+		if err != nil {
+			return bh, err
+		}
+		n := len(compressed)
+		b = append(compressed, make([]byte, blockTrailerLen)...)
+		b[n] = byte(compression)
+		w.compressionScratch = b
+	default:
 		tmp := buf.Alloc(blockTrailerLen)
 		tmp[0] = blockTypeNoCompression
 		b = buf.Bytes()
@@ -179,7 +244,7 @@ func (w *Writer) writeBlock(buf *util.Buffer, compression opt.Compression) (bh b
 
 	// Calculate the checksum.
 	n := len(b) - 4
-	checksum := util.NewCRC(b[:n]).Value()
+	checksum := w.checksum.Sum(b[:n])
 	binary.LittleEndian.PutUint32(b[n:], checksum)
 
 	// Write the buffer to the file.
@@ -242,12 +307,47 @@ func (w *Writer) Append(key, value []byte) error {
 		w.err = fmt.Errorf("leveldb/table: Writer: keys are not in increasing order: %q, %q", w.dataBlock.prevKey, key)
 		return w.err
 	}
+	return w.AppendOrdered(key, value)
+}
+
+// AppendOrdered is like Append but doesn't compare the key with the
+// previous one, for callers which already guarantee the keys are in
+// increasing order, e.g. merging the entries of sorted tables. Appending
+// keys out of order results in a table whose entries can't be found.
+//
+// It is safe to modify the contents of the arguments after AppendOrdered
+// returns.
+func (w *Writer) AppendOrdered(key, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.split != nil && w.nEntries > 0 && w.BytesLen() >= w.splitSize {
+		if err := w.splitTable(); err != nil {
+			return err
+		}
+	}
 
 	w.flushPendingBH(key)
+	if w.nEntries == 0 {
+		w.props.MinKey = append([]byte{}, key...)
+	}
+	w.props.RawKeySize += int64(len(key))
+	w.props.RawValueSize += int64(len(value))
+	for _, c := range w.collectors {
+		c.Add(key, value)
+	}
 	// Append key/value pair to the data block.
 	w.dataBlock.append(key, value)
 	// Add key to the filter block.
 	w.filterBlock.add(key)
+	if w.tableFilter != nil {
+		w.tableFilter.Add(key)
+	}
+	if w.prefixer != nil {
+		if prefix := w.prefixer.Prefix(key); prefix != nil {
+			w.filterBlock.addPrefix(prefix)
+		}
+	}
 
 	// Finish the data block if block size target reached.
 	if w.dataBlock.bytesLen() >= w.blockSize {
@@ -260,6 +360,61 @@ func (w *Writer) Append(key, value []byte) error {
 	return nil
 }
 
+// Writes the filter partitions followed by the filter partition index,
+// returns the filter partition index block handle.
+func (w *Writer) writeFilterPartitions() (blockHandle, error) {
+	w.filterBlock.cut(0)
+	var index, buf util.Buffer
+	for _, p := range w.filterBlock.partitions {
+		buf.Reset()
+		buf.Write(p.data)
+		bh, err := w.writeBlock(&buf, opt.NoCompression)
+		if err != nil {
+			return blockHandle{}, err
+		}
+		x := index.Alloc(filterIndexEntryLen)
+		binary.LittleEndian.PutUint64(x, p.start)
+		binary.LittleEndian.PutUint64(x[8:], bh.offset)
+		binary.LittleEndian.PutUint64(x[16:], bh.length)
+	}
+	w.filterBlock.partitions = nil
+	return w.writeBlock(&index, opt.NoCompression)
+}
+
+// SetSplit makes the writer split its output into tables of about the
+// given size. Once the size of the table being written reaches the given
+// size, the table is finished before the next key is appended, then split
+// is called to get the io.Writer of the next table, which is written the
+// same way. Once split is called the io.Writer of the finished table isn't
+// used anymore, e.g. its file may be closed. The tables are split at data
+// block boundaries, so the last table written is finished by Close.
+//
+// The tables don't overlap if the keys are unique, it is up to the caller
+// to keep entries which must not be split apart, e.g. the entries of the
+// same user key, in the same table.
+//
+// It must be called before the first Append.
+func (w *Writer) SetSplit(size int, split func() (io.Writer, error)) {
+	w.splitSize = size
+	w.split = split
+}
+
+// Finishes the table and continues with the next table.
+func (w *Writer) splitTable() error {
+	if err := w.Close(); err != nil {
+		return err
+	}
+	f, err := w.split()
+	if err != nil {
+		w.err = err
+		return err
+	}
+	splitSize, split := w.splitSize, w.split
+	w.init(f, w.o)
+	w.splitSize, w.split = splitSize, split
+	return nil
+}
+
 // BlocksLen returns number of blocks written so far.
 func (w *Writer) BlocksLen() int {
 	n := w.indexBlock.nEntries
@@ -275,7 +430,16 @@ func (w *Writer) EntriesLen() int {
 	return w.nEntries
 }
 
-// BytesLen returns number of bytes written so far.
+// SetKeyStats sets the number of deletion markers and of overwritten
+// entries recorded in the table properties, as the writer doesn't know
+// the format of the keys. It must be called before Close.
+func (w *Writer) SetKeyStats(deletions, overwrites int64) {
+	w.props.NumDeletions = deletions
+	w.props.NumOverwrites = overwrites
+}
+
+// BytesLen returns number of bytes written so far. If the output is
+// split, see SetSplit, it is the size of the table being written.
 func (w *Writer) BytesLen() int {
 	return int(w.offset)
 }
@@ -288,6 +452,10 @@ func (w *Writer) Close() error {
 		return w.err
 	}
 
+	if w.nEntries > 0 {
+		w.props.MaxKey = append([]byte{}, w.dataBlock.prevKey...)
+	}
+
 	// Write the last data block. Or empty data block if there
 	// aren't any data blocks at all.
 	if w.dataBlock.nEntries > 0 || w.nEntries == 0 {
@@ -297,21 +465,82 @@ func (w *Writer) Close() error {
 		}
 	}
 	w.flushPendingBH(nil)
+	w.props.DataSize = int64(w.offset)
 
 	// Write the filter block.
 	var filterBH blockHandle
-	w.filterBlock.finish()
-	if buf := &w.filterBlock.buf; buf.Len() > 0 {
-		filterBH, w.err = w.writeBlock(buf, opt.NoCompression)
+	var filterStart uint64
+	if w.filterBlock.generator != nil && w.filterBlock.partitionSize > 0 {
+		filterStart = w.offset
+		filterBH, w.err = w.writeFilterPartitions()
 		if w.err != nil {
 			return w.err
 		}
+	} else {
+		w.filterBlock.finish()
+		if buf := &w.filterBlock.buf; buf.Len() > 0 {
+			filterBH, w.err = w.writeBlock(buf, opt.NoCompression)
+			if w.err != nil {
+				return w.err
+			}
+		}
+	}
+
+	// Write the table filter.
+	var tableFilterBH blockHandle
+	if w.tableFilter != nil {
+		buf := &util.Buffer{}
+		w.tableFilter.Generate(buf)
+		if buf.Len() > 0 {
+			tableFilterBH, w.err = w.writeBlock(buf, opt.NoCompression)
+			if w.err != nil {
+				return w.err
+			}
+		}
+	}
+
+	// Write the properties block.
+	w.props.NumEntries = int64(w.nEntries)
+	w.props.CreationTime = time.Now()
+	for _, c := range w.collectors {
+		for name, value := range c.Finish() {
+			if w.props.User == nil {
+				w.props.User = make(map[string][]byte)
+			}
+			w.props.User[name] = value
+		}
+	}
+	props := blockWriter{restartInterval: 1, scratch: w.scratch[20:]}
+	w.props.encode(&props)
+	props.finish()
+	propsBH, err := w.writeBlock(&props.buf, opt.NoCompression)
+	if err != nil {
+		w.err = err
+		return w.err
 	}
 
 	// Write the metaindex block.
 	if filterBH.length > 0 {
-		key := []byte("filter." + w.filter.Name())
-		n := encodeBlockHandle(w.scratch[:20], filterBH)
+		if w.filterBlock.partitionSize > 0 {
+			var value [30]byte
+			key := []byte("partitionedfilter." + w.filter.Name())
+			n := encodeBlockHandle(value[:], filterBH)
+			n += binary.PutUvarint(value[n:], filterStart)
+			w.dataBlock.append(key, value[:n])
+		} else {
+			key := []byte("filter." + w.filter.Name())
+			n := encodeBlockHandle(w.scratch[:20], filterBH)
+			w.dataBlock.append(key, w.scratch[:n])
+		}
+		if w.prefixer != nil {
+			w.dataBlock.append([]byte("prefix."+w.prefixer.Name()), nil)
+		}
+	}
+	n := encodeBlockHandle(w.scratch[:20], propsBH)
+	w.dataBlock.append([]byte("properties"), w.scratch[:n])
+	if tableFilterBH.length > 0 {
+		key := []byte("tablefilter." + w.filter.Name())
+		n := encodeBlockHandle(w.scratch[:20], tableFilterBH)
 		w.dataBlock.append(key, w.scratch[:n])
 	}
 	w.dataBlock.finish()
@@ -334,8 +563,10 @@ func (w *Writer) Close() error {
 	for i := range footer {
 		footer[i] = 0
 	}
-	n := encodeBlockHandle(footer, metaindexBH)
+	n = encodeBlockHandle(footer, metaindexBH)
 	encodeBlockHandle(footer[n:], indexBH)
+	footer[footerLen-len(magic)-2] = formatVersion
+	footer[footerLen-len(magic)-1] = byte(w.checksum)
 	copy(footer[footerLen-len(magic):], magic)
 	if _, err := w.writer.Write(footer); err != nil {
 		w.err = err
@@ -351,25 +582,52 @@ func (w *Writer) Close() error {
 //
 // Table writer is not safe for concurrent use.
 func NewWriter(f io.Writer, o *opt.Options) *Writer {
-	w := &Writer{
+	w := &Writer{}
+	w.init(f, o)
+	return w
+}
+
+// Initializes the writer to write a new table to the file.
+func (w *Writer) init(f io.Writer, o *opt.Options) {
+	*w = Writer{
 		writer:          f,
+		o:               o,
 		cmp:             o.GetComparer(),
 		filter:          o.GetFilter(),
 		compression:     o.GetCompression(),
+		checksum:        util.Checksum(o.GetChecksum()),
 		blockSize:       o.GetBlockSize(),
 		comparerScratch: make([]byte, 0),
 	}
+	if o != nil && o.Compression != opt.DefaultCompression && !o.Compression.Writable() {
+		// Not silently written with another compression.
+		w.err = fmt.Errorf("leveldb/table: Writer: %v compression can't be used to write tables", o.Compression)
+	} else if w.compression.IsUser() {
+		w.compressor = o.GetCompressor(w.compression)
+		if w.compressor == nil {
+			w.err = fmt.Errorf("leveldb/table: Writer: no compressor for %v compression", w.compression)
+		}
+	}
 	// data block
 	w.dataBlock.restartInterval = o.GetBlockRestartInterval()
 	// The first 20-bytes are used for encoding block handle.
 	w.dataBlock.scratch = w.scratch[20:]
 	// index block
-	w.indexBlock.restartInterval = 1
+	w.indexBlock.restartInterval = o.GetIndexBlockRestartInterval()
+	w.indexBlock.noDelta = o.GetDisableIndexBlockDeltaEncoding()
 	w.indexBlock.scratch = w.scratch[20:]
 	// filter block
 	if w.filter != nil {
 		w.filterBlock.generator = w.filter.NewGenerator()
+		w.filterBlock.partitionSize = o.GetFilterPartitionSize()
 		w.filterBlock.flush(0)
+		w.prefixer = o.GetPrefixer()
+		if o.GetTableFilter() {
+			w.tableFilter = w.filter.NewGenerator()
+		}
+	}
+	// table properties collectors
+	for _, newCollector := range o.GetTablePropertiesCollectors() {
+		w.collectors = append(w.collectors, newCollector())
 	}
-	return w
 }
@@ -0,0 +1,297 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// +build ignore
+
+// This program generates the files of a DB in the formats of the C++
+// LevelDB library, as described by its doc/log_format.md and
+// doc/table_format.md, without using the leveldb package. The DB holds a
+// table with a bloom filter and a journal, and is used by the
+// compatibility tests.
+//
+// The files aren't written by the C++ library itself. The table blocks are
+// compressed as its table builder does, with snappy if that saves at least
+// 12.5%, using github.com/FactomProject/snappy-go, which writes the raw
+// snappy format the C++ library uses. Files written by the C++ library
+// (e.g. by its db_bench) may be added next to them.
+//
+// Run with: go run gen.go
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	snappy "github.com/FactomProject/snappy-go"
+)
+
+const (
+	typeDeletion = 0
+	typeValue    = 1
+
+	tableMagic = 0xdb4775248b80fb57
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func maskedCRC(b []byte) uint32 {
+	c := crc32.Checksum(b, crcTable)
+	return (c>>15 | c<<17) + 0xa282ead8
+}
+
+func putUvarint(buf *bytes.Buffer, x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], x)])
+}
+
+func putFixed32(buf *bytes.Buffer, x uint32) {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], x)
+	buf.Write(tmp[:])
+}
+
+func putFixed64(buf *bytes.Buffer, x uint64) {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], x)
+	buf.Write(tmp[:])
+}
+
+func putLengthPrefixed(buf *bytes.Buffer, b []byte) {
+	putUvarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func internalKey(ukey string, seq uint64, t byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(ukey)
+	putFixed64(&buf, seq<<8|uint64(t))
+	return buf.Bytes()
+}
+
+// Writes a log file of the given records, see doc/log_format.md. The
+// records are small enough to fit in a single block.
+func logFile(records ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, r := range records {
+		const fullType = 1
+		var header [7]byte
+		binary.LittleEndian.PutUint32(header[0:], maskedCRC(append([]byte{fullType}, r...)))
+		binary.LittleEndian.PutUint16(header[4:], uint16(len(r)))
+		header[6] = fullType
+		buf.Write(header[:])
+		buf.Write(r)
+	}
+	return buf.Bytes()
+}
+
+type entry struct {
+	key, value []byte
+}
+
+// Returns a block of the given entries with the given restart interval.
+func block(entries []entry, restartInterval int) []byte {
+	var buf bytes.Buffer
+	var restarts []uint32
+	var prev []byte
+	for i, e := range entries {
+		shared := 0
+		if i%restartInterval == 0 {
+			restarts = append(restarts, uint32(buf.Len()))
+		} else {
+			for shared < len(prev) && shared < len(e.key) && prev[shared] == e.key[shared] {
+				shared++
+			}
+		}
+		putUvarint(&buf, uint64(shared))
+		putUvarint(&buf, uint64(len(e.key)-shared))
+		putUvarint(&buf, uint64(len(e.value)))
+		buf.Write(e.key[shared:])
+		buf.Write(e.value)
+		prev = e.key
+	}
+	if len(restarts) == 0 {
+		restarts = append(restarts, 0)
+	}
+	for _, r := range restarts {
+		putFixed32(&buf, r)
+	}
+	putFixed32(&buf, uint32(len(restarts)))
+	return buf.Bytes()
+}
+
+// The hash of the C++ util/hash.cc.
+func hash(data []byte, seed uint32) uint32 {
+	const m = 0xc6a4a793
+	h := seed ^ uint32(len(data))*m
+	for ; len(data) >= 4; data = data[4:] {
+		h += binary.LittleEndian.Uint32(data)
+		h *= m
+		h ^= h >> 16
+	}
+	switch len(data) {
+	case 3:
+		h += uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h += uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h += uint32(data[0])
+		h *= m
+		h ^= h >> 24
+	}
+	return h
+}
+
+// The filter of the C++ util/bloom.cc.
+func bloomFilter(keys [][]byte, bitsPerKey int) []byte {
+	k := uint8(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	} else if k > 30 {
+		k = 30
+	}
+	bits := len(keys) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	n := (bits + 7) / 8
+	bits = n * 8
+	filter := make([]byte, n+1)
+	filter[n] = k
+	for _, key := range keys {
+		h := hash(key, 0xbc9f1d34)
+		delta := h>>17 | h<<15
+		for j := uint8(0); j < k; j++ {
+			pos := h % uint32(bits)
+			filter[pos/8] |= 1 << (pos % 8)
+			h += delta
+		}
+	}
+	return filter
+}
+
+// Returns a table of the given data blocks, with a bloom filter of the
+// user keys, see doc/table_format.md. The data blocks must start within
+// the first 2KiB, so a single filter covers them.
+func table(blocks ...[]entry) []byte {
+	var buf bytes.Buffer
+	handle := func(offset, size int) []byte {
+		var h bytes.Buffer
+		putUvarint(&h, uint64(offset))
+		putUvarint(&h, uint64(size))
+		return h.Bytes()
+	}
+	writeRawBlock := func(b []byte, compression byte) []byte {
+		offset := buf.Len()
+		buf.Write(b)
+		buf.WriteByte(compression)
+		putFixed32(&buf, maskedCRC(append(append([]byte{}, b...), compression)))
+		return handle(offset, len(b))
+	}
+	// Snappy compressed unless it saves less than 12.5%, see
+	// table/table_builder.cc.
+	writeBlock := func(b []byte) []byte {
+		if c := snappy.Encode(nil, b); len(c) < len(b)-len(b)/8 {
+			return writeRawBlock(c, 1)
+		}
+		return writeRawBlock(b, 0)
+	}
+
+	var (
+		index []entry
+		ukeys [][]byte
+	)
+	for _, entries := range blocks {
+		dataHandle := writeBlock(block(entries, 16))
+		if buf.Len() > 2048 {
+			log.Fatal("data blocks exceed the filter base")
+		}
+		index = append(index, entry{entries[len(entries)-1].key, dataHandle})
+		for _, e := range entries {
+			ukeys = append(ukeys, e.key[:len(e.key)-8])
+		}
+	}
+
+	// A single filter at offset zero, the filter base is 2KiB.
+	var filter bytes.Buffer
+	filter.Write(bloomFilter(ukeys, 10))
+	offsetsStart := filter.Len()
+	putFixed32(&filter, 0)
+	putFixed32(&filter, uint32(offsetsStart))
+	filter.WriteByte(11)
+	// The filter block is never compressed.
+	filterHandle := writeRawBlock(filter.Bytes(), 0)
+
+	metaindexHandle := writeBlock(block([]entry{{[]byte("filter.leveldb.BuiltinBloomFilter2"), filterHandle}}, 1))
+	indexHandle := writeBlock(block(index, 1))
+
+	footer := make([]byte, 48)
+	n := copy(footer, metaindexHandle)
+	copy(footer[n:], indexHandle)
+	binary.LittleEndian.PutUint64(footer[40:], tableMagic)
+	buf.Write(footer)
+	return buf.Bytes()
+}
+
+func main() {
+	dir := "db"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	write := func(name string, data []byte) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The table holds sequence numbers 1 to 5. The first data block is
+	// snappy compressed, the second one isn't.
+	tdata := table([]entry{
+		{internalKey("bar", 1, typeValue), []byte("v1")},
+		{internalKey("baz", 3, typeDeletion), nil},
+		{internalKey("baz", 2, typeValue), []byte("old")},
+		{internalKey("big", 5, typeValue), bytes.Repeat([]byte("v5"), 500)},
+	}, []entry{
+		{internalKey("foo", 4, typeValue), []byte("v3")},
+	})
+	write("000005.ldb", tdata)
+
+	// The journal holds a batch of sequence number 11.
+	var batch bytes.Buffer
+	putFixed64(&batch, 11)
+	putFixed32(&batch, 2)
+	batch.WriteByte(typeValue)
+	putLengthPrefixed(&batch, []byte("qux"))
+	putLengthPrefixed(&batch, []byte("v4"))
+	batch.WriteByte(typeDeletion)
+	putLengthPrefixed(&batch, []byte("foo"))
+	write("000003.log", logFile(batch.Bytes()))
+
+	// The version edit, see db/version_edit.cc.
+	var edit bytes.Buffer
+	putUvarint(&edit, 1) // kComparator
+	putLengthPrefixed(&edit, []byte("leveldb.BytewiseComparator"))
+	putUvarint(&edit, 2) // kLogNumber
+	putUvarint(&edit, 3)
+	putUvarint(&edit, 3) // kNextFileNumber
+	putUvarint(&edit, 6)
+	putUvarint(&edit, 4) // kLastSequence
+	putUvarint(&edit, 10)
+	putUvarint(&edit, 7) // kNewFile
+	putUvarint(&edit, 1)
+	putUvarint(&edit, 5)
+	putUvarint(&edit, uint64(len(tdata)))
+	putLengthPrefixed(&edit, internalKey("bar", 1, typeValue))
+	putLengthPrefixed(&edit, internalKey("foo", 4, typeValue))
+	write("MANIFEST-000002", logFile(edit.Bytes()))
+	write("CURRENT", []byte("MANIFEST-000002\n"))
+}
@@ -0,0 +1,428 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// +build ignore
+
+// This program generates tables in the RocksDB block-based table format,
+// as described by the RocksDB wiki (Rocksdb-BlockBasedTable-Format and
+// Index-Block-Format), without using the table package. The tables cover
+// the format versions, checksum types, compressions and index encodings
+// read by table.RocksDBReader, and are used by its tests and by the
+// ingestion tests.
+//
+// The snappy blocks are compressed with github.com/FactomProject/snappy-go,
+// which writes the raw snappy format RocksDB uses; the tables must be
+// regenerated against that library, not a stand-in. The tables aren't
+// written by RocksDB itself, tables dumped by RocksDB (e.g. with
+// sst_dump --command=recompress) may be added next to them.
+//
+// Run with: go run gen.go
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+
+	snappy "github.com/FactomProject/snappy-go"
+
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+const (
+	typeDeletion       = 0x0
+	typeValue          = 0x1
+	typeMerge          = 0x2
+	typeSingleDeletion = 0x7
+	typeRangeDeletion  = 0xf
+
+	checksumNone     = 0
+	checksumCRC32C   = 1
+	checksumXXHash   = 2
+	checksumXXHash64 = 3
+
+	compressionNone   = 0
+	compressionSnappy = 1
+	compressionZlib   = 2
+
+	indexBinarySearch          = 0
+	indexTwoLevel              = 2
+	indexBinarySearchWithFirst = 3
+
+	magic = 0x88e241b785f4cff7
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func putUvarint(buf *bytes.Buffer, x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutUvarint(tmp[:], x)])
+}
+
+func putVarint(buf *bytes.Buffer, x int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	buf.Write(tmp[:binary.PutVarint(tmp[:], x)])
+}
+
+func putFixed32(buf *bytes.Buffer, x uint32) {
+	var tmp [4]byte
+	binary.LittleEndian.PutUint32(tmp[:], x)
+	buf.Write(tmp[:])
+}
+
+func internalKey(ukey string, seq uint64, t byte) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], seq<<8|uint64(t))
+	return append([]byte(ukey), tmp[:]...)
+}
+
+type entry struct {
+	key, value []byte
+}
+
+type handle struct {
+	offset, size uint64
+}
+
+func (h handle) encode(buf *bytes.Buffer) {
+	putUvarint(buf, h.offset)
+	putUvarint(buf, h.size)
+}
+
+type options struct {
+	formatVersion   uint32
+	checksum        byte
+	compression     byte
+	blockEntries    int
+	restartInterval int
+	// Data block hash index, only flagged; the buckets are never read.
+	hashIndex bool
+
+	indexType       int
+	indexUserKey    bool
+	indexDeltaEnc   bool
+	indexRestart    int
+	indexPartitions int
+}
+
+type tableBuilder struct {
+	o   options
+	buf bytes.Buffer
+}
+
+func sharedPrefixLen(a, b []byte) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// Encodes a block. If handles is not nil the values are the given block
+// handles, delta encoded if deltaEnc is true.
+func (t *tableBuilder) block(entries []entry, restartInterval int, hashIndex bool, handles []handle, deltaEnc bool, firstKeys [][]byte) []byte {
+	var (
+		buf      bytes.Buffer
+		restarts []uint32
+		prev     []byte
+	)
+	for i, e := range entries {
+		shared := 0
+		if i%restartInterval == 0 {
+			restarts = append(restarts, uint32(buf.Len()))
+		} else {
+			shared = sharedPrefixLen(prev, e.key)
+		}
+		putUvarint(&buf, uint64(shared))
+		putUvarint(&buf, uint64(len(e.key)-shared))
+		value := e.value
+		if handles != nil {
+			var vbuf bytes.Buffer
+			if deltaEnc && shared > 0 {
+				putVarint(&vbuf, int64(handles[i].size)-int64(handles[i-1].size))
+			} else {
+				handles[i].encode(&vbuf)
+			}
+			if firstKeys != nil {
+				putUvarint(&vbuf, uint64(len(firstKeys[i])))
+				vbuf.Write(firstKeys[i])
+			}
+			value = vbuf.Bytes()
+		}
+		if handles == nil || !deltaEnc {
+			putUvarint(&buf, uint64(len(value)))
+		}
+		buf.Write(e.key[shared:])
+		buf.Write(value)
+		prev = e.key
+	}
+	if len(restarts) == 0 {
+		restarts = append(restarts, 0)
+	}
+	for _, r := range restarts {
+		putFixed32(&buf, r)
+	}
+	n := uint32(len(restarts))
+	if hashIndex {
+		buf.Write([]byte{0xff, 0xff, 0xff})
+		buf.Write([]byte{3, 0})
+		n |= 1 << 31
+	}
+	putFixed32(&buf, n)
+	return buf.Bytes()
+}
+
+// Writes a block with its trailer, returns its handle.
+func (t *tableBuilder) writeBlock(data []byte, compress bool) handle {
+	compression := byte(compressionNone)
+	if compress {
+		compression = t.o.compression
+	}
+	switch compression {
+	case compressionSnappy:
+		data = snappy.Encode(nil, data)
+	case compressionZlib:
+		var zbuf bytes.Buffer
+		putUvarint(&zbuf, uint64(len(data)))
+		w, _ := flate.NewWriter(&zbuf, flate.BestCompression)
+		w.Write(data)
+		w.Close()
+		data = zbuf.Bytes()
+	}
+	h := handle{uint64(t.buf.Len()), uint64(len(data))}
+	t.buf.Write(data)
+	t.buf.WriteByte(compression)
+	b := append(data[:len(data):len(data)], compression)
+	var checksum uint32
+	switch t.o.checksum {
+	case checksumCRC32C:
+		c := crc32.Checksum(b, crcTable)
+		checksum = (c>>15 | c<<17) + 0xa282ead8
+	case checksumXXHash:
+		checksum = util.XXHash32(b)
+	case checksumXXHash64:
+		checksum = uint32(util.XXHash64(b))
+	}
+	putFixed32(&t.buf, checksum)
+	return h
+}
+
+// Returns the index key of the block ending with the given internal key.
+func (t *tableBuilder) indexKey(last []byte) []byte {
+	if t.o.indexUserKey {
+		return last[:len(last)-8]
+	}
+	return last
+}
+
+func table(o options, entries, rangeDels []entry) []byte {
+	t := &tableBuilder{o: o}
+
+	// Data blocks, split only between user keys.
+	var (
+		index     []entry
+		handles   []handle
+		firstKeys [][]byte
+	)
+	for i := 0; i < len(entries); {
+		j := i + o.blockEntries
+		for j < len(entries) && bytes.Equal(entries[j-1].key[:len(entries[j-1].key)-8], entries[j].key[:len(entries[j].key)-8]) {
+			j++
+		}
+		if j > len(entries) {
+			j = len(entries)
+		}
+		h := t.writeBlock(t.block(entries[i:j], o.restartInterval, o.hashIndex, nil, false, nil), true)
+		index = append(index, entry{key: t.indexKey(entries[j-1].key)})
+		handles = append(handles, h)
+		firstKeys = append(firstKeys, entries[i].key)
+		i = j
+	}
+	if o.indexType != indexBinarySearchWithFirst {
+		firstKeys = nil
+	}
+
+	var metaindex []entry
+	addMeta := func(name string, h handle) {
+		var buf bytes.Buffer
+		h.encode(&buf)
+		metaindex = append(metaindex, entry{[]byte(name), buf.Bytes()})
+	}
+
+	// Properties.
+	var props []entry
+	prop := func(name string, value []byte) {
+		props = append(props, entry{[]byte(name), value})
+	}
+	varintProp := func(x uint64) []byte {
+		var buf bytes.Buffer
+		putUvarint(&buf, x)
+		return buf.Bytes()
+	}
+	boolProp := func(b bool) []byte {
+		if b {
+			return varintProp(1)
+		}
+		return varintProp(0)
+	}
+	var indexTypeProp bytes.Buffer
+	putFixed32(&indexTypeProp, uint32(o.indexType))
+	prop("rocksdb.block.based.table.index.type", indexTypeProp.Bytes())
+	prop("rocksdb.comparator", []byte("leveldb.BytewiseComparator"))
+	prop("rocksdb.index.key.is.user.key", boolProp(o.indexUserKey))
+	prop("rocksdb.index.value.is.delta.encoded", boolProp(o.indexDeltaEnc))
+	prop("rocksdb.num.entries", varintProp(uint64(len(entries))))
+	prop("rocksdb.num.range-deletions", varintProp(uint64(len(rangeDels))))
+	addMeta("rocksdb.properties", t.writeBlock(t.block(props, 1, false, nil, false, nil), false))
+
+	if len(rangeDels) > 0 {
+		addMeta("rocksdb.range_del", t.writeBlock(t.block(rangeDels, 1, false, nil, false, nil), false))
+	}
+
+	// Index.
+	var indexHandle handle
+	if o.indexType == indexTwoLevel {
+		var (
+			top        []entry
+			topHandles []handle
+		)
+		n := (len(index) + o.indexPartitions - 1) / o.indexPartitions
+		for i := 0; i < len(index); i += n {
+			j := i + n
+			if j > len(index) {
+				j = len(index)
+			}
+			h := t.writeBlock(t.block(index[i:j], o.indexRestart, false, handles[i:j], o.indexDeltaEnc, nil), false)
+			top = append(top, index[j-1])
+			topHandles = append(topHandles, h)
+		}
+		indexHandle = t.writeBlock(t.block(top, o.indexRestart, false, topHandles, o.indexDeltaEnc, nil), false)
+	} else {
+		indexHandle = t.writeBlock(t.block(index, o.indexRestart, false, handles, o.indexDeltaEnc, firstKeys), false)
+	}
+
+	metaHandle := t.writeBlock(t.block(metaindex, 1, false, nil, false, nil), false)
+
+	// Footer.
+	var footer bytes.Buffer
+	footer.WriteByte(o.checksum)
+	metaHandle.encode(&footer)
+	indexHandle.encode(&footer)
+	footer.Write(make([]byte, 41-footer.Len()))
+	putFixed32(&footer, o.formatVersion)
+	putFixed32(&footer, uint32(magic&0xffffffff))
+	putFixed32(&footer, uint32(magic>>32))
+	t.buf.Write(footer.Bytes())
+	return t.buf.Bytes()
+}
+
+func main() {
+	// A table of a live DB, holding multiple versions of the keys.
+	var entries []entry
+	for i := 0; i < 200; i++ {
+		ukey := fmt.Sprintf("key%03d", i)
+		if i%7 == 0 {
+			entries = append(entries, entry{internalKey(ukey, uint64(2000+i), typeDeletion), nil})
+		}
+		entries = append(entries, entry{internalKey(ukey, uint64(1000+i), typeValue), []byte(fmt.Sprintf("v2-%d", i))})
+		if i%10 == 0 {
+			entries = append(entries, entry{internalKey(ukey, 10, typeValue), []byte("old")})
+		}
+	}
+	write("v2.sst", table(options{
+		formatVersion:   2,
+		checksum:        checksumCRC32C,
+		compression:     compressionSnappy,
+		blockEntries:    16,
+		restartInterval: 4,
+		indexType:       indexBinarySearch,
+		indexRestart:    1,
+	}, entries, nil))
+
+	// A table with range deletions, user key index and delta encoded
+	// index values.
+	entries = []entry{
+		{internalKey("key055", 40, typeValue), []byte("covered")},
+		{internalKey("key058", 60, typeValue), []byte("v5-58")},
+		{internalKey("key100", 70, typeSingleDeletion), nil},
+	}
+	for i := 300; i < 400; i++ {
+		entries = append(entries, entry{internalKey(fmt.Sprintf("key%03d", i), 80, typeValue), []byte(fmt.Sprintf("v5-%d", i))})
+	}
+	rangeDels := []entry{
+		{internalKey("key050", 50, typeRangeDeletion), []byte("key060")},
+		{internalKey("key190", 90, typeRangeDeletion), []byte("key195")},
+	}
+	write("v5.sst", table(options{
+		formatVersion:   5,
+		checksum:        checksumXXHash64,
+		compression:     compressionZlib,
+		blockEntries:    10,
+		restartInterval: 16,
+		hashIndex:       true,
+		indexType:       indexBinarySearch,
+		indexUserKey:    true,
+		indexDeltaEnc:   true,
+		indexRestart:    4,
+	}, entries, rangeDels))
+
+	// A table with partitioned index.
+	entries = nil
+	for i := 0; i < 300; i++ {
+		entries = append(entries, entry{internalKey(fmt.Sprintf("part%03d", i), 0, typeValue), []byte(fmt.Sprintf("p-%d", i))})
+	}
+	write("v4p.sst", table(options{
+		formatVersion:   4,
+		checksum:        checksumXXHash,
+		compression:     compressionNone,
+		blockEntries:    8,
+		restartInterval: 16,
+		indexType:       indexTwoLevel,
+		indexDeltaEnc:   true,
+		indexRestart:    3,
+		indexPartitions: 5,
+	}, entries, nil))
+
+	// A table with the first keys in the index, without checksum.
+	entries = nil
+	for i := 0; i < 50; i++ {
+		entries = append(entries, entry{internalKey(fmt.Sprintf("first%02d", i), 0, typeValue), []byte(fmt.Sprintf("f-%d", i))})
+	}
+	write("v3f.sst", table(options{
+		formatVersion:   3,
+		checksum:        checksumNone,
+		compression:     compressionSnappy,
+		blockEntries:    7,
+		restartInterval: 2,
+		indexType:       indexBinarySearchWithFirst,
+		indexUserKey:    true,
+		indexRestart:    1,
+	}, entries, nil))
+
+	// A table with a merge operand.
+	entries = []entry{
+		{internalKey("merge", 5, typeMerge), []byte("+1")},
+	}
+	write("merge.sst", table(options{
+		formatVersion:   2,
+		checksum:        checksumCRC32C,
+		compression:     compressionNone,
+		blockEntries:    16,
+		restartInterval: 16,
+		indexType:       indexBinarySearch,
+		indexRestart:    1,
+	}, entries, nil))
+}
+
+func write(name string, data []byte) {
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
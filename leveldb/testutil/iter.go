@@ -7,6 +7,7 @@
 package testutil
 
 import (
+	"bytes"
 	"fmt"
 	"math/rand"
 
@@ -31,6 +32,8 @@ func (a IterAct) String() string {
 		return "next"
 	case IterSeek:
 		return "seek"
+	case IterSeekLE:
+		return "seek-le"
 	case IterSOI:
 		return "soi"
 	case IterEOI:
@@ -46,6 +49,7 @@ const (
 	IterPrev
 	IterNext
 	IterSeek
+	IterSeekLE
 	IterSOI
 	IterEOI
 )
@@ -229,6 +233,55 @@ func (t *IteratorTesting) SeekKey(key []byte) {
 	t.post()
 }
 
+func (t *IteratorTesting) SeekLE(i int) {
+	t.init()
+	t.setAct(IterSeekLE)
+
+	key, _ := t.Index(i)
+	oldKey, _ := t.IndexOrNil(t.Pos)
+
+	ok := t.Iter.SeekLE(key)
+	Expect(t.Iter.Error()).ShouldNot(HaveOccurred())
+	Expect(ok).Should(BeTrue(), fmt.Sprintf("SeekLE from key %q to %q, to pos %d, %s", oldKey, key, i, t.text()))
+
+	t.Pos = i
+	t.TestKV()
+	t.post()
+}
+
+func (t *IteratorTesting) SeekLEInexact(i int) {
+	var key0 []byte
+	key1, _ := t.Index(i)
+	if i > 0 {
+		key0, _ = t.Index(i - 1)
+	}
+	t.SeekLEKey(BytesSeparator(key0, key1))
+}
+
+func (t *IteratorTesting) SeekLEKey(key []byte) {
+	t.init()
+	t.setAct(IterSeekLE)
+	oldKey, _ := t.IndexOrNil(t.Pos)
+	i := t.Search(key)
+	if key_, _ := t.IndexOrNil(i); i >= t.Len() || !bytes.Equal(key_, key) {
+		i--
+	}
+
+	ok := t.Iter.SeekLE(key)
+	Expect(t.Iter.Error()).ShouldNot(HaveOccurred())
+	if i >= 0 {
+		key_, _ := t.Index(i)
+		Expect(ok).Should(BeTrue(), fmt.Sprintf("SeekLE from key %q to %q (%q), to pos %d, %s", oldKey, key, key_, i, t.text()))
+		t.Pos = i
+		t.TestKV()
+	} else {
+		Expect(ok).ShouldNot(BeTrue(), fmt.Sprintf("SeekLE from key %q to %q, %s", oldKey, key, t.text()))
+	}
+
+	t.Pos = i
+	t.post()
+}
+
 func (t *IteratorTesting) SOI() {
 	t.init()
 	t.setAct(IterSOI)
@@ -324,4 +377,27 @@ func DoIteratorTesting(t *IteratorTesting) {
 	for _, key := range []string{"", "foo", "bar", "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"} {
 		t.SeekKey([]byte(key))
 	}
+
+	ShuffledIndex(t.Rand, t.Len(), 1, func(i int) {
+		t.SeekLE(i)
+	})
+
+	ShuffledIndex(t.Rand, t.Len(), 1, func(i int) {
+		t.SeekLEInexact(i)
+	})
+
+	ShuffledIndex(t.Rand, t.Len(), 1, func(i int) {
+		t.SeekLE(i)
+		if i%2 != 0 {
+			t.PrevAll()
+			t.SOI()
+		} else {
+			t.NextAll()
+			t.EOI()
+		}
+	})
+
+	for _, key := range []string{"", "foo", "bar", "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"} {
+		t.SeekLEKey([]byte(key))
+	}
 }
@@ -60,6 +60,7 @@ const (
 	typeJournal
 	typeTable
 	typeTemp
+	typeValueLog
 
 	typeCount
 )
@@ -98,6 +99,8 @@ func flattenType(m StorageMode, t storage.FileType) int {
 		return x + typeTable
 	case storage.TypeTemp:
 		return x + typeTemp
+	case storage.TypeValueLog:
+		return x + typeValueLog
 	default:
 		panic("invalid file type")
 	}
@@ -116,6 +119,8 @@ func listFlattenType(m StorageMode, t storage.FileType) []int {
 			ret = append(ret, x+typeTable)
 		case t&storage.TypeTemp != 0:
 			ret = append(ret, x+typeTemp)
+		case t&storage.TypeValueLog != 0:
+			ret = append(ret, x+typeValueLog)
 		}
 	}
 	switch {
@@ -200,6 +205,20 @@ func (r *reader) ReadAt(p []byte, off int64) (n int, err error) {
 	return
 }
 
+func (r *reader) Mmap() ([]byte, error) {
+	if mr, ok := r.Reader.(storage.MmapReader); ok {
+		return mr.Mmap()
+	}
+	return nil, storage.ErrNotSupported
+}
+
+func (r *reader) DropCache() error {
+	if cd, ok := r.Reader.(storage.CacheDropper); ok {
+		return cd.DropCache()
+	}
+	return storage.ErrNotSupported
+}
+
 func (r *reader) Close() (err error) {
 	return r.s.fileClose(r.fd, r.Reader)
 }
@@ -236,6 +255,34 @@ func (w *writer) Sync() (err error) {
 	return
 }
 
+func (w *writer) Truncate(size int64) error {
+	if tw, ok := w.Writer.(storage.Truncater); ok {
+		return tw.Truncate(size)
+	}
+	return storage.ErrNotSupported
+}
+
+func (w *writer) SyncRange(off, n int64) error {
+	if rw, ok := w.Writer.(storage.RangeSyncer); ok {
+		return rw.SyncRange(off, n)
+	}
+	return storage.ErrNotSupported
+}
+
+func (w *writer) Preallocate(size int64) error {
+	if pw, ok := w.Writer.(storage.Preallocator); ok {
+		return pw.Preallocate(size)
+	}
+	return storage.ErrNotSupported
+}
+
+func (w *writer) DropCache() error {
+	if cd, ok := w.Writer.(storage.CacheDropper); ok {
+		return cd.DropCache()
+	}
+	return storage.ErrNotSupported
+}
+
 func (w *writer) Close() (err error) {
 	return w.s.fileClose(w.fd, w.Writer)
 }
@@ -315,6 +362,15 @@ func (s *Storage) logI(format string, args ...interface{}) {
 	s.logISkip(1, format, args...)
 }
 
+// AuditDurability wraps the underlying storage with
+// storage.NewDurabilityAudit, it must be called before any file is
+// created.
+func (s *Storage) AuditDurability(onViolation func(msg string)) {
+	s.mu.Lock()
+	s.Storage = storage.NewDurabilityAudit(s.Storage, onViolation)
+	s.mu.Unlock()
+}
+
 func (s *Storage) OnLog(onLog func(log string)) {
 	s.lmu.Lock()
 	s.onLog = onLog
@@ -498,6 +554,45 @@ func (s *Storage) Rename(oldfd, newfd storage.FileDesc) (err error) {
 	return
 }
 
+func (s *Storage) Recycle(oldfd, newfd storage.FileDesc) (w storage.Writer, err error) {
+	rs, ok := s.Storage.(storage.Recycler)
+	if !ok {
+		return nil, storage.ErrNotSupported
+	}
+	err = s.emulateError(ModeRename, oldfd.Type)
+	if err == nil {
+		s.stall(ModeRename, oldfd.Type)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.assertOpen(oldfd)
+		s.assertOpen(newfd)
+		s.countNB(ModeRename, oldfd.Type, 0)
+		w, err = rs.Recycle(oldfd, newfd)
+	}
+	if err != nil {
+		s.logI("file recycle failed, oldfd=%s newfd=%s err=%v", oldfd, newfd, err)
+	} else {
+		s.logI("file recycled, oldfd=%s newfd=%s", oldfd, newfd)
+		s.opens[packFile(newfd)] = true
+		w = &writer{s, newfd, w}
+	}
+	return
+}
+
+func (s *Storage) Sync() (err error) {
+	if ss, ok := s.Storage.(storage.Syncer); ok {
+		err = ss.Sync()
+	}
+	if err != nil {
+		s.logI("storage sync failed, err=%v", err)
+	} else {
+		s.logI("storage synced")
+	}
+	return
+}
+
 func (s *Storage) ForceRename(oldfd, newfd storage.FileDesc) (err error) {
 	s.countNB(ModeRename, oldfd.Type, 0)
 	if err = s.Storage.Rename(oldfd, newfd); err != nil {
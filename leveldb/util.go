@@ -30,34 +30,6 @@ func shortenb(bytes int) string {
 	return fmt.Sprintf("%d%sB", bytes, bunits[i])
 }
 
-func sshortenb(bytes int) string {
-	if bytes == 0 {
-		return "~"
-	}
-	sign := "+"
-	if bytes < 0 {
-		sign = "-"
-		bytes *= -1
-	}
-	i := 0
-	for ; bytes > 1024 && i < 4; i++ {
-		bytes /= 1024
-	}
-	return fmt.Sprintf("%s%d%sB", sign, bytes, bunits[i])
-}
-
-func sint(x int) string {
-	if x == 0 {
-		return "~"
-	}
-	sign := "+"
-	if x < 0 {
-		sign = "-"
-		x *= -1
-	}
-	return fmt.Sprintf("%s%d", sign, x)
-}
-
 func minInt(a, b int) int {
 	if a < b {
 		return a
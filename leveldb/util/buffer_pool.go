@@ -13,6 +13,10 @@ import (
 	"time"
 )
 
+// Buffers larger than maxBufferFactor times the baseline aren't pooled, so
+// a few large reads don't pin memory in the pool.
+const maxBufferFactor = 16
+
 type buffer struct {
 	b    []byte
 	miss int
@@ -26,6 +30,7 @@ type BufferPool struct {
 	sizeHalf  [5]uint32
 	baseline  [4]int
 	baseline0 int
+	max       int
 
 	mu     sync.RWMutex
 	closed bool
@@ -61,7 +66,7 @@ func (p *BufferPool) Get(n int) []byte {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if p.closed {
+	if p.closed || n > p.max {
 		return make([]byte, n)
 	}
 
@@ -154,7 +159,8 @@ func (p *BufferPool) Get(n int) []byte {
 	}
 }
 
-// Put adds given buffer to the pool.
+// Put adds given buffer to the pool. Empty buffers and buffers larger than
+// the pool cap are dropped.
 func (p *BufferPool) Put(b []byte) {
 	if p == nil {
 		return
@@ -163,7 +169,7 @@ func (p *BufferPool) Put(b []byte) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
-	if p.closed {
+	if p.closed || cap(b) == 0 || cap(b) > p.max {
 		return
 	}
 
@@ -221,13 +227,16 @@ func (p *BufferPool) drain() {
 	}
 }
 
-// NewBufferPool creates a new initialized 'buffer pool'.
+// NewBufferPool creates a new initialized 'buffer pool'. The buffers are
+// pooled by size classes around the given baseline, buffers larger than
+// 16 times the baseline aren't pooled.
 func NewBufferPool(baseline int) *BufferPool {
 	if baseline <= 0 {
 		panic("baseline can't be <= 0")
 	}
 	p := &BufferPool{
 		baseline0: baseline,
+		max:       baseline * maxBufferFactor,
 		baseline:  [...]int{baseline / 4, baseline / 2, baseline * 2, baseline * 4},
 		closeC:    make(chan struct{}, 1),
 	}
@@ -0,0 +1,56 @@
+// Copyright (c) 2014, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool(1024)
+	defer p.Close()
+
+	for _, n := range []int{0, 1, 100, 512, 1024, 3000, 5000, 16 * 1024, 16*1024 + 1, 1 << 20} {
+		b := p.Get(n)
+		if len(b) != n {
+			t.Fatalf("Get(%d): got length %d", n, len(b))
+		}
+		p.Put(b)
+	}
+
+	// Buffers of the baseline class are reused.
+	b := p.Get(1024)
+	b[0] = 'x'
+	p.Put(b)
+	if b1 := p.Get(1000); &b1[0] != &b[0] {
+		t.Error("Get: baseline buffer not reused")
+	}
+
+	// Empty buffers and buffers above the cap aren't pooled.
+	put := p.put
+	p.Put(make([]byte, 16*1024+1))
+	p.Put(nil)
+	if p.put != put {
+		t.Error("Put: empty buffer or buffer above the cap pooled")
+	}
+	get := p.get
+	if b := p.Get(1 << 20); len(b) != 1<<20 || p.get != get {
+		t.Error("Get: buffer above the cap taken from the pool")
+	}
+
+	// A nil or closed pool allocates.
+	var np *BufferPool
+	if b := np.Get(10); len(b) != 10 {
+		t.Errorf("nil Get: got length %d", len(b))
+	}
+	np.Put(make([]byte, 10))
+	p.Close()
+	if b := p.Get(10); len(b) != 10 {
+		t.Errorf("closed Get: got length %d", len(b))
+	}
+	p.Put(make([]byte, 10))
+}
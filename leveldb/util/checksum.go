@@ -0,0 +1,33 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+// Checksum is a checksum algorithm of the table blocks and journal chunks.
+// The values are recorded in the files and should not be changed.
+type Checksum byte
+
+const (
+	// CRC32CChecksum is the masked CRC-32 computed using Castagnoli's
+	// polynomial, see CRC. It is hardware accelerated where supported.
+	CRC32CChecksum Checksum = iota
+	// XXHash64Checksum is the lower 32 bits of the 64-bit xxHash.
+	XXHash64Checksum
+	nChecksum
+)
+
+// Valid returns whether the checksum algorithm is known.
+func (c Checksum) Valid() bool {
+	return c < nChecksum
+}
+
+// Sum returns the 32-bit checksum of the given bytes.
+func (c Checksum) Sum(b []byte) uint32 {
+	if c == XXHash64Checksum {
+		return uint32(XXHash64(b))
+	}
+	return NewCRC(b).Value()
+}
@@ -6,7 +6,10 @@
 
 package util
 
-// Range is a key range.
+import "github.com/FactomProject/goleveldb/leveldb/comparer"
+
+// Range is a key range. A nil Start is before all keys, and a nil Limit
+// after all keys; a nil range holds all keys.
 type Range struct {
 	// Start of the key range, include in the range.
 	Start []byte
@@ -16,7 +19,9 @@ type Range struct {
 }
 
 // BytesPrefix returns key range that satisfy the given prefix.
-// This only applicable for the standard 'bytes comparer'.
+// This only applicable for the standard 'bytes comparer'. The limit is the
+// prefix with its last byte below 0xff incremented, and the bytes after it
+// dropped; it is nil if the prefix is all 0xff.
 func BytesPrefix(prefix []byte) *Range {
 	var limit []byte
 	for i := len(prefix) - 1; i >= 0; i-- {
@@ -30,3 +35,58 @@ func BytesPrefix(prefix []byte) *Range {
 	}
 	return &Range{prefix, limit}
 }
+
+// Empty returns true if the range holds no keys, under the given comparer.
+func (r *Range) Empty(cmp comparer.BasicComparer) bool {
+	return r != nil && r.Limit != nil && (r.Start == nil && len(r.Limit) == 0 ||
+		r.Start != nil && cmp.Compare(r.Start, r.Limit) >= 0)
+}
+
+// Contains returns true if the range holds the given key, under the given
+// comparer.
+func (r *Range) Contains(cmp comparer.BasicComparer, key []byte) bool {
+	if r == nil {
+		return true
+	}
+	return (r.Start == nil || cmp.Compare(key, r.Start) >= 0) &&
+		(r.Limit == nil || cmp.Compare(key, r.Limit) < 0)
+}
+
+// ContainsRange returns true if the range holds all keys of the given
+// range, under the given comparer. An empty range is held by any range.
+func (r *Range) ContainsRange(cmp comparer.BasicComparer, x *Range) bool {
+	if r == nil || x.Empty(cmp) {
+		return true
+	}
+	if x == nil {
+		return r.Start == nil && r.Limit == nil
+	}
+	return (r.Start == nil || x.Start != nil && cmp.Compare(x.Start, r.Start) >= 0) &&
+		(r.Limit == nil || x.Limit != nil && cmp.Compare(x.Limit, r.Limit) <= 0)
+}
+
+// Intersect returns the range of the keys held by both the range and the
+// given one, under the given comparer. The returned range refers to the
+// bounds of the ranges, and is nil if both are nil. If the ranges don't
+// intersect the returned range is empty, with its limit set to its start.
+func (r *Range) Intersect(cmp comparer.BasicComparer, x *Range) *Range {
+	if r == nil && x == nil {
+		return nil
+	}
+	var res Range
+	for _, y := range [...]*Range{r, x} {
+		if y == nil {
+			continue
+		}
+		if y.Start != nil && (res.Start == nil || cmp.Compare(y.Start, res.Start) > 0) {
+			res.Start = y.Start
+		}
+		if y.Limit != nil && (res.Limit == nil || cmp.Compare(y.Limit, res.Limit) < 0) {
+			res.Limit = y.Limit
+		}
+	}
+	if res.Start != nil && res.Limit != nil && cmp.Compare(res.Start, res.Limit) > 0 {
+		res.Limit = res.Start
+	}
+	return &res
+}
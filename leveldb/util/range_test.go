@@ -0,0 +1,114 @@
+// Copyright (c) 2016, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/FactomProject/goleveldb/leveldb/comparer"
+)
+
+func TestBytesPrefix(t *testing.T) {
+	for _, x := range []struct {
+		prefix, limit string
+	}{
+		{"", ""},
+		{"a", "b"},
+		{"ab", "ac"},
+		{"a\xff", "b"},
+		{"a\xfe\xff\xff", "a\xff"},
+		{"\xff\xff", ""},
+	} {
+		r := BytesPrefix([]byte(x.prefix))
+		if string(r.Start) != x.prefix || string(r.Limit) != x.limit || (x.limit == "") != (r.Limit == nil) {
+			t.Errorf("BytesPrefix(%q): got %q, %q, want limit %q", x.prefix, r.Start, r.Limit, x.limit)
+		}
+		for _, key := range []string{x.prefix, x.prefix + "\x00", x.prefix + "\xff\xff"} {
+			if !r.Contains(comparer.DefaultComparer, []byte(key)) {
+				t.Errorf("BytesPrefix(%q): doesn't contain %q", x.prefix, key)
+			}
+		}
+	}
+}
+
+func TestRange(t *testing.T) {
+	cmp := comparer.DefaultComparer
+	rng := func(start, limit string) *Range {
+		r := &Range{}
+		if start != "-" {
+			r.Start = []byte(start)
+		}
+		if limit != "-" {
+			r.Limit = []byte(limit)
+		}
+		return r
+	}
+	str := func(r *Range) string {
+		if r == nil {
+			return "nil"
+		}
+		var b bytes.Buffer
+		for _, x := range [][]byte{r.Start, r.Limit} {
+			if x == nil {
+				b.WriteString("[-]")
+			} else {
+				b.WriteString("[" + string(x) + "]")
+			}
+		}
+		return b.String()
+	}
+
+	for _, x := range []struct {
+		r     *Range
+		empty bool
+		keys  string // Keys of a-e held by the range.
+	}{
+		{nil, false, "abcde"},
+		{rng("-", "-"), false, "abcde"},
+		{rng("b", "-"), false, "bcde"},
+		{rng("-", "c"), false, "ab"},
+		{rng("b", "d"), false, "bc"},
+		{rng("c", "c"), true, ""},
+		{rng("d", "b"), true, ""},
+		{rng("-", ""), true, ""},
+	} {
+		if e := x.r.Empty(cmp); e != x.empty {
+			t.Errorf("%s.Empty: got %v", str(x.r), e)
+		}
+		for _, c := range "abcde" {
+			key := []byte(string(c))
+			if want := bytes.Contains([]byte(x.keys), key); x.r.Contains(cmp, key) != want {
+				t.Errorf("%s.Contains(%q): got %v", str(x.r), key, !want)
+			}
+		}
+	}
+
+	for _, x := range []struct {
+		r, x      *Range
+		intersect string
+		contains  bool
+	}{
+		{nil, nil, "nil", true},
+		{nil, rng("b", "d"), "[b][d]", true},
+		{rng("b", "d"), nil, "[b][d]", false},
+		{rng("-", "-"), rng("b", "d"), "[b][d]", true},
+		{rng("a", "e"), rng("b", "d"), "[b][d]", true},
+		{rng("a", "c"), rng("b", "d"), "[b][c]", false},
+		{rng("b", "-"), rng("-", "d"), "[b][d]", false},
+		{rng("a", "b"), rng("c", "d"), "[c][c]", false},
+		{rng("a", "b"), rng("c", "c"), "[c][c]", true},
+		{rng("b", "d"), rng("a", "e"), "[b][d]", false},
+	} {
+		if got := str(x.r.Intersect(cmp, x.x)); got != x.intersect {
+			t.Errorf("%s.Intersect(%s): got %s, want %s", str(x.r), str(x.x), got, x.intersect)
+		}
+		if got := x.r.ContainsRange(cmp, x.x); got != x.contains {
+			t.Errorf("%s.ContainsRange(%s): got %v, want %v", str(x.r), str(x.x), got, x.contains)
+		}
+	}
+}
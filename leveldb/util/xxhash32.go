@@ -0,0 +1,66 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"encoding/binary"
+)
+
+const (
+	xx32Prime1 uint32 = 2654435761
+	xx32Prime2 uint32 = 2246822519
+	xx32Prime3 uint32 = 3266489917
+	xx32Prime4 uint32 = 668265263
+	xx32Prime5 uint32 = 374761393
+)
+
+func xx32Rotl(x uint32, r uint) uint32 {
+	return x<<r | x>>(32-r)
+}
+
+func xx32Round(acc, input uint32) uint32 {
+	acc += input * xx32Prime2
+	return xx32Rotl(acc, 13) * xx32Prime1
+}
+
+// XXHash32 returns the 32-bit xxHash of the given bytes, with a zero seed.
+func XXHash32(b []byte) uint32 {
+	n := len(b)
+	var h uint32
+	if n >= 16 {
+		p1 := xx32Prime1
+		v1, v2, v3, v4 := p1+xx32Prime2, xx32Prime2, uint32(0), -p1
+		for len(b) >= 16 {
+			v1 = xx32Round(v1, binary.LittleEndian.Uint32(b[0:4]))
+			v2 = xx32Round(v2, binary.LittleEndian.Uint32(b[4:8]))
+			v3 = xx32Round(v3, binary.LittleEndian.Uint32(b[8:12]))
+			v4 = xx32Round(v4, binary.LittleEndian.Uint32(b[12:16]))
+			b = b[16:]
+		}
+		h = xx32Rotl(v1, 1) + xx32Rotl(v2, 7) + xx32Rotl(v3, 12) + xx32Rotl(v4, 18)
+	} else {
+		h = xx32Prime5
+	}
+	h += uint32(n)
+
+	for len(b) >= 4 {
+		h += binary.LittleEndian.Uint32(b[:4]) * xx32Prime3
+		h = xx32Rotl(h, 17) * xx32Prime4
+		b = b[4:]
+	}
+	for _, c := range b {
+		h += uint32(c) * xx32Prime5
+		h = xx32Rotl(h, 11) * xx32Prime1
+	}
+
+	h ^= h >> 15
+	h *= xx32Prime2
+	h ^= h >> 13
+	h *= xx32Prime3
+	h ^= h >> 16
+	return h
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestXXHash32(t *testing.T) {
+	tests := []struct {
+		data string
+		hash uint32
+	}{
+		{"", 0x02cc5d05},
+		{"a", 0x550d7456},
+		{"abc", 0x32d153ff},
+		{"Nobody inspects the spammish repetition", 0xe2293b2f},
+	}
+	for _, x := range tests {
+		if h := XXHash32([]byte(x.data)); h != x.hash {
+			t.Errorf("XXHash32(%q): got %#x, want %#x", x.data, h, x.hash)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestXXHash64(t *testing.T) {
+	tests := []struct {
+		data string
+		hash uint64
+	}{
+		{"", 0xef46db3751d8e999},
+		{"a", 0xd24ec4f1a98c6e5b},
+		{"abc", 0x44bc2cf5ad770999},
+		{"Nobody inspects the spammish repetition", 0xfbcea83c8a378bf1},
+	}
+	for _, x := range tests {
+		if h := XXHash64([]byte(x.data)); h != x.hash {
+			t.Errorf("XXHash64(%q): got %#x, want %#x", x.data, h, x.hash)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2012, Suryandaru Triandana <syndtr@gmail.com>
+// All rights reserved.
+//
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package leveldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/FactomProject/goleveldb/leveldb/cache"
+	"github.com/FactomProject/goleveldb/leveldb/errors"
+	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
+	"github.com/FactomProject/goleveldb/leveldb/util"
+)
+
+// Value log.
+//
+// When value log is enabled, values whose length is at least the value log
+// threshold are written to a value log file accompanying the table being
+// built, and the table holds a value pointer instead. The value log file
+// shares file number with the table that created it, but may outlive that
+// table as value pointers are copied by compactions. A value log file is
+// removed once no table in any live version references it.
+//
+// Each value log record is the value followed by 4-bytes little-endian
+// checksum of the value.
+
+const vlogRecordTrailerLen = 4
+
+// ErrValuePtrCorrupted records value pointer corruption.
+type ErrValuePtrCorrupted struct {
+	Ptr    []byte
+	Reason string
+}
+
+func (e *ErrValuePtrCorrupted) Error() string {
+	return fmt.Sprintf("leveldb: value pointer %q corrupted: %s", e.Ptr, e.Reason)
+}
+
+func newErrValuePtrCorrupted(ptr []byte, reason string) error {
+	return &errors.ErrCorrupted{Reason: reason, Err: &ErrValuePtrCorrupted{append([]byte{}, ptr...), reason}}
+}
+
+// valuePtr points to a value log record.
+type valuePtr struct {
+	num    int64
+	offset int64
+	length int64
+}
+
+func (p valuePtr) size() int64 {
+	return p.length + vlogRecordTrailerLen
+}
+
+func (p valuePtr) encode(dst []byte) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	for _, x := range []int64{p.num, p.offset, p.length} {
+		n := binary.PutUvarint(buf[:], uint64(x))
+		dst = append(dst, buf[:n]...)
+	}
+	return dst
+}
+
+func decodeValuePtr(b []byte) (p valuePtr, err error) {
+	var x [3]int64
+	buf := b
+	for i := range x {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 || int64(v) < 0 {
+			return p, newErrValuePtrCorrupted(b, "invalid varint")
+		}
+		x[i] = int64(v)
+		buf = buf[n:]
+	}
+	if len(buf) != 0 {
+		return p, newErrValuePtrCorrupted(b, "trailing garbage")
+	}
+	return valuePtr{x[0], x[1], x[2]}, nil
+}
+
+type int64Slice []int64
+
+func (p int64Slice) Len() int           { return len(p) }
+func (p int64Slice) Less(i, j int) bool { return p[i] < p[j] }
+func (p int64Slice) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// vlogReader wraps storage.Reader so it can be cached.
+type vlogReader struct {
+	storage.Reader
+	size int64
+}
+
+func (r *vlogReader) Release() {
+	r.Close()
+}
+
+// vlogStat holds value log statistics used to decide whether a value
+// log file should be collected. The discarded bytes are committed to the
+// manifest along with the compaction that discards them, see
+// recValueLogDiscard, so they survive reopening the DB.
+type vlogStat struct {
+	size    int64
+	discard int64
+	collect bool
+}
+
+// Returns statistics of the given value log, creating one if not exist.
+// Must be called with vmu held.
+func (t *tOps) vlogStatNB(num int64) *vlogStat {
+	st := t.vstats[num]
+	if st == nil {
+		st = &vlogStat{}
+		t.vstats[num] = st
+	}
+	return st
+}
+
+// Records size of the newly written value log.
+func (t *tOps) vlogWritten(num, size int64) {
+	t.vmu.Lock()
+	t.vlogStatNB(num).size = size
+	t.vmu.Unlock()
+}
+
+// Returns the bytes of the given value log discarded by compactions.
+func (t *tOps) vlogDiscarded(num int64) int64 {
+	t.vmu.Lock()
+	defer t.vmu.Unlock()
+	if st := t.vstats[num]; st != nil {
+		return st.discard
+	}
+	return 0
+}
+
+// Appends the discarded bytes of the value logs to the given record,
+// except for value logs the record already holds.
+func (t *tOps) fillVlogDiscards(r *sessionRecord) {
+	t.vmu.Lock()
+	nums := make([]int64, 0, len(t.vstats))
+	for num, st := range t.vstats {
+		if st.discard > 0 && !r.hasValueLogDiscard(num) {
+			nums = append(nums, num)
+		}
+	}
+	sort.Sort(int64Slice(nums))
+	for _, num := range nums {
+		r.addValueLogDiscard(num, t.vstats[num].discard)
+	}
+	t.vmu.Unlock()
+}
+
+// Sets the bytes of the given value log discarded by compactions, as
+// committed to the manifest, and marks the value log for collection once
+// the discarded ratio reaches the threshold.
+func (t *tOps) vlogDiscard(num, discard int64) {
+	t.vmu.Lock()
+	st := t.vlogStatNB(num)
+	st.discard = discard
+	size := st.size
+	t.vmu.Unlock()
+
+	if size == 0 {
+		// Value log written by previous session, get the size from the
+		// file itself.
+		ch, err := t.openVlog(num)
+		if err != nil {
+			return
+		}
+		size = ch.Value().(*vlogReader).size
+		ch.Release()
+	}
+
+	t.vmu.Lock()
+	st.size = size
+	if !st.collect && float64(st.discard) >= t.vlogGCRatio*float64(st.size) {
+		st.collect = true
+		t.s.log(opt.LogDebug, "vlog@gc marked", "file", storage.FileDesc{Type: storage.TypeValueLog, Num: num}, "discard", st.discard, "size", st.size)
+	}
+	t.vmu.Unlock()
+}
+
+// Returns true if the given value log is marked for collection.
+func (t *tOps) vlogCollecting(num int64) bool {
+	t.vmu.Lock()
+	defer t.vmu.Unlock()
+	st := t.vstats[num]
+	return st != nil && st.collect
+}
+
+// Returns true if any of the given value logs is marked for collection.
+func (t *tOps) vlogsCollecting(nums []int64) bool {
+	if len(nums) == 0 {
+		return false
+	}
+	t.vmu.Lock()
+	defer t.vmu.Unlock()
+	for _, num := range nums {
+		if st := t.vstats[num]; st != nil && st.collect {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes value log written along with an uncommitted table, if any.
+func removeTableVlog(stor storage.Storage, num int64, vlogs []int64) {
+	for _, vnum := range vlogs {
+		if vnum == num {
+			stor.Remove(storage.FileDesc{Type: storage.TypeValueLog, Num: vnum})
+			break
+		}
+	}
+}
+
+// Opens value log. It returns a cache handle, which should
+// be released after use.
+func (t *tOps) openVlog(num int64) (ch *cache.Handle, err error) {
+	ch = t.cache.Get(1, uint64(num), func() (size int, value cache.Value) {
+		var r storage.Reader
+		r, err = t.s.stor.Open(storage.FileDesc{Type: storage.TypeValueLog, Num: num})
+		if err != nil {
+			return 0, nil
+		}
+		var n int64
+		n, err = r.Seek(0, io.SeekEnd)
+		if err != nil {
+			r.Close()
+			return 0, nil
+		}
+		return 1, &vlogReader{r, n}
+	})
+	if ch == nil && err == nil {
+		err = ErrClosed
+	}
+	return
+}
+
+// Reads value pointed by the given value pointer, and appends it to dst.
+// The pointer may be a slice of dst, it is decoded before appending.
+func (t *tOps) readValue(ptr, dst []byte) ([]byte, error) {
+	p, err := decodeValuePtr(ptr)
+	if err != nil {
+		return nil, err
+	}
+	return t.readValuePtr(p, dst)
+}
+
+// Reads value pointed by the given value pointer into a buffer of the pool.
+func (t *tOps) readValuePooled(ptr []byte) ([]byte, error) {
+	p, err := decodeValuePtr(ptr)
+	if err != nil {
+		return nil, err
+	}
+	return t.readValuePtr(p, t.bpool.Get(int(p.size()))[:0])
+}
+
+func (t *tOps) readValuePtr(p valuePtr, dst []byte) ([]byte, error) {
+	ch, err := t.openVlog(p.num)
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Release()
+	r := ch.Value().(*vlogReader)
+	fd := storage.FileDesc{Type: storage.TypeValueLog, Num: p.num}
+	if p.offset+p.size() > r.size {
+		return nil, errors.NewErrCorruptedAt(fd, p.offset, p.size(), "value pointer out of range", errors.New("leveldb: value pointer out of range"))
+	}
+	n := len(dst)
+	buf := append(dst, make([]byte, p.size())...)
+	if _, err := r.ReadAt(buf[n:], p.offset); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errors.NewErrCorruptedAt(fd, p.offset, p.size(), "value log record truncated", errors.New("leveldb: value log record truncated"))
+		}
+		return nil, err
+	}
+	m := n + int(p.length)
+	if util.NewCRC(buf[n:m]).Value() != binary.LittleEndian.Uint32(buf[m:]) {
+		return nil, errors.NewErrCorruptedAt(fd, p.offset, p.size(), "checksum mismatch", errors.New("leveldb: value log record checksum mismatch"))
+	}
+	return buf[:m], nil
+}
+
+// Removes value log from persistent storage. It waits until
+// no one use the the value log.
+func (t *tOps) removeVlog(num int64) {
+	t.vmu.Lock()
+	delete(t.vstats, num)
+	t.vmu.Unlock()
+	t.cache.Delete(1, uint64(num), func() {
+		fd := storage.FileDesc{Type: storage.TypeValueLog, Num: num}
+		if err := t.s.stor.Remove(fd); err != nil {
+			t.s.log(opt.LogWarn, "vlog@remove failed", "file", fd, "err", err)
+		} else {
+			t.s.log(opt.LogDebug, "vlog@remove removed", "file", fd)
+		}
+	})
+}
@@ -7,12 +7,15 @@
 package leveldb
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync/atomic"
 	"unsafe"
 
 	"github.com/FactomProject/goleveldb/leveldb/iterator"
 	"github.com/FactomProject/goleveldb/leveldb/opt"
+	"github.com/FactomProject/goleveldb/leveldb/storage"
 	"github.com/FactomProject/goleveldb/leveldb/util"
 )
 
@@ -26,6 +29,10 @@ type version struct {
 
 	levels []tFiles
 
+	// Range tombstones of all tables, and their index.
+	rdels   rangeDels
+	rdelIdx rangeDelIndex
+
 	// Level that should be compacted next and its compaction score.
 	// Score < 1 means compaction is not strictly needed. These fields
 	// are initialized by computeCompaction()
@@ -34,6 +41,10 @@ type version struct {
 
 	cSeek unsafe.Pointer
 
+	// Table that should be compacted for its garbage ratio, see
+	// opt.CompactionPriorityGarbage. Initialized by computeCompaction().
+	cGarbage *tSet
+
 	closing  bool
 	ref      int
 	released bool
@@ -53,7 +64,11 @@ func (v *version) incref() {
 		// Incr file ref.
 		for _, tt := range v.levels {
 			for _, t := range tt {
-				v.s.addFileRef(t.fd, 1)
+				if v.s.addFileRef(t.fd, 1) == 1 {
+					for _, vnum := range t.vlogs {
+						v.s.addFileRef(storage.FileDesc{Type: storage.TypeValueLog, Num: vnum}, 1)
+					}
+				}
 			}
 		}
 	}
@@ -70,6 +85,11 @@ func (v *version) releaseNB() {
 	for _, tt := range v.levels {
 		for _, t := range tt {
 			if v.s.addFileRef(t.fd, -1) == 0 {
+				for _, vnum := range t.vlogs {
+					if v.s.addFileRef(storage.FileDesc{Type: storage.TypeValueLog, Num: vnum}, -1) == 0 {
+						v.s.tops.removeVlog(vnum)
+					}
+				}
 				v.s.tops.remove(t)
 			}
 		}
@@ -135,12 +155,40 @@ func (v *version) walkOverlapping(aux tFiles, ikey internalKey, f func(level int
 	}
 }
 
-func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue bool) (value []byte, tcomp bool, err error) {
+// Finds the first entry of the table at or after the given internal key,
+// looking past the range tombstones keyed by the looked up user key, as
+// they don't delete their start key.
+func (v *version) find(t *tFile, ikey internalKey, dst []byte, ro *opt.ReadOptions, noValue bool) (rkey, rvalue []byte, err error) {
+	ukey := ikey.ukey()
+	for {
+		if noValue {
+			rkey, err = v.s.tops.findKey(t, ikey, ro)
+		} else {
+			rkey, rvalue, err = v.s.tops.find(t, ikey, dst, ro)
+		}
+		if err != nil {
+			return
+		}
+		rukey, rseq, rkt, kerr := parseInternalKey(rkey)
+		if kerr != nil || rkt != keyTypeRangeDel || v.s.icmp.uCompare(rukey, ukey) != 0 {
+			return
+		}
+		if rseq == 0 {
+			return nil, nil, ErrNotFound
+		}
+		ikey = makeInternalKey(nil, ukey, rseq-1, keyTypeSeek)
+	}
+}
+
+// Gets the value of the given key, the value is appended to dst. If dst is
+// nil the value is copied into a buffer of the pool, see tOps.valueDst.
+func (v *version) get(ctx context.Context, aux tFiles, ikey internalKey, dst []byte, ro *opt.ReadOptions, noValue bool, rdels rangeDelSet) (value []byte, meta EntryMeta, tcomp bool, err error) {
 	if v.closing {
-		return nil, false, ErrClosed
+		return nil, meta, false, ErrClosed
 	}
 
 	ukey := ikey.ukey()
+	iseq, _ := ikey.parseNum()
 
 	var (
 		tset  *tSet
@@ -151,6 +199,10 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 		zseq   uint64
 		zkt    keyType
 		zval   []byte
+		zdst   bool
+
+		vkt  keyType
+		vdst bool
 	)
 
 	err = ErrNotFound
@@ -158,6 +210,12 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 	// Since entries never hop across level, finding key/value
 	// in smaller level make later levels irrelevant.
 	v.walkOverlapping(aux, ikey, func(level int, t *tFile) bool {
+		// The table filter is kept in memory, the table doesn't need
+		// to be opened to rule out the key.
+		if !t.mayContain(ikey) {
+			return true
+		}
+
 		if level >= 0 && !tseek {
 			if tset == nil {
 				tset = &tSet{level, t}
@@ -169,12 +227,20 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 		var (
 			fikey, fval []byte
 			ferr        error
+
+			// Whether the value is appended to dst. A value found in
+			// level-0 may be kept, the next ones mustn't overwrite it.
+			fdst = !zfound
+
+			tinfo = opt.TraceInfo{Op: opt.TraceTableGet, KeySize: len(ukey), Level: level, TableNum: t.fd.Num}
+			tctx  = v.s.traceStart(ctx, tinfo)
 		)
-		if noValue {
-			fikey, ferr = v.s.tops.findKey(t, ikey, ro)
+		if fdst {
+			fikey, fval, ferr = v.find(t, ikey, dst, ro, noValue)
 		} else {
-			fikey, fval, ferr = v.s.tops.find(t, ikey, ro)
+			fikey, fval, ferr = v.find(t, ikey, nil, ro, noValue)
 		}
+		v.s.traceEnd(tctx, tinfo, ferr)
 
 		switch ferr {
 		case nil:
@@ -194,15 +260,14 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 						zseq = fseq
 						zkt = fkt
 						zval = fval
+						zdst = fdst
 					}
 				} else {
-					switch fkt {
-					case keyTypeVal:
+					if meta = entryMeta(v.s.icmp, rdels, ukey, fseq, fkt, iseq); meta.Type.isValue() {
 						value = fval
+						vkt = fkt
+						vdst = fdst
 						err = nil
-					case keyTypeDel:
-					default:
-						panic("leveldb: invalid internalKey type")
 					}
 					return false
 				}
@@ -215,13 +280,11 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 		return true
 	}, func(level int) bool {
 		if zfound {
-			switch zkt {
-			case keyTypeVal:
+			if meta = entryMeta(v.s.icmp, rdels, ukey, zseq, zkt, iseq); meta.Type.isValue() {
 				value = zval
+				vkt = zkt
+				vdst = zdst
 				err = nil
-			case keyTypeDel:
-			default:
-				panic("leveldb: invalid internalKey type")
 			}
 			return false
 		}
@@ -229,6 +292,26 @@ func (v *version) get(aux tFiles, ikey internalKey, ro *opt.ReadOptions, noValue
 		return true
 	})
 
+	if err == nil && !noValue {
+		switch {
+		case vkt == keyTypeValPtr:
+			// Value resides in the value log, which isn't cached.
+			if vdst {
+				value = value[len(dst):]
+			}
+			switch {
+			case ro.GetCacheOnly():
+				value, err = nil, ErrCacheMiss
+			case dst == nil:
+				value, err = v.s.tops.readValuePooled(value)
+			default:
+				value, err = v.s.tops.readValue(value, dst)
+			}
+		case !vdst && dst != nil:
+			value = append(dst, value...)
+		}
+	}
+
 	if tseek && tset.table.consumeSeek() <= 0 {
 		tcomp = atomic.CompareAndSwapPointer(&v.cSeek, nil, unsafe.Pointer(tset))
 	}
@@ -253,16 +336,21 @@ func (v *version) sampleSeek(ikey internalKey) (tcomp bool) {
 	return
 }
 
-func (v *version) getIterators(slice *util.Range, ro *opt.ReadOptions) (its []iterator.Iterator) {
+func (v *version) getIterators(slice *util.Range, ro *opt.ReadOptions, smp *sampler) (its []iterator.Iterator) {
 	strict := opt.GetStrict(v.s.o.Options, ro, opt.StrictReader)
 	for level, tables := range v.levels {
 		if level == 0 {
 			// Merge all level zero files together since they may overlap.
 			for _, t := range tables {
-				its = append(its, v.s.tops.newIterator(t, slice, ro))
+				its = append(its, v.s.tops.newSampleIterator(t, slice, ro, smp))
 			}
 		} else if len(tables) != 0 {
-			its = append(its, iterator.NewIndexedIterator(tables.newIndexIterator(v.s.tops, v.s.icmp, slice, ro), strict))
+			index := tables.newIndexIterator(v.s.tops, v.s.icmp, slice, ro, smp)
+			if ro.GetPinData() {
+				its = append(its, iterator.NewPinningIndexedIterator(index, strict))
+			} else {
+				its = append(its, iterator.NewIndexedIterator(index, strict))
+			}
 		}
 	}
 	return
@@ -294,10 +382,12 @@ func (v *version) tLen(level int) int {
 	return 0
 }
 
+// Returns approximate offset of the given key within the tables, a nil key
+// is after all keys.
 func (v *version) offsetOf(ikey internalKey) (n int64, err error) {
 	for level, tables := range v.levels {
 		for _, t := range tables {
-			if v.s.icmp.Compare(t.imax, ikey) <= 0 {
+			if ikey == nil || v.s.icmp.Compare(t.imax, ikey) <= 0 {
 				// Entire file is before "ikey", so just add the file size
 				n += t.size
 			} else if v.s.icmp.Compare(t.imin, ikey) > 0 {
@@ -323,7 +413,84 @@ func (v *version) offsetOf(ikey internalKey) (n int64, err error) {
 	return
 }
 
+// Returns approximate size and number of entries of the tables within
+// [imin, imax), a nil imax is after all keys. Number of entries of a table
+// partially within the range is proportional to the size within the range.
+func (v *version) sizeOf(imin, imax internalKey) (size, entries int64, err error) {
+	for level, tables := range v.levels {
+		for _, t := range tables {
+			if v.s.icmp.Compare(t.imax, imin) < 0 {
+				continue
+			}
+			if imax != nil && v.s.icmp.Compare(t.imin, imax) >= 0 {
+				if level > 0 {
+					break
+				}
+				continue
+			}
+			var start, limit int64
+			if v.s.icmp.Compare(t.imin, imin) < 0 {
+				if start, err = v.s.tops.offsetOf(t, imin); err != nil {
+					return
+				}
+			}
+			if imax == nil || v.s.icmp.Compare(t.imax, imax) < 0 {
+				limit = t.size
+			} else if limit, err = v.s.tops.offsetOf(t, imax); err != nil {
+				return
+			}
+			if limit <= start {
+				continue
+			}
+			size += limit - start
+			var (
+				n  int64
+				ok bool
+			)
+			if n, ok, err = v.s.tops.numEntries(t); err != nil {
+				return
+			}
+			if ok && t.size > 0 {
+				entries += n * (limit - start) / t.size
+			}
+		}
+	}
+	return
+}
+
+// Returns number of entries of the tables. Number of entries of tables
+// that don't record it is estimated from the average entry size of the
+// others.
+func (v *version) numEntries() (n int64, err error) {
+	var unknownSize, knownSize int64
+	for _, tables := range v.levels {
+		for _, t := range tables {
+			m, ok, err := v.s.tops.numEntries(t)
+			if err != nil {
+				return 0, err
+			}
+			if ok {
+				n += m
+				knownSize += t.size
+			} else {
+				unknownSize += t.size
+			}
+		}
+	}
+	if unknownSize > 0 && n > 0 {
+		n += unknownSize * n / knownSize
+	}
+	return
+}
+
 func (v *version) pickMemdbLevel(umin, umax []byte, maxLevel int) (level int) {
+	if v.s.o.GetFIFOCompactionTotalSize() > 0 {
+		// FIFO compaction keeps all tables at level-0.
+		return 0
+	}
+	if n := v.s.o.GetNumLevel(); n > 0 && maxLevel > n-1 {
+		maxLevel = n - 1
+	}
 	if maxLevel > 0 {
 		if len(v.levels) == 0 {
 			return maxLevel
@@ -348,6 +515,31 @@ func (v *version) pickMemdbLevel(umin, umax []byte, maxLevel int) (level int) {
 	return
 }
 
+// Picks the deepest level the ingested table of the given range can be
+// placed at, that is above the first level it overlaps with.
+func (v *version) pickIngestLevel(umin, umax []byte) (level int) {
+	if v.s.o.GetFIFOCompactionTotalSize() > 0 {
+		// FIFO compaction keeps all tables at level-0.
+		return 0
+	}
+	if len(v.levels) > 0 && v.levels[0].overlaps(v.s.icmp, umin, umax, true) {
+		return 0
+	}
+	bottom := v.s.o.GetNumLevel() - 1
+	if bottom < 0 {
+		bottom = len(v.levels) - 1
+		if bottom < ingestMaxLevel {
+			bottom = ingestMaxLevel
+		}
+	}
+	for ; level < bottom; level++ {
+		if pLevel := level + 1; pLevel < len(v.levels) && v.levels[pLevel].overlaps(v.s.icmp, umin, umax, false) {
+			break
+		}
+	}
+	return
+}
+
 func (v *version) computeCompaction() {
 	// Precomputed best level for next compaction
 	bestLevel := int(-1)
@@ -377,6 +569,9 @@ func (v *version) computeCompaction() {
 		} else {
 			score = float64(size) / float64(v.s.o.GetCompactionTotalSize(level))
 		}
+		if v.s.isLastLevel(level) {
+			score = 0
+		}
 
 		if score > bestScore {
 			bestLevel = level
@@ -392,11 +587,146 @@ func (v *version) computeCompaction() {
 	v.cLevel = bestLevel
 	v.cScore = bestScore
 
-	v.s.logf("version@stat F·%v S·%s%v Sc·%v", statFiles, shortenb(int(statTotSize)), statSizes, statScore)
+	if v.s.o.GetCompactionPriority() == opt.CompactionPriorityGarbage {
+		// Compacting the deepest level won't move the garbage further,
+		// the remaining are kept for the snapshots.
+		bestRatio := v.s.o.GetCompactionGarbageRatio()
+		for level := 0; level < len(v.levels)-1 && !v.s.isLastLevel(level); level++ {
+			for _, t := range v.levels[level] {
+				if ratio := t.garbageRatio(); ratio >= bestRatio {
+					v.cGarbage = &tSet{level, t}
+					bestRatio = ratio
+				}
+			}
+		}
+	}
+
+	v.s.log(opt.LogDebug, "version@stat", "files", statFiles, "size", statTotSize, "sizes", statSizes, "scores", statScore)
 }
 
 func (v *version) needCompaction() bool {
-	return v.cScore >= 1 || atomic.LoadPointer(&v.cSeek) != nil
+	if limit := v.s.o.GetFIFOCompactionTotalSize(); limit > 0 {
+		return v.size() > limit
+	}
+	return v.cScore >= 1 || atomic.LoadPointer(&v.cSeek) != nil || v.cGarbage != nil
+}
+
+// Returns the size and number of the tables pending compaction, that is
+// the level-0 tables once they reach the compaction trigger and the tables
+// exceeding the total size limit of the other levels.
+func (v *version) compactionDebt() (size int64, n int) {
+	for level, tables := range v.levels {
+		if v.s.isLastLevel(level) {
+			break
+		}
+		if level == 0 {
+			if len(tables) >= v.s.o.GetCompactionL0Trigger() {
+				size += tables.size()
+				n += len(tables)
+			}
+			continue
+		}
+		excess := tables.size() - v.s.o.GetCompactionTotalSize(level)
+		for _, t := range tables {
+			if excess <= 0 {
+				break
+			}
+			size += t.size
+			excess -= t.size
+			n++
+		}
+	}
+	return
+}
+
+// Returns the deepest level holding tables, -1 if there is none.
+func (v *version) bottomLevel() int {
+	for level := len(v.levels) - 1; level >= 0; level-- {
+		if len(v.levels[level]) > 0 {
+			return level
+		}
+	}
+	return -1
+}
+
+// Returns total size of the tables.
+func (v *version) size() (n int64) {
+	for _, tables := range v.levels {
+		n += tables.size()
+	}
+	return
+}
+
+// Returns the estimated number of bytes table compaction has yet to
+// compact to bring each level within its limit.
+func (v *version) pendingCompactionBytes() (n int64) {
+	if limit := v.s.o.GetFIFOCompactionTotalSize(); limit > 0 {
+		if size := v.size(); size > limit {
+			n = size - limit
+		}
+		return
+	}
+	for level, tables := range v.levels {
+		if v.s.isLastLevel(level) {
+			continue
+		}
+		if level == 0 {
+			if len(tables) >= v.s.o.GetCompactionL0Trigger() {
+				n += tables.size()
+			}
+		} else if size, limit := tables.size(), v.s.o.GetCompactionTotalSize(level); size > limit {
+			n += size - limit
+		}
+	}
+	return
+}
+
+type fifoTable struct {
+	level int
+	t     *tFile
+}
+
+type fifoTables []fifoTable
+
+func (p fifoTables) Len() int           { return len(p) }
+func (p fifoTables) Less(i, j int) bool { return p[i].t.fd.Num < p[j].t.fd.Num }
+func (p fifoTables) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// Returns the oldest tables to drop for total size of the tables to be
+// within the given limit, see opt.Options.FIFOCompactionTotalSize.
+func (v *version) pickFIFO(limit int64) (drop fifoTables) {
+	var tables fifoTables
+	for level, tt := range v.levels {
+		for _, t := range tt {
+			tables = append(tables, fifoTable{level, t})
+		}
+	}
+	sort.Sort(tables)
+	size := v.size()
+	for _, ft := range tables {
+		if size <= limit {
+			break
+		}
+		drop = append(drop, ft)
+		size -= ft.t.size
+	}
+	return
+}
+
+// Returns a table referencing value log being collected. Level-0 tables
+// are never picked since rewriting them would break their ordering.
+func (v *version) pickVlogGC() (level int, t *tFile) {
+	for level, tables := range v.levels {
+		if level == 0 {
+			continue
+		}
+		for _, t := range tables {
+			if v.s.tops.vlogsCollecting(t.vlogs) {
+				return level, t
+			}
+		}
+	}
+	return -1, nil
 }
 
 type tablesScratch struct {
@@ -506,6 +836,14 @@ func (p *versionStaging) finish() *version {
 	}
 	nv.levels = nv.levels[:n]
 
+	// Gather range tombstones.
+	for _, tables := range nv.levels {
+		for _, t := range tables {
+			nv.rdels = append(nv.rdels, t.rdels...)
+		}
+	}
+	nv.rdelIdx = newRangeDelIndex(nv.s.icmp, nv.rdels)
+
 	// Compute compaction score for new version.
 	nv.computeCompaction()
 